@@ -0,0 +1,153 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jsonata
+
+import (
+	"container/list"
+	"sync"
+)
+
+// A Cache is a fixed-size, least recently used cache of
+// compiled expressions, keyed by expression text. It is safe
+// for concurrent use, so a single Cache can be shared by all
+// of the goroutines in a server.
+//
+// By default, expressions that fail to compile are cached
+// along with their errors, so that repeated requests with the
+// same invalid expression are not parsed again. Use
+// SetCacheErrors to change this.
+type Cache struct {
+	mu          sync.Mutex
+	size        int
+	items       map[string]*list.Element
+	order       *list.List // most recently used first
+	cacheErrors bool
+	hits        uint64
+	misses      uint64
+}
+
+type cacheEntry struct {
+	expression string
+	expr       *Expr
+	err        error
+}
+
+// NewCache returns a Cache that holds up to maxEntries compiled
+// expressions. If maxEntries is zero or less, nothing is cached
+// and every call to Get compiles its expression.
+func NewCache(maxEntries int) *Cache {
+	return &Cache{
+		size:        maxEntries,
+		items:       make(map[string]*list.Element),
+		order:       list.New(),
+		cacheErrors: true,
+	}
+}
+
+// Get returns the compiled form of the given expression,
+// compiling it with Compile if it is not in the cache. The
+// returned Expr is a clone of the cached Expr (see Expr.Clone),
+// which the caller is free to modify, e.g. with RegisterVars.
+func (c *Cache) Get(expression string) (*Expr, error) {
+
+	if entry := c.get(expression); entry != nil {
+		if entry.err != nil {
+			return nil, entry.err
+		}
+		return entry.expr.Clone(), nil
+	}
+
+	// Compile outside the lock. If two goroutines compile the
+	// same expression at once, the second result wins. Both
+	// are equivalent.
+	expr, err := Compile(expression)
+	c.put(expression, expr, err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return expr.Clone(), nil
+}
+
+// SetCacheErrors sets whether the Cache holds on to the errors
+// from expressions that fail to compile. If cache is false, Get
+// compiles invalid expressions every time they are requested.
+// Changing the setting does not affect errors that are already
+// cached.
+func (c *Cache) SetCacheErrors(cache bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cacheErrors = cache
+}
+
+// Len returns the number of expressions in the cache,
+// including those that failed to compile.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// HitRate returns the proportion of calls to Get that found
+// the expression in the cache, from 0 to 1. It returns 0 if
+// Get has not been called.
+func (c *Cache) HitRate() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	total := c.hits + c.misses
+	if total == 0 {
+		return 0
+	}
+
+	return float64(c.hits) / float64(total)
+}
+
+func (c *Cache) get(expression string) *cacheEntry {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[expression]
+	if !ok {
+		c.misses++
+		return nil
+	}
+
+	c.hits++
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry)
+}
+
+func (c *Cache) put(expression string, expr *Expr, err error) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.size <= 0 || (err != nil && !c.cacheErrors) {
+		return
+	}
+
+	entry := &cacheEntry{
+		expression: expression,
+		expr:       expr,
+		err:        err,
+	}
+
+	if elem, ok := c.items[expression]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.items[expression] = c.order.PushFront(entry)
+
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).expression)
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jsonata
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/blues/jsonata-go/jparse"
+)
+
+func TestCache(t *testing.T) {
+
+	c := NewCache(2)
+
+	if rate := c.HitRate(); rate != 0 {
+		t.Errorf("expected a hit rate of 0 before any calls, got %v", rate)
+	}
+
+	a1, err := c.Get("a")
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+
+	// Cached expressions are cloned, so registering variables
+	// with one result does not affect the others.
+	if err := a1.RegisterVars(map[string]interface{}{"x": 1}); err != nil {
+		t.Fatalf("RegisterVars: %s", err)
+	}
+
+	a2, err := c.Get("a")
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+
+	if a1 == a2 {
+		t.Errorf("expected Get to return a copy of the cached expression")
+	}
+
+	if _, err := a2.Eval(map[string]interface{}{"a": "$x"}); err != nil {
+		t.Errorf("Eval: %s", err)
+	}
+
+	if _, ok := a2.registry["x"]; ok {
+		t.Errorf("expected variables registered with a copy to be ignored")
+	}
+
+	if rate := c.HitRate(); rate != 0.5 {
+		t.Errorf("expected a hit rate of 0.5, got %v", rate)
+	}
+
+	// Using b moves it to the front, so c evicts a.
+	c.Get("b")
+	c.Get("a")
+	c.Get("b")
+	c.Get("c")
+
+	if n := c.Len(); n != 2 {
+		t.Errorf("expected 2 cached expressions, got %d", n)
+	}
+
+	testCacheKeys(t, c, "c", "b")
+
+	c.Get("a")
+	testCacheKeys(t, c, "a", "c")
+
+	// Hits: a, a, b. Misses: a, b, c, a.
+	if rate, exp := c.HitRate(), 3.0/7.0; rate != exp {
+		t.Errorf("expected a hit rate of %v, got %v", exp, rate)
+	}
+
+	c = NewCache(0)
+	c.Get("a")
+	c.Get("a")
+
+	if n := c.Len(); n != 0 {
+		t.Errorf("expected no cached expressions, got %d", n)
+	}
+
+	if rate := c.HitRate(); rate != 0 {
+		t.Errorf("expected a hit rate of 0 with no cache, got %v", rate)
+	}
+}
+
+func TestCacheErrors(t *testing.T) {
+
+	const invalid = "a +"
+
+	c := NewCache(2)
+
+	_, err1 := c.Get(invalid)
+	if _, ok := err1.(*jparse.Error); !ok {
+		t.Fatalf("expected a *jparse.Error, got %T: %v", err1, err1)
+	}
+
+	// Compile errors are cached by default.
+	expr, err2 := c.Get(invalid)
+	if expr != nil {
+		t.Errorf("expected a nil Expr for an invalid expression")
+	}
+
+	if err2 != err1 {
+		t.Errorf("expected the cached error, got %v", err2)
+	}
+
+	testCacheKeys(t, c, invalid)
+
+	// Errors count towards the size of the cache.
+	c.Get("a")
+	c.Get("b")
+	testCacheKeys(t, c, "b", "a")
+
+	c = NewCache(2)
+	c.SetCacheErrors(false)
+
+	_, err1 = c.Get(invalid)
+	_, err2 = c.Get(invalid)
+
+	if err1 == nil || err2 == nil {
+		t.Fatalf("expected errors for an invalid expression")
+	}
+
+	if err1 == err2 {
+		t.Errorf("expected the expression to be compiled again")
+	}
+
+	if !reflect.DeepEqual(err1, err2) {
+		t.Errorf("expected equivalent errors, got %v and %v", err1, err2)
+	}
+
+	if n := c.Len(); n != 0 {
+		t.Errorf("expected no cached expressions, got %d", n)
+	}
+}
+
+func TestCacheConcurrent(t *testing.T) {
+
+	c := NewCache(10)
+
+	var wg sync.WaitGroup
+
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+
+			for i := 0; i < 100; i++ {
+				n := (g + i) % 20
+
+				e, err := c.Get(fmt.Sprintf("$ + %d", n))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				output, err := e.Eval(1.0)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				if exp := float64(n + 1); output != exp {
+					t.Errorf("expected %v, got %v (%T)", exp, output, output)
+				}
+			}
+		}(g)
+	}
+
+	wg.Wait()
+
+	if n := c.Len(); n != 10 {
+		t.Errorf("expected 10 cached expressions, got %d", n)
+	}
+}
+
+// testCacheKeys checks the expressions in c, most recently
+// used first.
+func testCacheKeys(t *testing.T, c *Cache, exp ...string) {
+
+	var keys []string
+	for elem := c.order.Front(); elem != nil; elem = elem.Next() {
+		keys = append(keys, elem.Value.(*cacheEntry).expression)
+	}
+
+	if !reflect.DeepEqual(keys, exp) {
+		t.Errorf("expected cached expressions %q, got %q", exp, keys)
+	}
+}
+
+// BenchmarkCacheParallel gets 100 distinct expressions from a
+// shared cache in 32 goroutines.
+func BenchmarkCacheParallel(b *testing.B) {
+
+	const goroutines = 32
+
+	exprs := make([]string, 100)
+	for i := range exprs {
+		exprs[i] = fmt.Sprintf(`Account.Order.Product[Price > %d].{"id": ProductID, "total": Price * Quantity}`, i)
+	}
+
+	for _, size := range []int{0, len(exprs)} {
+
+		name := "NoCache"
+		if size > 0 {
+			name = "Cache"
+		}
+
+		b.Run(name, func(b *testing.B) {
+
+			c := NewCache(size)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			var wg sync.WaitGroup
+
+			for g := 0; g < goroutines; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+
+					for i := g; i < b.N; i += goroutines {
+						if _, err := c.Get(exprs[i%len(exprs)]); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}(g)
+			}
+
+			wg.Wait()
+		})
+	}
+}
@@ -5,10 +5,11 @@
 package jsonata
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/blues/jsonata-go/jlib"
@@ -82,8 +83,16 @@ type goCallable struct {
 	params           []goCallableParam
 	isVariadic       bool
 	undefinedHandler jtypes.ArgHandler
+	undefinedArgs    jtypes.UndefinedArgs
 	contextHandler   jtypes.ArgHandler
+	applyContext     bool
 	context          reflect.Value
+	env              *environment
+	hasCallContext   bool
+	hasCtx           bool
+	signature        []jparse.Param
+	isExtension      bool
+	position         int
 }
 
 func newGoCallable(name string, ext Extension) (*goCallable, error) {
@@ -95,11 +104,63 @@ func newGoCallable(name string, ext Extension) (*goCallable, error) {
 	v := reflect.ValueOf(ext.Func)
 	t := v.Type()
 
-	params := makeGoCallableParams(t)
+	// If the first parameter is a CallContext or a
+	// context.Context, it's supplied by the evaluator rather
+	// than the caller. Exclude it from the function's
+	// parameters.
+	first := 0
+	hasCallContext := t.NumIn() > 0 && t.In(0) == typeCallContext
+	hasCtx := t.NumIn() > 0 && t.In(0) == typeCtx
+	if hasCallContext || hasCtx {
+		first = 1
+	}
+
+	params := makeGoCallableParams(t, first)
 	if err := validateGoCallableParams(params, t.IsVariadic()); err != nil {
 		return nil, err
 	}
 
+	var signature []jparse.Param
+	if ext.Signature != "" {
+		if ext.EvalContextHandler != nil {
+			return nil, fmt.Errorf("extensions cannot have both a signature and an EvalContextHandler")
+		}
+
+		var err error
+		signature, err = jparse.ParseSignature(ext.Signature)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := validateGoCallableSignature(signature, params, t.IsVariadic()); err != nil {
+			return nil, err
+		}
+	}
+
+	if ext.UndefinedHandler != nil && ext.UndefinedArgs != nil {
+		return nil, fmt.Errorf("extensions cannot have both an UndefinedHandler and UndefinedArgs")
+	}
+
+	if ext.ApplyContext {
+		if ext.EvalContextHandler != nil {
+			return nil, fmt.Errorf("extensions cannot have both ApplyContext and an EvalContextHandler")
+		}
+
+		if len(params) == 0 {
+			return nil, fmt.Errorf("ApplyContext requires a function with at least one parameter")
+		}
+
+		if signature != nil {
+			switch signature[0].Option {
+			case jparse.ParamOptional, jparse.ParamVariadic:
+				return nil, fmt.Errorf("ApplyContext cannot be used with an optional or variadic first parameter")
+			}
+			signature[0].Option = jparse.ParamContextable
+		} else if params[0].isOpt || (t.IsVariadic() && len(params) == 1) {
+			return nil, fmt.Errorf("ApplyContext cannot be used with an optional or variadic first parameter")
+		}
+	}
+
 	return &goCallable{
 		callableName: callableName{
 			name: name,
@@ -108,11 +169,19 @@ func newGoCallable(name string, ext Extension) (*goCallable, error) {
 		params:           params,
 		isVariadic:       t.IsVariadic(),
 		undefinedHandler: ext.UndefinedHandler,
+		undefinedArgs:    ext.UndefinedArgs,
 		contextHandler:   ext.EvalContextHandler,
+		applyContext:     ext.ApplyContext && signature == nil,
+		hasCallContext:   hasCallContext,
+		hasCtx:           hasCtx,
+		signature:        signature,
 	}, nil
 }
 
-var typeError = reflect.TypeOf((*error)(nil)).Elem()
+var (
+	typeError = reflect.TypeOf((*error)(nil)).Elem()
+	typeCtx   = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
 
 func validateGoCallableFunc(fn interface{}) error {
 
@@ -178,10 +247,34 @@ func validateGoCallableParams(params []goCallableParam, isVariadic bool) error {
 	return nil
 }
 
-func makeGoCallableParams(typ reflect.Type) []goCallableParam {
+// validateGoCallableSignature checks that a JSONata type
+// signature is compatible with the parameters of a Go function.
+func validateGoCallableSignature(signature []jparse.Param, params []goCallableParam, isVariadic bool) error {
+
+	sigCount := len(signature)
+	paramCount := len(params)
+
+	isSigVariadic := sigCount > 0 &&
+		signature[sigCount-1].Option == jparse.ParamVariadic
+
+	switch {
+	case isSigVariadic && !isVariadic:
+		return fmt.Errorf("a variadic signature requires a variadic function")
+	case isVariadic && sigCount < paramCount-1:
+		return fmt.Errorf("signature has %d parameter(s), function requires at least %d", sigCount, paramCount-1)
+	case !isVariadic && sigCount != paramCount:
+		return fmt.Errorf("signature has %d parameter(s), function has %d", sigCount, paramCount)
+	}
+
+	return nil
+}
+
+// makeGoCallableParams returns the parameters of a Go function
+// starting with the parameter at index first.
+func makeGoCallableParams(typ reflect.Type, first int) []goCallableParam {
 
-	paramCount := typ.NumIn()
-	if paramCount == 0 {
+	paramCount := typ.NumIn() - first
+	if paramCount <= 0 {
 		return nil
 	}
 
@@ -190,7 +283,7 @@ func makeGoCallableParams(typ reflect.Type) []goCallableParam {
 
 	for i := range params {
 
-		t := typ.In(i)
+		t := typ.In(first + i)
 		if isVariadic && i == paramCount-1 {
 			// The type of the final parameter in a variadic
 			// function is a slice of the declared type. Call
@@ -208,7 +301,14 @@ func (c *goCallable) SetContext(context reflect.Value) {
 	c.context = context
 }
 
+func (c *goCallable) SetEnvironment(env *environment) {
+	c.env = env
+}
+
 func (c *goCallable) ParamCount() int {
+	if c.signature != nil {
+		return len(c.signature)
+	}
 	return len(c.params)
 }
 
@@ -216,6 +316,8 @@ func (c *goCallable) Call(argv []reflect.Value) (reflect.Value, error) {
 
 	var err error
 
+	usedContext := c.usesContext(argv)
+
 	argv, err = c.validateArgCount(argv)
 	if err != nil {
 		if err == jtypes.ErrUndefined {
@@ -224,17 +326,48 @@ func (c *goCallable) Call(argv []reflect.Value) (reflect.Value, error) {
 		return undefined, err
 	}
 
-	argv, err = c.validateArgTypes(argv)
+	argv, err = c.validateArgTypes(argv, usedContext)
 	if err != nil {
+		if err == jtypes.ErrUndefined {
+			err = nil
+		}
 		return undefined, err
 	}
 
+	if c.hasCallContext {
+		ctx := CallContext{
+			context: c.context,
+			env:     c.env,
+		}
+		argv = append([]reflect.Value{reflect.ValueOf(ctx)}, argv...)
+	}
+
+	if c.hasCtx {
+		ctx := c.env.evalCtx()
+		argv = append([]reflect.Value{reflect.ValueOf(ctx)}, argv...)
+	}
+
 	results := c.fn.Call(argv)
 
 	if len(results) == 2 && !results[1].IsNil() {
 		err := results[1].Interface().(error)
 		if err == jtypes.ErrUndefined {
-			err = nil
+			return undefined, nil
+		}
+		if c.isExtension {
+			err = &ExtensionError{
+				Func:     c.Name(),
+				Position: c.position,
+				Err:      err,
+			}
+		} else if kerr, ok := err.(*jlib.KeyTypeError); ok {
+			// Report unconvertible map keys in the same way
+			// as the evaluator does.
+			err = newKeyTypeError(kerr.Type, c.position)
+		} else if terr, ok := err.(*jlib.TimestampError); ok {
+			err = newTimestampError(terr.Value, c.position)
+		} else {
+			setErrorPosition(err, c.position)
 		}
 		return undefined, err
 	}
@@ -242,11 +375,178 @@ func (c *goCallable) Call(argv []reflect.Value) (reflect.Value, error) {
 	return results[0], nil
 }
 
+// setErrorPosition sets the position of an error returned by
+// a built-in function. Errors that already have a position,
+// e.g. because they were returned by a function called by
+// this one, are not changed.
+func setErrorPosition(err error, pos int) {
+	switch err := err.(type) {
+	case *jlib.ArgValueError:
+		if err.Position == 0 {
+			err.Position = pos
+		}
+	case *jlib.NonArrayError:
+		if err.Position == 0 {
+			err.Position = pos
+		}
+	case *jlib.ArrayTypeError:
+		if err.Position == 0 {
+			err.Position = pos
+		}
+	case *jlib.Error:
+		if err.Position == 0 {
+			err.Position = pos
+		}
+	}
+}
+
+// setArgErrorPosition sets the position of an ArgCountError
+// or ArgTypeError returned by a call to fn. Errors from calls
+// that fn makes itself, e.g. to a function passed to $map, are
+// not changed. Like the errors returned by custom functions
+// (see ExtensionError), their position is unknown.
+func setArgErrorPosition(err error, fn jtypes.Callable, pos int) {
+	switch err := err.(type) {
+	case *ArgCountError:
+		if err.Func == fn.Name() && err.Position == 0 {
+			err.Position = pos
+		}
+	case *ArgTypeError:
+		if err.Func == fn.Name() && err.Position == 0 {
+			err.Position = pos
+		}
+	}
+}
+
+// argCountRange returns the minimum and maximum number of
+// arguments that the function accepts. A maximum of -1 means
+// that there is no upper limit.
+func (c *goCallable) argCountRange() (int, int) {
+
+	var min, max int
+
+	if c.signature != nil {
+		if len(c.signature) == 0 {
+			return 0, 0
+		}
+
+		for _, p := range c.signature {
+			if p.Option != jparse.ParamOptional {
+				min++
+			}
+		}
+
+		max = len(c.signature)
+		if c.signature[max-1].Option == jparse.ParamVariadic {
+			max = -1
+		}
+
+		if c.signature[0].Option == jparse.ParamContextable {
+			min--
+		}
+
+		return min, max
+	}
+
+	for _, p := range c.params {
+		if !p.isOpt {
+			min++
+		}
+	}
+
+	max = len(c.params)
+	if c.isVariadic {
+		min--
+		max = -1
+	}
+
+	if (c.applyContext || c.contextHandler != nil) && min > 0 {
+		min--
+	}
+
+	return min, max
+}
+
+// usesContext reports whether calling the function with the
+// given arguments would insert the evaluation context into the
+// argument list.
+func (c *goCallable) usesContext(argv []reflect.Value) bool {
+	switch {
+	case c.signature != nil:
+		return insertsContext(c.signature, argv)
+	case c.applyContext:
+		return c.insertsContext(argv)
+	default:
+		return c.contextHandler != nil && c.contextHandler(argv)
+	}
+}
+
+// insertsContext is the equivalent of the insertsContext
+// function for Go functions with ApplyContext set and no
+// signature. It uses the types of the Go function's parameters.
+func (c *goCallable) insertsContext(argv []reflect.Value) bool {
+
+	var required int
+	for _, p := range c.params {
+		if !p.isOpt {
+			required++
+		}
+	}
+	if c.isVariadic {
+		required--
+	}
+
+	switch {
+	case len(argv) < required:
+		return true
+	case len(argv) >= len(c.params), argv[0] == undefined:
+		return false
+	default:
+		_, ok := processGoCallableArg(resolveGoCallableArg(argv[0]), c.params[0])
+		return !ok
+	}
+}
+
+// returnsUndefined reports whether the function returns
+// undefined for the given arguments, according to its
+// UndefinedHandler or UndefinedArgs.
+func (c *goCallable) returnsUndefined(argv []reflect.Value) bool {
+
+	if c.undefinedHandler != nil {
+		return c.undefinedHandler(argv)
+	}
+
+	if c.undefinedArgs == nil {
+		return false
+	}
+
+	var isUndefined []bool
+	for i, arg := range argv {
+		if arg == undefined {
+			if isUndefined == nil {
+				isUndefined = make([]bool, len(argv))
+			}
+			isUndefined[i] = true
+		}
+	}
+
+	return isUndefined != nil && c.undefinedArgs(isUndefined)
+}
+
 func (c *goCallable) validateArgCount(argv []reflect.Value) ([]reflect.Value, error) {
 
 	argc := len(argv)
 
-	if c.contextHandler != nil && c.contextHandler(argv) {
+	if c.signature != nil {
+		var err error
+		argv, err = validateSignatureArgCount(c, c.signature, argv, c.context)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if (c.applyContext && c.insertsContext(argv)) ||
+		(c.contextHandler != nil && c.contextHandler(argv)) {
 		// TODO: Return an error if the evaluation context
 		// is not the correct type.
 		newargv := make([]reflect.Value, 1, len(argv)+1)
@@ -254,10 +554,11 @@ func (c *goCallable) validateArgCount(argv []reflect.Value) ([]reflect.Value, er
 		argv = append(newargv, argv...)
 	}
 
-	if c.undefinedHandler != nil && c.undefinedHandler(argv) {
-		// TODO: Validate the other arguments before doing
-		// this. Otherwise we mask errors with the other
-		// arguments.
+	// Functions with a signature call the undefined handler
+	// after their arguments have been type checked, so that
+	// an undefined argument doesn't mask errors with the
+	// other arguments.
+	if c.signature == nil && c.returnsUndefined(argv) {
 		return nil, jtypes.ErrUndefined
 	}
 
@@ -281,24 +582,26 @@ func (c *goCallable) validateArgCount(argv []reflect.Value) ([]reflect.Value, er
 	return argv, nil
 }
 
-func (c *goCallable) validateArgTypes(argv []reflect.Value) ([]reflect.Value, error) {
+func (c *goCallable) validateArgTypes(argv []reflect.Value, usedContext bool) ([]reflect.Value, error) {
 
 	var ok bool
 	paramCount := len(c.params)
 
-	for i, v := range argv {
-
-		v = jtypes.Resolve(v)
+	if c.signature != nil {
+		var err error
+		argv, err = validateSignatureArgTypes(c, c.signature, argv, usedContext)
+		if err != nil {
+			return nil, err
+		}
 
-		// The preceding call to Resolve dereferences pointers.
-		// This is fine for most types but we need to restore
-		// pointer type Callables.
-		if v.Kind() == reflect.Struct &&
-			reflect.PtrTo(v.Type()).Implements(jtypes.TypeCallable) {
-			if v.CanAddr() {
-				v = v.Addr()
-			}
+		if c.returnsUndefined(argv) {
+			return nil, jtypes.ErrUndefined
 		}
+	}
+
+	for i, v := range argv {
+
+		v = resolveGoCallableArg(v)
 
 		j := i
 		// Variadic functions can have more arguments than
@@ -310,7 +613,11 @@ func (c *goCallable) validateArgTypes(argv []reflect.Value) ([]reflect.Value, er
 
 		v, ok = processGoCallableArg(v, c.params[j])
 		if !ok {
-			return nil, newArgTypeError(c, i+1)
+			return nil, newCallArgTypeError(c, i, usedContext)
+		}
+
+		if c.isExtension {
+			v = plainExtensionArg(v, c.params[j].t)
 		}
 
 		argv[i] = v
@@ -319,9 +626,56 @@ func (c *goCallable) validateArgTypes(argv []reflect.Value) ([]reflect.Value, er
 	return argv, nil
 }
 
+// plainExtensionArg replaces any OrderedMaps in an argument
+// to an extension with regular Go maps, so that extensions
+// receive objects created by expressions in the same form as
+// objects from the input data. t is the parameter type. If it
+// does not allow the replacement, e.g. if it is
+// *jtypes.OrderedMap, the argument is returned unchanged.
+func plainExtensionArg(v reflect.Value, t reflect.Type) reflect.Value {
+
+	if !v.IsValid() || !v.CanInterface() || t == jtypes.TypeValue {
+		return v
+	}
+
+	p := jtypes.Plain(v.Interface())
+	if p == nil || !reflect.TypeOf(p).AssignableTo(t) {
+		return v
+	}
+
+	return reflect.ValueOf(p)
+}
+
+// resolveGoCallableArg prepares an argument to a Go function
+// for processGoCallableArg.
+func resolveGoCallableArg(v reflect.Value) reflect.Value {
+
+	// Decimals are passed as pointers so that they can
+	// be converted to the parameter type.
+	if d, ok := jtypes.AsDecimal(v); ok {
+		return reflect.ValueOf(d)
+	}
+
+	v = jtypes.Resolve(v)
+
+	// The preceding call to Resolve dereferences pointers.
+	// This is fine for most types but we need to restore
+	// pointer type Callables and OrderedMaps.
+	if v.Kind() == reflect.Struct &&
+		(reflect.PtrTo(v.Type()).Implements(jtypes.TypeCallable) ||
+			reflect.PtrTo(v.Type()) == jtypes.TypeOrderedMap) {
+		if v.CanAddr() {
+			v = v.Addr()
+		}
+	}
+
+	return v
+}
+
 var (
-	typeString    = reflect.TypeOf((*string)(nil)).Elem()
-	typeByteSlice = reflect.TypeOf((*[]byte)(nil)).Elem()
+	typeString       = reflect.TypeOf((*string)(nil)).Elem()
+	typeByteSlice    = reflect.TypeOf((*[]byte)(nil)).Elem()
+	typeInterfaceMap = reflect.MapOf(typeString, jtypes.TypeInterface)
 )
 
 func processGoCallableArg(arg reflect.Value, param goCallableParam) (reflect.Value, bool) {
@@ -348,6 +702,15 @@ func processGoCallableArg(arg reflect.Value, param goCallableParam) (reflect.Val
 		return arg, true
 	case paramType == jtypes.TypeValue:
 		return reflect.ValueOf(arg), true
+	case argType == jtypes.TypeOrderedMap && paramType == typeInterfaceMap:
+		// Functions that expect a regular Go map get a copy
+		// of the OrderedMap's contents.
+		return reflect.ValueOf(arg.Interface().(*jtypes.OrderedMap).Map()), true
+	case argType == jtypes.TypeJSONNumber && paramType.Kind() != reflect.String:
+		// A json.Number can be passed to any numeric type.
+		if n, ok := jtypes.AsNumber(arg); ok && reflect.TypeOf(n).ConvertibleTo(paramType) {
+			return reflect.ValueOf(n).Convert(paramType), true
+		}
 	case argType.ConvertibleTo(paramType):
 		// Only allow conversion to a string if the source type
 		// is a byte slice. Go can convert other types (such as
@@ -400,75 +763,24 @@ func processVariantArg(arg reflect.Value, param goCallableParam) (reflect.Value,
 	return undefined, false
 }
 
-// A lambdaCallable represents a user-defined JSONata function
-// created with the 'function' keyword.
-type lambdaCallable struct {
-	callableName
-	callableMarshaler
-	body       jparse.Node
-	paramNames []string
-	typed      bool
-	params     []jparse.Param
-	env        *environment
-	context    reflect.Value
-}
-
-func (f *lambdaCallable) ParamCount() int {
-	return len(f.paramNames)
-}
-
-func (f *lambdaCallable) Call(argv []reflect.Value) (reflect.Value, error) {
-
-	argv, err := f.validateArgs(argv)
-	if err != nil {
-		return undefined, err
-	}
-
-	// Create a local scope for this function's arguments.
-	env := newEnvironment(f.env, len(f.paramNames))
-
-	// Add the function arguments to the local scope.
-	// If there are fewer arguments than parameter names,
-	// default unset parameters to undefined. If there
-	// are more arguments than parameter names, ignore
-	// the extraneous arguments.
-	for i, name := range f.paramNames {
-
-		var v reflect.Value
-
-		if i < len(argv) {
-			v = argv[i]
-		}
-
-		env.bind(name, v)
-	}
-
-	// Evaluate the function body.
-	return eval(f.body, f.context, env)
-}
-
-func (f *lambdaCallable) validateArgs(argv []reflect.Value) ([]reflect.Value, error) {
-
-	// An untyped lambda can take any number of arguments
-	// of any type. No further processing is required.
-	if !f.typed {
-		return argv, nil
-	}
-
-	var err error
-
-	if argv, err = f.validateArgCount(argv); err != nil {
-		return nil, err
-	}
-
-	if argv, err = f.validateArgTypes(argv); err != nil {
-		return nil, err
-	}
-
-	return f.wrapVariadicArgs(argv), nil
+// insertsContext reports whether a call to a function with
+// the given type signature uses the evaluation context as its
+// first argument, i.e. whether there are fewer arguments than
+// parameters and the first parameter is contextable. It returns
+// false if the arguments already satisfy the signature, i.e.
+// there are enough arguments for the required parameters and
+// the first argument has the correct type.
+func insertsContext(params []jparse.Param, argv []reflect.Value) bool {
+	return len(argv) < len(params) && params[0].Option == jparse.ParamContextable &&
+		(len(argv) < requiredParamCount(params) || !matchesFirstParam(argv, params[0]))
 }
 
-func (f *lambdaCallable) validateArgCount(argv []reflect.Value) ([]reflect.Value, error) {
+// validateSignatureArgCount checks the number of arguments
+// passed to a function with a JSONata type signature. If there
+// are fewer arguments than parameters, it inserts the evaluation
+// context for a contextable first parameter and undefined values
+// for any missing optional parameters.
+func validateSignatureArgCount(f jtypes.Callable, params []jparse.Param, argv []reflect.Value, context reflect.Value) ([]reflect.Value, error) {
 
 	// argc is the number of arguments originally passed to
 	// the function.
@@ -476,20 +788,20 @@ func (f *lambdaCallable) validateArgCount(argv []reflect.Value) ([]reflect.Value
 
 	// paramCount is the number of parameters specified in
 	// the function's type signature.
-	paramCount := len(f.params)
+	paramCount := len(params)
 
-	// If there are fewer arguments than parameters and the
-	// first parameter is contextable, insert the evaluation
-	// context into the argument list.
-	if argc < paramCount && f.params[0].Option == jparse.ParamContextable {
-		argv = append([]reflect.Value{f.context}, argv...)
+	// If the first parameter is contextable and the arguments
+	// don't satisfy the signature, insert the evaluation context
+	// into the argument list.
+	if insertsContext(params, argv) {
+		argv = append([]reflect.Value{context}, argv...)
 	}
 
 	// If there are still fewer arguments than parameters and
 	// the missing arguments correspond to optional parameters,
 	// append undefined arguments to the argument list.
 	for i := len(argv); i < paramCount; i++ {
-		if f.params[i].Option != jparse.ParamOptional {
+		if params[i].Option != jparse.ParamOptional {
 			break
 		}
 		argv = append(argv, undefined)
@@ -501,7 +813,7 @@ func (f *lambdaCallable) validateArgCount(argv []reflect.Value) ([]reflect.Value
 
 	// isVar indicates whether the function is variadic.
 	isVar := paramCount > 0 &&
-		f.params[paramCount-1].Option == jparse.ParamVariadic
+		params[paramCount-1].Option == jparse.ParamVariadic
 
 	// If there are a) fewer arguments than parameters or b)
 	// extra arguments on a non-variadic function, return an
@@ -513,9 +825,49 @@ func (f *lambdaCallable) validateArgCount(argv []reflect.Value) ([]reflect.Value
 	return argv, nil
 }
 
-func (f *lambdaCallable) validateArgTypes(argv []reflect.Value) ([]reflect.Value, error) {
+// requiredParamCount returns the number of parameters in a
+// JSONata type signature that are not optional.
+func requiredParamCount(params []jparse.Param) int {
 
-	paramCount := len(f.params)
+	var n int
+	for _, p := range params {
+		if p.Option != jparse.ParamOptional {
+			n++
+		}
+	}
+
+	return n
+}
+
+// matchesFirstParam returns true if the first argument in argv
+// has the type of the given parameter. Undefined arguments match
+// any parameter.
+func matchesFirstParam(argv []reflect.Value, p jparse.Param) bool {
+
+	if len(argv) == 0 {
+		return false
+	}
+
+	arg := argv[0]
+	if arg == undefined {
+		return true
+	}
+
+	if p.Type == jparse.ParamTypeArray {
+		arg = arrayify(arg)
+	}
+
+	return validSignatureArgType(arg, p)
+}
+
+// validateSignatureArgTypes checks the types of the arguments
+// passed to a function with a JSONata type signature. Arguments
+// for array parameters are converted to arrays. The usedContext
+// parameter indicates whether the first argument is the
+// evaluation context, inserted by validateSignatureArgCount.
+func validateSignatureArgTypes(f jtypes.Callable, params []jparse.Param, argv []reflect.Value, usedContext bool) ([]reflect.Value, error) {
+
+	paramCount := len(params)
 
 	for i, arg := range argv {
 
@@ -527,9 +879,9 @@ func (f *lambdaCallable) validateArgTypes(argv []reflect.Value) ([]reflect.Value
 		var param jparse.Param
 
 		if i < paramCount {
-			param = f.params[i]
+			param = params[i]
 		} else if paramCount > 0 {
-			param = f.params[paramCount-1]
+			param = params[paramCount-1]
 		}
 
 		// If a parameter is an array type, force the
@@ -539,15 +891,41 @@ func (f *lambdaCallable) validateArgTypes(argv []reflect.Value) ([]reflect.Value
 			argv[i] = arg
 		}
 
-		if !f.validArgType(arg, param) {
-			return nil, newArgTypeError(f, i+1)
+		if !validSignatureArgType(arg, param) {
+			err := newCallArgTypeError(f, i, usedContext)
+			if !err.Context && param.Type == jparse.ParamTypeArray && len(param.SubParams) > 0 {
+				err.ArrayOf = arrayTypeName(param.SubParams[0].Type)
+			}
+			return nil, err
 		}
 	}
 
 	return argv, nil
 }
 
-func (f *lambdaCallable) validArgType(arg reflect.Value, p jparse.Param) bool {
+// newCallArgTypeError returns an ArgTypeError for the argument
+// at index i of a function call. If usedContext is true, the
+// first argument is the evaluation context and the error gives
+// the position of the argument as written in the expression,
+// i.e. not counting the context.
+func newCallArgTypeError(f jtypes.Callable, i int, usedContext bool) *ArgTypeError {
+
+	if !usedContext {
+		return newArgTypeError(f, i+1)
+	}
+
+	if i == 0 {
+		err := newArgTypeError(f, 1)
+		err.Context = true
+		return err
+	}
+
+	return newArgTypeError(f, i)
+}
+
+// validSignatureArgType returns true if an argument matches
+// a parameter in a JSONata type signature.
+func validSignatureArgType(arg reflect.Value, p jparse.Param) bool {
 
 	typ := p.Type
 
@@ -576,7 +954,7 @@ func (f *lambdaCallable) validArgType(arg reflect.Value, p jparse.Param) bool {
 				return true
 			}
 			return jtypes.IsArrayOf(arg, func(v reflect.Value) bool {
-				return f.validArgType(v, p.SubParams[0])
+				return validSignatureArgType(v, p.SubParams[0])
 			})
 		}
 		return false
@@ -587,12 +965,203 @@ func (f *lambdaCallable) validArgType(arg reflect.Value, p jparse.Param) bool {
 	return false
 }
 
-func (f *lambdaCallable) wrapVariadicArgs(argv []reflect.Value) []reflect.Value {
+// A lambdaCallable represents a user-defined JSONata function
+// created with the 'function' keyword.
+type lambdaCallable struct {
+	callableName
+	callableMarshaler
+	body       jparse.Node
+	paramNames []string
+	patterns   []jparse.Node
+	typed      bool
+	params     []jparse.Param
+	env        *environment
+	context    reflect.Value
+}
 
-	paramCount := len(f.params)
+func (f *lambdaCallable) ParamCount() int {
+	return len(f.paramNames)
+}
 
-	if paramCount < 1 ||
-		f.params[paramCount-1].Option != jparse.ParamVariadic {
+func (f *lambdaCallable) Call(argv []reflect.Value) (reflect.Value, error) {
+
+	var last *tailCall
+
+	for {
+		v, call, err := f.call(argv)
+		if err != nil {
+			if last != nil {
+				setArgErrorPosition(err, f, last.node.Start)
+			}
+			return v, err
+		}
+
+		if call == nil {
+			if last == nil {
+				return v, nil
+			}
+			return last.finish(v)
+		}
+
+		// The function body ended with a function call. If
+		// it's a call to another lambda (or to this one), go
+		// round the loop again instead of calling it. This
+		// stops tail-recursive lambdas from using up the
+		// stack.
+		next, ok := call.fn.(*lambdaCallable)
+		if !ok {
+			v, err := call.fn.Call(call.argv)
+			if err != nil {
+				setArgErrorPosition(err, call.fn, call.node.Start)
+				return v, err
+			}
+			return call.finish(v)
+		}
+
+		f, argv, last = next, call.argv, call
+	}
+}
+
+// call evaluates the function body with the given arguments.
+// If the body ends with a function call, call returns it
+// without making it.
+func (f *lambdaCallable) call(argv []reflect.Value) (reflect.Value, *tailCall, error) {
+
+	argv, err := f.validateArgs(argv)
+	if err != nil {
+		return undefined, nil, err
+	}
+
+	// Create a local scope for this function's arguments.
+	env := newEnvironment(f.env, len(f.paramNames))
+
+	// Add the function arguments to the local scope.
+	// If there are fewer arguments than parameter names,
+	// default unset parameters to undefined. If there
+	// are more arguments than parameter names, ignore
+	// the extraneous arguments.
+	for i, name := range f.paramNames {
+
+		var v reflect.Value
+
+		if i < len(argv) {
+			v = argv[i]
+		}
+
+		if i < len(f.patterns) && f.patterns[i] != nil {
+			if err := bindPattern(env, f.patterns[i], v); err != nil {
+				return undefined, nil, err
+			}
+			continue
+		}
+
+		env.bind(name, v)
+	}
+
+	// Evaluate the function body.
+	return evalTail(f.body, f.context, env)
+}
+
+// bindPattern binds the variables in a destructuring pattern
+// to the corresponding parts of v. Variables whose index or
+// key is missing from v are bound to undefined. A value that
+// is not an array is treated as an array of one item, as it
+// is in a path expression.
+func bindPattern(env *environment, pattern jparse.Node, v reflect.Value) error {
+
+	if sym, ok := pattern.(*jparse.VariableNode); ok {
+		env.bind(sym.Name, v)
+		return nil
+	}
+
+	v, err := convertValue(v)
+	if err != nil {
+		return err
+	}
+	v = jtypes.Resolve(v)
+
+	switch pattern := pattern.(type) {
+	case *jparse.ArrayPatternNode:
+		for i, item := range pattern.Items {
+
+			var elem reflect.Value
+
+			switch {
+			case jtypes.IsArray(v):
+				if i < v.Len() {
+					elem = v.Index(i)
+				}
+			case i == 0:
+				elem = v
+			}
+
+			if err := bindPattern(env, item, elem); err != nil {
+				return err
+			}
+		}
+
+	case *jparse.ObjectPatternNode:
+		for _, field := range pattern.Fields {
+
+			var value reflect.Value
+
+			name := &jparse.NameNode{
+				Value: field.Key,
+			}
+
+			switch {
+			case jtypes.IsStruct(v):
+				value = evalNameStruct(name, v)
+			case jtypes.IsMap(v):
+				value = evalNameMap(name, v)
+			}
+
+			if err := bindPattern(env, field.Value, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (f *lambdaCallable) validateArgs(argv []reflect.Value) ([]reflect.Value, error) {
+
+	// An untyped lambda can take any number of arguments
+	// of any type. No further processing is required.
+	if !f.typed {
+		return argv, nil
+	}
+
+	var err error
+
+	usedContext := insertsContext(f.params, argv)
+
+	if argv, err = f.validateArgCount(argv); err != nil {
+		return nil, err
+	}
+
+	if argv, err = f.validateArgTypes(argv, usedContext); err != nil {
+		return nil, err
+	}
+
+	return f.wrapVariadicArgs(argv), nil
+}
+
+func (f *lambdaCallable) validateArgCount(argv []reflect.Value) ([]reflect.Value, error) {
+	return validateSignatureArgCount(f, f.params, argv, f.context)
+}
+
+func (f *lambdaCallable) validateArgTypes(argv []reflect.Value, usedContext bool) ([]reflect.Value, error) {
+	return validateSignatureArgTypes(f, f.params, argv, usedContext)
+}
+
+func (f *lambdaCallable) wrapVariadicArgs(argv []reflect.Value) []reflect.Value {
+
+	paramCount := len(f.params)
+
+	if paramCount < 1 ||
+		f.params[paramCount-1].Option != jparse.ParamVariadic {
 		return argv
 	}
 
@@ -607,7 +1176,10 @@ func (f *lambdaCallable) wrapVariadicArgs(argv []reflect.Value) []reflect.Value
 }
 
 // A partialCallable represents the partial application of
-// a Callable.
+// a Callable. It evaluates the fixed arguments, fills in the
+// placeholders and calls the underlying Callable, so any
+// argument checks and handlers of the original function
+// still apply.
 type partialCallable struct {
 	callableName
 	callableMarshaler
@@ -657,6 +1229,123 @@ func (f *partialCallable) Call(argv []reflect.Value) (reflect.Value, error) {
 	return f.fn.Call(args)
 }
 
+// A millisCallable implements the $millis function. It returns
+// a fixed time (the start of the evaluation) in milliseconds
+// since the Unix epoch.
+type millisCallable struct {
+	callableName
+	callableMarshaler
+	millis int64
+}
+
+func (f *millisCallable) ParamCount() int {
+	return 0
+}
+
+func (f *millisCallable) argCountRange() (int, int) {
+	return 0, 0
+}
+
+func (f *millisCallable) Call(argv []reflect.Value) (reflect.Value, error) {
+
+	if len(argv) > 0 {
+		return undefined, newArgCountError(f, len(argv))
+	}
+
+	return reflect.ValueOf(f.millis), nil
+}
+
+// A nowCallable implements the $now function. It returns a
+// fixed time (the start of the evaluation) formatted in the
+// same way as $fromMillis, with the same optional picture and
+// timezone arguments.
+type nowCallable struct {
+	callableName
+	callableMarshaler
+	millis int64
+}
+
+func (f *nowCallable) ParamCount() int {
+	return 2
+}
+
+func (f *nowCallable) argCountRange() (int, int) {
+	return 0, 2
+}
+
+func (f *nowCallable) Call(argv []reflect.Value) (reflect.Value, error) {
+
+	if len(argv) > 2 {
+		return undefined, newArgCountError(f, len(argv))
+	}
+
+	var opts [2]jtypes.OptionalString
+
+	for i, v := range argv {
+		if v == undefined {
+			continue
+		}
+
+		s, ok := jtypes.AsString(v)
+		if !ok {
+			return undefined, newArgTypeError(f, i+1)
+		}
+
+		opts[i] = jtypes.NewOptionalString(s)
+	}
+
+	s, err := jlib.FromMillis(f.millis, opts[0], opts[1])
+	if err != nil {
+		return undefined, err
+	}
+
+	return reflect.ValueOf(s), nil
+}
+
+// A traceCallable implements the $trace function. It passes
+// its first argument, and an optional label, to a sink (see
+// Expr.SetTraceSink) and returns the first argument unchanged.
+// A traceCallable with a nil sink discards its arguments.
+type traceCallable struct {
+	callableName
+	callableMarshaler
+	sink func(TraceRecord)
+}
+
+func (f *traceCallable) ParamCount() int {
+	return 2
+}
+
+func (f *traceCallable) argCountRange() (int, int) {
+	return 0, 2
+}
+
+func (f *traceCallable) Call(argv []reflect.Value) (reflect.Value, error) {
+
+	if len(argv) > 2 {
+		return undefined, newArgCountError(f, len(argv))
+	}
+
+	v := undefined
+	if len(argv) > 0 {
+		v = argv[0]
+	}
+
+	var label string
+	if len(argv) > 1 && argv[1] != undefined {
+		var ok bool
+		if label, ok = jtypes.AsString(argv[1]); !ok {
+			return undefined, newArgTypeError(f, 2)
+		}
+	}
+
+	if f.sink != nil {
+		f.sink(newTraceRecord(label, v))
+	}
+
+	return v, nil
+}
+
 // A transformationCallable represents JSONata's object
 // transformation operator. It's a function that takes an
 // object and updates and/or removes the specified keys.
@@ -682,6 +1371,9 @@ func (f *transformationCallable) Call(argv []reflect.Value) (reflect.Value, erro
 
 	obj, err := f.clone(argv[0])
 	if err != nil {
+		if kerr, ok := err.(*jlib.KeyTypeError); ok {
+			return undefined, newKeyTypeError(kerr.Type, jparse.SpanOf(f.pattern).Start)
+		}
 		return undefined, newEvalError(ErrClone, nil, nil)
 	}
 
@@ -689,7 +1381,14 @@ func (f *transformationCallable) Call(argv []reflect.Value) (reflect.Value, erro
 		return undefined, nil
 	}
 
-	items, err := eval(f.pattern, obj, f.env)
+	// The pattern is evaluated against the copy of the input,
+	// which is also the root ($$) of any paths in the pattern.
+	// Without this, $$ would refer to the original input data,
+	// which the transformation must not change.
+	env := newEnvironment(f.env, 1)
+	env.bind("$", obj)
+
+	items, err := eval(f.pattern, obj, env)
 	if err != nil {
 		return undefined, err
 	}
@@ -731,6 +1430,16 @@ func (f *transformationCallable) validateArgs(argv []reflect.Value) error {
 	return nil
 }
 
+// updateEntries applies the update object to a matched item.
+// The update expression is evaluated with the item as its
+// context. Each key in the update object replaces the key of
+// the same name in the item, including keys whose values are
+// arrays: to append to an existing array, the update must
+// include the existing items explicitly, e.g. with $append or
+// an array constructor such as [Product, $newItem]. Keys with
+// undefined values are skipped, so a conditional update like
+// {"Flag": cond ? true : undefined} leaves the item unchanged
+// when cond is false.
 func (f *transformationCallable) updateEntries(item reflect.Value) error {
 
 	updates, err := eval(f.updates, item, f.env)
@@ -742,8 +1451,18 @@ func (f *transformationCallable) updateEntries(item reflect.Value) error {
 		return newEvalError(ErrIllegalUpdate, f.updates, nil)
 	}
 
-	for _, key := range updates.MapKeys() {
-		item.SetMapIndex(key, updates.MapIndex(key))
+	dest, ordered := jtypes.AsOrderedMap(item)
+
+	for _, key := range jtypes.MapKeys(updates) {
+		value := jtypes.MapIndex(updates, key)
+		switch {
+		case !value.IsValid() || !value.CanInterface():
+			continue
+		case ordered:
+			dest.Set(key.String(), value.Interface())
+		default:
+			item.SetMapIndex(key, value)
+		}
 	}
 
 	return nil
@@ -762,31 +1481,40 @@ func (f *transformationCallable) deleteEntries(item reflect.Value) error {
 		return newEvalError(ErrIllegalDelete, f.deletes, nil)
 	}
 
+	dest, ordered := jtypes.AsOrderedMap(item)
+
 	for i := 0; i < deletes.Len(); i++ {
 		key := jtypes.Resolve(deletes.Index(i))
+		if ordered {
+			dest.Delete(key.String())
+			continue
+		}
 		item.SetMapIndex(key, undefined)
 	}
 
 	return nil
 }
 
+// clone returns a deep copy of the transformation's input so
+// that updates do not modify the caller's data. Maps and structs
+// are copied to OrderedMaps and arrays are copied to slices of
+// type []interface{}, all the way down. Other values are shared
+// with the input because JSONata cannot modify them.
+//
+// The copy is made before the pattern is evaluated, so its cost
+// is proportional to the size of the whole input, not just the
+// parts that the transformation updates.
 func (f *transformationCallable) clone(v reflect.Value) (reflect.Value, error) {
 
 	if v == undefined {
 		return undefined, nil
 	}
 
-	s, err := jlib.String(v.Interface())
+	dest, err := jlib.Clone(v)
 	if err != nil {
 		return undefined, err
 	}
 
-	var dest interface{}
-	d := json.NewDecoder(strings.NewReader(s))
-	if err = d.Decode(&dest); err != nil {
-		return undefined, err
-	}
-
 	return reflect.ValueOf(dest), nil
 }
 
@@ -826,7 +1554,7 @@ func (f *regexCallable) Call(argv []reflect.Value) (reflect.Value, error) {
 	}
 
 	matches, indexes := f.findMatches(s)
-	return newMatchCallable(f.Name(), matches, indexes).Call(nil)
+	return newMatchCallable(f.Name(), matches, indexes, f.re.SubexpNames()).Call(nil)
 }
 
 var typeRegexPtr = reflect.TypeOf((*regexp.Regexp)(nil))
@@ -870,7 +1598,9 @@ func (f *regexCallable) findMatches(s string) ([][]string, [][]int) {
 // A matchCallable represents a regular expression match. Its
 // Call method returns an object containing the details of the
 // match, plus a Callable that returns the details of the next
-// match.
+// match. If the regular expression has named capturing groups,
+// the object also contains a "named" object that maps group
+// names to the captured text.
 type matchCallable struct {
 	callableName
 	callableMarshaler
@@ -878,10 +1608,14 @@ type matchCallable struct {
 	start  int
 	end    int
 	groups []string
+	named  map[string]string
 	next   jtypes.Callable
 }
 
-func newMatchCallable(name string, matches [][]string, indexes [][]int) jtypes.Callable {
+// newMatchCallable returns a Callable for the first of the given
+// matches. The names are the names of the regular expression's
+// capturing groups, as returned by regexp.Regexp.SubexpNames.
+func newMatchCallable(name string, matches [][]string, indexes [][]int, names []string) jtypes.Callable {
 
 	if len(matches) < 1 {
 		return &undefinedCallable{
@@ -899,18 +1633,45 @@ func newMatchCallable(name string, matches [][]string, indexes [][]int) jtypes.C
 		start:  indexes[0][0],
 		end:    indexes[0][1],
 		groups: matches[0][1:],
-		next:   newMatchCallable("next", matches[1:], indexes[1:]),
+		named:  namedGroups(matches[0], names),
+		next:   newMatchCallable("next", matches[1:], indexes[1:], names),
+	}
+}
+
+// namedGroups returns a map of group names to captured text for
+// the given match, or nil if none of the groups are named.
+func namedGroups(match []string, names []string) map[string]string {
+
+	var named map[string]string
+
+	for i, name := range names {
+		if name == "" || i >= len(match) {
+			continue
+		}
+		if named == nil {
+			named = map[string]string{}
+		}
+		named[name] = match[i]
 	}
+
+	return named
 }
 
 func (f *matchCallable) Call([]reflect.Value) (reflect.Value, error) {
-	return reflect.ValueOf(map[string]interface{}{
+
+	res := map[string]interface{}{
 		"match":  f.match,
 		"start":  f.start,
 		"end":    f.end,
 		"groups": f.groups,
 		"next":   f.next,
-	}), nil
+	}
+
+	if f.named != nil {
+		res["named"] = f.named
+	}
+
+	return reflect.ValueOf(res), nil
 }
 
 func (*matchCallable) ParamCount() int {
@@ -931,33 +1692,278 @@ func (*undefinedCallable) ParamCount() int {
 	return 0
 }
 
-// A chainCallable provides function composition.
+// A chainCallable provides function composition. It calls
+// each function with the output of the previous one.
 type chainCallable struct {
 	callableName
 	callableMarshaler
 	callables []jtypes.Callable
 }
 
+// newChainCallable returns a chainCallable that calls f1 and
+// then f2. Chains are flattened, so that a chain of chains
+// numbers its stages consecutively.
+func newChainCallable(f1, f2 jtypes.Callable) *chainCallable {
+
+	var callables []jtypes.Callable
+
+	for _, f := range []jtypes.Callable{f1, f2} {
+		if chain, ok := f.(*chainCallable); ok {
+			callables = append(callables, chain.callables...)
+		} else {
+			callables = append(callables, f)
+		}
+	}
+
+	return &chainCallable{
+		callables: callables,
+	}
+}
+
+// ParamCount returns the parameter count of the first function
+// in the chain, which receives the chain's arguments.
 func (f *chainCallable) ParamCount() int {
-	return 1
+	return f.callables[0].ParamCount()
 }
 
 func (f *chainCallable) Call(argv []reflect.Value) (reflect.Value, error) {
 
+	// The first function is called with all of the arguments,
+	// so that they are checked against its signature. Later
+	// functions receive the output of the previous one.
+	if len(argv) == 0 {
+		argv = []reflect.Value{undefined}
+	}
+
 	var err error
 	var v reflect.Value
 
-	if len(argv) > 0 {
-		v = argv[0]
-	}
+	for i, fn := range f.callables {
 
-	for _, fn := range f.callables {
+		if i > 0 {
+			argv = []reflect.Value{v}
+		}
 
-		v, err = fn.Call([]reflect.Value{v})
+		v, err = fn.Call(argv)
 		if err != nil {
-			return undefined, err
+			return undefined, newChainError(fn.Name(), i+1, err)
+		}
+	}
+
+	return v, nil
+}
+
+// A memoCallable implements the $memoize function. It caches
+// the results of the underlying Callable so that it is only
+// called once for each distinct list of arguments. Arguments
+// are compared with jlib.DeepEqual. Errors are not cached.
+//
+// The cache belongs to the memoCallable, which is created
+// during an evaluation, so cached results are discarded when
+// the evaluation ends.
+type memoCallable struct {
+	callableName
+	callableMarshaler
+	fn    jtypes.Callable
+	cache map[string][]memoEntry
+}
+
+type memoEntry struct {
+	argv []reflect.Value
+	v    reflect.Value
+}
+
+func newMemoCallable(fn jtypes.Callable) *memoCallable {
+	return &memoCallable{
+		callableName: callableName{
+			name: fn.Name(),
+		},
+		fn: fn,
+	}
+}
+
+func (f *memoCallable) ParamCount() int {
+	return f.fn.ParamCount()
+}
+
+func (f *memoCallable) Call(argv []reflect.Value) (reflect.Value, error) {
+
+	key, ok := memoKey(argv)
+	if !ok {
+		return f.fn.Call(argv)
+	}
+
+	for _, entry := range f.cache[key] {
+		if memoArgsEqual(entry.argv, argv) {
+			return entry.v, nil
 		}
 	}
 
+	// Copy the arguments before the call. Some Callables
+	// modify their argument lists.
+	entry := memoEntry{
+		argv: append([]reflect.Value(nil), argv...),
+	}
+
+	v, err := f.fn.Call(argv)
+	if err != nil {
+		return undefined, err
+	}
+
+	if f.cache == nil {
+		f.cache = map[string][]memoEntry{}
+	}
+
+	entry.v = v
+	f.cache[key] = append(f.cache[key], entry)
+
 	return v, nil
 }
+
+// memoKey returns the cache key for a list of arguments.
+// Equal arguments produce the same key but unequal arguments
+// may too (e.g. functions, which all have the same string
+// representation), so cache entries must be compared with
+// memoArgsEqual. The second return value is false if the
+// arguments cannot be converted to a key.
+func memoKey(argv []reflect.Value) (string, bool) {
+
+	var b strings.Builder
+
+	for _, arg := range argv {
+
+		// Undefined arguments are written as "undefined".
+		// Collisions with the string "undefined" are caught
+		// by memoArgsEqual.
+		s := "undefined"
+		if arg.IsValid() {
+
+			if !arg.CanInterface() {
+				return "", false
+			}
+
+			var err error
+			if s, err = jlib.String(arg.Interface()); err != nil {
+				return "", false
+			}
+		}
+
+		b.WriteString(strconv.Itoa(len(s)))
+		b.WriteByte(':')
+		b.WriteString(s)
+	}
+
+	return b.String(), true
+}
+
+// memoArgsEqual returns true if two argument lists are deeply
+// equal. Unlike jlib.DeepEqual, it treats undefined arguments
+// as equal to each other.
+func memoArgsEqual(argv1, argv2 []reflect.Value) bool {
+
+	if len(argv1) != len(argv2) {
+		return false
+	}
+
+	for i := range argv1 {
+		v1, v2 := argv1[i], argv2[i]
+		if v1 == undefined || v2 == undefined {
+			if v1 != v2 {
+				return false
+			}
+			continue
+		}
+		if !jlib.DeepEqual(v1, v2) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// An evalCallable implements the $eval function. It parses
+// and evaluates a JSONata expression at runtime, using the
+// environment of the calling expression. Parsed expressions
+// are cached so that repeated calls with the same string
+// (e.g. from inside a $map) only parse it once.
+type evalCallable struct {
+	callableName
+	callableMarshaler
+	env     *environment
+	context reflect.Value
+	cache   map[string]jparse.Node
+}
+
+func newEvalCallable(env *environment) *evalCallable {
+	return &evalCallable{
+		callableName: callableName{
+			name: "eval",
+		},
+		env: env,
+	}
+}
+
+func (f *evalCallable) SetContext(context reflect.Value) {
+	f.context = context
+}
+
+func (f *evalCallable) SetEnvironment(env *environment) {
+	f.env = env
+}
+
+func (f *evalCallable) ParamCount() int {
+	return 2
+}
+
+func (f *evalCallable) argCountRange() (int, int) {
+	return 1, 2
+}
+
+func (f *evalCallable) Call(argv []reflect.Value) (reflect.Value, error) {
+
+	if len(argv) < 1 || len(argv) > 2 {
+		return undefined, newArgCountError(f, len(argv))
+	}
+
+	if argv[0] == undefined {
+		return undefined, nil
+	}
+
+	expr, ok := jtypes.AsString(argv[0])
+	if !ok {
+		return undefined, newArgTypeError(f, 1)
+	}
+
+	focus := f.context
+	if len(argv) > 1 && argv[1] != undefined {
+		focus = argv[1]
+	}
+
+	node, err := f.parse(expr)
+	if err != nil {
+		return undefined, newEvalError(ErrEvalParse, "$"+f.Name(), err.Error())
+	}
+
+	// Evaluate the expression in a child environment so
+	// that any assignments it makes don't leak out.
+	return eval(node, focus, newEnvironment(f.env, 0))
+}
+
+func (f *evalCallable) parse(expr string) (jparse.Node, error) {
+
+	if node, ok := f.cache[expr]; ok {
+		return node, nil
+	}
+
+	node, err := jparse.ParseWithOperators(expr, f.env.operatorBps())
+	if err != nil {
+		return nil, err
+	}
+
+	if f.cache == nil {
+		f.cache = map[string]jparse.Node{}
+	}
+	f.cache[expr] = node
+
+	return node, nil
+}
@@ -6,10 +6,10 @@ package jsonata
 
 import (
 	"errors"
-	"math"
 	"reflect"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -537,9 +537,250 @@ func TestGoCallable(t *testing.T) {
 			},
 			Output: "test",
 		},
+		{
+			// Signature: too few arguments
+			Name: "signatureCount1",
+			Ext: Extension{
+				Func: func(s string, n jtypes.OptionalInt) string {
+					return s
+				},
+				Signature: "<sn?:s>",
+			},
+			Error: &ArgCountError{
+				Func:     "signatureCount1",
+				Expected: 2,
+				Received: 0,
+			},
+		},
+		{
+			// Signature: too many arguments
+			Name: "signatureCount2",
+			Ext: Extension{
+				Func: func(s string, n jtypes.OptionalInt) string {
+					return s
+				},
+				Signature: "<sn?:s>",
+			},
+			Args: []interface{}{
+				"hello",
+				1,
+				2,
+			},
+			Error: &ArgCountError{
+				Func:     "signatureCount2",
+				Expected: 2,
+				Received: 3,
+			},
+		},
+		{
+			// Signature: wrong argument type. Without the
+			// signature, the number would be rejected by the
+			// Go type check.
+			Name: "signatureType",
+			Ext: Extension{
+				Func: func(v interface{}) interface{} {
+					return v
+				},
+				Signature: "<s:s>",
+			},
+			Args: []interface{}{
+				100,
+			},
+			Error: &ArgTypeError{
+				Func:  "signatureType",
+				Which: 1,
+			},
+		},
+		{
+			// Signature: missing optional argument
+			Name: "signatureOptional",
+			Ext: Extension{
+				Func: func(s string, n jtypes.OptionalInt) string {
+					return strings.Repeat(s, n.Int+1)
+				},
+				Signature: "<sn?:s>",
+			},
+			Args: []interface{}{
+				"x",
+			},
+			Output: "x",
+		},
+		{
+			// Signature: contextable parameter
+			Name: "signatureContext",
+			Ext: Extension{
+				Func: func(s string, n int) string {
+					return strings.Repeat(s, n)
+				},
+				Signature: "<s-n:s>",
+			},
+			Context: "x",
+			Args: []interface{}{
+				3,
+			},
+			Output: "xxx",
+		},
+		{
+			// Signature: variadic parameter
+			Name: "signatureVariadic",
+			Ext: Extension{
+				Func: func(sep string, values ...interface{}) string {
+					return strconv.Itoa(len(values)) + sep
+				},
+				Signature: "<sx+:s>",
+			},
+			Args: []interface{}{
+				"!",
+				1,
+				"two",
+				false,
+			},
+			Output: "3!",
+		},
+		{
+			// Signature: array parameter
+			Name: "signatureArray",
+			Ext: Extension{
+				Func: func(values []interface{}) int {
+					return len(values)
+				},
+				Signature: "<a<n>:n>",
+			},
+			Args: []interface{}{
+				1.5,
+			},
+			Output: 1,
+		},
 	})
 }
 
+func TestNewGoCallableSignature(t *testing.T) {
+
+	tests := []struct {
+		Name string
+		Ext  Extension
+		Fail bool
+	}{
+		{
+			Name: "valid",
+			Ext: Extension{
+				Func:      func(string, jtypes.OptionalInt) string { return "" },
+				Signature: "<sn?:s>",
+			},
+		},
+		{
+			Name: "variadic",
+			Ext: Extension{
+				Func:      func(string, ...interface{}) string { return "" },
+				Signature: "<sx+:s>",
+			},
+		},
+		{
+			// A variadic Go function can have a fixed
+			// number of parameters in its signature.
+			Name: "variadicFixed",
+			Ext: Extension{
+				Func:      func(...interface{}) string { return "" },
+				Signature: "<nn:s>",
+			},
+		},
+		{
+			// Error: Invalid signature.
+			Name: "invalid",
+			Ext: Extension{
+				Func:      func(string) string { return "" },
+				Signature: "<z:s>",
+			},
+			Fail: true,
+		},
+		{
+			// Error: Signature has too few parameters.
+			Name: "tooFew",
+			Ext: Extension{
+				Func:      func(string, int) string { return "" },
+				Signature: "<s:s>",
+			},
+			Fail: true,
+		},
+		{
+			// Error: Variadic signature, non-variadic function.
+			Name: "notVariadic",
+			Ext: Extension{
+				Func:      func(string, int) string { return "" },
+				Signature: "<sn+:s>",
+			},
+			Fail: true,
+		},
+		{
+			// Error: Signature and EvalContextHandler.
+			Name: "contextHandler",
+			Ext: Extension{
+				Func:               func(string) string { return "" },
+				Signature:          "<s-:s>",
+				EvalContextHandler: jtypes.ArgCountEquals(0),
+			},
+			Fail: true,
+		},
+		{
+			// Error: ApplyContext and EvalContextHandler.
+			Name: "applyContextHandler",
+			Ext: Extension{
+				Func:               func(string) string { return "" },
+				ApplyContext:       true,
+				EvalContextHandler: jtypes.ArgCountEquals(0),
+			},
+			Fail: true,
+		},
+		{
+			// Error: ApplyContext with no parameters.
+			Name: "applyContextNoParams",
+			Ext: Extension{
+				Func:         func() string { return "" },
+				ApplyContext: true,
+			},
+			Fail: true,
+		},
+		{
+			// Error: ApplyContext with an optional first parameter.
+			Name: "applyContextOptional",
+			Ext: Extension{
+				Func:         func(jtypes.OptionalString) string { return "" },
+				ApplyContext: true,
+			},
+			Fail: true,
+		},
+		{
+			// Error: ApplyContext with an optional first parameter
+			// in the signature.
+			Name: "applyContextOptionalSignature",
+			Ext: Extension{
+				Func:         func(string) string { return "" },
+				Signature:    "<s?:s>",
+				ApplyContext: true,
+			},
+			Fail: true,
+		},
+		{
+			// Error: ApplyContext with a variadic function.
+			Name: "applyContextVariadic",
+			Ext: Extension{
+				Func:         func(...string) string { return "" },
+				ApplyContext: true,
+			},
+			Fail: true,
+		},
+	}
+
+	for _, test := range tests {
+
+		_, err := newGoCallable(test.Name, test.Ext)
+
+		if (err != nil) != test.Fail {
+			t.Errorf("%s: expected error %v, got %v", test.Name, test.Fail, err)
+		}
+	}
+}
+
 func testGoCallable(t *testing.T, tests []goCallableTest) {
 
 	for _, test := range tests {
@@ -1559,8 +1800,9 @@ func TestLambdaCallable(t *testing.T) {
 				},
 			},
 			Error: &ArgTypeError{
-				Func:  "array4",
-				Which: 1,
+				Func:    "array4",
+				Which:   1,
+				ArrayOf: "strings",
 			},
 		},
 		{
@@ -1892,7 +2134,7 @@ func TestPartialCallableTest(t *testing.T) {
 			Args: []reflect.Value{
 				reflect.ValueOf(6),
 			},
-			Output: float64(12),
+			Output: int64(12),
 		},
 		{
 			// Error evaluating argument in partial definition.
@@ -1994,6 +2236,9 @@ func TestTransformationCallable(t *testing.T) {
 		},
 	}
 
+	cyclic := map[string]interface{}{}
+	cyclic["self"] = cyclic
+
 	testTransformationCallable(t, []transformationCallableTest{
 		{
 			// Update only.
@@ -2021,27 +2266,27 @@ func TestTransformationCallable(t *testing.T) {
 			Input: data,
 			Output: []interface{}{
 				map[string]interface{}{
-					"value": float64(1),
+					"value": 1,
 					"es":    "one",
 					"en":    "uno",
 				},
 				map[string]interface{}{
-					"value": float64(2),
+					"value": 2,
 					"es":    "two",
 					"en":    "dos",
 				},
 				map[string]interface{}{
-					"value": float64(3),
+					"value": 3,
 					"es":    "three",
 					"en":    "tres",
 				},
 				map[string]interface{}{
-					"value": float64(4),
+					"value": 4,
 					"es":    "four",
 					"en":    "cuatro",
 				},
 				map[string]interface{}{
-					"value": float64(5),
+					"value": 5,
 					"es":    "five",
 					"en":    "cinco",
 				},
@@ -2057,23 +2302,23 @@ func TestTransformationCallable(t *testing.T) {
 			Input: data,
 			Output: []interface{}{
 				map[string]interface{}{
-					"value": float64(1),
+					"value": 1,
 					"en":    "one",
 				},
 				map[string]interface{}{
-					"value": float64(2),
+					"value": 2,
 					"en":    "two",
 				},
 				map[string]interface{}{
-					"value": float64(3),
+					"value": 3,
 					"en":    "three",
 				},
 				map[string]interface{}{
-					"value": float64(4),
+					"value": 4,
 					"en":    "four",
 				},
 				map[string]interface{}{
-					"value": float64(5),
+					"value": 5,
 					"en":    "five",
 				},
 			},
@@ -2095,19 +2340,19 @@ func TestTransformationCallable(t *testing.T) {
 			Input: data,
 			Output: []interface{}{
 				map[string]interface{}{
-					"value": float64(1),
+					"value": 1,
 				},
 				map[string]interface{}{
-					"value": float64(2),
+					"value": 2,
 				},
 				map[string]interface{}{
-					"value": float64(3),
+					"value": 3,
 				},
 				map[string]interface{}{
-					"value": float64(4),
+					"value": 4,
 				},
 				map[string]interface{}{
-					"value": float64(5),
+					"value": 5,
 				},
 			},
 		},
@@ -2142,19 +2387,19 @@ func TestTransformationCallable(t *testing.T) {
 			Input: data,
 			Output: []interface{}{
 				map[string]interface{}{
-					"one": float64(1),
+					"one": 1,
 				},
 				map[string]interface{}{
-					"two": float64(2),
+					"two": 2,
 				},
 				map[string]interface{}{
-					"three": float64(3),
+					"three": 3,
 				},
 				map[string]interface{}{
-					"four": float64(4),
+					"four": 4,
 				},
 				map[string]interface{}{
-					"five": float64(5),
+					"five": 5,
 				},
 			},
 		},
@@ -2179,9 +2424,9 @@ func TestTransformationCallable(t *testing.T) {
 				3,
 			},
 			Output: []interface{}{
-				float64(1),
-				float64(2),
-				float64(3),
+				1,
+				2,
+				3,
 			},
 		},
 		{
@@ -2199,7 +2444,7 @@ func TestTransformationCallable(t *testing.T) {
 			// Non-cloneable input. Return error.
 			Pattern: &jparse.VariableNode{},
 			Updates: &jparse.ObjectNode{},
-			Input:   []float64{math.NaN()},
+			Input:   cyclic,
 			Error: &EvalError{
 				Type: ErrClone,
 			},
@@ -2315,7 +2560,7 @@ func testTransformationCallable(t *testing.T, tests []transformationCallableTest
 
 		var output interface{}
 		if v.IsValid() && v.CanInterface() {
-			output = v.Interface()
+			output = jtypes.Plain(v.Interface())
 		}
 
 		if test.Undefined {
@@ -2730,17 +2975,20 @@ func TestCallableParamCount(t *testing.T) {
 			Count: 0,
 		},
 		{
-			// All chainCallables take 1 parameter.
+			// A chainCallable takes the same number of
+			// parameters as its first function.
 			Callable: &chainCallable{
 				callableName: callableName{
 					name: "chainCallable",
 				},
 				callables: []jtypes.Callable{
-					&undefinedCallable{},
+					&lambdaCallable{
+						paramNames: []string{"x", "y"},
+					},
 					&undefinedCallable{},
 				},
 			},
-			Count: 1,
+			Count: 2,
 		},
 	}
 
@@ -0,0 +1,88 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jsonata
+
+import (
+	"reflect"
+
+	"github.com/blues/jsonata-go/jlib"
+	"github.com/blues/jsonata-go/jparse"
+	"github.com/blues/jsonata-go/jtypes"
+)
+
+// A Collator compares two strings for sorting. It returns a
+// negative number if a sorts before b, a positive number if
+// a sorts after b and zero if they sort equally.
+type Collator func(a, b string) int
+
+// SetCollator sets the function used to order strings. It is
+// used by the sort operator (e.g. Product^(Name)), by $sort
+// when it sorts an array of strings without a comparison
+// function, and by the <, <=, > and >= operators when both
+// operands are strings. Pass nil to restore the default, which
+// compares strings byte by byte. For example, to sort strings
+// according to the rules of a language, use a collator from
+// the golang.org/x/text/collate package:
+//
+//	c := collate.New(language.German)
+//	e.SetCollator(c.CompareString)
+//
+// Strings that the collator considers equal keep their order
+// in the input. The collator must be safe for concurrent use
+// if the Expr is evaluated from more than one goroutine at
+// once. SetCollator can be called before or after Optimize.
+func (e *Expr) SetCollator(fn Collator) {
+
+	if fn == nil {
+		e.collator = nil
+		e.collated = nil
+		return
+	}
+
+	e.collator = fn
+	e.collated = collatedCallables(fn)
+}
+
+// collatedCallables returns replacements for the built-in
+// functions that order strings. The replacements use the
+// given collator.
+func collatedCallables(fn Collator) map[string]reflect.Value {
+	return map[string]reflect.Value{
+		"sort": reflect.ValueOf(mustGoCallable("sort", Extension{
+			Func: func(v reflect.Value, swap jtypes.OptionalCallable) (interface{}, error) {
+				return jlib.SortCollated(v, swap, fn)
+			},
+			UndefinedArgs: defaultUndefinedArgs,
+			Signature:     "<af?:a>",
+		})),
+	}
+}
+
+// compareCollated compares the operands of an ordering operator,
+// which must both be strings, using the environment's collator.
+// The second return value is false if there is no collator.
+func compareCollated(op jparse.ComparisonOperator, lhs, rhs reflect.Value, env *environment) (bool, bool) {
+
+	if env.collator == nil {
+		return false, false
+	}
+
+	s1, _ := jtypes.AsString(lhs)
+	s2, _ := jtypes.AsString(rhs)
+	cmp := env.collator(s1, s2)
+
+	switch op {
+	case jparse.ComparisonLess:
+		return cmp < 0, true
+	case jparse.ComparisonLessEqual:
+		return cmp <= 0, true
+	case jparse.ComparisonGreater:
+		return cmp > 0, true
+	case jparse.ComparisonGreaterEqual:
+		return cmp >= 0, true
+	default:
+		return false, false
+	}
+}
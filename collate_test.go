@@ -0,0 +1,242 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jsonata
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// reverseCollator orders strings in the reverse of their usual
+// order, so that tests can tell whether it was used.
+func reverseCollator(a, b string) int {
+	return strings.Compare(b, a)
+}
+
+func TestCollator(t *testing.T) {
+
+	data := map[string]interface{}{
+		"items": []interface{}{
+			map[string]interface{}{"name": "Zebra", "n": 1.0},
+			map[string]interface{}{"name": "apple", "n": 2.0},
+			map[string]interface{}{"name": "Äpfel", "n": 3.0},
+			map[string]interface{}{"name": "Apple", "n": 4.0},
+		},
+	}
+
+	tests := []struct {
+		Expression string
+		Default    interface{}
+		Collated   interface{}
+	}{
+		{
+			Expression: `items^(name).name`,
+			Default:    []interface{}{"Apple", "Zebra", "apple", "Äpfel"},
+			Collated:   []interface{}{"Äpfel", "apple", "Zebra", "Apple"},
+		},
+		{
+			Expression: `items^(>name).name`,
+			Default:    []interface{}{"Äpfel", "apple", "Zebra", "Apple"},
+			Collated:   []interface{}{"Apple", "Zebra", "apple", "Äpfel"},
+		},
+		{
+			// Numeric sort terms are unaffected.
+			Expression: `items^(>n).n`,
+			Default:    []interface{}{4.0, 3.0, 2.0, 1.0},
+			Collated:   []interface{}{4.0, 3.0, 2.0, 1.0},
+		},
+		{
+			Expression: `$sort(items.name)`,
+			Default:    []interface{}{"Apple", "Zebra", "apple", "Äpfel"},
+			Collated:   []interface{}{"Äpfel", "apple", "Zebra", "Apple"},
+		},
+		{
+			// A comparison function takes precedence.
+			Expression: `$sort(items, function($a, $b) { $a.n < $b.n }).name`,
+			Default:    []interface{}{"Apple", "Äpfel", "apple", "Zebra"},
+			Collated:   []interface{}{"Apple", "Äpfel", "apple", "Zebra"},
+		},
+		{
+			// But comparisons in the function use the collator.
+			Expression: `$sort(items.name, function($a, $b) { $a > $b })`,
+			Default:    []interface{}{"Apple", "Zebra", "apple", "Äpfel"},
+			Collated:   []interface{}{"Äpfel", "apple", "Zebra", "Apple"},
+		},
+		{
+			Expression: `$sort([3, 1, 2])`,
+			Default:    []interface{}{1.0, 2.0, 3.0},
+			Collated:   []interface{}{1.0, 2.0, 3.0},
+		},
+		{
+			Expression: `["a" < "b", "a" <= "b", "a" > "b", "a" >= "b", "a" < "a", "a" <= "a"]`,
+			Default:    []interface{}{true, true, false, false, false, true},
+			Collated:   []interface{}{false, false, true, true, false, true},
+		},
+		{
+			Expression: `items[name < "b"].name`,
+			Default:    []interface{}{"Zebra", "apple", "Apple"},
+			Collated:   "Äpfel",
+		},
+		{
+			// Filters and sorts on a path with a positional
+			// binding use the collator too. The positions show
+			// which of the original items were selected, and
+			// in what order.
+			Expression: `items#$i[name < "b"].$i`,
+			Default:    []interface{}{0.0, 1.0, 3.0},
+			Collated:   2.0,
+		},
+		{
+			Expression: `items#$i^(name).$i`,
+			Default:    []interface{}{3.0, 0.0, 1.0, 2.0},
+			Collated:   []interface{}{2.0, 1.0, 0.0, 3.0},
+		},
+		{
+			// Equality is not affected.
+			Expression: `["a" = "a", "a" != "b", "a" in ["a"]]`,
+			Default:    []interface{}{true, true, true},
+			Collated:   []interface{}{true, true, true},
+		},
+		{
+			Expression: `1 < 2`,
+			Default:    true,
+			Collated:   true,
+		},
+	}
+
+	for _, test := range tests {
+
+		e := MustCompile(test.Expression)
+
+		output, err := e.Eval(data)
+		if err != nil {
+			t.Fatalf("%s: %s", test.Expression, err)
+		}
+		if !reflect.DeepEqual(output, test.Default) {
+			t.Errorf("%s: expected %v, got %v", test.Expression, test.Default, output)
+		}
+
+		// The collator is copied to clones and applies to
+		// expressions evaluated with $eval.
+		e.SetCollator(reverseCollator)
+		ev := MustCompile("$eval($e)")
+		ev.SetCollator(reverseCollator)
+
+		for _, e := range []*Expr{e, e.Clone(), ev} {
+
+			output, err := e.EvalWithVars(data, map[string]interface{}{
+				"e": test.Expression,
+			})
+			if err != nil {
+				t.Fatalf("%s: %s", test.Expression, err)
+			}
+			if !reflect.DeepEqual(output, test.Collated) {
+				t.Errorf("%s: expected %v with collator, got %v", test.Expression, test.Collated, output)
+			}
+		}
+
+		// A nil collator restores the default.
+		e.SetCollator(nil)
+
+		output, err = e.Eval(data)
+		if err != nil {
+			t.Fatalf("%s: %s", test.Expression, err)
+		}
+		if !reflect.DeepEqual(output, test.Default) {
+			t.Errorf("%s: expected %v after removing collator, got %v", test.Expression, test.Default, output)
+		}
+	}
+}
+
+func TestCollatorOptimize(t *testing.T) {
+
+	// Optimize does not fold string comparisons, so the
+	// collator applies whether it is set before or after.
+	tests := []struct {
+		Expression string
+		Default    interface{}
+		Collated   interface{}
+	}{
+		{
+			Expression: `["a" < "b", "a" <= "b", "a" > "b", "a" >= "b"]`,
+			Default:    []interface{}{true, true, false, false},
+			Collated:   []interface{}{false, false, true, true},
+		},
+		{
+			Expression: `("a" & "x") < $uppercase("b") ? "less" : "not less"`,
+			Default:    "not less",
+			Collated:   "less",
+		},
+	}
+
+	for _, test := range tests {
+
+		expr := test.Expression
+
+		before := MustCompile(expr)
+		before.SetCollator(reverseCollator)
+		before.Optimize()
+
+		after := MustCompile(expr)
+		after.Optimize()
+
+		output, err := after.Eval(nil)
+		if err != nil {
+			t.Fatalf("%s: %s", expr, err)
+		}
+		if !reflect.DeepEqual(output, test.Default) {
+			t.Errorf("%s: expected %v, got %v", expr, test.Default, output)
+		}
+
+		after.SetCollator(reverseCollator)
+
+		for _, e := range []*Expr{before, after} {
+			output, err := e.Eval(nil)
+			if err != nil {
+				t.Fatalf("%s: %s", expr, err)
+			}
+			if !reflect.DeepEqual(output, test.Collated) {
+				t.Errorf("%s: expected %v with collator, got %v", expr, test.Collated, output)
+			}
+		}
+	}
+}
+
+func TestCollatorStable(t *testing.T) {
+
+	// Strings that the collator considers equal keep their
+	// order in the input, and later sort terms break ties.
+	e := MustCompile(`{
+		"sort": $sort(["b", "A", "a", "B"]),
+		"asc": items^(name).n,
+		"desc": items^(name, >n).n
+	}`)
+	e.SetCollator(func(a, b string) int {
+		return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+	})
+
+	output, err := e.Eval(map[string]interface{}{
+		"items": []interface{}{
+			map[string]interface{}{"name": "b", "n": 1.0},
+			map[string]interface{}{"name": "A", "n": 2.0},
+			map[string]interface{}{"name": "a", "n": 3.0},
+			map[string]interface{}{"name": "B", "n": 4.0},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := map[string]interface{}{
+		"sort": []interface{}{"A", "a", "b", "B"},
+		"asc":  []interface{}{2.0, 3.0, 1.0, 4.0},
+		"desc": []interface{}{3.0, 2.0, 4.0, 1.0},
+	}
+
+	if !reflect.DeepEqual(output, exp) {
+		t.Errorf("expected %v, got %v", exp, output)
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jsonata
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blues/jsonata-go/jtypes"
+)
+
+// A ValueConverter converts a value from the input data into
+// a value that JSONata understands, i.e. a string, number,
+// boolean, nil, map, slice or struct.
+type ValueConverter func(v interface{}) (interface{}, error)
+
+var (
+	convertersMutex sync.Mutex
+	converters      map[reflect.Type]ValueConverter
+
+	// converterCache maps types to their ValueConverter (or to
+	// nil if the type does not need converting).
+	converterCache sync.Map
+
+	// numConverters is the number of custom converters. It is
+	// read without a lock on every field access.
+	numConverters int32
+)
+
+var (
+	typeTime          = reflect.TypeOf(time.Time{})
+	typeRawMessage    = reflect.TypeOf(json.RawMessage(nil))
+	typeJSONMarshaler = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// RegisterValueConverter registers a function that converts
+// input values of type t before JSONata reads them. It is
+// designed to be called once on program startup (e.g. from an
+// init function).
+//
+// Without a custom converter, the following types are converted
+// in the same way as encoding/json:
+//
+//   - time.Time values become RFC 3339 strings.
+//   - json.RawMessage values are decoded.
+//   - Other types that implement json.Marshaler are encoded to
+//     JSON and then decoded.
+//
+// Types that implement fmt.Stringer are not converted unless
+// they have a custom converter (e.g. one that calls String).
+//
+// Converters apply to variables and to the values found by path
+// steps, e.g. to the Created field in the path Order.Created,
+// including the values found by the wildcard (*) and descendant
+// (**) operators.
+// Values in the input are converted when JSONata reads them, so
+// unused values are never converted.
+func RegisterValueConverter(t reflect.Type, fn ValueConverter) error {
+
+	if t == nil {
+		return errors.New("RegisterValueConverter: type cannot be nil")
+	}
+
+	if fn == nil {
+		return errors.New("RegisterValueConverter: converter cannot be nil")
+	}
+
+	convertersMutex.Lock()
+	defer convertersMutex.Unlock()
+
+	if converters == nil {
+		converters = map[reflect.Type]ValueConverter{}
+	}
+
+	converters[t] = fn
+	atomic.StoreInt32(&numConverters, int32(len(converters)))
+
+	// Clear any cached results.
+	converterCache.Range(func(k, _ interface{}) bool {
+		converterCache.Delete(k)
+		return true
+	})
+
+	return nil
+}
+
+// convertValue applies the relevant ValueConverter, if any,
+// to v. Slices whose elements need converting are converted
+// to slices of type []interface{}.
+func convertValue(v reflect.Value) (reflect.Value, error) {
+
+	r := jtypes.Resolve(v)
+	if !r.IsValid() || !r.CanInterface() {
+		return v, nil
+	}
+
+	if fn := converterFor(r.Type()); fn != nil {
+		return applyConverter(fn, r)
+	}
+
+	if r.Kind() == reflect.Slice && r.Type().Elem().Kind() != reflect.Interface {
+		if fn := converterFor(r.Type().Elem()); fn != nil {
+			return convertSlice(fn, r)
+		}
+	}
+
+	return v, nil
+}
+
+func applyConverter(fn ValueConverter, v reflect.Value) (reflect.Value, error) {
+
+	res, err := fn(v.Interface())
+	if err != nil {
+		return undefined, err
+	}
+
+	if res == nil {
+		return reflect.ValueOf(null), nil
+	}
+
+	return reflect.ValueOf(res), nil
+}
+
+func convertSlice(fn ValueConverter, v reflect.Value) (reflect.Value, error) {
+
+	results := make([]interface{}, v.Len())
+
+	for i := range results {
+		item := v.Index(i)
+		if !item.CanInterface() {
+			continue
+		}
+		res, err := fn(item.Interface())
+		if err != nil {
+			return undefined, err
+		}
+		results[i] = res
+	}
+
+	return reflect.ValueOf(results), nil
+}
+
+// converterFor returns the ValueConverter for type t, or nil
+// if values of type t do not need converting.
+func converterFor(t reflect.Type) ValueConverter {
+
+	// Fast path for types that can't have a converter, which
+	// includes the types produced by encoding/json.
+	if t.NumMethod() == 0 && t.Kind() != reflect.Struct && atomic.LoadInt32(&numConverters) == 0 {
+		return nil
+	}
+
+	if fn, ok := converterCache.Load(t); ok {
+		return fn.(ValueConverter)
+	}
+
+	fn := newConverter(t)
+	converterCache.Store(t, fn)
+	return fn
+}
+
+func newConverter(t reflect.Type) ValueConverter {
+
+	convertersMutex.Lock()
+	fn := converters[t]
+	convertersMutex.Unlock()
+
+	if fn != nil {
+		return fn
+	}
+
+	switch {
+	case t == typeTime:
+		return convertTime
+	case t == typeRawMessage:
+		return convertRawMessage
+	case t == jtypes.TypeOrderedMap.Elem(), t == jtypes.TypeDecimal.Elem():
+		// These types implement json.Marshaler but JSONata
+		// reads them directly.
+		return nil
+	case t.Implements(jtypes.TypeCallable), reflect.PtrTo(t).Implements(jtypes.TypeCallable):
+		return nil
+	case t.Implements(typeJSONMarshaler):
+		return convertMarshaler
+	case reflect.PtrTo(t).Implements(typeJSONMarshaler):
+		return func(v interface{}) (interface{}, error) {
+			p := reflect.New(t)
+			p.Elem().Set(reflect.ValueOf(v))
+			return convertMarshaler(p.Interface())
+		}
+	default:
+		return nil
+	}
+}
+
+func convertTime(v interface{}) (interface{}, error) {
+	return v.(time.Time).Format(time.RFC3339Nano), nil
+}
+
+func convertRawMessage(v interface{}) (interface{}, error) {
+	return jtypes.DecodeOrdered(json.NewDecoder(bytes.NewReader(v.(json.RawMessage))))
+}
+
+func convertMarshaler(v interface{}) (interface{}, error) {
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return jtypes.DecodeOrdered(json.NewDecoder(bytes.NewReader(b)))
+}
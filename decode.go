@@ -0,0 +1,473 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jsonata
+
+import (
+	"context"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/blues/jsonata-go/jlib"
+	"github.com/blues/jsonata-go/jtypes"
+)
+
+// EvalTo is like Eval except that it stores the result in the
+// value pointed to by out, which must be a non-nil pointer. The
+// result is copied into out directly, without being encoded to
+// JSON and decoded again, but the rules for matching values to
+// Go types are the same as encoding/json's Unmarshal:
+//
+//   - Objects are stored in structs and in maps with string or
+//     integer keys. Object keys are matched to struct fields by
+//     json tag or field name, preferring an exact match but also
+//     accepting a case-insensitive match.
+//   - Numbers are stored in any numeric type. An error is
+//     returned if the number does not fit in an integer type.
+//   - Values are stored in an empty interface as they would be
+//     by Eval.
+//   - Types that implement json.Unmarshaler or, for strings,
+//     encoding.TextUnmarshaler decode themselves.
+//
+// Type mismatches are reported as *json.UnmarshalTypeError
+// values. If the expression returns no results, EvalTo returns
+// ErrUndefined unless out is a pointer to a pointer, in which
+// case the pointer is set to nil.
+func (e *Expr) EvalTo(data interface{}, out interface{}) error {
+
+	dest := reflect.ValueOf(out)
+	if dest.Kind() != reflect.Ptr || dest.IsNil() {
+		return fmt.Errorf("EvalTo: out must be a non-nil pointer, not %T", out)
+	}
+
+	result, err := e.evalOrdered(context.Background(), data, nil)
+	if err == ErrUndefined && dest.Elem().Kind() == reflect.Ptr {
+		dest.Elem().Set(reflect.Zero(dest.Elem().Type()))
+		return nil
+	}
+	if err != nil && !isPartial(err) {
+		return err
+	}
+
+	if derr := decodeValue(result, dest.Elem(), ""); derr != nil {
+		return derr
+	}
+
+	return err
+}
+
+// decodeValue stores src, a value returned by evalOrdered, in
+// dest. The field argument is the path to dest from the root
+// of the output, for use in error messages.
+func decodeValue(src interface{}, dest reflect.Value, field string) error {
+
+	if src == nil {
+		switch dest.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice:
+			dest.Set(reflect.Zero(dest.Type()))
+		}
+		return nil
+	}
+
+	if dest.CanAddr() {
+		switch p := dest.Addr().Interface().(type) {
+		case json.Unmarshaler:
+			return decodeUnmarshaler(src, p)
+		case encoding.TextUnmarshaler:
+			if s, ok := src.(string); ok {
+				return p.UnmarshalText([]byte(s))
+			}
+		}
+	}
+
+	if dest.Kind() == reflect.Ptr {
+		if dest.IsNil() {
+			dest.Set(reflect.New(dest.Type().Elem()))
+		}
+		return decodeValue(src, dest.Elem(), field)
+	}
+
+	v := reflect.ValueOf(src)
+
+	switch dest.Kind() {
+	case reflect.Interface:
+		if dest.NumMethod() == 0 {
+			dest.Set(reflect.ValueOf(jtypes.Plain(src)))
+			return nil
+		}
+	case reflect.Bool:
+		if b, ok := jtypes.AsBool(v); ok {
+			dest.SetBool(b)
+			return nil
+		}
+	case reflect.String:
+		if s, ok := jtypes.AsString(v); ok {
+			dest.SetString(s)
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if jtypes.IsNumber(v) {
+			return decodeInt(v, dest, field)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if jtypes.IsNumber(v) {
+			return decodeUint(v, dest, field)
+		}
+	case reflect.Float32, reflect.Float64:
+		if n, ok := jtypes.AsNumber(v); ok {
+			if dest.OverflowFloat(n) {
+				return newDecodeError(v, dest, field)
+			}
+			dest.SetFloat(n)
+			return nil
+		}
+	case reflect.Slice:
+		if dest.Type().Elem().Kind() == reflect.Uint8 {
+			if s, ok := jtypes.AsString(v); ok {
+				b, err := base64.StdEncoding.DecodeString(s)
+				if err != nil {
+					return err
+				}
+				dest.SetBytes(b)
+				return nil
+			}
+		}
+		if jtypes.IsArray(v) {
+			return decodeSlice(v, dest, field)
+		}
+	case reflect.Array:
+		if jtypes.IsArray(v) {
+			return decodeArray(v, dest, field)
+		}
+	case reflect.Map:
+		if jtypes.IsMap(v) {
+			return decodeMap(v, dest, field)
+		}
+	case reflect.Struct:
+		if jtypes.IsMap(v) {
+			return decodeStruct(v, dest, field)
+		}
+	}
+
+	// Values from the input data (e.g. structs) may not be
+	// in a form that we can decode directly. Fall back to
+	// encoding/json if the type is not a basic JSON type.
+	if !isJSONType(v) {
+		b, err := json.Marshal(src)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(b, dest.Addr().Interface())
+	}
+
+	return newDecodeError(v, dest, field)
+}
+
+func decodeUnmarshaler(src interface{}, dest json.Unmarshaler) error {
+
+	b, err := json.Marshal(jtypes.Plain(src))
+	if err != nil {
+		return err
+	}
+
+	return dest.UnmarshalJSON(b)
+}
+
+func decodeInt(v reflect.Value, dest reflect.Value, field string) error {
+
+	n, ok := jtypes.AsInt64(v)
+	if !ok {
+		f, _ := jtypes.AsNumber(v)
+		if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+			return newDecodeError(v, dest, field)
+		}
+		n = int64(f)
+	}
+
+	if dest.OverflowInt(n) {
+		return newDecodeError(v, dest, field)
+	}
+
+	dest.SetInt(n)
+	return nil
+}
+
+func decodeUint(v reflect.Value, dest reflect.Value, field string) error {
+
+	var n uint64
+
+	if i, ok := jtypes.AsInt64(v); ok {
+		if i < 0 {
+			return newDecodeError(v, dest, field)
+		}
+		n = uint64(i)
+	} else if u, err := strconv.ParseUint(numberString(v), 10, 64); err == nil {
+		n = u
+	} else {
+		f, _ := jtypes.AsNumber(v)
+		if f != math.Trunc(f) || f < 0 || f >= math.MaxUint64 {
+			return newDecodeError(v, dest, field)
+		}
+		n = uint64(f)
+	}
+
+	if dest.OverflowUint(n) {
+		return newDecodeError(v, dest, field)
+	}
+
+	dest.SetUint(n)
+	return nil
+}
+
+func decodeSlice(v reflect.Value, dest reflect.Value, field string) error {
+
+	v = jtypes.Resolve(v)
+	n := v.Len()
+
+	results := reflect.MakeSlice(dest.Type(), n, n)
+
+	for i := 0; i < n; i++ {
+		if err := decodeItem(v.Index(i), results.Index(i), fmt.Sprintf("%s[%d]", field, i)); err != nil {
+			return err
+		}
+	}
+
+	dest.Set(results)
+	return nil
+}
+
+func decodeArray(v reflect.Value, dest reflect.Value, field string) error {
+
+	v = jtypes.Resolve(v)
+
+	for i := 0; i < dest.Len(); i++ {
+
+		if i >= v.Len() {
+			dest.Index(i).Set(reflect.Zero(dest.Type().Elem()))
+			continue
+		}
+
+		if err := decodeItem(v.Index(i), dest.Index(i), fmt.Sprintf("%s[%d]", field, i)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func decodeMap(v reflect.Value, dest reflect.Value, field string) error {
+
+	keyType := dest.Type().Key()
+
+	switch keyType.Kind() {
+	case reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+	default:
+		return newDecodeError(v, dest, field)
+	}
+
+	if dest.IsNil() {
+		dest.Set(reflect.MakeMapWithSize(dest.Type(), jtypes.MapLen(v)))
+	}
+
+	elemType := dest.Type().Elem()
+
+	for _, k := range jtypes.MapKeys(v) {
+
+		name, ok := jtypes.AsString(k)
+		if !ok {
+			return newDecodeError(v, dest, field)
+		}
+
+		key, err := decodeMapKey(name, keyType)
+		if err != nil {
+			return err
+		}
+
+		elem := reflect.New(elemType).Elem()
+		if err := decodeItem(jtypes.MapIndex(v, k), elem, joinField(field, name)); err != nil {
+			return err
+		}
+
+		dest.SetMapIndex(key, elem)
+	}
+
+	return nil
+}
+
+func decodeMapKey(name string, t reflect.Type) (reflect.Value, error) {
+
+	switch t.Kind() {
+	case reflect.String:
+		return reflect.ValueOf(name).Convert(t), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(name, 10, 64)
+		if err != nil || reflect.Zero(t).OverflowUint(n) {
+			return reflect.Value{}, &json.UnmarshalTypeError{Value: "number " + name, Type: t}
+		}
+		return reflect.ValueOf(n).Convert(t), nil
+	default:
+		n, err := strconv.ParseInt(name, 10, 64)
+		if err != nil || reflect.Zero(t).OverflowInt(n) {
+			return reflect.Value{}, &json.UnmarshalTypeError{Value: "number " + name, Type: t}
+		}
+		return reflect.ValueOf(n).Convert(t), nil
+	}
+}
+
+func decodeStruct(v reflect.Value, dest reflect.Value, field string) error {
+
+	fields := jtypes.StructFields(dest.Type())
+
+	for _, k := range jtypes.MapKeys(v) {
+
+		name, ok := jtypes.AsString(k)
+		if !ok {
+			continue
+		}
+
+		i := matchField(fields, name)
+		if i < 0 {
+			// Ignore keys with no matching field, like
+			// encoding/json.
+			continue
+		}
+
+		f, err := fieldForDecode(dest, fields[i].Index)
+		if err != nil {
+			return err
+		}
+
+		if err := decodeItem(jtypes.MapIndex(v, k), f, joinField(field, fields[i].Name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fieldForDecode returns the field of struct value dest with
+// the given index sequence, allocating any nil embedded pointers
+// on the way, like encoding/json.
+func fieldForDecode(dest reflect.Value, index []int) (reflect.Value, error) {
+
+	for i, x := range index {
+		if i > 0 && dest.Kind() == reflect.Ptr {
+			if dest.IsNil() {
+				if !dest.CanSet() {
+					return reflect.Value{}, fmt.Errorf("EvalTo: cannot set embedded pointer to unexported struct: %v", dest.Type().Elem())
+				}
+				dest.Set(reflect.New(dest.Type().Elem()))
+			}
+			dest = dest.Elem()
+		}
+		dest = dest.Field(x)
+	}
+
+	return dest, nil
+}
+
+// matchField returns the index of the field with the given
+// name, or -1 if there is no such field. Exact matches take
+// precedence over case-insensitive matches.
+func matchField(fields []jtypes.StructField, name string) int {
+
+	match := -1
+
+	for i := range fields {
+		if fields[i].Name == name {
+			return i
+		}
+		if match < 0 && strings.EqualFold(fields[i].Name, name) {
+			match = i
+		}
+	}
+
+	return match
+}
+
+// decodeItem decodes an array item or an object value, which
+// may be an invalid reflect.Value or a JSONata null.
+func decodeItem(v reflect.Value, dest reflect.Value, field string) error {
+
+	if !v.IsValid() || !v.CanInterface() {
+		return decodeValue(nil, dest, field)
+	}
+
+	src := v.Interface()
+	if p, ok := src.(*interface{}); ok && p == nil {
+		src = nil
+	}
+
+	return decodeValue(src, dest, field)
+}
+
+// isJSONType returns true if v is one of the types that can
+// be produced by JSONata from JSON input.
+func isJSONType(v reflect.Value) bool {
+	switch {
+	case jtypes.IsBool(v), jtypes.IsString(v), jtypes.IsNumber(v):
+		return true
+	case jtypes.IsArray(v), jtypes.IsMap(v):
+		return true
+	default:
+		return false
+	}
+}
+
+func newDecodeError(v reflect.Value, dest reflect.Value, field string) error {
+	return &json.UnmarshalTypeError{
+		Value: describeValue(v),
+		Type:  dest.Type(),
+		Field: field,
+	}
+}
+
+// describeValue returns a description of v in the format
+// used by json.UnmarshalTypeError.
+func describeValue(v reflect.Value) string {
+	switch {
+	case jtypes.IsBool(v):
+		return "bool"
+	case jtypes.IsString(v):
+		return "string"
+	case jtypes.IsNumber(v):
+		if r := jtypes.Resolve(v); r.Kind() == reflect.Float32 || r.Kind() == reflect.Float64 {
+			return "number " + jlib.NumberToString(r.Float())
+		}
+		return "number " + numberString(v)
+	case jtypes.IsArray(v):
+		return "array"
+	case jtypes.IsMap(v), jtypes.IsStruct(v):
+		return "object"
+	default:
+		return jtypes.Resolve(v).Type().String()
+	}
+}
+
+func numberString(v reflect.Value) string {
+
+	v = jtypes.Resolve(v)
+
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64)
+	default:
+		return fmt.Sprint(v.Interface())
+	}
+}
+
+func joinField(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
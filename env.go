@@ -5,10 +5,15 @@
 package jsonata
 
 import (
+	"context"
 	"errors"
 	"math"
+	"math/rand"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"unicode/utf8"
 
 	"github.com/blues/jsonata-go/jlib"
@@ -17,21 +22,193 @@ import (
 )
 
 type environment struct {
-	parent  *environment
+	parent *environment
+
+	// Most environments have a few bindings at most, e.g. the
+	// parameters of a lambda function or the variables in a
+	// block. These are stored in local to avoid allocating a
+	// map. Environments with more bindings use symbols.
+	local   [envLocalSize]binding
+	nlocal  int
 	symbols map[string]reflect.Value
+
+	// size is the expected number of bindings. It's used to
+	// size the symbols map.
+	size int
+
+	// context is the item that produced the current item
+	// in a path evaluated in tuple mode. It's used by the
+	// parent operator.
+	context *tuple
+
+	// evalState holds the settings of the evaluation that the
+	// environment belongs to. It's shared with the parent
+	// environment.
+	*evalState
+}
+
+// An evalState holds the settings of a single evaluation, e.g.
+// its options and custom operators. Every environment in an
+// evaluation shares its parent's evalState, so a field added
+// here is available to all of them, including the environments
+// created for paths evaluated in tuple mode.
+type evalState struct {
+
+	// options holds the options of the expression being
+	// evaluated. It's nil if there are no options.
+	options *EvalOptions
+
+	// ctx is the context.Context passed to Expr.EvalCtx.
+	ctx context.Context
+
+	// done is ctx.Done(), saved so that the evaluator can
+	// poll it cheaply. It's nil if ctx can never be done.
+	done <-chan struct{}
+
+	// operators holds the custom operators that the expression
+	// was compiled with.
+	operators map[string]Operator
+
+	// timestamps holds the string literals in the expression
+	// that are RFC 3339 timestamps, parsed in advance for the
+	// TemporalComparison option.
+	timestamps map[*jparse.StringNode]time.Time
+
+	// trace holds the state of the evaluation if the Expr
+	// has a trace function (see Expr.SetTrace). It's nil if
+	// tracing is off.
+	trace *tracer
+
+	// collator is the Expr's collator (see Expr.SetCollator),
+	// or nil to compare strings byte by byte.
+	collator Collator
+
+	// errs holds the errors collected by array and object
+	// constructors when the CollectErrors option is set. It's
+	// nil if errors are not being collected, including in the
+	// environments returned by abortOnError, which have their
+	// own evalState.
+	errs *[]error
+}
+
+// noEvalState is the evalState of environments that are not
+// part of an evaluation, e.g. the base environment. It must
+// not be modified.
+var noEvalState = &evalState{}
+
+// envLocalSize is the number of bindings that an environment
+// can hold without allocating a map.
+const envLocalSize = 4
+
+type binding struct {
+	name  string
+	value reflect.Value
 }
 
 func newEnvironment(parent *environment, size int) *environment {
+
+	state := noEvalState
+	if parent != nil {
+		state = parent.evalState
+	}
+
 	return &environment{
-		parent:  parent,
-		symbols: make(map[string]reflect.Value, size),
+		parent:    parent,
+		size:      size,
+		evalState: state,
+	}
+}
+
+// newContextEnv returns an environment for a tuple, which
+// records the item that the tuple was produced from.
+func newContextEnv(parent *environment, context *tuple) *environment {
+	env := newEnvironment(parent, 0)
+	env.context = context
+	return env
+}
+
+// envPool holds the environments used by previous evaluations
+// (see Expr.newEnv) so that their memory can be reused.
+var envPool = sync.Pool{
+	New: func() interface{} {
+		return &environment{}
+	},
+}
+
+// acquireEnvironment is like newEnvironment except that the
+// environment may come from envPool. Pass it to releaseEnvironment
+// when it's no longer in use.
+func acquireEnvironment(parent *environment, size int) *environment {
+
+	env := envPool.Get().(*environment)
+	env.parent = parent
+	env.size = size
+	env.evalState = noEvalState
+	if parent != nil {
+		env.evalState = parent.evalState
 	}
+
+	return env
+}
+
+// releaseEnvironment clears env and returns it to envPool. The
+// caller must ensure that nothing refers to env, e.g. a lambda
+// function defined in env or one of its descendants.
+func releaseEnvironment(env *environment) {
+
+	for i := 0; i < env.nlocal; i++ {
+		env.local[i] = binding{}
+	}
+
+	for name := range env.symbols {
+		delete(env.symbols, name)
+	}
+
+	env.parent = nil
+	env.nlocal = 0
+	env.size = 0
+	env.context = nil
+	env.evalState = nil
+
+	envPool.Put(env)
 }
 
 func (s *environment) bind(name string, value reflect.Value) {
-	if s.symbols == nil {
-		s.symbols = make(map[string]reflect.Value)
+
+	if s.symbols != nil {
+		s.symbols[name] = value
+		return
+	}
+
+	for i := 0; i < s.nlocal; i++ {
+		if s.local[i].name == name {
+			s.local[i].value = value
+			return
+		}
 	}
+
+	if s.nlocal < envLocalSize {
+		s.local[s.nlocal] = binding{
+			name:  name,
+			value: value,
+		}
+		s.nlocal++
+		return
+	}
+
+	// Move the local bindings into a map.
+	size := s.size
+	if size <= envLocalSize {
+		size = 2 * envLocalSize
+	}
+
+	s.symbols = make(map[string]reflect.Value, size)
+	for i := 0; i < s.nlocal; i++ {
+		s.symbols[s.local[i].name] = s.local[i].value
+		s.local[i] = binding{}
+	}
+	s.nlocal = 0
+
 	s.symbols[name] = value
 }
 
@@ -48,311 +225,511 @@ func (s *environment) bindAll(values map[string]reflect.Value) {
 
 func (s *environment) lookup(name string) reflect.Value {
 
-	if v, ok := s.symbols[name]; ok {
-		return v
-	}
-	if s.parent != nil {
-		return s.parent.lookup(name)
+	for env := s; env != nil; env = env.parent {
+
+		for i := 0; i < env.nlocal; i++ {
+			if env.local[i].name == name {
+				return env.local[i].value
+			}
+		}
+
+		if v, ok := env.symbols[name]; ok {
+			return v
+		}
 	}
 
 	return undefined
 }
 
-var (
-	defaultUndefinedHandler = jtypes.ArgUndefined(0)
-	defaultContextHandler   = jtypes.ArgCountEquals(0)
+// each calls fn for each binding in s, not including the
+// bindings in its ancestors.
+func (s *environment) each(fn func(string, reflect.Value)) {
 
-	argCountEquals1 = jtypes.ArgCountEquals(1)
-)
+	for i := 0; i < s.nlocal; i++ {
+		fn(s.local[i].name, s.local[i].value)
+	}
+
+	for name, value := range s.symbols {
+		fn(name, value)
+	}
+}
+
+// evalOptions returns the resource limits of the expression
+// being evaluated, or nil if there are no limits.
+func (s *environment) evalOptions() *EvalOptions {
+	if s == nil {
+		return nil
+	}
+	return s.options
+}
+
+// collectError records err if the environment is collecting
+// errors (see EvalOptions.CollectErrors) and err is specific
+// to the value being evaluated. It returns true if err was
+// recorded, in which case the caller should omit the value and
+// carry on. Limit errors and context errors are never recorded
+// because they would recur for every other value.
+func (s *environment) collectError(err error) bool {
+
+	if s == nil || s.errs == nil {
+		return false
+	}
+
+	if e, ok := err.(*EvalError); ok && e.Type == ErrLimitExceeded {
+		return false
+	}
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	*s.errs = append(*s.errs, err)
+	return true
+}
+
+// abortOnError returns an environment in which errors are not
+// collected, for evaluating expressions that determine which
+// values are evaluated, e.g. predicates and conditions.
+func (s *environment) abortOnError() *environment {
+
+	if s == nil || s.errs == nil {
+		return s
+	}
+
+	state := *s.evalState
+	state.errs = nil
+
+	env := newEnvironment(s, 0)
+	env.evalState = &state
+	return env
+}
+
+// operatorBps returns the binding powers of the custom
+// operators available in the environment, for parsing
+// expressions passed to $eval.
+func (s *environment) operatorBps() map[string]int {
+	if s == nil {
+		return nil
+	}
+	return operatorBps(s.operators)
+}
+
+// evalCtx returns the context.Context of the evaluation, or
+// context.Background() if there isn't one.
+func (s *environment) evalCtx() context.Context {
+	if s == nil || s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// checkDone returns the context's error if the evaluation's
+// context.Context is done, and nil otherwise.
+func (s *environment) checkDone() error {
+
+	if s == nil || s.done == nil {
+		return nil
+	}
+
+	select {
+	case <-s.done:
+		return s.ctx.Err()
+	default:
+		return nil
+	}
+}
+
+// lookupContext returns the item that produced the current
+// item in a path, i.e. the parent of the current item.
+func (s *environment) lookupContext() (*tuple, bool) {
+
+	for env := s; env != nil; env = env.parent {
+		if env.context == noContext {
+			return nil, false
+		}
+		if env.context != nil {
+			return env.context, true
+		}
+	}
+
+	return nil, false
+}
+
+// noContext is used as the context of an environment whose
+// item is known to have no parent. It stops lookupContext from
+// searching the environment's ancestors.
+var noContext = &tuple{}
+
+var defaultUndefinedArgs = jtypes.ArgUndefinedAny(0)
 
 var baseEnv = initBaseEnv(map[string]Extension{
 
 	// String functions
 
 	"string": {
-		Func:               jlib.String,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: defaultContextHandler,
+		Func:          jlib.String,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<x:s>",
+		ApplyContext:  true,
 	},
 	"length": {
-		Func:               utf8.RuneCountInString,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: defaultContextHandler,
+		Func:          utf8.RuneCountInString,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<s:n>",
+		ApplyContext:  true,
 	},
 	"substring": {
-		Func:               jlib.Substring,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: contextHandlerSubstring,
+		Func:          jlib.Substring,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<snn?:s>",
+		ApplyContext:  true,
 	},
 	"substringBefore": {
-		Func:               jlib.SubstringBefore,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: contextHandlerSubstringBeforeAfter,
+		Func:          jlib.SubstringBefore,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<ss:s>",
+		ApplyContext:  true,
 	},
 	"substringAfter": {
-		Func:               jlib.SubstringAfter,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: contextHandlerSubstringBeforeAfter,
+		Func:          jlib.SubstringAfter,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<ss:s>",
+		ApplyContext:  true,
 	},
 	"uppercase": {
-		Func:               strings.ToUpper,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: defaultContextHandler,
+		Func:          strings.ToUpper,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<s:s>",
+		ApplyContext:  true,
 	},
 	"lowercase": {
-		Func:               strings.ToLower,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: defaultContextHandler,
+		Func:          strings.ToLower,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<s:s>",
+		ApplyContext:  true,
 	},
 	"pad": {
-		Func:               jlib.Pad,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: contextHandlerPad,
+		Func:          jlib.Pad,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<sns?:s>",
+		ApplyContext:  true,
 	},
 	"trim": {
-		Func:               jlib.Trim,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: defaultContextHandler,
+		Func:          jlib.Trim,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<s:s>",
+		ApplyContext:  true,
 	},
 	"contains": {
-		Func:               jlib.Contains,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: argCountEquals1,
+		Func:          jlib.Contains,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<s(sf):b>",
+		ApplyContext:  true,
 	},
 	"split": {
-		Func:               jlib.Split,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: contextHandlerSplit,
+		Func:          jlib.Split,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<s(sf)n?:a<s>>",
+		ApplyContext:  true,
 	},
 	"join": {
-		Func:               jlib.Join,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: nil,
+		Func:          jlib.Join,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<a<s>s?:s>",
 	},
 	"match": {
-		Func:               jlib.Match,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: contextHandlerMatch,
+		Func:          jlib.Match,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<sf<s:o>n?:a<o>>",
+		ApplyContext:  true,
 	},
 	"replace": {
-		Func:               jlib.Replace,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: contextHandlerReplace,
+		Func:          jlib.Replace,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<s(sf)(sf)n?:s>",
+		ApplyContext:  true,
 	},
 	"formatNumber": {
-		Func:               jlib.FormatNumber,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: contextHandlerFormatNumber,
+		Func:          jlib.FormatNumber,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<nso?:s>",
+		ApplyContext:  true,
 	},
 	"formatBase": {
-		Func:               jlib.FormatBase,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: defaultContextHandler,
+		Func:          jlib.FormatBase,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<nn?:s>",
+		ApplyContext:  true,
+	},
+	"formatInteger": {
+		Func:          jlib.FormatInteger,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<ns:s>",
+		ApplyContext:  true,
+	},
+	"parseInteger": {
+		Func:          jlib.ParseInteger,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<ss:n>",
+		ApplyContext:  true,
 	},
 	"base64encode": {
-		Func:               jlib.Base64Encode,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: defaultContextHandler,
+		Func:          jlib.Base64Encode,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<s:s>",
+		ApplyContext:  true,
 	},
 	"base64decode": {
-		Func:               jlib.Base64Decode,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: defaultContextHandler,
+		Func:          jlib.Base64Decode,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<s:s>",
+		ApplyContext:  true,
 	},
 	"decodeUrl": {
-		Func:               jlib.DecodeURL,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: defaultContextHandler,
+		Func:          jlib.DecodeURL,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<s:s>",
+		ApplyContext:  true,
 	},
 	"decodeUrlComponent": {
-		Func:               jlib.DecodeURL,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: defaultContextHandler,
+		Func:          jlib.DecodeURLComponent,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<s:s>",
+		ApplyContext:  true,
 	},
 	"encodeUrl": {
-		Func:               jlib.EncodeURL,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: defaultContextHandler,
+		Func:          jlib.EncodeURL,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<s:s>",
+		ApplyContext:  true,
 	},
 	"encodeUrlComponent": {
-		Func:               jlib.EncodeURLComponent,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: defaultContextHandler,
+		Func:          jlib.EncodeURLComponent,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<s:s>",
+		ApplyContext:  true,
 	},
 
 	// Number functions
 
 	"number": {
-		Func:               jlib.Number,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: defaultContextHandler,
+		Func:          jlib.Number,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<(nsb):n>",
+		ApplyContext:  true,
 	},
 	"abs": {
-		Func:               math.Abs,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: defaultContextHandler,
+		Func:          math.Abs,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<n:n>",
+		ApplyContext:  true,
 	},
 	"floor": {
-		Func:               math.Floor,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: defaultContextHandler,
+		Func:          math.Floor,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<n:n>",
+		ApplyContext:  true,
 	},
 	"ceil": {
-		Func:               math.Ceil,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: defaultContextHandler,
+		Func:          math.Ceil,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<n:n>",
+		ApplyContext:  true,
 	},
 	"round": {
-		Func:               jlib.Round,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: defaultContextHandler,
+		Func:          jlib.Round,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<nn?:n>",
+		ApplyContext:  true,
 	},
 	"power": {
-		Func:               jlib.Power,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: argCountEquals1,
+		Func:          jlib.Power,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<nn:n>",
+		ApplyContext:  true,
 	},
 	"sqrt": {
-		Func:               jlib.Sqrt,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: defaultContextHandler,
+		Func:          jlib.Sqrt,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<n:n>",
+		ApplyContext:  true,
 	},
 	"random": {
-		Func:               jlib.Random,
-		UndefinedHandler:   nil,
-		EvalContextHandler: nil,
+		Func:          jlib.Random,
+		UndefinedArgs: nil,
+		Signature:     "<:n>",
 	},
+	"uuid": {
+		Func:          jlib.UUID,
+		UndefinedArgs: nil,
+		Signature:     "<:s>",
+	},
+	"config": configExtension(nil),
 
 	// Number aggregation functions
 
 	"sum": {
-		Func:               jlib.Sum,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: nil,
+		Func:          jlib.Sum,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<a<n>:n>",
 	},
 	"max": {
-		Func:               jlib.Max,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: nil,
+		Func:          jlib.Max,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<a<n>:n>",
 	},
 	"min": {
-		Func:               jlib.Min,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: nil,
+		Func:          jlib.Min,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<a<n>:n>",
 	},
 	"average": {
-		Func:               jlib.Average,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: nil,
+		Func:          jlib.Average,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<a<n>:n>",
 	},
 
 	// Boolean functions
 
 	"boolean": {
-		Func:               jlib.Boolean,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: defaultContextHandler,
+		Func:          jlib.Boolean,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<x:b>",
+		ApplyContext:  true,
 	},
 	"not": {
-		Func:               jlib.Not,
-		UndefinedHandler:   nil,
-		EvalContextHandler: defaultContextHandler,
+		Func:          jlib.Not,
+		UndefinedArgs: nil,
+		Signature:     "<x:b>",
+		ApplyContext:  true,
 	},
 	"exists": {
-		Func:               jlib.Exists,
-		UndefinedHandler:   nil,
-		EvalContextHandler: nil,
+		Func:          jlib.Exists,
+		UndefinedArgs: nil,
+		Signature:     "<x:b>",
+	},
+	"isNull": {
+		Func:          jlib.IsNull,
+		UndefinedArgs: nil,
+		Signature:     "<x:b>",
 	},
 
 	// Array functions
 
 	"distinct": {
-		Func:               jlib.Distinct,
-		UndefinedHandler:   nil,
-		EvalContextHandler: nil,
+		Func:          jlib.Distinct,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<x:x>",
 	},
 	"count": {
-		Func:               jlib.Count,
-		UndefinedHandler:   nil,
-		EvalContextHandler: nil,
+		Func:          jlib.Count,
+		UndefinedArgs: nil,
+		Signature:     "<a:n>",
 	},
 	"reverse": {
-		Func:               jlib.Reverse,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: nil,
+		Func:          jlib.Reverse,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<a:a>",
 	},
 	"sort": {
-		Func:               jlib.Sort,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: nil,
+		Func:          jlib.Sort,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<af?:a>",
 	},
 	"shuffle": {
-		Func:               jlib.Shuffle,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: nil,
+		Func:          jlib.Shuffle,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<a:a>",
 	},
 	"zip": {
-		Func:               jlib.Zip,
-		UndefinedHandler:   nil,
-		EvalContextHandler: nil,
+		Func:          jlib.Zip,
+		UndefinedArgs: nil,
+		Signature:     "<a+>",
 	},
 	"append": {
-		Func:               jlib.Append,
-		UndefinedHandler:   undefinedHandlerAppend,
-		EvalContextHandler: nil,
+		Func:          jlib.Append,
+		UndefinedArgs: jtypes.ArgsAllUndefined(),
+		Signature:     "<xx:a>",
 	},
 	"map": {
-		Func:               jlib.Map,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: nil,
+		Func:          jlib.Map,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<af>",
 	},
 	"filter": {
-		Func:               jlib.Filter,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: nil,
+		Func:          jlib.Filter,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<af>",
 	},
 	"reduce": {
-		Func:               jlib.Reduce,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: nil,
+		Func:          jlib.Reduce,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<afj?:j>",
 	},
 	"single": {
-		Func:               jlib.Single,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: nil,
+		Func:          jlib.Single,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<af>",
+	},
+	"memoize": {
+		Func:          memoize,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<f:f>",
 	},
 
 	// Object functions
 
 	"each": {
-		Func:               jlib.Each,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: defaultContextHandler,
+		Func:          jlib.Each,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<of:a>",
+		ApplyContext:  true,
 	},
 	"sift": {
-		Func:               jlib.Sift,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: argCountEquals1,
+		Func:          jlib.Sift,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<of:o>",
+		ApplyContext:  true,
 	},
 	"keys": {
-		Func:               jlib.Keys,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: defaultContextHandler,
+		Func:          jlib.Keys,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<x:a<s>>",
+		ApplyContext:  true,
 	},
 	"lookup": {
-		Func:               lookup,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: defaultContextHandler,
+		Func:          lookup,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<xs:x>",
+		ApplyContext:  true,
 	},
 	"spread": {
-		Func:               jlib.Spread,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: defaultContextHandler,
+		Func:          jlib.Spread,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<x:a<o>>",
+		ApplyContext:  true,
 	},
 	"merge": {
-		Func:               jlib.Merge,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: nil,
+		Func:          jlib.Merge,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<a<o>o?:o>",
+	},
+	"clone": {
+		Func:          jlib.Clone,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<x:x>",
+		ApplyContext:  true,
+	},
+	"copy": {
+		Func:          jlib.Clone,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<x:x>",
+		ApplyContext:  true,
+	},
+	"deepEqual": {
+		Func:          jlib.DeepEqual,
+		UndefinedArgs: nil,
+		Signature:     "<xx:b>",
 	},
 
 	// Date functions
@@ -362,31 +739,68 @@ var baseEnv = initBaseEnv(map[string]Extension{
 	// runtime.
 
 	"fromMillis": {
-		Func:               jlib.FromMillis,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: defaultContextHandler,
+		Func:          jlib.FromMillis,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<ns?s?:s>",
+		ApplyContext:  true,
 	},
 	"toMillis": {
-		Func:               jlib.ToMillis,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: defaultContextHandler,
+		Func:          jlib.ToMillis,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<ss?s?:n>",
+		ApplyContext:  true,
 	},
 
 	"type": {
-		Func:               jlib.TypeOf,
-		UndefinedHandler:   defaultUndefinedHandler,
-		EvalContextHandler: defaultContextHandler,
+		Func:          jlib.TypeOf,
+		UndefinedArgs: defaultUndefinedArgs,
+		Signature:     "<x:s>",
+		ApplyContext:  true,
 	},
 
 	// Misc functions
 
 	"error": {
-		Func:               throw,
-		UndefinedHandler:   nil,
-		EvalContextHandler: nil,
+		Func:          throw,
+		UndefinedArgs: nil,
+		Signature:     "<s?:x>",
+	},
+	"assert": {
+		Func:          assert,
+		UndefinedArgs: nil,
+		Signature:     "<bs?:x>",
 	},
 })
 
+// CryptoExts returns the hashing and encoding functions $sha256,
+// $sha1, $md5, $hexEncode, $hexDecode, $base64urlEncode and
+// $base64urlDecode. Each one takes a single string. The hash
+// functions return their results as lowercase hex strings.
+//
+// These functions are not part of JSONata, so they are not
+// available by default. To use them, register the returned
+// map with RegisterExts, Expr.RegisterExts or CompileWithExts.
+func CryptoExts() map[string]Extension {
+
+	exts := map[string]Extension{
+		"sha256":          {Func: jlib.SHA256},
+		"sha1":            {Func: jlib.SHA1},
+		"md5":             {Func: jlib.MD5},
+		"hexEncode":       {Func: jlib.HexEncode},
+		"hexDecode":       {Func: jlib.HexDecode},
+		"base64urlEncode": {Func: jlib.Base64URLEncode},
+		"base64urlDecode": {Func: jlib.Base64URLDecode},
+	}
+
+	for name, ext := range exts {
+		ext.UndefinedArgs = defaultUndefinedArgs
+		ext.Signature = "<s-:s>"
+		exts[name] = ext
+	}
+
+	return exts
+}
+
 func initBaseEnv(exts map[string]Extension) *environment {
 
 	env := newEnvironment(nil, len(exts))
@@ -419,121 +833,205 @@ func lookup(v reflect.Value, name string) (interface{}, error) {
 	}
 
 	if seq, ok := asSequence(res); ok {
-		res = seq.Value()
+		// When v is an array, jsonata-js flattens the values
+		// found in each element into a single sequence.
+		flat := flattenArray(reflect.ValueOf(seq.values))
+		switch flat.Len() {
+		case 0:
+			res = undefined
+		case 1:
+			res = flat.Index(0)
+		default:
+			res = flat
+		}
 	}
 
 	if res.IsValid() && res.CanInterface() {
 		return res.Interface(), nil
 	}
 
-	return nil, nil
+	return nil, jtypes.ErrUndefined
 }
 
-func throw(msg string) (interface{}, error) {
-	return nil, errors.New(msg)
+// memoize returns a Callable that caches the results of fn.
+func memoize(fn jtypes.Callable) jtypes.Callable {
+	return newMemoCallable(fn)
 }
 
-// Undefined handlers
-
-func undefinedHandlerAppend(argv []reflect.Value) bool {
-	return len(argv) == 2 && argv[0] == undefined && argv[1] == undefined
+func throw(msg jtypes.OptionalString) (interface{}, error) {
+	if !msg.IsSet() {
+		return nil, newUserError("$error() function evaluated")
+	}
+	return nil, newUserError(msg.String)
 }
 
-// Context handlers
-
-func contextHandlerSubstring(argv []reflect.Value) bool {
-
-	// If substring() is called with one or two numeric arguments,
-	// use the evaluation context as the first argument.
-	switch len(argv) {
-	case 1:
-		return jtypes.IsNumber(argv[0])
-	case 2:
-		return jtypes.IsNumber(argv[0]) && jtypes.IsNumber(argv[1])
-	default:
-		return false
+func assert(cond bool, msg jtypes.OptionalString) (interface{}, error) {
+	if cond {
+		return nil, jtypes.ErrUndefined
+	}
+	if !msg.IsSet() {
+		return nil, newUserError("$assert() statement failed")
 	}
+	return nil, newUserError(msg.String)
 }
 
-func contextHandlerSubstringBeforeAfter(argv []reflect.Value) bool {
-
-	// If subStringBefore() or subStringAfter() are called with
-	// one string argument, use the evaluation context as the first
-	// argument.
-	return len(argv) == 1 && jtypes.IsString(argv[0])
-}
+// overrideCallables returns replacements for any built-in
+// functions whose behaviour depends on the given options, e.g.
+// functions that must check limits before they allocate their
+// results.
+func overrideCallables(opts EvalOptions) map[string]reflect.Value {
+
+	callables := map[string]reflect.Value{}
+
+	padFunc := jlib.Pad
+
+	if opts.Graphemes {
+		padFunc = jlib.PadGraphemes
+
+		callables["length"] = reflect.ValueOf(mustGoCallable("length", Extension{
+			Func:          jlib.GraphemeLength,
+			UndefinedArgs: defaultUndefinedArgs,
+			Signature:     "<s:n>",
+			ApplyContext:  true,
+		}))
+
+		callables["substring"] = reflect.ValueOf(mustGoCallable("substring", Extension{
+			Func:          jlib.SubstringGraphemes,
+			UndefinedArgs: defaultUndefinedArgs,
+			Signature:     "<snn?:s>",
+			ApplyContext:  true,
+		}))
+
+		callables["pad"] = reflect.ValueOf(mustGoCallable("pad", Extension{
+			Func:          jlib.PadGraphemes,
+			UndefinedArgs: defaultUndefinedArgs,
+			Signature:     "<sns?:s>",
+			ApplyContext:  true,
+		}))
+	}
 
-func contextHandlerPad(argv []reflect.Value) bool {
+	if opts.MaxStringLength > 0 {
+
+		max := opts.MaxStringLength
+
+		callables["pad"] = reflect.ValueOf(mustGoCallable("pad", Extension{
+			Func: func(s string, width int, chars jtypes.OptionalString) (string, error) {
+				if width > max || -width > max {
+					return "", newLimitError("MaxStringLength", max)
+				}
+				return padFunc(s, width, chars), nil
+			},
+			UndefinedArgs: defaultUndefinedArgs,
+			Signature:     "<sns?:s>",
+			ApplyContext:  true,
+		}))
+	}
 
-	// If pad() is called with a single number, or a number and
-	// a string, use the evaluation context as the first argument.
-	switch len(argv) {
-	case 1:
-		return jtypes.IsNumber(argv[0])
-	case 2:
-		return jtypes.IsNumber(argv[0]) && jtypes.IsString(argv[1])
-	default:
-		return false
+	if len(callables) == 0 {
+		return nil
 	}
-}
 
-func contextHandlerSplit(argv []reflect.Value) bool {
+	return callables
+}
 
-	// If split() is called with a single string/regex, or a
-	// string/regex and a number, use the evaluation context as
-	// the first argument.
-	switch len(argv) {
-	case 1:
-		return isStringOrCallable(argv[0])
-	case 2:
-		return isStringOrCallable(argv[0]) && jtypes.IsNumber(argv[1])
-	default:
-		return false
+// randomCallables returns replacements for the built-in
+// functions that use random numbers. The replacements draw
+// their numbers from src.
+func randomCallables(src rand.Source) map[string]reflect.Value {
+
+	r := rand.New(&lockedSource{src: src})
+
+	return map[string]reflect.Value{
+		"random": reflect.ValueOf(mustGoCallable("random", Extension{
+			Func: func() float64 {
+				return jlib.RandomFrom(r)
+			},
+			Signature: "<:n>",
+		})),
+		"shuffle": reflect.ValueOf(mustGoCallable("shuffle", Extension{
+			Func: func(v reflect.Value) interface{} {
+				return jlib.ShuffleFrom(v, r)
+			},
+			UndefinedArgs: defaultUndefinedArgs,
+			Signature:     "<a:a>",
+		})),
+		"uuid": reflect.ValueOf(mustGoCallable("uuid", Extension{
+			Func: func() string {
+				return jlib.UUIDFrom(r)
+			},
+			Signature: "<:s>",
+		})),
 	}
 }
 
-func contextHandlerMatch(argv []reflect.Value) bool {
-
-	// If match() is called with a single regex, or a regex and
-	// a number, use the evaluation context as the first argument.
-	switch len(argv) {
-	case 1:
-		return jtypes.IsCallable(argv[0])
-	case 2:
-		return jtypes.IsCallable(argv[0]) && jtypes.IsNumber(argv[1])
-	default:
-		return false
+// configExtension returns the $config function for the given
+// configuration (see Expr.SetConfig).
+func configExtension(config interface{}) Extension {
+	return Extension{
+		Func: func(path jtypes.OptionalString) (interface{}, error) {
+			return lookupConfig(config, path.String)
+		},
+		Signature: "<s?:x>",
 	}
 }
 
-func contextHandlerReplace(argv []reflect.Value) bool {
+// lookupConfig returns a copy of the value at a dotted path
+// in a configuration object. Numeric path segments index into
+// arrays. An empty path returns the whole configuration.
+func lookupConfig(config interface{}, path string) (interface{}, error) {
+
+	v := reflect.ValueOf(config)
+
+	if path != "" {
+		for _, key := range strings.Split(path, ".") {
+
+			v = jtypes.Resolve(v)
+
+			switch {
+			case jtypes.IsMap(v):
+				v = jtypes.MapIndex(v, reflect.ValueOf(key))
+			case jtypes.IsArray(v):
+				i, err := strconv.Atoi(key)
+				if err != nil || i < 0 || i >= v.Len() {
+					return nil, jtypes.ErrUndefined
+				}
+				v = v.Index(i)
+			default:
+				return nil, jtypes.ErrUndefined
+			}
+
+			if !v.IsValid() {
+				return nil, jtypes.ErrUndefined
+			}
+		}
+	}
 
-	// If replace() is called with a string/regex and a string/Callable,
-	// or a string/regex, a string/Callable, and a number, use the
-	// evaluation context as the first argument.
-	switch len(argv) {
-	case 2:
-		return isStringOrCallable(argv[0]) && isStringOrCallable(argv[1])
-	case 3:
-		return isStringOrCallable(argv[0]) && isStringOrCallable(argv[1]) && jtypes.IsNumber(argv[2])
-	default:
-		return false
+	if !v.IsValid() {
+		return nil, jtypes.ErrUndefined
 	}
+
+	// Return a copy so that the expression cannot modify the
+	// configuration, which is shared by all evaluations.
+	return jlib.Clone(v)
 }
 
-func contextHandlerFormatNumber(argv []reflect.Value) bool {
+// A lockedSource is a rand.Source that is safe for concurrent
+// use. Like the source used by the top level functions in the
+// math/rand package, it guards the underlying Source with a
+// mutex.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
 
-	// If formatNumber() is called with one or two arguments, and
-	// the first argument is a string, use the evaluation context
-	// as the first argument.
-	switch len(argv) {
-	case 1, 2:
-		return jtypes.IsString(argv[0])
-	default:
-		return false
-	}
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
 }
 
-func isStringOrCallable(v reflect.Value) bool {
-	return jtypes.IsString(v) || jtypes.IsCallable(v)
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
 }
@@ -8,7 +8,10 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"strconv"
+	"strings"
 
+	"github.com/blues/jsonata-go/jparse"
 	"github.com/blues/jsonata-go/jtypes"
 )
 
@@ -47,29 +50,69 @@ const (
 	ErrIllegalDelete
 	ErrNonSortable
 	ErrSortMismatch
+	ErrEvalParse
+	ErrNoParent
+	ErrLimitExceeded
+	ErrNonStringKey
+	ErrUnparseableTimestamp
+	ErrMethodCall
 )
 
 var errmsgs = map[ErrType]string{
-	ErrNonIntegerLHS:      `left side of the "{{value}}" operator must evaluate to an integer`,
-	ErrNonIntegerRHS:      `right side of the "{{value}}" operator must evaluate to an integer`,
-	ErrNonNumberLHS:       `left side of the "{{value}}" operator must evaluate to a number`,
-	ErrNonNumberRHS:       `right side of the "{{value}}" operator must evaluate to a number`,
-	ErrNonComparableLHS:   `left side of the "{{value}}" operator must evaluate to a number or string`,
-	ErrNonComparableRHS:   `right side of the "{{value}}" operator must evaluate to a number or string`,
-	ErrTypeMismatch:       `both sides of the "{{value}}" operator must have the same type`,
-	ErrNonCallable:        `cannot call non-function {{token}}`,
-	ErrNonCallableApply:   `cannot use function application with non-function {{token}}`,
-	ErrNonCallablePartial: `cannot partially apply non-function {{token}}`,
-	ErrNumberInf:          `result of the "{{value}}" operator is out of range`,
-	ErrNumberNaN:          `result of the "{{value}}" operator is not a valid number`,
-	ErrMaxRangeItems:      `range operator has too many items`,
-	ErrIllegalKey:         `object key {{token}} does not evaluate to a string`,
-	ErrDuplicateKey:       `multiple object keys evaluate to the value "{{value}}"`,
-	ErrClone:              `object transformation: cannot make a copy of the object`,
-	ErrIllegalUpdate:      `the insert/update clause of an object transformation must evaluate to an object`,
-	ErrIllegalDelete:      `the delete clause of an object transformation must evaluate to an array of strings`,
-	ErrNonSortable:        `expressions in a sort term must evaluate to strings or numbers`,
-	ErrSortMismatch:       `expressions in a sort term must have the same type`,
+	ErrNonIntegerLHS:        `left side of the "{{value}}" operator must evaluate to an integer`,
+	ErrNonIntegerRHS:        `right side of the "{{value}}" operator must evaluate to an integer`,
+	ErrNonNumberLHS:         `left side of the "{{value}}" operator must evaluate to a number`,
+	ErrNonNumberRHS:         `right side of the "{{value}}" operator must evaluate to a number`,
+	ErrNonComparableLHS:     `left side of the "{{value}}" operator must evaluate to a number or string`,
+	ErrNonComparableRHS:     `right side of the "{{value}}" operator must evaluate to a number or string`,
+	ErrTypeMismatch:         `both sides of the "{{value}}" operator must have the same type`,
+	ErrNonCallable:          `cannot call non-function {{token}}`,
+	ErrNonCallableApply:     `cannot use function application with non-function {{token}}`,
+	ErrNonCallablePartial:   `cannot partially apply non-function {{token}}`,
+	ErrNumberInf:            `result of the "{{value}}" operator is out of range`,
+	ErrNumberNaN:            `result of the "{{value}}" operator is not a valid number`,
+	ErrMaxRangeItems:        `range operator has too many items`,
+	ErrIllegalKey:           `object key {{token}} does not evaluate to a string`,
+	ErrDuplicateKey:         `multiple object keys evaluate to the value "{{value}}"`,
+	ErrClone:                `object transformation: cannot make a copy of the object`,
+	ErrIllegalUpdate:        `the insert/update clause of an object transformation must evaluate to an object`,
+	ErrIllegalDelete:        `the delete clause of an object transformation must evaluate to an array of strings`,
+	ErrNonSortable:          `expressions in a sort term must evaluate to strings or numbers`,
+	ErrSortMismatch:         `expressions in a sort term must have the same type`,
+	ErrEvalParse:            `function {{token}} could not parse its expression: {{value}}`,
+	ErrNoParent:             `the parent operator cannot be used here: the current context has no parent`,
+	ErrLimitExceeded:        `evaluation exceeded the {{token}} limit of {{value}}`,
+	ErrNonStringKey:         `object key of type {{value}} cannot be converted to a string`,
+	ErrUnparseableTimestamp: `could not parse timestamp "{{value}}"`,
+	ErrMethodCall:           `method {{token}} returned an error: {{value}}`,
+}
+
+// errcodes maps error types to the equivalent jsonata-js error
+// codes. Error types with no jsonata-js equivalent are omitted.
+var errcodes = map[ErrType]string{
+	ErrNonIntegerLHS:        "T2003",
+	ErrNonIntegerRHS:        "T2004",
+	ErrNonNumberLHS:         "T2001",
+	ErrNonNumberRHS:         "T2002",
+	ErrNonComparableLHS:     "T2010",
+	ErrNonComparableRHS:     "T2010",
+	ErrTypeMismatch:         "T2009",
+	ErrNonCallable:          "T1006",
+	ErrNonCallableApply:     "T2006",
+	ErrNonCallablePartial:   "T1008",
+	ErrNumberInf:            "D1001",
+	ErrNumberNaN:            "D1001",
+	ErrMaxRangeItems:        "D2014",
+	ErrIllegalKey:           "T1003",
+	ErrDuplicateKey:         "D1009",
+	ErrIllegalUpdate:        "T2011",
+	ErrIllegalDelete:        "T2012",
+	ErrNonSortable:          "T2008",
+	ErrSortMismatch:         "T2007",
+	ErrEvalParse:            "D3120",
+	ErrNoParent:             "S0217",
+	ErrNonStringKey:         "T1003",
+	ErrUnparseableTimestamp: "D3110",
 }
 
 var reErrMsg = regexp.MustCompile("{{(token|value)}}")
@@ -80,6 +123,20 @@ type EvalError struct {
 	Type  ErrType
 	Token string
 	Value string
+
+	// Item is the position, starting from 1, of the input item
+	// that caused the error. It is only set for errors of type
+	// ErrDuplicateKey where the key was produced by evaluating
+	// an expression against the items in an object constructor's
+	// input. It is zero otherwise.
+	Item int
+
+	// Position is the byte offset in the expression of the
+	// start of the part of the expression that caused the error,
+	// e.g. the operand of a numeric operator that did not
+	// evaluate to a number. It is zero if the error cannot be
+	// traced to a part of the expression.
+	Position int
 }
 
 func newEvalError(typ ErrType, token interface{}, value interface{}) *EvalError {
@@ -95,11 +152,61 @@ func newEvalError(typ ErrType, token interface{}, value interface{}) *EvalError
 		}
 	}
 
-	return &EvalError{
+	err := &EvalError{
 		Type:  typ,
 		Token: stringify(token),
 		Value: stringify(value),
 	}
+
+	if node, ok := token.(jparse.Node); ok {
+		err.Position = jparse.SpanOf(node).Start
+	}
+
+	return err
+}
+
+// newEvalErrorAt is like newEvalError except that it takes the
+// error's position from node. It is used for errors whose token
+// is not a node, or which have no token.
+func newEvalErrorAt(node jparse.Node, typ ErrType, token interface{}, value interface{}) *EvalError {
+	err := newEvalError(typ, token, value)
+	err.Position = jparse.SpanOf(node).Start
+	return err
+}
+
+// newDuplicateKeyError returns an error of type ErrDuplicateKey
+// for the given key. item is the position of the input item that
+// produced the key, or zero if the key is a string literal.
+func newDuplicateKeyError(token interface{}, key string, item int) *EvalError {
+	err := newEvalError(ErrDuplicateKey, token, key)
+	err.Item = item
+	return err
+}
+
+// newLimitError returns an error of type ErrLimitExceeded for
+// the named EvalOptions limit.
+func newLimitError(name string, limit int) *EvalError {
+	return newEvalError(ErrLimitExceeded, name, strconv.Itoa(limit))
+}
+
+// newKeyTypeError returns an error of type ErrNonStringKey
+// for a Go map key of the named type. pos is the position in
+// the expression of the operation that needed the key as a
+// string.
+func newKeyTypeError(typ string, pos int) *EvalError {
+	err := newEvalError(ErrNonStringKey, nil, typ)
+	err.Position = pos
+	return err
+}
+
+// newTimestampError returns an error of type
+// ErrUnparseableTimestamp for a string that a function could
+// not parse as a timestamp. pos is the position in the
+// expression of the function call.
+func newTimestampError(s string, pos int) *EvalError {
+	err := newEvalError(ErrUnparseableTimestamp, nil, s)
+	err.Position = pos
+	return err
 }
 
 func (e EvalError) Error() string {
@@ -109,7 +216,7 @@ func (e EvalError) Error() string {
 		return fmt.Sprintf("EvalError: unknown error type %d", e.Type)
 	}
 
-	return reErrMsg.ReplaceAllStringFunc(s, func(match string) string {
+	s = reErrMsg.ReplaceAllStringFunc(s, func(match string) string {
 		switch match {
 		case "{{token}}":
 			return e.Token
@@ -119,6 +226,19 @@ func (e EvalError) Error() string {
 			return match
 		}
 	})
+
+	if e.Item > 0 {
+		s += fmt.Sprintf(" (input item %d)", e.Item)
+	}
+
+	return s
+}
+
+// Code returns the jsonata-js error code for this error, e.g.
+// "T2001". It returns an empty string if jsonata-js has no
+// equivalent error.
+func (e EvalError) Code() string {
+	return errcodes[e.Type]
 }
 
 // ArgCountError is returned by the evaluation methods when an
@@ -128,6 +248,11 @@ type ArgCountError struct {
 	Func     string
 	Expected int
 	Received int
+
+	// Position is the byte offset in the expression of the
+	// start of the function call. It is zero if the position
+	// is unknown.
+	Position int
 }
 
 func newArgCountError(f jtypes.Callable, received int) *ArgCountError {
@@ -142,12 +267,32 @@ func (e ArgCountError) Error() string {
 	return fmt.Sprintf("function %q takes %d argument(s), got %d", e.Func, e.Expected, e.Received)
 }
 
+// Code returns the jsonata-js error code for this error.
+func (e ArgCountError) Code() string {
+	return "T0410"
+}
+
 // ArgTypeError is returned by the evaluation methods when an
 // expression contains a function call with the wrong argument
 // type.
 type ArgTypeError struct {
 	Func  string
 	Which int
+
+	// Context is true if the argument is the evaluation
+	// context, which was used in place of a missing argument.
+	Context bool
+
+	// ArrayOf is set if the function expects an array whose
+	// items have a particular type and the argument is an array
+	// with items of a different type. It describes the expected
+	// type, e.g. "numbers".
+	ArrayOf string
+
+	// Position is the byte offset in the expression of the
+	// start of the function call. It is zero if the position
+	// is unknown.
+	Position int
 }
 
 func newArgTypeError(f jtypes.Callable, which int) *ArgTypeError {
@@ -158,5 +303,198 @@ func newArgTypeError(f jtypes.Callable, which int) *ArgTypeError {
 }
 
 func (e ArgTypeError) Error() string {
-	return fmt.Sprintf("argument %d of function %q does not match function signature", e.Which, e.Func)
+	switch {
+	case e.Context:
+		return fmt.Sprintf("context value is not a compatible type with argument %d of function %q", e.Which, e.Func)
+	case e.ArrayOf != "":
+		return fmt.Sprintf("argument %d of function %q must be an array of %s", e.Which, e.Func, e.ArrayOf)
+	default:
+		return fmt.Sprintf("argument %d of function %q does not match function signature", e.Which, e.Func)
+	}
+}
+
+// Code returns the jsonata-js error code for this error.
+func (e ArgTypeError) Code() string {
+	switch {
+	case e.Context:
+		return "T0411"
+	case e.ArrayOf != "":
+		return "T0412"
+	default:
+		return "T0410"
+	}
+}
+
+// arrayTypeName returns a description of the items in an array
+// of the given type for use in error messages.
+func arrayTypeName(typ jparse.ParamType) string {
+	switch typ {
+	case jparse.ParamTypeNumber:
+		return "numbers"
+	case jparse.ParamTypeString:
+		return "strings"
+	case jparse.ParamTypeBool:
+		return "booleans"
+	case jparse.ParamTypeNull:
+		return "nulls"
+	case jparse.ParamTypeArray:
+		return "arrays"
+	case jparse.ParamTypeObject:
+		return "objects"
+	case jparse.ParamTypeFunc:
+		return "functions"
+	default:
+		return typ.String()
+	}
+}
+
+// UserError is returned by the evaluation methods when an
+// expression raises an error using the $error or $assert
+// functions. It lets callers distinguish errors raised
+// deliberately by an expression from evaluation failures.
+type UserError struct {
+	Message string
+}
+
+func newUserError(msg string) *UserError {
+	return &UserError{
+		Message: msg,
+	}
+}
+
+func (e UserError) Error() string {
+	return e.Message
+}
+
+// ExtensionError is returned by the evaluation methods when a
+// custom function registered with RegisterExts returns an
+// error. The original error is available via errors.Unwrap.
+type ExtensionError struct {
+	// Func is the name of the custom function.
+	Func string
+
+	// Position is the byte offset in the expression of the
+	// start of the function call. It is zero if the position
+	// is unknown, e.g. if the function was called by another
+	// function.
+	Position int
+
+	// Err is the error returned by the custom function.
+	Err error
+}
+
+func (e ExtensionError) Error() string {
+	if e.Position > 0 {
+		return fmt.Sprintf("function %q at position %d: %s", e.Func, e.Position, e.Err)
+	}
+	return fmt.Sprintf("function %q: %s", e.Func, e.Err)
+}
+
+// Unwrap returns the error returned by the custom function.
+func (e ExtensionError) Unwrap() error {
+	return e.Err
+}
+
+// OperatorError is returned by the evaluation methods when a
+// custom operator registered with RegisterOperator returns an
+// error. The original error is available via errors.Unwrap.
+type OperatorError struct {
+	// Operator is the symbol of the custom operator.
+	Operator string
+
+	// Position is the byte offset in the expression of the
+	// start of the operation, i.e. of its left hand side.
+	Position int
+
+	// Err is the error returned by the operator's Func, or
+	// an error saying that the operator is not registered.
+	Err error
+}
+
+func (e OperatorError) Error() string {
+	return fmt.Sprintf("operator %q at position %d: %s", e.Operator, e.Position, e.Err)
+}
+
+// Unwrap returns the error returned by the operator's Func.
+func (e OperatorError) Unwrap() error {
+	return e.Err
+}
+
+// MultiError is returned by the evaluation methods when the
+// CollectErrors option is set and one or more errors were
+// collected. The evaluation methods return the partial result
+// alongside the MultiError. The individual errors are available
+// via errors.Is and errors.As.
+type MultiError struct {
+	// Errors holds the collected errors in the order in which
+	// they occurred. If evaluation was stopped by an error that
+	// cannot be collected, that error is last.
+	Errors []error
+}
+
+func (e MultiError) Error() string {
+	if len(e.Errors) == 1 {
+		return e.Errors[0].Error()
+	}
+
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+
+	return fmt.Sprintf("%d errors: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the collected errors.
+func (e MultiError) Unwrap() []error {
+	return e.Errors
+}
+
+// ChainError is returned by the evaluation methods when a
+// function in a chain created with the ~> operator fails. The
+// original error is available via errors.Unwrap.
+type ChainError struct {
+	// Func is the name of the function that failed.
+	Func string
+
+	// Stage is the position of the function in the chain,
+	// starting from 1.
+	Stage int
+
+	// Err is the error returned by the function.
+	Err error
+}
+
+func newChainError(name string, stage int, err error) *ChainError {
+	return &ChainError{
+		Func:  name,
+		Stage: stage,
+		Err:   err,
+	}
+}
+
+func (e ChainError) Error() string {
+	return fmt.Sprintf("function %q at stage %d of chain: %s", e.Func, e.Stage, e.Err)
+}
+
+// Unwrap returns the error returned by the function.
+func (e ChainError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorCode returns the jsonata-js error code associated with
+// err, e.g. "S0201" or "D3030". It recognises the errors returned
+// by the parser, the evaluator and the built-in functions. It
+// returns an empty string if err is nil or has no equivalent in
+// jsonata-js.
+func ErrorCode(err error) string {
+	var coder interface {
+		Code() string
+	}
+
+	if errors.As(err, &coder) {
+		return coder.Code()
+	}
+
+	return ""
 }
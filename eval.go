@@ -5,10 +5,13 @@
 package jsonata
 
 import (
+	"errors"
 	"fmt"
 	"math"
+	"math/big"
 	"reflect"
 	"sort"
+	"strconv"
 
 	"github.com/blues/jsonata-go/jlib"
 	"github.com/blues/jsonata-go/jparse"
@@ -20,9 +23,20 @@ var undefined reflect.Value
 var typeInterfaceSlice = reflect.SliceOf(jtypes.TypeInterface)
 
 func eval(node jparse.Node, input reflect.Value, env *environment) (reflect.Value, error) {
+	if env != nil && env.trace != nil {
+		return env.trace.eval(node, input, env)
+	}
+	return evalNode(node, input, env)
+}
+
+func evalNode(node jparse.Node, input reflect.Value, env *environment) (reflect.Value, error) {
 	var err error
 	var v reflect.Value
 
+	if err := env.checkDone(); err != nil {
+		return undefined, err
+	}
+
 	switch node := node.(type) {
 	case *jparse.StringNode:
 		v, err = evalString(node, input, env)
@@ -52,18 +66,26 @@ func eval(node jparse.Node, input reflect.Value, env *environment) (reflect.Valu
 		v, err = evalBlock(node, input, env)
 	case *jparse.ConditionalNode:
 		v, err = evalConditional(node, input, env)
+	case *jparse.CoalesceNode:
+		v, err = evalCoalesce(node, input, env)
 	case *jparse.AssignmentNode:
 		v, err = evalAssignment(node, input, env)
 	case *jparse.WildcardNode:
 		v, err = evalWildcard(node, input, env)
 	case *jparse.DescendentNode:
 		v, err = evalDescendent(node, input, env)
+	case *jparse.ParentNode:
+		v, err = evalParent(node, input, env)
 	case *jparse.GroupNode:
 		v, err = evalGroup(node, input, env)
 	case *jparse.PredicateNode:
 		v, err = evalPredicate(node, input, env)
 	case *jparse.SortNode:
 		v, err = evalSort(node, input, env)
+	case *jparse.PositionalBindingNode:
+		v, err = evalBinding(node, input, env)
+	case *jparse.ContextBindingNode:
+		v, err = evalBinding(node, input, env)
 	case *jparse.LambdaNode:
 		v, err = evalLambda(node, input, env)
 	case *jparse.TypedLambdaNode:
@@ -84,6 +106,10 @@ func eval(node jparse.Node, input reflect.Value, env *environment) (reflect.Valu
 		v, err = evalBooleanOperator(node, input, env)
 	case *jparse.StringConcatenationNode:
 		v, err = evalStringConcatenation(node, input, env)
+	case *jparse.CustomOperatorNode:
+		v, err = evalCustomOperator(node, input, env)
+	case *constantNode:
+		v, err = evalConstant(node, input, env)
 	default:
 		panicf("eval: unexpected node type %T", node)
 	}
@@ -96,14 +122,49 @@ func eval(node jparse.Node, input reflect.Value, env *environment) (reflect.Valu
 		v = seq.Value()
 	}
 
+	if opts := env.evalOptions(); opts != nil {
+		if err := checkLimits(node, v, opts); err != nil {
+			return undefined, err
+		}
+	}
+
 	return v, nil
 }
 
+// checkLimits returns an error if v is a string or an array
+// that exceeds the limits in opts. Only values created by the
+// given node are checked. Values that come from the input data
+// or from variables are not.
+func checkLimits(node jparse.Node, v reflect.Value, opts *EvalOptions) error {
+
+	switch node.(type) {
+	case *jparse.ArrayNode, *jparse.PathNode, *jparse.FunctionCallNode, *jparse.FunctionApplicationNode:
+	default:
+		return nil
+	}
+
+	v = jtypes.Resolve(v)
+
+	switch {
+	case opts.MaxStringLength > 0 && jtypes.IsString(v) && v.Len() > opts.MaxStringLength:
+		return newLimitError("MaxStringLength", opts.MaxStringLength)
+	case opts.MaxArrayLength > 0 && jtypes.IsArray(v) && v.Len() > opts.MaxArrayLength:
+		return newLimitError("MaxArrayLength", opts.MaxArrayLength)
+	default:
+		return nil
+	}
+}
+
 func evalString(node *jparse.StringNode, data reflect.Value, env *environment) (reflect.Value, error) {
 	return reflect.ValueOf(node.Value), nil
 }
 
 func evalNumber(node *jparse.NumberNode, data reflect.Value, env *environment) (reflect.Value, error) {
+	if opts := env.evalOptions(); opts != nil && opts.Decimal {
+		if d, ok := jtypes.DecimalFromFloat(node.Value); ok {
+			return reflect.ValueOf(d), nil
+		}
+	}
 	return reflect.ValueOf(node.Value), nil
 }
 
@@ -123,29 +184,81 @@ func evalRegex(node *jparse.RegexNode, data reflect.Value, env *environment) (re
 
 func evalVariable(node *jparse.VariableNode, data reflect.Value, env *environment) (reflect.Value, error) {
 	if node.Name == "" {
-		return data, nil
+		return convertValue(data)
 	}
-	return env.lookup(node.Name), nil
+	return convertValue(env.lookup(node.Name))
 }
 
 func evalName(node *jparse.NameNode, data reflect.Value, env *environment) (reflect.Value, error) {
-	var err error
-	var v reflect.Value
+	data, err := convertValue(data)
+	if err != nil {
+		return undefined, err
+	}
 
 	data = jtypes.Resolve(data)
 
 	switch {
 	case jtypes.IsStruct(data):
-		v = data.FieldByName(node.Value)
+		v := evalNameStruct(node, data)
+		if v == undefined {
+			if opts := env.evalOptions(); opts != nil && opts.MethodFallback {
+				if v, _, err = evalNameMethod(node, data); err != nil {
+					return undefined, err
+				}
+			}
+		}
+		return convertValue(v)
 	case jtypes.IsMap(data):
-		v = data.MapIndex(reflect.ValueOf(node.Value))
+		return convertValue(evalNameMap(node, data))
 	case jtypes.IsArray(data):
-		v, err = evalNameArray(node, data, env)
+		return evalNameArray(node, data, env)
 	default:
 		return undefined, nil
 	}
+}
+
+func evalNameStruct(node *jparse.NameNode, data reflect.Value) reflect.Value {
+	v, ok := jtypes.FieldByName(data, node.Value)
+	if !ok {
+		return undefined
+	}
 
-	return v, err
+	return v
+}
+
+func evalNameMap(node *jparse.NameNode, data reflect.Value) reflect.Value {
+	key := reflect.ValueOf(node.Value)
+
+	if _, ok := jtypes.AsOrderedMap(data); ok {
+		return jtypes.MapIndex(data, key)
+	}
+
+	// Maps keyed by a named string type need the key to be
+	// converted before lookup. Maps with other key types are
+	// searched for a key whose string form (see jlib.KeyString)
+	// matches the name.
+	switch keyType := data.Type().Key(); {
+	case key.Type().AssignableTo(keyType):
+		if v := data.MapIndex(key); v.IsValid() || keyType.Kind() == reflect.String {
+			return v
+		}
+	case keyType.Kind() == reflect.String:
+		return data.MapIndex(key.Convert(keyType))
+	}
+
+	return evalNameMapSlow(node, data)
+}
+
+func evalNameMapSlow(node *jparse.NameNode, data reflect.Value) reflect.Value {
+
+	iter := data.MapRange()
+	for iter.Next() {
+		if s, ok := jlib.KeyString(iter.Key()); ok && s == node.Value {
+			return iter.Value()
+		}
+	}
+
+	return undefined
 }
 
 func evalNameArray(node *jparse.NameNode, data reflect.Value, env *environment) (reflect.Value, error) {
@@ -172,28 +285,18 @@ func evalPath(node *jparse.PathNode, data reflect.Value, env *environment) (refl
 		return undefined, nil
 	}
 
-	var isVar bool
-	switch step0 := node.Steps[0].(type) {
-	case (*jparse.VariableNode):
-		isVar = true
-	case (*jparse.PredicateNode):
-		_, isVar = step0.Expr.(*jparse.VariableNode)
+	if node.Tuples {
+		return evalTuplePath(node, data, env)
 	}
 
-	output := data
-	if isVar || !jtypes.IsArray(data) {
-		output = reflect.MakeSlice(typeInterfaceSlice, 1, 1)
-		if data.IsValid() {
-			output.Index(0).Set(data)
-		}
-	}
+	output := pathInput(node, data)
 
 	var err error
 	lastIndex := len(node.Steps) - 1
 	for i, step := range node.Steps {
 
-		if step0, ok := step.(*jparse.ArrayNode); ok && i == 0 {
-			output, err = eval(step0, output, env)
+		if i == 0 && isArrayConstructor(step) {
+			output, err = eval(step, output, env)
 		} else {
 			output, err = evalPathStep(step, output, env, i == lastIndex)
 		}
@@ -217,6 +320,33 @@ func evalPath(node *jparse.PathNode, data reflect.Value, env *environment) (refl
 	return output, nil
 }
 
+// pathInput returns the array of items that the first step
+// of a path is evaluated against.
+func pathInput(node *jparse.PathNode, data reflect.Value) reflect.Value {
+
+	var isVar bool
+	switch step0 := node.Steps[0].(type) {
+	case (*jparse.VariableNode):
+		isVar = true
+	case (*jparse.PredicateNode):
+		_, isVar = step0.Expr.(*jparse.VariableNode)
+	}
+
+	if !isVar && jtypes.IsArray(data) {
+		// Arrays nested in other arrays are held in
+		// interfaces. Unwrap them so that evalPathStep
+		// can index them.
+		return jtypes.Resolve(data)
+	}
+
+	output := reflect.MakeSlice(typeInterfaceSlice, 1, 1)
+	if data.IsValid() {
+		output.Index(0).Set(data)
+	}
+
+	return output
+}
+
 func evalPathStep(step jparse.Node, data reflect.Value, env *environment, lastStep bool) (reflect.Value, error) {
 	var err error
 	var results []reflect.Value
@@ -235,7 +365,7 @@ func evalPathStep(step jparse.Node, data reflect.Value, env *environment, lastSt
 		return results[0], nil
 	}
 
-	_, isCons := step.(*jparse.ArrayNode)
+	isCons := isArrayConstructor(step)
 	resultSequence := newSequence(len(results))
 
 	for _, v := range results {
@@ -310,6 +440,14 @@ func evalNegation(node *jparse.NegationNode, data reflect.Value, env *environmen
 		return undefined, err
 	}
 
+	if d, ok := jtypes.AsDecimal(rhs); ok {
+		return reflect.ValueOf(jtypes.NewDecimal(new(big.Rat).Neg(d.Rat()))), nil
+	}
+
+	if i, ok := jtypes.AsInt64(rhs); ok && i != math.MinInt64 {
+		return reflect.ValueOf(-i), nil
+	}
+
 	n, ok := jtypes.AsNumber(rhs)
 	if !ok {
 		return undefined, newEvalError(ErrNonNumberRHS, node.RHS, "-")
@@ -328,6 +466,341 @@ func isInteger(x float64) bool {
 	return x == math.Trunc(x)
 }
 
+// A tuple is an item in a path that is evaluated in tuple
+// mode. Each tuple has its own environment which records the
+// item that the tuple was produced from (see evalParent).
+type tuple struct {
+	value reflect.Value
+	env   *environment
+}
+
+func newTupleEnv(context tuple) *environment {
+	return newContextEnv(context.env, &context)
+}
+
+// evalTuplePath is like evalPath except that it keeps track
+// of the context that produced each item in the path. It's
+// used for paths that contain the parent operator or bind
+// variables.
+func evalTuplePath(node *jparse.PathNode, data reflect.Value, env *environment) (reflect.Value, error) {
+	tuples, output, err := evalPathTuples(node, data, env)
+	if err != nil || output != undefined {
+		return output, err
+	}
+
+	results := newSequence(len(tuples))
+	for _, t := range tuples {
+		if t.value.IsValid() && t.value.CanInterface() {
+			results.Append(t.value.Interface())
+		}
+	}
+
+	if results.Len() == 0 {
+		return undefined, nil
+	}
+
+	if node.KeepArrays {
+		results.keepSingletons = true
+	}
+
+	return reflect.ValueOf(results), nil
+}
+
+// evalPathTuples evaluates the steps of a path and returns the
+// resulting tuples. If the path yields a single array that
+// should not be split into tuples (see evalTupleStep), the
+// array is returned in the second return value instead.
+func evalPathTuples(node *jparse.PathNode, data reflect.Value, env *environment) ([]tuple, reflect.Value, error) {
+	var err error
+	var tuples []tuple
+	var output reflect.Value
+
+	input := pathInput(node, data)
+	lastIndex := len(node.Steps) - 1
+
+	for i, step := range node.Steps {
+
+		if i == 0 {
+			if isArrayConstructor(step) {
+				input, err = eval(step, input, env)
+				if err != nil || input == undefined {
+					return nil, undefined, err
+				}
+				if i == lastIndex {
+					return nil, input, nil
+				}
+				step = nil
+			}
+
+			tuples = makeTuples(input, env)
+
+			if step == nil {
+				continue
+			}
+		}
+
+		tuples, output, err = evalTupleStep(step, tuples, i == lastIndex)
+		if err != nil {
+			return nil, undefined, err
+		}
+
+		if output != undefined {
+			return nil, output, nil
+		}
+
+		if len(tuples) == 0 {
+			return nil, undefined, nil
+		}
+	}
+
+	return tuples, undefined, nil
+}
+
+// evalTupleStep evaluates a path step against each of the
+// input tuples and returns the resulting tuples. Like
+// evalPathStep, if this is the last step in the path and it
+// yields a single array, the array is returned as is (in the
+// second return value) rather than split into tuples.
+func evalTupleStep(step jparse.Node, input []tuple, lastStep bool) ([]tuple, reflect.Value, error) {
+
+	switch step := step.(type) {
+	case *jparse.ParentNode:
+		results := make([]tuple, 0, len(input))
+		for _, t := range input {
+			context, ok := t.env.lookupContext()
+			if !ok {
+				return nil, undefined, newEvalError(ErrNoParent, step, nil)
+			}
+
+			// The parent of an item derived from an undefined
+			// input (see pathInput) is undefined, so it's
+			// dropped like other undefined values in a path.
+			if v := context.value; v == undefined || (v.Kind() == reflect.Interface && v.IsNil()) {
+				continue
+			}
+
+			// The parent item replaces the current item but
+			// variables bound since the parent was produced
+			// must stay in scope. So rather than reuse the
+			// parent's environment, create a new one with the
+			// current variables and the parent's context.
+			grandparent, ok := context.env.lookupContext()
+			if !ok {
+				grandparent = noContext
+			}
+
+			results = append(results, tuple{
+				value: context.value,
+				env:   newContextEnv(t.env, grandparent),
+			})
+		}
+		return results, undefined, nil
+
+	case *jparse.PredicateNode:
+		var results []tuple
+		for _, t := range input {
+
+			items, _, err := evalTupleStep(step.Expr, []tuple{t}, false)
+			if err != nil {
+				return nil, undefined, err
+			}
+
+			for _, filter := range step.Filters {
+				if len(items) == 0 {
+					break
+				}
+				items, err = applyTupleFilter(filter, items)
+				if err != nil {
+					return nil, undefined, err
+				}
+			}
+
+			results = append(results, items...)
+		}
+		return results, undefined, nil
+
+	case *jparse.PositionalBindingNode:
+		var results []tuple
+		for _, t := range input {
+
+			items, _, err := evalTupleStep(step.Expr, []tuple{t}, false)
+			if err != nil {
+				return nil, undefined, err
+			}
+
+			for i, item := range items {
+				env := newEnvironment(item.env, 1)
+				env.bind(step.Name, reflect.ValueOf(float64(i)))
+				results = append(results, tuple{
+					value: item.value,
+					env:   env,
+				})
+			}
+		}
+		return results, undefined, nil
+
+	case *jparse.ContextBindingNode:
+		var results []tuple
+		for _, t := range input {
+
+			items, _, err := evalTupleStep(step.Expr, []tuple{t}, false)
+			if err != nil {
+				return nil, undefined, err
+			}
+
+			// The context item doesn't change so neither
+			// does its parent.
+			context, ok := t.env.lookupContext()
+			if !ok {
+				context = noContext
+			}
+
+			for _, item := range items {
+				env := newContextEnv(item.env, context)
+				env.bind(step.Name, item.value)
+				results = append(results, tuple{
+					value: t.value,
+					env:   env,
+				})
+			}
+		}
+		return results, undefined, nil
+
+	case *jparse.SortNode:
+		if path, ok := step.Expr.(*jparse.PathNode); ok && path.Tuples {
+			var results []tuple
+			for _, t := range input {
+
+				items, err := evalSortTuples(step, t)
+				if err != nil {
+					return nil, undefined, err
+				}
+
+				results = append(results, items...)
+			}
+			return results, undefined, nil
+		}
+	}
+
+	var results []tuple
+	var values []reflect.Value
+
+	isCons := isArrayConstructor(step)
+
+	for _, t := range input {
+
+		v, err := eval(step, t.value, t.env)
+		if err != nil {
+			return nil, undefined, err
+		}
+
+		if v == undefined {
+			continue
+		}
+
+		values = append(values, v)
+		env := newTupleEnv(t)
+
+		if isCons || !jtypes.IsArray(v) {
+			results = append(results, tuple{
+				value: v,
+				env:   env,
+			})
+			continue
+		}
+
+		v = arrayify(v)
+		for i, N := 0, v.Len(); i < N; i++ {
+			if vi := v.Index(i); vi.IsValid() && vi.CanInterface() {
+				results = append(results, tuple{
+					value: vi,
+					env:   env,
+				})
+			}
+		}
+	}
+
+	if lastStep && !isCons && len(values) == 1 && jtypes.IsArray(values[0]) {
+		return nil, values[0], nil
+	}
+
+	return results, undefined, nil
+}
+
+// makeTuples converts a value into a slice of tuples that
+// share the given environment. Arrays produce one tuple per
+// item.
+func makeTuples(v reflect.Value, env *environment) []tuple {
+	v = arrayify(v)
+	tuples := make([]tuple, 0, v.Len())
+
+	for i, N := 0, v.Len(); i < N; i++ {
+		tuples = append(tuples, tuple{
+			value: v.Index(i),
+			env:   env,
+		})
+	}
+
+	return tuples
+}
+
+func applyTupleFilter(filter jparse.Node, items []tuple) ([]tuple, error) {
+	var results []tuple
+	nItems := len(items)
+
+	for i, item := range items {
+
+		res, err := eval(filter, item.value, item.env.abortOnError())
+		if err != nil {
+			return nil, err
+		}
+
+		if jtypes.IsNumber(res) {
+			res = arrayify(res)
+		}
+
+		switch {
+		case jtypes.IsArrayOf(res, jtypes.IsNumber):
+			for j, N := 0, res.Len(); j < N; j++ {
+
+				n, _ := jtypes.AsNumber(res.Index(j))
+				index := int(math.Floor(n))
+				if index < 0 {
+					index += nItems
+				}
+
+				if index == i {
+					results = append(results, item)
+				}
+			}
+		case jlib.Boolean(res):
+			results = append(results, item)
+		}
+	}
+
+	return results, nil
+}
+
+func evalBinding(node jparse.Node, data reflect.Value, env *environment) (reflect.Value, error) {
+	// Bindings are usually evaluated as part of a tuple path.
+	// Outside of a path, treat the binding as a one-step path.
+	path := &jparse.PathNode{
+		Steps:  []jparse.Node{node},
+		Tuples: true,
+	}
+
+	return evalTuplePath(path, data, env)
+}
+
+func evalParent(node *jparse.ParentNode, data reflect.Value, env *environment) (reflect.Value, error) {
+	context, ok := env.lookupContext()
+	if !ok {
+		return undefined, newEvalError(ErrNoParent, node, nil)
+	}
+
+	return context.value, nil
+}
+
 func evalRange(node *jparse.RangeNode, data reflect.Value, env *environment) (reflect.Value, error) {
 	evaluate := func(node jparse.Node) (float64, bool, bool, error) {
 
@@ -367,10 +840,21 @@ func evalRange(node *jparse.RangeNode, data reflect.Value, env *environment) (re
 	}
 
 	size := int(rhs-lhs) + 1
+	opts := env.evalOptions()
+
 	// Check for integer overflow or an array size that exceeds
 	// our upper bound.
-	if size < 0 || size > maxRangeItems {
-		return undefined, newEvalError(ErrMaxRangeItems, "..", nil)
+	if size < 0 || (size > maxRangeItems && (opts == nil || opts.MaxRangeItems <= 0)) {
+		return undefined, newEvalErrorAt(node, ErrMaxRangeItems, "..", nil)
+	}
+
+	if opts != nil {
+		if opts.MaxRangeItems > 0 && size > opts.MaxRangeItems {
+			return undefined, newLimitError("MaxRangeItems", opts.MaxRangeItems)
+		}
+		if opts.MaxArrayLength > 0 && size > opts.MaxArrayLength {
+			return undefined, newLimitError("MaxArrayLength", opts.MaxArrayLength)
+		}
 	}
 
 	results := reflect.MakeSlice(typeInterfaceSlice, size, size)
@@ -383,6 +867,17 @@ func evalRange(node *jparse.RangeNode, data reflect.Value, env *environment) (re
 	return results, nil
 }
 
+// isArrayConstructor reports whether node is an array
+// constructor, i.e. an ArrayNode or a folded constant that
+// was an ArrayNode (see Expr.Optimize).
+func isArrayConstructor(node jparse.Node) bool {
+	if c, ok := node.(*constantNode); ok {
+		node = c.Node
+	}
+	_, ok := node.(*jparse.ArrayNode)
+	return ok
+}
+
 func evalArray(node *jparse.ArrayNode, data reflect.Value, env *environment) (reflect.Value, error) {
 	// Create a slice with capacity equal to the number of items
 	// in the ArrayNode. Note that the final length of the array
@@ -399,6 +894,9 @@ func evalArray(node *jparse.ArrayNode, data reflect.Value, env *environment) (re
 
 		v, err := eval(item, data, env)
 		if err != nil {
+			if env.collectError(err) {
+				continue
+			}
 			return undefined, err
 		}
 
@@ -406,17 +904,17 @@ func evalArray(node *jparse.ArrayNode, data reflect.Value, env *environment) (re
 			continue
 		}
 
-		switch item.(type) {
-		case *jparse.ArrayNode:
+		if isArrayConstructor(item) {
 			if v.CanInterface() {
 				results = append(results, v.Interface())
 			}
-		default:
-			v = arrayify(v)
-			for i, N := 0, v.Len(); i < N; i++ {
-				if vi := v.Index(i); vi.IsValid() && vi.CanInterface() {
-					results = append(results, vi.Interface())
-				}
+			continue
+		}
+
+		v = arrayify(v)
+		for i, N := 0, v.Len(); i < N; i++ {
+			if vi := v.Index(i); vi.IsValid() && vi.CanInterface() {
+				results = append(results, vi.Interface())
 			}
 		}
 	}
@@ -427,60 +925,159 @@ func evalArray(node *jparse.ArrayNode, data reflect.Value, env *environment) (re
 func evalObject(node *jparse.ObjectNode, data reflect.Value, env *environment) (reflect.Value, error) {
 	data = makeArray(data)
 
-	keys, err := groupItemsByKey(node, data, env)
+	envs, err := pairEnvs(node, data, env)
+	if err != nil {
+		return undefined, err
+	}
+
+	keys, order, err := groupItemsByKey(node, data, envs)
 	if err != nil {
 		return undefined, err
 	}
 
 	nItems := data.Len()
-	results := make(map[string]interface{}, len(keys))
+	results := jtypes.NewOrderedMap(len(keys))
+
+	for _, key := range order {
+
+		var values []reflect.Value
 
-	for key, idx := range keys {
+		for _, idx := range keys[key] {
 
-		items := data
-		if n := len(idx.items); n != 0 && n != nItems {
-			items = reflect.MakeSlice(typeInterfaceSlice, n, n)
-			for i, j := range idx.items {
-				items.Index(i).Set(data.Index(j))
+			items := data
+			if n := len(idx.items); n != 0 && n != nItems {
+				items = reflect.MakeSlice(typeInterfaceSlice, n, n)
+				for i, j := range idx.items {
+					items.Index(i).Set(data.Index(j))
+				}
 			}
-		}
 
-		value, err := eval(node.Pairs[idx.pair][1], items, env)
-		if err != nil {
-			return undefined, err
+			value, err := eval(node.Pairs[idx.pair][1], items, envs[idx.pair])
+			if err != nil {
+				if env.collectError(err) {
+					continue
+				}
+				return undefined, err
+			}
+
+			if value.IsValid() && value.CanInterface() {
+				values = append(values, value)
+			}
 		}
 
-		if value.IsValid() && value.CanInterface() {
-			results[key] = value.Interface()
+		switch len(values) {
+		case 0:
+		case 1:
+			results.Set(key, values[0].Interface())
+		default:
+			results.Set(key, groupValues(values))
 		}
 	}
 
 	return reflect.ValueOf(results), nil
 }
 
+// pairEnvs evaluates the bindings in an object constructor
+// and returns the environment in which to evaluate each pair.
+// Bindings are evaluated in order, against the input as a
+// whole rather than item by item (as keys are). Each one
+// creates a new scope so that the variable is only visible
+// to the keys and values of the pairs that follow it.
+func pairEnvs(node *jparse.ObjectNode, data reflect.Value, env *environment) ([]*environment, error) {
+
+	envs := make([]*environment, len(node.Pairs))
+	next := 0
+
+	for _, b := range node.Bindings {
+
+		for ; next < b.Pair; next++ {
+			envs[next] = env
+		}
+
+		env = newEnvironment(env, 1)
+
+		if _, err := evalAssignment(b.Assignment, data, env); err != nil {
+			return nil, err
+		}
+	}
+
+	for ; next < len(envs); next++ {
+		envs[next] = env
+	}
+
+	return envs, nil
+}
+
+// groupValues combines the values produced by different pairs
+// of an object constructor for the same key. Arrays are
+// flattened into the result.
+func groupValues(values []reflect.Value) []interface{} {
+	var results []interface{}
+
+	for _, v := range values {
+		if !jtypes.IsArray(v) {
+			results = append(results, v.Interface())
+			continue
+		}
+
+		v = jtypes.Resolve(v)
+		for i := 0; i < v.Len(); i++ {
+			if item := v.Index(i); item.CanInterface() {
+				results = append(results, item.Interface())
+			}
+		}
+	}
+
+	return results
+}
+
+// keyIndexes records the pair of an object constructor that
+// produced a key and the input items that it was produced
+// from. If items is empty, the key was produced by a string
+// literal and applies to all items.
 type keyIndexes struct {
 	pair  int
 	items []int
 }
 
-func groupItemsByKey(obj *jparse.ObjectNode, items reflect.Value, env *environment) (map[string]keyIndexes, error) {
+// groupItemsByKey evaluates the keys of an object constructor
+// against each input item, using the environment in envs that
+// corresponds to each pair. It returns the keys mapped to the
+// pairs and items that produced them, along with the keys in
+// the order that they were first seen.
+//
+// By default, a key can only be produced by one pair and each
+// key maps to a single keyIndexes. If the GroupDuplicateKeys
+// option is set, a key can be produced by several pairs, in
+// which case it maps to a keyIndexes for each of them.
+func groupItemsByKey(obj *jparse.ObjectNode, items reflect.Value, envs []*environment) (map[string][]keyIndexes, []string, error) {
 	nItems := items.Len()
-	results := make(map[string]keyIndexes, len(obj.Pairs))
+	results := make(map[string][]keyIndexes, len(obj.Pairs))
+	order := make([]string, 0, len(obj.Pairs))
 
 	for i, pair := range obj.Pairs {
 
 		keyNode := pair[0]
+		env := envs[i]
+
+		opts := env.evalOptions()
+		group := opts != nil && opts.GroupDuplicateKeys
 
 		if s, ok := keyNode.(*jparse.StringNode); ok {
 
 			key := s.Value
-			if _, ok := results[key]; ok {
-				return nil, newEvalError(ErrDuplicateKey, keyNode, key)
+			idxs, ok := results[key]
+			if ok && !group {
+				return nil, nil, newDuplicateKeyError(keyNode, key, 0)
 			}
 
-			results[key] = keyIndexes{
-				pair: i,
+			if !ok {
+				order = append(order, key)
 			}
+
+			results[key] = append(idxs, keyIndexes{
+				pair: i,
+			})
 			continue
 		}
 
@@ -488,33 +1085,74 @@ func groupItemsByKey(obj *jparse.ObjectNode, items reflect.Value, env *environme
 
 			v, err := eval(keyNode, items.Index(j), env)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 
-			key, ok := jtypes.AsString(v)
+			key, ok := objectKey(v, opts)
 			if !ok {
-				return nil, newEvalError(ErrIllegalKey, keyNode, nil)
+				return nil, nil, newEvalError(ErrIllegalKey, keyNode, nil)
 			}
 
-			idx, ok := results[key]
+			idxs, ok := results[key]
 			if !ok {
-				results[key] = keyIndexes{
-					pair:  i,
-					items: []int{j},
+				results[key] = []keyIndexes{
+					{
+						pair:  i,
+						items: []int{j},
+					},
 				}
+				order = append(order, key)
+				continue
+			}
+
+			// Pairs are processed in order, so only the most
+			// recent entry for this key can belong to this pair.
+			if last := &idxs[len(idxs)-1]; last.pair == i {
+				last.items = append(last.items, j)
 				continue
 			}
 
-			if idx.pair != i {
-				return nil, newEvalError(ErrDuplicateKey, keyNode, key)
+			if !group {
+				return nil, nil, newDuplicateKeyError(keyNode, key, j+1)
 			}
 
-			idx.items = append(idx.items, j)
-			results[key] = idx
+			results[key] = append(idxs, keyIndexes{
+				pair:  i,
+				items: []int{j},
+			})
 		}
 	}
 
-	return results, nil
+	return results, order, nil
+}
+
+// objectKey returns the value of a key expression as a string.
+// Keys must be strings unless the LenientObjectKeys option is
+// set, in which case numbers and booleans are converted to
+// strings in the same way as $string.
+func objectKey(v reflect.Value, opts *EvalOptions) (string, bool) {
+
+	if s, ok := jtypes.AsString(v); ok {
+		return s, true
+	}
+
+	if opts == nil || !opts.LenientObjectKeys {
+		return "", false
+	}
+
+	if d, ok := jtypes.AsDecimal(v); ok {
+		return d.String(), true
+	}
+
+	if n, ok := jtypes.AsNumber(v); ok {
+		return jlib.NumberToString(n), true
+	}
+
+	if b, ok := jtypes.AsBool(v); ok {
+		return strconv.FormatBool(b), true
+	}
+
+	return "", false
 }
 
 func evalBlock(node *jparse.BlockNode, data reflect.Value, env *environment) (reflect.Value, error) {
@@ -541,7 +1179,7 @@ func evalBlock(node *jparse.BlockNode, data reflect.Value, env *environment) (re
 }
 
 func evalConditional(node *jparse.ConditionalNode, data reflect.Value, env *environment) (reflect.Value, error) {
-	v, err := eval(node.If, data, env)
+	v, err := eval(node.If, data, env.abortOnError())
 	if err != nil {
 		return undefined, err
 	}
@@ -550,11 +1188,24 @@ func evalConditional(node *jparse.ConditionalNode, data reflect.Value, env *envi
 		return eval(node.Then, data, env)
 	}
 
-	if node.Else != nil {
-		return eval(node.Else, data, env)
+	if node.Else != nil {
+		return eval(node.Else, data, env)
+	}
+
+	return undefined, nil
+}
+
+func evalCoalesce(node *jparse.CoalesceNode, data reflect.Value, env *environment) (reflect.Value, error) {
+	v, err := eval(node.LHS, data, env)
+	if err != nil {
+		return undefined, err
+	}
+
+	if v != undefined && !isNull(v) {
+		return v, nil
 	}
 
-	return undefined, nil
+	return eval(node.RHS, data, env)
 }
 
 func evalAssignment(node *jparse.AssignmentNode, data reflect.Value, env *environment) (reflect.Value, error) {
@@ -570,9 +1221,22 @@ func evalAssignment(node *jparse.AssignmentNode, data reflect.Value, env *enviro
 func evalWildcard(node *jparse.WildcardNode, data reflect.Value, env *environment) (reflect.Value, error) {
 	results := newSequence(0)
 
-	walkObjectValues(data, func(v reflect.Value) {
+	data, err := convertValue(data)
+	if err != nil {
+		return undefined, err
+	}
+
+	err = walkObjectValues(data, func(v reflect.Value) error {
+		v, err := convertValue(v)
+		if err != nil {
+			return err
+		}
 		appendWildcard(results, v)
+		return nil
 	})
+	if err != nil {
+		return undefined, err
+	}
 
 	return reflect.ValueOf(results), nil
 }
@@ -596,18 +1260,25 @@ func appendWildcard(seq *sequence, v reflect.Value) {
 func evalDescendent(node *jparse.DescendentNode, data reflect.Value, env *environment) (reflect.Value, error) {
 	results := newSequence(0)
 
-	recurseDescendents(results, data)
+	if err := recurseDescendents(results, data); err != nil {
+		return undefined, err
+	}
 
 	return reflect.ValueOf(results), nil
 }
 
-func recurseDescendents(seq *sequence, v reflect.Value) {
+func recurseDescendents(seq *sequence, v reflect.Value) error {
+	v, err := convertValue(v)
+	if err != nil {
+		return err
+	}
+
 	if v.IsValid() && v.CanInterface() && !jtypes.IsArray(v) {
 		seq.Append(v.Interface())
 	}
 
-	walkObjectValues(v, func(v reflect.Value) {
-		recurseDescendents(seq, v)
+	return walkObjectValues(v, func(v reflect.Value) error {
+		return recurseDescendents(seq, v)
 	})
 }
 
@@ -650,6 +1321,10 @@ func applyFilter(filter jparse.Node, items reflect.Value, env *environment) (ref
 	nItems := items.Len()
 	results := reflect.MakeSlice(typeInterfaceSlice, 0, 0)
 
+	// Errors in a predicate affect which items are selected,
+	// so they are never collected.
+	env = env.abortOnError()
+
 	for i := 0; i < nItems; i++ {
 
 		item := items.Index(i)
@@ -690,20 +1365,19 @@ type sortinfo struct {
 	values []reflect.Value
 }
 
-func buildSortInfo(items reflect.Value, terms []jparse.SortTerm, env *environment) ([]*sortinfo, error) {
-	info := make([]*sortinfo, items.Len())
+func buildSortInfo(items []tuple, terms []jparse.SortTerm) ([]*sortinfo, error) {
+	info := make([]*sortinfo, len(items))
 
 	isNumberTerm := make([]bool, len(terms))
 	isStringTerm := make([]bool, len(terms))
 
-	for i, N := 0, items.Len(); i < N; i++ {
+	for i, item := range items {
 
-		item := items.Index(i)
 		values := make([]reflect.Value, len(terms))
 
 		for j, term := range terms {
 
-			v, err := eval(term.Expr, item, env)
+			v, err := eval(term.Expr, item.value, item.env)
 			if err != nil {
 				return nil, err
 			}
@@ -741,7 +1415,10 @@ func buildSortInfo(items reflect.Value, terms []jparse.SortTerm, env *environmen
 	return info, nil
 }
 
-func makeLessFunc(info []*sortinfo, terms []jparse.SortTerm) func(int, int) bool {
+// makeLessFunc returns a less function for sorting items by
+// their sort terms. Strings are compared with collate if it is
+// not nil.
+func makeLessFunc(info []*sortinfo, terms []jparse.SortTerm, collate Collator) func(int, int) bool {
 	return func(i, j int) bool {
 	Loop:
 		for t, term := range terms {
@@ -758,6 +1435,19 @@ func makeLessFunc(info []*sortinfo, terms []jparse.SortTerm) func(int, int) bool
 				return true
 			}
 
+			if collate != nil && jtypes.IsString(vi) {
+				s1, _ := jtypes.AsString(vi)
+				s2, _ := jtypes.AsString(vj)
+				cmp := collate(s1, s2)
+				if cmp == 0 {
+					continue Loop
+				}
+				if term.Dir == jparse.SortDescending {
+					return cmp > 0
+				}
+				return cmp < 0
+			}
+
 			if eq(vi, vj) {
 				continue Loop
 			}
@@ -773,27 +1463,65 @@ func makeLessFunc(info []*sortinfo, terms []jparse.SortTerm) func(int, int) bool
 }
 
 func evalSort(node *jparse.SortNode, data reflect.Value, env *environment) (reflect.Value, error) {
-	items, err := eval(node.Expr, data, env)
-	if err != nil || items == undefined {
+	items, err := evalSortTuples(node, tuple{
+		value: data,
+		env:   env,
+	})
+	if err != nil || items == nil {
 		return undefined, err
 	}
 
-	items = arrayify(items)
+	results := reflect.MakeSlice(typeInterfaceSlice, len(items), len(items))
 
-	info, err := buildSortInfo(items, node.Terms, env)
-	if err != nil {
-		return undefined, err
+	for i, item := range items {
+		results.Index(i).Set(item.value)
+	}
+
+	return normalizeArray(results), nil
+}
+
+// evalSortTuples evaluates the expression being sorted against
+// the given input and returns the sorted items. If the expression
+// is a tuple path, the sort terms are evaluated in the environment
+// of each item so that they can refer to variables bound in the
+// path. It returns nil if the expression is undefined.
+func evalSortTuples(node *jparse.SortNode, input tuple) ([]tuple, error) {
+	var items []tuple
+
+	if path, ok := node.Expr.(*jparse.PathNode); ok && path.Tuples {
+		tuples, output, err := evalPathTuples(path, input.value, input.env)
+		if err != nil {
+			return nil, err
+		}
+		items = tuples
+		if output != undefined {
+			items = makeTuples(output, input.env)
+		}
+	} else {
+		v, err := eval(node.Expr, input.value, input.env)
+		if err != nil || v == undefined {
+			return nil, err
+		}
+		items = makeTuples(v, input.env)
 	}
 
-	sort.SliceStable(info, makeLessFunc(info, node.Terms))
+	if items == nil {
+		return nil, nil
+	}
+
+	info, err := buildSortInfo(items, node.Terms)
+	if err != nil {
+		return nil, err
+	}
 
-	results := reflect.MakeSlice(typeInterfaceSlice, len(info), len(info))
+	sort.SliceStable(info, makeLessFunc(info, node.Terms, input.env.collator))
 
+	results := make([]tuple, len(info))
 	for i := range info {
-		results.Index(i).Set(items.Index(info[i].index))
+		results[i] = items[info[i].index]
 	}
 
-	return normalizeArray(results), nil
+	return results, nil
 }
 
 func evalLambda(node *jparse.LambdaNode, data reflect.Value, env *environment) (reflect.Value, error) {
@@ -802,6 +1530,7 @@ func evalLambda(node *jparse.LambdaNode, data reflect.Value, env *environment) (
 			name: "lambda",
 		},
 		paramNames: node.ParamNames,
+		patterns:   node.Patterns,
 		body:       node.Body,
 		context:    data,
 		env:        env,
@@ -818,6 +1547,7 @@ func evalTypedLambda(node *jparse.TypedLambdaNode, data reflect.Value, env *envi
 		typed:      true,
 		params:     node.In,
 		paramNames: node.ParamNames,
+		patterns:   node.Patterns,
 		body:       node.Body,
 		context:    data,
 		env:        env,
@@ -872,15 +1602,60 @@ type contextSetter interface {
 	SetContext(reflect.Value)
 }
 
+type environmentSetter interface {
+	SetEnvironment(*environment)
+}
+
 func evalFunctionCall(node *jparse.FunctionCallNode, data reflect.Value, env *environment) (reflect.Value, error) {
-	v, err := eval(node.Func, data, env)
+	fn, argv, err := prepareFunctionCall(node, data, env)
+	if err != nil {
+		return undefined, err
+	}
+
+	v, err := fn.Call(argv)
 	if err != nil {
+		setArgErrorPosition(err, fn, node.Start)
 		return undefined, err
 	}
 
+	return v, nil
+}
+
+// prepareFunctionCall evaluates the function and arguments
+// of a function call and returns them without making the call.
+func prepareFunctionCall(node *jparse.FunctionCallNode, data reflect.Value, env *environment) (jtypes.Callable, []reflect.Value, error) {
+	v, err := eval(node.Func, data, env.abortOnError())
+	if err != nil {
+		return nil, nil, err
+	}
+
 	fn, ok := jtypes.AsCallable(v)
 	if !ok {
-		return undefined, newEvalError(ErrNonCallable, node.Func, nil)
+		return nil, nil, newEvalError(ErrNonCallable, node.Func, nil)
+	}
+
+	argv := make([]reflect.Value, len(node.Args))
+	for i, arg := range node.Args {
+
+		v, err := eval(arg, data, env)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		argv[i] = v
+	}
+
+	// Set the call site details after evaluating the arguments.
+	// The arguments may call the same function with a different
+	// context or environment.
+
+	// Go callables (e.g. the built-in functions) are shared by
+	// all expressions and may be called from multiple goroutines
+	// at once. Set the call site details on a copy.
+	if c, ok := fn.(*goCallable); ok {
+		clone := *c
+		clone.position = node.Start
+		fn = &clone
 	}
 
 	if setter, ok := fn.(nameSetter); ok {
@@ -893,28 +1668,117 @@ func evalFunctionCall(node *jparse.FunctionCallNode, data reflect.Value, env *en
 		setter.SetContext(data)
 	}
 
-	argv := make([]reflect.Value, len(node.Args))
-	for i, arg := range node.Args {
+	if setter, ok := fn.(environmentSetter); ok {
+		setter.SetEnvironment(env)
+	}
 
-		v, err := eval(arg, data, env)
-		if err != nil {
+	return fn, argv, nil
+}
+
+// A tailCall is a function call in the tail position of a
+// lambda body. Its function and arguments have been evaluated
+// but the call itself has not been made.
+type tailCall struct {
+	fn   jtypes.Callable
+	argv []reflect.Value
+	node *jparse.FunctionCallNode
+	env  *environment
+}
+
+// finish applies the checks that evalNode applies to the
+// results of function calls to v, the result of the call.
+func (c *tailCall) finish(v reflect.Value) (reflect.Value, error) {
+
+	if seq, ok := asSequence(v); ok {
+		v = seq.Value()
+	}
+
+	if opts := c.env.evalOptions(); opts != nil {
+		if err := checkLimits(c.node, v, opts); err != nil {
 			return undefined, err
 		}
+	}
 
-		argv[i] = v
+	return v, nil
+}
+
+// evalTail evaluates the body of a lambda. If the last
+// expression to be evaluated is a function call, evalTail
+// returns the call instead of making it. This allows the
+// caller to make the call in a loop rather than recursively
+// (see lambdaCallable.Call), so that tail-recursive lambdas
+// run in constant stack space. When tracing is on, evalTail
+// evaluates the body with eval, so that every node is traced.
+func evalTail(node jparse.Node, data reflect.Value, env *environment) (reflect.Value, *tailCall, error) {
+
+	if env.trace != nil {
+		v, err := eval(node, data, env)
+		return v, nil, err
+	}
+
+	switch node := node.(type) {
+	case *jparse.FunctionCallNode:
+		fn, argv, err := prepareFunctionCall(node, data, env)
+		if err != nil {
+			return undefined, nil, err
+		}
+		return undefined, &tailCall{fn: fn, argv: argv, node: node, env: env}, nil
+
+	case *jparse.ConditionalNode:
+		v, err := eval(node.If, data, env.abortOnError())
+		if err != nil {
+			return undefined, nil, err
+		}
+
+		if jlib.Boolean(v) {
+			return evalTail(node.Then, data, env)
+		}
+
+		if node.Else != nil {
+			return evalTail(node.Else, data, env)
+		}
+
+		return undefined, nil, nil
+
+	case *jparse.BlockNode:
+		if len(node.Exprs) == 0 {
+			break
+		}
+
+		// As in evalBlock, variables defined inside the
+		// block are scoped to the block.
+		env = newEnvironment(env, 0)
+
+		last := len(node.Exprs) - 1
+		for _, node := range node.Exprs[:last] {
+			if _, err := eval(node, data, env); err != nil {
+				return undefined, nil, err
+			}
+		}
+
+		return evalTail(node.Exprs[last], data, env)
 	}
 
-	return fn.Call(argv)
+	v, err := eval(node, data, env)
+	return v, nil, err
 }
 
 func evalFunctionApplication(node *jparse.FunctionApplicationNode, data reflect.Value, env *environment) (reflect.Value, error) {
 	// If the right hand side is a function call, insert
 	// the left hand side into the argument list and
-	// evaluate it.
+	// evaluate it. Note that we call a copy of the function
+	// call node. The original must not be modified because
+	// it may be evaluated again, possibly concurrently.
 	if f, ok := node.RHS.(*jparse.FunctionCallNode); ok {
 
-		f.Args = append([]jparse.Node{node.LHS}, f.Args...)
-		return evalFunctionCall(f, data, env)
+		call := &jparse.FunctionCallNode{
+			Span:     node.Span,
+			Func:     f.Func,
+			Args:     append([]jparse.Node{node.LHS}, f.Args...),
+			Position: f.Position,
+		}
+
+		return evalFunctionCall(call, data, env)
 	}
 
 	// Evaluate both sides and return any errors.
@@ -943,35 +1807,27 @@ func evalFunctionApplication(node *jparse.FunctionApplicationNode, data reflect.
 	// Otherwise, combine both sides into a single callable.
 	f1, _ := jtypes.AsCallable(lhs)
 
-	f := &chainCallable{
-		callables: []jtypes.Callable{
-			f1,
-			f2,
-		},
-	}
-
-	return reflect.ValueOf(f), nil
+	return reflect.ValueOf(newChainCallable(f1, f2)), nil
 }
 
 func evalNumericOperator(node *jparse.NumericOperatorNode, data reflect.Value, env *environment) (reflect.Value, error) {
-	evaluate := func(node jparse.Node) (float64, bool, bool, error) {
+	evaluate := func(node jparse.Node) (reflect.Value, bool, bool, error) {
 
 		v, err := eval(node, data, env)
 		if err != nil || v == undefined {
-			return 0, false, false, err
+			return undefined, false, false, err
 		}
 
-		n, isNum := jtypes.AsNumber(v)
-		return n, true, isNum, nil
+		return v, true, jtypes.IsNumber(v), nil
 	}
 
 	// Evaluate both sides and return any errors.
-	lhs, lhsOK, lhsNumber, err := evaluate(node.LHS)
+	lhsValue, lhsOK, lhsNumber, err := evaluate(node.LHS)
 	if err != nil {
 		return undefined, err
 	}
 
-	rhs, rhsOK, rhsNumber, err := evaluate(node.RHS)
+	rhsValue, rhsOK, rhsNumber, err := evaluate(node.RHS)
 	if err != nil {
 		return undefined, err
 	}
@@ -990,6 +1846,20 @@ func evalNumericOperator(node *jparse.NumericOperatorNode, data reflect.Value, e
 		return undefined, nil
 	}
 
+	// If either side is a Decimal, use exact arithmetic.
+	if jtypes.IsDecimal(lhsValue) || jtypes.IsDecimal(rhsValue) {
+		return evalDecimalOperator(node, lhsValue, rhsValue)
+	}
+
+	// If both sides are integers, use integer arithmetic so
+	// that large values do not lose precision.
+	if v, ok := evalIntegerOperator(node.Type, lhsValue, rhsValue); ok {
+		return reflect.ValueOf(v), nil
+	}
+
+	lhs, _ := jtypes.AsNumber(lhsValue)
+	rhs, _ := jtypes.AsNumber(rhsValue)
+
 	var x float64
 
 	switch node.Type {
@@ -1008,16 +1878,127 @@ func evalNumericOperator(node *jparse.NumericOperatorNode, data reflect.Value, e
 	}
 
 	if math.IsInf(x, 0) {
-		return undefined, newEvalError(ErrNumberInf, nil, node.Type)
+		return undefined, newEvalErrorAt(node, ErrNumberInf, nil, node.Type)
 	}
 
 	if math.IsNaN(x) {
-		return undefined, newEvalError(ErrNumberNaN, nil, node.Type)
+		return undefined, newEvalErrorAt(node, ErrNumberNaN, nil, node.Type)
 	}
 
 	return reflect.ValueOf(x), nil
 }
 
+// maxExactFloat is the largest integer up to which all integers
+// can be represented exactly as a float64 (2^53).
+const maxExactFloat = 1 << 53
+
+// asIntegerOperand returns the value of v as an int64 if it is
+// a Go integer or a float with an integral value that can be
+// converted to an int64 without loss. The second return value
+// reports whether v is a Go integer.
+func asIntegerOperand(v reflect.Value) (int64, bool, bool) {
+	if n, ok := jtypes.AsInt64(v); ok {
+		return n, true, true
+	}
+
+	if f, ok := jtypes.AsNumber(v); ok && isInteger(f) && math.Abs(f) <= maxExactFloat {
+		return int64(f), false, true
+	}
+
+	return 0, false, false
+}
+
+// evalIntegerOperator applies a numeric operator to two integers,
+// at least one of which must be a Go integer (e.g. an int64 from
+// the input data). The second return value is false if the
+// operands are not integers, if the operator is division, or
+// if the result overflows an int64. In those cases the caller
+// falls back to floating point arithmetic.
+func evalIntegerOperator(typ jparse.NumericOperator, lhsValue, rhsValue reflect.Value) (int64, bool) {
+	x, xIsInt, ok := asIntegerOperand(lhsValue)
+	if !ok {
+		return 0, false
+	}
+
+	y, yIsInt, ok := asIntegerOperand(rhsValue)
+	if !ok || (!xIsInt && !yIsInt) {
+		return 0, false
+	}
+
+	switch typ {
+	case jparse.NumericAdd:
+		z := x + y
+		if (x > 0 && y > 0 && z < 0) || (x < 0 && y < 0 && z >= 0) {
+			return 0, false
+		}
+		return z, true
+	case jparse.NumericSubtract:
+		z := x - y
+		if (x >= 0 && y < 0 && z < 0) || (x < 0 && y > 0 && z >= 0) {
+			return 0, false
+		}
+		return z, true
+	case jparse.NumericMultiply:
+		if x == 0 || y == 0 {
+			return 0, true
+		}
+		z := x * y
+		if z/y != x || (x == -1 && y == math.MinInt64) || (y == -1 && x == math.MinInt64) {
+			return 0, false
+		}
+		return z, true
+	case jparse.NumericModulo:
+		if y == 0 {
+			return 0, false
+		}
+		return x % y, true
+	default:
+		return 0, false
+	}
+}
+
+// evalDecimalOperator applies a numeric operator to two numbers,
+// at least one of which is a Decimal. The result is a Decimal.
+func evalDecimalOperator(node *jparse.NumericOperatorNode, lhsValue, rhsValue reflect.Value) (reflect.Value, error) {
+	lhs, ok := jtypes.ToDecimal(lhsValue)
+	if !ok {
+		return undefined, newEvalErrorAt(node, ErrNumberInf, nil, node.Type)
+	}
+
+	rhs, ok := jtypes.ToDecimal(rhsValue)
+	if !ok {
+		return undefined, newEvalErrorAt(node, ErrNumberInf, nil, node.Type)
+	}
+
+	x, y := lhs.Rat(), rhs.Rat()
+
+	switch node.Type {
+	case jparse.NumericAdd:
+		x.Add(x, y)
+	case jparse.NumericSubtract:
+		x.Sub(x, y)
+	case jparse.NumericMultiply:
+		x.Mul(x, y)
+	case jparse.NumericDivide:
+		if y.Sign() == 0 {
+			return undefined, newEvalErrorAt(node, ErrNumberInf, nil, node.Type)
+		}
+		x.Quo(x, y)
+	case jparse.NumericModulo:
+		if y.Sign() == 0 {
+			return undefined, newEvalErrorAt(node, ErrNumberNaN, nil, node.Type)
+		}
+		// Like math.Mod, the result has the sign of x.
+		q := new(big.Rat).Quo(x, y)
+		n := new(big.Int).Quo(q.Num(), q.Denom())
+		x.Sub(x, q.Mul(y, q.SetInt(n)))
+	default:
+		panicf("unrecognised numeric operator %q", node.Type)
+	}
+
+	return reflect.ValueOf(jtypes.NewDecimal(x)), nil
+}
+
 // See https://docs.jsonata.org/expressions#comparison-expressions
 func evalComparisonOperator(node *jparse.ComparisonOperatorNode, data reflect.Value, env *environment) (reflect.Value, error) {
 	evaluate := func(node jparse.Node) (reflect.Value, bool, bool, error) {
@@ -1056,7 +2037,7 @@ func evalComparisonOperator(node *jparse.ComparisonOperatorNode, data reflect.Va
 
 		if lhs != undefined && rhs != undefined &&
 			(lhsNumber != rhsNumber || lhsString != rhsString) {
-			return undefined, newEvalError(ErrTypeMismatch, nil, node.Type)
+			return undefined, newEvalErrorAt(node, ErrTypeMismatch, nil, node.Type)
 		}
 	}
 
@@ -1065,6 +2046,15 @@ func evalComparisonOperator(node *jparse.ComparisonOperatorNode, data reflect.Va
 		return reflect.ValueOf(false), nil
 	}
 
+	if lhsString && rhsString && needComparableTypes(node.Type) {
+		if b, ok := compareTimestamps(node, lhs, rhs, env); ok {
+			return reflect.ValueOf(b), nil
+		}
+		if b, ok := compareCollated(node.Type, lhs, rhs, env); ok {
+			return reflect.ValueOf(b), nil
+		}
+	}
+
 	var b bool
 
 	switch node.Type {
@@ -1098,49 +2088,24 @@ func needComparableTypes(op jparse.ComparisonOperator) bool {
 	}
 }
 
+// eq implements the = operator. It's also used by the in
+// operator to compare the left hand side with each item on
+// the right. Values are compared with jlib.DeepEqual, the same
+// equality used by the $deepEqual and $distinct functions:
+//
+// Numbers are compared by value, regardless of their Go types
+// (e.g. 1 = 1.0). Strings and booleans are compared by value.
+// Arrays and objects are compared structurally, all the way
+// down, and Go structs are equal to objects with the same keys
+// and values. Functions are only equal to themselves.
 func eq(lhs, rhs reflect.Value) bool {
-	// Numbers, strings, arrays, objects and booleans are compared by value.
-	// Two strings might be different objects in memory but
-	// they're still considered equal if they have the
-	// same value.
-
-	if v1, ok := jtypes.AsNumber(lhs); ok {
-		v2, ok := jtypes.AsNumber(rhs)
-		return ok && v1 == v2
-	}
-
-	if v1, ok := jtypes.AsString(lhs); ok {
-		v2, ok := jtypes.AsString(rhs)
-		return ok && v1 == v2
-	}
-
-	if v1, ok := jtypes.AsBool(lhs); ok {
-		v2, ok := jtypes.AsBool(rhs)
-		return ok && v1 == v2
-	}
-
-	// Arrays and maps are compared with a deep equal
-	if jtypes.IsArray(lhs) && jtypes.IsArray(rhs) {
-		return reflect.DeepEqual(lhs.Interface(), rhs.Interface())
-	}
-
-	if jtypes.IsMap(lhs) && jtypes.IsMap(rhs) {
-		return reflect.DeepEqual(lhs.Interface(), rhs.Interface())
-	}
-
-	// All other types (e.g. functions) are
-	// compared directly. Two functions with the same contents
-	// are not considered equal unless they're the same
-	// physical object in memory.
-
-	return lhs == rhs
+	return jlib.DeepEqual(lhs, rhs)
 }
 
 func lt(lhs, rhs reflect.Value) bool {
-	if v1, ok := jtypes.AsNumber(lhs); ok {
-		if v2, ok := jtypes.AsNumber(rhs); ok {
-			return v1 < v2
-		}
+	if jtypes.IsNumber(lhs) && jtypes.IsNumber(rhs) {
+		cmp, ok := jtypes.CompareNumbers(lhs, rhs)
+		return ok && cmp < 0
 	}
 
 	if v1, ok := jtypes.AsString(lhs); ok {
@@ -1230,26 +2195,134 @@ func evalStringConcatenation(node *jparse.StringConcatenationNode, data reflect.
 		return undefined, err
 	}
 
+	// Check the length of the result before allocating it.
+	if opts := env.evalOptions(); opts != nil && opts.MaxStringLength > 0 {
+		if len(s1)+len(s2) > opts.MaxStringLength {
+			return undefined, newLimitError("MaxStringLength", opts.MaxStringLength)
+		}
+	}
+
 	return reflect.ValueOf(s1 + s2), nil
 }
 
 // Helper functions
 
-func walkObjectValues(v reflect.Value, fn func(reflect.Value)) {
+// walkObjectValues calls fn for each item in an array or each
+// value in an object. Object values are visited in a stable
+// order (see objectKeys). It stops at the first error returned
+// by fn and returns it.
+func walkObjectValues(v reflect.Value, fn func(reflect.Value) error) error {
 	switch v := jtypes.Resolve(v); {
 	case jtypes.IsArray(v):
 		for i, N := 0, v.Len(); i < N; i++ {
-			fn(v.Index(i))
+			if err := fn(v.Index(i)); err != nil {
+				return err
+			}
 		}
 	case jtypes.IsMap(v):
-		for _, k := range v.MapKeys() {
-			fn(v.MapIndex(k))
+		for _, k := range objectKeys(v) {
+			if err := fn(jtypes.MapIndex(v, k)); err != nil {
+				return err
+			}
 		}
 	case jtypes.IsStruct(v):
-		for i, N := 0, v.NumField(); i < N; i++ {
-			fn(v.Field(i))
+		for _, field := range jtypes.StructFields(v.Type()) {
+			if fv := field.Value(v); fv.IsValid() {
+				if err := fn(fv); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// objectKeys returns the keys of v, which must be a map or an
+// OrderedMap, in a stable order. The keys of an OrderedMap are
+// returned in insertion order. Go maps don't record the order
+// of their keys, so their keys are sorted lexicographically.
+func objectKeys(v reflect.Value) []reflect.Value {
+
+	keys := jtypes.MapKeys(v)
+	if _, ok := jtypes.AsOrderedMap(v); ok {
+		return keys
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keyString(keys[i]) < keyString(keys[j])
+	})
+
+	return keys
+}
+
+func keyString(k reflect.Value) string {
+	if s, ok := jlib.KeyString(k); ok {
+		return s
+	}
+	return fmt.Sprint(k.Interface())
+}
+
+func evalCustomOperator(node *jparse.CustomOperatorNode, data reflect.Value, env *environment) (reflect.Value, error) {
+	op, ok := env.operators[node.Symbol]
+	if !ok {
+		return undefined, &OperatorError{
+			Operator: node.Symbol,
+			Position: node.Start,
+			Err:      errUnknownOperator,
 		}
 	}
+
+	// Evaluate both sides and return any errors.
+	lhs, err := eval(node.LHS, data, env)
+	if err != nil {
+		return undefined, err
+	}
+
+	rhs, err := eval(node.RHS, data, env)
+	if err != nil {
+		return undefined, err
+	}
+
+	if !op.EvalUndefined && (lhs == undefined || rhs == undefined) {
+		return undefined, nil
+	}
+
+	operand := func(v reflect.Value) interface{} {
+		if isNull(v) {
+			return nil
+		}
+		return interfaceOrNil(v)
+	}
+
+	res, err := op.Func(operand(lhs), operand(rhs))
+	if err != nil {
+		if err == jtypes.ErrUndefined {
+			return undefined, nil
+		}
+		return undefined, &OperatorError{
+			Operator: node.Symbol,
+			Position: node.Start,
+			Err:      err,
+		}
+	}
+
+	return reflect.ValueOf(res), nil
+}
+
+// errUnknownOperator is the error in the OperatorError returned
+// for a custom operator that is not available to the evaluation.
+var errUnknownOperator = errors.New("operator is not registered")
+
+// isNull returns true if v is the JSON null value or some
+// other nil pointer.
+func isNull(v reflect.Value) bool {
+	v = jtypes.Resolve(v)
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	default:
+		return false
+	}
 }
 
 func normalizeArray(v reflect.Value) reflect.Value {
@@ -1335,6 +2408,11 @@ func (s sequence) Value() reflect.Value {
 	case n == 0:
 		return undefined
 	case n == 1 && !s.keepSingletons:
+		if s.values[0] == nil {
+			// A nil interface is the JSON null value from the
+			// input data. It is not undefined.
+			return reflect.ValueOf(null)
+		}
 		return reflect.ValueOf(s.values[0])
 	default:
 		return reflect.ValueOf(s.values)
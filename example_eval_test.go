@@ -44,3 +44,37 @@ func ExampleExpr_Eval() {
 	fmt.Println(res)
 	// Output: 135
 }
+
+func ExampleExpr_EvalOrdered() {
+
+	var data interface{}
+
+	// Decode JSON.
+	err := json.Unmarshal([]byte(jsonString), &data)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create expression.
+	e := jsonata.MustCompile(`{
+		"total": $sum(orders.(price*quantity)),
+		"count": $count(orders),
+		"average": $average(orders.price)
+	}`)
+
+	// Evaluate.
+	res, err := e.EvalOrdered(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Encode JSON. Keys appear in the order they were
+	// created.
+	b, err := json.Marshal(res)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println(string(b))
+	// Output: {"total":135,"count":3,"average":36.833333333333336}
+}
@@ -0,0 +1,562 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jsonata
+
+import (
+	"reflect"
+
+	"github.com/blues/jsonata-go/jparse"
+	"github.com/blues/jsonata-go/jtypes"
+)
+
+// foldableFuncs lists the built-in functions that Optimize
+// may call ahead of time. They have no side effects, return
+// the same result for the same arguments and do not take
+// function arguments.
+var foldableFuncs = map[string]bool{
+	"string":             true,
+	"length":             true,
+	"substring":          true,
+	"substringBefore":    true,
+	"substringAfter":     true,
+	"uppercase":          true,
+	"lowercase":          true,
+	"pad":                true,
+	"trim":               true,
+	"contains":           true,
+	"split":              true,
+	"join":               true,
+	"formatNumber":       true,
+	"formatBase":         true,
+	"formatInteger":      true,
+	"parseInteger":       true,
+	"base64encode":       true,
+	"base64decode":       true,
+	"decodeUrl":          true,
+	"decodeUrlComponent": true,
+	"encodeUrl":          true,
+	"encodeUrlComponent": true,
+	"number":             true,
+	"abs":                true,
+	"floor":              true,
+	"ceil":               true,
+	"round":              true,
+	"power":              true,
+	"sqrt":               true,
+	"sum":                true,
+	"max":                true,
+	"min":                true,
+	"average":            true,
+	"boolean":            true,
+	"not":                true,
+	"exists":             true,
+	"isNull":             true,
+	"distinct":           true,
+	"count":              true,
+	"reverse":            true,
+	"zip":                true,
+	"append":             true,
+	"keys":               true,
+	"lookup":             true,
+	"spread":             true,
+	"merge":              true,
+	"deepEqual":          true,
+	"type":               true,
+}
+
+// Optimize evaluates the constant parts of the expression
+// ahead of time so that Eval does not repeat the work on every
+// call. Constant parts include operators whose operands are
+// literals, array constructors whose items are constant and
+// calls to built-in functions such as $uppercase, $round and
+// $join with constant arguments.
+//
+// Parts of the expression that read the input data or refer
+// to variables are never folded, and nor are calls to $now,
+// $millis, $random, $trace or custom functions, or comparisons
+// of strings with <, <=, > and >=, which depend on the collator
+// (see SetCollator). Parts that return an error are left for
+// Eval to report. Optimize therefore does not change the
+// results of the expression.
+//
+// Optimize should be called after RegisterExts and RegisterVars.
+// A custom function or variable registered afterwards, or passed
+// to EvalWithVars, does not replace a built-in function of the
+// same name if the call has already been folded.
+//
+// Like RegisterExts, Optimize modifies the Expr and must not be
+// called concurrently with any other method. Copies made with
+// Clone after Optimize share the optimized expression.
+func (e *Expr) Optimize() {
+
+	f := &folder{
+		env:      e.newEnv(undefined, nil),
+		shadowed: boundNames(e.node),
+	}
+
+	for name := range e.registry {
+		f.shadowed[name] = true
+	}
+
+	e.node, _ = f.fold(e.node)
+}
+
+// A constantNode replaces a part of the syntax tree that
+// always evaluates to the same value. It embeds the original
+// node, which it prints in the same way.
+type constantNode struct {
+	jparse.Node
+	value reflect.Value
+}
+
+func evalConstant(node *constantNode, data reflect.Value, env *environment) (reflect.Value, error) {
+	return copyConstant(node.value), nil
+}
+
+// copyConstant returns a deep copy of the arrays and objects in
+// v, which is shared between evaluations, so that callers cannot
+// modify it. Unlike jlib.Clone, it preserves the types of v and
+// its contents.
+func copyConstant(v reflect.Value) reflect.Value {
+
+	if m, ok := jtypes.AsOrderedMap(v); ok {
+		res := jtypes.NewOrderedMap(m.Len())
+		for _, key := range m.Keys() {
+			value, _ := m.Get(key)
+			res.Set(key, copyConstant(reflect.ValueOf(value)).Interface())
+		}
+		return reflect.ValueOf(res)
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		return copyConstant(v.Elem())
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		res := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			res.Index(i).Set(copyConstant(v.Index(i)))
+		}
+		return res
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		res := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for _, key := range v.MapKeys() {
+			res.SetMapIndex(key, copyConstant(v.MapIndex(key)))
+		}
+		return res
+	default:
+		return v
+	}
+}
+
+// A folder replaces the constant parts of a syntax tree with
+// constantNodes.
+type folder struct {
+	env *environment
+
+	// shadowed contains the names of variables that may hide
+	// a built-in function, e.g. because the expression assigns
+	// to them or uses them as lambda parameters.
+	shadowed map[string]bool
+}
+
+// fold returns a copy of node in which constant subtrees have
+// been replaced by constantNodes. The original tree is not
+// modified because it may be shared with other Exprs (see
+// Clone). The second return value is true if node is constant,
+// i.e. it always evaluates to the same value.
+func (f *folder) fold(node jparse.Node) (jparse.Node, bool) {
+
+	switch node := node.(type) {
+	case *jparse.StringNode, *jparse.NumberNode, *jparse.BooleanNode, *jparse.NullNode, *jparse.RegexNode:
+		// Literals are constant but there is nothing to gain
+		// from replacing them.
+		return node, true
+
+	case *jparse.NegationNode:
+		n := *node
+		var isConst bool
+		n.RHS, isConst = f.fold(node.RHS)
+		return f.constant(&n, isConst)
+
+	case *jparse.NumericOperatorNode:
+		n := *node
+		isConst := f.foldPair(&n.LHS, &n.RHS)
+		return f.constant(&n, isConst)
+
+	case *jparse.ComparisonOperatorNode:
+		n := *node
+		isConst := f.foldPair(&n.LHS, &n.RHS)
+		if isConst && isOrdering(n.Type) && (isStringConstant(n.LHS) || isStringConstant(n.RHS)) {
+			// The result depends on the collator, which can
+			// be changed after Optimize (see SetCollator).
+			isConst = false
+		}
+		return f.constant(&n, isConst)
+
+	case *jparse.BooleanOperatorNode:
+		n := *node
+		isConst := f.foldPair(&n.LHS, &n.RHS)
+		return f.constant(&n, isConst)
+
+	case *jparse.StringConcatenationNode:
+		n := *node
+		isConst := f.foldPair(&n.LHS, &n.RHS)
+		return f.constant(&n, isConst)
+
+	case *jparse.CustomOperatorNode:
+		// Custom operators may not be pure functions, so
+		// they are never folded.
+		n := *node
+		f.foldPair(&n.LHS, &n.RHS)
+		return &n, false
+
+	case *jparse.CoalesceNode:
+		n := *node
+		isConst := f.foldPair(&n.LHS, &n.RHS)
+		return f.constant(&n, isConst)
+
+	case *jparse.ConditionalNode:
+		n := *node
+		isConst := f.foldPair(&n.If, &n.Then)
+		if n.Else != nil {
+			var elseConst bool
+			n.Else, elseConst = f.fold(node.Else)
+			isConst = isConst && elseConst
+		}
+		return f.constant(&n, isConst)
+
+	case *jparse.ArrayNode:
+		n := *node
+		var isConst bool
+		n.Items, isConst = f.foldList(node.Items)
+		return f.constant(&n, isConst)
+
+	case *jparse.BlockNode:
+		n := *node
+		var isConst bool
+		n.Exprs, isConst = f.foldList(node.Exprs)
+		return f.constant(&n, isConst)
+
+	case *jparse.FunctionCallNode:
+		n := *node
+		var isConst bool
+		n.Args, isConst = f.foldList(node.Args)
+		return f.constant(&n, isConst && f.isFoldableCall(&n))
+
+	case *jparse.FunctionApplicationNode:
+		// The right hand side of a function application is
+		// called with the left hand side as its first argument,
+		// so a function call on the right can't be evaluated
+		// by itself. Fold its arguments instead.
+		n := *node
+		n.LHS, _ = f.fold(node.LHS)
+		if call, ok := node.RHS.(*jparse.FunctionCallNode); ok {
+			c := *call
+			c.Args, _ = f.foldList(call.Args)
+			n.RHS = &c
+		} else {
+			n.RHS, _ = f.fold(node.RHS)
+		}
+		return &n, false
+
+	case *jparse.PartialNode:
+		n := *node
+		n.Func, _ = f.fold(node.Func)
+		n.Args, _ = f.foldList(node.Args)
+		return &n, false
+
+	case *jparse.RangeNode:
+		n := *node
+		f.foldPair(&n.LHS, &n.RHS)
+		return &n, false
+
+	case *jparse.PathNode:
+		n := *node
+		n.Steps, _ = f.foldList(node.Steps)
+		return &n, false
+
+	case *jparse.PredicateNode:
+		n := *node
+		n.Expr, _ = f.fold(node.Expr)
+		n.Filters, _ = f.foldList(node.Filters)
+		return &n, false
+
+	case *jparse.ObjectNode:
+		// Object constructors depend on their input even when
+		// all of their keys and values are constant (e.g. an
+		// empty array produces an empty object). Fold the keys
+		// and values only.
+		n := *node
+		n.Pairs = f.foldPairs(node.Pairs)
+		n.Bindings = f.foldBindings(node.Bindings)
+		return &n, false
+
+	case *jparse.GroupNode:
+		n := *node
+		n.Expr, _ = f.fold(node.Expr)
+		obj := *node.ObjectNode
+		obj.Pairs = f.foldPairs(node.Pairs)
+		obj.Bindings = f.foldBindings(node.Bindings)
+		n.ObjectNode = &obj
+		return &n, false
+
+	case *jparse.SortNode:
+		n := *node
+		n.Expr, _ = f.fold(node.Expr)
+		n.Terms = make([]jparse.SortTerm, len(node.Terms))
+		for i, term := range node.Terms {
+			term.Expr, _ = f.fold(term.Expr)
+			n.Terms[i] = term
+		}
+		return &n, false
+
+	case *jparse.AssignmentNode:
+		n := *node
+		n.Value, _ = f.fold(node.Value)
+		return &n, false
+
+	case *jparse.LambdaNode:
+		n := *node
+		n.Body, _ = f.fold(node.Body)
+		return &n, false
+
+	case *jparse.TypedLambdaNode:
+		n := *node
+		lambda := *node.LambdaNode
+		lambda.Body, _ = f.fold(node.Body)
+		n.LambdaNode = &lambda
+		return &n, false
+
+	case *jparse.ObjectTransformationNode:
+		n := *node
+		n.Pattern, _ = f.fold(node.Pattern)
+		n.Updates, _ = f.fold(node.Updates)
+		if n.Deletes != nil {
+			n.Deletes, _ = f.fold(node.Deletes)
+		}
+		return &n, false
+
+	case *jparse.PositionalBindingNode:
+		n := *node
+		n.Expr, _ = f.fold(node.Expr)
+		return &n, false
+
+	case *jparse.ContextBindingNode:
+		n := *node
+		n.Expr, _ = f.fold(node.Expr)
+		return &n, false
+
+	default:
+		// Variables, names, wildcards and the like depend on
+		// the input data or the environment.
+		return node, false
+	}
+}
+
+// foldPair folds the given nodes in place and reports whether
+// both are constant.
+func (f *folder) foldPair(lhs, rhs *jparse.Node) bool {
+	var lhsConst, rhsConst bool
+	*lhs, lhsConst = f.fold(*lhs)
+	*rhs, rhsConst = f.fold(*rhs)
+	return lhsConst && rhsConst
+}
+
+// isOrdering reports whether op orders its operands, i.e. it
+// is one of <, <=, > and >=.
+func isOrdering(op jparse.ComparisonOperator) bool {
+	switch op {
+	case jparse.ComparisonLess, jparse.ComparisonLessEqual, jparse.ComparisonGreater, jparse.ComparisonGreaterEqual:
+		return true
+	default:
+		return false
+	}
+}
+
+// isStringConstant reports whether node, a constant node
+// returned by fold, evaluates to a string.
+func isStringConstant(node jparse.Node) bool {
+	switch node := node.(type) {
+	case *jparse.StringNode:
+		return true
+	case *constantNode:
+		return jtypes.IsString(node.value)
+	default:
+		return false
+	}
+}
+
+// foldList returns a new slice containing the folded nodes and
+// reports whether all of them are constant.
+func (f *folder) foldList(nodes []jparse.Node) ([]jparse.Node, bool) {
+
+	if nodes == nil {
+		return nil, true
+	}
+
+	isConst := true
+	results := make([]jparse.Node, len(nodes))
+
+	for i, node := range nodes {
+		var ok bool
+		results[i], ok = f.fold(node)
+		isConst = isConst && ok
+	}
+
+	return results, isConst
+}
+
+func (f *folder) foldPairs(pairs [][2]jparse.Node) [][2]jparse.Node {
+
+	results := make([][2]jparse.Node, len(pairs))
+
+	for i, pair := range pairs {
+		results[i][0], _ = f.fold(pair[0])
+		results[i][1], _ = f.fold(pair[1])
+	}
+
+	return results
+}
+
+func (f *folder) foldBindings(bindings []jparse.ObjectBinding) []jparse.ObjectBinding {
+
+	if len(bindings) == 0 {
+		return nil
+	}
+
+	results := make([]jparse.ObjectBinding, len(bindings))
+
+	for i, b := range bindings {
+		node, _ := f.fold(b.Assignment)
+		results[i] = jparse.ObjectBinding{
+			Assignment: node.(*jparse.AssignmentNode),
+			Pair:       b.Pair,
+		}
+	}
+
+	return results
+}
+
+// isFoldableCall reports whether node, a call with constant
+// arguments, can be evaluated ahead of time. The function must
+// be a foldable built-in that is not hidden by a variable of
+// the same name, and it must not use the evaluation context
+// in place of a missing argument.
+func (f *folder) isFoldableCall(node *jparse.FunctionCallNode) bool {
+
+	sym, ok := node.Func.(*jparse.VariableNode)
+	if !ok || !foldableFuncs[sym.Name] || f.shadowed[sym.Name] {
+		return false
+	}
+
+	fn, ok := jtypes.AsCallable(f.env.lookup(sym.Name))
+	if !ok {
+		return false
+	}
+
+	c, ok := fn.(*goCallable)
+	if !ok || c.hasCallContext || c.hasCtx {
+		return false
+	}
+
+	argv := make([]reflect.Value, len(node.Args))
+	for i, arg := range node.Args {
+		v, err := eval(arg, undefined, f.env)
+		if err != nil {
+			return false
+		}
+		argv[i] = v
+	}
+
+	return !c.usesContext(argv)
+}
+
+// constant evaluates node, if it is constant, and returns a
+// constantNode holding the result. Nodes that return an error
+// or a function are not replaced. Nor are nodes that evaluate
+// to undefined, although they are still constant.
+func (f *folder) constant(node jparse.Node, isConst bool) (jparse.Node, bool) {
+
+	if !isConst {
+		return node, false
+	}
+
+	v, err := eval(node, undefined, f.env)
+	if err != nil || containsCallable(v) {
+		return node, false
+	}
+
+	if v == undefined {
+		return node, true
+	}
+
+	return &constantNode{
+		Node:  node,
+		value: v,
+	}, true
+}
+
+// containsCallable reports whether v is a function or an
+// array or object that contains a function.
+func containsCallable(v reflect.Value) bool {
+
+	switch {
+	case jtypes.IsCallable(v):
+		return true
+	case jtypes.IsArray(v):
+		v = jtypes.Resolve(v)
+		for i := 0; i < v.Len(); i++ {
+			if containsCallable(v.Index(i)) {
+				return true
+			}
+		}
+	case jtypes.IsMap(v):
+		for _, key := range jtypes.MapKeys(v) {
+			if containsCallable(jtypes.MapIndex(v, key)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// boundNames returns the names of the variables that the
+// expression binds, e.g. by assignment or as lambda parameters.
+func boundNames(node jparse.Node) map[string]bool {
+
+	names := map[string]bool{}
+
+	jparse.Walk(node, func(node jparse.Node) bool {
+		switch node := node.(type) {
+		case *jparse.AssignmentNode:
+			names[node.Name] = true
+		case *jparse.LambdaNode:
+			for _, name := range node.BoundNames() {
+				names[name] = true
+			}
+		case *jparse.TypedLambdaNode:
+			for _, name := range node.BoundNames() {
+				names[name] = true
+			}
+		case *jparse.PositionalBindingNode:
+			names[node.Name] = true
+		case *jparse.ContextBindingNode:
+			names[node.Name] = true
+		}
+		return true
+	})
+
+	return names
+}
@@ -0,0 +1,664 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jsonata
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/blues/jsonata-go/jparse"
+	"github.com/blues/jsonata-go/jtypes"
+)
+
+// Types reported in the InferredType field of an InputRef.
+const (
+	InputTypeUnknown  = ""
+	InputTypeNumber   = "number"
+	InputTypeString   = "string"
+	InputTypeBoolean  = "boolean"
+	InputTypeArray    = "array"
+	InputTypeObject   = "object"
+	InputTypeFunction = "function"
+	InputTypeDynamic  = "dynamic"
+)
+
+// An InputRef describes a value in the input data that an
+// expression reads (see Expr.Inputs).
+type InputRef struct {
+
+	// Path holds the field names that lead from the root of
+	// the input data to the value. Wildcards are represented
+	// by "*" and the descendant operator by "**".
+	Path []string
+
+	// Wildcard is true if Path contains a wildcard or a
+	// descendant operator.
+	Wildcard bool
+
+	// InferredType is the type that the expression expects the
+	// value to have, based on the operator or function that
+	// consumes it. It is one of the InputType constants.
+	// InputTypeUnknown means that the expression accepts any
+	// type or that the type cannot be inferred. InputTypeDynamic
+	// means that the value is passed to a function or lookup
+	// whose use of it cannot be analysed, so the expression
+	// may read any part of it.
+	InferredType string
+}
+
+func (r InputRef) String() string {
+	s := strings.Join(r.Path, ".")
+	if r.InferredType != InputTypeUnknown {
+		s += " (" + r.InferredType + ")"
+	}
+	return s
+}
+
+// Inputs returns the values in the input data that the Expr
+// reads, sorted by path. It analyses the expression without
+// evaluating it. For example, the expression
+//
+//	Account.Order.Product.(Price * Quantity)
+//
+// reads Account.Order.Product.Price and Account.Order.Product.Quantity,
+// both of which are expected to be numbers.
+//
+// Values are reported at the point where the expression uses
+// them. The objects and arrays that lead to a value are not
+// reported separately. Paths that start from the $ and $$
+// variables are resolved to the input data. Paths that start
+// from variables bound by the expression are resolved where
+// the variable's value is known, e.g. if it was assigned a
+// path or is a parameter of a function passed to $map or
+// $filter. Values that are read by other functions, or by
+// dynamic lookups such as $lookup, are reported with an
+// InferredType of InputTypeDynamic.
+func (e *Expr) Inputs() []InputRef {
+
+	a := &inputAnalyzer{
+		env:  e.newEnv(undefined, nil),
+		refs: map[string]*InputRef{},
+	}
+
+	root := &inputPath{}
+	a.use(a.analyze(e.node, root, inputScope{}), InputTypeUnknown)
+
+	refs := make([]InputRef, 0, len(a.refs))
+	for _, ref := range a.refs {
+		refs = append(refs, *ref)
+	}
+
+	sort.Slice(refs, func(i, j int) bool {
+		return lessPath(refs[i].Path, refs[j].Path)
+	})
+
+	return refs
+}
+
+// lessPath compares two paths one field name at a time.
+func lessPath(p1, p2 []string) bool {
+	for i := 0; i < len(p1) && i < len(p2); i++ {
+		if p1[i] != p2[i] {
+			return p1[i] < p2[i]
+		}
+	}
+	return len(p1) < len(p2)
+}
+
+// An inputPath is the location in the input data of a value
+// produced by an expression. A nil inputPath means that the
+// value does not come from the input data, or that its origin
+// is not known.
+type inputPath struct {
+	steps []string
+}
+
+func (p *inputPath) child(name string) *inputPath {
+	if p == nil {
+		return nil
+	}
+
+	steps := make([]string, len(p.steps)+1)
+	copy(steps, p.steps)
+	steps[len(p.steps)] = name
+
+	return &inputPath{
+		steps: steps,
+	}
+}
+
+func (p *inputPath) parent() *inputPath {
+	if p == nil || len(p.steps) == 0 {
+		return nil
+	}
+
+	return &inputPath{
+		steps: p.steps[:len(p.steps)-1],
+	}
+}
+
+// An inputScope maps the variables bound by an expression to
+// the locations of their values. Variables that are bound to
+// values from elsewhere map to nil.
+type inputScope map[string]*inputPath
+
+func (s inputScope) with(names ...string) inputScope {
+
+	scope := make(inputScope, len(s)+len(names))
+	for name, p := range s {
+		scope[name] = p
+	}
+
+	for _, name := range names {
+		scope[name] = nil
+	}
+
+	return scope
+}
+
+// An inputAnalyzer performs the analysis for Expr.Inputs.
+type inputAnalyzer struct {
+	env  *environment
+	refs map[string]*InputRef
+}
+
+// use records that the expression reads the value at p with
+// the given type. If the value has already been recorded with
+// a different type, the type is changed to InputTypeUnknown,
+// unless either type is InputTypeDynamic, which always wins.
+func (a *inputAnalyzer) use(p *inputPath, typ string) {
+
+	if p == nil || len(p.steps) == 0 {
+		return
+	}
+
+	key := strings.Join(p.steps, "\x00")
+
+	ref, ok := a.refs[key]
+	if !ok {
+		wildcard := false
+		for _, step := range p.steps {
+			if step == "*" || step == "**" {
+				wildcard = true
+			}
+		}
+
+		a.refs[key] = &InputRef{
+			Path:         p.steps,
+			Wildcard:     wildcard,
+			InferredType: typ,
+		}
+		return
+	}
+
+	switch {
+	case ref.InferredType == typ, ref.InferredType == InputTypeDynamic:
+	case typ == InputTypeDynamic, ref.InferredType == InputTypeUnknown:
+		ref.InferredType = typ
+	case typ != InputTypeUnknown:
+		ref.InferredType = InputTypeUnknown
+	}
+}
+
+// analyze records the values that node reads from the input
+// data when it is evaluated with the context ctx. It returns
+// the location of node's own value, which the caller must
+// pass to use (possibly after navigating further into it).
+func (a *inputAnalyzer) analyze(node jparse.Node, ctx *inputPath, scope inputScope) *inputPath {
+
+	switch node := node.(type) {
+	case *jparse.NameNode:
+		return ctx.child(node.Value)
+
+	case *jparse.WildcardNode:
+		return ctx.child("*")
+
+	case *jparse.DescendentNode:
+		return ctx.child("**")
+
+	case *jparse.ParentNode:
+		return ctx.parent()
+
+	case *jparse.VariableNode:
+		switch node.Name {
+		case "":
+			return ctx
+		case "$":
+			return &inputPath{}
+		default:
+			return scope[node.Name]
+		}
+
+	case *jparse.PathNode:
+		for _, step := range node.Steps {
+			ctx = a.analyze(step, ctx, scope)
+		}
+		return ctx
+
+	case *jparse.PredicateNode:
+		p := a.analyze(node.Expr, ctx, scope)
+		for _, filter := range node.Filters {
+			a.use(a.analyze(filter, p, scope), InputTypeUnknown)
+		}
+		return p
+
+	case *jparse.SortNode:
+		p := a.analyze(node.Expr, ctx, scope)
+		for _, term := range node.Terms {
+			a.use(a.analyze(term.Expr, p, scope), InputTypeUnknown)
+		}
+		return p
+
+	case *jparse.PositionalBindingNode:
+		scope[node.Name] = nil
+		return a.analyze(node.Expr, ctx, scope)
+
+	case *jparse.ContextBindingNode:
+		// The next step is evaluated in the current context,
+		// not against the bound value.
+		scope[node.Name] = a.analyze(node.Expr, ctx, scope)
+		return ctx
+
+	case *jparse.GroupNode:
+		p := a.analyze(node.Expr, ctx, scope)
+		a.analyzeObject(node.ObjectNode, p, scope)
+		return nil
+
+	case *jparse.ObjectNode:
+		a.analyzeObject(node, ctx, scope)
+		return nil
+
+	case *jparse.BlockNode:
+		scope = scope.with()
+		var p *inputPath
+		for i, expr := range node.Exprs {
+			if i > 0 {
+				a.use(p, InputTypeUnknown)
+			}
+			p = a.analyze(expr, ctx, scope)
+		}
+		return p
+
+	case *jparse.AssignmentNode:
+		// The value is recorded where the variable is used.
+		scope[node.Name] = a.analyze(node.Value, ctx, scope)
+		return nil
+
+	case *jparse.LambdaNode:
+		a.analyzeLambda(node, ctx, scope, nil)
+		return nil
+
+	case *jparse.TypedLambdaNode:
+		a.analyzeLambda(node.LambdaNode, ctx, scope, nil)
+		return nil
+
+	case *jparse.FunctionCallNode:
+		a.analyzeCall(node.Func, node.Args, nil, ctx, scope)
+		return nil
+
+	case *jparse.PartialNode:
+		a.analyzeCall(node.Func, node.Args, nil, ctx, scope)
+		return nil
+
+	case *jparse.FunctionApplicationNode:
+		p := a.analyze(node.LHS, ctx, scope)
+		switch rhs := node.RHS.(type) {
+		case *jparse.FunctionCallNode:
+			a.analyzeCall(rhs.Func, rhs.Args, p, ctx, scope)
+		case *jparse.ObjectTransformationNode:
+			a.use(p, InputTypeObject)
+			a.analyze(rhs, ctx, scope)
+		default:
+			a.analyzeCall(rhs, nil, p, ctx, scope)
+		}
+		return nil
+
+	case *jparse.ObjectTransformationNode:
+		// The transform operator applies to the object that
+		// is passed to it, not to the input data.
+		a.analyze(node.Pattern, nil, scope)
+		a.analyze(node.Updates, nil, scope)
+		a.analyze(node.Deletes, nil, scope)
+		return nil
+
+	case *jparse.NegationNode:
+		a.use(a.analyze(node.RHS, ctx, scope), InputTypeNumber)
+		return nil
+
+	case *jparse.RangeNode:
+		a.use(a.analyze(node.LHS, ctx, scope), InputTypeNumber)
+		a.use(a.analyze(node.RHS, ctx, scope), InputTypeNumber)
+		return nil
+
+	case *jparse.NumericOperatorNode:
+		a.use(a.analyze(node.LHS, ctx, scope), InputTypeNumber)
+		a.use(a.analyze(node.RHS, ctx, scope), InputTypeNumber)
+		return nil
+
+	case *jparse.StringConcatenationNode:
+		a.use(a.analyze(node.LHS, ctx, scope), InputTypeString)
+		a.use(a.analyze(node.RHS, ctx, scope), InputTypeString)
+		return nil
+
+	case *jparse.BooleanOperatorNode:
+		a.use(a.analyze(node.LHS, ctx, scope), InputTypeBoolean)
+		a.use(a.analyze(node.RHS, ctx, scope), InputTypeBoolean)
+		return nil
+
+	case *jparse.ComparisonOperatorNode:
+		if node.Type == jparse.ComparisonIn {
+			a.use(a.analyze(node.LHS, ctx, scope), literalType(node.RHS))
+			a.use(a.analyze(node.RHS, ctx, scope), InputTypeUnknown)
+			return nil
+		}
+		// The operands of a comparison are expected to have
+		// the same type, so a literal on one side tells us
+		// the type of the other.
+		a.use(a.analyze(node.LHS, ctx, scope), literalType(node.RHS))
+		a.use(a.analyze(node.RHS, ctx, scope), literalType(node.LHS))
+		return nil
+	}
+
+	// Other nodes evaluate their children in their own context.
+	jparse.Walk(node, func(child jparse.Node) bool {
+		if child == node {
+			return true
+		}
+		a.use(a.analyze(child, ctx, scope), InputTypeUnknown)
+		return false
+	})
+
+	return nil
+}
+
+// analyzeObject analyses the name/value pairs of an object
+// constructor or group-by expression.
+func (a *inputAnalyzer) analyzeObject(node *jparse.ObjectNode, ctx *inputPath, scope inputScope) {
+
+	scope = scope.with()
+	bindings := node.Bindings
+	for i, pair := range node.Pairs {
+		for len(bindings) > 0 && bindings[0].Pair <= i {
+			a.analyze(bindings[0].Assignment, ctx, scope)
+			bindings = bindings[1:]
+		}
+		a.use(a.analyze(pair[0], ctx, scope), InputTypeString)
+		a.use(a.analyze(pair[1], ctx, scope), InputTypeUnknown)
+	}
+	for _, b := range bindings {
+		a.analyze(b.Assignment, ctx, scope)
+	}
+}
+
+// analyzeLambda analyses the body of a lambda function. The
+// args hold the locations of the values passed to the lambda's
+// parameters, where known. The lambda's body is evaluated in
+// the context in which the lambda is defined.
+func (a *inputAnalyzer) analyzeLambda(node *jparse.LambdaNode, ctx *inputPath, scope inputScope, args []*inputPath) {
+
+	scope = scope.with(node.BoundNames()...)
+	for i, name := range node.ParamNames {
+		if name != "" && i < len(args) {
+			scope[name] = args[i]
+		}
+	}
+
+	a.use(a.analyze(node.Body, ctx, scope), InputTypeUnknown)
+}
+
+// itemParams lists the higher-order functions whose function
+// argument is called with the items of their first argument,
+// and which of the function's parameters receive the items.
+var itemParams = map[string][]int{
+	"map":    {0},
+	"filter": {0},
+	"single": {0},
+	"sort":   {0, 1},
+	"reduce": {1},
+	"each":   {0},
+	"sift":   {0},
+}
+
+// dynamicFuncs lists the built-in functions that read their
+// arguments in ways that cannot be analysed, e.g. by looking
+// up keys that are only known at evaluation time.
+var dynamicFuncs = map[string]bool{
+	"lookup": true,
+	"keys":   true,
+	"spread": true,
+	"merge":  true,
+	"eval":   true,
+}
+
+// analyzeCall analyses a call to the function fn with the
+// given arguments. If first is not nil, it is the location of
+// an extra first argument supplied by the ~> operator.
+func (a *inputAnalyzer) analyzeCall(fn jparse.Node, args []jparse.Node, first *inputPath, ctx *inputPath, scope inputScope) {
+
+	var paths []*inputPath
+	var lambdas []*jparse.LambdaNode
+
+	if first != nil {
+		paths = append(paths, first)
+		lambdas = append(lambdas, nil)
+	}
+
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case *jparse.LambdaNode:
+			lambdas = append(lambdas, arg)
+			paths = append(paths, nil)
+		case *jparse.TypedLambdaNode:
+			lambdas = append(lambdas, arg.LambdaNode)
+			paths = append(paths, nil)
+		default:
+			lambdas = append(lambdas, nil)
+			paths = append(paths, a.analyze(arg, ctx, scope))
+		}
+	}
+
+	name, params, ok := a.signature(fn, scope)
+	if !ok {
+		// The function is unknown or is defined by the
+		// expression itself.
+		switch fn := fn.(type) {
+		case *jparse.LambdaNode:
+			a.analyzeLambda(fn, ctx, scope, paths)
+		case *jparse.TypedLambdaNode:
+			a.analyzeLambda(fn.LambdaNode, ctx, scope, paths)
+		default:
+			a.use(a.analyze(fn, ctx, scope), InputTypeFunction)
+			for _, p := range paths {
+				a.use(p, InputTypeDynamic)
+			}
+		}
+		a.analyzeLambdas(lambdas, ctx, scope, nil)
+		return
+	}
+
+	// Functions that accept the context as their first
+	// argument use it when they are called with too few
+	// arguments.
+	if len(params) > 0 && params[0].Option == jparse.ParamContextable && len(paths) < requiredParams(params) {
+		paths = append([]*inputPath{ctx}, paths...)
+		lambdas = append([]*jparse.LambdaNode{nil}, lambdas...)
+	}
+
+	for i, p := range paths {
+		switch {
+		case dynamicFuncs[name]:
+			a.use(p, InputTypeDynamic)
+		case i < len(params):
+			a.use(p, paramInputType(params[i]))
+		case len(params) > 0 && params[len(params)-1].Option == jparse.ParamVariadic:
+			a.use(p, paramInputType(params[len(params)-1]))
+		default:
+			a.use(p, InputTypeUnknown)
+		}
+	}
+
+	var items *inputPath
+	if _, ok := itemParams[name]; ok && len(paths) > 0 {
+		items = paths[0]
+		if name == "each" || name == "sift" {
+			items = items.child("*")
+		}
+
+		// The items are passed to a function that the
+		// expression doesn't define.
+		if len(lambdas) < 2 || lambdas[1] == nil {
+			a.use(paths[0], InputTypeDynamic)
+		}
+	}
+
+	a.analyzeLambdas(lambdas, ctx, scope, func(i int) []*inputPath {
+		if items == nil || i != 1 {
+			return nil
+		}
+		args := make([]*inputPath, 3)
+		for _, n := range itemParams[name] {
+			args[n] = items
+		}
+		return args
+	})
+}
+
+// analyzeLambdas analyses the lambda functions passed to a
+// function call. The args function returns the locations of
+// the values passed to the i'th argument's parameters.
+func (a *inputAnalyzer) analyzeLambdas(lambdas []*jparse.LambdaNode, ctx *inputPath, scope inputScope, args func(int) []*inputPath) {
+	for i, lambda := range lambdas {
+		if lambda == nil {
+			continue
+		}
+		var params []*inputPath
+		if args != nil {
+			params = args(i)
+		}
+		a.analyzeLambda(lambda, ctx, scope, params)
+	}
+}
+
+// signature returns the name and signature of the built-in or
+// registered function that fn refers to. It returns false if
+// fn is not a known function.
+func (a *inputAnalyzer) signature(fn jparse.Node, scope inputScope) (string, []jparse.Param, bool) {
+
+	v, ok := fn.(*jparse.VariableNode)
+	if !ok || v.Name == "" || v.Name == "$" {
+		return "", nil, false
+	}
+
+	if _, ok := scope[v.Name]; ok {
+		return "", nil, false
+	}
+
+	c, ok := jtypes.AsCallable(a.env.lookup(v.Name))
+	if !ok {
+		return "", nil, false
+	}
+
+	gc, ok := c.(*goCallable)
+	if !ok {
+		return "", nil, false
+	}
+
+	if gc.signature != nil {
+		return v.Name, gc.signature, true
+	}
+
+	// Functions without a signature are described by the
+	// types of their Go parameters.
+	params := make([]jparse.Param, len(gc.params))
+	for i, p := range gc.params {
+		params[i] = jparse.Param{
+			Type: goParamType(p.t),
+		}
+	}
+
+	return v.Name, params, true
+}
+
+// requiredParams returns the number of parameters in a
+// signature that are not optional.
+func requiredParams(params []jparse.Param) int {
+	n := 0
+	for _, p := range params {
+		if p.Option != jparse.ParamOptional {
+			n++
+		}
+	}
+	return n
+}
+
+// paramInputType returns the InferredType for a value passed
+// to a parameter. Arrays of a single type are described by
+// the type of their items because paths that produce a
+// sequence of values (e.g. Order.Price) read items, not arrays.
+func paramInputType(p jparse.Param) string {
+	if p.Type == jparse.ParamTypeArray && len(p.SubParams) == 1 {
+		return paramInputType(p.SubParams[0])
+	}
+
+	switch p.Type {
+	case jparse.ParamTypeNumber:
+		return InputTypeNumber
+	case jparse.ParamTypeString:
+		return InputTypeString
+	case jparse.ParamTypeBool:
+		return InputTypeBoolean
+	case jparse.ParamTypeArray:
+		return InputTypeArray
+	case jparse.ParamTypeObject:
+		return InputTypeObject
+	case jparse.ParamTypeFunc:
+		return InputTypeFunction
+	default:
+		return InputTypeUnknown
+	}
+}
+
+// goParamType returns the ParamType that corresponds to a Go
+// type, or zero if there isn't one.
+func goParamType(t reflect.Type) jparse.ParamType {
+	if t == nil {
+		return 0
+	}
+
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return jparse.ParamTypeNumber
+	case reflect.String:
+		return jparse.ParamTypeString
+	case reflect.Bool:
+		return jparse.ParamTypeBool
+	case reflect.Slice, reflect.Array:
+		return jparse.ParamTypeArray
+	case reflect.Map, reflect.Struct:
+		return jparse.ParamTypeObject
+	case reflect.Func:
+		return jparse.ParamTypeFunc
+	default:
+		return 0
+	}
+}
+
+// literalType returns the InferredType that corresponds to a
+// literal value.
+func literalType(node jparse.Node) string {
+	switch node.(type) {
+	case *jparse.NumberNode:
+		return InputTypeNumber
+	case *jparse.StringNode:
+		return InputTypeString
+	case *jparse.BooleanNode:
+		return InputTypeBoolean
+	default:
+		return InputTypeUnknown
+	}
+}
@@ -5,31 +5,53 @@
 package jlib
 
 import (
-	"fmt"
+	"math/big"
 	"reflect"
 
 	"github.com/blues/jsonata-go/jtypes"
 )
 
 // Sum returns the total of an array of numbers. If the array is
-// empty, Sum returns 0.
-func Sum(v reflect.Value) (float64, error) {
+// empty, Sum returns 0. If all of the numbers are Go integers
+// (e.g. int64 values from the input data), Sum returns an int64,
+// unless the total overflows. If any of the numbers is a
+// *jtypes.Decimal, Sum returns the exact total as a Decimal.
+// Otherwise it returns a float64.
+func Sum(v reflect.Value) (interface{}, error) {
 
 	if !jtypes.IsArray(v) {
+		if d, ok := jtypes.AsDecimal(v); ok {
+			return d, nil
+		}
+		if n, ok := jtypes.AsInt64(v); ok {
+			return n, nil
+		}
 		if n, ok := jtypes.AsNumber(v); ok {
 			return n, nil
 		}
-		return 0, fmt.Errorf("cannot call sum on a non-array type")
+		return 0, &NonArrayError{Func: "sum"}
 	}
 
 	v = jtypes.Resolve(v)
 
+	if sum, ok := sumIntegers(v); ok {
+		return sum, nil
+	}
+
+	if hasDecimals(v) {
+		sum, err := sumDecimals(v, "sum")
+		if err != nil {
+			return 0, err
+		}
+		return jtypes.NewDecimal(sum), nil
+	}
+
 	var sum float64
 
 	for i := 0; i < v.Len(); i++ {
 		n, ok := jtypes.AsNumber(v.Index(i))
 		if !ok {
-			return 0, fmt.Errorf("cannot call sum on an array with non-number types")
+			return 0, &ArrayTypeError{Func: "sum", Type: "number"}
 		}
 		sum += n
 	}
@@ -38,14 +60,22 @@ func Sum(v reflect.Value) (float64, error) {
 }
 
 // Max returns the largest value in an array of numbers. If the
-// array is empty, Max returns 0 and an undefined error.
-func Max(v reflect.Value) (float64, error) {
+// array is empty, Max returns 0 and an undefined error. Like Sum,
+// Max returns an int64 if all of the numbers are Go integers, and
+// a *jtypes.Decimal if any of them is a Decimal.
+func Max(v reflect.Value) (interface{}, error) {
 
 	if !jtypes.IsArray(v) {
+		if d, ok := jtypes.AsDecimal(v); ok {
+			return d, nil
+		}
+		if n, ok := jtypes.AsInt64(v); ok {
+			return n, nil
+		}
 		if n, ok := jtypes.AsNumber(v); ok {
 			return n, nil
 		}
-		return 0, fmt.Errorf("cannot call max on a non-array type")
+		return 0, &NonArrayError{Func: "max"}
 	}
 
 	v = jtypes.Resolve(v)
@@ -53,12 +83,20 @@ func Max(v reflect.Value) (float64, error) {
 		return 0, jtypes.ErrUndefined
 	}
 
+	if max, ok := maxIntegers(v, 1); ok {
+		return max, nil
+	}
+
+	if hasDecimals(v) {
+		return maxDecimals(v, 1, "max")
+	}
+
 	var max float64
 
 	for i := 0; i < v.Len(); i++ {
 		n, ok := jtypes.AsNumber(v.Index(i))
 		if !ok {
-			return 0, fmt.Errorf("cannot call max on an array with non-number types")
+			return 0, &ArrayTypeError{Func: "max", Type: "number"}
 		}
 		if i == 0 || n > max {
 			max = n
@@ -69,14 +107,22 @@ func Max(v reflect.Value) (float64, error) {
 }
 
 // Min returns the smallest value in an array of numbers. If the
-// array is empty, Min returns 0 and an undefined error.
-func Min(v reflect.Value) (float64, error) {
+// array is empty, Min returns 0 and an undefined error. Like Sum,
+// Min returns an int64 if all of the numbers are Go integers, and
+// a *jtypes.Decimal if any of them is a Decimal.
+func Min(v reflect.Value) (interface{}, error) {
 
 	if !jtypes.IsArray(v) {
+		if d, ok := jtypes.AsDecimal(v); ok {
+			return d, nil
+		}
+		if n, ok := jtypes.AsInt64(v); ok {
+			return n, nil
+		}
 		if n, ok := jtypes.AsNumber(v); ok {
 			return n, nil
 		}
-		return 0, fmt.Errorf("cannot call min on a non-array type")
+		return 0, &NonArrayError{Func: "min"}
 	}
 
 	v = jtypes.Resolve(v)
@@ -84,12 +130,20 @@ func Min(v reflect.Value) (float64, error) {
 		return 0, jtypes.ErrUndefined
 	}
 
+	if min, ok := maxIntegers(v, -1); ok {
+		return min, nil
+	}
+
+	if hasDecimals(v) {
+		return maxDecimals(v, -1, "min")
+	}
+
 	var min float64
 
 	for i := 0; i < v.Len(); i++ {
 		n, ok := jtypes.AsNumber(v.Index(i))
 		if !ok {
-			return 0, fmt.Errorf("cannot call min on an array with non-number types")
+			return 0, &ArrayTypeError{Func: "min", Type: "number"}
 		}
 		if i == 0 || n < min {
 			min = n
@@ -99,15 +153,119 @@ func Min(v reflect.Value) (float64, error) {
 	return min, nil
 }
 
+// sumIntegers returns the total of an array of Go integers. The
+// second return value is false if the array is empty, if any item
+// is not an integer or if the total overflows an int64.
+func sumIntegers(v reflect.Value) (int64, bool) {
+
+	if v.Len() == 0 {
+		return 0, false
+	}
+
+	var sum int64
+
+	for i := 0; i < v.Len(); i++ {
+		n, ok := jtypes.AsInt64(v.Index(i))
+		if !ok {
+			return 0, false
+		}
+
+		total := sum + n
+		if (sum > 0 && n > 0 && total < 0) || (sum < 0 && n < 0 && total >= 0) {
+			return 0, false
+		}
+		sum = total
+	}
+
+	return sum, true
+}
+
+// maxIntegers returns the largest (if sign is 1) or smallest
+// (if sign is -1) value in a non-empty array of Go integers.
+// The second return value is false if any item is not an
+// integer.
+func maxIntegers(v reflect.Value, sign int64) (int64, bool) {
+
+	var max int64
+
+	for i := 0; i < v.Len(); i++ {
+		n, ok := jtypes.AsInt64(v.Index(i))
+		if !ok {
+			return 0, false
+		}
+		if i == 0 || sign*n > sign*max {
+			max = n
+		}
+	}
+
+	return max, true
+}
+
+// hasDecimals returns true if any item in an array is a
+// *jtypes.Decimal.
+func hasDecimals(v reflect.Value) bool {
+
+	for i := 0; i < v.Len(); i++ {
+		if jtypes.IsDecimal(v.Index(i)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sumDecimals returns the exact total of an array of numbers.
+// The name of the calling function is used in errors.
+func sumDecimals(v reflect.Value, name string) (*big.Rat, error) {
+
+	sum := new(big.Rat)
+
+	for i := 0; i < v.Len(); i++ {
+		d, ok := jtypes.ToDecimal(v.Index(i))
+		if !ok {
+			return nil, &ArrayTypeError{Func: name, Type: "number"}
+		}
+		sum.Add(sum, d.Rat())
+	}
+
+	return sum, nil
+}
+
+// maxDecimals returns the largest (if sign is 1) or smallest
+// (if sign is -1) value in a non-empty array of numbers as a
+// *jtypes.Decimal. The name of the calling function is used
+// in errors.
+func maxDecimals(v reflect.Value, sign int, name string) (interface{}, error) {
+
+	var max *jtypes.Decimal
+
+	for i := 0; i < v.Len(); i++ {
+		d, ok := jtypes.ToDecimal(v.Index(i))
+		if !ok {
+			return 0, &ArrayTypeError{Func: name, Type: "number"}
+		}
+		if i == 0 || sign*d.Rat().Cmp(max.Rat()) > 0 {
+			max = d
+		}
+	}
+
+	return max, nil
+}
+
 // Average returns the mean of an array of numbers. If the array
-// is empty, Average returns 0 and an undefined error.
-func Average(v reflect.Value) (float64, error) {
+// is empty, Average returns 0 and an undefined error. If any of
+// the numbers is a *jtypes.Decimal, Average returns the exact
+// mean as a Decimal. Otherwise it returns a float64.
+func Average(v reflect.Value) (interface{}, error) {
 
 	if !jtypes.IsArray(v) {
+		if d, ok := jtypes.AsDecimal(v); ok {
+			return d, nil
+		}
 		if n, ok := jtypes.AsNumber(v); ok {
 			return n, nil
 		}
-		return 0, fmt.Errorf("cannot call average on a non-array type")
+		return 0, &NonArrayError{Func: "average"}
 	}
 
 	v = jtypes.Resolve(v)
@@ -115,12 +273,21 @@ func Average(v reflect.Value) (float64, error) {
 		return 0, jtypes.ErrUndefined
 	}
 
+	if hasDecimals(v) {
+		sum, err := sumDecimals(v, "average")
+		if err != nil {
+			return 0, err
+		}
+		n := new(big.Rat).SetInt64(int64(v.Len()))
+		return jtypes.NewDecimal(sum.Quo(sum, n)), nil
+	}
+
 	var sum float64
 
 	for i := 0; i < v.Len(); i++ {
 		n, ok := jtypes.AsNumber(v.Index(i))
 		if !ok {
-			return 0, fmt.Errorf("cannot call average on an array with non-number types")
+			return 0, &ArrayTypeError{Func: "average", Type: "number"}
 		}
 		sum += n
 	}
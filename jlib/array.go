@@ -5,7 +5,6 @@
 package jlib
 
 import (
-	"fmt"
 	"math/rand"
 	"reflect"
 	"sort"
@@ -27,50 +26,86 @@ func Count(v reflect.Value) int {
 	return v.Len()
 }
 
-// Distinct returns the values passed in with any duplicates removed.
+// Distinct returns the values passed in with any duplicates
+// removed. The order of first occurrence is preserved. Objects
+// and arrays are compared by value, not by reference. Inputs
+// that are not arrays are returned unchanged.
 func Distinct(v reflect.Value) interface{} {
 	v = jtypes.Resolve(v)
 
-	// To match the behavior of jsonata-js, if this is a string we should
-	// return the entire string and not dedupe the individual characters
-	if jtypes.IsString(v) {
-		return v.String()
+	if !v.IsValid() {
+		return nil
 	}
 
-	if jtypes.IsArray(v) {
-		items := arrayify(v)
-		visited := make(map[interface{}]struct{})
-		distinctValues := reflect.MakeSlice(reflect.SliceOf(typeInterface), 0, 0)
-
-		for i := 0; i < items.Len(); i++ {
-			item := jtypes.Resolve(items.Index(i))
-
-			if jtypes.IsMap(item) {
-				// We can't hash a map, so convert it to a
-				// string that is hashable
-				mapItem := fmt.Sprint(item.Interface())
-				if _, ok := visited[mapItem]; ok {
-					continue
-				}
-				visited[mapItem] = struct{}{}
-				distinctValues = reflect.Append(distinctValues, item)
-
-				continue
-			}
+	// To match the behavior of jsonata-js, non-arrays and arrays
+	// with fewer than two items are returned as is. Note that
+	// strings are not deduped character by character.
+	if !jtypes.IsArray(v) || v.Len() < 2 {
+		return v.Interface()
+	}
 
-			if _, ok := visited[item.Interface()]; ok {
-				continue
-			}
+	items := arrayify(v)
+	buckets := make(map[interface{}][]reflect.Value)
+	distinctValues := reflect.MakeSlice(reflect.SliceOf(typeInterface), 0, 0)
+
+	for i := 0; i < items.Len(); i++ {
+		item := jtypes.Resolve(items.Index(i))
+		if !item.IsValid() {
+			continue
+		}
+
+		// Values are compared with DeepEqual. To avoid comparing
+		// every pair of values, they're grouped into buckets of
+		// values that might be equal first.
+		key := distinctKey(item)
+		if containsDeepEqual(buckets[key], item) {
+			continue
+		}
+		buckets[key] = append(buckets[key], item)
 
-			visited[item.Interface()] = struct{}{}
-			distinctValues = reflect.Append(distinctValues, item)
+		// Resolve dereferences OrderedMap pointers. Restore
+		// them so that they are returned in the same form as
+		// other JSONata objects.
+		if m, ok := jtypes.AsOrderedMap(item); ok {
+			item = reflect.ValueOf(m)
 		}
-		return distinctValues.Interface()
+
+		distinctValues = reflect.Append(distinctValues, item)
+	}
+
+	return distinctValues.Interface()
+}
+
+// distinctKey returns a hashable key for v such that values
+// that are equal according to DeepEqual have the same key.
+// Arrays, objects and other values that are expensive to hash
+// share a single key.
+func distinctKey(v reflect.Value) interface{} {
+
+	if n, ok := jtypes.AsNumber(v); ok {
+		return n
+	}
+
+	if s, ok := jtypes.AsString(v); ok {
+		return s
+	}
+
+	if b, ok := jtypes.AsBool(v); ok {
+		return b
 	}
 
 	return nil
 }
 
+func containsDeepEqual(values []reflect.Value, v reflect.Value) bool {
+	for _, value := range values {
+		if DeepEqual(value, v) {
+			return true
+		}
+	}
+	return false
+}
+
 // Append (golint)
 func Append(v1, v2 reflect.Value) (interface{}, error) {
 	if !v2.IsValid() && v1.IsValid() && v1.CanInterface() {
@@ -119,8 +154,23 @@ func Reverse(v reflect.Value) (interface{}, error) {
 	return results.Interface(), nil
 }
 
-// Sort (golint)
+// Sort sorts an array of numbers or strings in ascending order.
+// Other arrays can be sorted with the optional comparator function
+// swap, which is called with two items and returns true if the
+// first item should come after the second. The sort is stable:
+// items that the comparator does not swap keep their original
+// order. If the comparator returns an error, the sort stops and
+// the error is returned unchanged.
 func Sort(v reflect.Value, swap jtypes.OptionalCallable) (interface{}, error) {
+	return SortCollated(v, swap, nil)
+}
+
+// SortCollated is like Sort except that arrays of strings are
+// sorted using the given collator, which returns a negative
+// number, zero or a positive number if a sorts before, equally
+// with or after b. If collate is nil, strings are compared byte
+// by byte. The collator is not used if swap is provided.
+func SortCollated(v reflect.Value, swap jtypes.OptionalCallable, collate func(a, b string) int) (interface{}, error) {
 	v = jtypes.Resolve(v)
 
 	switch {
@@ -135,10 +185,10 @@ func Sort(v reflect.Value, swap jtypes.OptionalCallable) (interface{}, error) {
 	case jtypes.IsArrayOf(v, jtypes.IsNumber):
 		return sortNumberArray(v), nil
 	case jtypes.IsArrayOf(v, jtypes.IsString):
-		return sortStringArray(v), nil
+		return sortStringArray(v, collate), nil
 	}
 
-	return nil, fmt.Errorf("argument 1 of function sort must be an array of strings or numbers")
+	return nil, newArgValueError("sort", 1, "D3070", "must be an array of strings or numbers")
 }
 
 func sortNumberArray(v reflect.Value) []interface{} {
@@ -158,7 +208,7 @@ func sortNumberArray(v reflect.Value) []interface{} {
 	return results
 }
 
-func sortStringArray(v reflect.Value) []interface{} {
+func sortStringArray(v reflect.Value, collate func(a, b string) int) []interface{} {
 	size := v.Len()
 	results := make([]interface{}, 0, size)
 
@@ -169,6 +219,9 @@ func sortStringArray(v reflect.Value) []interface{} {
 	}
 
 	sort.SliceStable(results, func(i, j int) bool {
+		if collate != nil {
+			return collate(results[i].(string), results[j].(string)) < 0
+		}
 		return results[i].(string) < results[j].(string)
 	})
 
@@ -185,6 +238,8 @@ func sortArrayFunc(v reflect.Value, fn jtypes.Callable) (interface{}, error) {
 		}
 	}
 
+	argc := clamp(fn.ParamCount(), 0, 2)
+
 	swapFunc := func(lhs, rhs interface{}) (bool, error) {
 
 		args := []reflect.Value{
@@ -192,14 +247,20 @@ func sortArrayFunc(v reflect.Value, fn jtypes.Callable) (interface{}, error) {
 			reflect.ValueOf(rhs),
 		}
 
-		v, err := fn.Call(args)
+		v, err := fn.Call(args[:argc])
 		if err != nil {
 			return false, err
 		}
 
+		// An undefined result (e.g. from a comparison that
+		// involves a missing field) means don't swap.
+		if !v.IsValid() {
+			return false, nil
+		}
+
 		b, ok := jtypes.AsBool(v)
 		if !ok {
-			return false, fmt.Errorf("argument 2 of function sort must be a function that returns a boolean, got %v (%s)", v, v.Kind())
+			return false, newArgValueError("sort", 2, "T0410", "must be a function that returns a boolean, got %v (%s)", v, v.Kind())
 		}
 
 		return b, nil
@@ -261,6 +322,16 @@ func merge(lhs, rhs []interface{}, swapFunc func(interface{}, interface{}) (bool
 
 // Shuffle (golint)
 func Shuffle(v reflect.Value) interface{} {
+	return shuffle(v, rand.Intn)
+}
+
+// ShuffleFrom is like Shuffle except that it uses the given
+// random number generator.
+func ShuffleFrom(v reflect.Value, r *rand.Rand) interface{} {
+	return shuffle(v, r.Intn)
+}
+
+func shuffle(v reflect.Value, intn func(int) int) interface{} {
 	v = forceArray(jtypes.Resolve(v))
 
 	length := arrayLen(v)
@@ -268,7 +339,7 @@ func Shuffle(v reflect.Value) interface{} {
 
 	for i := 0; i < length; i++ {
 
-		j := rand.Intn(i + 1)
+		j := intn(i + 1)
 
 		if i != j {
 			results[i] = results[j]
@@ -288,7 +359,7 @@ func Zip(vs ...reflect.Value) (interface{}, error) {
 	var size int
 
 	if len(vs) == 0 {
-		return nil, fmt.Errorf("cannot call zip with no arguments")
+		return nil, newArgValueError("zip", 0, "T0410", "cannot call zip with no arguments")
 	}
 
 	for i := 0; i < len(vs); i++ {
@@ -37,7 +37,7 @@ func Boolean(v reflect.Value) bool {
 	}
 
 	if jtypes.IsMap(v) {
-		return v.Len() > 0
+		return jtypes.MapLen(v) > 0
 	}
 
 	return false
@@ -52,3 +52,14 @@ func Not(v reflect.Value) bool {
 func Exists(v reflect.Value) bool {
 	return v.IsValid()
 }
+
+// IsNull returns true if v is a JSON null. Like the = operator,
+// it treats nil interfaces, pointers, maps and slices as null,
+// so IsNull(v) is true exactly when v = null. If v is undefined
+// (e.g. a missing key), IsNull returns false rather than
+// undefined, like Exists. A key whose value is null therefore
+// gives true for both IsNull and Exists, while a missing key
+// gives false for both.
+func IsNull(v reflect.Value) bool {
+	return v.IsValid() && isNull(v)
+}
@@ -0,0 +1,242 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jlib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+
+	"github.com/blues/jsonata-go/jtypes"
+)
+
+// Clone returns a deep copy of v that shares no maps or slices
+// with the original. Maps and structs are copied to OrderedMaps
+// and arrays are copied to slices of type []interface{}, all the
+// way down. Values that JSONata cannot modify (e.g. strings,
+// numbers and functions) are shared with the original. Map keys
+// are converted to strings with KeyString. Clone returns an
+// error if v contains a cycle or a map key that cannot be
+// converted.
+func Clone(v reflect.Value) (interface{}, error) {
+	return deepCopy(v, map[uintptr]bool{})
+}
+
+var errCycle = errors.New("cannot copy a value that contains a cycle")
+
+// deepCopy returns a deep copy of v. The visiting map records
+// the maps, slices and pointers that are currently being copied
+// so that self-referencing data returns an error rather than
+// recursing forever.
+func deepCopy(v reflect.Value, visiting map[uintptr]bool) (interface{}, error) {
+
+	if !v.IsValid() {
+		return nil, nil
+	}
+
+	// Values that know how to encode themselves as JSON (e.g.
+	// time.Time) are copied via their JSON representation.
+	// OrderedMaps and Decimals are handled below.
+	if isJSONMarshaler(v) {
+		return copyJSON(v)
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return deepCopy(v.Elem(), visiting)
+
+	case reflect.Ptr:
+		if v.IsNil() {
+			// Nil pointers include the JSONata null value.
+			return v.Interface(), nil
+		}
+		if v.Type() == jtypes.TypeDecimal || jtypes.IsCallable(v) {
+			return v.Interface(), nil
+		}
+		if visiting[v.Pointer()] {
+			return nil, errCycle
+		}
+		visiting[v.Pointer()] = true
+		defer delete(visiting, v.Pointer())
+		return deepCopy(v.Elem(), visiting)
+
+	case reflect.Map:
+		if v.IsNil() {
+			return nil, nil
+		}
+		if visiting[v.Pointer()] {
+			return nil, errCycle
+		}
+		visiting[v.Pointer()] = true
+		defer delete(visiting, v.Pointer())
+		return copyMap(v, visiting)
+
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil, nil
+		}
+		if v.Type() == typeByteSlice {
+			return append([]byte(nil), v.Bytes()...), nil
+		}
+		if visiting[v.Pointer()] {
+			return nil, errCycle
+		}
+		visiting[v.Pointer()] = true
+		defer delete(visiting, v.Pointer())
+		return copySlice(v, visiting)
+
+	case reflect.Array:
+		return copySlice(v, visiting)
+
+	case reflect.Struct:
+		if m, ok := jtypes.AsOrderedMap(v); ok {
+			return copyOrderedMap(m, visiting)
+		}
+		if jtypes.IsCallable(v) || jtypes.IsDecimal(v) {
+			return v.Interface(), nil
+		}
+		return copyStruct(v, visiting)
+
+	default:
+		if !v.CanInterface() {
+			return nil, nil
+		}
+		return v.Interface(), nil
+	}
+}
+
+func copyMap(v reflect.Value, visiting map[uintptr]bool) (interface{}, error) {
+
+	keys := v.MapKeys()
+	names := make([]string, len(keys))
+
+	for i, k := range keys {
+		name, err := keyString("clone", k)
+		if err != nil {
+			return nil, err
+		}
+		names[i] = name
+	}
+
+	// Go maps are unordered. Sort the keys so that the copy
+	// has a predictable order.
+	sort.Sort(keysByName{keys, names})
+
+	dest := jtypes.NewOrderedMap(len(keys))
+
+	for i, k := range keys {
+		value, err := deepCopy(v.MapIndex(k), visiting)
+		if err != nil {
+			return nil, err
+		}
+		dest.Set(names[i], value)
+	}
+
+	return dest, nil
+}
+
+type keysByName struct {
+	keys  []reflect.Value
+	names []string
+}
+
+func (s keysByName) Len() int           { return len(s.names) }
+func (s keysByName) Less(i, j int) bool { return s.names[i] < s.names[j] }
+func (s keysByName) Swap(i, j int) {
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+	s.names[i], s.names[j] = s.names[j], s.names[i]
+}
+
+func copyOrderedMap(m *jtypes.OrderedMap, visiting map[uintptr]bool) (interface{}, error) {
+
+	dest := jtypes.NewOrderedMap(m.Len())
+
+	for _, k := range m.Keys() {
+		v, _ := m.Get(k)
+		value, err := deepCopy(reflect.ValueOf(v), visiting)
+		if err != nil {
+			return nil, err
+		}
+		dest.Set(k, value)
+	}
+
+	return dest, nil
+}
+
+func copySlice(v reflect.Value, visiting map[uintptr]bool) (interface{}, error) {
+
+	dest := make([]interface{}, v.Len())
+
+	for i := range dest {
+		value, err := deepCopy(v.Index(i), visiting)
+		if err != nil {
+			return nil, err
+		}
+		dest[i] = value
+	}
+
+	return dest, nil
+}
+
+func copyStruct(v reflect.Value, visiting map[uintptr]bool) (interface{}, error) {
+
+	fields := jtypes.StructFields(v.Type())
+	dest := jtypes.NewOrderedMap(len(fields))
+
+	for _, field := range fields {
+		val := field.Value(v)
+		if !val.IsValid() {
+			continue
+		}
+		value, err := deepCopy(val, visiting)
+		if err != nil {
+			return nil, err
+		}
+		dest.Set(field.Name, value)
+	}
+
+	return dest, nil
+}
+
+func isJSONMarshaler(v reflect.Value) bool {
+	t := v.Type()
+	switch {
+	case t.Kind() == reflect.Interface:
+		return false
+	case t == jtypes.TypeOrderedMap, t == jtypes.TypeOrderedMap.Elem():
+		return false
+	case t == jtypes.TypeDecimal, t == jtypes.TypeDecimal.Elem():
+		return false
+	case jtypes.IsCallable(v):
+		return false
+	default:
+		return t.Implements(typeJSONMarshaler)
+	}
+}
+
+// copyJSON copies a value by encoding it to JSON and decoding
+// the result.
+func copyJSON(v reflect.Value) (interface{}, error) {
+
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return nil, nil
+	}
+
+	if !v.CanInterface() {
+		return nil, nil
+	}
+
+	b, err := json.Marshal(v.Interface())
+	if err != nil {
+		return nil, err
+	}
+
+	return jtypes.DecodeOrdered(json.NewDecoder(bytes.NewReader(b)))
+}
@@ -0,0 +1,54 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jlib
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// The hashing and hex functions are not part of JSONata. The
+// evaluator does not register them by default.
+
+// SHA256 returns the SHA-256 hash of a string as a string of
+// lowercase hex digits.
+func SHA256(s string) (string, error) {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// SHA1 returns the SHA-1 hash of a string as a string of
+// lowercase hex digits.
+func SHA1(s string) (string, error) {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// MD5 returns the MD5 hash of a string as a string of
+// lowercase hex digits.
+func MD5(s string) (string, error) {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// HexEncode returns the bytes of a string as a string of
+// lowercase hex digits.
+func HexEncode(s string) (string, error) {
+	return hex.EncodeToString([]byte(s)), nil
+}
+
+// HexDecode returns the string represented by a string of hex
+// digits. The digits may be upper or lower case.
+func HexDecode(s string) (string, error) {
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return "", newArgValueError("hexDecode", 1, "", "must be a valid hex string")
+	}
+
+	return string(b), nil
+}
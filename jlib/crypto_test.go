@@ -0,0 +1,109 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jlib_test
+
+import (
+	"testing"
+
+	"github.com/blues/jsonata-go/jlib"
+)
+
+func TestEncodingFuncs(t *testing.T) {
+
+	tests := []struct {
+		Name   string
+		Func   func(string) (string, error)
+		Input  string
+		Output string
+		Error  bool
+	}{
+		{
+			Name:   "SHA256",
+			Func:   jlib.SHA256,
+			Input:  "abc",
+			Output: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		},
+		{
+			Name:   "SHA256",
+			Func:   jlib.SHA256,
+			Input:  "",
+			Output: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		},
+		{
+			Name:   "SHA1",
+			Func:   jlib.SHA1,
+			Input:  "abc",
+			Output: "a9993e364706816aba3e25717850c26c9cd0d89d",
+		},
+		{
+			Name:   "MD5",
+			Func:   jlib.MD5,
+			Input:  "abc",
+			Output: "900150983cd24fb0d6963f7d28e17f72",
+		},
+		{
+			Name:   "HexEncode",
+			Func:   jlib.HexEncode,
+			Input:  "hi\x00\xff",
+			Output: "686900ff",
+		},
+		{
+			Name:   "HexDecode",
+			Func:   jlib.HexDecode,
+			Input:  "686900FF",
+			Output: "hi\x00\xff",
+		},
+		{
+			Name:  "HexDecode",
+			Func:  jlib.HexDecode,
+			Input: "68z",
+			Error: true,
+		},
+		{
+			Name:   "Base64URLEncode",
+			Func:   jlib.Base64URLEncode,
+			Input:  "\xfb\xff",
+			Output: "-_8=",
+		},
+		{
+			Name:   "Base64URLDecode",
+			Func:   jlib.Base64URLDecode,
+			Input:  "-_8=",
+			Output: "\xfb\xff",
+		},
+		{
+			Name:  "Base64URLDecode",
+			Func:  jlib.Base64URLDecode,
+			Input: "+/8=",
+			Error: true,
+		},
+		{
+			Name:  "Base64Decode",
+			Func:  jlib.Base64Decode,
+			Input: "-_8=",
+			Error: true,
+		},
+	}
+
+	for _, test := range tests {
+
+		output, err := test.Func(test.Input)
+
+		if test.Error {
+			if _, ok := err.(*jlib.ArgValueError); !ok {
+				t.Errorf("%s(%q): expected an ArgValueError, got %q (error %v)", test.Name, test.Input, output, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s(%q): unexpected error: %s", test.Name, test.Input, err)
+		}
+
+		if output != test.Output {
+			t.Errorf("%s(%q): expected %q, got %q", test.Name, test.Input, test.Output, output)
+		}
+	}
+}
@@ -17,13 +17,14 @@ import (
 // 2006-01-02T15:04:05.000Z07:00
 const defaultFormatTimeLayout = "[Y]-[M01]-[D01]T[H01]:[m]:[s].[f001][Z01:01t]"
 
-var defaultParseTimeLayouts = []string{
-	"[Y]-[M01]-[D01]T[H01]:[m]:[s][Z01:01t]",
-	"[Y]-[M01]-[D01]T[H01]:[m]:[s][Z0100t]",
-	"[Y]-[M01]-[D01]T[H01]:[m]:[s]",
-	"[Y]-[M01]-[D01]",
-	"[Y]",
-}
+// reISOTime matches the ISO 8601 timestamps accepted by
+// ToMillis when no picture string is given: a calendar date
+// (2006-01-02), an ordinal date (2006-002), a year and month
+// or a year on its own, optionally followed by a time with or
+// without seconds, fractional seconds of any precision and a
+// time zone offset.
+var reISOTime = regexp.MustCompile(`^(\d{4})(?:-(\d\d)(?:-(\d\d))?|-(\d{3}))?` +
+	`(?:[Tt ](\d\d):(\d\d)(?::(\d\d)(?:[.,](\d+))?)?([Zz]|[+-]\d\d(?::?\d\d)?)?)?$`)
 
 // FromMillis (golint)
 func FromMillis(ms int64, picture jtypes.OptionalString, tz jtypes.OptionalString) (string, error) {
@@ -92,22 +93,128 @@ func parseTimeZone(tz string) (*time.Location, error) {
 	return loc, nil
 }
 
-// ToMillis (golint)
+// ToMillis converts a timestamp to the number of milliseconds
+// since the Unix epoch. If picture is empty, the timestamp must
+// be an ISO 8601 date (e.g. 2006-01-02, or 2006-002 for an
+// ordinal date), optionally followed by a time with or without
+// seconds and fractional seconds and a time zone offset, e.g.
+// 2006-01-02T15:04:05.999+07:00. Timestamps with no offset are
+// in UTC. Otherwise, picture describes the format of the
+// timestamp. Timestamps that cannot be parsed return a
+// *TimestampError.
 func ToMillis(s string, picture jtypes.OptionalString, tz jtypes.OptionalString) (int64, error) {
-	layouts := defaultParseTimeLayouts
-	if picture.String != "" {
-		layouts = []string{picture.String}
-	}
 
 	// TODO: How are timezones used for parsing?
 
-	for _, l := range layouts {
-		if t, err := parseTime(s, l); err == nil {
-			return timeToMS(t), nil
+	if picture.String == "" {
+		t, ok := parseISOTime(s)
+		if !ok {
+			return 0, newTimestampError("toMillis", s)
+		}
+		return timeToMS(t), nil
+	}
+
+	t, err := parseTime(s, picture.String)
+	if err != nil {
+		return 0, err
+	}
+
+	return timeToMS(t), nil
+}
+
+// parseISOTime parses an ISO 8601 timestamp in one of the
+// forms matched by reISOTime. Timestamps without a time zone
+// offset are in UTC.
+func parseISOTime(s string) (time.Time, bool) {
+
+	m := reISOTime.FindStringSubmatch(s)
+	if m == nil {
+		return time.Time{}, false
+	}
+
+	// The regular expression ensures that the numbers are
+	// valid, if not necessarily in range.
+	atoi := func(s string) int {
+		n, _ := strconv.Atoi(s)
+		return n
+	}
+
+	year, month, day := atoi(m[1]), 1, 1
+
+	switch {
+	case m[4] != "":
+		// Ordinal dates are converted to January dates,
+		// which time.Date normalises.
+		day = atoi(m[4])
+		if day < 1 || day > daysInYear(year) {
+			return time.Time{}, false
+		}
+	case m[2] != "":
+		month = atoi(m[2])
+		if month < 1 || month > 12 {
+			return time.Time{}, false
+		}
+		if m[3] != "" {
+			day = atoi(m[3])
+			if day < 1 || day > daysIn(year, time.Month(month)) {
+				return time.Time{}, false
+			}
+		}
+	}
+
+	var hour, min, sec, nsec int
+
+	if m[5] != "" {
+		hour, min = atoi(m[5]), atoi(m[6])
+		if m[7] != "" {
+			sec = atoi(m[7])
+		}
+		if hour > 23 || min > 59 || sec > 59 {
+			return time.Time{}, false
+		}
+
+		// Fractional seconds beyond nanoseconds are
+		// truncated.
+		if frac := m[8]; frac != "" {
+			if len(frac) > 9 {
+				frac = frac[:9]
+			}
+			nsec = atoi(frac)
+			for i := len(frac); i < 9; i++ {
+				nsec *= 10
+			}
+		}
+	}
+
+	loc := time.UTC
+
+	if zone := m[9]; zone != "" && zone != "Z" && zone != "z" {
+		hours := atoi(zone[1:3])
+		var mins int
+		if len(zone) > 3 {
+			mins = atoi(zone[len(zone)-2:])
+		}
+		if hours > 23 || mins > 59 {
+			return time.Time{}, false
+		}
+
+		offset := 60 * (60*hours + mins)
+		if zone[0] == '-' {
+			offset = -offset
 		}
+		loc = time.FixedZone("", offset)
 	}
 
-	return 0, fmt.Errorf("could not parse time %q", s)
+	return time.Date(year, time.Month(month), day, hour, min, sec, nsec, loc), true
+}
+
+// daysIn returns the number of days in the given month.
+func daysIn(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+func daysInYear(year int) int {
+	return 337 + daysIn(year, time.February)
 }
 
 var reMinus7 = regexp.MustCompile("-(0*7)")
@@ -118,7 +225,7 @@ func parseTime(s string, picture string) (time.Time, error) {
 
 	layout, err := jxpath.FormatTime(refTime, picture)
 	if err != nil {
-		return time.Time{}, fmt.Errorf("the second argument of the toMillis function must be a valid date format")
+		return time.Time{}, newArgValueError("toMillis", 2, "D3110", "must be a valid date format")
 	}
 
 	// Replace -07:00 with Z07:00
@@ -126,7 +233,7 @@ func parseTime(s string, picture string) (time.Time, error) {
 
 	t, err := time.Parse(layout, s)
 	if err != nil {
-		return time.Time{}, fmt.Errorf("could not parse time %q", s)
+		return time.Time{}, newTimestampError("toMillis", s)
 	}
 
 	return t, nil
@@ -136,6 +243,9 @@ func msToTime(ms int64) time.Time {
 	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
 }
 
+// timeToMS converts t to milliseconds since the Unix epoch.
+// Unlike t.UnixNano, it works for times outside the years 1678
+// to 2262.
 func timeToMS(t time.Time) int64 {
-	return t.UnixNano() / int64(time.Millisecond)
+	return t.Unix()*1000 + int64(t.Nanosecond())/int64(time.Millisecond)
 }
@@ -0,0 +1,185 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jlib
+
+import (
+	"reflect"
+
+	"github.com/blues/jsonata-go/jtypes"
+)
+
+// DeepEqual returns true if x and y are structurally equal.
+// Numbers are compared by value regardless of their Go types,
+// so 1 equals 1.0. Arrays are equal if they have the same
+// length and equal items in the same order. Objects, including
+// Go structs, are equal if they have the same keys and equal
+// values. Key order is not significant. Functions are only
+// equal to themselves. DeepEqual returns false if either value
+// is undefined.
+func DeepEqual(x, y reflect.Value) bool {
+
+	if !x.IsValid() || !y.IsValid() {
+		return false
+	}
+
+	return deepEqual(x, y)
+}
+
+func deepEqual(x, y reflect.Value) bool {
+
+	if jtypes.IsCallable(x) || jtypes.IsCallable(y) {
+		return sameCallable(x, y)
+	}
+
+	x = jtypes.Resolve(x)
+	y = jtypes.Resolve(y)
+
+	if isNull(x) || isNull(y) {
+		return isNull(x) && isNull(y)
+	}
+
+	switch {
+	case jtypes.IsNumber(x):
+		cmp, ok := jtypes.CompareNumbers(x, y)
+		return ok && cmp == 0
+
+	case jtypes.IsString(x):
+		s, ok := jtypes.AsString(y)
+		return ok && s == x.String()
+
+	case jtypes.IsBool(x):
+		b, ok := jtypes.AsBool(y)
+		return ok && b == x.Bool()
+
+	case jtypes.IsArray(x):
+		return jtypes.IsArray(y) && arraysEqual(x, y)
+
+	case isObject(x):
+		return isObject(y) && objectsEqual(x, y)
+
+	default:
+		return false
+	}
+}
+
+func arraysEqual(x, y reflect.Value) bool {
+
+	if x.Len() != y.Len() {
+		return false
+	}
+
+	for i := 0; i < x.Len(); i++ {
+		if !deepEqual(x.Index(i), y.Index(i)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func objectsEqual(x, y reflect.Value) bool {
+
+	xfields, xok := objectFields(x)
+	yfields, yok := objectFields(y)
+
+	// Objects with keys that can't be converted to strings
+	// have no JSONata equivalent. Fall back to Go's idea of
+	// equality rather than ignoring the keys.
+	if !xok || !yok {
+		return x.CanInterface() && y.CanInterface() &&
+			reflect.DeepEqual(x.Interface(), y.Interface())
+	}
+
+	if len(xfields) != len(yfields) {
+		return false
+	}
+
+	for name, xv := range xfields {
+		yv, ok := yfields[name]
+		if !ok || !deepEqual(xv, yv) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// objectFields returns the values of a map, OrderedMap or
+// struct, keyed by their JSONata names. It returns false if v
+// is a map with keys that KeyString cannot convert.
+func objectFields(v reflect.Value) (map[string]reflect.Value, bool) {
+
+	if jtypes.IsStruct(v) {
+		fields := jtypes.StructFields(v.Type())
+		res := make(map[string]reflect.Value, len(fields))
+		for _, field := range fields {
+			if val := field.Value(v); val.IsValid() {
+				res[field.Name] = val
+			}
+		}
+		return res, true
+	}
+
+	keys := jtypes.MapKeys(v)
+	res := make(map[string]reflect.Value, len(keys))
+
+	for _, key := range keys {
+		name, ok := KeyString(key)
+		if !ok {
+			return nil, false
+		}
+		res[name] = jtypes.MapIndex(v, key)
+	}
+
+	return res, true
+}
+
+func isObject(v reflect.Value) bool {
+	return jtypes.IsMap(v) || jtypes.IsStruct(v)
+}
+
+// isNull returns true if v is a JSON null, i.e. a nil
+// interface, pointer, map or slice.
+func isNull(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return true
+	case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice:
+		return v.IsNil()
+	default:
+		return false
+	}
+}
+
+// sameCallable returns true if x and y hold the same function.
+// Two functions with the same definition are not considered
+// equal unless they are the same object.
+func sameCallable(x, y reflect.Value) bool {
+
+	if !jtypes.IsCallable(x) || !jtypes.IsCallable(y) {
+		return false
+	}
+
+	x = unwrapInterface(x)
+	y = unwrapInterface(y)
+
+	if x.Type() != y.Type() {
+		return false
+	}
+
+	if x.Kind() == reflect.Ptr {
+		return x.Pointer() == y.Pointer()
+	}
+
+	return x.Type().Comparable() && x.CanInterface() && y.CanInterface() &&
+		x.Interface() == y.Interface()
+}
+
+func unwrapInterface(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Interface && !v.IsNil() {
+		v = v.Elem()
+	}
+	return v
+}
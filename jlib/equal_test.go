@@ -0,0 +1,226 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jlib_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/blues/jsonata-go/jlib"
+	"github.com/blues/jsonata-go/jtypes"
+)
+
+func TestDeepEqual(t *testing.T) {
+
+	ordered := jtypes.NewOrderedMap(2)
+	ordered.Set("b", []interface{}{1, 2})
+	ordered.Set("a", "one")
+
+	fn := new(paramCountCallable)
+
+	var null *interface{}
+
+	data := []struct {
+		X, Y  interface{}
+		Equal bool
+	}{
+		{
+			X:     1,
+			Y:     1.0,
+			Equal: true,
+		},
+		{
+			X:     uint8(3),
+			Y:     json.Number("3"),
+			Equal: true,
+		},
+		{
+			X:     1,
+			Y:     "1",
+			Equal: false,
+		},
+		{
+			X:     "hello",
+			Y:     "hello",
+			Equal: true,
+		},
+		{
+			X:     true,
+			Y:     true,
+			Equal: true,
+		},
+		{
+			X:     false,
+			Y:     0,
+			Equal: false,
+		},
+		{
+			X:     []string{"a", "b"},
+			Y:     []interface{}{"a", "b"},
+			Equal: true,
+		},
+		{
+			X:     []int{1, 2},
+			Y:     []float64{2, 1},
+			Equal: false,
+		},
+		{
+			X:     []int{1, 2},
+			Y:     []int{1, 2, 3},
+			Equal: false,
+		},
+		{
+			// Key order is not significant.
+			X: map[string]interface{}{
+				"a": "one",
+				"b": []float64{1, 2},
+			},
+			Y:     ordered,
+			Equal: true,
+		},
+		{
+			X: map[string]interface{}{
+				"a": "one",
+			},
+			Y:     ordered,
+			Equal: false,
+		},
+		{
+			X: struct {
+				A string        `json:"a"`
+				B []interface{} `json:"b"`
+				c int
+			}{
+				A: "one",
+				B: []interface{}{1.0, 2.0},
+			},
+			Y:     ordered,
+			Equal: true,
+		},
+		{
+			X:     []interface{}{nil, null},
+			Y:     []interface{}{null, nil},
+			Equal: true,
+		},
+		{
+			X:     nil,
+			Y:     0,
+			Equal: false,
+		},
+		{
+			X:     fn,
+			Y:     fn,
+			Equal: true,
+		},
+		{
+			X:     fn,
+			Y:     new(paramCountCallable),
+			Equal: false,
+		},
+		{
+			// Non-string keys are compared by their string
+			// form.
+			X:     map[int]float64{1: 1.5, 2: 2.5},
+			Y:     map[string]interface{}{"1": 1.5, "2": 2.5},
+			Equal: true,
+		},
+		{
+			X:     map[int]float64{1: 1.5, 2: 2.5},
+			Y:     map[int]float64{1: 1.5, 3: 2.5},
+			Equal: false,
+		},
+		{
+			X:     map[bool]string{true: "yes"},
+			Y:     map[string]string{"true": "yes"},
+			Equal: true,
+		},
+		{
+			X:     map[struct{ X int }]int{{1}: 1},
+			Y:     map[struct{ X int }]int{{1}: 1},
+			Equal: true,
+		},
+		{
+			X:     map[struct{ X int }]int{{1}: 1},
+			Y:     map[struct{ X int }]int{{2}: 1},
+			Equal: false,
+		},
+	}
+
+	for _, test := range data {
+
+		x := reflect.ValueOf(test.X)
+		y := reflect.ValueOf(test.Y)
+
+		if res := jlib.DeepEqual(x, y); res != test.Equal {
+			t.Errorf("DeepEqual(%v, %v): expected %t, got %t", test.X, test.Y, test.Equal, res)
+		}
+
+		if res := jlib.DeepEqual(y, x); res != test.Equal {
+			t.Errorf("DeepEqual(%v, %v): expected %t, got %t", test.Y, test.X, test.Equal, res)
+		}
+	}
+
+	if jlib.DeepEqual(reflect.Value{}, reflect.Value{}) {
+		t.Errorf("DeepEqual(undefined, undefined): expected false, got true")
+	}
+}
+
+func TestClone(t *testing.T) {
+
+	input := map[string]interface{}{
+		"a": []interface{}{
+			map[string]interface{}{
+				"b": 1,
+			},
+		},
+		"c": struct {
+			D []int `json:"d"`
+		}{
+			D: []int{1, 2},
+		},
+	}
+
+	output, err := jlib.Clone(reflect.ValueOf(input))
+	if err != nil {
+		t.Fatalf("Clone: unexpected error: %s", err)
+	}
+
+	if !jlib.DeepEqual(reflect.ValueOf(input), reflect.ValueOf(output)) {
+		t.Fatalf("Clone: expected a copy of %v, got %v", input, output)
+	}
+
+	// Modifying the copy does not affect the original.
+	m := output.(*jtypes.OrderedMap)
+	a, _ := m.Get("a")
+	b := a.([]interface{})[0].(*jtypes.OrderedMap)
+	b.Set("b", 2)
+
+	if n := input["a"].([]interface{})[0].(map[string]interface{})["b"]; n != 1 {
+		t.Errorf("Clone: expected original value 1, got %v", n)
+	}
+
+	cyclic := map[string]interface{}{}
+	cyclic["self"] = cyclic
+
+	if _, err := jlib.Clone(reflect.ValueOf(cyclic)); err == nil {
+		t.Errorf("Clone: expected an error for a cyclic value")
+	}
+
+	// Non-string keys are converted to strings.
+	output, err = jlib.Clone(reflect.ValueOf(map[int]float64{1: 1.5}))
+	if err != nil {
+		t.Fatalf("Clone: unexpected error: %s", err)
+	}
+
+	if v, ok := output.(*jtypes.OrderedMap).Get("1"); !ok || v != 1.5 {
+		t.Errorf("Clone: expected key \"1\" to be 1.5, got %v", v)
+	}
+
+	_, err = jlib.Clone(reflect.ValueOf(map[struct{}]int{{}: 1}))
+	if _, ok := err.(*jlib.KeyTypeError); !ok {
+		t.Errorf("Clone: expected a KeyTypeError, got %v", err)
+	}
+}
@@ -4,7 +4,10 @@
 
 package jlib
 
-import "fmt"
+import (
+	"fmt"
+	"reflect"
+)
 
 // ErrType (golint)
 type ErrType uint
@@ -19,6 +22,9 @@ const (
 type Error struct {
 	Type ErrType
 	Func string
+
+	// Position is set by the evaluator. See ArgValueError.
+	Position int
 }
 
 // Error (golint)
@@ -36,9 +42,206 @@ func (e Error) Error() string {
 	return fmt.Sprintf("%s: %s", e.Func, msg)
 }
 
+// Code returns the jsonata-js error code for this error.
+func (e Error) Code() string {
+	switch e.Type {
+	case ErrNaNInf:
+		return "D3001"
+	default:
+		return ""
+	}
+}
+
 func newError(name string, typ ErrType) *Error {
 	return &Error{
 		Func: name,
 		Type: typ,
 	}
 }
+
+// An ArgValueError is returned when an argument to a function
+// has the right type but an invalid value, e.g. a negative
+// number where a positive one is required.
+//
+// Its message has the form "<ordinal> argument of function
+// <name> <reason>", e.g. "third argument of function split
+// must evaluate to a positive number". Before ArgValueError was
+// introduced, some functions worded their messages differently
+// (e.g. "third argument of the split function ..."). Code that
+// needs to identify an error should use its fields and error
+// code rather than its message.
+type ArgValueError struct {
+	// Func is the name of the function that returned the error.
+	Func string
+
+	// Which is the position of the offending argument, starting
+	// from 1. It is zero if the error does not apply to a single
+	// argument.
+	Which int
+
+	// Reason describes the error. If Which is non-zero, Reason
+	// completes a sentence that starts with the argument's
+	// position and the function name, e.g. "must evaluate to
+	// a positive number". Otherwise it is the full message.
+	Reason string
+
+	// Position is the byte offset in the expression of the
+	// start of the function call. It is set by the
+	// evaluator, not by this package. If the function was not
+	// called directly by the expression, e.g. because it was
+	// passed to $map, Position is the position of the call that
+	// invoked it. It is zero if the position is unknown.
+	Position int
+
+	code string
+}
+
+// NewArgValueError returns an ArgValueError with the given
+// jsonata-js error code.
+func NewArgValueError(name string, which int, code string, reason string) *ArgValueError {
+	return &ArgValueError{
+		Func:   name,
+		Which:  which,
+		Reason: reason,
+		code:   code,
+	}
+}
+
+func newArgValueError(name string, which int, code string, format string, a ...interface{}) *ArgValueError {
+	return NewArgValueError(name, which, code, fmt.Sprintf(format, a...))
+}
+
+func (e ArgValueError) Error() string {
+	if e.Which < 1 {
+		return e.Reason
+	}
+
+	return fmt.Sprintf("%s argument of function %s %s", ordinal(e.Which), e.Func, e.Reason)
+}
+
+// Code returns the jsonata-js error code for this error.
+func (e ArgValueError) Code() string {
+	return e.code
+}
+
+// A NonArrayError is returned when a function that operates
+// on arrays is called with a value that is not an array.
+type NonArrayError struct {
+	Func string
+
+	// Position is set by the evaluator. See ArgValueError.
+	Position int
+}
+
+func (e NonArrayError) Error() string {
+	return fmt.Sprintf("cannot call %s on a non-array type", e.Func)
+}
+
+// Code returns the jsonata-js error code for this error.
+func (e NonArrayError) Code() string {
+	return "T0410"
+}
+
+// An ArrayTypeError is returned when a function that operates
+// on arrays of a particular type is called with an array that
+// contains other types.
+type ArrayTypeError struct {
+	Func string
+
+	// Type is the name of the expected type, e.g. "number".
+	Type string
+
+	// Position is set by the evaluator. See ArgValueError.
+	Position int
+}
+
+func (e ArrayTypeError) Error() string {
+	return fmt.Sprintf("cannot call %s on an array with non-%s types", e.Func, e.Type)
+}
+
+// Code returns the jsonata-js error code for this error.
+func (e ArrayTypeError) Code() string {
+	return "T0412"
+}
+
+// A KeyTypeError is returned when a function that operates on
+// objects is called with a Go map whose keys cannot be converted
+// to strings (see KeyString).
+type KeyTypeError struct {
+	Func string
+
+	// Type is the Go type of the offending key, e.g.
+	// "struct {}".
+	Type string
+
+	// Position is set by the evaluator. See ArgValueError.
+	Position int
+}
+
+func newKeyTypeError(name string, k reflect.Value) *KeyTypeError {
+	if k.Kind() == reflect.Interface && !k.IsNil() {
+		k = k.Elem()
+	}
+	return &KeyTypeError{
+		Func: name,
+		Type: k.Type().String(),
+	}
+}
+
+func (e KeyTypeError) Error() string {
+	return fmt.Sprintf("cannot call %s on an object with keys of type %s", e.Func, e.Type)
+}
+
+// Code returns the jsonata-js error code for this error.
+func (e KeyTypeError) Code() string {
+	return "T1003"
+}
+
+// A TimestampError is returned when a function that parses
+// timestamps is called with a string that it cannot parse.
+type TimestampError struct {
+	Func string
+
+	// Value is the string that could not be parsed.
+	Value string
+
+	// Position is set by the evaluator. See ArgValueError.
+	Position int
+}
+
+func newTimestampError(name string, s string) *TimestampError {
+	return &TimestampError{
+		Func:  name,
+		Value: s,
+	}
+}
+
+func (e TimestampError) Error() string {
+	return fmt.Sprintf("function %s could not parse timestamp %q", e.Func, e.Value)
+}
+
+// Code returns the jsonata-js error code for this error.
+func (e TimestampError) Code() string {
+	return "D3110"
+}
+
+var ordinals = []string{
+	"zeroth",
+	"first",
+	"second",
+	"third",
+	"fourth",
+	"fifth",
+	"sixth",
+	"seventh",
+	"eighth",
+	"ninth",
+	"tenth",
+}
+
+func ordinal(n int) string {
+	if n >= 0 && n < len(ordinals) {
+		return ordinals[n]
+	}
+	return fmt.Sprintf("%dth", n)
+}
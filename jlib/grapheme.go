@@ -0,0 +1,341 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jlib
+
+import (
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/blues/jsonata-go/jtypes"
+)
+
+// GraphemeLength returns the number of user-perceived characters
+// in a string. A user-perceived character is an extended grapheme
+// cluster as defined by Unicode Standard Annex #29, e.g. a letter
+// followed by combining accents or an emoji ZWJ sequence such as
+// 👩‍👩‍👧‍👦. Compare utf8.RuneCountInString, which counts
+// code points.
+func GraphemeLength(s string) int {
+	return countSegments(s, nextGrapheme)
+}
+
+// SubstringGraphemes is like Substring except that the offset
+// and length are measured in user-perceived characters (see
+// GraphemeLength). The result never splits a character.
+func SubstringGraphemes(s string, start float64, length jtypes.OptionalFloat64) string {
+	return substring(s, start, length, nextGrapheme)
+}
+
+// PadGraphemes is like Pad except that the width is measured in
+// user-perceived characters (see GraphemeLength).
+func PadGraphemes(s string, width int, chars jtypes.OptionalString) string {
+	return pad(s, width, chars, nextGrapheme)
+}
+
+// gcb is a Grapheme_Cluster_Break property value.
+type gcb int
+
+const (
+	gcbOther gcb = iota
+	gcbCR
+	gcbLF
+	gcbControl
+	gcbExtend
+	gcbZWJ
+	gcbRegionalIndicator
+	gcbPrepend
+	gcbSpacingMark
+	gcbL
+	gcbV
+	gcbT
+	gcbLV
+	gcbLVT
+)
+
+// nextGrapheme returns the length in bytes of the first extended
+// grapheme cluster in a non-empty string. It implements the
+// boundary rules GB3 to GB13 from UAX #29 (the Indic conjunct
+// rule GB9c is not implemented).
+func nextGrapheme(s string) int {
+
+	r, pos := utf8.DecodeRuneInString(s)
+	prev := graphemeBreak(r)
+
+	// ri is the number of consecutive regional indicators that
+	// end at the current position.
+	ri := 0
+	if prev == gcbRegionalIndicator {
+		ri = 1
+	}
+
+	// pict is true if the cluster so far ends with an extended
+	// pictographic character followed by zero or more Extend
+	// characters. zwj is true if that sequence is followed by
+	// a ZWJ.
+	pict := isExtendedPictographic(r)
+	zwj := false
+
+	for pos < len(s) {
+
+		r, size := utf8.DecodeRuneInString(s[pos:])
+		next := graphemeBreak(r)
+
+		if isGraphemeBoundary(prev, next, ri, zwj && isExtendedPictographic(r)) {
+			break
+		}
+
+		switch {
+		case next == gcbRegionalIndicator:
+			ri++
+		default:
+			ri = 0
+		}
+
+		switch {
+		case isExtendedPictographic(r):
+			pict, zwj = true, false
+		case next == gcbExtend && pict:
+			zwj = false
+		case next == gcbZWJ && pict:
+			pict, zwj = false, true
+		default:
+			pict, zwj = false, false
+		}
+
+		prev = next
+		pos += size
+	}
+
+	return pos
+}
+
+// isGraphemeBoundary reports whether there is a grapheme
+// cluster boundary between two characters with the given
+// properties. The ri argument is the number of consecutive
+// regional indicators before the boundary. The emoji argument
+// is true if the characters complete an emoji ZWJ sequence
+// (rule GB11).
+func isGraphemeBoundary(prev, next gcb, ri int, emoji bool) bool {
+
+	switch {
+	case prev == gcbCR && next == gcbLF: // GB3
+		return false
+	case prev == gcbControl || prev == gcbCR || prev == gcbLF: // GB4
+		return true
+	case next == gcbControl || next == gcbCR || next == gcbLF: // GB5
+		return true
+	case prev == gcbL && (next == gcbL || next == gcbV || next == gcbLV || next == gcbLVT): // GB6
+		return false
+	case (prev == gcbLV || prev == gcbV) && (next == gcbV || next == gcbT): // GB7
+		return false
+	case (prev == gcbLVT || prev == gcbT) && next == gcbT: // GB8
+		return false
+	case next == gcbExtend || next == gcbZWJ: // GB9
+		return false
+	case next == gcbSpacingMark: // GB9a
+		return false
+	case prev == gcbPrepend: // GB9b
+		return false
+	case prev == gcbZWJ && emoji: // GB11
+		return false
+	case prev == gcbRegionalIndicator && next == gcbRegionalIndicator: // GB12, GB13
+		return ri%2 == 0
+	default: // GB999
+		return true
+	}
+}
+
+const (
+	hangulBase   = 0xAC00
+	hangulCount  = 11172
+	hangulTCount = 28
+)
+
+// graphemeBreak returns the Grapheme_Cluster_Break property of
+// a rune. The values are derived from the general categories and
+// properties in the unicode package, which match the Unicode
+// data files closely enough for segmenting text.
+func graphemeBreak(r rune) gcb {
+
+	if r < 0x7F {
+		switch {
+		case r == '\r':
+			return gcbCR
+		case r == '\n':
+			return gcbLF
+		case r < 0x20:
+			return gcbControl
+		default:
+			return gcbOther
+		}
+	}
+
+	switch {
+	case r == 0x200D:
+		return gcbZWJ
+	case r == 0x200C:
+		return gcbExtend
+	case r >= hangulBase && r < hangulBase+hangulCount:
+		if (r-hangulBase)%hangulTCount == 0 {
+			return gcbLV
+		}
+		return gcbLVT
+	case unicode.Is(hangulL, r):
+		return gcbL
+	case unicode.Is(hangulV, r):
+		return gcbV
+	case unicode.Is(hangulT, r):
+		return gcbT
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Other_Grapheme_Extend, emojiModifier):
+		return gcbExtend
+	case unicode.Is(unicode.Regional_Indicator, r):
+		return gcbRegionalIndicator
+	case unicode.In(r, unicode.Prepended_Concatenation_Mark, prepend):
+		return gcbPrepend
+	case unicode.In(r, unicode.Cc, unicode.Cf, unicode.Zl, unicode.Zp):
+		return gcbControl
+	case unicode.Is(unicode.Mc, r), r == 0x0E33, r == 0x0EB3:
+		return gcbSpacingMark
+	default:
+		return gcbOther
+	}
+}
+
+func isExtendedPictographic(r rune) bool {
+	return r >= 0xA9 && unicode.Is(extendedPictographic, r)
+}
+
+var hangulL = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x1100, Hi: 0x115F, Stride: 1},
+		{Lo: 0xA960, Hi: 0xA97C, Stride: 1},
+	},
+}
+
+var hangulV = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x1160, Hi: 0x11A7, Stride: 1},
+		{Lo: 0xD7B0, Hi: 0xD7C6, Stride: 1},
+	},
+}
+
+var hangulT = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x11A8, Hi: 0x11FF, Stride: 1},
+		{Lo: 0xD7CB, Hi: 0xD7FB, Stride: 1},
+	},
+}
+
+// emojiModifier contains the skin tone modifiers, which have
+// the Grapheme_Cluster_Break value Extend.
+var emojiModifier = &unicode.RangeTable{
+	R32: []unicode.Range32{
+		{Lo: 0x1F3FB, Hi: 0x1F3FF, Stride: 1},
+	},
+}
+
+// prepend contains the characters with the Grapheme_Cluster_Break
+// value Prepend that are not prepended concatenation marks.
+var prepend = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x0D4E, Hi: 0x0D4E, Stride: 1},
+	},
+	R32: []unicode.Range32{
+		{Lo: 0x111C2, Hi: 0x111C3, Stride: 1},
+		{Lo: 0x1193F, Hi: 0x1193F, Stride: 1},
+		{Lo: 0x11941, Hi: 0x11941, Stride: 1},
+		{Lo: 0x11A3A, Hi: 0x11A3A, Stride: 1},
+		{Lo: 0x11A84, Hi: 0x11A89, Stride: 1},
+		{Lo: 0x11D46, Hi: 0x11D46, Stride: 1},
+	},
+}
+
+// extendedPictographic contains the characters with the
+// Extended_Pictographic property from the Unicode emoji data.
+var extendedPictographic = &unicode.RangeTable{
+	LatinOffset: 2,
+	R16: []unicode.Range16{
+		{Lo: 0x00A9, Hi: 0x00A9, Stride: 1},
+		{Lo: 0x00AE, Hi: 0x00AE, Stride: 1},
+		{Lo: 0x203C, Hi: 0x203C, Stride: 1},
+		{Lo: 0x2049, Hi: 0x2049, Stride: 1},
+		{Lo: 0x2122, Hi: 0x2122, Stride: 1},
+		{Lo: 0x2139, Hi: 0x2139, Stride: 1},
+		{Lo: 0x2194, Hi: 0x2199, Stride: 1},
+		{Lo: 0x21A9, Hi: 0x21AA, Stride: 1},
+		{Lo: 0x231A, Hi: 0x231B, Stride: 1},
+		{Lo: 0x2328, Hi: 0x2328, Stride: 1},
+		{Lo: 0x2388, Hi: 0x2388, Stride: 1},
+		{Lo: 0x23CF, Hi: 0x23CF, Stride: 1},
+		{Lo: 0x23E9, Hi: 0x23F3, Stride: 1},
+		{Lo: 0x23F8, Hi: 0x23FA, Stride: 1},
+		{Lo: 0x24C2, Hi: 0x24C2, Stride: 1},
+		{Lo: 0x25AA, Hi: 0x25AB, Stride: 1},
+		{Lo: 0x25B6, Hi: 0x25B6, Stride: 1},
+		{Lo: 0x25C0, Hi: 0x25C0, Stride: 1},
+		{Lo: 0x25FB, Hi: 0x25FE, Stride: 1},
+		{Lo: 0x2600, Hi: 0x2605, Stride: 1},
+		{Lo: 0x2607, Hi: 0x2612, Stride: 1},
+		{Lo: 0x2614, Hi: 0x2685, Stride: 1},
+		{Lo: 0x2690, Hi: 0x2705, Stride: 1},
+		{Lo: 0x2708, Hi: 0x2712, Stride: 1},
+		{Lo: 0x2714, Hi: 0x2714, Stride: 1},
+		{Lo: 0x2716, Hi: 0x2716, Stride: 1},
+		{Lo: 0x271D, Hi: 0x271D, Stride: 1},
+		{Lo: 0x2721, Hi: 0x2721, Stride: 1},
+		{Lo: 0x2728, Hi: 0x2728, Stride: 1},
+		{Lo: 0x2733, Hi: 0x2734, Stride: 1},
+		{Lo: 0x2744, Hi: 0x2744, Stride: 1},
+		{Lo: 0x2747, Hi: 0x2747, Stride: 1},
+		{Lo: 0x274C, Hi: 0x274C, Stride: 1},
+		{Lo: 0x274E, Hi: 0x274E, Stride: 1},
+		{Lo: 0x2753, Hi: 0x2755, Stride: 1},
+		{Lo: 0x2757, Hi: 0x2757, Stride: 1},
+		{Lo: 0x2763, Hi: 0x2767, Stride: 1},
+		{Lo: 0x2795, Hi: 0x2797, Stride: 1},
+		{Lo: 0x27A1, Hi: 0x27A1, Stride: 1},
+		{Lo: 0x27B0, Hi: 0x27B0, Stride: 1},
+		{Lo: 0x27BF, Hi: 0x27BF, Stride: 1},
+		{Lo: 0x2934, Hi: 0x2935, Stride: 1},
+		{Lo: 0x2B05, Hi: 0x2B07, Stride: 1},
+		{Lo: 0x2B1B, Hi: 0x2B1C, Stride: 1},
+		{Lo: 0x2B50, Hi: 0x2B50, Stride: 1},
+		{Lo: 0x2B55, Hi: 0x2B55, Stride: 1},
+		{Lo: 0x3030, Hi: 0x3030, Stride: 1},
+		{Lo: 0x303D, Hi: 0x303D, Stride: 1},
+		{Lo: 0x3297, Hi: 0x3297, Stride: 1},
+		{Lo: 0x3299, Hi: 0x3299, Stride: 1},
+	},
+	R32: []unicode.Range32{
+		{Lo: 0x1F000, Hi: 0x1F0FF, Stride: 1},
+		{Lo: 0x1F10D, Hi: 0x1F10F, Stride: 1},
+		{Lo: 0x1F12F, Hi: 0x1F12F, Stride: 1},
+		{Lo: 0x1F16C, Hi: 0x1F171, Stride: 1},
+		{Lo: 0x1F17E, Hi: 0x1F17F, Stride: 1},
+		{Lo: 0x1F18E, Hi: 0x1F18E, Stride: 1},
+		{Lo: 0x1F191, Hi: 0x1F19A, Stride: 1},
+		{Lo: 0x1F1AD, Hi: 0x1F1E5, Stride: 1},
+		{Lo: 0x1F201, Hi: 0x1F20F, Stride: 1},
+		{Lo: 0x1F21A, Hi: 0x1F21A, Stride: 1},
+		{Lo: 0x1F22F, Hi: 0x1F22F, Stride: 1},
+		{Lo: 0x1F232, Hi: 0x1F23A, Stride: 1},
+		{Lo: 0x1F23C, Hi: 0x1F23F, Stride: 1},
+		{Lo: 0x1F249, Hi: 0x1F3FA, Stride: 1},
+		{Lo: 0x1F400, Hi: 0x1F53D, Stride: 1},
+		{Lo: 0x1F546, Hi: 0x1F64F, Stride: 1},
+		{Lo: 0x1F680, Hi: 0x1F6FF, Stride: 1},
+		{Lo: 0x1F774, Hi: 0x1F77F, Stride: 1},
+		{Lo: 0x1F7D5, Hi: 0x1F7FF, Stride: 1},
+		{Lo: 0x1F80C, Hi: 0x1F80F, Stride: 1},
+		{Lo: 0x1F848, Hi: 0x1F84F, Stride: 1},
+		{Lo: 0x1F85A, Hi: 0x1F85F, Stride: 1},
+		{Lo: 0x1F888, Hi: 0x1F88F, Stride: 1},
+		{Lo: 0x1F8AE, Hi: 0x1F8FF, Stride: 1},
+		{Lo: 0x1F90C, Hi: 0x1F93A, Stride: 1},
+		{Lo: 0x1F93C, Hi: 0x1F945, Stride: 1},
+		{Lo: 0x1F947, Hi: 0x1FAFF, Stride: 1},
+		{Lo: 0x1FC00, Hi: 0x1FFFD, Stride: 1},
+	},
+}
@@ -5,20 +5,22 @@
 package jlib
 
 import (
-	"fmt"
 	"reflect"
 
 	"github.com/blues/jsonata-go/jtypes"
 )
 
-// Map (golint)
+// Map calls a function for each item in an array and returns
+// the results. The function is called with up to three arguments:
+// the item, its index and the array. Functions that take fewer
+// parameters receive only as many arguments as they take.
 func Map(v reflect.Value, f jtypes.Callable) (interface{}, error) {
 
 	v = forceArray(jtypes.Resolve(v))
 
 	var results []interface{}
 
-	argc := clamp(f.ParamCount(), 1, 3)
+	argc := clamp(f.ParamCount(), 0, 3)
 
 	for i := 0; i < arrayLen(v); i++ {
 
@@ -36,14 +38,16 @@ func Map(v reflect.Value, f jtypes.Callable) (interface{}, error) {
 	return results, nil
 }
 
-// Filter (golint)
+// Filter returns the items in an array for which a function
+// returns true. The function is called with the same arguments
+// as in Map.
 func Filter(v reflect.Value, f jtypes.Callable) (interface{}, error) {
 
 	v = forceArray(jtypes.Resolve(v))
 
 	var results []interface{}
 
-	argc := clamp(f.ParamCount(), 1, 3)
+	argc := clamp(f.ParamCount(), 0, 3)
 
 	for i := 0; i < arrayLen(v); i++ {
 
@@ -62,16 +66,21 @@ func Filter(v reflect.Value, f jtypes.Callable) (interface{}, error) {
 	return results, nil
 }
 
-// Reduce (golint)
+// Reduce combines the items in an array using a function of
+// at least two parameters. The function is called with the
+// accumulated value and the next item, followed by the item's
+// index and the array if the function takes them.
 func Reduce(v reflect.Value, f jtypes.Callable, init jtypes.OptionalValue) (interface{}, error) {
 
 	v = forceArray(jtypes.Resolve(v))
 
 	var res reflect.Value
 
-	if f.ParamCount() != 2 {
-		return nil, fmt.Errorf("second argument of function \"reduce\" must be a function that takes two arguments")
+	argc := f.ParamCount()
+	if argc < 2 {
+		return nil, newArgValueError("reduce", 2, "D3050", "must be a function that takes at least two arguments")
 	}
+	argc = clamp(argc, 2, 4)
 
 	i := 0
 	switch {
@@ -84,7 +93,9 @@ func Reduce(v reflect.Value, f jtypes.Callable, init jtypes.OptionalValue) (inte
 
 	var err error
 	for ; i < arrayLen(v); i++ {
-		res, err = f.Call([]reflect.Value{res, v.Index(i)})
+		argv := []reflect.Value{res, v.Index(i), reflect.ValueOf(i), v}
+
+		res, err = f.Call(argv[:argc])
 		if err != nil {
 			return nil, err
 		}
@@ -114,8 +125,12 @@ func Single(v reflect.Value, f jtypes.Callable) (interface{}, error) {
 		// more than one item in the slice, return a error, otherwise
 		// return the item
 		s := reflect.ValueOf(filteredValue)
-		if s.Len() != 1 {
-			return nil, fmt.Errorf("number of matching values returned by single() must be 1, got: %d", s.Len())
+		if n := s.Len(); n != 1 {
+			code := "D3138"
+			if n == 0 {
+				code = "D3139"
+			}
+			return nil, newArgValueError("single", 0, code, "number of matching values returned by single() must be 1, got: %d", n)
 		}
 		return s.Index(0).Interface(), nil
 
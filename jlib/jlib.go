@@ -6,6 +6,7 @@
 package jlib
 
 import (
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"reflect"
@@ -23,6 +24,8 @@ var typeBool = reflect.TypeOf((*bool)(nil)).Elem()
 var typeCallable = reflect.TypeOf((*jtypes.Callable)(nil)).Elem()
 var typeString = reflect.TypeOf((*string)(nil)).Elem()
 var typeNumber = reflect.TypeOf((*float64)(nil)).Elem()
+var typeByteSlice = reflect.TypeOf((*[]byte)(nil)).Elem()
+var typeJSONMarshaler = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
 
 // StringNumberBool (golint)
 type StringNumberBool reflect.Value
@@ -57,6 +60,11 @@ func (s StringCallable) toInterface() interface{} {
 // TypeOf implements the jsonata $type function that returns the data type of
 // the argument
 func TypeOf(x interface{}) (string, error) {
+	if x == nil {
+		// A Go nil, e.g. a JSON null decoded by encoding/json.
+		return "null", nil
+	}
+
 	v := reflect.ValueOf(x)
 	if jtypes.IsCallable(v) {
 		return "function", nil
@@ -73,12 +81,13 @@ func TypeOf(x interface{}) (string, error) {
 	if jtypes.IsBool(v) {
 		return "boolean", nil
 	}
-	if jtypes.IsMap(v) {
+	if jtypes.IsMap(v) || jtypes.IsStruct(v) {
 		return "object", nil
 	}
 
-	switch x.(type) {
-	case *interface{}:
+	// Nil pointers include the JSONata null value, which is
+	// a nil *interface{}.
+	if v = jtypes.Resolve(v); v.Kind() == reflect.Ptr && v.IsNil() {
 		return "null", nil
 	}
 
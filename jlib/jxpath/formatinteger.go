@@ -0,0 +1,676 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jxpath
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A PictureError is returned when a picture string is not
+// valid or uses a feature that is not supported.
+type PictureError struct {
+	Picture string
+	Reason  string
+}
+
+func (e *PictureError) Error() string {
+	return fmt.Sprintf("invalid picture string %q: %s", e.Picture, e.Reason)
+}
+
+func newPictureError(picture string, format string, a ...interface{}) error {
+	return &PictureError{
+		Picture: picture,
+		Reason:  fmt.Sprintf(format, a...),
+	}
+}
+
+// A MatchError is returned by ParseInteger when a string does
+// not match the picture string.
+type MatchError struct {
+	Value   string
+	Picture string
+}
+
+func (e *MatchError) Error() string {
+	return fmt.Sprintf("%q does not match the picture string %q", e.Value, e.Picture)
+}
+
+type integerFormat uint8
+
+const (
+	_ integerFormat = iota
+	formatDecimal
+	formatAlphaLower
+	formatAlphaUpper
+	formatRomanLower
+	formatRomanUpper
+	formatWordsLower
+	formatWordsUpper
+	formatWordsTitle
+)
+
+type integerPicture struct {
+	format  integerFormat
+	ordinal bool
+
+	// The following fields are only used by the decimal
+	// format.
+	mandatoryDigits int
+	groups          []digitGroup
+	regularGroups   bool
+}
+
+// A digitGroup describes a grouping separator in a decimal
+// digit pattern. Its position is the number of digits to the
+// right of the separator.
+type digitGroup struct {
+	position  int
+	separator string
+}
+
+var reFormatModifier = regexp.MustCompile(`^([co])(\(.+\))?([at])?$`)
+
+// FormatInteger converts an integer to a string, formatted
+// according to the given picture string. Supported formats
+// are decimal digit patterns (e.g. "0001" or "#,##0"), words
+// ("w", "W" or "Ww"), roman numerals ("i" or "I") and letters
+// ("a" or "A"). The ";o" modifier produces ordinal numbers
+// (e.g. "1st" or "first").
+//
+// See the XPath documentation for the syntax of the picture
+// string.
+//
+// https://www.w3.org/TR/xpath-functions-31/#formatting-integers
+func FormatInteger(n int, picture string) (string, error) {
+
+	pic, err := parseIntegerPicture(picture)
+	if err != nil {
+		return "", err
+	}
+
+	switch pic.format {
+	case formatAlphaLower, formatAlphaUpper:
+		if n > 0 {
+			return formatAlpha(n, pic.format == formatAlphaUpper), nil
+		}
+	case formatRomanLower, formatRomanUpper:
+		if n > 0 && n <= maxRoman {
+			return formatRoman(n, pic.format == formatRomanUpper), nil
+		}
+	case formatWordsLower:
+		return strings.ToLower(formatWords(n, pic.ordinal)), nil
+	case formatWordsUpper:
+		return strings.ToUpper(formatWords(n, pic.ordinal)), nil
+	case formatWordsTitle:
+		return formatWords(n, pic.ordinal), nil
+	case formatDecimal:
+		return formatDecimalPattern(n, pic), nil
+	}
+
+	// Numbers that cannot be represented with letters or roman
+	// numerals fall back to the default decimal format.
+	return strconv.Itoa(n), nil
+}
+
+// ParseInteger is the inverse of FormatInteger. It converts
+// a string formatted according to the given picture string
+// back into an integer.
+func ParseInteger(s string, picture string) (int, error) {
+
+	pic, err := parseIntegerPicture(picture)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	var ok bool
+
+	switch pic.format {
+	case formatAlphaLower, formatAlphaUpper:
+		n, ok = parseAlpha(s)
+	case formatRomanLower, formatRomanUpper:
+		n, ok = parseRoman(s)
+	case formatWordsLower, formatWordsUpper, formatWordsTitle:
+		n, ok = parseWords(s)
+	case formatDecimal:
+		n, ok = parseDecimalPattern(s, pic)
+	}
+
+	if !ok {
+		return 0, &MatchError{
+			Value:   s,
+			Picture: picture,
+		}
+	}
+
+	return n, nil
+}
+
+func parseIntegerPicture(picture string) (*integerPicture, error) {
+
+	if picture == "" {
+		return nil, newPictureError(picture, "picture string cannot be empty")
+	}
+
+	pic := &integerPicture{}
+	primary := picture
+
+	// Everything after the last semicolon is a format modifier.
+	if pos := strings.LastIndex(picture, ";"); pos >= 0 {
+
+		primary = picture[:pos]
+		modifier := picture[pos+1:]
+
+		matches := reFormatModifier.FindStringSubmatch(modifier)
+		if matches == nil {
+			return nil, newPictureError(picture, "invalid format modifier %q", modifier)
+		}
+
+		pic.ordinal = matches[1] == "o"
+	}
+
+	switch primary {
+	case "":
+		return nil, newPictureError(picture, "primary format token cannot be empty")
+	case "a":
+		pic.format = formatAlphaLower
+	case "A":
+		pic.format = formatAlphaUpper
+	case "i":
+		pic.format = formatRomanLower
+	case "I":
+		pic.format = formatRomanUpper
+	case "w":
+		pic.format = formatWordsLower
+	case "W":
+		pic.format = formatWordsUpper
+	case "Ww":
+		pic.format = formatWordsTitle
+	default:
+		if err := parseDecimalDigitPattern(primary, pic); err != nil {
+			return nil, newPictureError(picture, "%s", err)
+		}
+		pic.format = formatDecimal
+	}
+
+	return pic, nil
+}
+
+func parseDecimalDigitPattern(s string, pic *integerPicture) error {
+
+	var digits int
+	var hasDigits, lastWasSeparator bool
+
+	for _, r := range s {
+		switch {
+		case r == '#':
+			if digits > 0 {
+				return fmt.Errorf("an optional digit cannot follow a mandatory digit")
+			}
+			hasDigits = true
+			lastWasSeparator = false
+
+		case r >= '0' && r <= '9':
+			digits++
+			hasDigits = true
+			lastWasSeparator = false
+
+		case unicode.IsDigit(r):
+			return fmt.Errorf("only ASCII decimal digits are supported")
+
+		case unicode.IsLetter(r) || unicode.IsNumber(r):
+			return fmt.Errorf("unsupported format token %q", s)
+
+		default:
+			if !hasDigits {
+				return fmt.Errorf("a decimal digit pattern cannot start with a grouping separator")
+			}
+			if lastWasSeparator {
+				return fmt.Errorf("a decimal digit pattern cannot contain adjacent grouping separators")
+			}
+			lastWasSeparator = true
+		}
+	}
+
+	if digits == 0 {
+		return fmt.Errorf("a decimal digit pattern must contain at least one decimal digit")
+	}
+
+	if lastWasSeparator {
+		return fmt.Errorf("a decimal digit pattern cannot end with a grouping separator")
+	}
+
+	// Record the position of each grouping separator, working
+	// from right to left.
+	var groups []digitGroup
+	position := 0
+
+	for len(s) > 0 {
+		r, size := utf8.DecodeLastRuneInString(s)
+		s = s[:len(s)-size]
+
+		if r == '#' || (r >= '0' && r <= '9') {
+			position++
+			continue
+		}
+
+		groups = append(groups, digitGroup{
+			position:  position,
+			separator: string(r),
+		})
+	}
+
+	pic.mandatoryDigits = digits
+	pic.groups = groups
+	pic.regularGroups = isRegularGrouping(groups)
+
+	return nil
+}
+
+// isRegularGrouping returns true if the grouping separators in
+// a decimal digit pattern are the same character and occur at
+// regular intervals. Regular separators are repeated to the
+// left of the pattern as required. The groups must be ordered
+// from right to left.
+func isRegularGrouping(groups []digitGroup) bool {
+
+	if len(groups) == 0 {
+		return false
+	}
+
+	interval := groups[0].position
+
+	for i, group := range groups {
+		if group.separator != groups[0].separator {
+			return false
+		}
+		if group.position != interval*(i+1) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func formatDecimalPattern(n int, pic *integerPicture) string {
+
+	digits := strconv.Itoa(abs(n))
+	if padding := pic.mandatoryDigits - len(digits); padding > 0 {
+		digits = strings.Repeat("0", padding) + digits
+	}
+
+	separators := map[int]string{}
+	for _, group := range pic.groups {
+		separators[group.position] = group.separator
+	}
+
+	if pic.regularGroups {
+		interval := pic.groups[0].position
+		for pos := interval; pos < len(digits); pos += interval {
+			separators[pos] = pic.groups[0].separator
+		}
+	}
+
+	var b strings.Builder
+
+	if n < 0 {
+		b.WriteByte('-')
+	}
+
+	for i, r := range digits {
+		if i > 0 {
+			if sep, ok := separators[len(digits)-i]; ok {
+				b.WriteString(sep)
+			}
+		}
+		b.WriteRune(r)
+	}
+
+	if pic.ordinal {
+		b.WriteString(ordinalSuffix(abs(n)))
+	}
+
+	return b.String()
+}
+
+func parseDecimalPattern(s string, pic *integerPicture) (int, bool) {
+
+	if pic.ordinal {
+		for _, suffix := range []string{"st", "nd", "rd", "th"} {
+			if strings.HasSuffix(s, suffix) {
+				s = strings.TrimSuffix(s, suffix)
+				break
+			}
+		}
+	}
+
+	var negative bool
+	if strings.HasPrefix(s, "-") {
+		negative = true
+		s = s[1:]
+	}
+
+	separators := map[rune]bool{}
+	for _, group := range pic.groups {
+		r, _ := utf8.DecodeRuneInString(group.separator)
+		separators[r] = true
+	}
+
+	digits := strings.Map(func(r rune) rune {
+		if separators[r] {
+			return -1
+		}
+		return r
+	}, s)
+
+	if !isAllDigits(digits) {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(digits)
+	if err != nil {
+		return 0, false
+	}
+
+	if negative {
+		n = -n
+	}
+
+	return n, true
+}
+
+func formatAlpha(n int, upper bool) string {
+
+	base := 'a'
+	if upper {
+		base = 'A'
+	}
+
+	var letters []rune
+	for n > 0 {
+		n--
+		letters = append([]rune{base + rune(n%26)}, letters...)
+		n /= 26
+	}
+
+	return string(letters)
+}
+
+func parseAlpha(s string) (int, bool) {
+
+	if s == "" {
+		return 0, false
+	}
+
+	n := 0
+	for _, r := range strings.ToLower(s) {
+		if r < 'a' || r > 'z' {
+			return 0, false
+		}
+		n = n*26 + int(r-'a') + 1
+	}
+
+	return n, true
+}
+
+var romanNumerals = []struct {
+	value   int
+	numeral string
+}{
+	{1000, "m"},
+	{900, "cm"},
+	{500, "d"},
+	{400, "cd"},
+	{100, "c"},
+	{90, "xc"},
+	{50, "l"},
+	{40, "xl"},
+	{10, "x"},
+	{9, "ix"},
+	{5, "v"},
+	{4, "iv"},
+	{1, "i"},
+}
+
+// maxRoman is the largest number that can be written in
+// standard roman numerals.
+const maxRoman = 3999
+
+func formatRoman(n int, upper bool) string {
+
+	var b strings.Builder
+
+	for _, rn := range romanNumerals {
+		for n >= rn.value {
+			b.WriteString(rn.numeral)
+			n -= rn.value
+		}
+	}
+
+	if upper {
+		return strings.ToUpper(b.String())
+	}
+
+	return b.String()
+}
+
+func parseRoman(s string) (int, bool) {
+
+	s = strings.ToLower(s)
+	if s == "" {
+		return 0, false
+	}
+
+	n := 0
+	rest := s
+	for _, rn := range romanNumerals {
+		for strings.HasPrefix(rest, rn.numeral) {
+			n += rn.value
+			rest = rest[len(rn.numeral):]
+		}
+	}
+
+	// Reject non-standard numerals such as "iiii".
+	if rest != "" || n > maxRoman || formatRoman(n, false) != s {
+		return 0, false
+	}
+
+	return n, true
+}
+
+var (
+	smallNumberWords = []string{
+		"Zero", "One", "Two", "Three", "Four", "Five", "Six",
+		"Seven", "Eight", "Nine", "Ten", "Eleven", "Twelve",
+		"Thirteen", "Fourteen", "Fifteen", "Sixteen",
+		"Seventeen", "Eighteen", "Nineteen",
+	}
+
+	smallOrdinalWords = []string{
+		"Zeroth", "First", "Second", "Third", "Fourth", "Fifth",
+		"Sixth", "Seventh", "Eighth", "Ninth", "Tenth",
+		"Eleventh", "Twelfth", "Thirteenth", "Fourteenth",
+		"Fifteenth", "Sixteenth", "Seventeenth", "Eighteenth",
+		"Nineteenth",
+	}
+
+	decadeWords = []string{
+		"Twenty", "Thirty", "Forty", "Fifty", "Sixty", "Seventy",
+		"Eighty", "Ninety",
+	}
+
+	magnitudeWords = []string{
+		"Thousand", "Million", "Billion", "Trillion",
+	}
+)
+
+// formatWords converts an integer to English words, e.g.
+// "One Hundred and Twenty-Three". The output matches that of
+// the reference JSONata implementation.
+func formatWords(n int, ordinal bool) string {
+	if n < 0 {
+		return "Minus " + numberToWords(-n, false, ordinal)
+	}
+	return numberToWords(n, false, ordinal)
+}
+
+func numberToWords(n int, prev bool, ordinal bool) string {
+
+	var words string
+
+	switch {
+	case n < 20:
+		if prev {
+			words = " and "
+		}
+		if ordinal {
+			words += smallOrdinalWords[n]
+		} else {
+			words += smallNumberWords[n]
+		}
+
+	case n < 100:
+		if prev {
+			words = " and "
+		}
+		words += decadeWords[n/10-2]
+		if rem := n % 10; rem > 0 {
+			words += "-" + numberToWords(rem, false, ordinal)
+		} else if ordinal {
+			words = strings.TrimSuffix(words, "y") + "ieth"
+		}
+
+	case n < 1000:
+		if prev {
+			words = ", "
+		}
+		words += smallNumberWords[n/100] + " Hundred"
+		if rem := n % 100; rem > 0 {
+			words += numberToWords(rem, true, ordinal)
+		} else if ordinal {
+			words += "th"
+		}
+
+	default:
+		mag := 0
+		for factor := 1000; n/factor >= 1000 && mag < len(magnitudeWords)-1; factor *= 1000 {
+			mag++
+		}
+
+		factor := pow10(3 * (mag + 1))
+		if prev {
+			words = ", "
+		}
+		words += numberToWords(n/factor, false, false) + " " + magnitudeWords[mag]
+		if rem := n % factor; rem > 0 {
+			words += numberToWords(rem, true, ordinal)
+		} else if ordinal {
+			words += "th"
+		}
+	}
+
+	return words
+}
+
+var wordValues = func() map[string]int {
+
+	m := map[string]int{}
+
+	for i, w := range smallNumberWords {
+		m[strings.ToLower(w)] = i
+	}
+	for i, w := range smallOrdinalWords {
+		m[strings.ToLower(w)] = i
+	}
+	for i, w := range decadeWords {
+		w = strings.ToLower(w)
+		m[w] = (i + 2) * 10
+		m[strings.TrimSuffix(w, "y")+"ieth"] = (i + 2) * 10
+	}
+
+	return m
+}()
+
+var magnitudeValues = func() map[string]int {
+
+	m := map[string]int{
+		"hundred":   100,
+		"hundredth": 100,
+	}
+
+	for i, w := range magnitudeWords {
+		w = strings.ToLower(w)
+		m[w] = pow10(3 * (i + 1))
+		m[w+"th"] = pow10(3 * (i + 1))
+	}
+
+	return m
+}()
+
+func parseWords(s string) (int, bool) {
+
+	fields := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return r == ' ' || r == ',' || r == '-'
+	})
+
+	if len(fields) == 0 {
+		return 0, false
+	}
+
+	var negative bool
+	if fields[0] == "minus" {
+		negative = true
+		fields = fields[1:]
+	}
+
+	var total, current, largest int
+	var found bool
+
+	for _, field := range fields {
+
+		if field == "and" {
+			continue
+		}
+
+		if n, ok := wordValues[field]; ok {
+			current += n
+			found = true
+			continue
+		}
+
+		m, ok := magnitudeValues[field]
+		if !ok {
+			return 0, false
+		}
+
+		switch {
+		case m == 100:
+			current *= m
+		case m > largest:
+			total = (total + current) * m
+			current = 0
+			largest = m
+		default:
+			total += current * m
+			current = 0
+		}
+	}
+
+	if !found {
+		return 0, false
+	}
+
+	n := total + current
+	if negative {
+		n = -n
+	}
+
+	return n, true
+}
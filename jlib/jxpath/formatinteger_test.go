@@ -0,0 +1,348 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jxpath
+
+import (
+	"reflect"
+	"testing"
+)
+
+type formatIntegerTest struct {
+	Value   int
+	Picture string
+	Output  string
+	Error   error
+}
+
+func TestFormatInteger(t *testing.T) {
+
+	tests := []formatIntegerTest{
+		{
+			Value:   123,
+			Picture: "0",
+			Output:  "123",
+		},
+		{
+			Value:   7,
+			Picture: "0000",
+			Output:  "0007",
+		},
+		{
+			Value:   -7,
+			Picture: "000",
+			Output:  "-007",
+		},
+		{
+			Value:   1234567,
+			Picture: "#,##0",
+			Output:  "1,234,567",
+		},
+		{
+			Value:   12,
+			Picture: "#,##0",
+			Output:  "12",
+		},
+		{
+			Value:   1234567,
+			Picture: "#,##,000",
+			Output:  "12,34,567",
+		},
+		{
+			Value:   1234567,
+			Picture: "0 000",
+			Output:  "1 234 567",
+		},
+		{
+			Value:   1,
+			Picture: "0;o",
+			Output:  "1st",
+		},
+		{
+			Value:   112,
+			Picture: "0;o",
+			Output:  "112th",
+		},
+		{
+			Value:   23,
+			Picture: "#0;o",
+			Output:  "23rd",
+		},
+		{
+			Value:   1999,
+			Picture: "I",
+			Output:  "MCMXCIX",
+		},
+		{
+			Value:   2024,
+			Picture: "i",
+			Output:  "mmxxiv",
+		},
+		{
+			// Zero cannot be represented in roman numerals.
+			Value:   0,
+			Picture: "I",
+			Output:  "0",
+		},
+		{
+			Value:   4000,
+			Picture: "I",
+			Output:  "4000",
+		},
+		{
+			Value:   28,
+			Picture: "a",
+			Output:  "ab",
+		},
+		{
+			Value:   702,
+			Picture: "A",
+			Output:  "ZZ",
+		},
+		{
+			Value:   0,
+			Picture: "w",
+			Output:  "zero",
+		},
+		{
+			Value:   123,
+			Picture: "w",
+			Output:  "one hundred and twenty-three",
+		},
+		{
+			Value:   1234,
+			Picture: "W",
+			Output:  "ONE THOUSAND, TWO HUNDRED AND THIRTY-FOUR",
+		},
+		{
+			Value:   1001,
+			Picture: "Ww",
+			Output:  "One Thousand and One",
+		},
+		{
+			Value:   3000000,
+			Picture: "w",
+			Output:  "three million",
+		},
+		{
+			Value:   -40,
+			Picture: "w",
+			Output:  "minus forty",
+		},
+		{
+			Value:   21,
+			Picture: "w;o",
+			Output:  "twenty-first",
+		},
+		{
+			Value:   40,
+			Picture: "w;o",
+			Output:  "fortieth",
+		},
+		{
+			Value:   100,
+			Picture: "Ww;o",
+			Output:  "One Hundredth",
+		},
+		{
+			Value:   1000012,
+			Picture: "w;o",
+			Output:  "one million and twelfth",
+		},
+		{
+			Picture: "",
+			Error: &PictureError{
+				Picture: "",
+				Reason:  "picture string cannot be empty",
+			},
+		},
+		{
+			Picture: "x",
+			Error: &PictureError{
+				Picture: "x",
+				Reason:  `unsupported format token "x"`,
+			},
+		},
+		{
+			Picture: "#",
+			Error: &PictureError{
+				Picture: "#",
+				Reason:  "a decimal digit pattern must contain at least one decimal digit",
+			},
+		},
+		{
+			Picture: "0#",
+			Error: &PictureError{
+				Picture: "0#",
+				Reason:  "an optional digit cannot follow a mandatory digit",
+			},
+		},
+		{
+			Picture: "0,,000",
+			Error: &PictureError{
+				Picture: "0,,000",
+				Reason:  "a decimal digit pattern cannot contain adjacent grouping separators",
+			},
+		},
+		{
+			Picture: "0;x",
+			Error: &PictureError{
+				Picture: "0;x",
+				Reason:  `invalid format modifier "x"`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+
+		output, err := FormatInteger(test.Value, test.Picture)
+
+		if output != test.Output {
+			t.Errorf("%d %q: expected %q, got %q", test.Value, test.Picture, test.Output, output)
+		}
+
+		if !reflect.DeepEqual(err, test.Error) {
+			t.Errorf("%d %q: expected error %v, got %v", test.Value, test.Picture, test.Error, err)
+		}
+	}
+}
+
+func TestParseInteger(t *testing.T) {
+
+	tests := []formatIntegerTest{
+		{
+			Value:   1234567,
+			Picture: "#,##0",
+			Output:  "1,234,567",
+		},
+		{
+			Value:   -7,
+			Picture: "000",
+			Output:  "-007",
+		},
+		{
+			Value:   12,
+			Picture: "0;o",
+			Output:  "12th",
+		},
+		{
+			Value:   1999,
+			Picture: "I",
+			Output:  "MCMXCIX",
+		},
+		{
+			Value:   28,
+			Picture: "a",
+			Output:  "ab",
+		},
+		{
+			Value:   1234,
+			Picture: "w",
+			Output:  "one thousand, two hundred and thirty-four",
+		},
+		{
+			Value:   21,
+			Picture: "w;o",
+			Output:  "Twenty-First",
+		},
+		{
+			Value:   2000000000000000,
+			Picture: "w",
+			Output:  "two thousand trillion",
+		},
+	}
+
+	for _, test := range tests {
+
+		n, err := ParseInteger(test.Output, test.Picture)
+		if err != nil {
+			t.Errorf("%q %q: unexpected error %s", test.Output, test.Picture, err)
+		}
+
+		if n != test.Value {
+			t.Errorf("%q %q: expected %d, got %d", test.Output, test.Picture, test.Value, n)
+		}
+	}
+
+	invalid := []formatIntegerTest{
+		{
+			Picture: "0",
+			Output:  "12a",
+		},
+		{
+			Picture: "I",
+			Output:  "IIII",
+		},
+		{
+			Picture: "a",
+			Output:  "a1",
+		},
+		{
+			Picture: "w",
+			Output:  "one hundred and twelvety",
+		},
+	}
+
+	for _, test := range invalid {
+
+		n, err := ParseInteger(test.Output, test.Picture)
+
+		exp := &MatchError{
+			Value:   test.Output,
+			Picture: test.Picture,
+		}
+		if !reflect.DeepEqual(err, exp) {
+			t.Errorf("%q %q: expected error %v, got %d (error %v)", test.Output, test.Picture, exp, n, err)
+		}
+	}
+}
+
+func TestFormatIntegerRoundTrip(t *testing.T) {
+
+	pictures := []string{
+		"0",
+		"000",
+		"#,##0",
+		"0;o",
+		"i",
+		"I",
+		"a",
+		"A",
+		"w",
+		"W",
+		"Ww",
+		"w;o",
+	}
+
+	values := []int{
+		1, 2, 3, 9, 10, 11, 12, 13, 19, 20, 21, 40, 99, 100, 101,
+		110, 999, 1000, 1001, 1010, 1100, 2020, 3999, 12345,
+		100000, 1000000, 1234567, 1000000000, 987654321012,
+	}
+
+	for _, picture := range pictures {
+		for _, value := range values {
+
+			if (picture == "i" || picture == "I") && value > maxRoman {
+				continue
+			}
+
+			s, err := FormatInteger(value, picture)
+			if err != nil {
+				t.Errorf("%d %q: format error: %s", value, picture, err)
+				continue
+			}
+
+			n, err := ParseInteger(s, picture)
+			if err != nil {
+				t.Errorf("%d %q: parse error: %s", value, picture, err)
+				continue
+			}
+
+			if n != value {
+				t.Errorf("%d %q: formatted as %q, parsed as %d", value, picture, s, n)
+			}
+		}
+	}
+}
@@ -42,7 +42,39 @@ func Number(value StringNumberBool) (float64, error) {
 		}
 	}
 
-	return 0, fmt.Errorf("unable to cast %q to a number", s)
+	return 0, newArgValueError("number", 0, "D3030", "unable to cast %q to a number", s)
+}
+
+// NumberToString returns the string representation of a number
+// used by jsonata-js. The number is rounded to 15 significant
+// digits and then formatted like a JavaScript number, i.e. with
+// an exponent only if it is less than 1e-6 or at least 1e21.
+func NumberToString(x float64) string {
+
+	switch {
+	case math.IsNaN(x):
+		return "NaN"
+	case math.IsInf(x, 1):
+		return "Infinity"
+	case math.IsInf(x, -1):
+		return "-Infinity"
+	case x == 0:
+		// JavaScript writes negative zero as "0".
+		return "0"
+	}
+
+	// This is the equivalent of Number(x.toPrecision(15)).
+	x, _ = strconv.ParseFloat(strconv.FormatFloat(x, 'g', 15, 64), 64)
+
+	if abs := math.Abs(x); abs >= 1e-6 && abs < 1e21 {
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	}
+
+	// Go pads exponents to two digits (e.g. "1e-07") but
+	// JavaScript doesn't.
+	s := strconv.FormatFloat(x, 'e', -1, 64)
+	pos := strings.IndexByte(s, 'e') + 2
+	return s[:pos] + strings.TrimLeft(s[pos:], "0")
 }
 
 // Round rounds its input to the number of decimal places given
@@ -93,7 +125,7 @@ func Round(x float64, prec jtypes.OptionalInt) float64 {
 func Power(x, y float64) (float64, error) {
 	res := math.Pow(x, y)
 	if math.IsInf(res, 0) || math.IsNaN(res) {
-		return 0, fmt.Errorf("the power function has resulted in a value that cannot be represented as a JSON number")
+		return 0, newArgValueError("power", 0, "D3061", "the power function has resulted in a value that cannot be represented as a JSON number")
 	}
 	return res, nil
 }
@@ -102,7 +134,7 @@ func Power(x, y float64) (float64, error) {
 // if the number is less than zero.
 func Sqrt(x float64) (float64, error) {
 	if x < 0 {
-		return 0, fmt.Errorf("the sqrt function cannot be applied to a negative number")
+		return 0, newArgValueError("sqrt", 0, "D3060", "the sqrt function cannot be applied to a negative number")
 	}
 	return math.Sqrt(x), nil
 }
@@ -112,6 +144,12 @@ func Random() float64 {
 	return rand.Float64()
 }
 
+// RandomFrom is like Random except that it uses the given
+// random number generator.
+func RandomFrom(r *rand.Rand) float64 {
+	return r.Float64()
+}
+
 // multByPow10 multiplies a number by 10 to the power of n.
 // It does this by converting back and forth to strings to
 // avoid floating point rounding errors, e.g.
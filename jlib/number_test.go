@@ -6,6 +6,7 @@ package jlib_test
 
 import (
 	"fmt"
+	"math"
 	"testing"
 
 	"github.com/blues/jsonata-go/jlib"
@@ -141,3 +142,82 @@ func TestRound(t *testing.T) {
 		}
 	}
 }
+
+func TestNumberToString(t *testing.T) {
+
+	data := []struct {
+		Value  float64
+		Output string
+	}{
+		{
+			Value:  0,
+			Output: "0",
+		},
+		{
+			Value:  math.Copysign(0, -1),
+			Output: "0",
+		},
+		{
+			Value:  100,
+			Output: "100",
+		},
+		{
+			Value:  -2.5,
+			Output: "-2.5",
+		},
+		{
+			// Rounded to 15 significant digits.
+			Value:  22.0 / 7,
+			Output: "3.14285714285714",
+		},
+		{
+			Value:  0.1 + 0.2,
+			Output: "0.3",
+		},
+		{
+			Value:  90.57000000000001,
+			Output: "90.57",
+		},
+		{
+			Value:  1e-6,
+			Output: "0.000001",
+		},
+		{
+			Value:  1.5e-7,
+			Output: "1.5e-7",
+		},
+		{
+			Value:  1e20,
+			Output: "100000000000000000000",
+		},
+		{
+			Value:  1e21,
+			Output: "1e+21",
+		},
+		{
+			Value:  -1.2345e100,
+			Output: "-1.2345e+100",
+		},
+		{
+			Value:  123456789012345678,
+			Output: "123456789012346000",
+		},
+		{
+			Value:  math.Inf(1),
+			Output: "Infinity",
+		},
+		{
+			Value:  math.NaN(),
+			Output: "NaN",
+		},
+	}
+
+	for _, test := range data {
+
+		got := jlib.NumberToString(test.Value)
+
+		if got != test.Output {
+			t.Errorf("NumberToString(%g): Expected %q, got %q", test.Value, test.Output, got)
+		}
+	}
+}
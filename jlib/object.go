@@ -5,8 +5,9 @@
 package jlib
 
 import (
-	"fmt"
+	"math"
 	"reflect"
+	"strconv"
 
 	"github.com/blues/jsonata-go/jtypes"
 )
@@ -28,17 +29,60 @@ func toInterfaceMap(v reflect.Value) (map[string]interface{}, bool) {
 	return nil, false
 }
 
+// KeyString returns the name of a Go map key as a string.
+// String keys are returned unchanged. Numeric and boolean keys
+// are converted with the same rules as $string, so the int key
+// 1 becomes "1" and the bool key true becomes "true". The second
+// return value is false if the key cannot be converted, e.g.
+// because it is a struct or a NaN.
+func KeyString(k reflect.Value) (string, bool) {
+
+	if k.Kind() == reflect.Interface {
+		k = k.Elem()
+	}
+
+	switch k.Kind() {
+	case reflect.String:
+		return k.String(), true
+	case reflect.Bool:
+		return strconv.FormatBool(k.Bool()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), true
+	case reflect.Float32, reflect.Float64:
+		f := k.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return "", false
+		}
+		return NumberToString(f), true
+	default:
+		return "", false
+	}
+}
+
+// keyString is like KeyString except that it returns a
+// KeyTypeError if the key cannot be converted.
+func keyString(name string, k reflect.Value) (string, error) {
+	if s, ok := KeyString(k); ok {
+		return s, nil
+	}
+	return "", newKeyTypeError(name, k)
+}
+
 // Each applies the function fn to each name/value pair in
-// the object obj and returns the results in an array. The
-// order of the items in the array is undefined.
+// the object obj and returns the results in an array. Objects
+// created by JSONata are processed in insertion order. The
+// order for other maps is undefined.
 //
 // obj must be a map or a struct. If it is a struct, any
-// unexported fields are ignored.
+// unexported fields are ignored. If it is a map, its keys are
+// converted to strings with KeyString.
 //
-// fn must be a Callable that takes one, two or three
-// arguments. The first argument is the value of a name/value
-// pair. The second and third arguments, if applicable, are
-// the value and the source object respectively.
+// fn may be any Callable. It is called with up to three
+// arguments: the value of a name/value pair, the name and
+// the source object. Callables that take fewer parameters
+// receive only as many arguments as they take.
 func Each(obj reflect.Value, fn jtypes.Callable) (interface{}, error) {
 
 	var each func(reflect.Value, jtypes.Callable) ([]interface{}, error)
@@ -51,11 +95,7 @@ func Each(obj reflect.Value, fn jtypes.Callable) (interface{}, error) {
 	case jtypes.IsStruct(obj) && !jtypes.IsCallable(obj):
 		each = eachStruct
 	default:
-		return nil, fmt.Errorf("argument must be an object")
-	}
-
-	if argc := fn.ParamCount(); argc < 1 || argc > 3 {
-		return nil, fmt.Errorf("function must take 1, 2 or 3 arguments")
+		return nil, newArgValueError("each", 1, "T0410", "must be an object")
 	}
 
 	results, err := each(obj, fn)
@@ -75,23 +115,28 @@ func Each(obj reflect.Value, fn jtypes.Callable) (interface{}, error) {
 
 func eachMap(v reflect.Value, fn jtypes.Callable) ([]interface{}, error) {
 
-	size := v.Len()
+	size := jtypes.MapLen(v)
 	if size == 0 {
 		return nil, nil
 	}
 
 	var results []interface{}
 
-	argv := make([]reflect.Value, fn.ParamCount())
+	argv := make([]reflect.Value, clamp(fn.ParamCount(), 0, 3))
+
+	for _, k := range jtypes.MapKeys(v) {
 
-	for _, k := range v.MapKeys() {
+		key, err := keyString("each", k)
+		if err != nil {
+			return nil, err
+		}
 
 		for i := range argv {
 			switch i {
 			case 0:
-				argv[i] = v.MapIndex(k)
+				argv[i] = jtypes.MapIndex(v, k)
 			case 1:
-				argv[i] = k
+				argv[i] = reflect.ValueOf(key)
 			case 2:
 				argv[i] = v
 			}
@@ -115,28 +160,28 @@ func eachMap(v reflect.Value, fn jtypes.Callable) ([]interface{}, error) {
 
 func eachStruct(v reflect.Value, fn jtypes.Callable) ([]interface{}, error) {
 
-	size := v.NumField()
+	fields := jtypes.StructFields(v.Type())
+	size := len(fields)
 	if size == 0 {
 		return nil, nil
 	}
 
 	var results []interface{}
 
-	t := v.Type()
-	argv := make([]reflect.Value, fn.ParamCount())
+	argv := make([]reflect.Value, clamp(fn.ParamCount(), 0, 3))
 
-	for i := 0; i < size; i++ {
+	for _, field := range fields {
 
-		field := t.Field(i)
-		if field.PkgPath != "" {
-			// Skip unexported fields.
+		val := field.Value(v)
+		if !val.IsValid() {
+			// Skip fields promoted from nil embedded pointers.
 			continue
 		}
 
 		for j := range argv {
 			switch j {
 			case 0:
-				argv[j] = v.Field(i)
+				argv[j] = val
 			case 1:
 				argv[j] = reflect.ValueOf(field.Name)
 			case 2:
@@ -167,13 +212,13 @@ func eachStruct(v reflect.Value, fn jtypes.Callable) ([]interface{}, error) {
 // must be of type string. If it is a struct, any unexported
 // fields are ignored.
 //
-// fn must be a Callable that takes one, two or three
-// arguments. The first argument is the value of a name/value
-// pair. The second and third arguments, if applicable, are
-// the value and the source object respectively.
+// fn may be any Callable. It is called with up to three
+// arguments: the value of a name/value pair, the name and
+// the source object. Callables that take fewer parameters
+// receive only as many arguments as they take.
 func Sift(obj reflect.Value, fn jtypes.Callable) (interface{}, error) {
 
-	var sift func(reflect.Value, jtypes.Callable) (map[string]interface{}, error)
+	var sift func(reflect.Value, jtypes.Callable) (*jtypes.OrderedMap, error)
 
 	obj = jtypes.Resolve(obj)
 
@@ -183,11 +228,7 @@ func Sift(obj reflect.Value, fn jtypes.Callable) (interface{}, error) {
 	case jtypes.IsStruct(obj) && !jtypes.IsCallable(obj):
 		sift = siftStruct
 	default:
-		return nil, fmt.Errorf("argument must be an object")
-	}
-
-	if argc := fn.ParamCount(); argc < 1 || argc > 3 {
-		return nil, fmt.Errorf("function must take 1, 2 or 3 arguments")
+		return nil, newArgValueError("sift", 1, "T0410", "must be an object")
 	}
 
 	results, err := sift(obj, fn)
@@ -195,32 +236,32 @@ func Sift(obj reflect.Value, fn jtypes.Callable) (interface{}, error) {
 		return nil, err
 	}
 
-	if len(results) == 0 {
+	if results == nil || results.Len() == 0 {
 		return nil, jtypes.ErrUndefined
 	}
 
 	return results, nil
 }
 
-func siftMap(v reflect.Value, fn jtypes.Callable) (map[string]interface{}, error) {
+func siftMap(v reflect.Value, fn jtypes.Callable) (*jtypes.OrderedMap, error) {
 
-	size := v.Len()
+	size := jtypes.MapLen(v)
 	if size == 0 {
 		return nil, nil
 	}
 
-	var results map[string]interface{}
+	var results *jtypes.OrderedMap
 
-	argv := make([]reflect.Value, fn.ParamCount())
+	argv := make([]reflect.Value, clamp(fn.ParamCount(), 0, 3))
 
-	for _, k := range v.MapKeys() {
+	for _, k := range jtypes.MapKeys(v) {
 
-		key, ok := jtypes.AsString(k)
-		if !ok {
-			return nil, fmt.Errorf("object key must evaluate to a string, got %v (%s)", k, k.Kind())
+		key, err := keyString("sift", k)
+		if err != nil {
+			return nil, err
 		}
 
-		val := v.MapIndex(k)
+		val := jtypes.MapIndex(v, k)
 		if !val.IsValid() || !val.CanInterface() {
 			// Skip undefined or non-interfaceable values. We
 			// already know we don't want them in the results,
@@ -233,7 +274,7 @@ func siftMap(v reflect.Value, fn jtypes.Callable) (map[string]interface{}, error
 			case 0:
 				argv[i] = val
 			case 1:
-				argv[i] = k
+				argv[i] = reflect.ValueOf(key)
 			case 2:
 				argv[i] = v
 			}
@@ -246,37 +287,35 @@ func siftMap(v reflect.Value, fn jtypes.Callable) (map[string]interface{}, error
 
 		if Boolean(res) {
 			if results == nil {
-				results = make(map[string]interface{}, size)
+				results = jtypes.NewOrderedMap(size)
 			}
-			results[key] = val.Interface()
+			results.Set(key, val.Interface())
 		}
 	}
 
 	return results, nil
 }
 
-func siftStruct(v reflect.Value, fn jtypes.Callable) (map[string]interface{}, error) {
+func siftStruct(v reflect.Value, fn jtypes.Callable) (*jtypes.OrderedMap, error) {
 
-	size := v.NumField()
+	fields := jtypes.StructFields(v.Type())
+	size := len(fields)
 	if size == 0 {
 		return nil, nil
 	}
 
-	var results map[string]interface{}
+	var results *jtypes.OrderedMap
 
-	t := v.Type()
-	argv := make([]reflect.Value, fn.ParamCount())
+	argv := make([]reflect.Value, clamp(fn.ParamCount(), 0, 3))
 
-	for i := 0; i < size; i++ {
+	for _, field := range fields {
 
-		key := t.Field(i).Name
-		val := v.Field(i)
+		key := field.Name
+		val := field.Value(v)
 		if !val.IsValid() || !val.CanInterface() {
 			// Skip undefined or non-interfaceable values. We
 			// already know we don't want them in the results,
-			// so we can bypass the function call. This also
-			// filters out unexported fields (as they are
-			// non-interfaceable).
+			// so we can bypass the function call.
 			continue
 		}
 
@@ -298,9 +337,9 @@ func siftStruct(v reflect.Value, fn jtypes.Callable) (map[string]interface{}, er
 
 		if Boolean(res) {
 			if results == nil {
-				results = make(map[string]interface{}, size)
+				results = jtypes.NewOrderedMap(size)
 			}
-			results[key] = val.Interface()
+			results.Set(key, val.Interface())
 		}
 	}
 
@@ -308,7 +347,8 @@ func siftStruct(v reflect.Value, fn jtypes.Callable) (map[string]interface{}, er
 }
 
 // Keys returns an array of the names in the object obj.
-// The order of the returned items is undefined.
+// The names of objects created by JSONata are returned in
+// insertion order. The order for other maps is undefined.
 //
 // obj must be a map, a struct or an array. If obj is a map,
 // its keys must be of type string. If obj is a struct, any
@@ -350,10 +390,14 @@ func keys(v reflect.Value) ([]string, error) {
 
 func keysMap(v reflect.Value) ([]string, error) {
 
-	if v.Len() == 0 {
+	if jtypes.MapLen(v) == 0 {
 		return nil, nil
 	}
 
+	if m, ok := jtypes.AsOrderedMap(v); ok {
+		return append([]string(nil), m.Keys()...), nil
+	}
+
 	if m, ok := toInterfaceMap(v); ok {
 		return keysMapFast(m), nil
 	}
@@ -362,9 +406,9 @@ func keysMap(v reflect.Value) ([]string, error) {
 
 	for i, k := range v.MapKeys() {
 
-		key, ok := jtypes.AsString(k)
-		if !ok {
-			return nil, fmt.Errorf("object key must evaluate to a string, got %v (%s)", k, k.Kind())
+		key, err := keyString("keys", k)
+		if err != nil {
+			return nil, err
 		}
 
 		results[i] = key
@@ -385,26 +429,17 @@ func keysMapFast(m map[string]interface{}) []string {
 
 func keysStruct(v reflect.Value) ([]string, error) {
 
-	size := v.NumField()
-	if size == 0 {
+	fields := jtypes.StructFields(v.Type())
+	if len(fields) == 0 {
 		return nil, nil
 	}
 
-	var results []string
-
-	t := v.Type()
-	for i := 0; i < size; i++ {
-
-		field := t.Field(i)
-		if field.PkgPath != "" {
-			// Skip unexported fields.
-			continue
-		}
-
-		if results == nil {
-			results = make([]string, 0, size)
+	results := make([]string, 0, len(fields))
+	for _, field := range fields {
+		// Skip fields promoted from nil embedded pointers.
+		if field.Value(v).IsValid() {
+			results = append(results, field.Name)
 		}
-		results = append(results, field.Name)
 	}
 
 	return results, nil
@@ -454,20 +489,31 @@ func keysArray(v reflect.Value) ([]string, error) {
 // Merge merges an array of objects into a single object that
 // contains all of the name/value pairs from the array objects.
 // If a name appears multiple times, values from objects later
-// in the array override those from earlier.
+// in the array override those from earlier. Names appear in
+// the merged object in the order they were first seen.
 //
 // objs must be an array of maps or structs. Maps must have
 // keys of type string. Unexported struct fields are ignored.
-func Merge(objs reflect.Value) (interface{}, error) {
+//
+// The optional second argument is an object of options. If its
+// "deep" option is true, Merge merges nested objects recursively
+// instead of replacing them. Arrays and other values are still
+// replaced by later values.
+func Merge(objs reflect.Value, options jtypes.OptionalValue) (interface{}, error) {
+
+	deep, err := mergeOptions(options)
+	if err != nil {
+		return nil, err
+	}
 
 	var size int
-	var merge func(map[string]interface{}, reflect.Value) error
+	var merge func(*jtypes.OrderedMap, reflect.Value) error
 
 	objs = jtypes.Resolve(objs)
 
 	switch {
 	case jtypes.IsMap(objs):
-		size = objs.Len()
+		size = jtypes.MapLen(objs)
 		merge = mergeMap
 	case jtypes.IsStruct(objs) && !jtypes.IsCallable(objs):
 		size = objs.NumField()
@@ -477,19 +523,30 @@ func Merge(objs reflect.Value) (interface{}, error) {
 			obj := jtypes.Resolve(objs.Index(i))
 			switch {
 			case jtypes.IsMap(obj):
-				size += obj.Len()
+				size += jtypes.MapLen(obj)
 			case jtypes.IsStruct(obj):
 				size += obj.NumField()
 			default:
-				return nil, fmt.Errorf("argument must be an object or an array of objects")
+				return nil, newArgValueError("merge", 1, "T0410", "must be an object or an array of objects")
 			}
 		}
 		merge = mergeArray
 	default:
-		return nil, fmt.Errorf("argument must be an object or an array of objects")
+		return nil, newArgValueError("merge", 1, "T0410", "must be an object or an array of objects")
+	}
+
+	results := jtypes.NewOrderedMap(size)
+
+	if deep {
+		m := &deepMerger{
+			visiting: map[mergeKey]bool{},
+		}
+		merge = m.mergeObject
+		if jtypes.IsArray(objs) {
+			merge = m.mergeArray
+		}
 	}
 
-	results := make(map[string]interface{}, size)
 	if err := merge(results, objs); err != nil {
 		return nil, err
 	}
@@ -497,59 +554,216 @@ func Merge(objs reflect.Value) (interface{}, error) {
 	return results, nil
 }
 
-func mergeMap(dest map[string]interface{}, src reflect.Value) error {
+func mergeOptions(options jtypes.OptionalValue) (bool, error) {
+
+	if !options.IsSet() {
+		return false, nil
+	}
+
+	opts := jtypes.Resolve(options.Value)
+	if !jtypes.IsMap(opts) {
+		return false, newArgValueError("merge", 2, "T0410", "must be an object")
+	}
+
+	var deep bool
+
+	for _, key := range jtypes.MapKeys(opts) {
+
+		k, ok := jtypes.AsString(key)
+		if !ok || k != "deep" {
+			return false, newArgValueError("merge", 2, "T0410", "must only contain the deep option, not %v", key)
+		}
+
+		deep, ok = jtypes.AsBool(jtypes.MapIndex(opts, key))
+		if !ok {
+			return false, newArgValueError("merge", 2, "T0410", "must have a boolean deep option")
+		}
+	}
+
+	return deep, nil
+}
+
+// A mergeKey identifies an object in the source data for the
+// purpose of detecting cycles.
+type mergeKey struct {
+	ptr uintptr
+	typ reflect.Type
+}
+
+func newMergeKey(v reflect.Value) (mergeKey, bool) {
+	switch {
+	case v.Kind() == reflect.Map:
+		return mergeKey{v.Pointer(), v.Type()}, true
+	case v.CanAddr():
+		return mergeKey{v.Addr().Pointer(), v.Type()}, true
+	default:
+		return mergeKey{}, false
+	}
+}
+
+// A deepMerger merges objects recursively. It keeps track of
+// the objects that it is currently merging so that it does not
+// loop forever on self-referencing data.
+type deepMerger struct {
+	visiting map[mergeKey]bool
+}
+
+func (m *deepMerger) mergeArray(dest *jtypes.OrderedMap, src reflect.Value) error {
+
+	for i := 0; i < src.Len(); i++ {
+
+		item := jtypes.Resolve(src.Index(i))
+		if !isMergeable(item) {
+			continue
+		}
+
+		if err := m.mergeObject(dest, item); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *deepMerger) mergeObject(dest *jtypes.OrderedMap, src reflect.Value) error {
+
+	src = jtypes.Resolve(src)
+
+	if key, ok := newMergeKey(src); ok {
+		m.visiting[key] = true
+		defer delete(m.visiting, key)
+	}
+
+	return eachMergeField(src, func(name string, v reflect.Value) error {
+		return m.set(dest, name, v)
+	})
+}
+
+// set stores a value in dest. If dest already contains an object
+// under the same name and the new value is also an object, the
+// two objects are merged.
+func (m *deepMerger) set(dest *jtypes.OrderedMap, name string, v reflect.Value) error {
+
+	if !v.IsValid() || !v.CanInterface() {
+		return nil
+	}
+
+	existing, ok := dest.Get(name)
+	if !ok || !isMergeable(v) || !isMergeable(reflect.ValueOf(existing)) {
+		dest.Set(name, v.Interface())
+		return nil
+	}
+
+	// If the new value is an object that we're already in the
+	// middle of merging, the data contains a cycle. Replace the
+	// existing value instead of merging again.
+	if key, ok := newMergeKey(jtypes.Resolve(v)); ok && m.visiting[key] {
+		dest.Set(name, v.Interface())
+		return nil
+	}
+
+	merged := jtypes.NewOrderedMap(0)
+
+	err := eachMergeField(jtypes.Resolve(reflect.ValueOf(existing)), func(name string, v reflect.Value) error {
+		if v.IsValid() && v.CanInterface() {
+			merged.Set(name, v.Interface())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := m.mergeObject(merged, v); err != nil {
+		return err
+	}
+
+	dest.Set(name, merged)
+	return nil
+}
+
+func isMergeable(v reflect.Value) bool {
+	v = jtypes.Resolve(v)
+	return jtypes.IsMap(v) || (jtypes.IsStruct(v) && !jtypes.IsCallable(v))
+}
+
+// eachMergeField calls fn for each name/value pair in obj, which
+// must be a map or a struct.
+func eachMergeField(obj reflect.Value, fn func(string, reflect.Value) error) error {
+
+	if jtypes.IsStruct(obj) {
+		for _, field := range jtypes.StructFields(obj.Type()) {
+			val := field.Value(obj)
+			if !val.IsValid() {
+				continue
+			}
+			if err := fn(field.Name, val); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, k := range jtypes.MapKeys(obj) {
+
+		key, err := keyString("merge", k)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(key, jtypes.MapIndex(obj, k)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func mergeMap(dest *jtypes.OrderedMap, src reflect.Value) error {
 
 	if m, ok := toInterfaceMap(src); ok {
 		mergeMapFast(dest, m)
 		return nil
 	}
 
-	for _, k := range src.MapKeys() {
+	for _, k := range jtypes.MapKeys(src) {
 
-		key, ok := jtypes.AsString(k)
-		if !ok {
-			return fmt.Errorf("object key must evaluate to a string, got %v (%s)", k, k.Kind())
+		key, err := keyString("merge", k)
+		if err != nil {
+			return err
 		}
 
-		if val := src.MapIndex(k); val.IsValid() && val.CanInterface() {
-			dest[key] = val.Interface()
+		if val := jtypes.MapIndex(src, k); val.IsValid() && val.CanInterface() {
+			dest.Set(key, val.Interface())
 		}
 	}
 
 	return nil
 }
 
-func mergeMapFast(dest, src map[string]interface{}) {
+func mergeMapFast(dest *jtypes.OrderedMap, src map[string]interface{}) {
 	for k, v := range src {
 		if v != nil {
-			dest[k] = v
+			dest.Set(k, v)
 		}
 	}
 }
 
-func mergeStruct(dest map[string]interface{}, src reflect.Value) error {
-
-	t := src.Type()
-
-	for i := 0; i < src.NumField(); i++ {
+func mergeStruct(dest *jtypes.OrderedMap, src reflect.Value) error {
 
-		field := t.Field(i)
-		if field.PkgPath != "" {
-			// Skip unexported fields.
-			continue
-		}
+	for _, field := range jtypes.StructFields(src.Type()) {
 
-		if val := src.Field(i); val.IsValid() && val.CanInterface() {
-			dest[field.Name] = val.Interface()
+		if val := field.Value(src); val.IsValid() && val.CanInterface() {
+			dest.Set(field.Name, val.Interface())
 		}
 	}
 
 	return nil
 }
 
-func mergeArray(dest map[string]interface{}, src reflect.Value) error {
+func mergeArray(dest *jtypes.OrderedMap, src reflect.Value) error {
 
-	var merge func(map[string]interface{}, reflect.Value) error
+	var merge func(*jtypes.OrderedMap, reflect.Value) error
 
 	for i := 0; i < src.Len(); i++ {
 
@@ -580,25 +794,24 @@ func Spread(v reflect.Value) (interface{}, error) {
 	switch {
 	case jtypes.IsMap(v):
 		v = jtypes.Resolve(v)
-		keys := v.MapKeys()
+		keys := jtypes.MapKeys(v)
 		for _, k := range keys {
-			if k.Kind() != reflect.String {
-				return nil, fmt.Errorf("object key must evaluate to a string, got %v (%s)", k, k.Kind())
+			key, err := keyString("spread", k)
+			if err != nil {
+				return nil, err
 			}
-			if v := v.MapIndex(k); v.CanInterface() {
+			if v := jtypes.MapIndex(v, k); v.CanInterface() {
 				results = append(results, map[string]interface{}{
-					k.String(): v.Interface(),
+					key: v.Interface(),
 				})
 			}
 		}
 	case jtypes.IsStruct(v) && !jtypes.IsCallable(v):
 		v = jtypes.Resolve(v)
-		for i := 0; i < v.NumField(); i++ {
-			k := v.Type().Field(i).Name
-			v := v.FieldByIndex([]int{i})
-			if v.CanInterface() {
+		for _, field := range jtypes.StructFields(v.Type()) {
+			if v := field.Value(v); v.IsValid() && v.CanInterface() {
 				results = append(results, map[string]interface{}{
-					k: v.Interface(),
+					field.Name: v.Interface(),
 				})
 			}
 		}
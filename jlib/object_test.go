@@ -242,19 +242,27 @@ func TestEach(t *testing.T) {
 			// Note that we don't even get as far as validating the
 			// Callable in this case.
 			Input: "hello",
-			Error: fmt.Errorf("argument must be an object"),
+			Error: jlib.NewArgValueError("each", 1, "T0410", "must be an object"),
 		},
 		{
-			// Callable has too few parameters.
-			Input:    map[string]interface{}{},
-			Callable: paramCountCallable(0),
-			Error:    fmt.Errorf("function must take 1, 2 or 3 arguments"),
+			// A Callable with no parameters is called with
+			// no arguments.
+			Input: map[string]interface{}{
+				"a": 1,
+			},
+			Callable: argcCallable(0),
+			Output:   "0",
 		},
 		{
-			// Callable has too many parameters.
-			Input:    struct{}{},
-			Callable: paramCountCallable(4),
-			Error:    fmt.Errorf("function must take 1, 2 or 3 arguments"),
+			// A Callable with more than three parameters is
+			// called with three arguments.
+			Input: struct {
+				A int
+			}{
+				A: 1,
+			},
+			Callable: argcCallable(4),
+			Output:   "3",
 		},
 		{
 			// If the Callable returns an error, return the error.
@@ -298,6 +306,8 @@ type siftTest struct {
 	Error    error
 }
 
+type stringKey string
+
 func TestSift(t *testing.T) {
 
 	// valueIsOdd is a Callable that takes one argument and
@@ -392,6 +402,18 @@ func TestSift(t *testing.T) {
 				"b": "b",
 			},
 		},
+		{
+			// Map keys are passed to the Callable as strings,
+			// even if the underlying key type is not string.
+			Input: map[stringKey]interface{}{
+				"a": 1,
+				"b": "b",
+			},
+			Callable: valuesAreEqual,
+			Output: map[string]interface{}{
+				"b": "b",
+			},
+		},
 		{
 			Input: struct {
 				A int
@@ -438,27 +460,42 @@ func TestSift(t *testing.T) {
 			// Note that we don't even get as far as validating the
 			// Callable in this case.
 			Input: 3.141592,
-			Error: fmt.Errorf("argument must be an object"),
+			Error: jlib.NewArgValueError("sift", 1, "T0410", "must be an object"),
 		},
 		{
 			// Invalid key type.
-			Input: map[bool]string{
-				true: "true",
+			Input: map[struct{ X int }]string{
+				{1}: "one",
 			},
 			Callable: paramCountCallable(1),
-			Error:    fmt.Errorf("object key must evaluate to a string, got true (bool)"),
+			Error: &jlib.KeyTypeError{
+				Func: "sift",
+				Type: "struct { X int }",
+			},
 		},
 		{
-			// Callable has too few parameters.
-			Input:    map[string]interface{}{},
-			Callable: paramCountCallable(0),
-			Error:    fmt.Errorf("function must take 1, 2 or 3 arguments"),
+			// A Callable with no parameters is called with
+			// no arguments.
+			Input: map[string]interface{}{
+				"a": 1,
+			},
+			Callable: argcCallable(0),
+			Output: map[string]interface{}{
+				"a": 1,
+			},
 		},
 		{
-			// Callable has too many parameters.
-			Input:    struct{}{},
-			Callable: paramCountCallable(4),
-			Error:    fmt.Errorf("function must take 1, 2 or 3 arguments"),
+			// A Callable with more than three parameters is
+			// called with three arguments.
+			Input: struct {
+				A int
+			}{
+				A: 1,
+			},
+			Callable: argcCallable(4),
+			Output: map[string]interface{}{
+				"A": 1,
+			},
 		},
 		{
 			// If the Callable returns an error, return the error.
@@ -484,6 +521,7 @@ func testSift(t *testing.T, tests []siftTest) {
 	for i, test := range tests {
 
 		output, err := jlib.Sift(reflect.ValueOf(test.Input), test.Callable)
+		output = jtypes.Plain(output)
 
 		if !reflect.DeepEqual(output, test.Output) {
 			t.Errorf("Test %d: expected %v, got %v", i+1, test.Output, output)
@@ -580,6 +618,21 @@ func TestKeys(t *testing.T) {
 				"C",
 			},
 		},
+		{
+			// Struct fields are named after their json tags.
+			// Fields tagged with "-" are ignored.
+			Input: struct {
+				A int    `json:"a"`
+				B string `json:"b,omitempty"`
+				C bool   `json:",omitempty"`
+				D bool   `json:"-"`
+			}{},
+			Output: []string{
+				"a",
+				"b",
+				"C",
+			},
+		},
 		{
 			Input: []interface{}{
 				map[string]interface{}{
@@ -616,18 +669,47 @@ func TestKeys(t *testing.T) {
 			Error: jtypes.ErrUndefined,
 		},
 		{
-			Input: map[bool]string{
-				true: "true",
+			// Numeric and boolean keys are converted to
+			// strings.
+			Input: []interface{}{
+				map[int]float64{
+					1:  1.5,
+					-2: 2.5,
+				},
+				map[bool]string{
+					false: "false",
+				},
+				map[float64]int{
+					0.1: 1,
+				},
+			},
+			Output: []string{
+				"1",
+				"-2",
+				"false",
+				"0.1",
+			},
+		},
+		{
+			Input: map[struct{ X int }]string{
+				{1}: "one",
+			},
+			Error: &jlib.KeyTypeError{
+				Func: "keys",
+				Type: "struct { X int }",
 			},
-			Error: fmt.Errorf("object key must evaluate to a string, got true (bool)"),
 		},
 		{
 			Input: []interface{}{
-				map[bool]string{
-					false: "false",
+				map[interface{}]string{
+					"a":      "a",
+					[2]int{}: "array",
 				},
 			},
-			Error: fmt.Errorf("object key must evaluate to a string, got false (bool)"),
+			Error: &jlib.KeyTypeError{
+				Func: "keys",
+				Type: "[2]int",
+			},
 		},
 	})
 }
@@ -649,9 +731,10 @@ func testKeys(t *testing.T, tests []keysTest) {
 }
 
 type mergeTest struct {
-	Input  interface{}
-	Output interface{}
-	Error  error
+	Input   interface{}
+	Options interface{}
+	Output  interface{}
+	Error   error
 }
 
 func TestMerge(t *testing.T) {
@@ -773,36 +856,203 @@ func TestMerge(t *testing.T) {
 		},
 		{
 			Input: "this isn't an object",
-			Error: fmt.Errorf("argument must be an object or an array of objects"),
+			Error: jlib.NewArgValueError("merge", 1, "T0410", "must be an object or an array of objects"),
 		},
 		{
 			Input: []interface{}{
 				3.141592,
 			},
-			Error: fmt.Errorf("argument must be an object or an array of objects"),
+			Error: jlib.NewArgValueError("merge", 1, "T0410", "must be an object or an array of objects"),
+		},
+		{
+			Input: []interface{}{
+				map[bool]string{
+					true: "yes",
+				},
+				map[int]float64{
+					1: 1.5,
+				},
+			},
+			Output: map[string]interface{}{
+				"true": "yes",
+				"1":    1.5,
+			},
+		},
+		{
+			Input: map[struct{ X int }]string{
+				{1}: "one",
+			},
+			Error: &jlib.KeyTypeError{
+				Func: "merge",
+				Type: "struct { X int }",
+			},
 		},
+	})
+}
+
+func TestMergeDeep(t *testing.T) {
+
+	type point struct {
+		X, Y int
+	}
+
+	cyclic := map[string]interface{}{
+		"name": "cyclic",
+	}
+	cyclic["self"] = cyclic
+
+	deep := map[string]interface{}{
+		"deep": true,
+	}
+
+	testMerge(t, []mergeTest{
 		{
-			Input: map[bool]string{
-				true: "true",
+			// Without the deep option, nested objects are replaced.
+			Input: []interface{}{
+				map[string]interface{}{
+					"a": map[string]interface{}{
+						"b": 1,
+					},
+				},
+				map[string]interface{}{
+					"a": map[string]interface{}{
+						"c": 2,
+					},
+				},
+			},
+			Options: map[string]interface{}{
+				"deep": false,
+			},
+			Output: map[string]interface{}{
+				"a": map[string]interface{}{
+					"c": 2,
+				},
 			},
-			Error: fmt.Errorf("object key must evaluate to a string, got true (bool)"),
 		},
 		{
 			Input: []interface{}{
-				map[bool]string{
-					false: "false",
+				map[string]interface{}{
+					"a": map[string]interface{}{
+						"b": 1,
+						"d": map[string]interface{}{
+							"e": 3,
+						},
+					},
+					"f": "one",
+				},
+				map[string]interface{}{
+					"a": map[string]interface{}{
+						"c": 2,
+						"d": map[string]interface{}{
+							"g": 4,
+						},
+					},
+					"f": "two",
+				},
+			},
+			Options: deep,
+			Output: map[string]interface{}{
+				"a": map[string]interface{}{
+					"b": 1,
+					"c": 2,
+					"d": map[string]interface{}{
+						"e": 3,
+						"g": 4,
+					},
 				},
+				"f": "two",
 			},
-			Error: fmt.Errorf("object key must evaluate to a string, got false (bool)"),
+		},
+		{
+			// Arrays and scalars are replaced.
+			Input: []interface{}{
+				map[string]interface{}{
+					"a": []interface{}{1, 2},
+					"b": map[string]interface{}{
+						"c": 1,
+					},
+				},
+				map[string]interface{}{
+					"a": []interface{}{3},
+					"b": "replaced",
+				},
+			},
+			Options: deep,
+			Output: map[string]interface{}{
+				"a": []interface{}{3},
+				"b": "replaced",
+			},
+		},
+		{
+			// Structs are merged with maps.
+			Input: []interface{}{
+				map[string]interface{}{
+					"p": map[string]interface{}{
+						"Z": 3,
+					},
+				},
+				map[string]interface{}{
+					"p": point{X: 1, Y: 2},
+				},
+			},
+			Options: deep,
+			Output: map[string]interface{}{
+				"p": map[string]interface{}{
+					"X": 1,
+					"Y": 2,
+					"Z": 3,
+				},
+			},
+		},
+		{
+			Input:   map[string]interface{}{},
+			Options: "deep",
+			Error:   jlib.NewArgValueError("merge", 2, "T0410", "must be an object"),
+		},
+		{
+			Input: map[string]interface{}{},
+			Options: map[string]interface{}{
+				"deep": "yes",
+			},
+			Error: jlib.NewArgValueError("merge", 2, "T0410", "must have a boolean deep option"),
+		},
+		{
+			Input: map[string]interface{}{},
+			Options: map[string]interface{}{
+				"shallow": true,
+			},
+			Error: jlib.NewArgValueError("merge", 2, "T0410", "must only contain the deep option, not shallow"),
 		},
 	})
+
+	// Self-referencing data does not cause an infinite loop.
+	// (The output is not converted with jtypes.Plain, which
+	// does not support cycles.)
+	var options jtypes.OptionalValue
+	options.Set(reflect.ValueOf(reflect.ValueOf(deep)))
+
+	output, err := jlib.Merge(reflect.ValueOf([]interface{}{cyclic, cyclic}), options)
+	if err != nil {
+		t.Fatalf("cyclic: unexpected error %s", err)
+	}
+
+	m := output.(*jtypes.OrderedMap)
+	if self, _ := m.Get("self"); reflect.ValueOf(self).Pointer() != reflect.ValueOf(cyclic).Pointer() {
+		t.Errorf("cyclic: expected self to be the input map, got %v", self)
+	}
 }
 
 func testMerge(t *testing.T, tests []mergeTest) {
 
 	for i, test := range tests {
 
-		output, err := jlib.Merge(reflect.ValueOf(test.Input))
+		var options jtypes.OptionalValue
+		if test.Options != nil {
+			options.Set(reflect.ValueOf(reflect.ValueOf(test.Options)))
+		}
+
+		output, err := jlib.Merge(reflect.ValueOf(test.Input), options)
+		output = jtypes.Plain(output)
 
 		if !reflect.DeepEqual(output, test.Output) {
 			t.Errorf("Test %d: expected %v, got %v", i+1, test.Output, output)
@@ -830,6 +1080,22 @@ func (f paramCountCallable) Call([]reflect.Value) (reflect.Value, error) {
 	return reflect.Value{}, errTest
 }
 
+// argcCallable is a Callable that returns the number of
+// arguments it was called with as a string.
+type argcCallable int
+
+func (f argcCallable) Name() string {
+	return "argcCallable"
+}
+
+func (f argcCallable) ParamCount() int {
+	return int(f)
+}
+
+func (f argcCallable) Call(argv []reflect.Value) (reflect.Value, error) {
+	return reflect.ValueOf(strconv.Itoa(len(argv))), nil
+}
+
 type callable1 func([]reflect.Value) (reflect.Value, error)
 
 func (f callable1) Name() string    { return "callable1" }
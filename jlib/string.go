@@ -6,11 +6,14 @@ package jlib
 
 import (
 	"bytes"
+	cryptorand "crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"math"
-	"net/url"
+	"math/rand"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -41,12 +44,17 @@ func String(value interface{}) (string, error) {
 		if math.IsNaN(v) || math.IsInf(v, 0) {
 			return "", newError("string", ErrNaNInf)
 		}
+		return NumberToString(v), nil
 	}
 
-	// TODO: Round numbers to 13dps to match jsonata-js.
 	b := bytes.Buffer{}
 	e := json.NewEncoder(&b)
-	if err := e.Encode(value); err != nil {
+	v, err := formatFloats(reflect.ValueOf(value))
+	if err != nil {
+		return "", err
+	}
+
+	if err := e.Encode(v); err != nil {
 		return "", err
 	}
 
@@ -54,33 +62,132 @@ func String(value interface{}) (string, error) {
 	return strings.TrimSpace(b.String()), nil
 }
 
+// formatFloats returns a copy of a value in which floating point
+// numbers are replaced by their NumberToString representation,
+// so that they are encoded like jsonata-js numbers. Integers and
+// Decimals are unchanged, as are values inside Go structs. The
+// keys of Go maps are converted to strings with KeyString.
+func formatFloats(v reflect.Value) (interface{}, error) {
+
+	if !v.IsValid() || !v.CanInterface() {
+		return nil, nil
+	}
+
+	if m, ok := jtypes.AsOrderedMap(v); ok {
+		results := jtypes.NewOrderedMap(m.Len())
+		for _, k := range m.Keys() {
+			value, _ := m.Get(k)
+			res, err := formatFloats(reflect.ValueOf(value))
+			if err != nil {
+				return nil, err
+			}
+			results.Set(k, res)
+		}
+		return results, nil
+	}
+
+	switch r := jtypes.Resolve(v); r.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return json.Number(NumberToString(r.Float())), nil
+	case reflect.Slice, reflect.Array:
+		if r.Type().Elem().Kind() == reflect.Uint8 {
+			break
+		}
+		results := make([]interface{}, r.Len())
+		for i := range results {
+			res, err := formatFloats(r.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			results[i] = res
+		}
+		return results, nil
+	case reflect.Map:
+		results := make(map[string]interface{}, r.Len())
+		for _, k := range r.MapKeys() {
+			key, err := keyString("string", k)
+			if err != nil {
+				return nil, err
+			}
+			res, err := formatFloats(r.MapIndex(k))
+			if err != nil {
+				return nil, err
+			}
+			results[key] = res
+		}
+		return results, nil
+	}
+
+	return v.Interface(), nil
+}
+
 // Substring returns the portion of a string starting at the
 // given (zero-indexed) offset. Negative offsets count from the
 // end of the string, e.g. a start position of -1 returns the
 // last character. The optional third argument controls the
 // maximum number of characters returned. By default, Substring
 // returns all characters up to the end of the string.
-func Substring(s string, start int, length jtypes.OptionalInt) string {
+//
+// Substring follows the reference implementation of JSONata
+// for fractional arguments: the end of the substring is
+// computed from the start and length, then both ends are
+// truncated towards zero.
+func Substring(s string, start float64, length jtypes.OptionalFloat64) string {
+	return substring(s, start, length, nextRune)
+}
 
-	if (length.IsSet() && length.Int <= 0) || start >= utf8.RuneCountInString(s) {
-		return ""
+func substring(s string, start float64, length jtypes.OptionalFloat64, next segmenter) string {
+
+	n := countSegments(s, next)
+
+	if float64(n)+start < 0 {
+		start = 0
 	}
 
-	if start < 0 {
-		start += utf8.RuneCountInString(s)
+	end := float64(n)
+	if length.IsSet() {
+		if length.Float64 <= 0 {
+			return ""
+		}
+		if start >= 0 {
+			end = start + length.Float64
+		} else {
+			end = float64(n) + start + length.Float64
+		}
 	}
 
-	if start > 0 {
-		pos := positionOfNthRune(s, start)
-		s = s[pos:]
+	from, to := sliceIndex(start, n), sliceIndex(end, n)
+	if from >= to {
+		return ""
 	}
 
-	if length.IsSet() && length.Int < utf8.RuneCountInString(s) {
-		pos := positionOfNthRune(s, length.Int)
-		s = s[:pos]
+	if to < n {
+		s = s[:positionOfNthSegment(s, to, next)]
 	}
 
-	return s
+	return s[positionOfNthSegment(s, from, next):]
+}
+
+// sliceIndex converts a position in a sequence of n items to
+// an index in the same way as JavaScript's Array.slice:
+// fractions are truncated towards zero, negative positions
+// count from the end of the sequence and the result is
+// clamped to the range [0, n].
+func sliceIndex(pos float64, n int) int {
+
+	switch pos = math.Trunc(pos); {
+	case math.IsNaN(pos):
+		return 0
+	case pos < 0:
+		pos += float64(n)
+		if pos < 0 {
+			return 0
+		}
+	case pos > float64(n):
+		return n
+	}
+
+	return int(pos)
 }
 
 // SubstringBefore returns the portion of a string that precedes
@@ -109,8 +216,12 @@ func SubstringAfter(s, substr string) string {
 // the left. The optional third argument specifies the characters
 // used for padding. The default padding character is a space.
 func Pad(s string, width int, chars jtypes.OptionalString) string {
+	return pad(s, width, chars, nextRune)
+}
+
+func pad(s string, width int, chars jtypes.OptionalString, next segmenter) string {
 
-	padlen := abs(width) - utf8.RuneCountInString(s)
+	padlen := abs(width) - countSegments(s, next)
 	if padlen <= 0 {
 		return s
 	}
@@ -121,8 +232,8 @@ func Pad(s string, width int, chars jtypes.OptionalString) string {
 	}
 
 	padding := strings.Repeat(ch, padlen)
-	if utf8.RuneCountInString(padding) > padlen {
-		pos := positionOfNthRune(padding, padlen)
+	if countSegments(padding, next) > padlen {
+		pos := positionOfNthSegment(padding, padlen, next)
 		padding = padding[:pos]
 	}
 
@@ -156,7 +267,7 @@ func Contains(s string, pattern StringCallable) (bool, error) {
 		}
 		return len(matches) > 0, nil
 	default:
-		return false, fmt.Errorf("function contains takes a string or a regex")
+		return false, newArgValueError("contains", 2, "T0410", "must be a string or a regex")
 	}
 }
 
@@ -171,10 +282,13 @@ func Contains(s string, pattern StringCallable) (bool, error) {
 //
 // The optional third argument specifies the maximum number of
 // substrings to return. By default, Split returns all substrings.
+// An undefined limit is the same as no limit, so a partially
+// applied $split can take its limit from a value that may be
+// undefined. As in jsonata-js, a negative limit is an error.
 func Split(s string, separator StringCallable, limit jtypes.OptionalInt) ([]string, error) {
 
 	if limit.Int < 0 {
-		return nil, fmt.Errorf("third argument of the split function must evaluate to a positive number")
+		return nil, newArgValueError("split", 3, "D3020", "must evaluate to a positive number")
 	}
 
 	var parts []string
@@ -194,7 +308,7 @@ func Split(s string, separator StringCallable, limit jtypes.OptionalInt) ([]stri
 		}
 		parts = append(parts, s[pos:])
 	default:
-		return nil, fmt.Errorf("function split takes a string or a regex")
+		return nil, newArgValueError("split", 2, "T0410", "must be a string or a regex")
 	}
 
 	if limit.IsSet() && limit.Int < len(parts) {
@@ -213,7 +327,7 @@ func Join(values reflect.Value, separator jtypes.OptionalString) (string, error)
 		if s, ok := jtypes.AsString(values); ok {
 			return s, nil
 		}
-		return "", fmt.Errorf("function join takes an array of strings")
+		return "", newArgValueError("join", 1, "T0412", "must be an array of strings")
 	}
 
 	var vs []string
@@ -234,13 +348,17 @@ func Join(values reflect.Value, separator jtypes.OptionalString) (string, error)
 //     match - the substring matched by the regex
 //     index - the starting offset of this match
 //     groups - any captured groups for this match
+//     named - the captured groups keyed by name (only present
+//             if the regex has named groups)
 //
 // The optional third argument specifies the maximum number
 // of matches to return. By default, Match returns all matches.
+// As with Split, an undefined limit is the same as no limit and
+// a negative limit is an error.
 func Match(s string, pattern jtypes.Callable, limit jtypes.OptionalInt) ([]map[string]interface{}, error) {
 
 	if limit.Int < 0 {
-		return nil, fmt.Errorf("third argument of function match must evaluate to a positive number")
+		return nil, newArgValueError("match", 3, "D3040", "must evaluate to a positive number")
 	}
 
 	max := -1
@@ -256,11 +374,7 @@ func Match(s string, pattern jtypes.Callable, limit jtypes.OptionalInt) ([]map[s
 	result := make([]map[string]interface{}, len(matches))
 
 	for i, m := range matches {
-		result[i] = map[string]interface{}{
-			"match":  m.value,
-			"index":  m.indexes[0],
-			"groups": m.groups,
-		}
+		result[i] = m.object()
 	}
 
 	return result, nil
@@ -270,7 +384,9 @@ func Match(s string, pattern jtypes.Callable, limit jtypes.OptionalInt) ([]map[s
 // instances of the given pattern replaced by the value provided.
 // The pattern can be a string or a regular expression. The optional
 // fourth argument specifies the maximum number of replacements
-// to make. By default, all instances of pattern are replaced.
+// to make. By default (or if the limit is undefined), all
+// instances of pattern are replaced. A negative limit is an
+// error.
 //
 // If pattern is a string, the replacement must also be a string.
 // If pattern is a regular expression, the replacement can be a
@@ -279,15 +395,19 @@ func Match(s string, pattern jtypes.Callable, limit jtypes.OptionalInt) ([]map[s
 // When replacing a regular expression with a string, the replacement
 // string can refer to the matched value with $0 and any captured
 // groups with $N, where N is the order of the submatch (e.g. $1
-// is the first submatch).
+// is the first submatch). Named groups can also be referred to
+// with ${name}.
 //
 // When replacing a regular expression with a Callable, the Callable
 // must take a single argument and return a string. The argument is
-// an object of the same form returned by Match.
+// an object of the same form returned by Match, plus the "start",
+// "end" and "next" fields of the regular expression's own match
+// object. The limit, if given, is the maximum number of matches
+// that are passed to the Callable and replaced.
 func Replace(src string, pattern StringCallable, repl StringCallable, limit jtypes.OptionalInt) (string, error) {
 
 	if limit.Int < 0 {
-		return "", fmt.Errorf("fourth argument of function replace must evaluate to a positive number")
+		return "", newArgValueError("replace", 4, "D3011", "must evaluate to a positive number")
 	}
 
 	max := -1
@@ -301,19 +421,19 @@ func Replace(src string, pattern StringCallable, repl StringCallable, limit jtyp
 	case jtypes.Callable:
 		return replaceMatchFunc(src, pattern, repl, max)
 	default:
-		return "", fmt.Errorf("second argument of function replace must be a string or a regex")
+		return "", newArgValueError("replace", 2, "T0410", "must be a string or a regex")
 	}
 }
 
 func replaceString(src string, pattern string, repl StringCallable, limit int) (string, error) {
 
 	if pattern == "" {
-		return "", fmt.Errorf("second argument of function replace can't be an empty string")
+		return "", newArgValueError("replace", 2, "D3010", "can't be an empty string")
 	}
 
 	s, ok := repl.toInterface().(string)
 	if !ok {
-		return "", fmt.Errorf("third argument of function replace must be a string when pattern is a string")
+		return "", newArgValueError("replace", 3, "T0410", "must be a string when pattern is a string")
 	}
 
 	return strings.Replace(src, pattern, s, limit), nil
@@ -332,7 +452,7 @@ func replaceMatchFunc(src string, fn jtypes.Callable, repl StringCallable, limit
 	case jtypes.Callable:
 		f = repl
 	default:
-		return "", fmt.Errorf("third argument of function replace must be a string or a function")
+		return "", newArgValueError("replace", 3, "T0410", "must be a string or a function")
 	}
 
 	matches, err := extractMatches(fn, src, limit)
@@ -383,7 +503,7 @@ func FormatNumber(value float64, picture string, options jtypes.OptionalValue) (
 
 	opts := jtypes.Resolve(options.Value)
 	if !jtypes.IsMap(opts) {
-		return "", fmt.Errorf("decimal format options must be a map")
+		return "", newArgValueError("formatNumber", 3, "T0410", "must be an object")
 	}
 
 	format, err := newDecimalFormat(opts)
@@ -398,16 +518,16 @@ func newDecimalFormat(opts reflect.Value) (jxpath.DecimalFormat, error) {
 
 	format := jxpath.NewDecimalFormat()
 
-	for _, key := range opts.MapKeys() {
+	for _, key := range jtypes.MapKeys(opts) {
 
 		k, ok := jtypes.AsString(key)
 		if !ok {
-			return jxpath.DecimalFormat{}, fmt.Errorf("decimal format options must be a map of strings to strings")
+			return jxpath.DecimalFormat{}, newArgValueError("formatNumber", 3, "T0410", "must be an object with string values")
 		}
 
-		v, ok := jtypes.AsString(opts.MapIndex(key))
+		v, ok := jtypes.AsString(jtypes.MapIndex(opts, key))
 		if !ok {
-			return jxpath.DecimalFormat{}, fmt.Errorf("decimal format options must be a map of strings to strings")
+			return jxpath.DecimalFormat{}, newArgValueError("formatNumber", 3, "T0410", "must be an object with string values")
 		}
 
 		if err := updateDecimalFormat(&format, k, v); err != nil {
@@ -415,9 +535,49 @@ func newDecimalFormat(opts reflect.Value) (jxpath.DecimalFormat, error) {
 		}
 	}
 
+	if err := validateDecimalFormat(format); err != nil {
+		return jxpath.DecimalFormat{}, err
+	}
+
 	return format, nil
 }
 
+// validateDecimalFormat checks that the characters that have a
+// special meaning in a picture string are distinct, as required
+// by the XPath specification. Otherwise pictures like "#.###,00"
+// would be ambiguous.
+func validateDecimalFormat(format jxpath.DecimalFormat) error {
+
+	markers := []struct {
+		Option string
+		Value  string
+	}{
+		{"decimal-separator", string(format.DecimalSeparator)},
+		{"grouping-separator", string(format.GroupSeparator)},
+		{"exponent-separator", string(format.ExponentSeparator)},
+		{"percent", format.Percent},
+		{"per-mille", format.PerMille},
+		{"digit", string(format.OptionalDigit)},
+		{"pattern-separator", string(format.PatternSeparator)},
+	}
+
+	for i, m := range markers {
+
+		if r, w := utf8.DecodeRuneInString(m.Value); w == len(m.Value) &&
+			r >= format.ZeroDigit && r <= format.ZeroDigit+9 {
+			return newArgValueError("formatNumber", 3, "D3080", "has a value %q for option %q that is also a digit", m.Value, m.Option)
+		}
+
+		for _, other := range markers[:i] {
+			if m.Value == other.Value {
+				return newArgValueError("formatNumber", 3, "D3080", "has the same value %q for options %q and %q", m.Value, other.Option, m.Option)
+			}
+		}
+	}
+
+	return nil
+}
+
 func updateDecimalFormat(format *jxpath.DecimalFormat, key string, value string) error {
 
 	switch key {
@@ -432,7 +592,7 @@ func updateDecimalFormat(format *jxpath.DecimalFormat, key string, value string)
 	default:
 		r, w := utf8.DecodeRuneInString(value)
 		if r == utf8.RuneError || w != len(value) {
-			return fmt.Errorf("invalid value %q for option %q", value, key)
+			return newArgValueError("formatNumber", 3, "D3080", "has an invalid value %q for option %q", value, key)
 		}
 		switch key {
 		case "decimal-separator":
@@ -450,7 +610,7 @@ func updateDecimalFormat(format *jxpath.DecimalFormat, key string, value string)
 		case "pattern-separator":
 			format.PatternSeparator = r
 		default:
-			return fmt.Errorf("unknown option %q", key)
+			return newArgValueError("formatNumber", 3, "D3080", "has an unknown option %q", key)
 		}
 	}
 
@@ -468,12 +628,53 @@ func FormatBase(value float64, base jtypes.OptionalFloat64) (string, error) {
 	}
 
 	if radix < 2 || radix > 36 {
-		return "", fmt.Errorf("the second argument to formatBase must be between 2 and 36")
+		return "", newArgValueError("formatBase", 2, "D3100", "must be between 2 and 36")
 	}
 
 	return strconv.FormatInt(int64(Round(value, jtypes.OptionalInt{})), radix), nil
 }
 
+// The range of the int type.
+const (
+	maxInt = int(^uint(0) >> 1)
+	minInt = -maxInt - 1
+)
+
+// FormatInteger converts a number to a string, formatted
+// according to the given picture string. Non-integer values
+// are rounded down to the nearest integer, which must be
+// between -maxInt and maxInt. See the XPath function
+// format-integer for the syntax of the picture.
+func FormatInteger(value float64, picture string) (string, error) {
+
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return "", newError("formatInteger", ErrNaNInf)
+	}
+
+	// float64(minInt) is a power of two, so it is exact. It is
+	// excluded because it cannot be negated. Its negation is
+	// the smallest float that is greater than maxInt.
+	n := math.Floor(value)
+	if n <= float64(minInt) || n >= -float64(minInt) {
+		return "", newArgValueError("formatInteger", 1, "", "must be between %d and %d", -maxInt, maxInt)
+	}
+
+	return jxpath.FormatInteger(int(n), picture)
+}
+
+// ParseInteger converts a string to a number, using the
+// given picture string to interpret it. It is the inverse
+// of FormatInteger.
+func ParseInteger(s string, picture string) (float64, error) {
+
+	n, err := jxpath.ParseInteger(s, picture)
+	if err != nil {
+		return 0, err
+	}
+
+	return float64(n), nil
+}
+
 // Base64Encode returns the base 64 encoding of a string.
 func Base64Encode(s string) (string, error) {
 	return base64.StdEncoding.EncodeToString([]byte(s)), nil
@@ -481,62 +682,113 @@ func Base64Encode(s string) (string, error) {
 
 // Base64Decode returns the string represented by a base 64 string.
 func Base64Decode(s string) (string, error) {
+	return base64Decode("base64decode", base64.StdEncoding, s)
+}
 
-	b, err := base64.StdEncoding.DecodeString(s)
-	if err != nil {
-		return "", err
-	}
+// Base64URLEncode returns the URL-safe base 64 encoding of a
+// string, as defined in RFC 4648. It is not part of JSONata.
+func Base64URLEncode(s string) (string, error) {
+	return base64.URLEncoding.EncodeToString([]byte(s)), nil
+}
 
-	return string(b), nil
+// Base64URLDecode returns the string represented by a URL-safe
+// base 64 string. It is the inverse of Base64URLEncode.
+func Base64URLDecode(s string) (string, error) {
+	return base64Decode("base64urlDecode", base64.URLEncoding, s)
 }
 
-// DecodeURL decodes a Uniform Resource Locator (URL)
-// See https://docs.jsonata.org/string-functions#decodeurl
-// and https://docs.jsonata.org/string-functions#decodeurlcomponent
-func DecodeURL(s string) (string, error) {
-	escaped, err := url.QueryUnescape(s)
+func base64Decode(name string, enc *base64.Encoding, s string) (string, error) {
+
+	b, err := enc.DecodeString(s)
 	if err != nil {
-		return "", err
+		return "", newArgValueError(name, 1, "", "must be a valid base 64 string")
 	}
-	return escaped, nil
+
+	return string(b), nil
 }
 
-// EncodeURL decodes a Uniform Resource Locator (URL)
-// See https://docs.jsonata.org/string-functions#encodeurl
-func EncodeURL(s string) (string, error) {
-	// Go will encode the UTF-8 replacement character to %EF%BF%DB
-	// but jsonata-js expects the operation to fail, so we'll
-	// provide the same behavior
-	if s == "�" {
-		return "", fmt.Errorf("invalid character")
-	}
+// UUID returns a random (version 4) UUID as defined in RFC 4122,
+// e.g. "6ba7b810-9dad-41d1-80b4-00c04fd430c8". It is not part of
+// JSONata.
+func UUID() (string, error) {
 
-	baseURL, err := url.Parse(s)
-	if err != nil {
+	var b [16]byte
+	if _, err := cryptorand.Read(b[:]); err != nil {
 		return "", err
 	}
 
-	baseURL.RawQuery = baseURL.Query().Encode()
-	return baseURL.String(), nil
+	return formatUUID(b), nil
 }
 
-// EncodeURLComponent decodes a component of a Uniform Resource Locator (URL)
-// and https://docs.jsonata.org/string-functions#encodeurlcomponent
-func EncodeURLComponent(s string) (string, error) {
-	// Go will encode the UTF-8 replacement character to %EF%BF%DB
-	// but jsonata-js expects the operation to fail, so we'll
-	// provide the same behavior
-	if s == "�" {
-		return "", fmt.Errorf("invalid character")
-	}
+// UUIDFrom is like UUID except that it uses the given random
+// number generator.
+func UUIDFrom(r *rand.Rand) string {
+
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], r.Uint64())
+	binary.BigEndian.PutUint64(b[8:], r.Uint64())
+
+	return formatUUID(b)
+}
 
-	return url.QueryEscape(s), nil
+// formatUUID sets the version and variant bits of a random
+// UUID and returns it in the standard form.
+func formatUUID(b [16]byte) string {
+
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+
+	var buf [36]byte
+	hex.Encode(buf[0:8], b[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], b[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], b[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], b[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], b[10:])
+
+	return string(buf[:])
 }
 
 type match struct {
 	value   string
 	indexes [2]int
 	groups  []string
+	named   map[string]string
+	next    jtypes.Callable
+}
+
+// object returns the match in the form returned by Match.
+func (m match) object() map[string]interface{} {
+
+	obj := map[string]interface{}{
+		"match":  m.value,
+		"index":  m.indexes[0],
+		"groups": m.groups,
+	}
+
+	if m.named != nil {
+		obj["named"] = m.named
+	}
+
+	return obj
+}
+
+// callbackObject returns the match in the form passed to a
+// replacement function by Replace.
+func (m match) callbackObject() map[string]interface{} {
+
+	obj := m.object()
+	obj["start"] = m.indexes[0]
+	obj["end"] = m.indexes[1]
+
+	if m.next != nil {
+		obj["next"] = m.next
+	}
+
+	return obj
 }
 
 func extractMatches(fn jtypes.Callable, s string, limit int) ([]match, error) {
@@ -570,25 +822,25 @@ func callMatchFunc(fn jtypes.Callable, argv []reflect.Value, matches []match) ([
 
 	res = jtypes.Resolve(res)
 
-	v := res.MapIndex(reflect.ValueOf("match"))
+	v := jtypes.MapIndex(res, reflect.ValueOf("match"))
 	value, ok := jtypes.AsString(v)
 	if !ok {
 		return nil, fmt.Errorf("match function must return an object with a string value named 'match'")
 	}
 
-	v = res.MapIndex(reflect.ValueOf("start"))
+	v = jtypes.MapIndex(res, reflect.ValueOf("start"))
 	start, ok := jtypes.AsNumber(v)
 	if !ok {
 		return nil, fmt.Errorf("match function must return an object with a number value named 'start'")
 	}
 
-	v = res.MapIndex(reflect.ValueOf("end"))
+	v = jtypes.MapIndex(res, reflect.ValueOf("end"))
 	end, ok := jtypes.AsNumber(v)
 	if !ok {
 		return nil, fmt.Errorf("match function must return an object with a number value named 'end'")
 	}
 
-	v = res.MapIndex(reflect.ValueOf("groups"))
+	v = jtypes.MapIndex(res, reflect.ValueOf("groups"))
 	if !jtypes.IsArrayOf(v, jtypes.IsString) {
 		return nil, fmt.Errorf("match function must return an object with a string array value named 'groups'")
 	}
@@ -600,7 +852,25 @@ func callMatchFunc(fn jtypes.Callable, argv []reflect.Value, matches []match) ([
 		groups[i] = s
 	}
 
-	v = res.MapIndex(reflect.ValueOf("next"))
+	var named map[string]string
+
+	v = jtypes.MapIndex(res, reflect.ValueOf("named"))
+	if v.IsValid() {
+		if !jtypes.IsMap(v) {
+			return nil, fmt.Errorf("match function must return an object with an object value named 'named'")
+		}
+
+		named = map[string]string{}
+		for _, key := range jtypes.MapKeys(v) {
+			s, ok := jtypes.AsString(jtypes.MapIndex(v, key))
+			if !ok {
+				return nil, fmt.Errorf("match function must return an object with an object of strings named 'named'")
+			}
+			named[key.String()] = s
+		}
+	}
+
+	v = jtypes.MapIndex(res, reflect.ValueOf("next"))
 	next, ok := jtypes.AsCallable(v)
 	if !ok {
 		return nil, fmt.Errorf("match function must return an object with a Callable value named 'next'")
@@ -613,6 +883,8 @@ func callMatchFunc(fn jtypes.Callable, argv []reflect.Value, matches []match) ([
 			int(end),
 		},
 		groups: groups,
+		named:  named,
+		next:   next,
 	}))
 }
 
@@ -638,6 +910,19 @@ Loop:
 
 		r, _ := utf8.DecodeRuneInString(s)
 
+		if r == '{' {
+			// ${name} represents the named group called name.
+			// If there is no such group, the text is copied
+			// as is.
+			if end := strings.IndexRune(s, '}'); end > 0 {
+				if value, ok := m.named[s[1:end]]; ok {
+					result += value
+					s = s[end+1:]
+					continue
+				}
+			}
+		}
+
 		if r == '$' || r < '0' || r > '9' {
 			result += "$"
 			if r == '$' {
@@ -683,20 +968,14 @@ Loop:
 
 func callReplaceFunc(f jtypes.Callable, m match) (string, error) {
 
-	data := map[string]interface{}{
-		"match":  m.value,
-		"index":  m.indexes[0],
-		"groups": m.groups,
-	}
-
-	v, err := f.Call([]reflect.Value{reflect.ValueOf(data)})
+	v, err := f.Call([]reflect.Value{reflect.ValueOf(m.callbackObject())})
 	if err != nil {
 		return "", err
 	}
 
 	repl, ok := jtypes.AsString(v)
 	if !ok {
-		return "", fmt.Errorf("third argument of function replace must be a function that returns a string")
+		return "", newArgValueError("replace", 3, "D3012", "must be a function that returns a string")
 	}
 
 	return repl, nil
@@ -715,14 +994,38 @@ func runesToNumbers(runes []rune) []int {
 	return nums
 }
 
-func positionOfNthRune(s string, n int) int {
+// A segmenter returns the length in bytes of the first segment
+// (e.g. character) of a non-empty string.
+type segmenter func(s string) int
+
+func nextRune(s string) int {
+	_, size := utf8.DecodeRuneInString(s)
+	return size
+}
+
+// countSegments returns the number of segments in s.
+func countSegments(s string, next segmenter) int {
+
+	n := 0
+	for len(s) > 0 {
+		s = s[next(s):]
+		n++
+	}
+
+	return n
+}
+
+// positionOfNthSegment returns the byte offset of the nth
+// (zero-indexed) segment in s, or -1 if there are not enough
+// segments.
+func positionOfNthSegment(s string, n int, next segmenter) int {
 
-	i := 0
-	for pos := range s {
+	pos := 0
+	for i := 0; pos < len(s); i++ {
 		if i == n {
 			return pos
 		}
-		i++
+		pos += next(s[pos:])
 	}
 
 	return -1
@@ -98,6 +98,15 @@ func TestString(t *testing.T) {
 			},
 			Output: `{"bool":true,"hello":"world","null":null,"one hundred":100,"pi":3.14159265359}`,
 		},
+		{
+			// Floating point numbers are rounded to 15 significant
+			// digits like jsonata-js. Integers are not.
+			Input: map[string]interface{}{
+				"ratio": []interface{}{22.0 / 7, 0.1 + 0.2},
+				"id":    int64(9007199254740993),
+			},
+			Output: `{"id":9007199254740993,"ratio":[3.14285714285714,0.3]}`,
+		},
 		{
 			Input:  replaceCallable(nil),
 			Output: "",
@@ -141,8 +150,8 @@ func TestSubstring(t *testing.T) {
 	src := "😂 emoji"
 
 	data := []struct {
-		Start  int
-		Length jtypes.OptionalInt
+		Start  float64
+		Length jtypes.OptionalFloat64
 		Output string
 	}{
 		{
@@ -166,30 +175,30 @@ func TestSubstring(t *testing.T) {
 		},
 		{
 			Start:  0,
-			Length: jtypes.NewOptionalInt(1),
+			Length: jtypes.NewOptionalFloat64(1),
 			Output: "😂",
 		},
 		{
 			Start:  2,
-			Length: jtypes.NewOptionalInt(3),
+			Length: jtypes.NewOptionalFloat64(3),
 			Output: "emo",
 		},
 		{
 			// Length greater than string length.
 			Start:  2,
-			Length: jtypes.NewOptionalInt(30),
+			Length: jtypes.NewOptionalFloat64(30),
 			Output: "emoji",
 		},
 		{
 			// Zero length.
 			Start:  2,
-			Length: jtypes.NewOptionalInt(0),
+			Length: jtypes.NewOptionalFloat64(0),
 			Output: "",
 		},
 		{
 			// Negative length.
 			Start:  2,
-			Length: jtypes.NewOptionalInt(-5),
+			Length: jtypes.NewOptionalFloat64(-5),
 			Output: "",
 		},
 	}
@@ -200,9 +209,233 @@ func TestSubstring(t *testing.T) {
 
 		if got != test.Output {
 
-			s := fmt.Sprintf("substring(%q, %d", src, test.Start)
+			s := fmt.Sprintf("substring(%q, %g", src, test.Start)
 			if test.Length.IsSet() {
-				s += fmt.Sprintf(", %d", test.Length.Int)
+				s += fmt.Sprintf(", %g", test.Length.Float64)
+			}
+			s += ")"
+
+			t.Errorf("%s: Expected %q, got %q", s, test.Output, got)
+		}
+	}
+}
+
+// TestSubstringReference checks Substring against results
+// from the JavaScript implementation of JSONata.
+func TestSubstringReference(t *testing.T) {
+
+	data := []struct {
+		Input  string
+		Start  float64
+		Length jtypes.OptionalFloat64
+		Output string
+	}{
+		{
+			// Negative start with a length that runs past the end
+			// of the string.
+			Input:  "hello",
+			Start:  -2,
+			Length: jtypes.NewOptionalFloat64(5),
+			Output: "lo",
+		},
+		{
+			Input:  "hello",
+			Start:  -2,
+			Output: "lo",
+		},
+		{
+			// Negative start before the start of the string. The
+			// start is clamped to zero before the length is applied.
+			Input:  "hello",
+			Start:  -7,
+			Length: jtypes.NewOptionalFloat64(3),
+			Output: "hel",
+		},
+		{
+			Input:  "hello",
+			Start:  -7,
+			Output: "hello",
+		},
+		{
+			Input:  "hello",
+			Start:  -5,
+			Length: jtypes.NewOptionalFloat64(2),
+			Output: "he",
+		},
+		{
+			Input:  "hello",
+			Start:  -6,
+			Length: jtypes.NewOptionalFloat64(2),
+			Output: "he",
+		},
+		{
+			Input:  "hello",
+			Start:  5,
+			Output: "",
+		},
+		{
+			Input:  "hello",
+			Start:  5,
+			Length: jtypes.NewOptionalFloat64(1),
+			Output: "",
+		},
+		{
+			Input:  "hello",
+			Start:  4,
+			Length: jtypes.NewOptionalFloat64(10),
+			Output: "o",
+		},
+		{
+			Input:  "hello",
+			Start:  0,
+			Length: jtypes.NewOptionalFloat64(0),
+			Output: "",
+		},
+		{
+			Input:  "hello",
+			Start:  1,
+			Length: jtypes.NewOptionalFloat64(-1),
+			Output: "",
+		},
+		{
+			Input:  "hello",
+			Start:  -1,
+			Length: jtypes.NewOptionalFloat64(3),
+			Output: "o",
+		},
+		{
+			Input:  "hello",
+			Start:  1.5,
+			Output: "ello",
+		},
+		{
+			// The end of the substring is computed before it is
+			// truncated, so a fractional start and length can
+			// add up to an extra character.
+			Input:  "hello",
+			Start:  1.7,
+			Length: jtypes.NewOptionalFloat64(2.6),
+			Output: "ell",
+		},
+		{
+			Input:  "hello",
+			Start:  0.5,
+			Length: jtypes.NewOptionalFloat64(0.5),
+			Output: "h",
+		},
+		{
+			Input:  "hello",
+			Start:  0.4,
+			Length: jtypes.NewOptionalFloat64(0.4),
+			Output: "",
+		},
+		{
+			Input:  "hello",
+			Start:  2,
+			Length: jtypes.NewOptionalFloat64(0.5),
+			Output: "",
+		},
+		{
+			Input:  "hello",
+			Start:  -1.5,
+			Output: "o",
+		},
+		{
+			// -0.5 truncates to zero, which is the start of the
+			// string, not an offset from the end.
+			Input:  "hello",
+			Start:  -0.5,
+			Output: "hello",
+		},
+		{
+			// The end is 5.5, which is clamped to the end of the
+			// string.
+			Input:  "hello",
+			Start:  -0.5,
+			Length: jtypes.NewOptionalFloat64(1),
+			Output: "hello",
+		},
+		{
+			Input:  "hello",
+			Start:  -2.5,
+			Length: jtypes.NewOptionalFloat64(1.5),
+			Output: "l",
+		},
+		{
+			Input:  "hello",
+			Start:  -4.5,
+			Length: jtypes.NewOptionalFloat64(2),
+			Output: "e",
+		},
+		{
+			Input:  "hello",
+			Start:  -5.5,
+			Output: "hello",
+		},
+		{
+			Input:  "hello",
+			Start:  -5.5,
+			Length: jtypes.NewOptionalFloat64(2),
+			Output: "he",
+		},
+		{
+			Input:  "超明體繁",
+			Start:  1,
+			Length: jtypes.NewOptionalFloat64(2),
+			Output: "明體",
+		},
+		{
+			Input:  "超明體繁",
+			Start:  -3,
+			Length: jtypes.NewOptionalFloat64(2),
+			Output: "明體",
+		},
+		{
+			Input:  "超明體繁",
+			Start:  -10,
+			Length: jtypes.NewOptionalFloat64(2),
+			Output: "超明",
+		},
+		{
+			Input:  "超明體繁",
+			Start:  1.5,
+			Length: jtypes.NewOptionalFloat64(1.5),
+			Output: "明體",
+		},
+		{
+			Input:  "😂 emoji",
+			Start:  -6,
+			Length: jtypes.NewOptionalFloat64(2),
+			Output: " e",
+		},
+		{
+			Input:  "😂 emoji",
+			Start:  0,
+			Length: jtypes.NewOptionalFloat64(1.9),
+			Output: "😂",
+		},
+		{
+			Input:  "",
+			Start:  0,
+			Length: jtypes.NewOptionalFloat64(1),
+			Output: "",
+		},
+		{
+			Input:  "",
+			Start:  -1,
+			Output: "",
+		},
+	}
+
+	for _, test := range data {
+
+		got := jlib.Substring(test.Input, test.Start, test.Length)
+
+		if got != test.Output {
+
+			s := fmt.Sprintf("substring(%q, %g", test.Input, test.Start)
+			if test.Length.IsSet() {
+				s += fmt.Sprintf(", %g", test.Length.Float64)
 			}
 			s += ")"
 
@@ -367,6 +600,198 @@ func TestPad(t *testing.T) {
 	}
 }
 
+const (
+	family     = "\U0001F469\u200D\U0001F469\u200D\U0001F467\u200D\U0001F466" // 👩‍👩‍👧‍👦
+	eAcute     = "\u00E9"                                                     // é (composed)
+	eCombining = "e\u0301"                                                    // é (decomposed)
+)
+
+func TestGraphemeLength(t *testing.T) {
+
+	data := []struct {
+		Input     string
+		Graphemes int
+		Runes     int
+	}{
+		{
+			Input:     "",
+			Graphemes: 0,
+			Runes:     0,
+		},
+		{
+			Input:     "hello",
+			Graphemes: 5,
+			Runes:     5,
+		},
+		{
+			Input:     family,
+			Graphemes: 1,
+			Runes:     7,
+		},
+		{
+			Input:     "caf" + eAcute,
+			Graphemes: 4,
+			Runes:     4,
+		},
+		{
+			Input:     "caf" + eCombining,
+			Graphemes: 4,
+			Runes:     5,
+		},
+		{
+			// Multiple combining marks.
+			Input:     "a\u0308\u0301",
+			Graphemes: 1,
+			Runes:     3,
+		},
+		{
+			// Emoji with a skin tone modifier.
+			Input:     "\U0001F44D\U0001F3FD",
+			Graphemes: 1,
+			Runes:     2,
+		},
+		{
+			// Flags are pairs of regional indicators.
+			Input:     "\U0001F1EC\U0001F1E7\U0001F1EB\U0001F1F7\U0001F1EC",
+			Graphemes: 3,
+			Runes:     5,
+		},
+		{
+			Input:     "a\r\nb",
+			Graphemes: 3,
+			Runes:     4,
+		},
+		{
+			// Precomposed and decomposed Hangul syllables.
+			Input:     "\uD55C\u1112\u1161\u11AB",
+			Graphemes: 2,
+			Runes:     4,
+		},
+		{
+			// A ZWJ that doesn't join two pictographs.
+			Input:     "a\u200D\U0001F466",
+			Graphemes: 2,
+			Runes:     3,
+		},
+	}
+
+	for _, test := range data {
+
+		if got := jlib.GraphemeLength(test.Input); got != test.Graphemes {
+			t.Errorf("GraphemeLength(%q): expected %d, got %d", test.Input, test.Graphemes, got)
+		}
+
+		if got := utf8.RuneCountInString(test.Input); got != test.Runes {
+			t.Errorf("RuneCountInString(%q): expected %d, got %d", test.Input, test.Runes, got)
+		}
+	}
+}
+
+func TestSubstringGraphemes(t *testing.T) {
+
+	data := []struct {
+		Input     string
+		Start     float64
+		Length    jtypes.OptionalFloat64
+		Graphemes string
+		Runes     string
+	}{
+		{
+			Input:     family + " family",
+			Start:     0,
+			Length:    jtypes.NewOptionalFloat64(1),
+			Graphemes: family,
+			Runes:     "\U0001F469",
+		},
+		{
+			Input:     family + " family",
+			Start:     2,
+			Graphemes: "family",
+			Runes:     "\U0001F469\u200D\U0001F467\u200D\U0001F466 family",
+		},
+		{
+			Input:     "caf" + eCombining + "s",
+			Start:     3,
+			Length:    jtypes.NewOptionalFloat64(1),
+			Graphemes: eCombining,
+			Runes:     "e",
+		},
+		{
+			Input:     "caf" + eAcute + "s",
+			Start:     3,
+			Length:    jtypes.NewOptionalFloat64(1),
+			Graphemes: eAcute,
+			Runes:     eAcute,
+		},
+		{
+			Input:     "caf" + eCombining,
+			Start:     -1,
+			Graphemes: eCombining,
+			Runes:     "\u0301",
+		},
+		{
+			Input:     "caf" + eCombining,
+			Start:     4,
+			Graphemes: "",
+			Runes:     "\u0301",
+		},
+	}
+
+	for _, test := range data {
+
+		if got := jlib.SubstringGraphemes(test.Input, test.Start, test.Length); got != test.Graphemes {
+			t.Errorf("SubstringGraphemes(%q, %g): expected %q, got %q", test.Input, test.Start, test.Graphemes, got)
+		}
+
+		if got := jlib.Substring(test.Input, test.Start, test.Length); got != test.Runes {
+			t.Errorf("Substring(%q, %g): expected %q, got %q", test.Input, test.Start, test.Runes, got)
+		}
+	}
+}
+
+func TestPadGraphemes(t *testing.T) {
+
+	data := []struct {
+		Input     string
+		Width     int
+		Chars     jtypes.OptionalString
+		Graphemes string
+		Runes     string
+	}{
+		{
+			Input:     "caf" + eCombining,
+			Width:     6,
+			Graphemes: "caf" + eCombining + "  ",
+			Runes:     "caf" + eCombining + " ",
+		},
+		{
+			Input:     family,
+			Width:     -3,
+			Graphemes: "  " + family,
+			Runes:     family,
+		},
+		{
+			// Padding characters are not split.
+			Input:     "ab",
+			Width:     4,
+			Chars:     jtypes.NewOptionalString(eCombining),
+			Graphemes: "ab" + eCombining + eCombining,
+			Runes:     "ab" + eCombining,
+		},
+	}
+
+	for _, test := range data {
+
+		if got := jlib.PadGraphemes(test.Input, test.Width, test.Chars); got != test.Graphemes {
+			t.Errorf("PadGraphemes(%q, %d): expected %q, got %q", test.Input, test.Width, test.Graphemes, got)
+		}
+
+		if got := jlib.Pad(test.Input, test.Width, test.Chars); got != test.Runes {
+			t.Errorf("Pad(%q, %d): expected %q, got %q", test.Input, test.Width, test.Runes, got)
+		}
+	}
+}
+
 func TestTrim(t *testing.T) {
 
 	data := []struct {
@@ -459,7 +884,7 @@ func TestContains(t *testing.T) {
 		{
 			// Invalid pattern.
 			Pattern: 100,
-			Error:   fmt.Errorf("function contains takes a string or a regex"),
+			Error:   jlib.NewArgValueError("contains", 2, "T0410", "must be a string or a regex"),
 		},
 	}
 
@@ -523,7 +948,7 @@ func TestSplit(t *testing.T) {
 		{
 			Separator: "",
 			Limit:     jtypes.NewOptionalInt(-1),
-			Error:     fmt.Errorf("third argument of the split function must evaluate to a positive number"),
+			Error:     jlib.NewArgValueError("split", 3, "D3020", "must evaluate to a positive number"),
 		},
 		{
 			Separator: "muji",
@@ -589,7 +1014,7 @@ func TestSplit(t *testing.T) {
 		{
 			// Invalid separator.
 			Separator: 100,
-			Error:     fmt.Errorf("function split takes a string or a regex"),
+			Error:     jlib.NewArgValueError("split", 2, "T0410", "must be a string or a regex"),
 		},
 	}
 
@@ -660,7 +1085,7 @@ func TestJoin(t *testing.T) {
 				"four",
 				5,
 			},
-			Error: fmt.Errorf("function join takes an array of strings"),
+			Error: jlib.NewArgValueError("join", 1, "T0412", "must be an array of strings"),
 		},
 	}
 
@@ -816,7 +1241,7 @@ func TestMatch(t *testing.T) {
 		{
 			Pattern: abracadabraMatches2(),
 			Limit:   jtypes.NewOptionalInt(-1),
-			Error:   fmt.Errorf("third argument of function match must evaluate to a positive number"),
+			Error:   jlib.NewArgValueError("match", 3, "D3040", "must evaluate to a positive number"),
 		},
 		{
 			Pattern: &matchCallable{
@@ -883,7 +1308,7 @@ func TestReplace(t *testing.T) {
 			Pattern: "a",
 			Repl:    "å",
 			Limit:   jtypes.NewOptionalInt(-1),
-			Error:   fmt.Errorf("fourth argument of function replace must evaluate to a positive number"),
+			Error:   jlib.NewArgValueError("replace", 4, "D3011", "must evaluate to a positive number"),
 		},
 		{
 			Pattern: "a",
@@ -899,13 +1324,13 @@ func TestReplace(t *testing.T) {
 			Pattern: "",
 			Repl:    "å",
 			Limit:   jtypes.NewOptionalInt(0),
-			Error:   fmt.Errorf("second argument of function replace can't be an empty string"),
+			Error:   jlib.NewArgValueError("replace", 2, "D3010", "can't be an empty string"),
 		},
 		{
 			Pattern: "a",
 			Repl:    replaceCallable(nil),
 			Limit:   jtypes.NewOptionalInt(0),
-			Error:   fmt.Errorf("third argument of function replace must be a string when pattern is a string"),
+			Error:   jlib.NewArgValueError("replace", 3, "T0410", "must be a string when pattern is a string"),
 		},
 
 		// Matching function patterns
@@ -932,7 +1357,7 @@ func TestReplace(t *testing.T) {
 			Pattern: abracadabraMatches0(),
 			Repl:    "åå",
 			Limit:   jtypes.NewOptionalInt(-1),
-			Error:   fmt.Errorf("fourth argument of function replace must evaluate to a positive number"),
+			Error:   jlib.NewArgValueError("replace", 4, "D3011", "must evaluate to a positive number"),
 		},
 		{
 			// $0 is replaced by the full matched string.
@@ -1032,6 +1457,19 @@ func TestReplace(t *testing.T) {
 			Limit:  jtypes.NewOptionalInt(0),
 			Output: "abracadabra",
 		},
+		{
+			Pattern: abracadabraMatches1(),
+			Repl: replaceCallable(func(m map[string]interface{}) (interface{}, error) {
+				start, _ := m["start"].(int)
+				end, _ := m["end"].(int)
+				if _, ok := m["next"].(jtypes.Callable); !ok {
+					return "", fmt.Errorf("replaceCallable expected a next function")
+				}
+				return fmt.Sprintf("<%d-%d>", start, end), nil
+			}),
+			Limit:  jtypes.NewOptionalInt(2),
+			Output: "<0-2>r<3-5>adabra",
+		},
 		{
 			Pattern: abracadabraMatches1(),
 			Repl: replaceCallable(func(m map[string]interface{}) (interface{}, error) {
@@ -1062,7 +1500,7 @@ func TestReplace(t *testing.T) {
 			Repl: replaceCallable(func(m map[string]interface{}) (interface{}, error) {
 				return 100, nil
 			}),
-			Error: fmt.Errorf("third argument of function replace must be a function that returns a string"),
+			Error: jlib.NewArgValueError("replace", 3, "D3012", "must be a function that returns a string"),
 		},
 		{
 			Pattern: abracadabraMatches2(),
@@ -1074,7 +1512,7 @@ func TestReplace(t *testing.T) {
 		{
 			Pattern: abracadabraMatches2(),
 			Repl:    100,
-			Error:   fmt.Errorf("third argument of function replace must be a string or a function"),
+			Error:   jlib.NewArgValueError("replace", 3, "T0410", "must be a string or a function"),
 		},
 	}
 
@@ -1106,7 +1544,7 @@ func TestReplace(t *testing.T) {
 func TestReplaceInvalidPattern(t *testing.T) {
 
 	_, got := jlib.Replace("abracadabra", newStringCallable(100), newStringCallable(""), jtypes.OptionalInt{})
-	exp := fmt.Errorf("second argument of function replace must be a string or a regex")
+	exp := jlib.NewArgValueError("replace", 2, "T0410", "must be a string or a regex")
 
 	if !reflect.DeepEqual(exp, got) {
 		t.Errorf("Expected error %v, got %v", exp, got)
@@ -1185,6 +1623,63 @@ func TestFormatNumber(t *testing.T) {
 			},
 			Output: "1ʹ234·57",
 		},
+		{
+			Value:   1234.5,
+			Picture: "#.###,00",
+			// German-style separators.
+			Options: map[string]interface{}{
+				"decimal-separator":  ",",
+				"grouping-separator": ".",
+			},
+			Output: "1.234,50",
+		},
+		{
+			Value:   -1234.5,
+			Picture: "#.###,00",
+			// German-style separators with a custom minus sign.
+			Options: map[string]interface{}{
+				"decimal-separator":  ",",
+				"grouping-separator": ".",
+				"minus-sign":         "−",
+			},
+			Output: "−1.234,50",
+		},
+		{
+			Value:   1234.5,
+			Picture: "#,###,00",
+			// Separators must be distinct.
+			Options: map[string]interface{}{
+				"decimal-separator": ",",
+			},
+			Error: jlib.NewArgValueError("formatNumber", 3, "D3080", `has the same value "," for options "decimal-separator" and "grouping-separator"`),
+		},
+		{
+			Value:   0.5,
+			Picture: "0pc",
+			// Separators must be distinct from the percent symbol.
+			Options: map[string]interface{}{
+				"percent":           "pc",
+				"decimal-separator": "pc",
+			},
+			Error: jlib.NewArgValueError("formatNumber", 3, "D3080", `has an invalid value "pc" for option "decimal-separator"`),
+		},
+		{
+			Value:   0.5,
+			Picture: "0%",
+			Options: map[string]interface{}{
+				"grouping-separator": "%",
+			},
+			Error: jlib.NewArgValueError("formatNumber", 3, "D3080", `has the same value "%" for options "grouping-separator" and "percent"`),
+		},
+		{
+			Value:   1234.5,
+			Picture: "#,##0.00",
+			// Separators cannot be digits.
+			Options: map[string]interface{}{
+				"decimal-separator": "5",
+			},
+			Error: jlib.NewArgValueError("formatNumber", 3, "D3080", `has a value "5" for option "decimal-separator" that is also a digit`),
+		},
 		{
 			Value:   1234.5678,
 			Picture: "00.000E0",
@@ -1289,11 +1784,11 @@ func TestFormatBase(t *testing.T) {
 		},
 		{
 			Base:  jtypes.NewOptionalFloat64(1),
-			Error: fmt.Errorf("the second argument to formatBase must be between 2 and 36"),
+			Error: jlib.NewArgValueError("formatBase", 2, "D3100", "must be between 2 and 36"),
 		},
 		{
 			Base:  jtypes.NewOptionalFloat64(40),
-			Error: fmt.Errorf("the second argument to formatBase must be between 2 and 36"),
+			Error: jlib.NewArgValueError("formatBase", 2, "D3100", "must be between 2 and 36"),
 		},
 	}
 
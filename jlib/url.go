@@ -0,0 +1,209 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jlib
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// The URL functions follow the behaviour of JavaScript's
+// encodeURI, encodeURIComponent, decodeURI and decodeURIComponent.
+// See https://tc39.es/ecma262/#sec-uri-handling-functions
+
+const (
+	// uriMarks are the characters other than letters and
+	// digits that are never escaped.
+	uriMarks = "-_.!~*'()"
+
+	// uriReserved are the characters that delimit the parts
+	// of a URL. EncodeURL and DecodeURL leave them alone.
+	uriReserved = ";/?:@&=+$,#"
+)
+
+// EncodeURL encodes a Uniform Resource Locator (URL) by
+// replacing certain characters with escape sequences. Reserved
+// characters such as "/", "?" and "&" are not escaped.
+// See https://docs.jsonata.org/string-functions#encodeurl
+func EncodeURL(s string) (string, error) {
+	return encodeURI("encodeUrl", s, uriMarks+uriReserved)
+}
+
+// EncodeURLComponent encodes a component of a Uniform Resource
+// Locator (URL) by replacing certain characters with escape
+// sequences. Unlike EncodeURL, it escapes reserved characters.
+// See https://docs.jsonata.org/string-functions#encodeurlcomponent
+func EncodeURLComponent(s string) (string, error) {
+	return encodeURI("encodeUrlComponent", s, uriMarks)
+}
+
+// DecodeURL decodes a Uniform Resource Locator (URL) previously
+// created by EncodeURL. Escape sequences that represent reserved
+// characters are not decoded.
+// See https://docs.jsonata.org/string-functions#decodeurl
+func DecodeURL(s string) (string, error) {
+	return decodeURI("decodeUrl", s, uriReserved)
+}
+
+// DecodeURLComponent decodes a component of a Uniform Resource
+// Locator (URL) previously created by EncodeURLComponent.
+// See https://docs.jsonata.org/string-functions#decodeurlcomponent
+func DecodeURLComponent(s string) (string, error) {
+	return decodeURI("decodeUrlComponent", s, "")
+}
+
+const upperhex = "0123456789ABCDEF"
+
+// encodeURI percent-encodes the UTF-8 bytes of s, except for
+// letters, digits and the characters in keep.
+func encodeURI(name string, s string, keep string) (string, error) {
+
+	// JavaScript fails to encode strings that contain unpaired
+	// surrogates. In Go, these arrive as invalid UTF-8 or as
+	// the Unicode replacement character (which is what the
+	// JSON decoder substitutes for them).
+	if !utf8.ValidString(s) || strings.ContainsRune(s, utf8.RuneError) {
+		return "", newMalformedURLError(name, s)
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		if isAlphaNumeric(c) || strings.IndexByte(keep, c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+
+		b.WriteByte('%')
+		b.WriteByte(upperhex[c>>4])
+		b.WriteByte(upperhex[c&15])
+	}
+
+	return b.String(), nil
+}
+
+// decodeURI replaces the escape sequences in s with the
+// characters they represent. Escape sequences for the ASCII
+// characters in reserved are left as they are.
+func decodeURI(name string, s string, reserved string) (string, error) {
+
+	if strings.IndexByte(s, '%') < 0 {
+		return s, nil
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+
+	for i := 0; i < len(s); {
+
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			i++
+			continue
+		}
+
+		c, ok := unhexByte(s, i)
+		if !ok {
+			return "", newMalformedURLError(name, s)
+		}
+
+		if c < utf8.RuneSelf {
+			if strings.IndexByte(reserved, c) >= 0 {
+				b.WriteString(s[i : i+3])
+			} else {
+				b.WriteByte(c)
+			}
+			i += 3
+			continue
+		}
+
+		// A non-ASCII character is a sequence of two to four
+		// escaped bytes that must form valid UTF-8.
+		n := utf8SequenceLength(c)
+		if n == 0 {
+			return "", newMalformedURLError(name, s)
+		}
+
+		var buf [utf8.UTFMax]byte
+		buf[0] = c
+
+		for k := 1; k < n; k++ {
+			c, ok := unhexByte(s, i+3*k)
+			if !ok {
+				return "", newMalformedURLError(name, s)
+			}
+			buf[k] = c
+		}
+
+		if _, size := utf8.DecodeRune(buf[:n]); size != n {
+			return "", newMalformedURLError(name, s)
+		}
+
+		b.Write(buf[:n])
+		i += 3 * n
+	}
+
+	return b.String(), nil
+}
+
+// unhexByte returns the byte represented by the escape
+// sequence at position i in s. The boolean return value is
+// false if there is no valid escape sequence at i.
+func unhexByte(s string, i int) (byte, bool) {
+
+	if i+2 >= len(s) || s[i] != '%' {
+		return 0, false
+	}
+
+	hi, ok1 := unhex(s[i+1])
+	lo, ok2 := unhex(s[i+2])
+	if !ok1 || !ok2 {
+		return 0, false
+	}
+
+	return hi<<4 | lo, true
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	default:
+		return 0, false
+	}
+}
+
+// utf8SequenceLength returns the number of bytes in a UTF-8
+// sequence that starts with the given byte. It returns zero
+// if the byte cannot start a multi-byte sequence.
+func utf8SequenceLength(c byte) int {
+	switch {
+	case c&0xE0 == 0xC0:
+		return 2
+	case c&0xF0 == 0xE0:
+		return 3
+	case c&0xF8 == 0xF0:
+		return 4
+	default:
+		return 0
+	}
+}
+
+func isAlphaNumeric(c byte) bool {
+	return 'a' <= c && c <= 'z' ||
+		'A' <= c && c <= 'Z' ||
+		'0' <= c && c <= '9'
+}
+
+func newMalformedURLError(name string, s string) *ArgValueError {
+	return newArgValueError(name, 0, "D3140", "malformed URL passed to %s(): %q", name, s)
+}
@@ -0,0 +1,173 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jlib_test
+
+import (
+	"testing"
+
+	"github.com/blues/jsonata-go/jlib"
+)
+
+type urlTest struct {
+	Input  string
+	Output string
+	Error  bool
+}
+
+func testURLFunc(t *testing.T, name string, fn func(string) (string, error), tests []urlTest) {
+
+	for _, test := range tests {
+
+		output, err := fn(test.Input)
+
+		if test.Error {
+			if err == nil {
+				t.Errorf("%s(%q): expected an error, got %q", name, test.Input, output)
+				continue
+			}
+			if e, ok := err.(*jlib.ArgValueError); !ok || e.Code() != "D3140" {
+				t.Errorf("%s(%q): expected error D3140, got %v", name, test.Input, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s(%q): unexpected error: %s", name, test.Input, err)
+		}
+
+		if output != test.Output {
+			t.Errorf("%s(%q): expected %q, got %q", name, test.Input, test.Output, output)
+		}
+	}
+}
+
+func TestEncodeURL(t *testing.T) {
+	testURLFunc(t, "EncodeURL", jlib.EncodeURL, []urlTest{
+		{
+			Input:  "https://example.com/a path/?q=x y&z=1#frag",
+			Output: "https://example.com/a%20path/?q=x%20y&z=1#frag",
+		},
+		{
+			Input:  "-_.!~*'();/?:@&=+$,#",
+			Output: "-_.!~*'();/?:@&=+$,#",
+		},
+		{
+			Input:  "100% [ok] \"quoted\"",
+			Output: "100%25%20%5Bok%5D%20%22quoted%22",
+		},
+		{
+			Input:  "https://mozilla.org/?x=шеллы",
+			Output: "https://mozilla.org/?x=%D1%88%D0%B5%D0%BB%D0%BB%D1%8B",
+		},
+		{
+			Input: "�",
+			Error: true,
+		},
+		{
+			Input: "\xff",
+			Error: true,
+		},
+	})
+}
+
+func TestEncodeURLComponent(t *testing.T) {
+	testURLFunc(t, "EncodeURLComponent", jlib.EncodeURLComponent, []urlTest{
+		{
+			Input:  "?x=шеллы",
+			Output: "%3Fx%3D%D1%88%D0%B5%D0%BB%D0%BB%D1%8B",
+		},
+		{
+			Input:  "-_.!~*'();/?:@&=+$,#",
+			Output: "-_.!~*'()%3B%2F%3F%3A%40%26%3D%2B%24%2C%23",
+		},
+		{
+			Input:  "a b+c",
+			Output: "a%20b%2Bc",
+		},
+		{
+			Input:  "\U0001F600",
+			Output: "%F0%9F%98%80",
+		},
+		{
+			Input: "�",
+			Error: true,
+		},
+	})
+}
+
+func TestDecodeURL(t *testing.T) {
+	testURLFunc(t, "DecodeURL", jlib.DecodeURL, []urlTest{
+		{
+			Input:  "https://mozilla.org/?x=%D1%88%D0%B5%D0%BB%D0%BB%D1%8B",
+			Output: "https://mozilla.org/?x=шеллы",
+		},
+		{
+			// Reserved characters stay escaped.
+			Input:  "%3Fx%3D%20%2b%23",
+			Output: "%3Fx%3D %2b%23",
+		},
+		{
+			// Plus signs are not spaces.
+			Input:  "a+b",
+			Output: "a+b",
+		},
+		{
+			Input: "%E0%A4%A",
+			Error: true,
+		},
+		{
+			Input: "%",
+			Error: true,
+		},
+	})
+}
+
+func TestDecodeURLComponent(t *testing.T) {
+	testURLFunc(t, "DecodeURLComponent", jlib.DecodeURLComponent, []urlTest{
+		{
+			Input:  "%3Fx%3D%D1%88%D0%B5%D0%BB%D0%BB%D1%8B",
+			Output: "?x=шеллы",
+		},
+		{
+			Input:  "%3b%2F%3F%3A%40%26%3D%2B%24%2C%23",
+			Output: ";/?:@&=+$,#",
+		},
+		{
+			Input:  "%F0%9F%98%80 %EF%BF%BD",
+			Output: "\U0001F600 �",
+		},
+		{
+			Input:  "a+b",
+			Output: "a+b",
+		},
+		{
+			Input: "%E0%A4%A",
+			Error: true,
+		},
+		{
+			Input: "%zz",
+			Error: true,
+		},
+		{
+			// A continuation byte can't start a sequence.
+			Input: "%80",
+			Error: true,
+		},
+		{
+			// Encoded surrogates are not valid UTF-8.
+			Input: "%ED%A0%80",
+			Error: true,
+		},
+		{
+			// Overlong encoding of "/".
+			Input: "%C0%AF",
+			Error: true,
+		},
+		{
+			Input: "%C3%28",
+			Error: true,
+		},
+	})
+}
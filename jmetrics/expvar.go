@@ -0,0 +1,153 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Package jmetrics provides an implementation of jsonata.Metrics
+// that publishes evaluation statistics with the expvar package.
+package jmetrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jsonata "github.com/blues/jsonata-go"
+)
+
+// durationBounds are the upper bounds of the buckets in the
+// duration histogram. Evaluations that take longer than the
+// last bound are counted in a final, unbounded bucket.
+var durationBounds = [...]time.Duration{
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// Expvar is a jsonata.Metrics that publishes statistics for
+// each expression as an expvar variable. The statistics are
+// keyed by expression fingerprint (see jsonata.Expr.Fingerprint)
+// and have the following fields:
+//
+//	evals - the number of evaluations
+//	errors - the number of evaluations that returned an error
+//	         other than jsonata.ErrUndefined
+//	undefined - the number of evaluations that returned
+//	            jsonata.ErrUndefined
+//	in_flight - the number of evaluations in progress
+//	peak_size - the largest result size reported to OnEvalEnd
+//	durations - a histogram of evaluation times, keyed by the
+//	            upper bound of each bucket
+//
+// An Expvar is safe for concurrent use.
+type Expvar struct {
+	vars  *expvar.Map
+	stats sync.Map // fingerprint -> *exprStats
+}
+
+var _ jsonata.Metrics = (*Expvar)(nil)
+
+// NewExpvar returns an Expvar that publishes its statistics
+// under the given name. Like expvar.NewMap, it panics if the
+// name is already in use.
+func NewExpvar(name string) *Expvar {
+	return &Expvar{
+		vars: expvar.NewMap(name),
+	}
+}
+
+// OnEvalStart implements jsonata.Metrics.
+func (x *Expvar) OnEvalStart(fingerprint string) {
+	atomic.AddInt64(&x.statsFor(fingerprint).inFlight, 1)
+}
+
+// OnEvalEnd implements jsonata.Metrics.
+func (x *Expvar) OnEvalEnd(fingerprint string, d time.Duration, err error, size int) {
+
+	s := x.statsFor(fingerprint)
+
+	atomic.AddInt64(&s.inFlight, -1)
+	atomic.AddInt64(&s.evals, 1)
+
+	switch err {
+	case nil:
+	case jsonata.ErrUndefined:
+		atomic.AddInt64(&s.undefined, 1)
+	default:
+		atomic.AddInt64(&s.errors, 1)
+	}
+
+	for {
+		peak := atomic.LoadInt64(&s.peakSize)
+		if int64(size) <= peak || atomic.CompareAndSwapInt64(&s.peakSize, peak, int64(size)) {
+			break
+		}
+	}
+
+	i := 0
+	for i < len(durationBounds) && d > durationBounds[i] {
+		i++
+	}
+	atomic.AddInt64(&s.durations[i], 1)
+}
+
+// statsFor returns the statistics for the given fingerprint,
+// creating and publishing them if necessary.
+func (x *Expvar) statsFor(fingerprint string) *exprStats {
+
+	if s, ok := x.stats.Load(fingerprint); ok {
+		return s.(*exprStats)
+	}
+
+	s, loaded := x.stats.LoadOrStore(fingerprint, &exprStats{})
+	if !loaded {
+		x.vars.Set(fingerprint, s.(*exprStats))
+	}
+
+	return s.(*exprStats)
+}
+
+// exprStats holds the statistics for one expression. It
+// implements expvar.Var.
+type exprStats struct {
+	evals     int64
+	errors    int64
+	undefined int64
+	inFlight  int64
+	peakSize  int64
+	durations [len(durationBounds) + 1]int64
+}
+
+// String returns the statistics as a JSON object.
+func (s *exprStats) String() string {
+
+	durations := make(map[string]int64, len(s.durations))
+	for i := range s.durations {
+		key := "+Inf"
+		if i < len(durationBounds) {
+			key = durationBounds[i].String()
+		}
+		durations[key] = atomic.LoadInt64(&s.durations[i])
+	}
+
+	b, _ := json.Marshal(struct {
+		Evals     int64            `json:"evals"`
+		Errors    int64            `json:"errors"`
+		Undefined int64            `json:"undefined"`
+		InFlight  int64            `json:"in_flight"`
+		PeakSize  int64            `json:"peak_size"`
+		Durations map[string]int64 `json:"durations"`
+	}{
+		Evals:     atomic.LoadInt64(&s.evals),
+		Errors:    atomic.LoadInt64(&s.errors),
+		Undefined: atomic.LoadInt64(&s.undefined),
+		InFlight:  atomic.LoadInt64(&s.inFlight),
+		PeakSize:  atomic.LoadInt64(&s.peakSize),
+		Durations: durations,
+	})
+
+	return string(b)
+}
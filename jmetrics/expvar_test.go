@@ -0,0 +1,63 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jmetrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+
+	jsonata "github.com/blues/jsonata-go"
+)
+
+func TestExpvar(t *testing.T) {
+
+	m := NewExpvar("jmetrics_test")
+
+	e := jsonata.MustCompile(`$number(a)`)
+	e.SetMetrics(m)
+
+	inputs := []interface{}{
+		map[string]interface{}{"a": "1"},
+		map[string]interface{}{"a": "2"},
+		map[string]interface{}{"a": "x"},
+		nil,
+	}
+
+	for _, input := range inputs {
+		e.Eval(input)
+	}
+
+	v := expvar.Get("jmetrics_test").(*expvar.Map).Get(e.Fingerprint())
+	if v == nil {
+		t.Fatalf("expected statistics for %s", e.Fingerprint())
+	}
+
+	var stats struct {
+		Evals     int64            `json:"evals"`
+		Errors    int64            `json:"errors"`
+		Undefined int64            `json:"undefined"`
+		InFlight  int64            `json:"in_flight"`
+		PeakSize  int64            `json:"peak_size"`
+		Durations map[string]int64 `json:"durations"`
+	}
+
+	if err := json.Unmarshal([]byte(v.String()), &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Evals != 4 || stats.Errors != 1 || stats.Undefined != 1 || stats.InFlight != 0 || stats.PeakSize != 1 {
+		t.Errorf("unexpected statistics: %s", v)
+	}
+
+	var total int64
+	for _, n := range stats.Durations {
+		total += n
+	}
+
+	if len(stats.Durations) != len(durationBounds)+1 || total != stats.Evals {
+		t.Errorf("unexpected durations: %v", stats.Durations)
+	}
+}
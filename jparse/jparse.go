@@ -4,6 +4,12 @@
 
 package jparse
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
 // The JSONata parser is based on Pratt's Top Down Operator
 // Precededence algorithm (see https://tdop.github.io/). Given
 // a series of tokens representing a JSONata expression and the
@@ -52,6 +58,7 @@ var nuds = [...]nud{
 	typeMinus:       parseNegation,
 	typeDescendent:  parseDescendent,
 	typePipe:        parseObjectTransformation,
+	typeMod:         parseParent,
 	typeIn:          parseName,
 	typeAnd:         parseName,
 	typeOr:          parseName,
@@ -62,8 +69,11 @@ var nuds = [...]nud{
 var leds = [...]led{
 	typeParenOpen:    parseFunctionCall,
 	typeBracketOpen:  parsePredicate,
+	typePosition:     parsePositionalBinding,
+	typeContextBind:  parseContextBinding,
 	typeBraceOpen:    parseGroup,
 	typeCondition:    parseConditional,
+	typeCoalesce:     parseCoalesce,
 	typeAssign:       parseAssignment,
 	typeApply:        parseFunctionApplication,
 	typeConcat:       parseStringConcatenation,
@@ -98,6 +108,8 @@ var bps = initBindingPowers([][]tokenType{
 	{
 		typeParenOpen,
 		typeBracketOpen,
+		typePosition,
+		typeContextBind,
 	},
 	{
 		typeDot,
@@ -134,6 +146,7 @@ var bps = initBindingPowers([][]tokenType{
 	},
 	{
 		typeCondition,
+		typeCoalesce,
 	},
 	{
 		typeAssign,
@@ -170,6 +183,23 @@ func lookupBp(tt tokenType) int {
 // and returns the root node. If the provided expression is not
 // valid, Parse returns an error of type Error.
 func Parse(expr string) (root Node, err error) {
+	return ParseWithOperators(expr, nil)
+}
+
+// ParseWithOperators is like Parse except that it also
+// recognises custom infix operators. The ops argument maps
+// the symbol of each operator to its binding power. Custom
+// operators are represented in the syntax tree by nodes of
+// type CustomOperatorNode. If one of the operators is not
+// valid, ParseWithOperators returns the error from
+// CheckOperator.
+func ParseWithOperators(expr string, ops map[string]int) (root Node, err error) {
+
+	for symbol, bp := range ops {
+		if err := CheckOperator(symbol, bp); err != nil {
+			return nil, err
+		}
+	}
 
 	// Handle panics from parseExpression.
 	defer func() {
@@ -182,19 +212,34 @@ func Parse(expr string) (root Node, err error) {
 		}
 	}()
 
-	p := newParser(expr)
+	p := newParser(expr, ops)
 	node := p.parseExpression(0)
 
 	if p.token.Type != typeEOF {
 		return nil, newError(ErrSyntaxError, p.token)
 	}
 
-	return node.optimize()
+	node, err = node.optimize()
+	if err != nil {
+		return nil, err
+	}
+
+	markTuplePaths(node)
+	return node, nil
 }
 
 type parser struct {
 	lexer lexer
 	token token
+	// start is the byte offset of the current token, including
+	// any opening quote or delimiter. end is the byte offset
+	// just after the previous token. They are used to record
+	// the span of each node.
+	start int
+	end   int
+	// ops maps the symbols of custom operators to their
+	// binding powers.
+	ops map[string]int
 	// The following function pointers are a workaround
 	// for an initialisation loop compile error. See the
 	// comment in newParser.
@@ -203,10 +248,11 @@ type parser struct {
 	lookupBp  func(tokenType) int
 }
 
-func newParser(input string) parser {
+func newParser(input string, ops map[string]int) parser {
 
 	p := parser{
 		lexer: newLexer(input),
+		ops:   ops,
 
 		// Because the nuds/leds arrays refer to functions that
 		// call the parser methods, the parser methods cannot
@@ -227,6 +273,15 @@ func newParser(input string) parser {
 		lookupBp:  lookupBp,
 	}
 
+	for symbol := range ops {
+		p.lexer.operators = append(p.lexer.operators, symbol)
+	}
+
+	// Match longer symbols first, e.g. ~~> before ~~.
+	sort.Slice(p.lexer.operators, func(i, j int) bool {
+		return len(p.lexer.operators[i]) > len(p.lexer.operators[j])
+	})
+
 	// Set current token to the first token in the expression.
 	p.advance(true)
 	return p
@@ -248,6 +303,7 @@ func (p *parser) parseExpression(rbp int) Node {
 		panic(newError(ErrUnexpectedEOF, p.token))
 	}
 
+	start := p.start
 	t := p.token
 	p.advance(false)
 
@@ -261,12 +317,20 @@ func (p *parser) parseExpression(rbp int) Node {
 		panic(err)
 	}
 
-	for rbp < p.lookupBp(p.token.Type) {
+	// Every node built here, including the infix operations
+	// below, starts at the first token of the expression and
+	// ends at the last token consumed so far.
+	lhs.setSpan(Span{start, p.end})
+
+	for rbp < p.bp(p.token) {
 
 		t := p.token
 		p.advance(true)
 
 		led := p.lookupLed(t.Type)
+		if t.Type == typeOperator {
+			led = parseCustomOperator
+		}
 		if led == nil {
 			panic(newError(ErrInfix, t))
 		}
@@ -275,6 +339,8 @@ func (p *parser) parseExpression(rbp int) Node {
 		if err != nil {
 			panic(err)
 		}
+
+		lhs.setSpan(Span{start, p.end})
 	}
 
 	return lhs
@@ -284,6 +350,9 @@ func (p *parser) parseExpression(rbp int) Node {
 // the parser's current token pointer. It panics if the lexer
 // returns an error token.
 func (p *parser) advance(allowRegex bool) {
+	p.end = p.lexer.current
+	p.lexer.skipWhitespace()
+	p.start = p.lexer.current
 	p.token = p.lexer.next(allowRegex)
 	if p.token.Type == typeError {
 		panic(p.lexer.err)
@@ -308,9 +377,70 @@ func (p *parser) consume(expected tokenType, allowRegex bool) {
 	p.advance(allowRegex)
 }
 
-// bp returns the binding power for the given token type.
-func (p *parser) bp(t tokenType) int {
-	return p.lookupBp(t)
+// bp returns the binding power for the given token. Custom
+// operators are not in the bps table because their binding
+// powers are set by the caller.
+func (p *parser) bp(t token) int {
+	if t.Type == typeOperator {
+		return p.ops[t.Value]
+	}
+	return p.lookupBp(t.Type)
+}
+
+// Custom operators cannot bind more loosely than the 'or'
+// operator or more tightly than the '*' operator. See
+// CheckOperator.
+const (
+	minOperatorBp = 30
+	maxOperatorBp = 70
+)
+
+// CheckOperator returns an error if symbol and bp cannot be
+// used to define a custom operator.
+//
+// A symbol is made up of the characters
+//
+//	! # % & * + - / < = > ? @ ^ | ~
+//
+// and must start with ! or ~. All of the other characters are
+// operators in their own right, so a symbol that started with
+// one of them could change the meaning of existing expressions.
+// For the same reason, a symbol cannot start with the built-in
+// operators != and ~>.
+//
+// The binding power sets the precedence of the operator. The
+// built-in operators have the following binding powers:
+//
+//	70  * / %
+//	60  + - &
+//	50  = != < <= > >= in ~>
+//	40  and
+//	30  or
+//
+// A custom operator must have a binding power from 30 to 70.
+// Operators with equal binding powers are left associative.
+func CheckOperator(symbol string, bp int) error {
+
+	switch {
+	case symbol == "":
+		return fmt.Errorf("operator symbol cannot be empty")
+	case symbol[0] != '!' && symbol[0] != '~':
+		return fmt.Errorf("operator %q must start with ! or ~", symbol)
+	case strings.HasPrefix(symbol, "!=") || strings.HasPrefix(symbol, "~>") || len(symbol) == 1:
+		return fmt.Errorf("operator %q conflicts with a built-in operator", symbol)
+	}
+
+	for _, r := range symbol {
+		if !strings.ContainsRune("!#%&*+-/<=>?@^|~", r) {
+			return fmt.Errorf("operator %q contains invalid character %q", symbol, r)
+		}
+	}
+
+	if bp < minOperatorBp || bp > maxOperatorBp {
+		return fmt.Errorf("operator %q has binding power %d, must be from %d to %d", symbol, bp, minOperatorBp, maxOperatorBp)
+	}
+
+	return nil
 }
 
 // initBindingPowers calculates binding power values for the
@@ -228,6 +228,80 @@ func TestNumberNode(t *testing.T) {
 				Token:    "1e1000",
 			},
 		},
+		{
+			Inputs: []string{
+				"0xff",
+				"0XFF",
+				"0o377",
+				"0b11111111",
+			},
+			Output: &jparse.NumberNode{
+				Value: 255,
+			},
+		},
+		{
+			// Integers that cannot be represented exactly
+			// are rounded, as in jsonata-js.
+			Input: "0x20000000000001",
+			Output: &jparse.NumberNode{
+				Value: 1 << 53,
+			},
+		},
+		{
+			Input: "-0x",
+			Error: &jparse.Error{
+				Type:     jparse.ErrInvalidNumber,
+				Position: 1,
+				Token:    "0x",
+				Hint:     "expected hexadecimal digits after 0x",
+			},
+		},
+		{
+			Input: "0b102",
+			Error: &jparse.Error{
+				Type:     jparse.ErrInvalidNumber,
+				Position: 0,
+				Token:    "0b102",
+				Hint:     "'2' is not a valid binary digit",
+			},
+		},
+		{
+			Input: "1 + 0o78",
+			Error: &jparse.Error{
+				Type:     jparse.ErrInvalidNumber,
+				Position: 4,
+				Token:    "0o78",
+				Hint:     "'8' is not a valid octal digit",
+			},
+		},
+		{
+			Input: "0x" + strings.Repeat("f", 256),
+			Error: &jparse.Error{
+				Type:     jparse.ErrNumberRange,
+				Position: 0,
+				Token:    "0x" + strings.Repeat("f", 256),
+			},
+		},
+		{
+			// Numeric separators are not supported by
+			// jsonata-js.
+			Input: "1_000",
+			Error: &jparse.Error{
+				Type:     jparse.ErrInvalidNumber,
+				Position: 0,
+				Token:    "1_000",
+				Hint:     "numeric separators (_) are not supported",
+			},
+		},
+		{
+			Input: "2 * 1.5e1_0",
+			Error: &jparse.Error{
+				Type:     jparse.ErrInvalidNumber,
+				Position: 4,
+				Token:    "1.5e1_0",
+				Hint:     "numeric separators (_) are not supported",
+			},
+		},
 	})
 }
 
@@ -539,6 +613,297 @@ func TestDescendentNode(t *testing.T) {
 	})
 }
 
+func TestParentNode(t *testing.T) {
+	testParser(t, []testCase{
+		{
+			Input:  "%",
+			Output: &jparse.ParentNode{},
+		},
+		{
+			Input: "%.OrderID",
+			Output: &jparse.PathNode{
+				Steps: []jparse.Node{
+					&jparse.ParentNode{},
+					&jparse.NameNode{
+						Value: "OrderID",
+					},
+				},
+				Tuples: true,
+			},
+		},
+		{
+			Input: "Product.%.%",
+			Output: &jparse.PathNode{
+				Steps: []jparse.Node{
+					&jparse.NameNode{
+						Value: "Product",
+					},
+					&jparse.ParentNode{},
+					&jparse.ParentNode{},
+				},
+				Tuples: true,
+			},
+		},
+		{
+			// Paths are marked if they contain a parent
+			// operator at any depth.
+			Input: "Order.Product.{ Name: %.OrderID }",
+			Output: &jparse.PathNode{
+				Steps: []jparse.Node{
+					&jparse.NameNode{
+						Value: "Order",
+					},
+					&jparse.NameNode{
+						Value: "Product",
+					},
+					&jparse.ObjectNode{
+						Pairs: [][2]jparse.Node{
+							{
+								&jparse.PathNode{
+									Steps: []jparse.Node{
+										&jparse.NameNode{
+											Value: "Name",
+										},
+									},
+								},
+								&jparse.PathNode{
+									Steps: []jparse.Node{
+										&jparse.ParentNode{},
+										&jparse.NameNode{
+											Value: "OrderID",
+										},
+									},
+									Tuples: true,
+								},
+							},
+						},
+					},
+				},
+				Tuples: true,
+			},
+		},
+		{
+			Input: "%Field",
+			Error: &jparse.Error{
+				Type:     jparse.ErrSyntaxError,
+				Position: 1,
+				Token:    "Field",
+			},
+		},
+	})
+}
+
+func TestPositionalBindingNode(t *testing.T) {
+	testParser(t, []testCase{
+		{
+			Input: "books#$i",
+			Output: &jparse.PathNode{
+				Steps: []jparse.Node{
+					&jparse.PositionalBindingNode{
+						Expr: &jparse.NameNode{
+							Value: "books",
+						},
+						Name: "i",
+					},
+				},
+				Tuples: true,
+			},
+		},
+		{
+			Input: "library.books#$i.title",
+			Output: &jparse.PathNode{
+				Steps: []jparse.Node{
+					&jparse.NameNode{
+						Value: "library",
+					},
+					&jparse.PositionalBindingNode{
+						Expr: &jparse.NameNode{
+							Value: "books",
+						},
+						Name: "i",
+					},
+					&jparse.NameNode{
+						Value: "title",
+					},
+				},
+				Tuples: true,
+			},
+		},
+		{
+			// A binding that follows a predicate applies
+			// to the filtered items.
+			Input: "books[copies > 1]#$i",
+			Output: &jparse.PathNode{
+				Steps: []jparse.Node{
+					&jparse.PositionalBindingNode{
+						Expr: &jparse.PredicateNode{
+							Expr: &jparse.NameNode{
+								Value: "books",
+							},
+							Filters: []jparse.Node{
+								&jparse.ComparisonOperatorNode{
+									Type: jparse.ComparisonGreater,
+									LHS: &jparse.PathNode{
+										Steps: []jparse.Node{
+											&jparse.NameNode{
+												Value: "copies",
+											},
+										},
+									},
+									RHS: &jparse.NumberNode{
+										Value: 1,
+									},
+								},
+							},
+						},
+						Name: "i",
+					},
+				},
+				Tuples: true,
+			},
+		},
+		{
+			// A predicate that follows a binding can refer
+			// to the bound variable.
+			Input: "books#$i[$i < 2]",
+			Output: &jparse.PathNode{
+				Steps: []jparse.Node{
+					&jparse.PredicateNode{
+						Expr: &jparse.PositionalBindingNode{
+							Expr: &jparse.NameNode{
+								Value: "books",
+							},
+							Name: "i",
+						},
+						Filters: []jparse.Node{
+							&jparse.ComparisonOperatorNode{
+								Type: jparse.ComparisonLess,
+								LHS: &jparse.VariableNode{
+									Name: "i",
+								},
+								RHS: &jparse.NumberNode{
+									Value: 2,
+								},
+							},
+						},
+					},
+				},
+				Tuples: true,
+			},
+		},
+		{
+			Input: "books#i",
+			Error: &jparse.Error{
+				Type:     jparse.ErrUnexpectedToken,
+				Position: 6,
+				Token:    "i",
+				Hint:     "(variable)",
+			},
+		},
+		{
+			Input: "books#",
+			Error: &jparse.Error{
+				Type:     jparse.ErrMissingToken,
+				Position: 6,
+				Hint:     "(variable)",
+			},
+		},
+	})
+}
+
+func TestContextBindingNode(t *testing.T) {
+	testParser(t, []testCase{
+		{
+			Input: "loans@$l",
+			Output: &jparse.PathNode{
+				Steps: []jparse.Node{
+					&jparse.ContextBindingNode{
+						Expr: &jparse.NameNode{
+							Value: "loans",
+						},
+						Name: "l",
+					},
+				},
+				Tuples: true,
+			},
+		},
+		{
+			Input: "loans@$l.books@$b[$l.isbn = $b.isbn]",
+			Output: &jparse.PathNode{
+				Steps: []jparse.Node{
+					&jparse.ContextBindingNode{
+						Expr: &jparse.NameNode{
+							Value: "loans",
+						},
+						Name: "l",
+					},
+					&jparse.PredicateNode{
+						Expr: &jparse.ContextBindingNode{
+							Expr: &jparse.NameNode{
+								Value: "books",
+							},
+							Name: "b",
+						},
+						Filters: []jparse.Node{
+							&jparse.ComparisonOperatorNode{
+								Type: jparse.ComparisonEqual,
+								LHS: &jparse.PathNode{
+									Steps: []jparse.Node{
+										&jparse.VariableNode{
+											Name: "l",
+										},
+										&jparse.NameNode{
+											Value: "isbn",
+										},
+									},
+								},
+								RHS: &jparse.PathNode{
+									Steps: []jparse.Node{
+										&jparse.VariableNode{
+											Name: "b",
+										},
+										&jparse.NameNode{
+											Value: "isbn",
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+				Tuples: true,
+			},
+		},
+		{
+			// Context and positional bindings can be combined.
+			Input: "books@$b#$i",
+			Output: &jparse.PathNode{
+				Steps: []jparse.Node{
+					&jparse.PositionalBindingNode{
+						Expr: &jparse.ContextBindingNode{
+							Expr: &jparse.NameNode{
+								Value: "books",
+							},
+							Name: "b",
+						},
+						Name: "i",
+					},
+				},
+				Tuples: true,
+			},
+		},
+		{
+			Input: "loans@l",
+			Error: &jparse.Error{
+				Type:     jparse.ErrUnexpectedToken,
+				Position: 6,
+				Token:    "l",
+				Hint:     "(variable)",
+			},
+		},
+	})
+}
+
 func TestObjectTransformationNode(t *testing.T) {
 	testParser(t, []testCase{
 		{
@@ -643,6 +1008,7 @@ func TestFunctionCallNode(t *testing.T) {
 				Func: &jparse.VariableNode{
 					Name: "random",
 				},
+				Position: 7,
 			},
 		},
 		{
@@ -656,6 +1022,7 @@ func TestFunctionCallNode(t *testing.T) {
 						Value: "hello",
 					},
 				},
+				Position: 10,
 			},
 		},
 		{
@@ -675,6 +1042,7 @@ func TestFunctionCallNode(t *testing.T) {
 						Value: 2,
 					},
 				},
+				Position: 10,
 			},
 		},
 		{
@@ -763,16 +1131,98 @@ func TestLambdaNode(t *testing.T) {
 			},
 		},
 		{
-			// Lambdas cannot be partials.
-			Input: "function(?, 10){0}",
-			Error: &jparse.Error{
-				Type:     jparse.ErrPrefix,
-				Position: 9,
-				Token:    "?",
+			Input: `function($n, [$a, $b], {"price": $p, "tags": [$t]}){$p}`,
+			Output: &jparse.LambdaNode{
+				ParamNames: []string{
+					"n",
+					"",
+					"",
+				},
+				Patterns: []jparse.Node{
+					nil,
+					&jparse.ArrayPatternNode{
+						Items: []jparse.Node{
+							&jparse.VariableNode{
+								Name: "a",
+							},
+							&jparse.VariableNode{
+								Name: "b",
+							},
+						},
+					},
+					&jparse.ObjectPatternNode{
+						Fields: []jparse.PatternField{
+							{
+								Key: "price",
+								Value: &jparse.VariableNode{
+									Name: "p",
+								},
+							},
+							{
+								Key: "tags",
+								Value: &jparse.ArrayPatternNode{
+									Items: []jparse.Node{
+										&jparse.VariableNode{
+											Name: "t",
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+				Body: &jparse.VariableNode{
+					Name: "p",
+				},
 			},
 		},
 		{
-			// Trailing delimiter.
+			// Illegal item in an array pattern.
+			Input: "function([$a, 1]){$a}",
+			Error: &jparse.Error{
+				Type:     jparse.ErrIllegalParam,
+				Position: 14,
+				Token:    "1",
+			},
+		},
+		{
+			// Ranges are not patterns.
+			Input: "function([$a..$b]){$a}",
+			Error: &jparse.Error{
+				Type:     jparse.ErrIllegalParam,
+				Position: 10,
+				Token:    "$a..$b",
+			},
+		},
+		{
+			// Object pattern keys must be strings.
+			Input: "function({price: $p}){$p}",
+			Error: &jparse.Error{
+				Type:     jparse.ErrIllegalPatternKey,
+				Position: 10,
+				Token:    "price",
+			},
+		},
+		{
+			// Duplicate parameter in a pattern.
+			Input: `function($a, {"a": $a}){$a}`,
+			Error: &jparse.Error{
+				Type:     jparse.ErrDuplicateParam,
+				Position: 20,
+				Token:    "a",
+			},
+		},
+		{
+			// Lambdas cannot be partials.
+			Input: "function(?, 10){0}",
+			Error: &jparse.Error{
+				Type:     jparse.ErrPrefix,
+				Position: 9,
+				Token:    "?",
+			},
+		},
+		{
+			// Trailing delimiter.
 			Input: "function($x, $y,){0}",
 			Error: &jparse.Error{
 				Type:     jparse.ErrPrefix,
@@ -899,6 +1349,7 @@ func TestPartialApplicationNode(t *testing.T) {
 					&jparse.NumberNode{},
 					&jparse.PlaceholderNode{},
 				},
+				Position: 10,
 			},
 		},
 	})
@@ -932,6 +1383,7 @@ func TestFunctionApplicationNode(t *testing.T) {
 							Value: " ",
 						},
 					},
+					Position: 33,
 				},
 			},
 		},
@@ -1192,6 +1644,68 @@ func TestConditionalNode(t *testing.T) {
 	})
 }
 
+func TestCoalesceNode(t *testing.T) {
+	testParser(t, []testCase{
+		{
+			Input: `Field ?: "default"`,
+			Output: &jparse.CoalesceNode{
+				LHS: &jparse.PathNode{
+					Steps: []jparse.Node{
+						&jparse.NameNode{
+							Value: "Field",
+						},
+					},
+				},
+				RHS: &jparse.StringNode{
+					Value: "default",
+				},
+			},
+		},
+		{
+			// The operator is right-associative.
+			Input: `$a ?: $b ?: 0`,
+			Output: &jparse.CoalesceNode{
+				LHS: &jparse.VariableNode{
+					Name: "a",
+				},
+				RHS: &jparse.CoalesceNode{
+					LHS: &jparse.VariableNode{
+						Name: "b",
+					},
+					RHS: &jparse.NumberNode{},
+				},
+			},
+		},
+		{
+			// It binds more loosely than the comparison
+			// operators.
+			Input: `$a ?: 1 < 2`,
+			Output: &jparse.CoalesceNode{
+				LHS: &jparse.VariableNode{
+					Name: "a",
+				},
+				RHS: &jparse.ComparisonOperatorNode{
+					Type: jparse.ComparisonLess,
+					LHS: &jparse.NumberNode{
+						Value: 1,
+					},
+					RHS: &jparse.NumberNode{
+						Value: 2,
+					},
+				},
+			},
+		},
+		{
+			// Missing default value.
+			Input: `$a ?:`,
+			Error: &jparse.Error{
+				Type:     jparse.ErrUnexpectedEOF,
+				Position: 5,
+			},
+		},
+	})
+}
+
 func TestArrayNode(t *testing.T) {
 	testParser(t, []testCase{
 		{
@@ -1391,6 +1905,123 @@ func TestObjectNode(t *testing.T) {
 				Token:    "}",
 			},
 		},
+		{
+			Input: `{$x := 1; "one": $x, $y := 2;}`,
+			Output: &jparse.ObjectNode{
+				Pairs: [][2]jparse.Node{
+					{
+						&jparse.StringNode{
+							Value: "one",
+						},
+						&jparse.VariableNode{
+							Name: "x",
+						},
+					},
+				},
+				Bindings: []jparse.ObjectBinding{
+					{
+						Assignment: &jparse.AssignmentNode{
+							Name: "x",
+							Value: &jparse.NumberNode{
+								Value: 1,
+							},
+						},
+						Pair: 0,
+					},
+					{
+						Assignment: &jparse.AssignmentNode{
+							Name: "y",
+							Value: &jparse.NumberNode{
+								Value: 2,
+							},
+						},
+						Pair: 1,
+					},
+				},
+			},
+		},
+		{
+			// Bindings can be separated by commas too.
+			Input: `{$x := 1, "one": $x}`,
+			Output: &jparse.ObjectNode{
+				Pairs: [][2]jparse.Node{
+					{
+						&jparse.StringNode{
+							Value: "one",
+						},
+						&jparse.VariableNode{
+							Name: "x",
+						},
+					},
+				},
+				Bindings: []jparse.ObjectBinding{
+					{
+						Assignment: &jparse.AssignmentNode{
+							Name: "x",
+							Value: &jparse.NumberNode{
+								Value: 1,
+							},
+						},
+						Pair: 0,
+					},
+				},
+			},
+		},
+		{
+			// An assignment followed by a colon is a key.
+			Input: `{$x := "one": 1}`,
+			Output: &jparse.ObjectNode{
+				Pairs: [][2]jparse.Node{
+					{
+						&jparse.AssignmentNode{
+							Name: "x",
+							Value: &jparse.StringNode{
+								Value: "one",
+							},
+						},
+						&jparse.NumberNode{
+							Value: 1,
+						},
+					},
+				},
+			},
+		},
+		{
+			// Pairs can be followed by a semicolon if the next
+			// entry is a binding.
+			Input: `{"one": 1; $x := 2, "two": $x}`,
+			Output: &jparse.ObjectNode{
+				Pairs: [][2]jparse.Node{
+					{
+						&jparse.StringNode{
+							Value: "one",
+						},
+						&jparse.NumberNode{
+							Value: 1,
+						},
+					},
+					{
+						&jparse.StringNode{
+							Value: "two",
+						},
+						&jparse.VariableNode{
+							Name: "x",
+						},
+					},
+				},
+				Bindings: []jparse.ObjectBinding{
+					{
+						Assignment: &jparse.AssignmentNode{
+							Name: "x",
+							Value: &jparse.NumberNode{
+								Value: 2,
+							},
+						},
+						Pair: 1,
+					},
+				},
+			},
+		},
 	})
 }
 
@@ -1539,12 +2170,9 @@ func TestNumericOperatorNode(t *testing.T) {
 			},
 		},
 		{
-			Input: "%",
-			Error: &jparse.Error{
-				Type:     jparse.ErrPrefix,
-				Token:    "%",
-				Position: 0,
-			},
+			// In the prefix position, % is the parent operator.
+			Input:  "%",
+			Output: &jparse.ParentNode{},
 		},
 	})
 }
@@ -2000,6 +2628,7 @@ func TestPathNode(t *testing.T) {
 						Func: &jparse.VariableNode{
 							Name: "uppercase",
 						},
+						Position: 17,
 					},
 				},
 			},
@@ -2046,6 +2675,267 @@ func TestPathNode(t *testing.T) {
 	})
 }
 
+func TestCustomOperatorNode(t *testing.T) {
+
+	ops := map[string]int{
+		"~~":  50,
+		"~~>": 60,
+		"!?":  30,
+	}
+
+	str := func(s string) jparse.Node {
+		return &jparse.StringNode{Value: s}
+	}
+
+	data := []testCase{
+		{
+			Input: `"a" ~~ "b"`,
+			Output: &jparse.CustomOperatorNode{
+				Symbol:       "~~",
+				BindingPower: 50,
+				LHS:          str("a"),
+				RHS:          str("b"),
+				Position:     4,
+			},
+		},
+		{
+			// Longer symbols are matched first.
+			Input: `"a"~~>"b"`,
+			Output: &jparse.CustomOperatorNode{
+				Symbol:       "~~>",
+				BindingPower: 60,
+				LHS:          str("a"),
+				RHS:          str("b"),
+				Position:     3,
+			},
+		},
+		{
+			// Precedence and associativity.
+			Input: `"a" ~~ "b" ~~ "c" & "d" !? "e"`,
+			Output: &jparse.CustomOperatorNode{
+				Symbol:       "!?",
+				BindingPower: 30,
+				LHS: &jparse.CustomOperatorNode{
+					Symbol:       "~~",
+					BindingPower: 50,
+					LHS: &jparse.CustomOperatorNode{
+						Symbol:       "~~",
+						BindingPower: 50,
+						LHS:          str("a"),
+						RHS:          str("b"),
+						Position:     4,
+					},
+					RHS: &jparse.StringConcatenationNode{
+						LHS: str("c"),
+						RHS: str("d"),
+					},
+					Position: 11,
+				},
+				RHS:      str("e"),
+				Position: 24,
+			},
+		},
+		{
+			// Built-in operators are unaffected.
+			Input: `"a" != "b"`,
+			Output: &jparse.ComparisonOperatorNode{
+				Type: jparse.ComparisonNotEqual,
+				LHS:  str("a"),
+				RHS:  str("b"),
+			},
+		},
+		{
+			Input: `~~ "a"`,
+			Error: &jparse.Error{
+				Type:     jparse.ErrPrefix,
+				Token:    "~~",
+				Position: 0,
+			},
+		},
+	}
+
+	for _, test := range data {
+
+		output, err := jparse.ParseWithOperators(test.Input, ops)
+		clearSpans(output)
+
+		if !reflect.DeepEqual(output, test.Output) {
+			t.Errorf("%s: expected output %s, got %s", test.Input, test.Output, output)
+		}
+		if !reflect.DeepEqual(err, test.Error) {
+			t.Errorf("%s: expected error %s, got %s", test.Input, test.Error, err)
+		}
+	}
+
+	// Without the operator, the symbol is not recognised.
+	if _, err := jparse.Parse(`"a" ~~ "b"`); err == nil {
+		t.Errorf("Parse: expected an error for an unregistered operator")
+	}
+
+	// Invalid operators are rejected.
+	if _, err := jparse.ParseWithOperators(`"a" ~> "b"`, map[string]int{"~>": 50}); err == nil {
+		t.Errorf("ParseWithOperators: expected an error for an invalid operator")
+	}
+}
+
+func TestCheckOperator(t *testing.T) {
+
+	data := []struct {
+		Symbol string
+		Bp     int
+		Valid  bool
+	}{
+		{"~~", 50, true},
+		{"!~", 30, true},
+		{"~=>", 70, true},
+		{"!!", 40, true},
+		{"", 50, false},
+		{"~", 50, false},
+		{"!", 50, false},
+		{"~>", 50, false},
+		{"~>>", 50, false},
+		{"!=", 50, false},
+		{"!==", 50, false},
+		{"<~", 50, false},
+		{"~ ~", 50, false},
+		{"~a", 50, false},
+		{"~(", 50, false},
+		{"~~", 29, false},
+		{"~~", 71, false},
+	}
+
+	for _, test := range data {
+		err := jparse.CheckOperator(test.Symbol, test.Bp)
+		if got := err == nil; got != test.Valid {
+			t.Errorf("CheckOperator(%q, %d): expected valid %t, got error %v", test.Symbol, test.Bp, test.Valid, err)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	testParser(t, []testCase{
+		{
+			Inputs: []string{
+				`{ /* key */ "a": /* value */ 1 /* end */ }`,
+				"/* leading */ {\"a\": 1}",
+				"{\"a\": 1} /*\n * trailing\n */",
+			},
+			Output: &jparse.ObjectNode{
+				Pairs: [][2]jparse.Node{
+					{
+						&jparse.StringNode{
+							Value: "a",
+						},
+						&jparse.NumberNode{
+							Value: 1,
+						},
+					},
+				},
+			},
+		},
+		{
+			Input: `Account /* the account */ . /* its orders */ Order`,
+			Output: &jparse.PathNode{
+				Steps: []jparse.Node{
+					&jparse.NameNode{
+						Value: "Account",
+					},
+					&jparse.NameNode{
+						Value: "Order",
+					},
+				},
+			},
+		},
+		{
+			// A slash followed by an asterisk starts a
+			// comment, not a division or a regex.
+			Input: `4/**/ / /** 3 **/ 2`,
+			Output: &jparse.NumericOperatorNode{
+				Type: jparse.NumericDivide,
+				LHS: &jparse.NumberNode{
+					Value: 4,
+				},
+				RHS: &jparse.NumberNode{
+					Value: 2,
+				},
+			},
+		},
+		{
+			Input: `(1 + /* oops`,
+			Error: &jparse.Error{
+				Type:     jparse.ErrUnterminatedComment,
+				Position: 5,
+				Token:    "/*",
+				Hint:     "*/",
+			},
+		},
+	})
+}
+
+func TestParseSignature(t *testing.T) {
+
+	data := []struct {
+		Input  string
+		Output []jparse.Param
+		Error  error
+	}{
+		{
+			Input: "<s-n?:s>",
+			Output: []jparse.Param{
+				{
+					Type:   jparse.ParamTypeString,
+					Option: jparse.ParamContextable,
+				},
+				{
+					Type:   jparse.ParamTypeNumber,
+					Option: jparse.ParamOptional,
+				},
+			},
+		},
+		{
+			Input: "a<n>x+",
+			Output: []jparse.Param{
+				{
+					Type: jparse.ParamTypeArray,
+					SubParams: []jparse.Param{
+						{
+							Type: jparse.ParamTypeNumber,
+						},
+					},
+				},
+				{
+					Type:   jparse.ParamTypeAny,
+					Option: jparse.ParamVariadic,
+				},
+			},
+		},
+		{
+			Input:  "<>",
+			Output: []jparse.Param{},
+		},
+		{
+			Input: "<sz>",
+			Error: &jparse.Error{
+				Type: jparse.ErrInvalidParamType,
+				Hint: "z",
+			},
+		},
+	}
+
+	for _, test := range data {
+
+		output, err := jparse.ParseSignature(test.Input)
+
+		if !reflect.DeepEqual(output, test.Output) {
+			t.Errorf("%s: expected params %v, got %v", test.Input, test.Output, output)
+		}
+
+		if !reflect.DeepEqual(err, test.Error) {
+			t.Errorf("%s: expected error %v, got %v", test.Input, test.Error, err)
+		}
+	}
+}
+
 func TestStringers(t *testing.T) {
 
 	data := []struct {
@@ -2202,6 +3092,18 @@ func TestStringers(t *testing.T) {
 			Input:  "λ($x,$y,$z)<a<(ns)>-nf?:a>{$w*$h}",
 			String: "λ($x, $y, $z)<a<(ns)>-nf?>{$w * $h}", // TODO: handle output type
 		},
+		{
+			Input:  `function([$a,$b],{'price':$p,"tags":[$t]}){$a}`,
+			String: `function([$a, $b], {"price": $p, "tags": [$t]}){$a}`,
+		},
+		{
+			Input:  "λ($x,[$y])<na>{$y}",
+			String: "λ($x, [$y])<na>{$y}",
+		},
+		{
+			Input:  `{$x:=1;"one":$x,"two":$x*2,$y:=3}`,
+			String: `{$x := 1; "one": $x, "two": $x * 2, $y := 3}`,
+		},
 		{
 			Input:  "$[0]",
 			String: "$[0]",
@@ -2306,6 +3208,22 @@ func TestStringers(t *testing.T) {
 			Input:  "'hello' ~> $uppercase",
 			String: `"hello" ~> $uppercase`,
 		},
+		{
+			Input:  "Order.Product.%.%.Name",
+			String: "Order.Product.%.%.Name",
+		},
+		{
+			Input:  "library.books[price > 30]#$i.title",
+			String: "library.books[price > 30]#$i.title",
+		},
+		{
+			Input:  `Account.Name ?: "unknown"`,
+			String: `Account.Name ?: "unknown"`,
+		},
+		{
+			Input:  "library.loans@$l.books@$b[$l.isbn = $b.isbn].$b.title",
+			String: "library.loans@$l.books@$b[$l.isbn = $b.isbn].$b.title",
+		},
 	}
 
 	for _, test := range data {
@@ -2322,6 +3240,408 @@ func TestStringers(t *testing.T) {
 	}
 }
 
+func TestNodeStrings(t *testing.T) {
+
+	name := func(s string) jparse.Node {
+		return &jparse.NameNode{Value: s}
+	}
+
+	path := func(steps ...jparse.Node) jparse.Node {
+		return &jparse.PathNode{Steps: steps}
+	}
+
+	num := func(f float64) jparse.Node {
+		return &jparse.NumberNode{Value: f}
+	}
+
+	data := []struct {
+		Node   jparse.Node
+		String string
+	}{
+		{
+			Node: &jparse.NumericOperatorNode{
+				Type: jparse.NumericMultiply,
+				LHS: &jparse.NumericOperatorNode{
+					Type: jparse.NumericAdd,
+					LHS:  num(1),
+					RHS:  num(2),
+				},
+				RHS: num(3),
+			},
+			String: "(1 + 2) * 3",
+		},
+		{
+			Node: &jparse.NumericOperatorNode{
+				Type: jparse.NumericSubtract,
+				LHS:  name("a"),
+				RHS: &jparse.NumericOperatorNode{
+					Type: jparse.NumericSubtract,
+					LHS:  name("b"),
+					RHS:  name("c"),
+				},
+			},
+			String: "a - (b - c)",
+		},
+		{
+			Node: &jparse.NumericOperatorNode{
+				Type: jparse.NumericMultiply,
+				LHS:  num(-1),
+				RHS:  num(-2),
+			},
+			String: "(-1) * -2",
+		},
+		{
+			Node: &jparse.NegationNode{
+				RHS: &jparse.StringConcatenationNode{
+					LHS: name("a"),
+					RHS: name("b"),
+				},
+			},
+			String: "-(a & b)",
+		},
+		{
+			Node: &jparse.CoalesceNode{
+				LHS: &jparse.CoalesceNode{
+					LHS: name("a"),
+					RHS: name("b"),
+				},
+				RHS: &jparse.CoalesceNode{
+					LHS: name("c"),
+					RHS: name("d"),
+				},
+			},
+			String: "(a ?: b) ?: c ?: d",
+		},
+		{
+			Node: &jparse.PredicateNode{
+				Expr:    path(name("a"), name("b")),
+				Filters: []jparse.Node{num(0), name("c")},
+			},
+			String: "(a.b)[0][c]",
+		},
+		{
+			Node: path(name("a"), &jparse.BooleanOperatorNode{
+				Type: jparse.BooleanOr,
+				LHS:  name("b"),
+				RHS:  name("c"),
+			}),
+			String: "a.(b or c)",
+		},
+		{
+			Node: &jparse.ComparisonOperatorNode{
+				Type: jparse.ComparisonEqual,
+				LHS: &jparse.SortNode{
+					Expr: path(name("a"), name("b")),
+					Terms: []jparse.SortTerm{
+						{Dir: jparse.SortDescending, Expr: name("c")},
+					},
+				},
+				RHS: &jparse.SortNode{
+					Expr: name("d"),
+					Terms: []jparse.SortTerm{
+						{Dir: jparse.SortDefault, Expr: name("e")},
+					},
+				},
+			},
+			String: "a.b^(>c) = (d^(e))",
+		},
+		{
+			Node: &jparse.FunctionCallNode{
+				Func: &jparse.ConditionalNode{
+					If:   name("a"),
+					Then: &jparse.VariableNode{Name: "f"},
+					Else: &jparse.VariableNode{Name: "g"},
+				},
+				Args: []jparse.Node{num(1)},
+			},
+			String: "(a ? $f : $g)(1)",
+		},
+		{
+			Node:   name("Product Name"),
+			String: "`Product Name`",
+		},
+		{
+			Node:   name("true"),
+			String: "`true`",
+		},
+		{
+			Node:   name("2nd"),
+			String: "`2nd`",
+		},
+		{
+			Node:   name("and"),
+			String: "and",
+		},
+		{
+			Node:   &jparse.StringNode{Value: "tab\t \"quote\" \x01 \u00e9"},
+			String: `"tab\t \"quote\" \u0001 é"`,
+		},
+		{
+			Node:   num(0.1),
+			String: "0.1",
+		},
+		{
+			Node:   num(123456789),
+			String: "123456789",
+		},
+		{
+			Node:   num(1e21),
+			String: "1e+21",
+		},
+		{
+			Node:   num(1.5e-7),
+			String: "1.5e-07",
+		},
+		{
+			Node: &jparse.TypedLambdaNode{
+				LambdaNode: &jparse.LambdaNode{
+					Body:       &jparse.VariableNode{Name: "x"},
+					ParamNames: []string{"x"},
+				},
+				In:  []jparse.Param{{Type: jparse.ParamTypeNumber}},
+				Out: []jparse.Param{{Type: jparse.ParamTypeString}},
+			},
+			String: "function($x)<n:s>{$x}",
+		},
+	}
+
+	for _, test := range data {
+
+		s := test.Node.String()
+		if s != test.String {
+			t.Errorf("expected string %s, got %s", test.String, s)
+		}
+
+		if _, err := jparse.Parse(s); err != nil {
+			t.Errorf("%s: parse error: %s", s, err)
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+
+	node, err := jparse.Parse(`(
+		$v := "s" & 1 & true & null;
+		$re := /ab+/;
+		$f := function($x) { -$x };
+		$g := function($x)<n:n> { $x * 2 };
+		$h := function([$x, {"y": $y}]) { $x + $y };
+		$p := $f(?);
+		$r := [1..2];
+		$o := {"k": a.b.%.c};
+		a.*.**[0]^(>d){e: f} ~> |g|{"h": 1}, ["i"]|;
+		j#$k@$l.(m ?: n);
+		$f(o) > 1 and $p(2) = 2 ? $g(3) : ($v != "s" or $o)
+	)`)
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+
+	types := map[string]bool{}
+
+	jparse.Walk(node, func(n jparse.Node) bool {
+		types[reflect.TypeOf(n).Elem().Name()] = true
+		return true
+	})
+
+	exp := []string{
+		"StringNode",
+		"NumberNode",
+		"BooleanNode",
+		"NullNode",
+		"RegexNode",
+		"VariableNode",
+		"NameNode",
+		"PathNode",
+		"NegationNode",
+		"RangeNode",
+		"ArrayNode",
+		"ObjectNode",
+		"BlockNode",
+		"WildcardNode",
+		"DescendentNode",
+		"ParentNode",
+		"ObjectTransformationNode",
+		"LambdaNode",
+		"TypedLambdaNode",
+		"ArrayPatternNode",
+		"ObjectPatternNode",
+		"PartialNode",
+		"PlaceholderNode",
+		"FunctionCallNode",
+		"PredicateNode",
+		"GroupNode",
+		"ConditionalNode",
+		"CoalesceNode",
+		"AssignmentNode",
+		"NumericOperatorNode",
+		"ComparisonOperatorNode",
+		"BooleanOperatorNode",
+		"StringConcatenationNode",
+		"SortNode",
+		"FunctionApplicationNode",
+		"PositionalBindingNode",
+		"ContextBindingNode",
+	}
+
+	for _, name := range exp {
+		if !types[name] {
+			t.Errorf("Walk: expected to visit a %s", name)
+		}
+	}
+
+	// Returning false skips a node's children.
+	var names []string
+
+	jparse.Walk(node, func(n jparse.Node) bool {
+		switch n := n.(type) {
+		case *jparse.NameNode:
+			names = append(names, n.Value)
+		case *jparse.LambdaNode, *jparse.TypedLambdaNode, *jparse.ObjectTransformationNode:
+			return false
+		}
+		return true
+	})
+
+	if got, want := strings.Join(names, ","), "a,b,c,a,d,e,f,j,m,n,o"; got != want {
+		t.Errorf("Walk: expected names %s, got %s", want, got)
+	}
+}
+
+func TestSpans(t *testing.T) {
+
+	data := []struct {
+		Input string
+		Spans []string // the source of each node, in Walk order
+	}{
+		{
+			Input: `$sum(Order.Price) * 2`,
+			Spans: []string{
+				`$sum(Order.Price) * 2`,
+				`$sum(Order.Price)`,
+				`$sum`,
+				`Order.Price`,
+				`Order`,
+				`Price`,
+				`2`,
+			},
+		},
+		{
+			// Spans include quotes and delimiters.
+			Input: `"a" & 'b' & /ab+/i`,
+			Spans: []string{
+				`"a" & 'b' & /ab+/i`,
+				`"a" & 'b'`,
+				`"a"`,
+				`'b'`,
+				`/ab+/i`,
+			},
+		},
+		{
+			// Optimized paths and predicates span the
+			// nodes that they replace.
+			Input: "Account.`Order`[0].Product[Price > 10][]",
+			Spans: []string{
+				"Account.`Order`[0].Product[Price > 10][]",
+				`Account`,
+				"`Order`[0]",
+				"`Order`",
+				`0`,
+				`Product[Price > 10]`,
+				`Product`,
+				`Price > 10`,
+				`Price`,
+				`Price`,
+				`10`,
+			},
+		},
+		{
+			Input: `-1 + -x`,
+			Spans: []string{
+				`-1 + -x`,
+				`-1`,
+				`-x`,
+				`x`,
+				`x`,
+			},
+		},
+		{
+			Input: `Orders{Customer: [1..3]}`,
+			Spans: []string{
+				`Orders{Customer: [1..3]}`,
+				`Orders`,
+				`Orders`,
+				`{Customer: [1..3]}`,
+				`Customer`,
+				`Customer`,
+				`[1..3]`,
+				`1..3`,
+				`1`,
+				`3`,
+			},
+		},
+		{
+			Input: `(
+  $f := λ($x)<n:n>{ $x };
+  $f(?)
+)`,
+			Spans: []string{
+				"(\n  $f := λ($x)<n:n>{ $x };\n  $f(?)\n)",
+				`$f := λ($x)<n:n>{ $x }`,
+				`λ($x)<n:n>{ $x }`,
+				`$x`,
+				`$f(?)`,
+				`$f`,
+				`?`,
+			},
+		},
+		{
+			// Spans do not include comments.
+			Input: `/* call */ $f(1 /* one */) /* end */`,
+			Spans: []string{
+				`$f(1 /* one */)`,
+				`$f`,
+				`1`,
+			},
+		},
+		{
+			Input: `books#$i[$i > 0]@$b.title`,
+			Spans: []string{
+				`books#$i[$i > 0]@$b.title`,
+				`books#$i[$i > 0]@$b`,
+				`books#$i[$i > 0]`,
+				`books#$i`,
+				`books`,
+				`$i > 0`,
+				`$i`,
+				`0`,
+				`title`,
+			},
+		},
+	}
+
+	for _, test := range data {
+
+		node, err := jparse.Parse(test.Input)
+		if err != nil {
+			t.Errorf("%s: %s", test.Input, err)
+			continue
+		}
+
+		var spans []string
+
+		jparse.Walk(node, func(n jparse.Node) bool {
+			span := jparse.SpanOf(n)
+			spans = append(spans, test.Input[span.Start:span.End])
+			return true
+		})
+
+		if !reflect.DeepEqual(spans, test.Spans) {
+			t.Errorf("%s: expected spans %q, got %q", test.Input, test.Spans, spans)
+		}
+	}
+}
+
 func testParser(t *testing.T, data []testCase) {
 
 	for _, test := range data {
@@ -2334,6 +3654,7 @@ func testParser(t *testing.T, data []testCase) {
 		for _, input := range inputs {
 
 			output, err := jparse.Parse(input)
+			clearSpans(output)
 
 			if !reflect.DeepEqual(output, test.Output) {
 				t.Errorf("%s: expected output %s, got %s", input, test.Output, output)
@@ -2344,3 +3665,17 @@ func testParser(t *testing.T, data []testCase) {
 		}
 	}
 }
+
+// clearSpans zeroes the spans of a syntax tree so that the
+// parser's output can be compared with trees built by hand.
+// Spans are tested separately (see TestSpans).
+func clearSpans(node jparse.Node) {
+	jparse.Walk(node, func(n jparse.Node) bool {
+		v := reflect.ValueOf(n).Elem().FieldByName("Span")
+		v.Set(reflect.Zero(v.Type()))
+		if n, ok := n.(*jparse.TypedLambdaNode); ok {
+			n.LambdaNode.Span = jparse.Span{}
+		}
+		return true
+	})
+}
@@ -6,6 +6,7 @@ package jparse
 
 import (
 	"fmt"
+	"strings"
 	"unicode/utf8"
 )
 
@@ -56,11 +57,17 @@ const (
 	typeRange
 	typeAssign
 	typeDescendent
+	typePosition
+	typeContextBind
+	typeCoalesce
 
 	// Keyword operators
 	typeAnd
 	typeOr
 	typeIn
+
+	// Custom operators (see ParseWithOperators)
+	typeOperator
 )
 
 func (tt tokenType) String() string {
@@ -81,6 +88,8 @@ func (tt tokenType) String() string {
 		return "(variable)"
 	case typeRegex:
 		return "(regex)"
+	case typeOperator:
+		return "(operator)"
 	default:
 		if s := symbolsAndKeywords[tt]; s != "" {
 			return s
@@ -114,6 +123,8 @@ var symbols1 = [...]tokenType{
 	'>': typeGreater,
 	'^': typeSort,
 	'&': typeConcat,
+	'#': typePosition,
+	'@': typeContextBind,
 }
 
 type runeTokenType struct {
@@ -131,6 +142,7 @@ var symbols2 = [...][]runeTokenType{
 	'~': {{'>', typeApply}},
 	':': {{'=', typeAssign}},
 	'*': {{'*', typeDescendent}},
+	'?': {{':', typeCoalesce}},
 }
 
 const (
@@ -187,6 +199,9 @@ type lexer struct {
 	current int
 	width   int
 	err     error
+	// operators holds the symbols of any custom operators,
+	// longest first.
+	operators []string
 }
 
 // newLexer creates a new lexer from the provided input. The
@@ -212,6 +227,23 @@ func (l *lexer) next(allowRegex bool) token {
 
 	l.skipWhitespace()
 
+	// skipWhitespace stops at the start of a comment with no
+	// closing delimiter. The rest of the input is part of the
+	// comment.
+	if strings.HasPrefix(l.input[l.current:], "/*") {
+		l.current += 2
+		t := l.error(ErrUnterminatedComment, "*/")
+		l.current = l.length
+		return t
+	}
+
+	for _, op := range l.operators {
+		if strings.HasPrefix(l.input[l.current:], op) {
+			l.current += len(op)
+			return l.newToken(typeOperator)
+		}
+	}
+
 	ch := l.nextRune()
 	if ch == eof {
 		return l.eof()
@@ -272,11 +304,11 @@ Loop:
 		case ')', ']', '}':
 			depth--
 		case '\\':
-			if r := l.nextRune(); r != eof && r != '\n' {
+			if r := l.nextRune(); r != eof {
 				break
 			}
 			fallthrough
-		case eof, '\n':
+		case eof:
 			return l.error(ErrUnterminatedRegex, string(delim))
 		}
 	}
@@ -287,15 +319,89 @@ Loop:
 	l.ignore()
 
 	// Convert JavaScript-style regex flags to Go format,
-	// e.g. /ab+/i becomes /(?i)ab+/.
+	// e.g. /ab+/i becomes /(?i)ab+/. Go does not support the
+	// x (extended) flag, so the whitespace and comments that
+	// it allows are removed from the expression instead.
 	if l.acceptAll(isRegexFlag) {
-		flags := l.newToken(0)
-		t.Value = fmt.Sprintf("(?%s)%s", flags.Value, t.Value)
+		flags := l.newToken(0).Value
+		if strings.ContainsRune(flags, 'x') {
+			flags = strings.Replace(flags, "x", "", -1)
+			t.Value = compactRegex(t.Value)
+		}
+		if flags != "" {
+			t.Value = fmt.Sprintf("(?%s)%s", flags, t.Value)
+		}
+	}
+
+	// Anything else that would be read as part of a name
+	// is an invalid flag.
+	switch ch := l.nextRune(); {
+	case ch == eof:
+	case isWhitespace(ch), lookupSymbol1(ch) > 0, lookupSymbol2(ch) != nil:
+		l.backup()
+	default:
+		return l.error(ErrInvalidRegexFlag, "")
 	}
 
 	return t
 }
 
+// compactRegex removes the whitespace and comments allowed by
+// the x flag from a regular expression. Comments start with #
+// and run to the end of the line. Whitespace and # characters
+// are kept if they are escaped or inside a character class.
+func compactRegex(s string) string {
+
+	var b strings.Builder
+	var inClass, inComment bool
+
+	for i := 0; i < len(s); i++ {
+
+		c := s[i]
+
+		switch {
+		case inComment:
+			inComment = c != '\n'
+
+		case c == '\\' && i+1 < len(s):
+			// Go does not allow whitespace to be escaped,
+			// so escaped whitespace is written as is.
+			i++
+			if !isWhitespace(rune(s[i])) {
+				b.WriteByte(c)
+			}
+			b.WriteByte(s[i])
+
+		case inClass:
+			b.WriteByte(c)
+			switch {
+			case c == '[' && strings.HasPrefix(s[i+1:], ":"):
+				// Skip over ASCII classes like [:alpha:].
+				if end := strings.Index(s[i+1:], ":]"); end >= 0 {
+					b.WriteString(s[i+1 : i+end+3])
+					i += end + 2
+				}
+			case c == ']':
+				inClass = false
+			}
+
+		case c == '[':
+			b.WriteByte(c)
+			inClass = true
+
+		case c == '#':
+			inComment = true
+
+		case isWhitespace(rune(c)):
+
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
 // scanString reads a string literal from the current position
 // and returns a string token. The opening quote has already been
 // consumed.
@@ -329,12 +435,26 @@ func (l *lexer) scanNumber() token {
 	// JSON does not support leading zeroes. The integer part of
 	// a number will either be a single zero, or a non-zero digit
 	// followed by zero or more digits.
-	if !l.acceptRune('0') {
+	//
+	// Integers can also be written in hexadecimal, octal or
+	// binary with a 0x, 0o or 0b prefix. The lexer reads all of
+	// the letters and digits that follow the prefix and leaves
+	// the parser to check them.
+	//
+	// Underscores are read as part of a number so that the
+	// parser can reject numeric separators (e.g. 1_000) with
+	// a helpful error.
+	if l.acceptRune('0') {
+		if l.accept(isRadixPrefix) {
+			l.acceptAll(isAlphanumeric)
+			return l.newToken(typeNumber)
+		}
+	} else {
 		l.accept(isNonZeroDigit)
-		l.acceptAll(isDigit)
+		l.acceptAll(isDigitOrSeparator)
 	}
 	if l.acceptRune('.') {
-		if !l.acceptAll(isDigit) {
+		if !l.acceptAll(isDigitOrSeparator) {
 			// If there are no digits after the decimal point,
 			// don't treat the dot as part of the number. It
 			// could be part of the range operator, e.g. "1..5".
@@ -344,7 +464,7 @@ func (l *lexer) scanNumber() token {
 	}
 	if l.acceptRunes2('e', 'E') {
 		l.acceptRunes2('+', '-')
-		l.acceptAll(isDigit)
+		l.acceptAll(isDigitOrSeparator)
 	}
 	return l.newToken(typeNumber)
 }
@@ -491,8 +611,27 @@ func (l *lexer) acceptAll(isValid func(rune) bool) bool {
 	return b
 }
 
+// skipWhitespace skips whitespace and comments. Comments are
+// enclosed in /* and */ and can appear anywhere that whitespace
+// can. Because comments are skipped before the next token is
+// read, a forward slash followed by an asterisk always starts
+// a comment, even where a regular expression is allowed.
 func (l *lexer) skipWhitespace() {
-	l.acceptAll(isWhitespace)
+	for {
+		l.acceptAll(isWhitespace)
+
+		if !strings.HasPrefix(l.input[l.current:], "/*") {
+			break
+		}
+
+		n := strings.Index(l.input[l.current+2:], "*/")
+		if n < 0 {
+			break
+		}
+
+		l.current += n + 4
+	}
+
 	l.ignore()
 }
 
@@ -507,7 +646,7 @@ func isWhitespace(r rune) bool {
 
 func isRegexFlag(r rune) bool {
 	switch r {
-	case 'i', 'm', 's':
+	case 'i', 'm', 's', 'x':
 		return true
 	default:
 		return false
@@ -522,6 +661,23 @@ func isNonZeroDigit(r rune) bool {
 	return r >= '1' && r <= '9'
 }
 
+func isDigitOrSeparator(r rune) bool {
+	return isDigit(r) || r == '_'
+}
+
+func isRadixPrefix(r rune) bool {
+	switch r {
+	case 'x', 'X', 'o', 'O', 'b', 'B':
+		return true
+	default:
+		return false
+	}
+}
+
+func isAlphanumeric(r rune) bool {
+	return isDigit(r) || r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
 // symbolsAndKeywords maps operator token types back to their
 // string representations. It's only used by tokenType.String
 // (and one test).
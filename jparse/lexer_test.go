@@ -36,6 +36,61 @@ func TestLexerWhitespace(t *testing.T) {
 	})
 }
 
+func TestLexerComments(t *testing.T) {
+	testLexer(t, []lexerTestCase{
+		{
+			Input: "/* comment */",
+		},
+		{
+			Input: "/**/ /***/ /** nested * asterisks **/",
+		},
+		{
+			Input: "a /* one */.b/* two *//* three */ + 1",
+			Tokens: []token{
+				tok(typeName, "a", 0),
+				tok(typeDot, ".", 11),
+				tok(typeName, "b", 12),
+				tok(typePlus, "+", 34),
+				tok(typeNumber, "1", 36),
+			},
+		},
+		{
+			// Comments take precedence over regular
+			// expressions.
+			Input:      "/* not a regex */ /ab+/",
+			AllowRegex: true,
+			Tokens: []token{
+				tok(typeRegex, "ab+", 19),
+			},
+		},
+		{
+			Input: "1 /* no closing delimiter *",
+			Tokens: []token{
+				tok(typeNumber, "1", 0),
+				tok(typeError, "/*", 2),
+			},
+			Error: &Error{
+				Type:     ErrUnterminatedComment,
+				Token:    "/*",
+				Hint:     "*/",
+				Position: 2,
+			},
+		},
+		{
+			Input: "/*/",
+			Tokens: []token{
+				tok(typeError, "/*", 0),
+			},
+			Error: &Error{
+				Type:     ErrUnterminatedComment,
+				Token:    "/*",
+				Hint:     "*/",
+				Position: 0,
+			},
+		},
+	})
+}
+
 func TestLexerRegex(t *testing.T) {
 	testLexer(t, []lexerTestCase{
 		{
@@ -81,12 +136,64 @@ func TestLexerRegex(t *testing.T) {
 				tok(typeName, "i", 6),
 			},
 		},
+		{
+			Input:      `/^ab+$/ms`,
+			AllowRegex: true,
+			Tokens: []token{
+				tok(typeRegex, "(?ms)^ab+$", 1),
+			},
+		},
+		{
+			Input:      "/a b # comment\n\tc+ # another\n/x",
+			AllowRegex: true,
+			Tokens: []token{
+				tok(typeRegex, "abc+", 1),
+			},
+		},
+		{
+			Input:      `/[a #]+\ \# b/xi`,
+			AllowRegex: true,
+			Tokens: []token{
+				tok(typeRegex, `(?i)[a #]+ \#b`, 1),
+			},
+		},
+		{
+			Input:      `/[^ #]x [ab ][[:space:] #]/x`,
+			AllowRegex: true,
+			Tokens: []token{
+				tok(typeRegex, `[^ #]x[ab ][[:space:] #]`, 1),
+			},
+		},
+		{
+			Input:      `/ab+/i)`,
+			AllowRegex: true,
+			Tokens: []token{
+				tok(typeRegex, "(?i)ab+", 1),
+				tok(typeParenClose, ")", 6),
+			},
+		},
 		{
 			Input:      `/ab+/I`,
 			AllowRegex: true,
 			Tokens: []token{
-				tok(typeRegex, "ab+", 1),
-				tok(typeName, "I", 5),
+				tok(typeError, "I", 5),
+			},
+			Error: &Error{
+				Type:     ErrInvalidRegexFlag,
+				Token:    "I",
+				Position: 5,
+			},
+		},
+		{
+			Input:      `/ab+/mg`,
+			AllowRegex: true,
+			Tokens: []token{
+				tok(typeError, "g", 6),
+			},
+			Error: &Error{
+				Type:     ErrInvalidRegexFlag,
+				Token:    "g",
+				Position: 6,
 			},
 		},
 		{
@@ -242,6 +349,33 @@ func TestLexerNumbers(t *testing.T) {
 				tok(typeDot, ".", 1),
 			},
 		},
+		{
+			Input: "0xff 0O17 0b101",
+			Tokens: []token{
+				tok(typeNumber, "0xff", 0),
+				tok(typeNumber, "0O17", 5),
+				tok(typeNumber, "0b101", 10),
+			},
+		},
+		{
+			// Letters and digits after a radix prefix are
+			// part of the number, even if they are not valid
+			// digits. The parser reports the error.
+			Input: "0b12z+0x",
+			Tokens: []token{
+				tok(typeNumber, "0b12z", 0),
+				tok(typePlus, "+", 5),
+				tok(typeNumber, "0x", 6),
+			},
+		},
+		{
+			// Underscores are part of the number so that
+			// the parser can reject them.
+			Input: "1_000.5_0e1_0",
+			Tokens: []token{
+				tok(typeNumber, "1_000.5_0e1_0", 0),
+			},
+		},
 	})
 }
 
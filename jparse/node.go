@@ -6,6 +6,8 @@ package jparse
 
 import (
 	"fmt"
+	"math"
+	"math/big"
 	"regexp"
 	"regexp/syntax"
 	"strconv"
@@ -15,13 +17,44 @@ import (
 )
 
 // Node represents an individual node in a syntax tree.
+//
+// The String method of a Node returns a JSONata expression in
+// a normalised form (e.g. with consistent spacing and quotes)
+// which parses to an equivalent syntax tree.
 type Node interface {
 	String() string
 	optimize() (Node, error)
+	span() Span
+	setSpan(Span)
+}
+
+// A Span identifies the part of the source expression that a
+// node was parsed from. Start is the byte offset of the node's
+// first character and End is the byte offset just after its
+// last character. All node types embed a Span. Nodes that were
+// not created by the parser have an empty span.
+type Span struct {
+	Start int
+	End   int
+}
+
+func (s Span) span() Span {
+	return s
+}
+
+func (s *Span) setSpan(span Span) {
+	*s = span
+}
+
+// SpanOf returns the part of the source expression that node
+// was parsed from.
+func SpanOf(node Node) Span {
+	return node.span()
 }
 
 // A StringNode represents a string literal.
 type StringNode struct {
+	Span
 	Value string
 }
 
@@ -47,16 +80,28 @@ func (n *StringNode) optimize() (Node, error) {
 }
 
 func (n StringNode) String() string {
-	return fmt.Sprintf("%q", n.Value)
+	return quoteString(n.Value)
 }
 
-// A NumberNode represents a number literal.
+// A NumberNode represents a number literal. Number literals
+// can be written in decimal, with an optional fraction and
+// exponent, or as integers in hexadecimal (0xff), octal (0o17)
+// or binary (0b101).
 type NumberNode struct {
+	Span
 	Value float64
 }
 
 func parseNumber(p *parser, t token) (Node, error) {
 
+	if strings.ContainsRune(t.Value, '_') {
+		return nil, newErrorHint(ErrInvalidNumber, t, "numeric separators (_) are not supported")
+	}
+
+	if len(t.Value) > 1 && t.Value[0] == '0' && isRadixPrefix(rune(t.Value[1])) {
+		return parseInteger(p, t)
+	}
+
 	// Number literals are promoted to type float64.
 	n, err := strconv.ParseFloat(t.Value, 64)
 	if err != nil {
@@ -72,16 +117,73 @@ func parseNumber(p *parser, t token) (Node, error) {
 	}, nil
 }
 
+// parseInteger parses a hexadecimal, octal or binary integer
+// literal. Like jsonata-js (and JavaScript), it silently rounds
+// values that cannot be represented exactly as a float64 to the
+// nearest float64. Values too large to be represented at all
+// are an error.
+func parseInteger(p *parser, t token) (Node, error) {
+
+	var base int
+	var name string
+
+	switch t.Value[1] {
+	case 'x', 'X':
+		base, name = 16, "hexadecimal"
+	case 'o', 'O':
+		base, name = 8, "octal"
+	case 'b', 'B':
+		base, name = 2, "binary"
+	}
+
+	digits := t.Value[2:]
+	if digits == "" {
+		return nil, newErrorHint(ErrInvalidNumber, t, fmt.Sprintf("expected %s digits after %s", name, t.Value))
+	}
+
+	for _, r := range digits {
+		if digitValue(r) >= base {
+			return nil, newErrorHint(ErrInvalidNumber, t, fmt.Sprintf("'%c' is not a valid %s digit", r, name))
+		}
+	}
+
+	i, _ := new(big.Int).SetString(digits, base)
+	n, _ := new(big.Float).SetInt(i).Float64()
+	if math.IsInf(n, 0) {
+		return nil, newError(ErrNumberRange, t)
+	}
+
+	return &NumberNode{
+		Value: n,
+	}, nil
+}
+
+// digitValue returns the value of a digit in bases up to 36.
+// It returns 36 for characters that are not digits.
+func digitValue(r rune) int {
+	switch {
+	case r >= '0' && r <= '9':
+		return int(r - '0')
+	case r >= 'a' && r <= 'z':
+		return int(r-'a') + 10
+	case r >= 'A' && r <= 'Z':
+		return int(r-'A') + 10
+	default:
+		return 36
+	}
+}
+
 func (n *NumberNode) optimize() (Node, error) {
 	return n, nil
 }
 
 func (n NumberNode) String() string {
-	return fmt.Sprintf("%g", n.Value)
+	return formatNumber(n.Value)
 }
 
 // A BooleanNode represents the boolean constant true or false.
 type BooleanNode struct {
+	Span
 	Value bool
 }
 
@@ -112,7 +214,9 @@ func (n BooleanNode) String() string {
 }
 
 // A NullNode represents the JSON null value.
-type NullNode struct{}
+type NullNode struct {
+	Span
+}
 
 func parseNull(p *parser, t token) (Node, error) {
 	return &NullNode{}, nil
@@ -128,6 +232,7 @@ func (NullNode) String() string {
 
 // A RegexNode represents a regular expression.
 type RegexNode struct {
+	Span
 	Value *regexp.Regexp
 }
 
@@ -137,7 +242,7 @@ func parseRegex(p *parser, t token) (Node, error) {
 		return nil, newError(ErrEmptyRegex, t)
 	}
 
-	re, err := regexp.Compile(t.Value)
+	re, err := regexes.compile(t.Value)
 	if err != nil {
 		hint := "unknown error"
 		if e, ok := err.(*syntax.Error); ok {
@@ -166,6 +271,7 @@ func (n RegexNode) String() string {
 
 // A VariableNode represents a JSONata variable.
 type VariableNode struct {
+	Span
 	Name string
 }
 
@@ -185,6 +291,7 @@ func (n VariableNode) String() string {
 
 // A NameNode represents a JSON field name.
 type NameNode struct {
+	Span
 	Value   string
 	escaped bool
 }
@@ -204,12 +311,13 @@ func parseEscapedName(p *parser, t token) (Node, error) {
 
 func (n *NameNode) optimize() (Node, error) {
 	return &PathNode{
+		Span:  n.Span,
 		Steps: []Node{n},
 	}, nil
 }
 
 func (n NameNode) String() string {
-	if n.escaped {
+	if n.escaped || !isPlainName(n.Value) {
 		return fmt.Sprintf("`%s`", n.Value)
 	}
 	return n.Value
@@ -225,9 +333,16 @@ func (n NameNode) Escaped() bool {
 
 // A PathNode represents a JSON object path. It consists of one
 // or more 'steps' or Nodes (most commonly NameNode objects).
+//
+// Tuples is set if the path, or an expression within one of
+// its steps, uses the parent operator or binds a variable. Such
+// paths have to keep track of the context that produced each
+// item.
 type PathNode struct {
+	Span
 	Steps      []Node
 	KeepArrays bool
+	Tuples     bool
 }
 
 func (n *PathNode) optimize() (Node, error) {
@@ -235,7 +350,13 @@ func (n *PathNode) optimize() (Node, error) {
 }
 
 func (n PathNode) String() string {
-	s := joinNodes(n.Steps, ".")
+
+	steps := make([]string, len(n.Steps))
+	for i, step := range n.Steps {
+		steps[i] = operandString(step, lookupBp(typeDot), i > 0)
+	}
+
+	s := strings.Join(steps, ".")
 	if n.KeepArrays {
 		s += "[]"
 	}
@@ -244,12 +365,13 @@ func (n PathNode) String() string {
 
 // A NegationNode represents a numeric negation operation.
 type NegationNode struct {
+	Span
 	RHS Node
 }
 
 func parseNegation(p *parser, t token) (Node, error) {
 	return &NegationNode{
-		RHS: p.parseExpression(p.bp(t.Type)),
+		RHS: p.parseExpression(p.bp(t)),
 	}, nil
 }
 
@@ -266,6 +388,7 @@ func (n *NegationNode) optimize() (Node, error) {
 	// instead of waiting for evaluation.
 	if number, ok := n.RHS.(*NumberNode); ok {
 		return &NumberNode{
+			Span:  n.Span,
 			Value: -number.Value,
 		}, nil
 	}
@@ -274,11 +397,12 @@ func (n *NegationNode) optimize() (Node, error) {
 }
 
 func (n NegationNode) String() string {
-	return fmt.Sprintf("-%s", n.RHS)
+	return fmt.Sprintf("-%s", operandString(n.RHS, lookupBp(typeMinus), true))
 }
 
 // A RangeNode represents the range operator.
 type RangeNode struct {
+	Span
 	LHS Node
 	RHS Node
 }
@@ -306,6 +430,7 @@ func (n RangeNode) String() string {
 
 // An ArrayNode represents an array of items.
 type ArrayNode struct {
+	Span
 	Items []Node
 }
 
@@ -321,10 +446,12 @@ func parseArray(p *parser, t token) (Node, error) {
 
 			p.consume(typeRange, true)
 
+			lhs := item
 			item = &RangeNode{
-				LHS: item,
+				LHS: lhs,
 				RHS: p.parseExpression(0),
 			}
+			item.setSpan(Span{lhs.span().Start, p.end})
 		}
 
 		items = append(items, item)
@@ -362,33 +489,88 @@ func (n ArrayNode) String() string {
 
 // An ObjectNode represents an object, an unordered list of
 // key-value pairs.
+//
+// An object can also contain variable assignments, e.g.
+//
+//	{ $total := Price * Quantity; "total": $total }
+//
+// Assignments are held in Bindings rather than in Pairs. They
+// do not add keys to the object. Entries are separated by
+// commas, or by semicolons if the entry on either side of the
+// separator is an assignment. An assignment may be followed by
+// a semicolon at the end of the object.
 type ObjectNode struct {
+	Span
 	Pairs [][2]Node
+
+	// Bindings holds the variable assignments in the object,
+	// in the order in which they appear.
+	Bindings []ObjectBinding
+}
+
+// An ObjectBinding is a variable assignment in an object
+// constructor. The variable is in scope for the keys and
+// values of the pairs that follow the assignment, and for
+// the assignments that follow it. Assignments are evaluated
+// once, in order, against the object's input as a whole, even
+// in a group-by expression whose keys are evaluated against
+// each input item in turn.
+type ObjectBinding struct {
+	Assignment *AssignmentNode
+
+	// Pair is the number of pairs that precede the assignment,
+	// i.e. the variable is in scope for Pairs[Pair:].
+	Pair int
 }
 
 func parseObject(p *parser, t token) (Node, error) {
 
-	var pairs [][2]Node
+	obj := &ObjectNode{}
+
+	var sep token
+	var prevBinding bool
 
 	for hasItems := p.token.Type != typeBraceClose; hasItems; { // disallow trailing commas
 
 		key := p.parseExpression(0)
-		p.consume(typeColon, true)
-		value := p.parseExpression(0)
 
-		pairs = append(pairs, [2]Node{key, value})
+		// An assignment followed by a colon is a key (whose
+		// value is the assigned value). Otherwise it binds a
+		// variable.
+		assign, isBinding := key.(*AssignmentNode)
+		isBinding = isBinding && p.token.Type != typeColon
 
-		if p.token.Type != typeComma {
+		// Semicolons only separate bindings from other entries.
+		if sep.Type == typeSemicolon && !isBinding && !prevBinding {
+			panic(newErrorHint(ErrUnexpectedToken, sep, typeBraceClose.String()))
+		}
+
+		if isBinding {
+			obj.Bindings = append(obj.Bindings, ObjectBinding{
+				Assignment: assign,
+				Pair:       len(obj.Pairs),
+			})
+		} else {
+			p.consume(typeColon, true)
+			value := p.parseExpression(0)
+			obj.Pairs = append(obj.Pairs, [2]Node{key, value})
+		}
+
+		if p.token.Type != typeComma && p.token.Type != typeSemicolon {
+			break
+		}
+
+		sep, prevBinding = p.token, isBinding
+		p.advance(true)
+
+		if sep.Type == typeSemicolon && isBinding && p.token.Type == typeBraceClose { // allow trailing semicolons
 			break
 		}
-		p.consume(typeComma, true)
 	}
 
 	p.consume(typeBraceClose, false)
 
-	return &ObjectNode{
-		Pairs: pairs,
-	}, nil
+	return obj, nil
 }
 
 func (n *ObjectNode) optimize() (Node, error) {
@@ -404,22 +586,43 @@ func (n *ObjectNode) optimize() (Node, error) {
 		}
 	}
 
+	for i := range n.Bindings {
+		if _, err = n.Bindings[i].Assignment.optimize(); err != nil {
+			return nil, err
+		}
+	}
+
 	return n, nil
 }
 
 func (n ObjectNode) String() string {
 
-	values := make([]string, len(n.Pairs))
+	var b strings.Builder
+
+	sep := ""
+	bindings := n.Bindings
+
+	for i := 0; i <= len(n.Pairs); i++ {
 
-	for i, pair := range n.Pairs {
-		values[i] = fmt.Sprintf("%s: %s", pair[0], pair[1])
+		for len(bindings) > 0 && bindings[0].Pair == i {
+			b.WriteString(sep)
+			b.WriteString(bindings[0].Assignment.String())
+			sep = "; "
+			bindings = bindings[1:]
+		}
+
+		if i < len(n.Pairs) {
+			fmt.Fprintf(&b, "%s%s: %s", sep, n.Pairs[i][0], n.Pairs[i][1])
+			sep = ", "
+		}
 	}
 
-	return fmt.Sprintf("{%s}", strings.Join(values, ", "))
+	return fmt.Sprintf("{%s}", b.String())
 }
 
 // A BlockNode represents a block expression.
 type BlockNode struct {
+	Span
 	Exprs []Node
 }
 
@@ -463,7 +666,9 @@ func (n BlockNode) String() string {
 }
 
 // A WildcardNode represents the wildcard operator.
-type WildcardNode struct{}
+type WildcardNode struct {
+	Span
+}
 
 func parseWildcard(p *parser, t token) (Node, error) {
 	return &WildcardNode{}, nil
@@ -478,7 +683,9 @@ func (WildcardNode) String() string {
 }
 
 // A DescendentNode represents the descendent operator.
-type DescendentNode struct{}
+type DescendentNode struct {
+	Span
+}
 
 func parseDescendent(p *parser, t token) (Node, error) {
 	return &DescendentNode{}, nil
@@ -492,9 +699,27 @@ func (DescendentNode) String() string {
 	return "**"
 }
 
+// A ParentNode represents the parent operator.
+type ParentNode struct {
+	Span
+}
+
+func parseParent(p *parser, t token) (Node, error) {
+	return &ParentNode{}, nil
+}
+
+func (n *ParentNode) optimize() (Node, error) {
+	return n, nil
+}
+
+func (ParentNode) String() string {
+	return "%"
+}
+
 // An ObjectTransformationNode represents the object transformation
 // operator.
 type ObjectTransformationNode struct {
+	Span
 	Pattern Node
 	Updates Node
 	Deletes Node
@@ -802,6 +1027,18 @@ func parseParams(s string) ([]Param, error) {
 	return params, nil
 }
 
+// ParseSignature parses a function type signature such as
+// "<s-n?:s>" and returns its parameters. The enclosing angle
+// brackets are optional. The return type, if any, is ignored.
+func ParseSignature(sig string) ([]Param, error) {
+
+	if strings.HasPrefix(sig, "<") && strings.HasSuffix(sig, ">") {
+		sig = sig[1 : len(sig)-1]
+	}
+
+	return parseParams(sig)
+}
+
 func getBracketedString(s string, open, close rune) string {
 
 	var depth int
@@ -829,9 +1066,16 @@ func getBracketedString(s string, open, close rune) string {
 }
 
 // A LambdaNode represents a user-defined JSONata function.
+//
+// ParamNames holds the name of each parameter. Parameters
+// that destructure their argument, e.g. [$a, $b], have an
+// empty name and a corresponding entry in Patterns. Patterns
+// is nil if none of the parameters are patterns.
 type LambdaNode struct {
+	Span
 	Body       Node
 	ParamNames []string
+	Patterns   []Node
 	shorthand  bool
 }
 
@@ -854,12 +1098,64 @@ func (n LambdaNode) String() string {
 		name = "λ"
 	}
 
+	return fmt.Sprintf("%s(%s){%s}", name, n.paramString(), n.Body)
+}
+
+func (n LambdaNode) paramString() string {
+
 	params := make([]string, len(n.ParamNames))
 	for i, s := range n.ParamNames {
+		if pattern := n.pattern(i); pattern != nil {
+			params[i] = pattern.String()
+			continue
+		}
 		params[i] = "$" + s
 	}
 
-	return fmt.Sprintf("%s(%s){%s}", name, strings.Join(params, ", "), n.Body)
+	return strings.Join(params, ", ")
+}
+
+// pattern returns the destructuring pattern for the parameter
+// at index i, or nil if the parameter is a plain variable.
+func (n LambdaNode) pattern(i int) Node {
+	if i >= len(n.Patterns) {
+		return nil
+	}
+	return n.Patterns[i]
+}
+
+// BoundNames returns the names of the variables bound by the
+// lambda's parameters, including the variables in any
+// destructuring patterns.
+func (n LambdaNode) BoundNames() []string {
+
+	var names []string
+
+	for i, name := range n.ParamNames {
+		if pattern := n.pattern(i); pattern != nil {
+			names = appendPatternNames(names, pattern)
+			continue
+		}
+		names = append(names, name)
+	}
+
+	return names
+}
+
+func appendPatternNames(names []string, pattern Node) []string {
+	switch pattern := pattern.(type) {
+	case *VariableNode:
+		names = append(names, pattern.Name)
+	case *ArrayPatternNode:
+		for _, item := range pattern.Items {
+			names = appendPatternNames(names, item)
+		}
+	case *ObjectPatternNode:
+		for _, field := range pattern.Fields {
+			names = appendPatternNames(names, field.Value)
+		}
+	}
+	return names
 }
 
 // Shorthand returns true if the lambda function was defined
@@ -873,6 +1169,7 @@ func (n LambdaNode) Shorthand() bool {
 // A TypedLambdaNode represents a user-defined JSONata function
 // with a type signature.
 type TypedLambdaNode struct {
+	Span
 	*LambdaNode
 	In  []Param
 	Out []Param
@@ -896,23 +1193,81 @@ func (n TypedLambdaNode) String() string {
 		name = "λ"
 	}
 
-	params := make([]string, len(n.ParamNames))
-	for i, s := range n.ParamNames {
-		params[i] = "$" + s
-	}
-
 	inputs := make([]string, len(n.In))
 	for i, p := range n.In {
 		inputs[i] = p.String()
 	}
 
-	return fmt.Sprintf("%s(%s)<%s>{%s}", name, strings.Join(params, ", "), strings.Join(inputs, ""), n.Body)
+	sig := strings.Join(inputs, "")
+	if len(n.Out) > 0 {
+		sig += ":"
+		for _, p := range n.Out {
+			sig += p.String()
+		}
+	}
+
+	return fmt.Sprintf("%s(%s)<%s>{%s}", name, n.paramString(), sig, n.Body)
+}
+
+// An ArrayPatternNode represents a lambda parameter that
+// destructures an array, e.g. the parameter [$a, $b] in
+//
+//	function([$a, $b]){ $a + $b }
+//
+// Each item is a VariableNode or a nested pattern.
+type ArrayPatternNode struct {
+	Span
+	Items []Node
+}
+
+func (n *ArrayPatternNode) optimize() (Node, error) {
+	return n, nil
+}
+
+func (n ArrayPatternNode) String() string {
+	return fmt.Sprintf("[%s]", joinNodes(n.Items, ", "))
+}
+
+// An ObjectPatternNode represents a lambda parameter that
+// destructures an object, e.g. the parameter {"price": $p}
+// in
+//
+//	function({"price": $p}){ $p * 2 }
+type ObjectPatternNode struct {
+	Span
+	Fields []PatternField
+}
+
+// A PatternField is a key in an ObjectPatternNode and the
+// VariableNode or nested pattern that its value is bound to.
+type PatternField struct {
+	Key   string
+	Value Node
+}
+
+func (n *ObjectPatternNode) optimize() (Node, error) {
+	return n, nil
+}
+
+func (n ObjectPatternNode) String() string {
+
+	values := make([]string, len(n.Fields))
+
+	for i, field := range n.Fields {
+		values[i] = fmt.Sprintf("%s: %s", quoteString(field.Key), field.Value)
+	}
+
+	return fmt.Sprintf("{%s}", strings.Join(values, ", "))
 }
 
 // A PartialNode represents a partially applied function.
+// Position is the byte offset of the opening parenthesis
+// of the argument list in the source expression.
 type PartialNode struct {
-	Func Node
-	Args []Node
+	Span
+	Func     Node
+	Args     []Node
+	Position int
 }
 
 func (n *PartialNode) optimize() (Node, error) {
@@ -935,12 +1290,14 @@ func (n *PartialNode) optimize() (Node, error) {
 }
 
 func (n PartialNode) String() string {
-	return fmt.Sprintf("%s(%s)", n.Func, joinNodes(n.Args, ", "))
+	return fmt.Sprintf("%s(%s)", operandString(n.Func, lookupBp(typeParenOpen), false), joinNodes(n.Args, ", "))
 }
 
 // A PlaceholderNode represents a placeholder argument
 // in a partially applied function.
-type PlaceholderNode struct{}
+type PlaceholderNode struct {
+	Span
+}
 
 func (n *PlaceholderNode) optimize() (Node, error) {
 	return n, nil
@@ -951,9 +1308,13 @@ func (PlaceholderNode) String() string {
 }
 
 // A FunctionCallNode represents a call to a function.
+// Position is the byte offset of the opening parenthesis
+// of the argument list in the source expression.
 type FunctionCallNode struct {
-	Func Node
-	Args []Node
+	Span
+	Func     Node
+	Args     []Node
+	Position int
 }
 
 const typePlaceholder = typeCondition
@@ -961,7 +1322,7 @@ const typePlaceholder = typeCondition
 func parseFunctionCall(p *parser, t token, lhs Node) (Node, error) {
 
 	if isLambda, shorthand := isLambdaName(lhs); isLambda {
-		return parseLambdaDefinition(p, shorthand)
+		return parseLambdaDefinition(p, lhs, shorthand)
 	}
 
 	var args []Node
@@ -973,8 +1334,11 @@ func parseFunctionCall(p *parser, t token, lhs Node) (Node, error) {
 
 		if p.token.Type == typePlaceholder {
 			isPartial = true
-			arg = &PlaceholderNode{}
+			start := p.start
 			p.consume(typePlaceholder, true)
+			arg = &PlaceholderNode{
+				Span: Span{start, p.end},
+			}
 		} else {
 			arg = p.parseExpression(0)
 		}
@@ -991,14 +1355,16 @@ func parseFunctionCall(p *parser, t token, lhs Node) (Node, error) {
 
 	if isPartial {
 		return &PartialNode{
-			Func: lhs,
-			Args: args,
+			Func:     lhs,
+			Args:     args,
+			Position: t.Position,
 		}, nil
 	}
 
 	return &FunctionCallNode{
-		Func: lhs,
-		Args: args,
+		Func:     lhs,
+		Args:     args,
+		Position: t.Position,
 	}, nil
 }
 
@@ -1022,7 +1388,7 @@ func (n *FunctionCallNode) optimize() (Node, error) {
 }
 
 func (n FunctionCallNode) String() string {
-	return fmt.Sprintf("%s(%s)", n.Func, joinNodes(n.Args, ", "))
+	return fmt.Sprintf("%s(%s)", operandString(n.Func, lookupBp(typeParenOpen), false), joinNodes(n.Args, ", "))
 }
 
 func isLambdaName(n Node) (bool, bool) {
@@ -1034,11 +1400,11 @@ func isLambdaName(n Node) (bool, bool) {
 	}
 }
 
-func parseLambdaDefinition(p *parser, shorthand bool) (Node, error) {
+func parseLambdaDefinition(p *parser, name Node, shorthand bool) (Node, error) {
 
 	var params []Param
 
-	paramNames, err := extractParamNames(p)
+	paramNames, patterns, err := extractParams(p)
 	if err != nil {
 		return nil, err
 	}
@@ -1059,8 +1425,10 @@ func parseLambdaDefinition(p *parser, shorthand bool) (Node, error) {
 	p.consume(typeBraceClose, true)
 
 	lambda := &LambdaNode{
+		Span:       Span{name.span().Start, p.end},
 		Body:       body,
 		ParamNames: paramNames,
+		Patterns:   patterns,
 		shorthand:  shorthand,
 	}
 
@@ -1069,14 +1437,17 @@ func parseLambdaDefinition(p *parser, shorthand bool) (Node, error) {
 	}
 
 	return &TypedLambdaNode{
+		Span:       lambda.Span,
 		LambdaNode: lambda,
 		In:         params,
 	}, nil
 }
 
-func extractParamNames(p *parser) ([]string, error) {
+func extractParams(p *parser) ([]string, []Node, error) {
 
 	var names []string
+	var patterns []Node
+	var hasPatterns bool
 	usedNames := map[string]bool{}
 
 	currToken := p.token
@@ -1084,17 +1455,27 @@ func extractParamNames(p *parser) ([]string, error) {
 
 		arg := p.parseExpression(0)
 
-		v, ok := arg.(*VariableNode)
-		if !ok {
-			return nil, newError(ErrIllegalParam, currToken)
-		}
+		switch arg := arg.(type) {
+		case *VariableNode:
+			if usedNames[arg.Name] {
+				return nil, nil, newError(ErrDuplicateParam, currToken)
+			}
+			usedNames[arg.Name] = true
+			names = append(names, arg.Name)
+			patterns = append(patterns, nil)
 
-		if usedNames[v.Name] {
-			return nil, newError(ErrDuplicateParam, currToken)
-		}
+		case *ArrayNode, *ObjectNode:
+			pattern, err := p.newPattern(arg, usedNames)
+			if err != nil {
+				return nil, nil, err
+			}
+			names = append(names, "")
+			patterns = append(patterns, pattern)
+			hasPatterns = true
 
-		usedNames[v.Name] = true
-		names = append(names, v.Name)
+		default:
+			return nil, nil, newError(ErrIllegalParam, currToken)
+		}
 
 		if p.token.Type != typeComma {
 			break
@@ -1106,7 +1487,83 @@ func extractParamNames(p *parser) ([]string, error) {
 
 	p.consume(typeParenClose, false)
 
-	return names, nil
+	if !hasPatterns {
+		patterns = nil
+	}
+
+	return names, patterns, nil
+}
+
+// newPattern converts an array or object constructor in a
+// parameter list to a destructuring pattern. Array items and
+// object values must be variables or nested patterns. Object
+// keys must be string literals.
+func (p *parser) newPattern(node Node, usedNames map[string]bool) (Node, error) {
+
+	switch node := node.(type) {
+	case *VariableNode:
+		if usedNames[node.Name] {
+			// Match the token that the lexer produces for a
+			// variable, which excludes the leading $.
+			return nil, newError(ErrDuplicateParam, token{
+				Value:    node.Name,
+				Position: node.Start + 1,
+			})
+		}
+		usedNames[node.Name] = true
+		return node, nil
+
+	case *ArrayNode:
+		items := make([]Node, len(node.Items))
+		for i, item := range node.Items {
+			pattern, err := p.newPattern(item, usedNames)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = pattern
+		}
+		return &ArrayPatternNode{
+			Span:  node.Span,
+			Items: items,
+		}, nil
+
+	case *ObjectNode:
+		if len(node.Bindings) > 0 {
+			return nil, newError(ErrIllegalPatternKey, p.nodeToken(node.Bindings[0].Assignment))
+		}
+		fields := make([]PatternField, len(node.Pairs))
+		for i, pair := range node.Pairs {
+			key, ok := pair[0].(*StringNode)
+			if !ok {
+				return nil, newError(ErrIllegalPatternKey, p.nodeToken(pair[0]))
+			}
+			pattern, err := p.newPattern(pair[1], usedNames)
+			if err != nil {
+				return nil, err
+			}
+			fields[i] = PatternField{
+				Key:   key.Value,
+				Value: pattern,
+			}
+		}
+		return &ObjectPatternNode{
+			Span:   node.Span,
+			Fields: fields,
+		}, nil
+
+	default:
+		return nil, newError(ErrIllegalParam, p.nodeToken(node))
+	}
+}
+
+// nodeToken returns a token holding the source text of a
+// node, for use in error messages.
+func (p *parser) nodeToken(node Node) token {
+	span := node.span()
+	return token{
+		Value:    p.lexer.input[span.Start:span.End],
+		Position: span.Start,
+	}
 }
 
 func extractSignature(p *parser) (string, bool) {
@@ -1147,6 +1604,7 @@ Loop:
 
 // A PredicateNode represents a predicate expression.
 type PredicateNode struct {
+	Span
 	Expr    Node
 	Filters []Node
 }
@@ -1156,11 +1614,18 @@ func (n *PredicateNode) optimize() (Node, error) {
 }
 
 func (n PredicateNode) String() string {
-	return fmt.Sprintf("%s[%s]", n.Expr, joinNodes(n.Filters, ", "))
+
+	s := operandString(n.Expr, lookupBp(typeBracketOpen), false)
+	for _, filter := range n.Filters {
+		s += fmt.Sprintf("[%s]", filter)
+	}
+
+	return s
 }
 
 // A GroupNode represents a group expression.
 type GroupNode struct {
+	Span
 	Expr Node
 	*ObjectNode
 }
@@ -1172,6 +1637,10 @@ func parseGroup(p *parser, t token, lhs Node) (Node, error) {
 		return nil, err
 	}
 
+	// The object is not parsed by parseExpression, so set
+	// its span here.
+	obj.setSpan(Span{t.Position, p.end})
+
 	return &GroupNode{
 		Expr:       lhs,
 		ObjectNode: obj.(*ObjectNode),
@@ -1204,11 +1673,12 @@ func (n *GroupNode) optimize() (Node, error) {
 }
 
 func (n GroupNode) String() string {
-	return fmt.Sprintf("%s%s", n.Expr, n.ObjectNode)
+	return fmt.Sprintf("%s%s", operandString(n.Expr, lookupBp(typeBraceOpen), false), n.ObjectNode)
 }
 
 // A ConditionalNode represents an if-then-else expression.
 type ConditionalNode struct {
+	Span
 	If   Node
 	Then Node
 	Else Node
@@ -1257,7 +1727,7 @@ func (n *ConditionalNode) optimize() (Node, error) {
 
 func (n ConditionalNode) String() string {
 
-	s := fmt.Sprintf("%s ? %s", n.If, n.Then)
+	s := fmt.Sprintf("%s ? %s", operandString(n.If, lookupBp(typeCondition), true), n.Then)
 	if n.Else != nil {
 		s += fmt.Sprintf(" : %s", n.Else)
 	}
@@ -1265,8 +1735,46 @@ func (n ConditionalNode) String() string {
 	return s
 }
 
+// A CoalesceNode represents the default value operator, which
+// returns its left hand side unless it evaluates to undefined
+// or null, in which case it returns its right hand side.
+type CoalesceNode struct {
+	Span
+	LHS Node
+	RHS Node
+}
+
+func parseCoalesce(p *parser, t token, lhs Node) (Node, error) {
+	return &CoalesceNode{
+		LHS: lhs,
+		RHS: p.parseExpression(p.bp(t) - 1), // right-associative
+	}, nil
+}
+
+func (n *CoalesceNode) optimize() (Node, error) {
+
+	var err error
+
+	n.LHS, err = n.LHS.optimize()
+	if err != nil {
+		return nil, err
+	}
+
+	n.RHS, err = n.RHS.optimize()
+	if err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+func (n CoalesceNode) String() string {
+	return binaryString(n.LHS, "?:", n.RHS, typeCoalesce, true)
+}
+
 // An AssignmentNode represents a variable assignment.
 type AssignmentNode struct {
+	Span
 	Name  string
 	Value Node
 }
@@ -1280,7 +1788,7 @@ func parseAssignment(p *parser, t token, lhs Node) (Node, error) {
 
 	return &AssignmentNode{
 		Name:  v.Name,
-		Value: p.parseExpression(p.bp(t.Type) - 1), // right-associative
+		Value: p.parseExpression(p.bp(t) - 1), // right-associative
 	}, nil
 }
 
@@ -1333,6 +1841,7 @@ func (op NumericOperator) String() string {
 
 // A NumericOperatorNode represents a numeric operation.
 type NumericOperatorNode struct {
+	Span
 	Type NumericOperator
 	LHS  Node
 	RHS  Node
@@ -1360,7 +1869,7 @@ func parseNumericOperator(p *parser, t token, lhs Node) (Node, error) {
 	return &NumericOperatorNode{
 		Type: op,
 		LHS:  lhs,
-		RHS:  p.parseExpression(p.bp(t.Type)),
+		RHS:  p.parseExpression(p.bp(t)),
 	}, nil
 }
 
@@ -1382,7 +1891,13 @@ func (n *NumericOperatorNode) optimize() (Node, error) {
 }
 
 func (n NumericOperatorNode) String() string {
-	return fmt.Sprintf("%s %s %s", n.LHS, n.Type, n.RHS)
+
+	tt := typeMult
+	if n.Type == NumericAdd || n.Type == NumericSubtract {
+		tt = typePlus
+	}
+
+	return binaryString(n.LHS, n.Type.String(), n.RHS, tt, false)
 }
 
 // A ComparisonOperator is an operation that compares two values.
@@ -1423,6 +1938,7 @@ func (op ComparisonOperator) String() string {
 
 // A ComparisonOperatorNode represents a comparison operation.
 type ComparisonOperatorNode struct {
+	Span
 	Type ComparisonOperator
 	LHS  Node
 	RHS  Node
@@ -1454,7 +1970,7 @@ func parseComparisonOperator(p *parser, t token, lhs Node) (Node, error) {
 	return &ComparisonOperatorNode{
 		Type: op,
 		LHS:  lhs,
-		RHS:  p.parseExpression(p.bp(t.Type)),
+		RHS:  p.parseExpression(p.bp(t)),
 	}, nil
 }
 
@@ -1476,7 +1992,7 @@ func (n *ComparisonOperatorNode) optimize() (Node, error) {
 }
 
 func (n ComparisonOperatorNode) String() string {
-	return fmt.Sprintf("%s %s %s", n.LHS, n.Type, n.RHS)
+	return binaryString(n.LHS, n.Type.String(), n.RHS, typeEqual, false)
 }
 
 // A BooleanOperator is a logical AND or OR operation between
@@ -1503,6 +2019,7 @@ func (op BooleanOperator) String() string {
 
 // A BooleanOperatorNode represents a boolean operation.
 type BooleanOperatorNode struct {
+	Span
 	Type BooleanOperator
 	LHS  Node
 	RHS  Node
@@ -1524,7 +2041,7 @@ func parseBooleanOperator(p *parser, t token, lhs Node) (Node, error) {
 	return &BooleanOperatorNode{
 		Type: op,
 		LHS:  lhs,
-		RHS:  p.parseExpression(p.bp(t.Type)),
+		RHS:  p.parseExpression(p.bp(t)),
 	}, nil
 }
 
@@ -1546,12 +2063,19 @@ func (n *BooleanOperatorNode) optimize() (Node, error) {
 }
 
 func (n BooleanOperatorNode) String() string {
-	return fmt.Sprintf("%s %s %s", n.LHS, n.Type, n.RHS)
+
+	tt := typeAnd
+	if n.Type == BooleanOr {
+		tt = typeOr
+	}
+
+	return binaryString(n.LHS, n.Type.String(), n.RHS, tt, false)
 }
 
 // A StringConcatenationNode represents a string concatenation
 // operation.
 type StringConcatenationNode struct {
+	Span
 	LHS Node
 	RHS Node
 }
@@ -1559,7 +2083,7 @@ type StringConcatenationNode struct {
 func parseStringConcatenation(p *parser, t token, lhs Node) (Node, error) {
 	return &StringConcatenationNode{
 		LHS: lhs,
-		RHS: p.parseExpression(p.bp(t.Type)),
+		RHS: p.parseExpression(p.bp(t)),
 	}, nil
 }
 
@@ -1581,7 +2105,54 @@ func (n *StringConcatenationNode) optimize() (Node, error) {
 }
 
 func (n StringConcatenationNode) String() string {
-	return fmt.Sprintf("%s & %s", n.LHS, n.RHS)
+	return binaryString(n.LHS, "&", n.RHS, typeConcat, false)
+}
+
+// A CustomOperatorNode represents an infix operator defined
+// by the caller (see ParseWithOperators). Position is the byte
+// offset of the operator symbol in the source expression.
+type CustomOperatorNode struct {
+	Span
+	Symbol       string
+	BindingPower int
+	LHS          Node
+	RHS          Node
+	Position     int
+}
+
+func parseCustomOperator(p *parser, t token, lhs Node) (Node, error) {
+	bp := p.bp(t)
+	return &CustomOperatorNode{
+		Symbol:       t.Value,
+		BindingPower: bp,
+		LHS:          lhs,
+		RHS:          p.parseExpression(bp),
+		Position:     t.Position,
+	}, nil
+}
+
+func (n *CustomOperatorNode) optimize() (Node, error) {
+
+	var err error
+
+	n.LHS, err = n.LHS.optimize()
+	if err != nil {
+		return nil, err
+	}
+
+	n.RHS, err = n.RHS.optimize()
+	if err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+func (n CustomOperatorNode) String() string {
+	return fmt.Sprintf("%s %s %s",
+		operandString(n.LHS, n.BindingPower, false),
+		n.Symbol,
+		operandString(n.RHS, n.BindingPower, true))
 }
 
 // SortDir describes the sort order of a sort operation.
@@ -1603,6 +2174,7 @@ type SortTerm struct {
 
 // A SortNode represents a sort clause on a JSONata path step.
 type SortNode struct {
+	Span
 	Expr  Node
 	Terms []SortTerm
 }
@@ -1681,12 +2253,13 @@ func (n SortNode) String() string {
 		terms[i] = sym + t.Expr.String()
 	}
 
-	return fmt.Sprintf("%s^(%s)", n.Expr, strings.Join(terms, ", "))
+	return fmt.Sprintf("%s^(%s)", operandString(n.Expr, lookupBp(typeSort), false), strings.Join(terms, ", "))
 }
 
 // A FunctionApplicationNode represents a function application
 // operation.
 type FunctionApplicationNode struct {
+	Span
 	LHS Node
 	RHS Node
 }
@@ -1694,7 +2267,7 @@ type FunctionApplicationNode struct {
 func parseFunctionApplication(p *parser, t token, lhs Node) (Node, error) {
 	return &FunctionApplicationNode{
 		LHS: lhs,
-		RHS: p.parseExpression(p.bp(t.Type)),
+		RHS: p.parseExpression(p.bp(t)),
 	}, nil
 }
 
@@ -1716,13 +2289,89 @@ func (n *FunctionApplicationNode) optimize() (Node, error) {
 }
 
 func (n FunctionApplicationNode) String() string {
-	return fmt.Sprintf("%s ~> %s", n.LHS, n.RHS)
+	return binaryString(n.LHS, "~>", n.RHS, typeApply, false)
+}
+
+// A PositionalBindingNode represents a path step that binds the
+// position of each of its items to a variable, e.g. books#$i.
+// The variable is visible to the rest of the path.
+type PositionalBindingNode struct {
+	Span
+	Expr Node
+	Name string
+}
+
+func parsePositionalBinding(p *parser, t token, lhs Node) (Node, error) {
+
+	name := p.token.Value
+	p.consume(typeVariable, false)
+
+	return &PositionalBindingNode{
+		Expr: lhs,
+		Name: name,
+	}, nil
+}
+
+func (n *PositionalBindingNode) optimize() (Node, error) {
+
+	path, step, err := optimizeBinding(n.Expr)
+	if err != nil {
+		return nil, err
+	}
+
+	n.Expr = step
+	path.Steps[len(path.Steps)-1] = n
+	path.Span = n.Span
+	return path, nil
+}
+
+func (n PositionalBindingNode) String() string {
+	return fmt.Sprintf("%s#$%s", operandString(n.Expr, lookupBp(typePosition), false), n.Name)
+}
+
+// A ContextBindingNode represents a path step that binds each
+// of its items to a variable, e.g. books@$b. Unlike other path
+// steps, it does not change the context item, so the next step
+// is evaluated against the same input as this one.
+type ContextBindingNode struct {
+	Span
+	Expr Node
+	Name string
+}
+
+func parseContextBinding(p *parser, t token, lhs Node) (Node, error) {
+
+	name := p.token.Value
+	p.consume(typeVariable, false)
+
+	return &ContextBindingNode{
+		Expr: lhs,
+		Name: name,
+	}, nil
+}
+
+func (n *ContextBindingNode) optimize() (Node, error) {
+
+	path, step, err := optimizeBinding(n.Expr)
+	if err != nil {
+		return nil, err
+	}
+
+	n.Expr = step
+	path.Steps[len(path.Steps)-1] = n
+	path.Span = n.Span
+	return path, nil
+}
+
+func (n ContextBindingNode) String() string {
+	return fmt.Sprintf("%s@$%s", operandString(n.Expr, lookupBp(typeContextBind), false), n.Name)
 }
 
 // A dotNode is an interim structure used to process JSONata path
 // expressions. It is deliberately unexported and creates a PathNode
 // during its optimize phase.
 type dotNode struct {
+	Span
 	lhs Node
 	rhs Node
 }
@@ -1730,13 +2379,15 @@ type dotNode struct {
 func parseDot(p *parser, t token, lhs Node) (Node, error) {
 	return &dotNode{
 		lhs: lhs,
-		rhs: p.parseExpression(p.bp(t.Type)),
+		rhs: p.parseExpression(p.bp(t)),
 	}, nil
 }
 
 func (n *dotNode) optimize() (Node, error) {
 
-	path := &PathNode{}
+	path := &PathNode{
+		Span: n.Span,
+	}
 
 	lhs, err := n.lhs.optimize()
 	if err != nil {
@@ -1791,6 +2442,7 @@ func (n dotNode) String() string {
 // processing path expressions. It is deliberately unexported
 // and gets converted into a PathNode during optimization.
 type singletonArrayNode struct {
+	Span
 	lhs Node
 }
 
@@ -1804,9 +2456,11 @@ func (n *singletonArrayNode) optimize() (Node, error) {
 	switch lhs := lhs.(type) {
 	case *PathNode:
 		lhs.KeepArrays = true
+		lhs.Span = n.Span
 		return lhs, nil
 	default:
 		return &PathNode{
+			Span:       n.Span,
 			Steps:      []Node{lhs},
 			KeepArrays: true,
 		}, nil
@@ -1821,6 +2475,7 @@ func (n singletonArrayNode) String() string {
 // predicate expressions. It is deliberately unexported and gets
 // converted into a PredicateNode during optimization.
 type predicateNode struct {
+	Span
 	lhs Node // the context for this predicate
 	rhs Node // the predicate expression
 }
@@ -1869,16 +2524,20 @@ func (n *predicateNode) optimize() (Node, error) {
 		switch last := lhs.Steps[i].(type) {
 		case *PredicateNode:
 			last.Filters = append(last.Filters, rhs)
+			last.End = n.End
 		default:
 			step := &PredicateNode{
+				Span:    Span{last.span().Start, n.End},
 				Expr:    last,
 				Filters: []Node{rhs},
 			}
 			lhs.Steps = append(lhs.Steps[:i], step)
 		}
+		lhs.Span = n.Span
 		return lhs, nil
 	default:
 		return &PredicateNode{
+			Span:    n.Span,
 			Expr:    lhs,
 			Filters: []Node{rhs},
 		}, nil
@@ -1889,8 +2548,356 @@ func (n *predicateNode) String() string {
 	return fmt.Sprintf("%s[%s]", n.lhs, n.rhs)
 }
 
+// Walk traverses a syntax tree in depth-first order. It calls
+// visitor for node and, if visitor returns true, walks each of
+// the node's children in turn. Children include the nodes held
+// by compound fields such as object pairs, sort terms, the
+// embedded ObjectNode of a GroupNode, the body of a
+// TypedLambdaNode and the parameter patterns of a lambda.
+// Nil nodes are skipped.
+//
+// Walk does not modify the tree. Callers that modify nodes
+// during a walk do so at their own risk.
+func Walk(node Node, visitor func(Node) bool) {
+
+	if node == nil || !visitor(node) {
+		return
+	}
+
+	for _, child := range childNodes(node) {
+		Walk(child, visitor)
+	}
+}
+
+// String helpers
+
+// maxPrecedence is the precedence of nodes that are not
+// operators, e.g. literals and names.
+const maxPrecedence = math.MaxInt32
+
+// precedence returns the binding power of the operator that
+// produces the given node. This determines whether the node
+// needs parentheses when it is an operand of another operator.
+func precedence(node Node) int {
+	switch n := node.(type) {
+	case *PathNode:
+		if len(n.Steps) == 1 {
+			return precedence(n.Steps[0])
+		}
+		return lookupBp(typeDot)
+	case *NumberNode:
+		if math.Signbit(n.Value) {
+			// Negative numbers are written with a leading
+			// minus sign, which parses as negation.
+			return lookupBp(typeMinus)
+		}
+	case *NegationNode:
+		return lookupBp(typeMinus)
+	case *NumericOperatorNode:
+		if n.Type == NumericAdd || n.Type == NumericSubtract {
+			return lookupBp(typePlus)
+		}
+		return lookupBp(typeMult)
+	case *StringConcatenationNode:
+		return lookupBp(typeConcat)
+	case *CustomOperatorNode:
+		return n.BindingPower
+	case *ComparisonOperatorNode:
+		return lookupBp(typeEqual)
+	case *SortNode:
+		return lookupBp(typeSort)
+	case *FunctionApplicationNode:
+		return lookupBp(typeApply)
+	case *BooleanOperatorNode:
+		if n.Type == BooleanOr {
+			return lookupBp(typeOr)
+		}
+		return lookupBp(typeAnd)
+	case *ConditionalNode:
+		return lookupBp(typeCondition)
+	case *CoalesceNode:
+		return lookupBp(typeCoalesce)
+	case *AssignmentNode:
+		return lookupBp(typeAssign)
+	case *GroupNode:
+		return lookupBp(typeBraceOpen)
+	case *PredicateNode, *FunctionCallNode, *PartialNode,
+		*PositionalBindingNode, *ContextBindingNode:
+		return lookupBp(typeParenOpen)
+	}
+
+	return maxPrecedence
+}
+
+// operandString returns the string form of a node that is an
+// operand of an operator with binding power bp. The node is
+// enclosed in parentheses if it binds less tightly than the
+// operator. If strict is true, nodes that bind equally tightly
+// are also enclosed in parentheses (e.g. the right hand side
+// of a left-associative operator).
+//
+// Negations on the right hand side of an operator are never
+// enclosed in parentheses because the parser reads them as
+// prefixes. Likewise, postfix operations (e.g. sorts and
+// predicates) are never enclosed in parentheses on the left
+// hand side of an operator.
+func operandString(node Node, bp int, strict bool) string {
+
+	if !strict && isPostfix(node) {
+		return node.String()
+	}
+
+	prec := precedence(node)
+
+	if strict && prec == lookupBp(typeMinus) {
+		switch node.(type) {
+		case *NegationNode, *NumberNode:
+			return node.String()
+		}
+	}
+
+	if prec < bp || (strict && prec == bp) {
+		return fmt.Sprintf("(%s)", node)
+	}
+
+	return node.String()
+}
+
+// isPostfix returns true if node is an operation that follows
+// its operand and ends with a closing bracket or a variable.
+// Further operators can follow such nodes without changing
+// the way that they are parsed.
+func isPostfix(node Node) bool {
+	switch n := node.(type) {
+	case *PathNode:
+		return len(n.Steps) == 1 && !n.KeepArrays && isPostfix(n.Steps[0])
+	case *SortNode, *GroupNode, *PredicateNode, *FunctionCallNode,
+		*PartialNode, *PositionalBindingNode, *ContextBindingNode:
+		return true
+	default:
+		return false
+	}
+}
+
+// binaryString returns the string form of a binary operation,
+// adding parentheses to the operands where they are needed to
+// preserve the structure of the syntax tree.
+func binaryString(lhs Node, op string, rhs Node, tt tokenType, rightAssoc bool) string {
+
+	bp := lookupBp(tt)
+
+	return fmt.Sprintf("%s %s %s",
+		operandString(lhs, bp, rightAssoc),
+		op,
+		operandString(rhs, bp, !rightAssoc))
+}
+
+// formatNumber returns the shortest string that parses to the
+// given number. Integers below 1e21 are written without an
+// exponent, like JavaScript.
+func formatNumber(f float64) string {
+	if f == math.Trunc(f) && math.Abs(f) < 1e21 {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// quoteString returns a JSONata string literal for s. Unlike
+// strconv.Quote, it only uses escape sequences that JSONata
+// supports.
+func quoteString(s string) string {
+
+	var b strings.Builder
+
+	b.WriteByte('"')
+
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(&b, `\u%04x`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+
+	b.WriteByte('"')
+
+	return b.String()
+}
+
+// isPlainName returns true if s can be written as a field name
+// without backticks.
+func isPlainName(s string) bool {
+
+	l := newLexer(s)
+
+	switch t := l.next(false); t.Type {
+	case typeName, typeAnd, typeOr, typeIn:
+		// The keywords and, or and in are parsed as names
+		// when they appear in place of a value.
+		if t.Value != s {
+			return false
+		}
+	default:
+		return false
+	}
+
+	return l.next(false).Type == typeEOF
+}
+
 // Helpers
 
+// childNodes returns the immediate children of a node.
+func childNodes(node Node) []Node {
+
+	var nodes []Node
+
+	add := func(ns ...Node) {
+		for _, n := range ns {
+			if n != nil {
+				nodes = append(nodes, n)
+			}
+		}
+	}
+
+	switch n := node.(type) {
+	case *PathNode:
+		add(n.Steps...)
+	case *NegationNode:
+		add(n.RHS)
+	case *RangeNode:
+		add(n.LHS, n.RHS)
+	case *ArrayNode:
+		add(n.Items...)
+	case *ObjectNode:
+		for _, b := range n.Bindings {
+			add(b.Assignment)
+		}
+		for _, pair := range n.Pairs {
+			add(pair[0], pair[1])
+		}
+	case *BlockNode:
+		add(n.Exprs...)
+	case *ObjectTransformationNode:
+		add(n.Pattern, n.Updates, n.Deletes)
+	case *LambdaNode:
+		add(n.Patterns...)
+		add(n.Body)
+	case *TypedLambdaNode:
+		add(n.Patterns...)
+		add(n.Body)
+	case *ArrayPatternNode:
+		add(n.Items...)
+	case *ObjectPatternNode:
+		for _, field := range n.Fields {
+			add(field.Value)
+		}
+	case *PartialNode:
+		add(n.Func)
+		add(n.Args...)
+	case *FunctionCallNode:
+		add(n.Func)
+		add(n.Args...)
+	case *PredicateNode:
+		add(n.Expr)
+		add(n.Filters...)
+	case *GroupNode:
+		add(n.Expr, n.ObjectNode)
+	case *ConditionalNode:
+		add(n.If, n.Then, n.Else)
+	case *CoalesceNode:
+		add(n.LHS, n.RHS)
+	case *AssignmentNode:
+		add(n.Value)
+	case *NumericOperatorNode:
+		add(n.LHS, n.RHS)
+	case *ComparisonOperatorNode:
+		add(n.LHS, n.RHS)
+	case *BooleanOperatorNode:
+		add(n.LHS, n.RHS)
+	case *StringConcatenationNode:
+		add(n.LHS, n.RHS)
+	case *CustomOperatorNode:
+		add(n.LHS, n.RHS)
+	case *SortNode:
+		add(n.Expr)
+		for _, term := range n.Terms {
+			add(term.Expr)
+		}
+	case *FunctionApplicationNode:
+		add(n.LHS, n.RHS)
+	case *PositionalBindingNode:
+		add(n.Expr)
+	case *ContextBindingNode:
+		add(n.Expr)
+	}
+
+	return nodes
+}
+
+// markTuplePaths sets the Tuples flag on any path that contains
+// a parent operator or a variable binding, either as a step or
+// within a step. It returns true if the given node contains
+// either of those.
+func markTuplePaths(node Node) bool {
+
+	var found bool
+	switch node.(type) {
+	case *ParentNode, *PositionalBindingNode, *ContextBindingNode:
+		found = true
+	}
+
+	for _, child := range childNodes(node) {
+		if markTuplePaths(child) {
+			found = true
+		}
+	}
+
+	if path, ok := node.(*PathNode); ok && found {
+		path.Tuples = true
+	}
+
+	return found
+}
+
+// optimizeBinding optimizes the expression that a variable
+// binding applies to. It returns the path that the binding
+// belongs in and the step that it binds (the last step of
+// the path). Bindings only make sense in a path, so if the
+// expression is not a path, it becomes one.
+func optimizeBinding(expr Node) (*PathNode, Node, error) {
+
+	expr, err := expr.optimize()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	path, ok := expr.(*PathNode)
+	if !ok {
+		path = &PathNode{
+			Steps: []Node{expr},
+		}
+	}
+
+	return path, path.Steps[len(path.Steps)-1], nil
+}
+
 func joinNodes(nodes []Node, sep string) string {
 
 	values := make([]string, len(nodes))
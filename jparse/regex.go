@@ -0,0 +1,109 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jparse
+
+import (
+	"container/list"
+	"regexp"
+	"sync"
+)
+
+// regexCacheSize is the maximum number of compiled regular
+// expressions held by the parser's cache.
+const regexCacheSize = 256
+
+// regexes caches the regular expressions compiled by the
+// parser. Expressions that are parsed repeatedly, e.g. by
+// $eval inside a lambda function, reuse the compiled regex
+// rather than compiling the same pattern each time.
+var regexes = newRegexCache(regexCacheSize)
+
+// A regexCache is a fixed-size, least recently used cache of
+// compiled regular expressions, keyed by pattern. Flags are
+// part of the pattern (e.g. "(?i)ab+"). It is safe for
+// concurrent use.
+type regexCache struct {
+	mu    sync.Mutex
+	size  int
+	items map[string]*list.Element
+	order *list.List // most recently used first
+}
+
+type regexCacheEntry struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+func newRegexCache(size int) *regexCache {
+	return &regexCache{
+		size:  size,
+		items: make(map[string]*list.Element, size),
+		order: list.New(),
+	}
+}
+
+// compile returns the compiled form of the given pattern,
+// compiling it if it is not in the cache. Patterns that fail
+// to compile are not cached.
+func (c *regexCache) compile(pattern string) (*regexp.Regexp, error) {
+
+	if re := c.get(pattern); re != nil {
+		return re, nil
+	}
+
+	// Compile outside the lock. If two goroutines compile the
+	// same pattern at once, the second result wins. Both are
+	// equivalent.
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	c.put(pattern, re)
+	return re, nil
+}
+
+func (c *regexCache) get(pattern string) *regexp.Regexp {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[pattern]
+	if !ok {
+		return nil
+	}
+
+	c.order.MoveToFront(elem)
+	return elem.Value.(*regexCacheEntry).re
+}
+
+func (c *regexCache) put(pattern string, re *regexp.Regexp) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[pattern]; ok {
+		elem.Value.(*regexCacheEntry).re = re
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.items[pattern] = c.order.PushFront(&regexCacheEntry{
+		pattern: pattern,
+		re:      re,
+	})
+
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*regexCacheEntry).pattern)
+	}
+}
+
+func (c *regexCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
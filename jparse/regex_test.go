@@ -0,0 +1,70 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jparse
+
+import (
+	"testing"
+)
+
+func TestRegexCache(t *testing.T) {
+
+	c := newRegexCache(2)
+
+	compile := func(pattern string) interface{} {
+		re, err := c.compile(pattern)
+		if err != nil {
+			t.Fatalf("compile %q: %s", pattern, err)
+		}
+		return re
+	}
+
+	a := compile("a+")
+	if compile("a+") != a {
+		t.Errorf("expected cached regex for a+")
+	}
+
+	b := compile("(?i)b+")
+	if compile("b+") == b {
+		t.Errorf("expected different regexes for b+ and (?i)b+")
+	}
+
+	// The cache holds two items. Adding b+ evicted the least
+	// recently used item, a+.
+	if n := c.len(); n != 2 {
+		t.Errorf("expected 2 cached regexes, got %d", n)
+	}
+
+	if compile("a+") == a {
+		t.Errorf("expected a+ to be evicted")
+	}
+
+	if _, err := c.compile("a("); err == nil {
+		t.Errorf("expected an error for an invalid pattern")
+	}
+
+	if n := c.len(); n != 2 {
+		t.Errorf("expected 2 cached regexes, got %d", n)
+	}
+}
+
+func TestParseRegexUsesCache(t *testing.T) {
+
+	node1, err := Parse(`/ab+c/i`)
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+
+	node2, err := Parse(`$match("abc", /ab+c/i)`)
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+
+	re1 := node1.(*RegexNode).Value
+	re2 := node2.(*FunctionCallNode).Args[1].(*RegexNode).Value
+
+	if re1 != re2 {
+		t.Errorf("expected Parse to reuse the compiled regex")
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	jsonata "github.com/blues/jsonata-go"
+)
+
+func main() {
+	var ndjson, emitNull, keepGoing bool
+
+	flag.BoolVar(&ndjson, "ndjson", false, "read newline-delimited JSON and evaluate the expression against each line")
+	flag.BoolVar(&emitNull, "null", false, "with -ndjson, write null for lines that evaluate to undefined")
+	flag.BoolVar(&keepGoing, "continue", false, "with -ndjson, report errors and continue with the next line")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 || flag.NArg() > 2 {
+		usage()
+		os.Exit(1)
+	}
+
+	expr, err := jsonata.Compile(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Compile error: %s\n", err)
+		os.Exit(1)
+	}
+
+	input := os.Stdin
+	if flag.NArg() == 2 {
+		f, err := os.Open(flag.Arg(1))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		input = f
+	}
+
+	if ndjson {
+		err = evalStream(expr, input, emitNull, keepGoing)
+	} else {
+		err = eval(expr, input)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Syntax: jsonata-cli [options] <expression> [file]")
+	fmt.Fprintln(os.Stderr, "Evaluates a JSONata expression against JSON read from file or, if no file is given, stdin.")
+	flag.PrintDefaults()
+}
+
+func eval(expr *jsonata.Expr, r io.Reader) error {
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	b, err := expr.EvalBytes(data)
+	if err == jsonata.ErrUndefined {
+		// Don't treat not finding any results as an error.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(os.Stdout, "%s\n", b)
+	return err
+}
+
+func evalStream(expr *jsonata.Expr, r io.Reader, emitNull, keepGoing bool) error {
+
+	opts := jsonata.StreamOptions{
+		EmitUndefined: emitNull,
+	}
+
+	if keepGoing {
+		opts.OnError = func(err error) error {
+			fmt.Fprintln(os.Stderr, err)
+			return nil
+		}
+	}
+
+	return jsonata.EvalStream(expr, r, os.Stdout, opts)
+}
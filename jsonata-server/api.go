@@ -0,0 +1,193 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+
+	jsonata "github.com/blues/jsonata-go"
+	"github.com/blues/jsonata-go/jparse"
+)
+
+// An apiRequest is the body of a request to the /api/eval
+// endpoint.
+type apiRequest struct {
+	Expression string                 `json:"expression"`
+	Data       interface{}            `json:"data"`
+	Bindings   map[string]interface{} `json:"bindings"`
+}
+
+// An apiResponse is the body of a response from the /api/eval
+// endpoint. Result is null and Undefined is true if the
+// expression evaluated to undefined.
+type apiResponse struct {
+	Result    interface{} `json:"result"`
+	Undefined bool        `json:"undefined,omitempty"`
+	Error     *apiError   `json:"error"`
+	TimeMs    float64     `json:"timeMs"`
+}
+
+// An apiError describes a compile or evaluation error. Code
+// is the jsonata-js error code, if there is one. Position is
+// the position in the expression of a compile error.
+type apiError struct {
+	Message  string `json:"message"`
+	Code     string `json:"code,omitempty"`
+	Position *int   `json:"position,omitempty"`
+}
+
+func newAPIError(err error) *apiError {
+
+	e := &apiError{
+		Message: err.Error(),
+		Code:    jsonata.ErrorCode(err),
+	}
+
+	var perr *jparse.Error
+	if errors.As(err, &perr) {
+		pos := perr.Position
+		e.Position = &pos
+	}
+
+	return e
+}
+
+// evaluateAPI handles requests to the /api/eval endpoint. It
+// accepts a JSON object containing an expression, the input
+// data and any variable bindings, and returns the result as a
+// JSON object. The response status is 400 if the request is
+// malformed or the expression does not compile, 413 if the body
+// is larger than l.maxDocSize, and 422 if the evaluation fails
+// or takes longer than l.evalTimeout. Add ?pretty=1 to the URL
+// to indent the response.
+func (l limits) evaluateAPI(w http.ResponseWriter, r *http.Request) {
+
+	pretty := r.URL.Query().Get("pretty") == "1"
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeAPIError(w, http.StatusMethodNotAllowed, errors.New("method must be POST"), pretty)
+		return
+	}
+
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+		writeAPIError(w, http.StatusUnsupportedMediaType, errors.New("content type must be application/json"), pretty)
+		return
+	}
+
+	// Read one byte more than the limit to tell a body that is
+	// too large from one that is exactly the maximum size.
+	b, err := io.ReadAll(io.LimitReader(r.Body, l.maxDocSize+1))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("input error: %s", err), pretty)
+		return
+	}
+
+	if int64(len(b)) > l.maxDocSize {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("request body is larger than %d bytes", l.maxDocSize), pretty)
+		return
+	}
+
+	var req apiRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("input error: %s", err), pretty)
+		return
+	}
+
+	if req.Expression == "" {
+		writeAPIError(w, http.StatusBadRequest, errors.New("expression is empty"), pretty)
+		return
+	}
+
+	res, status := evalAPI(&req, l.evalTimeout)
+	writeAPIResponse(w, status, res, pretty)
+}
+
+// evalAPI compiles and evaluates the expression in req. The
+// evaluation stops when the timeout expires, but not in the
+// middle of a call to a Go function.
+func evalAPI(req *apiRequest, timeout time.Duration) (res *apiResponse, status int) {
+
+	start := time.Now()
+
+	defer func() {
+		if r := recover(); r != nil {
+			res = &apiResponse{
+				Error: &apiError{
+					Message: fmt.Sprintf("PANIC: %v", r),
+				},
+			}
+			status = http.StatusInternalServerError
+		}
+		res.TimeMs = float64(time.Since(start)) / float64(time.Millisecond)
+	}()
+
+	expr, err := exprs.Get(req.Expression)
+	if err != nil {
+		return &apiResponse{Error: newAPIError(err)}, http.StatusBadRequest
+	}
+
+	if len(req.Bindings) > 0 {
+		if err := expr.RegisterVars(req.Bindings); err != nil {
+			return &apiResponse{Error: newAPIError(err)}, http.StatusBadRequest
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result, err := expr.EvalCtx(ctx, req.Data)
+	switch {
+	case err == jsonata.ErrUndefined:
+		return &apiResponse{Undefined: true}, http.StatusOK
+	case errors.Is(err, context.DeadlineExceeded):
+		return &apiResponse{Error: timeoutResponse(timeout).Error}, http.StatusUnprocessableEntity
+	case err != nil:
+		return &apiResponse{Error: newAPIError(err)}, http.StatusUnprocessableEntity
+	default:
+		return &apiResponse{Result: result}, http.StatusOK
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error, pretty bool) {
+	writeAPIResponse(w, status, &apiResponse{Error: newAPIError(err)}, pretty)
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, res *apiResponse, pretty bool) {
+
+	var b []byte
+	var err error
+
+	if pretty {
+		b, err = json.MarshalIndent(res, "", "    ")
+	} else {
+		b, err = json.Marshal(res)
+	}
+
+	if err != nil {
+		status = http.StatusInternalServerError
+		b, _ = json.Marshal(&apiResponse{
+			Error: &apiError{
+				Message: fmt.Sprintf("encode error: %s", err),
+			},
+			TimeMs: res.TimeMs,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+
+	if _, err := w.Write(append(b, '\n')); err != nil {
+		log.Println(err)
+	}
+}
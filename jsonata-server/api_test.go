@@ -0,0 +1,213 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvaluateAPI(t *testing.T) {
+
+	tests := []struct {
+		Method      string
+		ContentType string
+		Body        string
+		Status      int
+		Response    map[string]interface{}
+	}{
+		{
+			Body:   `{"expression": "a + $sum(b)", "data": {"a": 1, "b": [2, 3]}}`,
+			Status: http.StatusOK,
+			Response: map[string]interface{}{
+				"result": 6.0,
+				"error":  nil,
+			},
+		},
+		{
+			Body:   `{"expression": "$x * 2", "bindings": {"x": 21}}`,
+			Status: http.StatusOK,
+			Response: map[string]interface{}{
+				"result": 42.0,
+				"error":  nil,
+			},
+		},
+		{
+			// Undefined results are not errors.
+			Body:   `{"expression": "missing", "data": {"a": 1}}`,
+			Status: http.StatusOK,
+			Response: map[string]interface{}{
+				"result":    nil,
+				"undefined": true,
+				"error":     nil,
+			},
+		},
+		{
+			Body:   `{"expression": "a +"}`,
+			Status: http.StatusBadRequest,
+			Response: map[string]interface{}{
+				"result": nil,
+				"error": map[string]interface{}{
+					"message":  "unexpected end of expression",
+					"code":     "S0207",
+					"position": 3.0,
+				},
+			},
+		},
+		{
+			Body:   `{"expression": "$number(a)", "data": {"a": "x"}}`,
+			Status: http.StatusUnprocessableEntity,
+			Response: map[string]interface{}{
+				"result": nil,
+				"error": map[string]interface{}{
+					"message": `unable to cast "x" to a number`,
+					"code":    "D3030",
+				},
+			},
+		},
+		{
+			Body:   `{"expression": "1", "data": }`,
+			Status: http.StatusBadRequest,
+			Response: map[string]interface{}{
+				"result": nil,
+				"error": map[string]interface{}{
+					"message": "input error: invalid character '}' looking for beginning of value",
+				},
+			},
+		},
+		{
+			Body:   `{"data": {"a": 1}}`,
+			Status: http.StatusBadRequest,
+			Response: map[string]interface{}{
+				"result": nil,
+				"error": map[string]interface{}{
+					"message": "expression is empty",
+				},
+			},
+		},
+		{
+			ContentType: "text/plain",
+			Body:        `{"expression": "1"}`,
+			Status:      http.StatusUnsupportedMediaType,
+			Response: map[string]interface{}{
+				"result": nil,
+				"error": map[string]interface{}{
+					"message": "content type must be application/json",
+				},
+			},
+		},
+		{
+			Method: http.MethodGet,
+			Status: http.StatusMethodNotAllowed,
+			Response: map[string]interface{}{
+				"result": nil,
+				"error": map[string]interface{}{
+					"message": "method must be POST",
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+
+		method := test.Method
+		if method == "" {
+			method = http.MethodPost
+		}
+
+		contentType := test.ContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+
+		r := httptest.NewRequest(method, "/api/eval", strings.NewReader(test.Body))
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+
+		serverLimits.evaluateAPI(w, r)
+
+		if w.Code != test.Status {
+			t.Errorf("%s: expected status %d, got %d", test.Body, test.Status, w.Code)
+		}
+
+		if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+			t.Errorf("%s: unexpected content type %q", test.Body, ct)
+		}
+
+		var res map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s: %s", test.Body, err)
+		}
+
+		if _, ok := res["timeMs"].(float64); !ok {
+			t.Errorf("%s: expected a duration in %s", test.Body, w.Body)
+		}
+		delete(res, "timeMs")
+
+		if !reflect.DeepEqual(res, test.Response) {
+			t.Errorf("%s: expected response %v, got %v", test.Body, test.Response, res)
+		}
+	}
+}
+
+func TestEvaluateAPILimits(t *testing.T) {
+
+	// post sends a request to a copy of the default limits,
+	// modified by fn, and returns the status and the error
+	// message from the response.
+	post := func(fn func(*limits), body string) (int, string) {
+
+		l := serverLimits
+		fn(&l)
+
+		r := httptest.NewRequest(http.MethodPost, "/api/eval", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+
+		l.evaluateAPI(w, r)
+
+		var res apiResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s: %s", body, err)
+		}
+
+		if res.Error == nil {
+			return w.Code, ""
+		}
+		return w.Code, res.Error.Message
+	}
+
+	// Evaluations that run out of time return an error.
+	status, msg := post(func(l *limits) {
+		l.evalTimeout = time.Nanosecond
+	}, `{"expression": "1"}`)
+
+	if status != http.StatusUnprocessableEntity || !strings.Contains(msg, "timed out") {
+		t.Errorf("expected a timeout error, got %d %q", status, msg)
+	}
+
+	// Bodies longer than the maximum document size are rejected.
+	body := `{"expression": "1"}`
+	n := int64(len(body))
+	maxSize := func(l *limits) {
+		l.maxDocSize = n
+	}
+
+	status, msg = post(maxSize, body)
+	if status != http.StatusOK || msg != "" {
+		t.Errorf("%s: expected status 200, got %d %q", body, status, msg)
+	}
+
+	body += " "
+	status, msg = post(maxSize, body)
+	if status != http.StatusRequestEntityTooLarge || !strings.Contains(msg, "larger than") {
+		t.Errorf("%s: expected status 413, got %d %q", body, status, msg)
+	}
+}
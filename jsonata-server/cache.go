@@ -0,0 +1,19 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	jsonata "github.com/blues/jsonata-go"
+)
+
+// defaultCacheSize is the default maximum number of compiled
+// expressions held by the server's cache.
+const defaultCacheSize = 512
+
+// exprs caches the expressions compiled by the server. The
+// -cache-size flag sets its size. The cache returns clones of
+// the cached Exprs, so handlers are free to modify them, e.g.
+// with RegisterVars.
+var exprs = jsonata.NewCache(defaultCacheSize)
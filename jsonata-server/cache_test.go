@@ -0,0 +1,73 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	jsonata "github.com/blues/jsonata-go"
+)
+
+// benchAPIExpression is like benchExpression without the
+// location functions, which the server does not provide.
+const benchAPIExpression = `
+(
+	$values := {
+		"device_uid": device,
+		"when_captured": $formatTime(when),
+		"temp_f": body.env_temp * 9 / 5 + 32,
+		"pm_total": $sum(body.[pms_pm01_0, pms_pm02_5, pms_pm10_0])
+	};
+
+	req = "note.add" and when ? $merge([body, $values]) : $error("unexpected req/when")
+)`
+
+func BenchmarkEvaluateAPI(b *testing.B) {
+
+	req, err := json.Marshal(map[string]interface{}{
+		"expression": benchAPIExpression,
+		"data":       data,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	body := string(req)
+
+	for _, size := range []int{0, defaultCacheSize} {
+
+		name := "NoCache"
+		if size > 0 {
+			name = "Cache"
+		}
+
+		b.Run(name, func(b *testing.B) {
+
+			exprs = jsonata.NewCache(size)
+			defer func() {
+				exprs = jsonata.NewCache(defaultCacheSize)
+			}()
+
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+
+				r := httptest.NewRequest(http.MethodPost, "/api/eval", strings.NewReader(body))
+				r.Header.Set("Content-Type", "application/json")
+				w := httptest.NewRecorder()
+
+				serverLimits.evaluateAPI(w, r)
+
+				if w.Code != http.StatusOK {
+					b.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+				}
+			}
+		})
+	}
+}
@@ -20,16 +20,16 @@ import (
 
 func init() {
 
-	argUndefined0 := jtypes.ArgUndefined(0)
+	argUndefined0 := jtypes.ArgUndefinedAny(0)
 
 	exts := map[string]jsonata.Extension{
 		"formatTime": {
-			Func:             formatTime,
-			UndefinedHandler: argUndefined0,
+			Func:          formatTime,
+			UndefinedArgs: argUndefined0,
 		},
 		"parseTime": {
-			Func:             parseTime,
-			UndefinedHandler: argUndefined0,
+			Func:          parseTime,
+			UndefinedArgs: argUndefined0,
 		},
 	}
 
@@ -41,9 +41,17 @@ func init() {
 func main() {
 
 	port := flag.Uint("port", 8080, "The port `number` to serve on")
+	cacheSize := flag.Int("cache-size", defaultCacheSize, "The maximum `number` of compiled expressions to cache")
+	flag.Int64Var(&serverLimits.maxDocSize, "max-doc-size", defaultMaxDocSize, "The maximum size in `bytes` of an /api/eval request or a /ws message, including its data document")
+	flag.DurationVar(&serverLimits.evalTimeout, "eval-timeout", defaultEvalTimeout, "The maximum `duration` of an evaluation requested over /api/eval or /ws")
+	flag.DurationVar(&serverLimits.idleTimeout, "idle-timeout", defaultIdleTimeout, "The `duration` after which an idle /ws connection is closed")
 	flag.Parse()
 
+	exprs = jsonata.NewCache(*cacheSize)
+
 	http.HandleFunc("/eval", evaluate)
+	http.HandleFunc("/api/eval", serverLimits.evaluateAPI)
+	http.HandleFunc("/ws", serverLimits.evaluateWS)
 	http.HandleFunc("/bench", benchmark)
 	http.Handle("/", http.FileServer(http.Dir("site")))
 
@@ -95,11 +103,16 @@ func eval(input, expression string) (b []byte, status int, err error) {
 	}
 
 	// Compile the JSONata expression.
-	expr, err := jsonata.Compile(expression)
+	expr, err := exprs.Get(expression)
 	if err != nil {
 		return nil, http.StatusBadRequest, fmt.Errorf("compile error: %s", err)
 	}
 
+	// Log the values passed to $trace.
+	expr.SetTraceSink(func(r jsonata.TraceRecord) {
+		log.Printf("$trace: %s", r)
+	})
+
 	// Evaluate the JSONata expression.
 	result, err := expr.Eval(data)
 	if err != nil {
@@ -0,0 +1,393 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// This file implements the subset of the WebSocket protocol
+// (RFC 6455) that the /ws endpoint needs: the server side of
+// the opening handshake, and text messages, which may be
+// fragmented, with the ping, pong and close control frames.
+// Extensions and subprotocols are not supported.
+
+// wsGUID is the value that the handshake appends to the
+// client's key (see RFC 6455, section 1.3).
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Frame opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// Close status codes.
+const (
+	wsCloseNormal        = 1000
+	wsCloseProtocolError = 1002
+	wsCloseUnsupported   = 1003
+	wsCloseInvalidData   = 1007
+	wsCloseTooBig        = 1009
+)
+
+// maxControlPayload is the maximum payload length of a control
+// frame.
+const maxControlPayload = 125
+
+// wsWriteTimeout is the time limit for sending a frame to the
+// client.
+const wsWriteTimeout = 10 * time.Second
+
+// A wsConn is the server end of a WebSocket connection. Its
+// methods must not be called concurrently.
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	// maxMessage is the maximum length in bytes of a message
+	// received from the client.
+	maxMessage int64
+
+	// idleTimeout is the time limit for receiving each frame
+	// from the client. If it is zero, there is no limit.
+	idleTimeout time.Duration
+}
+
+// A wsCloseError is returned by readMessage when the connection
+// must be closed with the given status code.
+type wsCloseError struct {
+	code   int
+	reason string
+}
+
+func (e *wsCloseError) Error() string {
+	return fmt.Sprintf("websocket: %s (%d)", e.reason, e.code)
+}
+
+// upgradeWebSocket performs the server side of the WebSocket
+// handshake. If the request is not a valid WebSocket handshake,
+// or it comes from a web page on another site, upgradeWebSocket
+// writes an error response and returns an error.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request, maxMessage int64, idleTimeout time.Duration) (*wsConn, error) {
+
+	fail := func(status int, msg string) (*wsConn, error) {
+		http.Error(w, msg, status)
+		return nil, errors.New("websocket: " + msg)
+	}
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		return fail(http.StatusMethodNotAllowed, "method must be GET")
+	}
+
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		return fail(http.StatusBadRequest, "not a websocket handshake")
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return fail(http.StatusBadRequest, "unsupported websocket version")
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return fail(http.StatusBadRequest, "missing Sec-WebSocket-Key")
+	}
+
+	if !sameOrigin(r) {
+		return fail(http.StatusForbidden, "cross-origin requests are not allowed")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return fail(http.StatusInternalServerError, "connection does not support hijacking")
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", wsAccept(key))
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{
+		conn:        conn,
+		br:          rw.Reader,
+		maxMessage:  maxMessage,
+		idleTimeout: idleTimeout,
+	}, nil
+}
+
+// sameOrigin reports whether the request's Origin header, if
+// it has one, matches its Host header. Browsers send an Origin
+// header with every WebSocket handshake and, unlike other
+// requests, do not stop pages from other sites from making
+// them, so the server has to reject them itself. Clients that
+// are not browsers generally don't send an Origin header.
+func sameOrigin(r *http.Request) bool {
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// wsAccept returns the value of the Sec-WebSocket-Accept header
+// for the given Sec-WebSocket-Key.
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// headerContains reports whether any of the comma-separated
+// values of the named header is equal to token, ignoring case.
+func headerContains(h http.Header, name, token string) bool {
+
+	for _, value := range h[http.CanonicalHeaderKey(name)] {
+		for _, s := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// readMessage returns the next text message from the client. It
+// answers pings while it waits. If the client closes the
+// connection, readMessage replies to the close frame with a
+// normal close and returns io.EOF. A close frame with an invalid
+// status code is a protocol error. If the client violates the protocol or sends a message
+// longer than maxMessage, readMessage returns a *wsCloseError.
+// If no frame arrives within the idle timeout, readMessage
+// returns a timeout error.
+func (c *wsConn) readMessage() ([]byte, error) {
+
+	var msg []byte
+	started := false
+
+	for {
+		if c.idleTimeout > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
+		}
+
+		fin, opcode, payload, err := c.readFrame(c.maxMessage - int64(len(msg)))
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+
+		case wsPong:
+			continue
+
+		case wsClose:
+			if len(payload) == 1 {
+				return nil, &wsCloseError{wsCloseProtocolError, "invalid close frame"}
+			}
+			if len(payload) >= 2 {
+				if code := int(binary.BigEndian.Uint16(payload)); !validCloseCode(code) {
+					return nil, &wsCloseError{wsCloseProtocolError, fmt.Sprintf("invalid close code %d", code)}
+				}
+			}
+			c.writeClose(wsCloseNormal, "")
+			return nil, io.EOF
+
+		case wsBinary:
+			return nil, &wsCloseError{wsCloseUnsupported, "binary messages are not supported"}
+
+		case wsText:
+			if started {
+				return nil, &wsCloseError{wsCloseProtocolError, "expected a continuation frame"}
+			}
+			started = true
+
+		case wsContinuation:
+			if !started {
+				return nil, &wsCloseError{wsCloseProtocolError, "unexpected continuation frame"}
+			}
+
+		default:
+			return nil, &wsCloseError{wsCloseProtocolError, fmt.Sprintf("unknown opcode %d", opcode)}
+		}
+
+		msg = append(msg, payload...)
+
+		if fin {
+			if !utf8.Valid(msg) {
+				return nil, &wsCloseError{wsCloseInvalidData, "text message is not valid UTF-8"}
+			}
+			return msg, nil
+		}
+	}
+}
+
+// validCloseCode reports whether a client can send the given
+// status code in a close frame. Codes that are reserved for
+// local use, such as 1005 (no status) and 1006 (abnormal
+// closure), must not be sent (see RFC 6455, section 7.4).
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+		return true
+	case code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	default:
+		return false
+	}
+}
+
+// readFrame reads a frame from the client and returns its FIN
+// bit, opcode and unmasked payload. Data frames with payloads
+// longer than max bytes are rejected.
+func (c *wsConn) readFrame(max int64) (bool, byte, []byte, error) {
+
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := hdr[0]&0x80 != 0
+	opcode := hdr[0] & 0x0F
+	masked := hdr[1]&0x80 != 0
+	n := int64(hdr[1] & 0x7F)
+
+	if hdr[0]&0x70 != 0 {
+		return false, 0, nil, &wsCloseError{wsCloseProtocolError, "reserved bits are set"}
+	}
+
+	if !masked {
+		return false, 0, nil, &wsCloseError{wsCloseProtocolError, "client frames must be masked"}
+	}
+
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+
+	isControl := opcode&0x8 != 0
+	switch {
+	case isControl && (n > maxControlPayload || !fin):
+		return false, 0, nil, &wsCloseError{wsCloseProtocolError, "invalid control frame"}
+	case !isControl && (n < 0 || n > max):
+		return false, 0, nil, &wsCloseError{wsCloseTooBig, "message too big"}
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// writeMessage sends a text message to the client.
+func (c *wsConn) writeMessage(b []byte) error {
+	return c.writeFrame(wsText, b)
+}
+
+// writeClose sends a close frame with the given status code.
+func (c *wsConn) writeClose(code int, reason string) error {
+
+	if len(reason) > maxControlPayload-2 {
+		reason = reason[:maxControlPayload-2]
+	}
+
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+
+	return c.writeFrame(wsClose, append(payload, reason...))
+}
+
+// writeFrame sends a single, unmasked frame to the client.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+
+	hdr := make([]byte, 2, 10+len(payload))
+	hdr[0] = 0x80 | opcode
+
+	switch n := len(payload); {
+	case n < 126:
+		hdr[1] = byte(n)
+	case n <= 0xFFFF:
+		hdr[1] = 126
+		hdr = append(hdr, byte(n>>8), byte(n))
+	default:
+		hdr[1] = 127
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		hdr = append(hdr, ext[:]...)
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+
+	_, err := c.conn.Write(append(hdr, payload...))
+	return err
+}
+
+// close closes the underlying network connection.
+func (c *wsConn) close() error {
+	return c.conn.Close()
+}
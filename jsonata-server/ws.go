@@ -0,0 +1,269 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	jsonata "github.com/blues/jsonata-go"
+)
+
+// defaultMaxDocSize is the default maximum length in bytes of a
+// request to the /api/eval endpoint or a message sent to the /ws
+// endpoint, including the data document it carries.
+const defaultMaxDocSize = 16 << 20
+
+// defaultEvalTimeout is the default time limit for evaluations
+// requested over the /api/eval and /ws endpoints.
+const defaultEvalTimeout = 10 * time.Second
+
+// defaultIdleTimeout is the default time limit for receiving
+// each frame of a message sent to the /ws endpoint. Connections
+// that are idle for longer are closed.
+const defaultIdleTimeout = 5 * time.Minute
+
+// wsCacheSize is the number of compiled expressions that each
+// /ws connection caches.
+const wsCacheSize = 16
+
+// limits holds the limits that the server applies to
+// requests.
+type limits struct {
+	maxDocSize  int64
+	evalTimeout time.Duration
+	idleTimeout time.Duration
+}
+
+// serverLimits is set by the -max-doc-size, -eval-timeout and
+// -idle-timeout flags. Handlers are methods on a copy of it,
+// so that it is never read while requests are being served.
+var serverLimits = limits{
+	maxDocSize:  defaultMaxDocSize,
+	evalTimeout: defaultEvalTimeout,
+	idleTimeout: defaultIdleTimeout,
+}
+
+// A wsRequest is a message sent to the /ws endpoint. Data, if
+// present, replaces the connection's input document. Expression,
+// if present, replaces the connection's expression. The server
+// evaluates the expression against the document whenever either
+// of them changes, as long as there is an expression to
+// evaluate. ID is optional and is copied to the response.
+type wsRequest struct {
+	ID         json.RawMessage `json:"id"`
+	Data       json.RawMessage `json:"data"`
+	Expression *string         `json:"expression"`
+}
+
+// A wsResponse is a message sent by the /ws endpoint with the
+// result of an evaluation, or an error if the request could not
+// be handled. Result is null and Undefined is true if the
+// expression evaluated to undefined.
+type wsResponse struct {
+	ID         json.RawMessage `json:"id,omitempty"`
+	Result     interface{}     `json:"result"`
+	Undefined  bool            `json:"undefined,omitempty"`
+	Error      *apiError       `json:"error"`
+	DurationMs float64         `json:"durationMs"`
+}
+
+// A wsSession holds the state of a /ws connection.
+type wsSession struct {
+	data       interface{}
+	expression string
+	exprs      *jsonata.Cache
+
+	// timeout is the time limit for each evaluation.
+	timeout time.Duration
+
+	// busy holds a value while an evaluation is running. An
+	// evaluation that times out during a call to a Go function
+	// keeps running in the background until the call returns,
+	// and the session refuses to start another one until it
+	// does.
+	busy chan struct{}
+}
+
+// evaluateWS handles connections to the /ws endpoint, which
+// evaluates expressions against a data document that the client
+// sends once, for live editing of expressions. See wsRequest
+// and wsResponse for the message formats.
+func (l limits) evaluateWS(w http.ResponseWriter, r *http.Request) {
+
+	conn, err := upgradeWebSocket(w, r, l.maxDocSize, l.idleTimeout)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer conn.close()
+
+	s := &wsSession{
+		exprs:   jsonata.NewCache(wsCacheSize),
+		timeout: l.evalTimeout,
+		busy:    make(chan struct{}, 1),
+	}
+
+	for {
+		msg, err := conn.readMessage()
+		if err != nil {
+			var cerr *wsCloseError
+			if errors.As(err, &cerr) {
+				conn.writeClose(cerr.code, cerr.reason)
+			}
+			if err != io.EOF {
+				log.Println(err)
+			}
+			return
+		}
+
+		res := s.handle(msg)
+		if res == nil {
+			continue
+		}
+
+		b, err := json.Marshal(res)
+		if err != nil {
+			b, _ = json.Marshal(&wsResponse{
+				ID: res.ID,
+				Error: &apiError{
+					Message: fmt.Sprintf("encode error: %s", err),
+				},
+				DurationMs: res.DurationMs,
+			})
+		}
+
+		if err := conn.writeMessage(b); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+}
+
+// handle processes a message from the client and returns the
+// response, or nil if the message does not need one.
+func (s *wsSession) handle(msg []byte) *wsResponse {
+
+	var req wsRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		return &wsResponse{
+			Error: newAPIError(fmt.Errorf("input error: %s", err)),
+		}
+	}
+
+	if len(req.Data) > 0 {
+		var data interface{}
+		if err := json.Unmarshal(req.Data, &data); err != nil {
+			return &wsResponse{
+				ID:    req.ID,
+				Error: newAPIError(fmt.Errorf("input error: %s", err)),
+			}
+		}
+		s.data = data
+	}
+
+	if req.Expression != nil {
+		if *req.Expression == "" {
+			return &wsResponse{
+				ID:    req.ID,
+				Error: newAPIError(errors.New("expression is empty")),
+			}
+		}
+		s.expression = *req.Expression
+	}
+
+	if s.expression == "" {
+		return nil
+	}
+
+	res := s.eval()
+	res.ID = req.ID
+	return res
+}
+
+// eval evaluates the session's expression against its data,
+// subject to the evaluation timeout.
+func (s *wsSession) eval() *wsResponse {
+
+	start := time.Now()
+
+	select {
+	case s.busy <- struct{}{}:
+	default:
+		return &wsResponse{
+			Error: &apiError{
+				Message: "a previous evaluation that timed out is still running",
+			},
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	// The evaluator stops when the context is done, but not in
+	// the middle of a call to a Go function, so evaluate in a
+	// separate goroutine and stop waiting when the time is up.
+	done := make(chan *wsResponse, 1)
+	go func(expression string, data interface{}) {
+		defer func() { <-s.busy }()
+		done <- s.evalCtx(ctx, expression, data)
+	}(s.expression, s.data)
+
+	var res *wsResponse
+	select {
+	case res = <-done:
+	case <-ctx.Done():
+		res = timeoutResponse(s.timeout)
+	}
+
+	res.DurationMs = float64(time.Since(start)) / float64(time.Millisecond)
+	return res
+}
+
+// evalCtx compiles and evaluates an expression. It recovers
+// from panics in the evaluator.
+func (s *wsSession) evalCtx(ctx context.Context, expression string, data interface{}) (res *wsResponse) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			res = &wsResponse{
+				Error: &apiError{
+					Message: fmt.Sprintf("PANIC: %v", r),
+				},
+			}
+		}
+	}()
+
+	expr, err := s.exprs.Get(expression)
+	if err != nil {
+		return &wsResponse{Error: newAPIError(err)}
+	}
+
+	result, err := expr.EvalCtx(ctx, data)
+	switch {
+	case err == jsonata.ErrUndefined:
+		return &wsResponse{Undefined: true}
+	case errors.Is(err, context.DeadlineExceeded):
+		return timeoutResponse(s.timeout)
+	case err != nil:
+		return &wsResponse{Error: newAPIError(err)}
+	default:
+		return &wsResponse{Result: result}
+	}
+}
+
+func timeoutResponse(timeout time.Duration) *wsResponse {
+	return &wsResponse{
+		Error: &apiError{
+			Message: fmt.Sprintf("evaluation timed out after %s", timeout),
+		},
+	}
+}
@@ -0,0 +1,439 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	jsonata "github.com/blues/jsonata-go"
+)
+
+// A wsTestClient is a minimal WebSocket client for testing the
+// /ws endpoint.
+type wsTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func dialWS(t *testing.T, srv *httptest.Server) *wsTestClient {
+	return dialWSOrigin(t, srv, "")
+}
+
+// dialWSOrigin is like dialWS except that the handshake has
+// an Origin header, if origin is not empty.
+func dialWSOrigin(t *testing.T, srv *httptest.Server, origin string) *wsTestClient {
+
+	conn, resp := handshakeWS(t, srv, origin)
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status %d, got %d", http.StatusSwitchingProtocols, resp.StatusCode)
+	}
+
+	// The accept value for this key is given in RFC 6455.
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected Sec-WebSocket-Accept %q", accept)
+	}
+
+	return conn
+}
+
+// handshakeWS sends a WebSocket handshake to the server and
+// returns the connection and the server's response.
+func handshakeWS(t *testing.T, srv *httptest.Server, origin string) (*wsTestClient, *http.Response) {
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	req := "GET /ws HTTP/1.1\r\n" +
+		"Host: " + srv.Listener.Addr().String() + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n"
+	if origin != "" {
+		req += "Origin: " + origin + "\r\n"
+	}
+
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &wsTestClient{
+		t:    t,
+		conn: conn,
+		br:   br,
+	}, resp
+}
+
+// writeFrame sends a masked frame.
+func (c *wsTestClient) writeFrame(fin bool, opcode byte, payload []byte) {
+
+	b := []byte{opcode, 0x80}
+	if fin {
+		b[0] |= 0x80
+	}
+
+	switch n := len(payload); {
+	case n < 126:
+		b[1] |= byte(n)
+	case n <= 0xFFFF:
+		b[1] |= 126
+		b = append(b, byte(n>>8), byte(n))
+	default:
+		b[1] |= 127
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		b = append(b, ext[:]...)
+	}
+
+	mask := []byte{1, 2, 3, 4}
+	b = append(b, mask...)
+	for i, x := range payload {
+		b = append(b, x^mask[i%4])
+	}
+
+	if _, err := c.conn.Write(b); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// readFrame reads an unmasked frame.
+func (c *wsTestClient) readFrame() (byte, []byte) {
+
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		c.t.Fatal(err)
+	}
+
+	n := uint64(hdr[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(c.br, ext[:])
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(c.br, ext[:])
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		c.t.Fatal(err)
+	}
+
+	return hdr[0] & 0x0F, payload
+}
+
+func (c *wsTestClient) send(msg string) {
+	c.writeFrame(true, wsText, []byte(msg))
+}
+
+func (c *wsTestClient) receive() map[string]interface{} {
+
+	opcode, payload := c.readFrame()
+	if opcode != wsText {
+		c.t.Fatalf("expected a text frame, got opcode %d (%q)", opcode, payload)
+	}
+
+	var res map[string]interface{}
+	if err := json.Unmarshal(payload, &res); err != nil {
+		c.t.Fatal(err)
+	}
+
+	if _, ok := res["durationMs"].(float64); !ok {
+		c.t.Errorf("expected a duration in %s", payload)
+	}
+	delete(res, "durationMs")
+
+	return res
+}
+
+// expectClose reads a close frame with the given status code.
+func (c *wsTestClient) expectClose(code int) {
+
+	opcode, payload := c.readFrame()
+	if opcode != wsClose || len(payload) < 2 {
+		c.t.Fatalf("expected a close frame, got opcode %d (%q)", opcode, payload)
+	}
+
+	if got := int(binary.BigEndian.Uint16(payload)); got != code {
+		c.t.Errorf("expected close code %d, got %d (%q)", code, got, payload[2:])
+	}
+}
+
+func TestEvaluateWS(t *testing.T) {
+
+	err := jsonata.RegisterExts(map[string]jsonata.Extension{
+		"wsTestPanic": {
+			Func: func() interface{} {
+				panic("oops")
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(serverLimits.evaluateWS))
+	defer srv.Close()
+
+	c := dialWS(t, srv)
+	defer c.conn.Close()
+
+	tests := []struct {
+		Message  string
+		Response map[string]interface{}
+	}{
+		{
+			// Data on its own is stored without a response.
+			Message: `{"data": {"a": 1, "b": [2, 3]}}`,
+		},
+		{
+			Message: `{"id": 1, "expression": "a + $sum(b)"}`,
+			Response: map[string]interface{}{
+				"id":     1.0,
+				"result": 6.0,
+				"error":  nil,
+			},
+		},
+		{
+			// The data is kept between expressions.
+			Message: `{"id": "two", "expression": "b[-1]"}`,
+			Response: map[string]interface{}{
+				"id":     "two",
+				"result": 3.0,
+				"error":  nil,
+			},
+		},
+		{
+			// New data re-evaluates the current expression.
+			Message: `{"data": {"b": [4, 5]}}`,
+			Response: map[string]interface{}{
+				"result": 5.0,
+				"error":  nil,
+			},
+		},
+		{
+			Message: `{"expression": "c"}`,
+			Response: map[string]interface{}{
+				"result":    nil,
+				"undefined": true,
+				"error":     nil,
+			},
+		},
+		{
+			Message: `{"expression": "b +"}`,
+			Response: map[string]interface{}{
+				"result": nil,
+				"error": map[string]interface{}{
+					"message":  "unexpected end of expression",
+					"code":     "S0207",
+					"position": 3.0,
+				},
+			},
+		},
+		{
+			Message: `{"expression": "$number(\"x\")"}`,
+			Response: map[string]interface{}{
+				"result": nil,
+				"error": map[string]interface{}{
+					"message": `unable to cast "x" to a number`,
+					"code":    "D3030",
+				},
+			},
+		},
+		{
+			// Panics are reported to the client.
+			Message: `{"expression": "$wsTestPanic()"}`,
+			Response: map[string]interface{}{
+				"result": nil,
+				"error": map[string]interface{}{
+					"message": "PANIC: oops",
+				},
+			},
+		},
+		{
+			Message: `{"expression": ""}`,
+			Response: map[string]interface{}{
+				"result": nil,
+				"error": map[string]interface{}{
+					"message": "expression is empty",
+				},
+			},
+		},
+		{
+			Message: `{"data": }`,
+			Response: map[string]interface{}{
+				"result": nil,
+				"error": map[string]interface{}{
+					"message": "input error: invalid character '}' looking for beginning of value",
+				},
+			},
+		},
+		{
+			// A null document replaces the current one.
+			Message: `{"data": null, "expression": "$exists(b)"}`,
+			Response: map[string]interface{}{
+				"result": false,
+				"error":  nil,
+			},
+		},
+	}
+
+	for _, test := range tests {
+
+		c.send(test.Message)
+
+		if test.Response == nil {
+			continue
+		}
+
+		if res := c.receive(); !reflect.DeepEqual(res, test.Response) {
+			t.Errorf("%s: expected response %v, got %v", test.Message, test.Response, res)
+		}
+	}
+
+	// Fragmented messages and pings are supported.
+	c.writeFrame(false, wsText, []byte(`{"expression": `))
+	c.writeFrame(true, wsPing, []byte("ping"))
+	c.writeFrame(true, wsContinuation, []byte(`"1 + 1"}`))
+
+	if opcode, payload := c.readFrame(); opcode != wsPong || string(payload) != "ping" {
+		t.Errorf("expected a pong, got opcode %d (%q)", opcode, payload)
+	}
+
+	if res := c.receive(); res["result"] != 2.0 {
+		t.Errorf("expected a result of 2, got %v", res)
+	}
+
+	c.writeFrame(true, wsClose, []byte{0x03, 0xE8})
+	c.expectClose(wsCloseNormal)
+}
+
+func TestEvaluateWSLimits(t *testing.T) {
+
+	// newServer starts a server with the default limits,
+	// modified by fn.
+	newServer := func(fn func(*limits)) *httptest.Server {
+		l := serverLimits
+		fn(&l)
+		return httptest.NewServer(http.HandlerFunc(l.evaluateWS))
+	}
+
+	// Evaluations that run out of time return an error.
+	srv := newServer(func(l *limits) {
+		l.evalTimeout = time.Nanosecond
+	})
+	defer srv.Close()
+
+	c := dialWS(t, srv)
+	defer c.conn.Close()
+
+	c.send(`{"expression": "1"}`)
+
+	res := c.receive()
+	if e, _ := res["error"].(map[string]interface{}); e == nil || !strings.Contains(e["message"].(string), "timed out") {
+		t.Errorf("expected a timeout error, got %v", res)
+	}
+
+	// Messages longer than the maximum document size close the
+	// connection.
+	srv = newServer(func(l *limits) {
+		l.maxDocSize = 32
+	})
+	defer srv.Close()
+
+	c = dialWS(t, srv)
+	defer c.conn.Close()
+
+	c.send(`{"data": [1, 2, 3]}`)
+	c.send(`{"data": "` + strings.Repeat("x", 32) + `"}`)
+	c.expectClose(wsCloseTooBig)
+
+	// So do protocol errors, e.g. unmasked frames.
+	c = dialWS(t, srv)
+	defer c.conn.Close()
+
+	c.conn.Write([]byte{0x81, 0x01, '1'})
+	c.expectClose(wsCloseProtocolError)
+
+	// Close frames are answered with a normal close, whatever
+	// the client's status code, unless the code is one that
+	// must not be sent.
+	for code, expected := range map[int]int{
+		wsCloseNormal: wsCloseNormal,
+		1001:          wsCloseNormal,
+		4000:          wsCloseNormal,
+		999:           wsCloseProtocolError,
+		1005:          wsCloseProtocolError,
+		1006:          wsCloseProtocolError,
+		1015:          wsCloseProtocolError,
+		5000:          wsCloseProtocolError,
+	} {
+		c = dialWS(t, srv)
+		defer c.conn.Close()
+
+		c.writeFrame(true, wsClose, []byte{byte(code >> 8), byte(code)})
+		c.expectClose(expected)
+	}
+
+	// Idle connections are closed.
+	srv = newServer(func(l *limits) {
+		l.idleTimeout = 10 * time.Millisecond
+	})
+	defer srv.Close()
+
+	c = dialWS(t, srv)
+	defer c.conn.Close()
+
+	if _, err := c.br.ReadByte(); err != io.EOF {
+		t.Errorf("expected an idle connection to be closed, got %v", err)
+	}
+
+	// Handshakes from pages on other sites are rejected.
+	c, resp := handshakeWS(t, srv, "http://example.com")
+	c.conn.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status %d, got %d", http.StatusForbidden, resp.StatusCode)
+	}
+
+	// Those from the same site are not.
+	c = dialWSOrigin(t, srv, "http://"+srv.Listener.Addr().String())
+	c.conn.Close()
+
+	// Requests that are not WebSocket handshakes are rejected.
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -11,6 +13,7 @@ import (
 	"reflect"
 	"regexp"
 	"strings"
+	"time"
 
 	jsonata "github.com/blues/jsonata-go"
 	types "github.com/blues/jsonata-go/jtypes"
@@ -27,18 +30,62 @@ type testCase struct {
 	Depth       int
 	Bindings    map[string]interface{}
 	Result      interface{}
-	Undefined   bool
+	Undefined   bool   `json:"undefinedResult"`
 	Error       string `json:"code"`
 	Token       string
 	Unordered   bool
 }
 
+// A result is the outcome of running a test case.
+type result int
+
+const (
+	passed result = iota
+	failed
+	skipped
+)
+
+// A groupSummary counts the results of the test cases in one
+// test group.
+type groupSummary struct {
+	Group   string `json:"group"`
+	Passed  int    `json:"passed"`
+	Failed  int    `json:"failed"`
+	Skipped int    `json:"skipped"`
+}
+
+func (s *groupSummary) add(r result) {
+	switch r {
+	case passed:
+		s.Passed++
+	case failed:
+		s.Failed++
+	case skipped:
+		s.Skipped++
+	}
+}
+
+// A summary counts the results of a test run, overall and by
+// test group.
+type summary struct {
+	Passed  int             `json:"passed"`
+	Failed  int             `json:"failed"`
+	Skipped int             `json:"skipped"`
+	Groups  []*groupSummary `json:"groups"`
+}
+
+// errTimeLimit is returned for test cases that do not finish
+// within their time limit.
+var errTimeLimit = errors.New("time limit exceeded")
+
 func main() {
 	var group string
 	var verbose bool
+	var jsonOutput bool
 
 	flag.BoolVar(&verbose, "verbose", false, "verbose output")
 	flag.StringVar(&group, "group", "", "restrict to one or more test groups")
+	flag.BoolVar(&jsonOutput, "json", false, "write a JSON summary of the results for each test group to stdout")
 	flag.Parse()
 
 	if flag.NArg() != 1 {
@@ -50,27 +97,40 @@ func main() {
 	testdir := filepath.Join(root, "groups")
 	datadir := filepath.Join(root, "datasets")
 
-	err := run(testdir, datadir, group)
+	sum, err := run(testdir, datadir, group)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error while running: %s\n", err)
 		os.Exit(2)
 	}
 
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(sum); err != nil {
+			fmt.Fprintf(os.Stderr, "Error while writing summary: %s\n", err)
+			os.Exit(2)
+		}
+		return
+	}
+
+	fmt.Fprintln(os.Stdout)
+	fmt.Fprintln(os.Stdout, sum.Passed, "passed", sum.Failed, "failed", sum.Skipped, "skipped")
 	fmt.Fprintln(os.Stdout, "OK")
 }
 
 // run runs all test cases
-func run(testdir string, datadir string, filter string) error {
-	var numPassed, numFailed int
-	err := filepath.Walk(testdir, func(path string, info os.FileInfo, walkFnErr error) error {
-		var dirName string
+func run(testdir string, datadir string, filter string) (*summary, error) {
+	var sum summary
+	groups := map[string]*groupSummary{}
 
+	err := filepath.Walk(testdir, func(path string, info os.FileInfo, walkFnErr error) error {
 		if info.IsDir() {
 			if path == testdir {
 				return nil
 			}
-			dirName = filepath.Base(path)
-			if filter != "" && !strings.Contains(dirName, filter) {
+			// Only filter on the top level directories. Groups
+			// can contain nested directories of test cases.
+			if filepath.Dir(path) == testdir && filter != "" && !strings.Contains(info.Name(), filter) {
 				return filepath.SkipDir
 			}
 			return nil
@@ -87,95 +147,126 @@ func run(testdir string, datadir string, filter string) error {
 			return fmt.Errorf("walk %s: %s", path, err)
 		}
 
-		for _, testCase := range testCases {
-			failed, err := runTest(testCase, datadir, path)
+		groupName, err := filepath.Rel(testdir, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		groupName = filepath.ToSlash(groupName)
+
+		group := groups[groupName]
+		if group == nil {
+			group = &groupSummary{
+				Group: groupName,
+			}
+			groups[groupName] = group
+			sum.Groups = append(sum.Groups, group)
+		}
 
+		for _, testCase := range testCases {
+			res, err := runTest(testCase, datadir, path)
 			if err != nil {
 				return err
 			}
-			if failed {
-				numFailed++
-			} else {
-				numPassed++
-			}
+			group.add(res)
 		}
 
 		return nil
 	})
 
 	if err != nil {
-		return fmt.Errorf("walk %s: ", err)
+		return nil, fmt.Errorf("walk: %w", err)
 	}
 
-	fmt.Fprintln(os.Stdout)
-	fmt.Fprintln(os.Stdout, numPassed, "passed", numFailed, "failed")
-	return nil
+	for _, group := range sum.Groups {
+		sum.Passed += group.Passed
+		sum.Failed += group.Failed
+		sum.Skipped += group.Skipped
+	}
+
+	return &sum, nil
 }
 
 // runTest runs a single test case
-func runTest(tc testCase, dataDir string, path string) (bool, error) {
-	// Some tests assume JavaScript-style object traversal,
-	// these are marked as unordered and can be skipped
-	// See https://github.com/jsonata-js/jsonata/issues/179
-	if tc.Unordered {
-		return false, nil
-	}
-
-	if tc.TimeLimit != 0 {
-		return false, nil
+func runTest(tc testCase, dataDir string, path string) (result, error) {
+	// Test cases that expect a stack overflow rely on jsonata-js's
+	// recursion limit. jsonata-go does not have one, so these cases
+	// would overflow the Go stack and crash the test runner.
+	if tc.Error == "U1001" {
+		return skipped, nil
 	}
 
 	// If this test has an associated dataset, load it
 	data := tc.Data
 	if tc.Dataset != "" {
 		var dest interface{}
-		err := readJSONFile(filepath.Join(dataDir, tc.Dataset+".json"), &dest)
+		err := readJSONFile(datasetPath(dataDir, path, tc.Dataset), &dest)
 		if err != nil {
-			return false, err
+			return failed, err
 		}
 		data = dest
 	}
 
-	var failed bool
 	expr, unQuoted := replaceQuotesInPaths(tc.Expr)
-	got, _ := eval(expr, tc.Bindings, data)
+	timeLimit := time.Duration(tc.TimeLimit) * time.Millisecond
+	got, err := evalWithTimeLimit(expr, tc.Bindings, data, timeLimit)
 
-	if !equalResults(got, tc.Result) {
-		failed = true
-		printTestCase(os.Stderr, tc, strings.TrimSuffix(filepath.Base(path), ".json"))
-		fmt.Fprintf(os.Stderr, "Test file: %s \n", path)
+	if checkResult(tc, got, err) {
+		return passed, nil
+	}
 
-		if tc.Category != "" {
-			fmt.Fprintf(os.Stderr, "Category: %s \n", tc.Category)
-		}
-		if tc.Description != "" {
-			fmt.Fprintf(os.Stderr, "Description: %s \n", tc.Description)
-		}
+	printTestCase(os.Stderr, tc, strings.TrimSuffix(filepath.Base(path), ".json"))
+	fmt.Fprintf(os.Stderr, "Test file: %s \n", path)
 
-		fmt.Fprintf(os.Stderr, "Expression: %s\n", expr)
-		if unQuoted {
-			fmt.Fprintf(os.Stderr, "Unquoted: %t\n", unQuoted)
-		}
+	if tc.Category != "" {
+		fmt.Fprintf(os.Stderr, "Category: %s \n", tc.Category)
+	}
+	if tc.Description != "" {
+		fmt.Fprintf(os.Stderr, "Description: %s \n", tc.Description)
+	}
+
+	fmt.Fprintf(os.Stderr, "Expression: %s\n", expr)
+	if unQuoted {
+		fmt.Fprintf(os.Stderr, "Unquoted: %t\n", unQuoted)
+	}
+	switch {
+	case tc.Error != "":
+	case tc.Undefined:
+		fmt.Fprintln(os.Stderr, "Expected Result: undefined")
+	default:
 		fmt.Fprintf(os.Stderr, "Expected Result: %v [%T]\n", tc.Result, tc.Result)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Actual error:    %v [%s]\n", err, jsonata.ErrorCode(err))
+	} else {
 		fmt.Fprintf(os.Stderr, "Actual Result:   %v [%T]\n", got, got)
 	}
 
-	// TODO this block is commented out to make staticcheck happy,
-	// but we should check that the error is the same as the js one
-	// var exp error
-	// if tc.Undefined {
-	// 	exp = jsonata.ErrUndefined
-	// } else {
-	// 	exp = convertError(tc.Error)
-	// }
-
-	// if !reflect.DeepEqual(err, exp) {
-	// TODO: Compare actual/expected errors
-	// }
-
 	return failed, nil
 }
 
+// checkResult reports whether the result and error returned by
+// a test case match the expected outcome.
+func checkResult(tc testCase, got interface{}, err error) bool {
+	switch {
+	case tc.Error != "":
+		// Test cases that expect an error specify the jsonata-js
+		// error code. Check that we return an error with the same
+		// code.
+		return jsonata.ErrorCode(err) == tc.Error
+	case err == jsonata.ErrUndefined:
+		return tc.Undefined
+	case err != nil, tc.Undefined:
+		return false
+	case tc.Unordered:
+		// Some tests assume JavaScript-style object traversal
+		// and don't specify the order of the results.
+		// See https://github.com/jsonata-js/jsonata/issues/179
+		return equalResultsUnordered(got, tc.Result)
+	default:
+		return equalResults(got, tc.Result)
+	}
+}
+
 // loadTestExprFile loads a jsonata expression from a file and returns the
 // expression
 // For example, one test looks like this
@@ -189,9 +280,7 @@ func runTest(tc testCase, dataDir string, path string) (bool, error) {
 // We want to load the expression from case000.jsonata so we can use it
 // as an expression in the test case
 func loadTestExprFile(testPath string, exprFileName string) (string, error) {
-	splitPath := strings.Split(testPath, "/")
-	splitPath[len(splitPath)-1] = exprFileName
-	exprFilePath := strings.Join(splitPath, "/")
+	exprFilePath := filepath.Join(filepath.Dir(testPath), filepath.FromSlash(exprFileName))
 
 	content, err := ioutil.ReadFile(exprFilePath)
 	if err != nil {
@@ -220,13 +309,13 @@ func loadTestCases(path string) ([]testCase, error) {
 
 		// If any of the tests specify an expression file, load it from
 		// disk and add it to the test case
-		for _, testCase := range tcs {
-			if testCase.ExprFile != "" {
-				expr, err := loadTestExprFile(path, testCase.ExprFile)
+		for i := range tcs {
+			if tcs[i].ExprFile != "" {
+				expr, err := loadTestExprFile(path, tcs[i].ExprFile)
 				if err != nil {
 					return nil, err
 				}
-				testCase.Expr = expr
+				tcs[i].Expr = expr
 			}
 		}
 		return tcs, nil
@@ -248,6 +337,25 @@ func loadTestCases(path string) ([]testCase, error) {
 	return []testCase{tc}, nil
 }
 
+// datasetPath returns the path of the dataset used by a test
+// case. Datasets are usually named, e.g. "dataset5", and live in
+// the datasets directory. A dataset given as a relative path,
+// e.g. "./data.json" or "../shared/data", is resolved relative
+// to the directory containing the test case instead. Paths use
+// forward slashes on all platforms.
+func datasetPath(dataDir string, testPath string, dataset string) string {
+	name := filepath.FromSlash(dataset)
+	if filepath.Ext(name) != ".json" {
+		name += ".json"
+	}
+
+	if !strings.Contains(dataset, "/") {
+		return filepath.Join(dataDir, name)
+	}
+
+	return filepath.Join(filepath.Dir(testPath), name)
+}
+
 func printTestCase(w io.Writer, tc testCase, name string) {
 	fmt.Fprintln(w)
 	fmt.Fprintf(w, "Failed Test Case: %s\n", name)
@@ -267,7 +375,7 @@ func printTestCase(w io.Writer, tc testCase, name string) {
 	}
 }
 
-func eval(expression string, bindings map[string]interface{}, data interface{}) (interface{}, error) {
+func eval(ctx context.Context, expression string, bindings map[string]interface{}, data interface{}) (interface{}, error) {
 	expr, err := jsonata.Compile(expression)
 	if err != nil {
 		return nil, err
@@ -278,7 +386,29 @@ func eval(expression string, bindings map[string]interface{}, data interface{})
 		return nil, err
 	}
 
-	return expr.Eval(data)
+	return expr.EvalCtx(ctx, data)
+}
+
+// evalWithTimeLimit is like eval but returns errTimeLimit if
+// the evaluation does not finish within the given time limit.
+// A limit of zero means no limit. The evaluation stops when the
+// time is up, but not in the middle of a call to a function.
+func evalWithTimeLimit(expression string, bindings map[string]interface{}, data interface{}, limit time.Duration) (interface{}, error) {
+
+	ctx := context.Background()
+
+	if limit > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limit)
+		defer cancel()
+	}
+
+	value, err := eval(ctx, expression, bindings, data)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, errTimeLimit
+	}
+
+	return value, err
 }
 
 func equalResults(x, y interface{}) bool {
@@ -322,6 +452,50 @@ func equalResults(x, y interface{}) bool {
 	return false
 }
 
+// equalResultsUnordered is like equalResults except that the
+// elements of arrays can appear in any order.
+func equalResultsUnordered(x, y interface{}) bool {
+	vx := types.Resolve(reflect.ValueOf(x))
+	vy := types.Resolve(reflect.ValueOf(y))
+
+	if !types.IsArray(vx) || !types.IsArray(vy) {
+		return equalResults(x, y)
+	}
+
+	if vx.Len() != vy.Len() {
+		return false
+	}
+
+	matched := map[int]bool{}
+
+	for i := 0; i < vx.Len(); i++ {
+
+		found := false
+		ix := vx.Index(i).Interface()
+
+		for j := 0; j < vy.Len(); j++ {
+
+			if matched[j] {
+				continue
+			}
+
+			if !equalResults(ix, vy.Index(j).Interface()) {
+				continue
+			}
+
+			found = true
+			matched[j] = true
+			break
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
 func readJSONFile(path string, dest interface{}) error {
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
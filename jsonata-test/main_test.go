@@ -1,6 +1,14 @@
 package main
 
-import "testing"
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
 
 func TestReplaceQuotesInPaths(t *testing.T) {
 
@@ -90,3 +98,167 @@ func TestReplaceQuotesInPathsNoOp(t *testing.T) {
 		}
 	}
 }
+
+func TestRun(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "jsonata-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	groups := map[string]string{
+		"numbers": `[
+			{"expr": "1 + 2", "result": 3},
+			{"expr": "1 + 2", "result": 4},
+			{"expr": "1 + \"2\"", "code": "T2001"},
+			{"expr": "1 + \"2\"", "code": "T2002"},
+			{"expr": "1 + \"2\"", "result": 3}
+		]`,
+		"arrays": `[
+			{"expr": "[3, 1, 2]", "result": [1, 2, 3], "unordered": true},
+			{"expr": "[3, 1, 2]", "result": [1, 2, 3]},
+			{"expr": "[3, 1, 1]", "result": [1, 3, 3], "unordered": true},
+			{"expr": "nothing", "undefinedResult": true},
+			{"expr": "nothing", "result": null},
+			{"expr": "$f()", "code": "U1001"}
+		]`,
+	}
+
+	for name, cases := range groups {
+		path := filepath.Join(dir, "groups", name)
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(path, "cases.json"), []byte(cases), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Silence the details of failed test cases.
+	stderr := os.Stderr
+	os.Stderr, _ = os.Open(os.DevNull)
+	defer func() {
+		os.Stderr = stderr
+	}()
+
+	sum, err := run(filepath.Join(dir, "groups"), filepath.Join(dir, "datasets"), "")
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+
+	b, err := json.Marshal(sum)
+	if err != nil {
+		t.Fatalf("json.Marshal: %s", err)
+	}
+
+	var got interface{}
+	json.Unmarshal(b, &got)
+
+	var exp interface{}
+	json.Unmarshal([]byte(`{
+		"passed": 4,
+		"failed": 6,
+		"skipped": 1,
+		"groups": [
+			{"group": "arrays", "passed": 2, "failed": 3, "skipped": 1},
+			{"group": "numbers", "passed": 2, "failed": 3, "skipped": 0}
+		]
+	}`), &exp)
+
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("\nExpected: %s\nActual:   %s", exp, b)
+	}
+}
+
+func TestEvalWithTimeLimit(t *testing.T) {
+
+	got, err := evalWithTimeLimit(`$sum([1..100])`, nil, nil, time.Second)
+	if err != nil || !equalResults(got, 5050) {
+		t.Errorf("expected 5050, got %v (error %v)", got, err)
+	}
+
+	// The evaluation stops when the time is up, so the test
+	// does not leave it running in the background.
+	_, err = evalWithTimeLimit(`$reduce([1..1000000], function($a, $v) { $a + $v })`, nil, nil, time.Millisecond)
+	if err != errTimeLimit {
+		t.Errorf("expected errTimeLimit, got %v", err)
+	}
+}
+
+func TestRunExprFiles(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "jsonata-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"groups/files/cases.json": `[
+			{"expr-file": "sum.jsonata", "data": [1, 2, 3], "result": 6},
+			{"expr-file": "count.jsonata", "data": [1, 2, 3], "result": 3}
+		]`,
+		"groups/files/sum.jsonata":   `$sum($)`,
+		"groups/files/count.jsonata": `$count($)`,
+		"groups/files/nested/case.json": `{
+			"expr-file": "name.jsonata",
+			"dataset": "../../../data/people",
+			"result": "Fred"
+		}`,
+		"groups/files/nested/name.jsonata":    `name`,
+		"data/people.json":                    `{"name": "Fred"}`,
+		"groups/datasets/case.json":           `{"expr": "name", "dataset": "dataset0", "result": "Wilma"}`,
+		"datasets/dataset0.json":              `{"name": "Wilma"}`,
+		"groups/other/case.json":              `{"expr": "1", "result": 1}`,
+		"groups/other/nested/files/case.json": `{"expr": "2", "result": 2}`,
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Silence the details of failed test cases.
+	stderr := os.Stderr
+	os.Stderr, _ = os.Open(os.DevNull)
+	defer func() {
+		os.Stderr = stderr
+	}()
+
+	// The files filter matches a top level group only, so the
+	// nested directory called files in the other group is not
+	// included.
+	sum, err := run(filepath.Join(dir, "groups"), filepath.Join(dir, "datasets"), "files")
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+
+	exp := &summary{
+		Passed: 3,
+		Groups: []*groupSummary{
+			{Group: "files", Passed: 2},
+			{Group: "files/nested", Passed: 1},
+		},
+	}
+
+	if !reflect.DeepEqual(sum, exp) {
+		b, _ := json.Marshal(sum)
+		t.Errorf("unexpected summary: %s", b)
+	}
+
+	sum, err = run(filepath.Join(dir, "groups"), filepath.Join(dir, "datasets"), "")
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+
+	if sum.Passed != 6 || sum.Failed != 0 {
+		b, _ := json.Marshal(sum)
+		t.Errorf("unexpected summary: %s", b)
+	}
+}
@@ -5,8 +5,11 @@
 package jsonata
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"reflect"
 	"sync"
 	"time"
@@ -20,6 +23,9 @@ import (
 var (
 	globalRegistryMutex sync.RWMutex
 	globalRegistry      map[string]reflect.Value
+
+	globalOperatorsMutex sync.RWMutex
+	globalOperators      map[string]Operator
 )
 
 // An Extension describes custom functionality added to a
@@ -30,6 +36,22 @@ type Extension struct {
 	// functionality and returns either one or two values.
 	// The second return value, if provided, must be an
 	// error.
+	//
+	// If the first parameter of Func has type context.Context,
+	// Func receives the context passed to Expr.EvalCtx, or
+	// context.Background() if the expression was evaluated
+	// with one of the other methods. Like a CallContext, the
+	// parameter does not count towards the function's
+	// arguments in JSONata, and it is not included in the
+	// arguments passed to UndefinedHandler, UndefinedArgs and
+	// EvalContextHandler or checked against Signature.
+	//
+	// Objects created by an expression keep their keys in
+	// order, so internally they are *jtypes.OrderedMap values.
+	// Func receives them as map[string]interface{} values
+	// instead, including when they are nested in arrays or
+	// other objects, unless the parameter has type
+	// *jtypes.OrderedMap or reflect.Value.
 	Func interface{}
 
 	// UndefinedHandler is a function that determines how
@@ -37,16 +59,180 @@ type Extension struct {
 	// UndefinedHandler is non-nil, it is called before
 	// Func with the same arguments. If the handler returns
 	// true, Func is not called and undefined is returned
-	// instead.
+	// instead. If the extension has a Signature, the handler
+	// is called after the arguments have been checked against
+	// the signature.
+	//
+	// Partial applications of an extension (e.g. $fn(?, 2))
+	// and functions composed with the ~> operator call the
+	// extension with the arguments they are given, so the
+	// handler applies to them in the same way as to a direct
+	// call. Missing placeholder arguments are undefined.
+	//
+	// New extensions should use UndefinedArgs, which does the
+	// same job without exposing the internal representation
+	// of undefined values.
 	UndefinedHandler jtypes.ArgHandler
 
+	// UndefinedArgs is like UndefinedHandler except that it
+	// is passed a slice that reports which of the arguments
+	// are undefined, rather than the arguments themselves.
+	// It is only called if at least one argument is undefined.
+	// The jtypes package provides UndefinedArgs for common
+	// cases, e.g. jtypes.ArgUndefinedAny(0) returns undefined
+	// if the first argument is undefined, and
+	// jtypes.ArgsAnyUndefined() returns undefined if any
+	// argument is. An Extension cannot have both an
+	// UndefinedHandler and UndefinedArgs.
+	UndefinedArgs jtypes.UndefinedArgs
+
 	// EvalContextHandler is a function that determines how
 	// this extension handles missing arguments. If
 	// EvalContextHandler is non-nil, it is called before
 	// Func with the same arguments. If the handler returns
 	// true, the evaluation context is inserted as the first
-	// argument when Func is called.
+	// argument when Func is called. Most extensions should
+	// use ApplyContext instead.
 	EvalContextHandler jtypes.ArgHandler
+
+	// ApplyContext makes the evaluation context the default
+	// value of Func's first parameter, as it is for built-in
+	// functions such as $uppercase and $number. If ApplyContext
+	// is true and a call does not supply the first argument,
+	// the context is inserted at the start of the argument
+	// list. The first argument counts as missing if there are
+	// too few arguments for the required parameters, or if
+	// there are fewer arguments than parameters and the first
+	// argument does not have the first parameter's type. For
+	// example, with a Func of type func(string, int) string,
+	// both $fn() and $fn(2) use the context, but $fn("a", 2)
+	// and $fn("a") do not.
+	//
+	// The evaluation context is the value that the function
+	// call is applied to. In a path such as name.$fn(), it is
+	// the current value of name. A call that is not part of a
+	// path, e.g. $fn(), uses the current input, which at the
+	// top level of an expression is the data passed to Eval.
+	// If the context is undefined, the argument is undefined.
+	// If the context has the wrong type, the call fails with
+	// an ArgTypeError.
+	//
+	// If ApplyContext is false (the default), a missing first
+	// argument is an error, unless the first parameter is
+	// optional. For extensions with a Signature, ApplyContext
+	// is equivalent to marking the first parameter with "-".
+	// ApplyContext cannot be combined with an EvalContextHandler.
+	ApplyContext bool
+
+	// Signature is an optional JSONata type signature for
+	// Func, e.g. "<s-n?:s>". It uses the same syntax as the
+	// signatures of typed lambda functions. If Signature is
+	// set, the number and types of the arguments are checked
+	// against it before Func is called. Missing arguments for
+	// optional parameters are passed to Func as undefined and
+	// a contextable parameter is replaced by the evaluation
+	// context if no argument is provided for it (see
+	// ApplyContext). Signature cannot be combined with an
+	// EvalContextHandler.
+	Signature string
+}
+
+// A CallContext gives an extension function access to the
+// expression that called it. If the first parameter of an
+// Extension's Func has type CallContext, JSONata populates
+// it when the function is called. The parameter does not
+// count towards the function's arguments in JSONata, so
+//
+//	func(ctx jsonata.CallContext, ref string) (interface{}, error)
+//
+// is called from JSONata as $resolve(ref).
+//
+// The evaluation context and environment are only available
+// when the function is called directly, e.g. $resolve(ref).
+// If the function is called indirectly, e.g. as an argument
+// to $map, the context is undefined and only the variables
+// registered with the Expr are available.
+type CallContext struct {
+	context reflect.Value
+	env     *environment
+}
+
+var typeCallContext = reflect.TypeOf(CallContext{})
+
+// Context returns the evaluation context of the function
+// call, i.e. the value of $. It returns nil if the context
+// is undefined.
+func (c CallContext) Context() interface{} {
+	return interfaceOrNil(c.context)
+}
+
+// Root returns the input data of the expression, i.e. the
+// value of $$. It returns nil if the input is undefined.
+func (c CallContext) Root() interface{} {
+	if c.env == nil {
+		return nil
+	}
+	return interfaceOrNil(c.env.lookup("$"))
+}
+
+// Lookup returns the value of a variable that is visible
+// at the call site, including variables bound with the :=
+// operator and variables registered with the Expr. The name
+// does not include the leading $. The second return value
+// is false if the variable is undefined.
+func (c CallContext) Lookup(name string) (interface{}, bool) {
+	if c.env == nil {
+		return nil, false
+	}
+
+	v := c.env.lookup(name)
+	if v == undefined || !v.CanInterface() {
+		return nil, false
+	}
+
+	return v.Interface(), true
+}
+
+// Eval evaluates a JSONata expression against the given
+// context. The expression can refer to any variables that
+// are visible at the call site. Assignments made by the
+// expression are not visible outside of it. If the result
+// is undefined, Eval returns jtypes.ErrUndefined, which can
+// be returned as is from an extension function.
+func (c CallContext) Eval(expr string, context interface{}) (interface{}, error) {
+
+	node, err := jparse.ParseWithOperators(expr, c.env.operatorBps())
+	if err != nil {
+		return nil, err
+	}
+
+	input, ok := context.(reflect.Value)
+	if !ok {
+		input = reflect.ValueOf(context)
+	}
+
+	env := baseEnv
+	if c.env != nil {
+		env = c.env
+	}
+
+	result, err := eval(node, input, newEnvironment(env, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	if result == undefined || !result.CanInterface() {
+		return nil, jtypes.ErrUndefined
+	}
+
+	return result.Interface(), nil
+}
+
+func interfaceOrNil(v reflect.Value) interface{} {
+	if v == undefined || !v.CanInterface() {
+		return nil
+	}
+	return v.Interface()
 }
 
 // RegisterExts registers custom functions for use in JSONata
@@ -54,8 +240,10 @@ type Extension struct {
 // startup (e.g. from an init function).
 //
 // Custom functions registered at the package level will be
-// available to all Expr objects. To register custom functions
-// with specific Expr objects, use the RegisterExts method.
+// available to all Expr objects compiled after the call. Expr
+// objects that have already been compiled are not affected.
+// To register custom functions with specific Expr objects, use
+// the RegisterExts method or CompileWithExts.
 func RegisterExts(exts map[string]Extension) error {
 
 	values, err := processExts(exts)
@@ -85,10 +273,260 @@ func RegisterVars(vars map[string]interface{}) error {
 	return nil
 }
 
+// An Operator describes a custom infix operator. See
+// RegisterOperator.
+type Operator struct {
+
+	// BindingPower sets the precedence of the operator
+	// relative to the built-in operators. It must be from 30
+	// (the binding power of 'or') to 70 (the binding power of
+	// '*'). See jparse.CheckOperator for details.
+	BindingPower int
+
+	// Func implements the operator. It is called with the
+	// values of the left and right hand operands and returns
+	// the result of the operation. JSON null is passed as nil.
+	// If Func returns nil or jtypes.ErrUndefined, the result
+	// is undefined. Other errors are returned to the caller
+	// wrapped in an OperatorError.
+	Func func(lhs, rhs interface{}) (interface{}, error)
+
+	// EvalUndefined controls what happens when one of the
+	// operands is undefined. By default, Func is not called
+	// and the result is undefined, as with the arithmetic
+	// operators. If EvalUndefined is true, Func is called with
+	// nil in place of the undefined operand, much as the string
+	// concatenation operator treats undefined as an empty
+	// string.
+	EvalUndefined bool
+}
+
+// RegisterOperator registers a custom infix operator for use
+// in JSONata expressions. For example,
+//
+//	jsonata.RegisterOperator("~~", jsonata.Operator{
+//		BindingPower: 50,
+//		Func:         fuzzyMatch,
+//	})
+//
+// lets expressions write a ~~ b in place of $fuzzyMatch(a, b).
+// The symbol must start with ! or ~ and must not clash with
+// the built-in operators. See jparse.CheckOperator for the
+// full rules. Registering a symbol that is already registered
+// replaces the existing operator.
+//
+// Like RegisterExts, RegisterOperator is designed to be called
+// on program startup. Operators are available to Expr objects
+// compiled after the call. Expr objects that have already been
+// compiled are not affected, either by RegisterOperator or by
+// UnregisterOperator.
+func RegisterOperator(symbol string, op Operator) error {
+
+	if err := jparse.CheckOperator(symbol, op.BindingPower); err != nil {
+		return err
+	}
+
+	if op.Func == nil {
+		return fmt.Errorf("operator %q has no Func", symbol)
+	}
+
+	updateGlobalOperators(func(ops map[string]Operator) {
+		ops[symbol] = op
+	})
+	return nil
+}
+
+// UnregisterOperator removes a custom operator registered with
+// RegisterOperator. Expressions compiled after the call cannot
+// use the operator. UnregisterOperator does nothing if the
+// symbol is not registered.
+func UnregisterOperator(symbol string) {
+	updateGlobalOperators(func(ops map[string]Operator) {
+		delete(ops, symbol)
+	})
+}
+
+// updateGlobalOperators applies update to a copy of the global
+// operators and replaces the original with it. Expr objects
+// share the map that was current when they were compiled, so
+// it must not be modified in place.
+func updateGlobalOperators(update func(map[string]Operator)) {
+
+	globalOperatorsMutex.Lock()
+	defer globalOperatorsMutex.Unlock()
+
+	ops := make(map[string]Operator, len(globalOperators)+1)
+	for symbol, op := range globalOperators {
+		ops[symbol] = op
+	}
+
+	update(ops)
+	globalOperators = ops
+}
+
+// operatorBps returns the binding powers of the given
+// operators in the form used by jparse.ParseWithOperators.
+func operatorBps(ops map[string]Operator) map[string]int {
+
+	if len(ops) == 0 {
+		return nil
+	}
+
+	bps := make(map[string]int, len(ops))
+	for symbol, op := range ops {
+		bps[symbol] = op.BindingPower
+	}
+
+	return bps
+}
+
+// EvalOptions controls how an Expr is evaluated. Its limits
+// restrict the resources that an Expr can use and are designed
+// for applications that evaluate untrusted expressions. Limits
+// with a value of zero take their default values.
+//
+// When a limit is exceeded, evaluation stops and returns an
+// EvalError of type ErrLimitExceeded. The error's Token field
+// holds the name of the limit (e.g. "MaxStringLength").
+type EvalOptions struct {
+
+	// MaxRangeItems is the maximum number of items in an array
+	// created by the range operator. The default is 10,000,000,
+	// which matches jsonata-js. Ranges that exceed the default
+	// return an error of type ErrMaxRangeItems.
+	MaxRangeItems int
+
+	// MaxStringLength is the maximum length in bytes of a string
+	// created by the string concatenation operator or returned by
+	// a function. The default is no limit.
+	MaxStringLength int
+
+	// MaxArrayLength is the maximum number of items in an array
+	// created by a range, an array constructor or a path, or
+	// returned by a function. The default is no limit.
+	MaxArrayLength int
+
+	// Decimal enables exact decimal arithmetic. In decimal mode,
+	// number literals in the expression (and numbers in the input
+	// to EvalBytes) are represented as *jtypes.Decimal values
+	// rather than float64s, so that expressions like 0.1 + 0.2
+	// produce exact results. Operations that mix Decimals and
+	// regular numbers produce Decimals. Numeric results are
+	// returned from Eval as json.Number values.
+	//
+	// Decimal mode applies to the arithmetic and comparison
+	// operators and to the aggregation functions $sum, $max,
+	// $min and $average. Other built-in functions, such as
+	// $round and $power, convert their arguments to float64.
+	// Results that have no exact decimal representation, such
+	// as 22/7, are returned with the precision of a float64.
+	Decimal bool
+
+	// GroupDuplicateKeys changes how object constructors handle
+	// keys that are produced by more than one name/value pair,
+	// e.g. {"a": 1, "a": 2}. By default, duplicate keys return
+	// an error of type ErrDuplicateKey, which matches jsonata-js.
+	// If GroupDuplicateKeys is true, the values for a duplicate
+	// key are combined into an array instead.
+	GroupDuplicateKeys bool
+
+	// Graphemes makes $length, $substring and $pad count
+	// user-perceived characters (extended grapheme clusters as
+	// defined by Unicode Standard Annex #29) rather than code
+	// points. For example, the emoji 👩‍👩‍👧‍👦 is a single
+	// character made up of seven code points, and "é" written
+	// as an e followed by a combining accent is one character
+	// made up of two code points. In either mode, strings are
+	// never split in the middle of a code point.
+	Graphemes bool
+
+	// CollectErrors makes array constructors, object
+	// constructors and group-by expressions carry on when one
+	// of their items or values fails to evaluate. The failed
+	// item (or the key whose value failed) is omitted from the
+	// result and the error is collected. If any errors were
+	// collected, the evaluation methods return the partial
+	// result along with a *MultiError that holds them.
+	//
+	// Errors in predicates, conditions and the function part
+	// of a function call are never collected where they occur
+	// because they determine what else gets evaluated. They
+	// fail the enclosing item or value as a whole. Limit
+	// errors and context errors always stop the evaluation.
+	CollectErrors bool
+
+	// KeepSingletonArrays stops paths that produce the result
+	// of the expression from unwrapping a single matching value.
+	// For example, Phone[type="mobile"].number returns
+	// ["077 7700 1234"] rather than "077 7700 1234". It has the
+	// same effect as appending [] to those paths (including the
+	// last expression in a block and both branches of a
+	// condition). Paths elsewhere in the expression, such as
+	// function arguments, are unaffected.
+	KeepSingletonArrays bool
+
+	// TemporalComparison makes the <, <=, > and >= operators
+	// compare strings that are both RFC 3339 timestamps (e.g.
+	// "2024-01-01T02:00:00+02:00") as instants in time rather
+	// than as strings. Timestamps with different time zone
+	// offsets compare correctly, e.g. the example above is not
+	// less than "2024-01-01T00:00:00Z". The = and != operators
+	// still compare timestamps as strings.
+	TemporalComparison bool
+
+	// MethodFallback makes names in paths call methods on Go
+	// structs in the input that have no field with that name.
+	// For example, with an input of type []Order, the path
+	// Total calls the Total method of each Order. Only exported
+	// methods that take no arguments and return one value, or
+	// a value and an error, are called. Methods with pointer
+	// receivers are called on a copy of the struct unless it
+	// was passed by pointer or is an item in a slice. A method
+	// that returns a non-nil error stops the evaluation with
+	// an error of type ErrMethodCall.
+	MethodFallback bool
+
+	// LenientObjectKeys makes object constructors, group-by
+	// expressions and the update objects of the transform
+	// operator accept keys that evaluate to numbers or
+	// booleans. Such keys are converted to strings in the same
+	// way as $string, e.g. Product{ProductID: Price} uses keys
+	// like "858383". By default, and in jsonata-js, keys that
+	// are not strings return an error of type ErrIllegalKey.
+	// Keys that are null, objects, arrays or functions are
+	// errors either way. Converted keys follow the usual rules
+	// for duplicates, so the number 858383 and the string
+	// "858383" produce the same key.
+	LenientObjectKeys bool
+}
+
 // An Expr represents a JSONata expression.
+//
+// An Expr is safe to evaluate from multiple goroutines at
+// once. However, RegisterExts, RegisterVars, SetClock,
+// SetRandSource, SetConfig, SetTrace, SetTraceSink,
+// SetCollator and SetMetrics modify the Expr and must not be
+// called concurrently with any other method. To register different
+// functions or variables for each goroutine, give each
+// goroutine its own copy of the Expr using the Clone method.
 type Expr struct {
-	node     jparse.Node
-	registry map[string]reflect.Value
+	node      jparse.Node
+	registry  map[string]reflect.Value
+	options   *EvalOptions
+	overrides map[string]reflect.Value
+	clock     func() time.Time
+	random    map[string]reflect.Value
+	config    reflect.Value
+	operators map[string]Operator
+	rawPath   *rawPath
+	trace     func(TraceEvent)
+	traceSink reflect.Value
+	collator  Collator
+	collated  map[string]reflect.Value
+	metrics   Metrics
+
+	timestamps  map[*jparse.StringNode]time.Time
+	fingerprint string
 }
 
 // Compile parses a JSONata expression and returns an Expr
@@ -96,14 +534,40 @@ type Expr struct {
 // not a valid JSONata expression, Compile returns an error
 // of type jparse.Error.
 func Compile(expr string) (*Expr, error) {
+	return CompileWithOptions(expr, EvalOptions{})
+}
 
-	node, err := jparse.Parse(expr)
+// CompileWithOptions is like Compile except that evaluation of
+// the returned Expr is subject to the limits in opts.
+func CompileWithOptions(expr string, opts EvalOptions) (*Expr, error) {
+
+	globalOperatorsMutex.RLock()
+	ops := globalOperators
+	globalOperatorsMutex.RUnlock()
+
+	node, err := jparse.ParseWithOperators(expr, operatorBps(ops))
 	if err != nil {
 		return nil, err
 	}
 
+	if opts.KeepSingletonArrays {
+		node = keepSingletonArrays(node)
+	}
+
 	e := &Expr{
-		node: node,
+		node:        node,
+		operators:   ops,
+		rawPath:     newRawPath(node),
+		fingerprint: fingerprint(expr),
+	}
+
+	if opts != (EvalOptions{}) {
+		e.options = &opts
+		e.overrides = overrideCallables(opts)
+	}
+
+	if opts.TemporalComparison {
+		e.timestamps = literalTimestamps(node)
 	}
 
 	globalRegistryMutex.RLock()
@@ -113,6 +577,54 @@ func Compile(expr string) (*Expr, error) {
 	return e, nil
 }
 
+// keepSingletonArrays sets the KeepArrays flag on the paths
+// that produce the result of node. A name on its own is made
+// into a path, as the parser does for name[].
+func keepSingletonArrays(node jparse.Node) jparse.Node {
+
+	switch n := node.(type) {
+	case *jparse.PathNode:
+		n.KeepArrays = true
+	case *jparse.NameNode:
+		return &jparse.PathNode{
+			Span:       n.Span,
+			Steps:      []jparse.Node{n},
+			KeepArrays: true,
+		}
+	case *jparse.BlockNode:
+		if len(n.Exprs) > 0 {
+			last := len(n.Exprs) - 1
+			n.Exprs[last] = keepSingletonArrays(n.Exprs[last])
+		}
+	case *jparse.ConditionalNode:
+		n.Then = keepSingletonArrays(n.Then)
+		if n.Else != nil {
+			n.Else = keepSingletonArrays(n.Else)
+		}
+	}
+
+	return node
+}
+
+// CompileWithExts is like Compile except that the returned Expr
+// can also call the given custom functions. The functions are
+// only available to the returned Expr. They take precedence
+// over custom functions with the same names registered at the
+// package level.
+func CompileWithExts(expr string, exts map[string]Extension) (*Expr, error) {
+
+	e, err := Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := e.RegisterExts(exts); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
 // MustCompile is like Compile except it panics if given an
 // invalid expression.
 func MustCompile(expr string) *Expr {
@@ -130,16 +642,152 @@ func MustCompile(expr string) *Expr {
 // a JSON string. The output is an object suitable for
 // marshaling into a JSON string. Use EvalBytes to skip the
 // unmarshal/marshal steps and work solely with JSON strings.
+// JSON null values in the output, including those nested in
+// arrays and objects, are returned as untyped nils.
+//
+// The wildcard (*) and descendant (**) operators visit the
+// values of an object in a stable order. For *jtypes.OrderedMap
+// input (see jtypes.DecodeOrdered), this is the order in which
+// the keys were added, as in jsonata-js. Go maps have no key
+// order, so their keys are visited in lexicographic order.
 //
 // Eval can be called multiple times, with different input
 // data if required.
 func (e *Expr) Eval(data interface{}) (interface{}, error) {
+	return e.EvalCtx(context.Background(), data)
+}
+
+// EvalCtx is like Eval except that it passes ctx to custom
+// functions whose first parameter is a context.Context. This
+// allows functions that call external services to observe the
+// caller's deadlines and cancellation. If ctx is done before
+// or during the evaluation, EvalCtx returns ctx.Err(). The
+// evaluator checks ctx before it evaluates each part of the
+// expression, but a single call to a Go function (built-in or
+// custom) runs to completion. Errors
+// returned by custom functions, including context errors, are
+// wrapped in an ExtensionError and can be examined with
+// errors.Is and errors.As.
+func (e *Expr) EvalCtx(ctx context.Context, data interface{}) (interface{}, error) {
+
+	result, err := e.evalOrdered(ctx, data, nil)
+	if err != nil && !isPartial(err) {
+		return nil, err
+	}
+
+	// Objects created by the expression are ordered internally.
+	// Return them as regular Go maps.
+	return jtypes.Plain(result), err
+}
+
+// EvalWithVars is like Eval except that the given variables
+// are available to the expression for this evaluation only.
+// They take precedence over any variables of the same name
+// registered with RegisterVars. Variables can be any value
+// that RegisterVars accepts, including values that implement
+// jtypes.Callable, which can be called from the expression
+// like functions.
+//
+// Unlike RegisterVars, EvalWithVars does not modify the Expr.
+// It can be called from multiple goroutines at once, with
+// different variables for each call.
+func (e *Expr) EvalWithVars(data interface{}, vars map[string]interface{}) (interface{}, error) {
+
+	values, err := processVars(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := e.evalOrdered(context.Background(), data, values)
+	if err != nil && !isPartial(err) {
+		return nil, err
+	}
+
+	return jtypes.Plain(result), err
+}
+
+// EvalOrdered is like Eval except that objects created by the
+// expression (e.g. with object constructors, $merge or the
+// transform operator) are returned as *jtypes.OrderedMap values
+// rather than Go maps. An OrderedMap remembers the order in
+// which its keys were added and encodes to JSON in that order.
+// Its keys and values can be read with the Keys and Get methods,
+// or it can be converted to a Go map with the Map method.
+//
+// Objects that come from the input data are returned as is.
+func (e *Expr) EvalOrdered(data interface{}) (interface{}, error) {
+	return e.evalOrdered(context.Background(), data, nil)
+}
+
+func (e *Expr) evalOrdered(ctx context.Context, data interface{}, vars map[string]reflect.Value) (interface{}, error) {
+
+	if m := e.getMetrics(); m != nil {
+		return e.measure(m, func() (interface{}, error) {
+			return e.evalUnmeasured(ctx, data, vars)
+		})
+	}
+
+	return e.evalUnmeasured(ctx, data, vars)
+}
+
+func (e *Expr) evalUnmeasured(ctx context.Context, data interface{}, vars map[string]reflect.Value) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	input, ok := data.(reflect.Value)
 	if !ok {
 		input = reflect.ValueOf(data)
 	}
 
-	result, err := eval(e.node, input, e.newEnv(input))
+	env := e.newEnv(input, vars)
+	env.ctx = ctx
+	env.done = ctx.Done()
+
+	var errs []error
+	if e.options != nil && e.options.CollectErrors {
+		env.errs = &errs
+	}
+
+	if e.trace != nil {
+		env.trace = &tracer{
+			fn: e.trace,
+		}
+	}
+
+	result, err := eval(e.node, input, env)
+
+	// The environment can be reused by a later evaluation
+	// unless the result contains a function that refers to it.
+	if !containsCallable(result) {
+		releaseEnvironment(env)
+	}
+
+	v, err := e.result(result, err)
+	if len(errs) == 0 {
+		return v, err
+	}
+
+	if err != nil && err != ErrUndefined {
+		errs = append(errs, err)
+	}
+
+	return v, &MultiError{
+		Errors: errs,
+	}
+}
+
+// isPartial reports whether err was returned with a partial
+// result (see EvalOptions.CollectErrors).
+func isPartial(err error) bool {
+	_, ok := err.(*MultiError)
+	return ok
+}
+
+// result converts the result of evaluating the Expr to a
+// value for the evaluation methods to return.
+func (e *Expr) result(result reflect.Value, err error) (interface{}, error) {
+
 	if err != nil {
 		return nil, err
 	}
@@ -156,7 +804,14 @@ func (e *Expr) Eval(data interface{}) (interface{}, error) {
 		return nil, nil
 	}
 
-	return result.Interface(), nil
+	// Replace the internal null value with an untyped nil.
+	v := jtypes.PlainNulls(result.Interface())
+
+	if e.options != nil && e.options.Decimal {
+		v = jtypes.PlainDecimals(v)
+	}
+
+	return v, nil
 }
 
 // EvalBytes is like Eval but it accepts and returns byte slices
@@ -164,18 +819,72 @@ func (e *Expr) Eval(data interface{}) (interface{}, error) {
 func (e *Expr) EvalBytes(data []byte) ([]byte, error) {
 
 	var v interface{}
+	var err error
 
-	err := json.Unmarshal(data, &v)
+	if e.options != nil && e.options.Decimal {
+		v, err = decodeDecimals(data)
+	} else {
+		err = json.Unmarshal(data, &v)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	v, err = e.Eval(v)
-	if err != nil {
+	if err != nil && !isPartial(err) {
+		return nil, err
+	}
+
+	b, merr := json.Marshal(v)
+	if merr != nil {
+		return nil, merr
+	}
+
+	return b, err
+}
+
+// decodeDecimals decodes JSON data with its numbers represented
+// as Decimals.
+func decodeDecimals(data []byte) (interface{}, error) {
+
+	var v interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	if err := dec.Decode(&v); err != nil {
 		return nil, err
 	}
 
-	return json.Marshal(v)
+	if dec.More() {
+		return nil, fmt.Errorf("invalid character after top-level value")
+	}
+
+	return decimalsFromNumbers(v), nil
+}
+
+// decimalsFromNumbers replaces the json.Numbers in a decoded
+// JSON value with Decimals.
+func decimalsFromNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if d, ok := jtypes.ParseDecimal(string(v)); ok {
+			return d
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = decimalsFromNumbers(v[i])
+		}
+		return v
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = decimalsFromNumbers(v[k])
+		}
+		return v
+	default:
+		return v
+	}
 }
 
 // RegisterExts registers custom functions for use during
@@ -210,7 +919,106 @@ func (e *Expr) RegisterVars(vars map[string]interface{}) error {
 	return nil
 }
 
-// String returns a string representation of an Expr.
+// SetClock sets the function that the time functions $now and
+// $millis use to get the current time. The clock is read once
+// at the start of each evaluation, so every call to a time
+// function within a single evaluation returns the same time.
+// Pass nil to restore the default clock, time.Now.
+//
+// SetClock is intended for tests that need deterministic
+// output from expressions that use the current time.
+func (e *Expr) SetClock(now func() time.Time) {
+	e.clock = now
+}
+
+// SetRandSource sets the source of the random numbers used by
+// $random, $shuffle and $uuid. By default, $random and $shuffle
+// use the shared source in the math/rand package and $uuid uses
+// crypto/rand. Setting a source with a known seed makes their
+// results reproducible, e.g.
+//
+//	e.SetRandSource(rand.NewSource(42))
+//
+// Evaluations of the Expr (and of its clones) draw from the
+// same source. Access to it is synchronised, so concurrent
+// evaluations are safe, but the order in which they draw
+// numbers is not predictable. Pass nil to restore the default
+// source.
+func (e *Expr) SetRandSource(src rand.Source) {
+	if src == nil {
+		e.random = nil
+		return
+	}
+	e.random = randomCallables(src)
+}
+
+// SetConfig makes a read-only configuration object available
+// to the expression via the $config function. $config takes a
+// dotted path, e.g. $config("region.name"), and returns the
+// value at that path, or undefined if there isn't one. Numeric
+// path segments index into arrays. Without an argument, $config
+// returns the whole configuration.
+//
+// SetConfig stores a deep copy of config, so later changes to
+// the map do not affect the Expr. $config returns a new copy of
+// the requested value on each call, so nothing the expression
+// does with it (e.g. applying the transform operator) can change
+// the configuration. Evaluations of the Expr (and of its clones)
+// can therefore share it safely. SetConfig returns an error if
+// config cannot be copied, e.g. because it contains a cycle.
+// Pass nil to remove the configuration.
+func (e *Expr) SetConfig(config map[string]interface{}) error {
+
+	if config == nil {
+		e.config = reflect.Value{}
+		return nil
+	}
+
+	c, err := jlib.Clone(reflect.ValueOf(config))
+	if err != nil {
+		return err
+	}
+
+	e.config = reflect.ValueOf(mustGoCallable("config", configExtension(c)))
+	return nil
+}
+
+// Clone returns an independent copy of an Expr. The copy
+// shares the compiled expression with the original but has
+// its own custom functions and variables: calling RegisterExts
+// or RegisterVars on the copy does not affect the original
+// and vice versa.
+//
+// Clone is cheap compared to Compile and is designed to be
+// called once per request by applications that evaluate the
+// same expression with different custom variables.
+func (e *Expr) Clone() *Expr {
+
+	clone := &Expr{
+		node:      e.node,
+		options:   e.options,
+		overrides: e.overrides,
+		clock:     e.clock,
+		random:    e.random,
+		config:    e.config,
+		operators: e.operators,
+		rawPath:   e.rawPath,
+		trace:     e.trace,
+		traceSink: e.traceSink,
+		collator:  e.collator,
+		collated:  e.collated,
+		metrics:   e.metrics,
+
+		timestamps:  e.timestamps,
+		fingerprint: e.fingerprint,
+	}
+
+	clone.updateRegistry(e.registry)
+	return clone
+}
+
+// String returns the expression in a normalised form, which
+// compiles to an equivalent Expr.
 func (e *Expr) String() string {
 	if e.node == nil {
 		return ""
@@ -218,6 +1026,13 @@ func (e *Expr) String() string {
 	return e.node.String()
 }
 
+// AST returns the root node of the expression's syntax tree,
+// for use with jparse.Walk and the jparse node types. The tree
+// is shared with the Expr and must not be modified.
+func (e *Expr) AST() jparse.Node {
+	return e.node
+}
+
 func (e *Expr) updateRegistry(values map[string]reflect.Value) {
 
 	for name, v := range values {
@@ -228,67 +1043,89 @@ func (e *Expr) updateRegistry(values map[string]reflect.Value) {
 	}
 }
 
-func (e *Expr) newEnv(input reflect.Value) *environment {
-
-	tc := timeCallables(time.Now())
-
-	env := newEnvironment(baseEnv, len(tc)+len(e.registry)+1)
+// newEnv returns the environment for a single evaluation of
+// the Expr. The vars, if any, are bound after the Expr's own
+// registry so that they take precedence over it.
+func (e *Expr) newEnv(input reflect.Value, vars map[string]reflect.Value) *environment {
+
+	env := acquireEnvironment(baseEnv, len(e.overrides)+len(e.random)+len(e.collated)+len(e.registry)+len(vars)+6)
+	env.evalState = &evalState{
+		options:    e.options,
+		operators:  e.operators,
+		timestamps: e.timestamps,
+		collator:   e.collator,
+	}
 
 	env.bind("$", input)
-	env.bindAll(tc)
+	bindTimeCallables(env, e.now())
+	env.bind("eval", reflect.ValueOf(newEvalCallable(env)))
+	env.bindAll(e.overrides)
+	env.bindAll(e.random)
+	env.bindAll(e.collated)
+	if e.config.IsValid() {
+		env.bind("config", e.config)
+	}
+	if e.traceSink.IsValid() {
+		env.bind("trace", e.traceSink)
+	} else {
+		env.bind("trace", discardTrace)
+	}
 	env.bindAll(e.registry)
+	bindCtxCallables(env, e.registry)
+	env.bindAll(vars)
 
 	return env
 }
 
-var (
-	milisT = mustGoCallable("millis", Extension{
-		Func: func(millis int64) int64 {
-			return millis
-		},
-	})
+// bindCtxCallables rebinds the custom functions that take a
+// context.Context to copies that refer to env, so that they
+// can get the context when they are called indirectly, e.g.
+// from $map.
+func bindCtxCallables(env *environment, registry map[string]reflect.Value) {
+
+	for name, v := range registry {
+		fn, _ := jtypes.AsCallable(v)
+		c, ok := fn.(*goCallable)
+		if !ok || !c.hasCtx {
+			continue
+		}
 
-	nowT = mustGoCallable("now", Extension{
-		Func: func(millis int64, picture jtypes.OptionalString, tz jtypes.OptionalString) (string, error) {
-			return jlib.FromMillis(millis, picture, tz)
-		},
-	})
-)
+		clone := *c
+		clone.env = env
+		env.bind(name, reflect.ValueOf(&clone))
+	}
+}
+
+// now returns the current time according to the Expr's clock.
+func (e *Expr) now() time.Time {
+	if e.clock != nil {
+		return e.clock()
+	}
+	return time.Now()
+}
 
-func timeCallables(t time.Time) map[string]reflect.Value {
+// bindTimeCallables binds the $millis and $now functions,
+// which return the given time, in env.
+func bindTimeCallables(env *environment, t time.Time) {
 
 	ms := t.UnixNano() / int64(time.Millisecond)
 
-	millis := &partialCallable{
+	millis := &millisCallable{
 		callableName: callableName{
 			name: "millis",
 		},
-		fn: milisT,
-		args: []jparse.Node{
-			&jparse.NumberNode{
-				Value: float64(ms),
-			},
-		},
+		millis: ms,
 	}
 
-	now := &partialCallable{
+	now := &nowCallable{
 		callableName: callableName{
 			name: "now",
 		},
-		fn: nowT,
-		args: []jparse.Node{
-			&jparse.NumberNode{
-				Value: float64(ms),
-			},
-			&jparse.PlaceholderNode{},
-			&jparse.PlaceholderNode{},
-		},
+		millis: ms,
 	}
 
-	return map[string]reflect.Value{
-		"millis": reflect.ValueOf(millis),
-		"now":    reflect.ValueOf(now),
-	}
+	env.bind("millis", reflect.ValueOf(millis))
+	env.bind("now", reflect.ValueOf(now))
 }
 
 func processExts(exts map[string]Extension) (map[string]reflect.Value, error) {
@@ -305,6 +1142,7 @@ func processExts(exts map[string]Extension) (map[string]reflect.Value, error) {
 		if err != nil {
 			return nil, fmt.Errorf("%s is not a valid function: %s", name, err)
 		}
+		callable.isExtension = true
 
 		if m == nil {
 			m = make(map[string]reflect.Value, len(exts))
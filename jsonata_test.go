@@ -5,20 +5,32 @@
 package jsonata
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
 	"io/ioutil"
 	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 	"unicode/utf8"
 
+	"github.com/blues/jsonata-go/jlib"
+	"github.com/blues/jsonata-go/jlib/jxpath"
 	"github.com/blues/jsonata-go/jparse"
 	"github.com/blues/jsonata-go/jtypes"
 )
@@ -98,6 +110,18 @@ func TestLiterals(t *testing.T) {
 			Expression: "6.022e23",
 			Output:     6.022e23,
 		},
+		{
+			Expression: []string{
+				"0xFF",
+				"0o377",
+				"0b11111111",
+			},
+			Output: float64(255),
+		},
+		{
+			Expression: "0x0F = 15 and -0b1 = -1",
+			Output:     true,
+		},
 		{
 			Expression: "1.602E-19",
 			Output:     1.602e-19,
@@ -149,6 +173,35 @@ func TestLiterals(t *testing.T) {
 	})
 }
 
+func TestComments(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: `
+				/* Double the total price */
+				(
+					$prices := [1, 2, 3]; /* the prices */
+					$sum($prices) /* summed */ * 2
+				)
+			`,
+			Output: float64(12),
+		},
+		{
+			Expression: `{"a": /* comment */ [1, 2] /* trailing */}.a[/**/1]`,
+			Output:     float64(2),
+		},
+		{
+			Expression: `$count([1, 2] /* unterminated`,
+			Error: &jparse.Error{
+				Type:     jparse.ErrUnterminatedComment,
+				Token:    "/*",
+				Hint:     "*/",
+				Position: 14,
+			},
+		},
+	})
+}
+
 func TestStringLiterals(t *testing.T) {
 
 	runTestCases(t, nil, []*testCase{
@@ -418,6 +471,97 @@ func TestSingletonArrays(t *testing.T) {
 	})
 }
 
+func TestKeepSingletonArrays(t *testing.T) {
+
+	data := testdata.address
+
+	tests := []struct {
+		Expression string
+		Output     interface{}
+		Error      error
+	}{
+		{
+			Expression: `Phone[type="mobile"].number`,
+			Output: []interface{}{
+				"077 7700 1234",
+			},
+		},
+		{
+			// Paths that already keep arrays are unchanged.
+			Expression: `Phone[type="mobile"][].number`,
+			Output: []interface{}{
+				"077 7700 1234",
+			},
+		},
+		{
+			Expression: `Phone[type="office"].number`,
+			Output: []interface{}{
+				"01962 001234",
+				"01962 001235",
+			},
+		},
+		{
+			Expression: `Phone[0].number`,
+			Output: []interface{}{
+				"0203 544 1234",
+			},
+		},
+		{
+			Expression: `Surname`,
+			Output: []interface{}{
+				"Smith",
+			},
+		},
+		{
+			Expression: `($type := "mobile"; Phone[type=$type].number)`,
+			Output: []interface{}{
+				"077 7700 1234",
+			},
+		},
+		{
+			Expression: `Age > 18 ? Phone[type="mobile"].number : Surname`,
+			Output: []interface{}{
+				"077 7700 1234",
+			},
+		},
+		{
+			// Paths that are not the result of the expression
+			// still unwrap singletons.
+			Expression: `$uppercase(Phone[type="mobile"].type)`,
+			Output:     "MOBILE",
+		},
+		{
+			Expression: `{"mobile": Phone[type="mobile"].number}`,
+			Output: map[string]interface{}{
+				"mobile": "077 7700 1234",
+			},
+		},
+		{
+			Expression: `Phone[type="fax"].number`,
+			Error:      ErrUndefined,
+		},
+	}
+
+	for _, test := range tests {
+
+		e, err := CompileWithOptions(test.Expression, EvalOptions{
+			KeepSingletonArrays: true,
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", test.Expression, err)
+		}
+
+		output, err := e.Eval(data)
+		if err != test.Error {
+			t.Errorf("%s: expected error %v, got %v", test.Expression, test.Error, err)
+		}
+
+		if !reflect.DeepEqual(output, test.Output) {
+			t.Errorf("%s: expected output %v, got %v", test.Expression, test.Output, output)
+		}
+	}
+}
+
 func TestArraySelectors(t *testing.T) {
 
 	runTestCases(t, testdata.foobar, []*testCase{
@@ -933,6 +1077,78 @@ func TestComparisonOperators3(t *testing.T) {
 	})
 }
 
+func TestComparisonOperators4(t *testing.T) {
+
+	// Go values that are equal to JSONata values with
+	// different Go types.
+	type point struct {
+		X int `json:"x"`
+		Y int `json:"y"`
+	}
+
+	data := map[string]interface{}{
+		"ints":    []int{1, 2},
+		"strings": []string{"a", "b"},
+		"point":   point{X: 1, Y: 2},
+		"points": []point{
+			{X: 1, Y: 2},
+			{X: 3, Y: 4},
+		},
+		"nested": map[string]interface{}{
+			"list": [][]int64{{1, 2}, {3}},
+		},
+	}
+
+	runTestCases(t, data, []*testCase{
+		{
+			Expression: []string{
+				`1 = 1.0`,
+				`ints = [1, 2]`,
+				`ints = [1.0, 2.0]`,
+				`strings = ["a", "b"]`,
+				`point = {"y": 2, "x": 1}`,
+				`points[0] = point`,
+				`nested = {"list": [[1, 2], [3]]}`,
+				`[1, [2, {"a": null}]] = [1, [2, {"a": null}]]`,
+			},
+			Output: true,
+		},
+		{
+			Expression: []string{
+				`ints = [2, 1]`,
+				`ints = [1, 2, 3]`,
+				`strings = ["a"]`,
+				`point = {"x": 1}`,
+				`point = {"x": 1, "y": "2"}`,
+				`nested = {"list": [[1, 2], [3, 4]]}`,
+			},
+			Output: false,
+		},
+		{
+			Expression: []string{
+				`ints != [1.0, 2.0]`,
+				`point != {"x": 1, "y": 2}`,
+			},
+			Output: false,
+		},
+		{
+			Expression: []string{
+				`ints != [2, 1]`,
+				`point != {"x": 2, "y": 1}`,
+			},
+			Output: true,
+		},
+		{
+			Expression: `$count($distinct([point, points[0], {"x": 1.0, "y": 2.0}]))`,
+			Output:     1,
+		},
+		{
+			Expression: `($target := {"x": 3, "y": 4}; $filter(points, function($v){$v = $target}).x)`,
+			Output:     3,
+		},
+	})
+}
+
 func TestIncludeOperator(t *testing.T) {
 
 	runTestCases(t, nil, []*testCase{
@@ -941,6 +1157,10 @@ func TestIncludeOperator(t *testing.T) {
 				"1 in [1,2]",
 				`"world" in ["hello", "world"]`,
 				`"hello" in "hello"`,
+				`[1,2] in [[1,2],[3,4]]`,
+				`[1.0,2.0] in [[1,2],[3,4]]`,
+				`{"a": [1]} in [{"a": [1]}, {"b": 2}]`,
+				`{"a": 1} in {"a": 1}`,
 			},
 			Output: true,
 		},
@@ -950,6 +1170,8 @@ func TestIncludeOperator(t *testing.T) {
 				`"hello" in [1,2]`,
 				`in in ["hello", "world"]`,
 				`"world" in in`,
+				`[2,1] in [[1,2],[3,4]]`,
+				`{"a": [2]} in [{"a": [1]}, {"b": 2}]`,
 			},
 			Output: false,
 		},
@@ -1682,15 +1904,38 @@ func TestSortOperator7(t *testing.T) {
 	runTestCases(t, readJSON("account7.json"), []*testCase{
 		{
 			Expression: `Account.Order.Product^(Price).SKU`,
-			Error:      fmt.Errorf("The expressions within an order-by clause must evaluate to numeric or string values"), // TODO: use a proper error
-			Skip:       true,                                                                                              // returns ErrUndefined
+			Error: &EvalError{
+				Type:  ErrNonSortable,
+				Token: "Price",
+			},
+		},
+		{
+			// Items with an undefined sort term go last.
+			Expression: `Account.Order.Product^(Description.Colour = "Purple" ? Price).SKU`,
+			Output: []interface{}{
+				"0406654608",
+				"040657863",
+				"0406634348",
+				"0406654603",
+			},
+		},
+		{
+			// If the sort term is undefined for every item, the
+			// items keep their original order.
+			Expression: `Account.Order.Product^(Missing).SKU`,
+			Output: []interface{}{
+				"0406654608",
+				"0406634348",
+				"040657863",
+				"0406654603",
+			},
 		},
 	})
 }
 
 func TestWildcards(t *testing.T) {
 
-	runTestCasesFunc(t, equalArraysUnordered, testdata.foobar, []*testCase{
+	runTestCases(t, testdata.foobar, []*testCase{
 		{
 			Expression: "foo.*",
 			Output: []interface{}{
@@ -1714,7 +1959,6 @@ func TestWildcards(t *testing.T) {
 		{
 			Expression: "foo.*[0]",
 			Output:     float64(42),
-			Skip:       true, // We can't predict the order of the items in "foo.*"
 		},
 	})
 }
@@ -1874,7 +2118,6 @@ func TestDescendents2(t *testing.T) {
 		{
 			Expression: "**[2]",
 			Output:     "Firefly",
-			Skip:       true, // We can't guarantee the order of object sub-items!
 		},
 		{
 			Expression: []string{
@@ -1896,109 +2139,487 @@ func TestDescendents3(t *testing.T) {
 	})
 }
 
-func TestBlockExpressions(t *testing.T) {
+func TestObjectValueOrder(t *testing.T) {
 
-	runTestCases(t, nil, []*testCase{
-		{
-			Expression: "()",
-			Error:      ErrUndefined,
-		},
+	src := `{"b": {"z": 1, "y": [2, 3]}, "a": 4, "c": {"x": 5}}`
+
+	dec := json.NewDecoder(strings.NewReader(src))
+	ordered, err := jtypes.DecodeOrdered(dec)
+	if err != nil {
+		t.Fatalf("DecodeOrdered: %s", err)
+	}
+
+	var unordered interface{}
+	if err := json.Unmarshal([]byte(src), &unordered); err != nil {
+		t.Fatalf("json.Unmarshal: %s", err)
+	}
+
+	// OrderedMaps are traversed in insertion order.
+	runTestCases(t, ordered, []*testCase{
 		{
-			Expression: []string{
-				"(1; 2; 3)",
-				"(1; 2; 3;)",
+			Expression: `*.*`,
+			Output: []interface{}{
+				float64(1),
+				float64(2),
+				float64(3),
+				float64(5),
 			},
-			Output: float64(3),
 		},
 		{
-			Expression: "($a:=1; $b:=2; $c:=($a:=4; $a+$b); $a+$c)",
-			Output:     float64(7),
+			Expression: `**[$type($) = "number"]`,
+			Output: []interface{}{
+				float64(1),
+				float64(2),
+				float64(3),
+				float64(4),
+				float64(5),
+			},
 		},
 	})
-}
-
-func TestBlockExpressions2(t *testing.T) {
 
-	runTestCases(t, testdata.account, []*testCase{
+	// Go maps are traversed in key order.
+	runTestCases(t, unordered, []*testCase{
 		{
-			Expression: "Account.Order.Product.($var1 := Price ; $var2:=Quantity; $var1 * $var2)",
+			Expression: `*.*`,
 			Output: []interface{}{
-				68.9,
-				21.67,
-				137.8,
-				107.99,
+				float64(2),
+				float64(3),
+				float64(1),
+				float64(5),
 			},
 		},
 		{
-			Expression: []string{
-				`(
-					$func := function($arg) {$arg.Account.Order[0].OrderID};
-					$func($)
-				)`,
-				`(
-					$func := function($arg) {$arg.Account.Order[0]};
-					$func($).OrderID
-				)`,
+			Expression: `**[$type($) = "number"]`,
+			Output: []interface{}{
+				float64(4),
+				float64(2),
+				float64(3),
+				float64(1),
+				float64(5),
 			},
-			Output: "order103",
 		},
 	})
 }
 
-func TestArrayConstructor(t *testing.T) {
+func TestParentOperator(t *testing.T) {
 
-	runTestCases(t, nil, []*testCase{
+	runTestCases(t, testdata.account, []*testCase{
 		{
-			Expression: "[]",
-			Output:     []interface{}{},
+			Expression: "Account.Order.Product.{ \"Product\": `Product Name`, \"Order\": %.OrderID, \"Account\": %.%.`Account Name` }",
+			Output: []interface{}{
+				map[string]interface{}{
+					"Product": "Bowler Hat",
+					"Order":   "order103",
+					"Account": "Firefly",
+				},
+				map[string]interface{}{
+					"Product": "Trilby hat",
+					"Order":   "order103",
+					"Account": "Firefly",
+				},
+				map[string]interface{}{
+					"Product": "Bowler Hat",
+					"Order":   "order104",
+					"Account": "Firefly",
+				},
+				map[string]interface{}{
+					"Product": "Cloak",
+					"Order":   "order104",
+					"Account": "Firefly",
+				},
+			},
 		},
 		{
-			Expression: "[1]",
+			Expression: []string{
+				"Account.Order.Product.%.OrderID",
+				"Account.Order.Product.(%.OrderID)",
+				"Account.Order.Product.Description.%.%.OrderID",
+			},
 			Output: []interface{}{
-				float64(1),
+				"order103",
+				"order103",
+				"order104",
+				"order104",
 			},
 		},
 		{
-			Expression: "[1, 2]",
+			Expression: "Account.Order.Product.Price.%.`Product Name`",
 			Output: []interface{}{
-				float64(1),
-				float64(2),
+				"Bowler Hat",
+				"Trilby hat",
+				"Bowler Hat",
+				"Cloak",
 			},
 		},
 		{
-			Expression: "[1, 2,3]",
+			Expression: []string{
+				"Account.Order.Product[%.OrderID = 'order104'].SKU",
+				"Account.Order.Product.SKU[%.%.OrderID = 'order104']",
+			},
 			Output: []interface{}{
-				float64(1),
-				float64(2),
-				float64(3),
+				"040657863",
+				"0406654603",
 			},
 		},
 		{
-			Expression: "[1, 2, [3, 4]]",
+			Expression: "Account.Order.Product.(%.OrderID & \": \" & `Product Name`)",
 			Output: []interface{}{
-				float64(1),
-				float64(2),
-				[]interface{}{
-					float64(3),
-					float64(4),
-				},
+				"order103: Bowler Hat",
+				"order103: Trilby hat",
+				"order104: Bowler Hat",
+				"order104: Cloak",
 			},
 		},
 		{
-			Expression: `[1, "two", ["three", 4]]`,
+			Expression: "Account.Order.Product.[%.%.`Account Name`, SKU]",
 			Output: []interface{}{
-				float64(1),
-				"two",
 				[]interface{}{
-					"three",
-					float64(4),
+					"Firefly",
+					"0406654608",
+				},
+				[]interface{}{
+					"Firefly",
+					"0406634348",
+				},
+				[]interface{}{
+					"Firefly",
+					"040657863",
+				},
+				[]interface{}{
+					"Firefly",
+					"0406654603",
 				},
 			},
 		},
 		{
-			Expression: `[1, $two, ["three", $four]]`,
-			Vars: map[string]interface{}{
-				"two":  float64(2),
+			// Lambdas defined in a path step can refer to
+			// the parent of the step's context.
+			Expression: "Account.Order.Product.($f := function() { %.OrderID }; $f())",
+			Output: []interface{}{
+				"order103",
+				"order103",
+				"order104",
+				"order104",
+			},
+		},
+		{
+			Expression: "Account.Order[0].Product[0].Description.%.%.OrderID",
+			Output:     "order103",
+		},
+		{
+			Expression: "Account.Order.Product.%.OrderID[]",
+			Output: []interface{}{
+				"order103",
+				"order103",
+				"order104",
+				"order104",
+			},
+		},
+		{
+			Expression: "Account.Order[0].%.`Account Name`[]",
+			Output: []interface{}{
+				"Firefly",
+			},
+		},
+		{
+			Expression: []string{
+				"%",
+				"%.Account",
+				"Account.%.%",
+			},
+			Error: &EvalError{
+				Type:  ErrNoParent,
+				Token: "%",
+			},
+		},
+	})
+
+	// The parent of an item derived from an undefined input is
+	// undefined.
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: `{"a": 1}.%`,
+			Error:      ErrUndefined,
+		},
+		{
+			Expression: `$count({"a": 1}.%)`,
+			Output:     0,
+		},
+	})
+}
+
+func TestPositionalBinding(t *testing.T) {
+
+	runTestCases(t, testdata.library, []*testCase{
+		{
+			Expression: `library.books#$i.["book " & $i & ": " & title]`,
+			Output: []interface{}{
+				[]interface{}{
+					"book 0: Structure and Interpretation of Computer Programs",
+				},
+				[]interface{}{
+					"book 1: The C Programming Language",
+				},
+				[]interface{}{
+					"book 2: The AWK Programming Language",
+				},
+				[]interface{}{
+					"book 3: Compilers: Principles, Techniques, and Tools",
+				},
+			},
+		},
+		{
+			Expression: `library.books#$i[$i < 2].title`,
+			Output: []interface{}{
+				"Structure and Interpretation of Computer Programs",
+				"The C Programming Language",
+			},
+		},
+		{
+			// Positions are assigned after filtering.
+			Expression: `library.books[price > 30]#$i.{ "index": $i, "title": title }`,
+			Output: []interface{}{
+				map[string]interface{}{
+					"index": float64(0),
+					"title": "Structure and Interpretation of Computer Programs",
+				},
+				map[string]interface{}{
+					"index": float64(1),
+					"title": "The C Programming Language",
+				},
+			},
+		},
+		{
+			// Positions are assigned after sorting...
+			Expression: `library.books^(price)#$i.($string($i) & ": " & title)`,
+			Output: []interface{}{
+				"0: Compilers: Principles, Techniques, and Tools",
+				"1: The C Programming Language",
+				"2: Structure and Interpretation of Computer Programs",
+				"3: The AWK Programming Language",
+			},
+		},
+		{
+			// ...and before sorting if the sort comes later.
+			Expression: `library.books#$i^(>$i).($string($i) & ": " & title)`,
+			Output: []interface{}{
+				"3: Compilers: Principles, Techniques, and Tools",
+				"2: The AWK Programming Language",
+				"1: The C Programming Language",
+				"0: Structure and Interpretation of Computer Programs",
+			},
+		},
+		{
+			// Positions are relative to the item that
+			// produced them.
+			Expression: `library.books#$i.authors#$j[$i = 2].($string($i) & "." & $string($j) & " " & $)`,
+			Output: []interface{}{
+				"2.0 Aho",
+				"2.1 Kernighan",
+				"2.2 Weinberger",
+			},
+		},
+		{
+			// Bound variables survive the parent operator.
+			Expression: `library.books#$i.authors.%.($i & ": " & isbn)`,
+			Output: []interface{}{
+				"0: 9780262510875",
+				"0: 9780262510875",
+				"1: 9780131103627",
+				"1: 9780131103627",
+				"2: 9780201079814",
+				"2: 9780201079814",
+				"2: 9780201079814",
+				"3: 9780201100884",
+				"3: 9780201100884",
+				"3: 9780201100884",
+				"3: 9780201100884",
+			},
+		},
+		{
+			// Bound variables are not visible outside
+			// of the path.
+			Expression: `(library.books#$i.title; $i)`,
+			Error:      ErrUndefined,
+		},
+	})
+}
+
+func TestContextBinding(t *testing.T) {
+
+	runTestCases(t, testdata.library, []*testCase{
+		{
+			Expression: []string{
+				`library.loans@$l.books@$b[$l.isbn=$b.isbn].{ "title": $b.title, "customer": $l.customer }`,
+				`library.books@$b.loans@$l[$l.isbn=$b.isbn].{ "title": $b.title, "customer": $l.customer }`,
+			},
+			Output: []interface{}{
+				map[string]interface{}{
+					"title":    "Structure and Interpretation of Computer Programs",
+					"customer": "10001",
+				},
+				map[string]interface{}{
+					"title":    "Compilers: Principles, Techniques, and Tools",
+					"customer": "10003",
+				},
+			},
+		},
+		{
+			Expression: []string{
+				`library.loans@$l.books@$b[$l.isbn=$b.isbn].customers[$l.customer=id].{ "customer": name, "book": $b.title, "due": $l.return }`,
+				`$.library.loans@$l.books@$b[$l.isbn=$b.isbn].customers[$l.customer=id].{ "customer": name, "book": $b.title, "due": $l.return }`,
+			},
+			Output: []interface{}{
+				map[string]interface{}{
+					"customer": "Joe Doe",
+					"book":     "Structure and Interpretation of Computer Programs",
+					"due":      "2016-12-05",
+				},
+				map[string]interface{}{
+					"customer": "Jason Arthur",
+					"book":     "Compilers: Principles, Techniques, and Tools",
+					"due":      "2016-10-22",
+				},
+			},
+		},
+		{
+			Expression: `library.customers@$c.loans[customer=$c.id].$c.name`,
+			Output: []interface{}{
+				"Joe Doe",
+				"Jason Arthur",
+			},
+		},
+		{
+			// Sort terms can refer to bound variables.
+			Expression: `library.books@$b^($b.price).$b.title`,
+			Output: []interface{}{
+				"Compilers: Principles, Techniques, and Tools",
+				"The C Programming Language",
+				"Structure and Interpretation of Computer Programs",
+				"The AWK Programming Language",
+			},
+		},
+		{
+			Expression: `library.books@$b#$i[$i > 1].($string($i) & ": " & $b.title)`,
+			Output: []interface{}{
+				"2: The AWK Programming Language",
+				"3: Compilers: Principles, Techniques, and Tools",
+			},
+		},
+		{
+			// The binding doesn't change the context item.
+			Expression: `library.loans@$l.$count(books)`,
+			Output: []interface{}{
+				4,
+				4,
+			},
+		},
+	})
+}
+
+func TestBlockExpressions(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: "()",
+			Error:      ErrUndefined,
+		},
+		{
+			Expression: []string{
+				"(1; 2; 3)",
+				"(1; 2; 3;)",
+			},
+			Output: float64(3),
+		},
+		{
+			Expression: "($a:=1; $b:=2; $c:=($a:=4; $a+$b); $a+$c)",
+			Output:     float64(7),
+		},
+	})
+}
+
+func TestBlockExpressions2(t *testing.T) {
+
+	runTestCases(t, testdata.account, []*testCase{
+		{
+			Expression: "Account.Order.Product.($var1 := Price ; $var2:=Quantity; $var1 * $var2)",
+			Output: []interface{}{
+				68.9,
+				21.67,
+				137.8,
+				107.99,
+			},
+		},
+		{
+			Expression: []string{
+				`(
+					$func := function($arg) {$arg.Account.Order[0].OrderID};
+					$func($)
+				)`,
+				`(
+					$func := function($arg) {$arg.Account.Order[0]};
+					$func($).OrderID
+				)`,
+			},
+			Output: "order103",
+		},
+	})
+}
+
+func TestArrayConstructor(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: "[]",
+			Output:     []interface{}{},
+		},
+		{
+			Expression: "[1]",
+			Output: []interface{}{
+				float64(1),
+			},
+		},
+		{
+			Expression: "[1, 2]",
+			Output: []interface{}{
+				float64(1),
+				float64(2),
+			},
+		},
+		{
+			Expression: "[1, 2,3]",
+			Output: []interface{}{
+				float64(1),
+				float64(2),
+				float64(3),
+			},
+		},
+		{
+			Expression: "[1, 2, [3, 4]]",
+			Output: []interface{}{
+				float64(1),
+				float64(2),
+				[]interface{}{
+					float64(3),
+					float64(4),
+				},
+			},
+		},
+		{
+			Expression: `[1, "two", ["three", 4]]`,
+			Output: []interface{}{
+				float64(1),
+				"two",
+				[]interface{}{
+					"three",
+					float64(4),
+				},
+			},
+		},
+		{
+			Expression: `[1, $two, ["three", $four]]`,
+			Vars: map[string]interface{}{
+				"two":  float64(2),
 				"four": "four",
 			},
 			Output: []interface{}{
@@ -2328,6 +2949,7 @@ func TestObjectConstructor2(t *testing.T) {
 				Type:  ErrDuplicateKey,
 				Token: "`Product Name`",
 				Value: "Bowler Hat",
+				Item:  1,
 			},
 		},
 		{
@@ -2443,42 +3065,126 @@ func TestObjectConstructor3(t *testing.T) {
 	})
 }
 
-func TestRangeOperator(t *testing.T) {
+func TestObjectConstructorAssignments(t *testing.T) {
 
-	runTestCases(t, nil, []*testCase{
+	runTestCases(t, testdata.account, []*testCase{
 		{
-			Expression: "[0..9]",
-			Output: []interface{}{
-				float64(0),
-				float64(1),
-				float64(2),
-				float64(3),
-				float64(4),
-				float64(5),
-				float64(6),
-				float64(7),
-				float64(8),
-				float64(9),
+			Expression: `Account.Order[0].Product[0].{ $total := Price * Quantity; "total": $total, "double": $total * 2 }`,
+			Output: map[string]interface{}{
+				"total":  68.9,
+				"double": 137.8,
 			},
 		},
 		{
-			Expression: "[0..9][$ % 2 = 0]",
-			Output: []interface{}{
-				float64(0),
-				float64(2),
-				float64(4),
-				float64(6),
-				float64(8),
+			// Assignments are evaluated in order and are only
+			// visible to the pairs that follow them.
+			Expression: `{ "a": $x, $x := 1; $y := $x + 1; "b": $x, "c": $y }`,
+			Output: map[string]interface{}{
+				"b": float64(1),
+				"c": float64(2),
 			},
 		},
-
 		{
-			Expression: "[0, 4..9, 20, 22]",
-			Output: []interface{}{
-				float64(0),
-				float64(4),
-				float64(5),
-				float64(6),
+			// Assignments are scoped to the object.
+			Expression: `($x := 5; { $x := 1; "x": $x }.x + $x)`,
+			Output:     float64(6),
+		},
+		{
+			// Assignments can be used in keys.
+			Expression: `{ $key := "name"; $key: "value" }`,
+			Output: map[string]interface{}{
+				"name": "value",
+			},
+		},
+		{
+			// Assignments can be separated from pairs by commas
+			// or semicolons.
+			Expression: `{ "a": 1; $x := 2, "b": $x, $y := 3, "c": $y }`,
+			Output: map[string]interface{}{
+				"a": float64(1),
+				"b": float64(2),
+				"c": float64(3),
+			},
+		},
+		{
+			// In a group-by expression, keys are evaluated
+			// against each item but can see assignments.
+			Expression: `Account.Order.Product{ $prefix := "sku-"; $prefix & SKU: Quantity }`,
+			Output: map[string]interface{}{
+				"sku-0406654608": float64(2),
+				"sku-0406634348": float64(1),
+				"sku-040657863":  float64(4),
+				"sku-0406654603": float64(1),
+			},
+		},
+		{
+			// Assignments are evaluated against all of the
+			// items, not each one.
+			Expression: `Account.Order.Product{ $n := $sum(Quantity); SKU: $n }`,
+			Output: map[string]interface{}{
+				"0406654608": float64(8),
+				"0406634348": float64(8),
+				"040657863":  float64(8),
+				"0406654603": float64(8),
+			},
+		},
+		{
+			// Assignments hide built-in functions of the same
+			// name, including when the expression is optimized.
+			Expression: `{ $uppercase := function($s) { $s }; "a": $uppercase("x") }`,
+			Output: map[string]interface{}{
+				"a": "x",
+			},
+		},
+		{
+			Expression: `{ $x := 1 }`,
+			Output:     map[string]interface{}{},
+		},
+		{
+			Expression: `{ $x := $error("boom"); "a": 1 }`,
+			Error: &UserError{
+				Message: "boom",
+			},
+		},
+	})
+}
+
+func TestRangeOperator(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: "[0..9]",
+			Output: []interface{}{
+				float64(0),
+				float64(1),
+				float64(2),
+				float64(3),
+				float64(4),
+				float64(5),
+				float64(6),
+				float64(7),
+				float64(8),
+				float64(9),
+			},
+		},
+		{
+			Expression: "[0..9][$ % 2 = 0]",
+			Output: []interface{}{
+				float64(0),
+				float64(2),
+				float64(4),
+				float64(6),
+				float64(8),
+			},
+		},
+
+		{
+			Expression: "[0, 4..9, 20, 22]",
+			Output: []interface{}{
+				float64(0),
+				float64(4),
+				float64(5),
+				float64(6),
 				float64(7),
 				float64(8),
 				float64(9),
@@ -2697,6 +3403,100 @@ func TestConditionals5(t *testing.T) {
 	})
 }
 
+func TestCoalesce(t *testing.T) {
+
+	runTestCases(t, testdata.account, []*testCase{
+		{
+			Expression: []string{
+				`Account.Foo ?: "default"`,
+				`$missing ?: "default"`,
+				`null ?: "default"`,
+				`$null ?: "default"`,
+			},
+			Vars: map[string]interface{}{
+				"null": nil,
+			},
+			Output: "default",
+		},
+		{
+			Expression: `Account.` + "`Account Name`" + ` ?: "default"`,
+			Output:     "Firefly",
+		},
+		{
+			// Falsy values are not replaced.
+			Expression: `0 ?: 1`,
+			Output:     float64(0),
+		},
+		{
+			Expression: `"" ?: "default"`,
+			Output:     "",
+		},
+		{
+			Expression: `false ?: true`,
+			Output:     false,
+		},
+		{
+			Expression: `[] ?: [1]`,
+			Output:     []interface{}{},
+		},
+		{
+			Expression: []string{
+				`Account.Foo ?: Account.Bar ?: null ?: "last"`,
+				`(Account.Foo ?: Account.Bar) ?: "last"`,
+			},
+			Output: "last",
+		},
+		{
+			Expression: `Account.Foo ?: Account.Order[0].OrderID ?: "last"`,
+			Output:     "order103",
+		},
+		{
+			Expression: `Account.Order.Product.(Foo ?: SKU)`,
+			Output: []interface{}{
+				"0406654608",
+				"0406634348",
+				"040657863",
+				"0406654603",
+			},
+		},
+		{
+			Expression: `Account.Foo ?: Account.Bar`,
+			Error:      ErrUndefined,
+		},
+	})
+}
+
+func TestCoalesceEvaluatesOnce(t *testing.T) {
+
+	var calls int
+	exts := map[string]Extension{
+		"next": {
+			Func: func() int {
+				calls++
+				return calls
+			},
+		},
+	}
+
+	// Don't use runTestCases, which evaluates the expression
+	// more than once.
+	expr := MustCompile(`$next() ?: 100`)
+	must(t, "Exts", expr.RegisterExts(exts))
+
+	output, err := expr.Eval(nil)
+	if err != nil {
+		t.Fatalf("Eval: %s", err)
+	}
+
+	if output != 1 {
+		t.Errorf("Eval returned %v, expected 1", output)
+	}
+
+	if calls != 1 {
+		t.Errorf("$next() called %d times, expected 1", calls)
+	}
+}
+
 func TestBooleanExpressions(t *testing.T) {
 
 	runTestCases(t, nil, []*testCase{
@@ -2786,7 +3586,6 @@ func TestNullExpressions(t *testing.T) {
 			Output: []interface{}{
 				nil,
 			},
-			Skip: true, // uses the wrong kind of nil (*interface{}(nil) instead of plain nil)?
 		},
 		{
 			Expression: "[null, null]",
@@ -2794,7 +3593,6 @@ func TestNullExpressions(t *testing.T) {
 				nil,
 				nil,
 			},
-			Skip: true, // uses the wrong kind of nil (*interface{}(nil) instead of plain nil)?
 		},
 		{
 			Expression: "$not(null)",
@@ -2815,7 +3613,54 @@ func TestNullExpressions(t *testing.T) {
 				"false": false,
 				"null":  nil,
 			},
-			Skip: true, // uses the wrong kind of nil (*interface{}(nil) instead of plain nil)?
+		},
+		{
+			Expression: `{"array": [null, {"null": null}]}`,
+			Output: map[string]interface{}{
+				"array": []interface{}{
+					nil,
+					map[string]interface{}{
+						"null": nil,
+					},
+				},
+			},
+		},
+	})
+}
+
+func TestNullValues(t *testing.T) {
+
+	data := map[string]interface{}{
+		"a": nil,
+		"b": []interface{}{
+			map[string]interface{}{"x": nil},
+			map[string]interface{}{"x": 1},
+		},
+	}
+
+	runTestCases(t, data, []*testCase{
+		{
+			Expression: "a",
+			Output:     nil,
+		},
+		{
+			Expression: "$exists(a)",
+			Output:     true,
+		},
+		{
+			Expression: "$type(b[0].x)",
+			Output:     "null",
+		},
+		{
+			Expression: "a = null",
+			Output:     true,
+		},
+		{
+			Expression: "b.x",
+			Output: []interface{}{
+				nil,
+				1,
+			},
 		},
 	})
 }
@@ -3043,69 +3888,376 @@ func TestLambdas2(t *testing.T) {
 	})
 }
 
-func TestPartials(t *testing.T) {
+func TestLambdaPatterns(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: `$map($zip([1, 2, 3], [4, 5, 6]), function([$a, $b]){ $a + $b })`,
+			Output: []interface{}{
+				float64(5),
+				float64(7),
+				float64(9),
+			},
+		},
+		{
+			Expression: `$map([{"price": 2, "qty": 3}, {"price": 5}], function({"price": $p, "qty": $q}){ $exists($q) ? $p * $q : $p })`,
+			Output: []interface{}{
+				float64(6),
+				float64(5),
+			},
+		},
+		{
+			Expression: `$reduce($zip(["a", "b"], [1, 2]), function($acc, [$k, $v]){ $merge([$acc, {$k: $v}]) }, {})`,
+			Output: map[string]interface{}{
+				"a": float64(1),
+				"b": float64(2),
+			},
+		},
+		{
+			// Nested patterns.
+			Expression: `function({"pos": [$x, $y]}){ $x * $y }({"pos": [3, 4]})`,
+			Output:     float64(12),
+		},
+		{
+			// Missing indexes and keys are undefined.
+			Expression: `function([$a, $b], {"c": $c}){ [$exists($a), $exists($b), $exists($c)] }([1], {})`,
+			Output: []interface{}{
+				true,
+				false,
+				false,
+			},
+		},
+		{
+			// Missing arguments are undefined.
+			Expression: `function($a, [$b]){ $exists($b) }(1)`,
+			Output:     false,
+		},
+		{
+			// Non-arrays are treated as single item arrays.
+			Expression: `function([$a, $b]){ [$a, $exists($b)] }(5)`,
+			Output: []interface{}{
+				float64(5),
+				false,
+			},
+		},
+		{
+			Expression: `function([$a, $b])<a:n>{ $a * $b }([3, 4])`,
+			Output:     float64(12),
+		},
+		{
+			// Pattern variables shadow outer variables.
+			Expression: `($f := function(){ 1 }; function([$f]){ $f() }([function(){ 2 }]))`,
+			Output:     float64(2),
+		},
+	})
+}
+
+func TestTailCalls(t *testing.T) {
+
+	// Lambdas that call themselves in tail position should
+	// run in constant stack space. Lower the maximum stack
+	// size so that deep recursion fails quickly (and fatally)
+	// if they don't.
+	defer debug.SetMaxStack(debug.SetMaxStack(1 << 20))
 
 	runTestCases(t, nil, []*testCase{
 		{
 			Expression: `
 				(
-					$add := function($x, $y){$x+$y};
-					$add2 := $add(?, 2);
-					$add2(3)
+					$sum := function($n, $acc) { $n = 0 ? $acc : $sum($n-1, $acc+$n) };
+					$sum(50000, 0)
 				)`,
-			Output: float64(5),
+			Output: float64(1250025000),
 		},
 		{
+			// Build a linked list with 50,000 elements,
+			// then count them.
 			Expression: `
 				(
-					$add := function($x, $y){$x+$y};
-					$add2 := $add(2, ?);
-					$add2(4)
+					$build := function($n, $list) {
+						$n = 0 ? $list : $build($n-1, {"head": $n, "tail": $list})
+					};
+					$length := function($list, $n) {(
+						$tail := $list.tail;
+						$exists($list) ? $length($tail, $n+1) : $n
+					)};
+					$list := $build(50000, undefined);
+					[$list.head, $length($list, 0)]
 				)`,
-			Output: float64(6),
+			Output: []interface{}{
+				float64(1),
+				float64(50000),
+			},
 		},
 		{
+			// Mutual recursion.
 			Expression: `
 				(
-					$last_letter := $substring(?, -1);
-					$last_letter("Hello World")
+					$even := function($n) { $n = 0 ? true : $odd($n-1) };
+					$odd := function($n) { $n = 0 ? false : $even($n-1) };
+					[$even(50000), $odd(50000)]
 				)`,
-			Output: "d",
+			Output: []interface{}{
+				true,
+				false,
+			},
 		},
 		{
+			// Typed lambdas.
 			Expression: `
 				(
-					$firstn := $substring(?, 0, ?);
-					$first5 := $firstn(?, 5);
-					$first5("Hello World")
+					$count := λ($n, $acc)<nn:n> { $n = 0 ? $acc : $count($n-1, $acc+1) };
+					$count(50000, 0)
 				)`,
-			Output: "Hello",
+			Output: float64(50000),
 		},
 		{
+			// Errors in tail calls.
 			Expression: `
 				(
-					$firstn := $substr(?, 0, ?);
-					$first5 := $firstn(?, 5);
-					$first5("Hello World")
+					$fail := function($n) { $n = 0 ? $error("done") : $fail($n-1) };
+					$fail(50000)
 				)`,
-			Exts: map[string]Extension{
-				"substr": {
-					Func: func(s string, start, length int) string {
-						if length <= 0 || start >= len(s) {
-							return ""
-						}
-
-						if start < 0 {
-							start += len(s)
-						}
+			Error: &UserError{
+				Message: "done",
+			},
+		},
+	})
 
-						if start > 0 {
-							s = s[start:]
-						}
+	// Limits apply to the results of tail calls, including
+	// calls from functions such as $map.
+	exprs := []string{
+		`$map([1, 2], function() { $append([1..30], [1..30]) })`,
+		`(
+			$f := function($n) { $n = 0 ? $append([1..30], [1..30]) : $f($n-1) };
+			$map([1000, 1000], $f)
+		)`,
+	}
 
-						if length < len(s) {
-							s = s[:length]
-						}
+	for _, expr := range exprs {
+
+		e, err := CompileWithOptions(expr, EvalOptions{
+			MaxArrayLength: 50,
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", expr, err)
+		}
+
+		_, err = e.Eval(nil)
+
+		exp := &EvalError{
+			Type:  ErrLimitExceeded,
+			Token: "MaxArrayLength",
+			Value: "50",
+		}
+		if !reflect.DeepEqual(err, exp) {
+			t.Errorf("%s: expected error %v, got %v", expr, exp, err)
+		}
+	}
+}
+
+func TestFuncMemoize(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			// A memoized recursive function should be fast...
+			Expression: `
+				(
+					$fibonacci := $memoize(function($x) { $x <= 1 ? $x : $fibonacci($x-1) + $fibonacci($x-2) });
+					$fibonacci(35)
+				)`,
+			Output: float64(9227465),
+		},
+		{
+			// ...and should return the same values as the
+			// original.
+			Expression: `
+				(
+					$fibonacci := function($x) { $x <= 1 ? $x : $fibonacci($x-1) + $fibonacci($x-2) };
+					$memoized := $memoize($fibonacci);
+					$deepEqual([0..15].$memoized($), [0..15].$fibonacci($))
+				)`,
+			Output: true,
+		},
+		{
+			Expression: `
+				(
+					$k := $memoize(function($o) { $keys($o) });
+					[$k({"a": 1}), $k({"b": 2}), $k({"a": 1})]
+				)`,
+			Output: []interface{}{
+				"a",
+				"b",
+				"a",
+			},
+		},
+		{
+			Expression: `
+				(
+					$e := $memoize(function($v) { $exists($v) });
+					[$e("undefined"), $e(undefined), $e("undefined")]
+				)`,
+			Output: []interface{}{
+				true,
+				false,
+				true,
+			},
+		},
+		{
+			Expression: `$memoize(undefined)`,
+			Error:      ErrUndefined,
+		},
+		{
+			Expression: `$memoize("hello")`,
+			Error: &ArgTypeError{
+				Func:  "memoize",
+				Which: 1,
+			},
+		},
+	})
+}
+
+func TestFuncMemoizeCalls(t *testing.T) {
+
+	var calls int
+
+	exts := map[string]Extension{
+		"record": {
+			Func: func(v interface{}) (interface{}, error) {
+				calls++
+				if s, ok := v.(string); ok && s == "fail" {
+					return nil, errors.New("failed")
+				}
+				return v, nil
+			},
+		},
+	}
+
+	tests := []struct {
+		Expression string
+		Calls      int
+		Error      bool
+	}{
+		{
+			Expression: `($f := $memoize($record); [$f(1), $f(1.0), $f(2)])`,
+			Calls:      2,
+		},
+		{
+			Expression: `($f := $memoize($record); [$f({"a": [1, 2]}), $f({"a": [1, 2]}), $f({"a": [2, 1]})])`,
+			Calls:      2,
+		},
+		{
+			Expression: `($f := $memoize($record); [$f(undefined), $f(undefined), $f(null)])`,
+			Calls:      2,
+		},
+		{
+			// Functions are only equal to themselves.
+			Expression: `($f := $memoize($record); [$f($string), $f($string), $f($number)])`,
+			Calls:      2,
+		},
+		{
+			// Errors are not cached.
+			Expression: `($f := $memoize($record); [$f("fail") ? 1 : 2, $f("fail")])`,
+			Calls:      1,
+			Error:      true,
+		},
+		{
+			// Caches are not shared between evaluations.
+			Expression: `($f := $memoize($record); $f(1))`,
+			Calls:      1,
+		},
+	}
+
+	for _, test := range tests {
+
+		e, err := CompileWithExts(test.Expression, exts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+
+			calls = 0
+			_, err = e.Eval(nil)
+
+			if test.Error && err == nil {
+				t.Errorf("%s: expected an error", test.Expression)
+			}
+
+			if !test.Error && err != nil {
+				t.Errorf("%s: unexpected error: %s", test.Expression, err)
+			}
+
+			if calls != test.Calls {
+				t.Errorf("%s: expected %d calls, got %d", test.Expression, test.Calls, calls)
+			}
+		}
+	}
+}
+
+func TestPartials(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: `
+				(
+					$add := function($x, $y){$x+$y};
+					$add2 := $add(?, 2);
+					$add2(3)
+				)`,
+			Output: float64(5),
+		},
+		{
+			Expression: `
+				(
+					$add := function($x, $y){$x+$y};
+					$add2 := $add(2, ?);
+					$add2(4)
+				)`,
+			Output: float64(6),
+		},
+		{
+			Expression: `
+				(
+					$last_letter := $substring(?, -1);
+					$last_letter("Hello World")
+				)`,
+			Output: "d",
+		},
+		{
+			Expression: `
+				(
+					$firstn := $substring(?, 0, ?);
+					$first5 := $firstn(?, 5);
+					$first5("Hello World")
+				)`,
+			Output: "Hello",
+		},
+		{
+			Expression: `
+				(
+					$firstn := $substr(?, 0, ?);
+					$first5 := $firstn(?, 5);
+					$first5("Hello World")
+				)`,
+			Exts: map[string]Extension{
+				"substr": {
+					Func: func(s string, start, length int) string {
+						if length <= 0 || start >= len(s) {
+							return ""
+						}
+
+						if start < 0 {
+							start += len(s)
+						}
+
+						if start > 0 {
+							s = s[start:]
+						}
+
+						if length < len(s) {
+							s = s[:length]
+						}
 
 						return s
 					},
@@ -3272,203 +4424,231 @@ func TestFuncExists2(t *testing.T) {
 	})
 }
 
-func TestFuncCount(t *testing.T) {
+func TestFuncType(t *testing.T) {
 
 	runTestCases(t, nil, []*testCase{
 		{
 			Expression: []string{
-				"$count([])",
-				"$count([nothing])",
-				"$count([nothing,nada,now't])",
+				`$type(null)`,
+				`$type([null][0])`,
+				`$type($lookup({"a": null}, "a"))`,
 			},
-			Output: 0,
+			Output: "null",
 		},
 		{
 			Expression: []string{
-				"$count(0)",
-				"$count(false)",
-				"$count(null)",
-				`$count("")`,
+				`$type(1)`,
+				`$type(-3.14)`,
+				`$type($int)`,
 			},
-			Output: 1,
+			Vars: map[string]interface{}{
+				"int": 42,
+			},
+			Output: "number",
 		},
 		{
 			Expression: []string{
-				"$count([1,2,3])",
-				"$count([1,2,3,nothing,nada,nichts])",
-				"$count([1..3])",
-				`$count(["1","2","3"])`,
-				`$count(["1","2",3])`,
-				`$count([0.5,true,{"one":1}])`,
+				`$type("")`,
+				`$type("hello")`,
 			},
-			Output: 3,
+			Output: "string",
 		},
 		{
-			Expression: "$count()",
-			Error: &ArgCountError{
-				Func:     "count",
-				Expected: 1,
-				Received: 0,
+			Expression: []string{
+				`$type(true)`,
+				`$type(false)`,
+				`$type(1 = 1)`,
 			},
+			Output: "boolean",
 		},
 		{
 			Expression: []string{
-				"$count([],[])",
-				"$count([1,2,3],[])",
-			},
-			Error: &ArgCountError{
-				Func:     "count",
-				Expected: 1,
-				Received: 2,
+				`$type([])`,
+				`$type([1, 2, 3])`,
+				`$type([[1]])`,
 			},
+			Output: "array",
 		},
 		{
 			Expression: []string{
-				"$count(1,2,3)",
-				"$count([],[],[])",
-				"$count([1,2],[],[])",
+				`$type({})`,
+				`$type({"a": 1})`,
+				`$type($struct)`,
+				`$type($structptr)`,
 			},
-			Error: &ArgCountError{
-				Func:     "count",
-				Expected: 1,
-				Received: 3,
+			Vars: map[string]interface{}{
+				"struct": struct {
+					A int
+				}{},
+				"structptr": &struct {
+					A int
+				}{},
 			},
+			Output: "object",
 		},
 		{
-			Expression: "$count(nothing)",
-			Output:     0,
+			Expression: []string{
+				`$type(function(){1})`,
+				`$type(λ($x){$x})`,
+				`$type($sum)`,
+				`$type($substring(?, 1))`,
+				`$type(/regex/)`,
+			},
+			Output: "function",
 		},
 		{
-			Expression: "$count([1,2,3,4]) / 2",
-			Output:     float64(2),
+			Expression: []string{
+				`$type(nothing)`,
+				`$type([1,2,3][5])`,
+			},
+			Error: ErrUndefined,
+		},
+		{
+			Expression: `$type(1, 2)`,
+			Error: &ArgCountError{
+				Func:     "type",
+				Expected: 1,
+				Received: 2,
+			},
 		},
 	})
 }
 
-func TestFuncCount2(t *testing.T) {
+func TestFuncType2(t *testing.T) {
 
-	runTestCases(t, testdata.account, []*testCase{
+	runTestCases(t, testdata.address, []*testCase{
 		{
-			Expression: "$count(Account.Order.Product.(Price * Quantity))",
-			Output:     4,
+			// With no arguments, $type uses the evaluation
+			// context.
+			Expression: `$type()`,
+			Output:     "object",
 		},
 		{
-			Expression: "Account.Order.$count(Product.(Price * Quantity))",
+			Expression: `FirstName.$type()`,
+			Output:     "string",
+		},
+		{
+			Expression: `$type($lookup(Other, "Misc"))`,
+			Output:     "null",
+		},
+		{
+			Expression: `$map([Age, FirstName, [Age], Other, Age > 18], $type)`,
 			Output: []interface{}{
-				2,
-				2,
+				"number",
+				"string",
+				"array",
+				"object",
+				"boolean",
 			},
 		},
 		{
-			Expression: `Account.Order.(OrderID & ": " & $count(Product.(Price*Quantity)))`,
+			Expression: `Phone.($type(number) = "string")`,
 			Output: []interface{}{
-				"order103: 2",
-				"order104: 2",
+				true,
+				true,
+				true,
+				true,
 			},
 		},
+		{
+			Expression: `$type(Phone) = "array" ? $count(Phone) : 1`,
+			Output:     4,
+		},
 	})
 }
 
-func TestFuncAppend(t *testing.T) {
+func TestFuncError(t *testing.T) {
 
-	runTestCases(t, nil, []*testCase{
+	runTestCases(t, testdata.account, []*testCase{
 		{
-			Expression: []string{
-				"$append([], [])",
-				"$append([nothing], [nothing])",
+			Expression: `$error("Something went wrong")`,
+			Error: &UserError{
+				Message: "Something went wrong",
 			},
-			Output: []interface{}{},
 		},
 		{
 			Expression: []string{
-				"$append(1, 2)",
-				"$append([1], [2])",
+				`$error()`,
+				`$error(nothing)`,
 			},
-			Output: []interface{}{
-				float64(1),
-				float64(2),
+			Error: &UserError{
+				Message: "$error() function evaluated",
 			},
 		},
 		{
-			Expression: "$append([1,2], [3,4])",
-			Output: []interface{}{
-				float64(1),
-				float64(2),
-				float64(3),
-				float64(4),
+			Expression: `Account.Order[0].Product[0].(Price > 20 ? $error("Price " & Price & " too high") : Price)`,
+			Error: &UserError{
+				Message: "Price 34.45 too high",
 			},
 		},
 		{
-			Expression: []string{
-				"$append(1, [3,4])",
-				"$append([1,3], 4)",
-				"$append([1,3,4], [])",
-				"$append([1,3,4], nothing)",
-				"$append([1,3,4], [nothing])",
-				"$append([1,3,4], [nothing,nada])",
-			},
-			Output: []interface{}{
-				float64(1),
-				float64(3),
-				float64(4),
-			},
+			Expression: `Account.Order[0].Product[0].(Price > 50 ? $error("Price too high") : Price)`,
+			Output:     34.45,
 		},
 		{
-			Expression: []string{
-				"$append(1, nothing)",
-				"$append(nothing, 1)",
+			Expression: `$error(1)`,
+			Error: &ArgTypeError{
+				Func:  "error",
+				Which: 1,
 			},
-			Output: float64(1),
 		},
 		{
-			Expression: []string{
-				"$append([1], nothing)",
-				"$append([1,nothing], nothing)",
-				"$append(nothing, [1])",
-				"$append(nothing, [1,nothing])",
-			},
-			Output: []interface{}{
-				float64(1),
+			Expression: `$error("a", "b")`,
+			Error: &ArgCountError{
+				Func:     "error",
+				Expected: 1,
+				Received: 2,
 			},
 		},
+	})
+}
+
+func TestFuncAssert(t *testing.T) {
+
+	runTestCases(t, testdata.account, []*testCase{
 		{
 			Expression: []string{
-				"$append([2,3,4], nothing)",
-				"$append([2,3], [4,nothing])",
-				"$append([2], [3,4,nothing])",
-				"$append(2, [3,4,nothing])",
+				`$assert(true)`,
+				`$assert(true, "Should not fail")`,
+				`$assert($count(Account.Order) = 2, "Expected two orders")`,
 			},
-			Output: []interface{}{
-				float64(2),
-				float64(3),
-				float64(4),
+			Error: ErrUndefined,
+		},
+		{
+			Expression: `($assert($exists(Account), "No account"); Account.Order[0].OrderID)`,
+			Output:     "order103",
+		},
+		{
+			Expression: `$assert($count(Account.Order) = 3, "Expected three orders")`,
+			Error: &UserError{
+				Message: "Expected three orders",
 			},
 		},
 		{
-			Expression: "$append(nothing, nothing)",
-			Error:      ErrUndefined,
+			Expression: `$assert(false)`,
+			Error: &UserError{
+				Message: "$assert() statement failed",
+			},
 		},
 		{
-			Expression: "$append()",
-			Error: &ArgCountError{
-				Func:     "append",
-				Expected: 2,
-				Received: 0,
+			Expression: `$assert("true", "Not a boolean")`,
+			Error: &ArgTypeError{
+				Func:  "assert",
+				Which: 1,
 			},
-			Skip: true, // returns ErrUndefined
 		},
 		{
-			Expression: "$append([])",
+			Expression: `$assert()`,
 			Error: &ArgCountError{
-				Func:     "append",
+				Func:     "assert",
 				Expected: 2,
-				Received: 1,
+				Received: 0,
 			},
 		},
 		{
-			Expression: "$append([],[],[])",
+			Expression: `$assert(true, "a", "b")`,
 			Error: &ArgCountError{
-				Func:     "append",
+				Func:     "assert",
 				Expected: 2,
 				Received: 3,
 			},
@@ -3476,4473 +4656,12330 @@ func TestFuncAppend(t *testing.T) {
 	})
 }
 
-func TestFuncReverse(t *testing.T) {
+func TestUserErrorAs(t *testing.T) {
 
-	runTestCases(t, nil, []*testCase{
+	for _, exp := range []string{
+		`$error("user error")`,
+		`$assert(false, "user error")`,
+		`[1, 2, 3].($ = 2 ? $error("user error") : $)`,
+	} {
+		_, err := MustCompile(exp).Eval(nil)
+
+		var userErr *UserError
+		if !errors.As(err, &userErr) {
+			t.Errorf("%s: expected a UserError, got %v [%T]", exp, err, err)
+			continue
+		}
+
+		if userErr.Message != "user error" {
+			t.Errorf("%s: expected message %q, got %q", exp, "user error", userErr.Message)
+		}
+	}
+
+	_, err := MustCompile(`1 + "a"`).Eval(nil)
+
+	var userErr *UserError
+	if errors.As(err, &userErr) {
+		t.Errorf("expected a non-user error, got %v [%T]", err, err)
+	}
+}
+
+func TestFuncEval(t *testing.T) {
+
+	runTestCases(t, testdata.account, []*testCase{
 		{
-			Expression: []string{
-				"$reverse([])",
-				"$reverse([nothing])",
-			},
-			Output: []interface{}{},
+			Expression: `$eval("1 + 2")`,
+			Output:     float64(3),
 		},
 		{
 			Expression: []string{
-				"$reverse(1)",
-				"$reverse([1])",
+				`$eval("Account.Order[0].OrderID")`,
+				`$eval("OrderID", Account.Order[0])`,
+				`Account.Order[0].$eval("OrderID")`,
+				`"Account.Order[0].OrderID" ~> $eval()`,
 			},
+			Output: "order103",
+		},
+		{
+			Expression: `Account.Order.$eval("OrderID")`,
 			Output: []interface{}{
-				float64(1),
+				"order103",
+				"order104",
 			},
 		},
 		{
-			Expression: []string{
-				"$reverse([1..5])",
-				"$reverse([1,2,3,4,nothing,5,nada])",
-			},
+			Expression: `$eval("[1,2,3]")`,
 			Output: []interface{}{
-				float64(5),
-				float64(4),
-				float64(3),
-				float64(2),
 				float64(1),
+				float64(2),
+				float64(3),
 			},
 		},
 		{
-			Expression: `$reverse(["hello","world"])`,
-			Output: []interface{}{
-				"world",
-				"hello",
-			},
+			// Variables in scope at the call site are visible
+			// to the evaluated expression.
+			Expression: `($x := 10; $eval("$x * 2"))`,
+			Output:     float64(20),
 		},
 		{
-			Expression: `$reverse([true,0.5,"hello",{"one":1},[1,2,3]])`,
+			// Assignments made by the evaluated expression do
+			// not leak out.
+			Expression: `($x := 10; $eval("$x := 5"); $x)`,
+			Output:     float64(10),
+		},
+		{
+			Expression: `(
+				$rules := [
+					{"name": "total", "expr": "$sum(Product.Quantity)"},
+					{"name": "count", "expr": "$count(Product)"}
+				];
+				$rules.{
+					"name": name,
+					"value": $eval(expr, $$.Account.Order[0])
+				}
+			)`,
 			Output: []interface{}{
-				[]interface{}{
-					float64(1),
-					float64(2),
-					float64(3),
+				map[string]interface{}{
+					"name":  "total",
+					"value": float64(3),
 				},
 				map[string]interface{}{
-					"one": float64(1),
+					"name":  "count",
+					"value": 2,
 				},
-				"hello",
-				0.5,
-				true,
 			},
 		},
 		{
-			Expression: "$reverse(nothing)",
-			Error:      ErrUndefined,
+			Expression: `$eval("$double(21)")`,
+			Exts: map[string]Extension{
+				"double": {
+					Func: func(n float64) float64 {
+						return n * 2
+					},
+				},
+			},
+			Output: float64(42),
 		},
 		{
-			Expression: "$reverse()",
-			Error: &ArgCountError{
-				Func:     "reverse",
-				Expected: 1,
-				Received: 0,
+			Expression: `$eval("$greeting")`,
+			Vars: map[string]interface{}{
+				"greeting": "hello",
+			},
+			Output: "hello",
+		},
+		{
+			Expression: []string{
+				`$eval(nothing)`,
+				`$eval("nothing")`,
 			},
+			Error: ErrUndefined,
 		},
 		{
-			Expression: "$reverse([],[])",
+			Expression: `$eval("$error('raised')")`,
+			Error: &UserError{
+				Message: "raised",
+			},
+		},
+		{
+			Expression: `$eval("1 +")`,
+			Error: &EvalError{
+				Type:  ErrEvalParse,
+				Token: "$eval",
+				Value: "unexpected end of expression",
+			},
+		},
+		{
+			Expression: `$eval(1)`,
+			Error: &ArgTypeError{
+				Func:  "eval",
+				Which: 1,
+			},
+		},
+		{
+			Expression: `$eval()`,
 			Error: &ArgCountError{
-				Func:     "reverse",
-				Expected: 1,
-				Received: 2,
+				Func:     "eval",
+				Expected: 2,
+				Received: 0,
 			},
 		},
 		{
-			Expression: "$reverse(1,2,3)",
+			Expression: `$eval("1", 2, 3)`,
 			Error: &ArgCountError{
-				Func:     "reverse",
-				Expected: 1,
+				Func:     "eval",
+				Expected: 2,
 				Received: 3,
 			},
 		},
 	})
 }
 
-func TestFuncReverse2(t *testing.T) {
+func TestFuncEvalCache(t *testing.T) {
 
-	data := []interface{}{1, 2, 3}
+	env := newEnvironment(nil, 0)
+	f := newEvalCallable(env)
 
-	runTestCases(t, data, []*testCase{
-		{
-			Expression: "[$, $reverse($), $]",
-			Output: []interface{}{
-				[]interface{}{
-					1,
-					2,
-					3,
-				},
-				[]interface{}{
-					3,
-					2,
-					1,
-				},
-				[]interface{}{
-					1,
-					2,
-					3,
-				},
-			},
-			Skip: true, // sub-arrays are wrapped in extra brackets
-		},
-	})
+	for i := 0; i < 3; i++ {
+		for _, expr := range []string{"1 + 1", "2 + 2"} {
+			if _, err := f.Call([]reflect.Value{reflect.ValueOf(expr)}); err != nil {
+				t.Fatalf("%s: unexpected error: %s", expr, err)
+			}
+		}
+	}
+
+	if len(f.cache) != 2 {
+		t.Errorf("expected 2 cached expressions, got %d", len(f.cache))
+	}
 }
 
-func TestFuncSort(t *testing.T) {
+func TestFuncCount(t *testing.T) {
 
 	runTestCases(t, nil, []*testCase{
-		{
-			Expression: "$sort(nothing)",
-			Error:      ErrUndefined,
-		},
 		{
 			Expression: []string{
-				"$sort(1)",
-				"$sort([1])",
-			},
-			Output: []interface{}{
-				float64(1),
+				"$count([])",
+				"$count([nothing])",
+				"$count([nothing,nada,now't])",
 			},
+			Output: 0,
 		},
 		{
-			Expression: "$sort([1,3,2])",
-			Output: []interface{}{
-				float64(1),
-				float64(2),
-				float64(3),
+			Expression: []string{
+				"$count(0)",
+				"$count(false)",
+				"$count(null)",
+				`$count("")`,
 			},
+			Output: 1,
 		},
 		{
-			Expression: "$sort([1,3,22,11])",
-			Output: []interface{}{
-				float64(1),
-				float64(3),
-				float64(11),
-				float64(22),
+			Expression: []string{
+				"$count([1,2,3])",
+				"$count([1,2,3,nothing,nada,nichts])",
+				"$count([1..3])",
+				`$count(["1","2","3"])`,
+				`$count(["1","2",3])`,
+				`$count([0.5,true,{"one":1}])`,
 			},
+			Output: 3,
 		},
-	})
-}
-
-func TestFuncSort2(t *testing.T) {
-
-	runTestCases(t, testdata.account, []*testCase{
 		{
-			Expression: "$sort(Account.Order.Product.Price)",
-			Output: []interface{}{
-				21.67,
-				34.45,
-				34.45,
-				107.99,
+			Expression: "$count()",
+			Error: &ArgCountError{
+				Func:     "count",
+				Expected: 1,
+				Received: 0,
 			},
 		},
 		{
-			Expression: "$sort(Account.Order.Product.`Product Name`)",
-			Output: []interface{}{
-				"Bowler Hat",
-				"Bowler Hat",
-				"Cloak",
-				"Trilby hat",
+			Expression: []string{
+				"$count([],[])",
+				"$count([1,2,3],[])",
+			},
+			Error: &ArgCountError{
+				Func:     "count",
+				Expected: 1,
+				Received: 2,
 			},
 		},
 		{
-			Expression: `$sort(Account.Order.Product, function($a, $b) { $a.(Price * Quantity) > $b.(Price * Quantity) }).(Price & " x " & Quantity)`,
-			Output: []interface{}{
-				"21.67 x 1",
-				"34.45 x 2",
-				"107.99 x 1",
-				"34.45 x 4",
+			Expression: []string{
+				"$count(1,2,3)",
+				"$count([],[],[])",
+				"$count([1,2],[],[])",
 			},
-		},
-		{
-			Expression: `$sort(Account.Order.Product, function($a, $b) { $a.Price > $b.Price }).SKU`,
-			Output: []interface{}{
-				"0406634348",
-				"0406654608",
-				"040657863",
-				"0406654603",
+			Error: &ArgCountError{
+				Func:     "count",
+				Expected: 1,
+				Received: 3,
 			},
 		},
 		{
-			Expression: `
-				(Account.Order.Product
-					~> $sort(λ($a,$b){$a.Quantity < $b.Quantity})
-					~> $sort(λ($a,$b){$a.Price > $b.Price})
-				).SKU`,
-			Output: []interface{}{
-				"0406634348",
-				"040657863",
-				"0406654608",
-				"0406654603",
-			},
+			Expression: "$count(nothing)",
+			Output:     0,
 		},
 		{
-			Expression: "$sort(Account.Order.Product)",
-			Error:      fmt.Errorf("argument 1 of function sort must be an array of strings or numbers"), // TODO: Use a proper error
+			Expression: "$count([1,2,3,4]) / 2",
+			Output:     float64(2),
 		},
 	})
 }
 
-func TestFuncSort3(t *testing.T) {
-
-	data := []interface{}{1, 3, 2}
+func TestFuncCount2(t *testing.T) {
 
-	runTestCases(t, data, []*testCase{
+	runTestCases(t, testdata.account, []*testCase{
 		{
-			Expression: "[[$], [$sort($)], [$]]",
+			Expression: "$count(Account.Order.Product.(Price * Quantity))",
+			Output:     4,
+		},
+		{
+			Expression: "Account.Order.$count(Product.(Price * Quantity))",
 			Output: []interface{}{
-				[]float64{
-					1,
-					3,
-					2,
-				},
-				[]float64{
-					1,
-					2,
-					3,
-				},
-				[]float64{
-					1,
-					3,
-					2,
-				},
+				2,
+				2,
+			},
+		},
+		{
+			Expression: `Account.Order.(OrderID & ": " & $count(Product.(Price*Quantity)))`,
+			Output: []interface{}{
+				"order103: 2",
+				"order104: 2",
 			},
-			Skip: true, // inner arrays are wrapped in extra brackets
 		},
 	})
 }
 
-func TestFuncShuffle(t *testing.T) {
+func TestFuncDistinct(t *testing.T) {
 
 	runTestCases(t, nil, []*testCase{
 		{
-			Expression: []string{
-				"$shuffle([])",
-				"$shuffle([nothing])",
+			Expression: "$distinct([1,2,3,3,4,3,5])",
+			Output: []interface{}{
+				float64(1),
+				float64(2),
+				float64(3),
+				float64(4),
+				float64(5),
 			},
-			Output: []interface{}{},
 		},
 		{
-			Expression: []string{
-				"$shuffle(1)",
-				"$shuffle([1])",
+			Expression: `$distinct(["a","b","a","c","b"])`,
+			Output: []interface{}{
+				"a",
+				"b",
+				"c",
 			},
+		},
+		{
+			Expression: `$distinct([{"a":1},{"a":1},{"a":2}])`,
 			Output: []interface{}{
-				float64(1),
+				map[string]interface{}{
+					"a": float64(1),
+				},
+				map[string]interface{}{
+					"a": float64(2),
+				},
 			},
 		},
 		{
-			Expression: "$count($shuffle([1..10]))",
-			Output:     10,
+			Expression: "$distinct([[1,2],[1,2],[2,1]])",
+			Output: []interface{}{
+				[]interface{}{
+					float64(1),
+					float64(2),
+				},
+				[]interface{}{
+					float64(2),
+					float64(1),
+				},
+			},
 		},
 		{
-			Expression: "$sort($shuffle([1..10]))",
+			Expression: `$distinct([1, 1.0, [1, {"a": 2}], [1.0, {"a": 2.0}]])`,
 			Output: []interface{}{
 				float64(1),
-				float64(2),
-				float64(3),
-				float64(4),
-				float64(5),
-				float64(6),
-				float64(7),
-				float64(8),
-				float64(9),
-				float64(10),
+				[]interface{}{
+					float64(1),
+					map[string]interface{}{
+						"a": float64(2),
+					},
+				},
 			},
 		},
 		{
-			Expression: "$shuffle(nothing)",
+			Expression: `$distinct([1,"1",true,null,1,"1",true,null])`,
+			Output: []interface{}{
+				float64(1),
+				"1",
+				true,
+				nil,
+			},
+		},
+		{
+			Expression: "$distinct([])",
+			Output:     []interface{}{},
+		},
+		{
+			Expression: "$distinct(1)",
+			Output:     float64(1),
+		},
+		{
+			Expression: `$distinct("hello")`,
+			Output:     "hello",
+		},
+		{
+			Expression: "$distinct(nothing)",
 			Error:      ErrUndefined,
 		},
 		{
-			Expression: "$shuffle()",
+			Expression: "$distinct()",
 			Error: &ArgCountError{
-				Func:     "shuffle",
+				Func:     "distinct",
 				Expected: 1,
 				Received: 0,
 			},
 		},
 		{
-			Expression: "$shuffle([],[])",
+			Expression: "$distinct([1],[2])",
 			Error: &ArgCountError{
-				Func:     "shuffle",
+				Func:     "distinct",
 				Expected: 1,
 				Received: 2,
 			},
 		},
-		{
-			Expression: "$shuffle(1,2,3)",
-			Error: &ArgCountError{
-				Func:     "shuffle",
-				Expected: 1,
-				Received: 3,
-			},
-		},
 	})
 }
 
-func TestFuncShuffle2(t *testing.T) {
+func TestFuncDistinct2(t *testing.T) {
 
-	// TODO: These tests don't actually verify that the values
-	// have been shuffled.
-	runTestCasesFunc(t, equalArraysUnordered, nil, []*testCase{
+	runTestCases(t, testdata.account, []*testCase{
 		{
 			Expression: []string{
-				"$shuffle([1..10])",
-				"$shuffle($reverse([1..10]))",
+				"$distinct(Account.Order.Product.Description.Colour)",
+				"Account.Order.Product.Description.Colour ~> $distinct()",
 			},
 			Output: []interface{}{
-				float64(1),
-				float64(2),
-				float64(3),
-				float64(4),
-				float64(5),
-				float64(6),
-				float64(7),
-				float64(8),
-				float64(9),
-				float64(10),
+				"Purple",
+				"Orange",
+				"Black",
 			},
 		},
 		{
-			Expression: `$shuffle([true,-0.5,"hello",[1,2,3],{"one":1}])`,
+			Expression: "Account.Order.Product.SKU ~> $distinct() ~> $count()",
+			Output:     4,
+		},
+		{
+			Expression: `$distinct(Account.Order.Product.Description.{"Colour": Colour})`,
 			Output: []interface{}{
-				true,
-				-0.5,
-				"hello",
-				[]interface{}{
-					float64(1),
-					float64(2),
-					float64(3),
+				map[string]interface{}{
+					"Colour": "Purple",
 				},
 				map[string]interface{}{
-					"one": float64(1),
+					"Colour": "Orange",
+				},
+				map[string]interface{}{
+					"Colour": "Black",
 				},
 			},
 		},
 	})
 }
 
-func TestFuncZip(t *testing.T) {
+func TestFuncDistinctGoValues(t *testing.T) {
 
-	runTestCases(t, nil, []*testCase{
+	// A struct with an interface field is a comparable type, but
+	// comparing two of them panics if the field holds a slice or
+	// a map.
+	type item struct {
+		Value interface{}
+	}
+
+	data := map[string]interface{}{
+		"numbers": []interface{}{
+			1,
+			int64(1),
+			1.0,
+			json.Number("1"),
+			uint8(2),
+			float32(2),
+		},
+		"items": []interface{}{
+			item{Value: []interface{}{1, 2}},
+			item{Value: []interface{}{1.0, 2.0}},
+			item{Value: map[string]interface{}{"a": 1}},
+			item{Value: map[string]interface{}{"a": 1}},
+		},
+	}
+
+	runTestCases(t, data, []*testCase{
 		{
-			Expression: []string{
-				`$zip(1,2,3)`,
-				`$zip(1,2,[3])`,
-				`$zip([1],[2],[3])`,
-				`$zip([1],[2,3],[3,4,5])`,
-			},
+			// Numbers are compared by value, regardless of
+			// their Go types.
+			Expression: "$distinct(numbers)",
 			Output: []interface{}{
-				[]interface{}{
-					float64(1),
-					float64(2),
-					float64(3),
-				},
+				1,
+				uint8(2),
 			},
 		},
 		{
-			Expression: `$zip([1,2,3])`,
+			Expression: "$distinct(items)",
 			Output: []interface{}{
-				[]interface{}{
-					float64(1),
-				},
-				[]interface{}{
-					float64(2),
-				},
-				[]interface{}{
-					float64(3),
-				},
+				item{Value: []interface{}{1, 2}},
+				item{Value: map[string]interface{}{"a": 1}},
 			},
 		},
+	})
+}
+
+func TestFuncAppend(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `$zip([1,2,3],["one","two","three"])`,
-			Output: []interface{}{
-				[]interface{}{
-					float64(1),
-					"one",
-				},
-				[]interface{}{
-					float64(2),
-					"two",
-				},
-				[]interface{}{
-					float64(3),
-					"three",
-				},
+			Expression: []string{
+				"$append([], [])",
+				"$append([nothing], [nothing])",
 			},
+			Output: []interface{}{},
 		},
 		{
-			Expression: `$zip([1,2,3],["one","two","three"],[true,false,true])`,
+			Expression: []string{
+				"$append(1, 2)",
+				"$append([1], [2])",
+			},
 			Output: []interface{}{
-				[]interface{}{
-					float64(1),
-					"one",
-					true,
-				},
-				[]interface{}{
-					float64(2),
-					"two",
-					false,
-				},
-				[]interface{}{
-					float64(3),
-					"three",
-					true,
-				},
+				float64(1),
+				float64(2),
 			},
 		},
 		{
-			Expression: `$zip([1,2,3],["one","two"],[true,false,true])`,
+			Expression: "$append([1,2], [3,4])",
 			Output: []interface{}{
-				[]interface{}{
-					float64(1),
-					"one",
-					true,
-				},
-				[]interface{}{
-					float64(2),
-					"two",
-					false,
-				},
+				float64(1),
+				float64(2),
+				float64(3),
+				float64(4),
 			},
 		},
 		{
 			Expression: []string{
-				`$zip(nothing)`,
-				`$zip(nothing,nada,now't)`,
-				`$zip(1,2,3,nothing)`,
-				`$zip([1,2,3],nothing)`,
-				`$zip([1,2,3],[nothing])`,
-				`$zip([1,2,3],[nothing,nada,now't])`,
+				"$append(1, [3,4])",
+				"$append([1,3], 4)",
+				"$append([1,3,4], [])",
+				"$append([1,3,4], nothing)",
+				"$append([1,3,4], [nothing])",
+				"$append([1,3,4], [nothing,nada])",
+			},
+			Output: []interface{}{
+				float64(1),
+				float64(3),
+				float64(4),
 			},
-			Output: []interface{}{},
-		},
-		{
-			Expression: `$zip()`,
-			Error:      fmt.Errorf("cannot call zip with no arguments"),
 		},
-	})
-}
-
-func TestFuncSum(t *testing.T) {
-
-	runTestCases(t, nil, []*testCase{
 		{
 			Expression: []string{
-				"$sum(0)",
-				"$sum([])",
-				"$sum([0])",
-				"$sum([nothing])",
-				"$sum([0,nothing])",
+				"$append(1, nothing)",
+				"$append(nothing, 1)",
 			},
-			Output: float64(0),
-		},
-		{
-			Expression: "$sum(1)",
-			Output:     float64(1),
+			Output: float64(1),
 		},
 		{
 			Expression: []string{
-				"$sum(15)",
-				"$sum([1..5])",
-				"$sum([1..5])",
-				"$sum([1..4,5])",
-				"$sum([1,2,3,4,5])",
-				"$sum([1,2,3,4,nothing,nada,5])",
+				"$append([1], nothing)",
+				"$append([1,nothing], nothing)",
+				"$append(nothing, [1])",
+				"$append(nothing, [1,nothing])",
+			},
+			Output: []interface{}{
+				float64(1),
 			},
-			Output: float64(15),
 		},
 		{
 			Expression: []string{
-				`$sum("")`,
-				"$sum(true)",
-				`$sum({"one":1})`,
+				"$append([2,3,4], nothing)",
+				"$append([2,3], [4,nothing])",
+				"$append([2], [3,4,nothing])",
+				"$append(2, [3,4,nothing])",
+			},
+			Output: []interface{}{
+				float64(2),
+				float64(3),
+				float64(4),
 			},
-			Error: errors.New("cannot call sum on a non-array type"), // TODO: Don't rely on error strings
 		},
 		{
-			Expression: []string{
-				`$sum([1,2,"3"])`,
-				"$sum([1,2,true])",
-			},
-			Error: errors.New("cannot call sum on an array with non-number types"), // TODO: Don't rely on error strings
+			Expression: "$append(nothing, nothing)",
+			Error:      ErrUndefined,
 		},
 		{
-			Expression: "$sum()",
+			Expression: "$append()",
 			Error: &ArgCountError{
-				Func:     "sum",
-				Expected: 1,
+				Func:     "append",
+				Expected: 2,
 				Received: 0,
 			},
 		},
 		{
-			Expression: "$sum(1,2)",
+			Expression: "$append([])",
 			Error: &ArgCountError{
-				Func:     "sum",
-				Expected: 1,
-				Received: 2,
-			},
-		},
-		{
-			Expression: "$sum(nothing)",
-			Error:      ErrUndefined,
-		},
-	})
-}
-
-func TestFuncSum2(t *testing.T) {
-
-	runTestCases(t, testdata.account, []*testCase{
-		{
-			Expression: "$sum(Account.Order.Product.(Price * Quantity))",
-			Output:     336.36,
-		},
-		{
-			Expression: "Account.Order.$sum(Product.(Price * Quantity))",
-			Output: []interface{}{
-				90.57000000000001,
-				245.79000000000002,
+				Func:     "append",
+				Expected: 2,
+				Received: 1,
 			},
 		},
 		{
-			Expression: `Account.Order.(OrderID & ": " & $sum(Product.(Price*Quantity)))`,
-			Output: []interface{}{
-				// TODO: Why does jsonata-js only display to 2dp?
-				"order103: 90.57000000000001",
-				"order104: 245.79000000000002",
+			Expression: "$append([],[],[])",
+			Error: &ArgCountError{
+				Func:     "append",
+				Expected: 2,
+				Received: 3,
 			},
 		},
-		{
-			Expression: "$sum(Account.Order)",
-			Error:      fmt.Errorf("cannot call sum on an array with non-number types"), // TODO: relying on error strings is bad
-		},
 	})
 }
 
-func TestFuncMax(t *testing.T) {
+func TestFuncReverse(t *testing.T) {
 
 	runTestCases(t, nil, []*testCase{
 		{
 			Expression: []string{
-				"$max(1)",
-				"$max([1,0])",
-				"$max([1,0,-1.5])",
+				"$reverse([])",
+				"$reverse([nothing])",
 			},
-			Output: float64(1),
+			Output: []interface{}{},
 		},
 		{
 			Expression: []string{
-				"$max(-1)",
-				"$max([-1,-5])",
-				"$max([-1,-5,nothing])",
+				"$reverse(1)",
+				"$reverse([1])",
+			},
+			Output: []interface{}{
+				float64(1),
 			},
-			Output: float64(-1),
 		},
 		{
 			Expression: []string{
-				"$max(3)",
-				"$max([1,2,3])",
-				"$max([1..3])",
-				"$max([1..3,nothing])",
+				"$reverse([1..5])",
+				"$reverse([1,2,3,4,nothing,5,nada])",
+			},
+			Output: []interface{}{
+				float64(5),
+				float64(4),
+				float64(3),
+				float64(2),
+				float64(1),
 			},
-			Output: float64(3),
 		},
 		{
-			Expression: []string{
-				`$max("")`,
-				`$max(true)`,
-				`$max({"one":1})`,
+			Expression: `$reverse(["hello","world"])`,
+			Output: []interface{}{
+				"world",
+				"hello",
 			},
-			Error: fmt.Errorf("cannot call max on a non-array type"), // TODO: Don't rely on the error string
 		},
 		{
-			Expression: []string{
-				`$max(["1","2","3"])`,
-				`$max(["1","2",3])`,
+			Expression: `$reverse([true,0.5,"hello",{"one":1},[1,2,3]])`,
+			Output: []interface{}{
+				[]interface{}{
+					float64(1),
+					float64(2),
+					float64(3),
+				},
+				map[string]interface{}{
+					"one": float64(1),
+				},
+				"hello",
+				0.5,
+				true,
 			},
-			Error: fmt.Errorf("cannot call max on an array with non-number types"), // TODO: Don't rely on the error string
 		},
 		{
-			Expression: "$max()",
+			Expression: "$reverse(nothing)",
+			Error:      ErrUndefined,
+		},
+		{
+			Expression: "$reverse()",
 			Error: &ArgCountError{
-				Func:     "max",
+				Func:     "reverse",
 				Expected: 1,
 				Received: 0,
 			},
 		},
 		{
-			Expression: "$max([],[])",
+			Expression: "$reverse([],[])",
 			Error: &ArgCountError{
-				Func:     "max",
+				Func:     "reverse",
 				Expected: 1,
 				Received: 2,
 			},
 		},
 		{
-			Expression: "$max(1,2,3)",
+			Expression: "$reverse(1,2,3)",
 			Error: &ArgCountError{
-				Func:     "max",
+				Func:     "reverse",
 				Expected: 1,
 				Received: 3,
 			},
 		},
+	})
+}
+
+func TestFuncReverse2(t *testing.T) {
+
+	data := []interface{}{1, 2, 3}
+
+	runTestCases(t, data, []*testCase{
 		{
-			Expression: []string{
-				"$max(nothing)",
-				"$max([])",
-				"$max([nothing])",
-				"$max([nothing,nada,nichts])",
+			Expression: "[$, $reverse($), $]",
+			Output: []interface{}{
+				[]interface{}{
+					1,
+					2,
+					3,
+				},
+				[]interface{}{
+					3,
+					2,
+					1,
+				},
+				[]interface{}{
+					1,
+					2,
+					3,
+				},
 			},
-			Error: ErrUndefined,
+			Skip: true, // sub-arrays are wrapped in extra brackets
 		},
 	})
 }
 
-func TestFuncMax2(t *testing.T) {
+func TestFuncSort(t *testing.T) {
 
-	runTestCases(t, testdata.account, []*testCase{
-		{
-			Expression: "$max(Account.Order.Product.(Price * Quantity))",
-			Output:     137.8,
-		},
+	runTestCases(t, nil, []*testCase{
 		{
-			Expression: "$max(Account.Order.Product.(Price * Quantity))",
-			Output:     137.8,
+			Expression: "$sort(nothing)",
+			Error:      ErrUndefined,
 		},
 		{
-			Expression: "Account.Order.$max(Product.(Price * Quantity))",
+			Expression: []string{
+				"$sort(1)",
+				"$sort([1])",
+			},
 			Output: []interface{}{
-				68.9,
-				137.8,
+				float64(1),
 			},
 		},
-	})
-}
-
-func TestFuncMin(t *testing.T) {
-
-	runTestCases(t, nil, []*testCase{
 		{
-			Expression: []string{
-				"$min(1)",
-				"$min([1,2,3])",
-				"$min([1..3])",
-				"$min([1..3,nothing])",
+			Expression: "$sort([1,3,2])",
+			Output: []interface{}{
+				float64(1),
+				float64(2),
+				float64(3),
 			},
-			Output: float64(1),
 		},
 		{
-			Expression: []string{
-				"$min(-5)",
-				"$min([-1,-2,-3,-4,-5])",
-				"$min([-5..0])",
-				"$min([-5,nothing])",
+			Expression: "$sort([1,3,22,11])",
+			Output: []interface{}{
+				float64(1),
+				float64(3),
+				float64(11),
+				float64(22),
 			},
-			Output: float64(-5),
 		},
 		{
-			Expression: []string{
-				`$min("")`,
-				`$min(true)`,
-				`$min({"one":1})`,
+			// Sorting with a comparator is stable.
+			Expression: `$sort([
+				{"key": 2, "id": "a"},
+				{"key": 1, "id": "b"},
+				{"key": 2, "id": "c"},
+				{"key": 1, "id": "d"},
+				{"key": 2, "id": "e"},
+				{"key": 1, "id": "f"}
+			], function($l, $r) { $l.key > $r.key }).id`,
+			Output: []interface{}{
+				"b",
+				"d",
+				"f",
+				"a",
+				"c",
+				"e",
 			},
-			Error: fmt.Errorf("cannot call min on a non-array type"), // TODO: Don't rely on error strings
 		},
 		{
-			Expression: []string{
-				`$min(["1","2","3"])`,
-				`$min(["1","2",3])`,
+			// An undefined result does not swap items.
+			Expression: `$sort([3, 1, 2], function($l, $r) { $l.missing })`,
+			Output: []interface{}{
+				float64(3),
+				float64(1),
+				float64(2),
 			},
-			Error: fmt.Errorf("cannot call min on an array with non-number types"), // TODO: Don't rely on error strings
 		},
 		{
-			Expression: "$min()",
-			Error: &ArgCountError{
-				Func:     "min",
-				Expected: 1,
-				Received: 0,
-			},
+			// Errors from the comparator stop the sort.
+			Expression: `$sort(["1", "abc", "2"], function($l, $r) { $number($l) > $number($r) })`,
+			Error:      jlib.NewArgValueError("number", 0, "D3030", `unable to cast "abc" to a number`),
 		},
 		{
-			Expression: "$min([],[])",
-			Error: &ArgCountError{
-				Func:     "min",
-				Expected: 1,
-				Received: 2,
+			Expression: `$sort([1, 2], function($l, $r) { $fail($l) })`,
+			Exts: map[string]Extension{
+				"fail": {
+					Func: func(v interface{}) (bool, error) {
+						return false, errors.New("comparison failed")
+					},
+				},
 			},
-		},
-		{
-			Expression: "$min(1,2,3)",
-			Error: &ArgCountError{
-				Func:     "min",
-				Expected: 1,
-				Received: 3,
+			Error: &ExtensionError{
+				Func:     "fail",
+				Position: 33,
+				Err:      errors.New("comparison failed"),
 			},
 		},
 		{
-			Expression: []string{
-				"$min([])",
-				"$min(nothing)",
-				"$min([nothing,nada,now't])",
-			},
-			Error: ErrUndefined,
+			Expression: `$sort([1, 2], function($l, $r) { "yes" })`,
+			Error:      jlib.NewArgValueError("sort", 2, "T0410", "must be a function that returns a boolean, got yes (string)"),
 		},
 	})
 }
 
-func TestFuncMin2(t *testing.T) {
+func TestFuncSort2(t *testing.T) {
 
 	runTestCases(t, testdata.account, []*testCase{
 		{
-			Expression: "$min(Account.Order.Product.(Price * Quantity))",
-			Output:     21.67,
-		},
-		{
-			Expression: "Account.Order.$min(Product.(Price * Quantity))",
+			Expression: "$sort(Account.Order.Product.Price)",
 			Output: []interface{}{
 				21.67,
+				34.45,
+				34.45,
 				107.99,
 			},
 		},
 		{
-			Expression: `Account.Order.(OrderID & ": " & $min(Product.(Price*Quantity)))`,
+			Expression: "$sort(Account.Order.Product.`Product Name`)",
 			Output: []interface{}{
-				"order103: 21.67",
-				"order104: 107.99",
+				"Bowler Hat",
+				"Bowler Hat",
+				"Cloak",
+				"Trilby hat",
+			},
+		},
+		{
+			Expression: `$sort(Account.Order.Product, function($a, $b) { $a.(Price * Quantity) > $b.(Price * Quantity) }).(Price & " x " & Quantity)`,
+			Output: []interface{}{
+				"21.67 x 1",
+				"34.45 x 2",
+				"107.99 x 1",
+				"34.45 x 4",
+			},
+		},
+		{
+			Expression: `$sort(Account.Order.Product, function($a, $b) { $a.Price > $b.Price }).SKU`,
+			Output: []interface{}{
+				"0406634348",
+				"0406654608",
+				"040657863",
+				"0406654603",
+			},
+		},
+		{
+			Expression: `
+				(Account.Order.Product
+					~> $sort(λ($a,$b){$a.Quantity < $b.Quantity})
+					~> $sort(λ($a,$b){$a.Price > $b.Price})
+				).SKU`,
+			Output: []interface{}{
+				"0406634348",
+				"040657863",
+				"0406654608",
+				"0406654603",
 			},
 		},
+		{
+			Expression: "$sort(Account.Order.Product)",
+			Error:      jlib.NewArgValueError("sort", 1, "D3070", "must be an array of strings or numbers"),
+		},
 	})
 }
 
-func TestFuncAverage(t *testing.T) {
+func TestFuncSort3(t *testing.T) {
 
-	runTestCases(t, nil, []*testCase{
+	data := []interface{}{1, 3, 2}
+
+	runTestCases(t, data, []*testCase{
 		{
-			Expression: "$average(1)",
-			Output:     float64(1),
+			Expression: "[[$], [$sort($)], [$]]",
+			Output: []interface{}{
+				[]float64{
+					1,
+					3,
+					2,
+				},
+				[]float64{
+					1,
+					2,
+					3,
+				},
+				[]float64{
+					1,
+					3,
+					2,
+				},
+			},
+			Skip: true, // inner arrays are wrapped in extra brackets
 		},
+	})
+}
+
+func TestFuncShuffle(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
 		{
 			Expression: []string{
-				"$average(2)",
-				"$average([1,2,3])",
-				"$average([1..3])",
-				"$average([1..3,nothing])",
+				"$shuffle([])",
+				"$shuffle([nothing])",
 			},
-			Output: float64(2),
+			Output: []interface{}{},
 		},
 		{
 			Expression: []string{
-				`$average("")`,
-				`$average(true)`,
-				`$average({"one":1})`,
+				"$shuffle(1)",
+				"$shuffle([1])",
+			},
+			Output: []interface{}{
+				float64(1),
 			},
-			Error: fmt.Errorf("cannot call average on a non-array type"), // TODO: Don't rely on the error string
 		},
 		{
-			Expression: []string{
-				`$average(["1","2","3"])`,
-				`$average(["1","2",3])`,
+			Expression: "$count($shuffle([1..10]))",
+			Output:     10,
+		},
+		{
+			Expression: "$sort($shuffle([1..10]))",
+			Output: []interface{}{
+				float64(1),
+				float64(2),
+				float64(3),
+				float64(4),
+				float64(5),
+				float64(6),
+				float64(7),
+				float64(8),
+				float64(9),
+				float64(10),
 			},
-			Error: fmt.Errorf("cannot call average on an array with non-number types"), // TODO: Don't rely on the error string
 		},
 		{
-			Expression: "$average()",
+			Expression: "$shuffle(nothing)",
+			Error:      ErrUndefined,
+		},
+		{
+			Expression: "$shuffle()",
 			Error: &ArgCountError{
-				Func:     "average",
+				Func:     "shuffle",
 				Expected: 1,
 				Received: 0,
 			},
 		},
 		{
-			Expression: "$average([],[])",
+			Expression: "$shuffle([],[])",
 			Error: &ArgCountError{
-				Func:     "average",
+				Func:     "shuffle",
 				Expected: 1,
 				Received: 2,
 			},
 		},
 		{
-			Expression: "$average(1,2,3)",
+			Expression: "$shuffle(1,2,3)",
 			Error: &ArgCountError{
-				Func:     "average",
+				Func:     "shuffle",
 				Expected: 1,
 				Received: 3,
 			},
 		},
-		{
-			Expression: []string{
-				"$average([])",
-				"$average(nothing)",
-				"$average([nothing,nada,now't])"},
-			Error: ErrUndefined,
-		},
 	})
 }
 
-func TestFuncAverage2(t *testing.T) {
+func TestFuncShuffle2(t *testing.T) {
 
-	runTestCases(t, testdata.account, []*testCase{
-		{
-			Expression: "$average(Account.Order.Product.(Price * Quantity))",
-			Output:     84.09,
-		},
+	// TODO: These tests don't actually verify that the values
+	// have been shuffled.
+	runTestCasesFunc(t, equalArraysUnordered, nil, []*testCase{
 		{
-			Expression: "Account.Order.$average(Product.(Price * Quantity))",
-			Output: []interface{}{
-				45.285000000000004,
-				122.89500000000001,
+			Expression: []string{
+				"$shuffle([1..10])",
+				"$shuffle($reverse([1..10]))",
 			},
-		},
-		{
-			Expression: `Account.Order.(OrderID & ": " & $average(Product.(Price*Quantity)))`,
-			Output: []interface{}{
-				// TODO: Why does jsonata-js only display to 3dp?
-				"order103: 45.285000000000004",
-				"order104: 122.89500000000001",
-			},
-		},
-	})
-}
-
-func TestFuncSpread(t *testing.T) {
-
-	runTestCases(t, nil, []*testCase{
-		{
-			Expression: `$spread("Hello World")`,
-			Output:     "Hello World",
-		},
-		{
-			Expression: `$spread([1,2,3])`,
 			Output: []interface{}{
 				float64(1),
 				float64(2),
 				float64(3),
+				float64(4),
+				float64(5),
+				float64(6),
+				float64(7),
+				float64(8),
+				float64(9),
+				float64(10),
 			},
 		},
 		{
-			Expression: `$string($spread(function($x){$x*$x}))`,
-			Output:     "",
-		},
-		{
-			Expression: "$spread(nothing)",
-			Error:      ErrUndefined,
+			Expression: `$shuffle([true,-0.5,"hello",[1,2,3],{"one":1}])`,
+			Output: []interface{}{
+				true,
+				-0.5,
+				"hello",
+				[]interface{}{
+					float64(1),
+					float64(2),
+					float64(3),
+				},
+				map[string]interface{}{
+					"one": float64(1),
+				},
+			},
 		},
 	})
 }
 
-func TestFuncSpread2(t *testing.T) {
-
-	data := []map[string]interface{}{
-		{
-			"one": 1,
-		},
-		{
-			"two": 2,
-		},
-		{
-			"three": 3,
-		},
-	}
+func TestFuncZip(t *testing.T) {
 
-	runTestCases(t, data, []*testCase{
+	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `$spread($[0])`,
+			Expression: []string{
+				`$zip(1,2,3)`,
+				`$zip(1,2,[3])`,
+				`$zip([1],[2],[3])`,
+				`$zip([1],[2,3],[3,4,5])`,
+			},
 			Output: []interface{}{
-				map[string]interface{}{
-					"one": 1,
+				[]interface{}{
+					float64(1),
+					float64(2),
+					float64(3),
 				},
 			},
 		},
 		{
-			Expression: `$spread($)`,
+			Expression: `$zip([1,2,3])`,
 			Output: []interface{}{
-				map[string]interface{}{
-					"one": 1,
+				[]interface{}{
+					float64(1),
 				},
-				map[string]interface{}{
-					"two": 2,
+				[]interface{}{
+					float64(2),
 				},
-				map[string]interface{}{
-					"three": 3,
+				[]interface{}{
+					float64(3),
 				},
 			},
 		},
-	})
-}
-
-func TestFuncSpread3(t *testing.T) {
-
-	runTestCasesFunc(t, equalArraysUnordered, testdata.account, []*testCase{
 		{
-			Expression: "$spread((Account.Order.Product.Description))",
+			Expression: `$zip([1,2,3],["one","two","three"])`,
 			Output: []interface{}{
-				map[string]interface{}{
-					"Colour": "Purple",
-				},
-				map[string]interface{}{
-					"Width": float64(300),
-				},
-				map[string]interface{}{
-					"Height": float64(200),
-				},
-				map[string]interface{}{
-					"Depth": float64(210),
-				},
-				map[string]interface{}{
-					"Weight": 0.75,
-				},
-				map[string]interface{}{
-					"Colour": "Orange",
-				},
-				map[string]interface{}{
-					"Width": float64(300),
-				},
-				map[string]interface{}{
-					"Height": float64(200),
-				},
-				map[string]interface{}{
-					"Depth": float64(210),
-				},
-				map[string]interface{}{
-					"Weight": 0.6,
-				},
-				map[string]interface{}{
-					"Colour": "Purple",
-				},
-				map[string]interface{}{
-					"Width": float64(300),
-				},
-				map[string]interface{}{
-					"Height": float64(200),
+				[]interface{}{
+					float64(1),
+					"one",
 				},
-				map[string]interface{}{
-					"Depth": float64(210),
+				[]interface{}{
+					float64(2),
+					"two",
 				},
-				map[string]interface{}{
-					"Weight": 0.75,
+				[]interface{}{
+					float64(3),
+					"three",
 				},
-				map[string]interface{}{
-					"Colour": "Black",
+			},
+		},
+		{
+			Expression: `$zip([1,2,3],["one","two","three"],[true,false,true])`,
+			Output: []interface{}{
+				[]interface{}{
+					float64(1),
+					"one",
+					true,
 				},
-				map[string]interface{}{
-					"Width": float64(30),
+				[]interface{}{
+					float64(2),
+					"two",
+					false,
 				},
-				map[string]interface{}{
-					"Height": float64(20),
+				[]interface{}{
+					float64(3),
+					"three",
+					true,
 				},
-				map[string]interface{}{
-					"Depth": float64(210),
+			},
+		},
+		{
+			Expression: `$zip([1,2,3],["one","two"],[true,false,true])`,
+			Output: []interface{}{
+				[]interface{}{
+					float64(1),
+					"one",
+					true,
 				},
-				map[string]interface{}{
-					"Weight": float64(2),
+				[]interface{}{
+					float64(2),
+					"two",
+					false,
 				},
 			},
 		},
+		{
+			Expression: []string{
+				`$zip(nothing)`,
+				`$zip(nothing,nada,now't)`,
+				`$zip(1,2,3,nothing)`,
+				`$zip([1,2,3],nothing)`,
+				`$zip([1,2,3],[nothing])`,
+				`$zip([1,2,3],[nothing,nada,now't])`,
+			},
+			Output: []interface{}{},
+		},
+		{
+			Expression: `$zip()`,
+			Error: &ArgCountError{
+				Func:     "zip",
+				Expected: 1,
+				Received: 0,
+			},
+		},
 	})
 }
 
-/*
-func TestFuncSpread4(t *testing.T) {
-
-	t.SkipNow()
+func TestFuncSum(t *testing.T) {
 
-	data := []struct {
-		Int        int
-		Bool       bool
-		String     string
-		Interface  interface{}
-		unexported bool
-	}{
+	runTestCases(t, nil, []*testCase{
 		{
-			Int:    1,
-			Bool:   true,
-			String: "string",
+			Expression: []string{
+				"$sum(0)",
+				"$sum([])",
+				"$sum([0])",
+				"$sum([nothing])",
+				"$sum([0,nothing])",
+			},
+			Output: float64(0),
 		},
 		{
-			Int:    0,
-			Bool:   false,
-			String: "",
+			Expression: "$sum(1)",
+			Output:     float64(1),
 		},
-	}
-
-	runTestCases(t, data, []*testCase{
 		{
-			Expression: `$spread($[0])`,
-			Output: []interface{}{
-				map[string]interface{}{
-					"Int": 1,
-				},
-				map[string]interface{}{
-					"Bool": true,
-				},
-				map[string]interface{}{
-					"String": "string",
-				},
-				map[string]interface{}{
-					"Interface": nil,
-				},
+			Expression: []string{
+				"$sum(15)",
+				"$sum([1..5])",
+				"$sum([1..5])",
+				"$sum([1..4,5])",
+				"$sum([1,2,3,4,5])",
+				"$sum([1,2,3,4,nothing,nada,5])",
 			},
+			Output: float64(15),
 		},
 		{
-			Expression: `$spread($[1])`,
-			Output: []interface{}{
-				map[string]interface{}{
-					"Int": 0,
-				},
-				map[string]interface{}{
-					"Bool": false,
-				},
-				map[string]interface{}{
-					"String": "",
-				},
-				map[string]interface{}{
-					"Interface": nil,
-				},
-			},
-		},
-		{
-			Expression: `$spread($)`,
-			Output: []interface{}{
-				map[string]interface{}{
-					"Int": 1,
-				},
-				map[string]interface{}{
-					"Bool": true,
-				},
-				map[string]interface{}{
-					"String": "string",
-				},
-				map[string]interface{}{
-					"Interface": nil,
-				},
-				map[string]interface{}{
-					"Int": 0,
-				},
-				map[string]interface{}{
-					"Bool": false,
-				},
-				map[string]interface{}{
-					"String": "",
-				},
-				map[string]interface{}{
-					"Interface": nil,
-				},
+			Expression: []string{
+				`$sum("")`,
+				"$sum(true)",
+				`$sum({"one":1})`,
 			},
-		},
-	})
-}
-*/
-
-func TestFuncMerge(t *testing.T) {
-
-	runTestCases(t, nil, []*testCase{
-		{
-			Expression: `$merge({"a":1})`,
-			Output: map[string]interface{}{
-				"a": float64(1),
+			Error: &ArgTypeError{
+				Func:    "sum",
+				Which:   1,
+				ArrayOf: "numbers",
 			},
 		},
 		{
-			Expression: `$merge([{"a":1}, {"b":2}])`,
-			Output: map[string]interface{}{
-				"a": float64(1),
-				"b": float64(2),
+			Expression: []string{
+				`$sum([1,2,"3"])`,
+				"$sum([1,2,true])",
 			},
-		},
-		{
-			Expression: `$merge([{"a": 1}, {"b": 2, "c": 3}])`,
-			Output: map[string]interface{}{
-				"a": float64(1),
-				"b": float64(2),
-				"c": float64(3),
+			Error: &ArgTypeError{
+				Func:    "sum",
+				Which:   1,
+				ArrayOf: "numbers",
 			},
 		},
 		{
-			Expression: `$merge([{"a": 1}, {"b": 2, "a": 3}])`,
-			Output: map[string]interface{}{
-				"a": float64(3),
-				"b": float64(2),
+			Expression: "$sum()",
+			Error: &ArgCountError{
+				Func:     "sum",
+				Expected: 1,
+				Received: 0,
 			},
 		},
 		{
-			Expression: []string{
-				`$merge([])`,
-				`$merge({})`,
+			Expression: "$sum(1,2)",
+			Error: &ArgCountError{
+				Func:     "sum",
+				Expected: 1,
+				Received: 2,
 			},
-			Output: map[string]interface{}{},
 		},
 		{
-			Expression: `$merge(nothing)`,
+			Expression: "$sum(nothing)",
 			Error:      ErrUndefined,
 		},
 	})
 }
 
-func TestFuncEach(t *testing.T) {
+func TestFuncSum2(t *testing.T) {
 
-	runTestCasesFunc(t, equalArraysUnordered, testdata.address, []*testCase{
+	runTestCases(t, testdata.account, []*testCase{
 		{
-			Expression: `$each(Address, λ($v, $k) {$k & ": " & $v})`,
+			Expression: "$sum(Account.Order.Product.(Price * Quantity))",
+			Output:     336.36,
+		},
+		{
+			Expression: "Account.Order.$sum(Product.(Price * Quantity))",
 			Output: []interface{}{
-				"Street: Hursley Park",
-				"City: Winchester",
-				"Postcode: SO21 2JN",
+				90.57000000000001,
+				245.79000000000002,
+			},
+		},
+		{
+			Expression: `Account.Order.(OrderID & ": " & $sum(Product.(Price*Quantity)))`,
+			Output: []interface{}{
+				"order103: 90.57",
+				"order104: 245.79",
+			},
+		},
+		{
+			Expression: "$sum(Account.Order)",
+			Error: &ArgTypeError{
+				Func:    "sum",
+				Which:   1,
+				ArrayOf: "numbers",
 			},
 		},
 	})
 }
 
-func TestFuncMap(t *testing.T) {
+func TestFuncMax(t *testing.T) {
 
 	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `$map([1,2,3], $string)`,
-			Output: []interface{}{
-				"1",
-				"2",
-				"3",
+			Expression: []string{
+				"$max(1)",
+				"$max([1,0])",
+				"$max([1,0,-1.5])",
 			},
+			Output: float64(1),
 		},
 		{
-			Expression: `$map([1,4,9,16], $squareroot)`,
-			Exts: map[string]Extension{
-				"squareroot": {
-					Func: func(x float64) float64 {
-						return math.Sqrt(x)
-					},
-				},
+			Expression: []string{
+				"$max(-1)",
+				"$max([-1,-5])",
+				"$max([-1,-5,nothing])",
 			},
-			Output: []interface{}{
-				float64(1),
-				float64(2),
-				float64(3),
-				float64(4),
+			Output: float64(-1),
+		},
+		{
+			Expression: []string{
+				"$max(3)",
+				"$max([1,2,3])",
+				"$max([1..3])",
+				"$max([1..3,nothing])",
 			},
+			Output: float64(3),
 		},
 		{
-			Expression: `
-				(
-					$data := {
-						"one": [1,2,3,4,5],
-						"two": [5,4,3,2,1]
-					};
-					$add := function($x){$x*$x};
-					$map($data.one, $add)
-				)`,
-			Output: []interface{}{
-				float64(1),
-				float64(4),
-				float64(9),
-				float64(16),
-				float64(25),
+			Expression: []string{
+				`$max("")`,
+				`$max(true)`,
+				`$max({"one":1})`,
+			},
+			Error: &ArgTypeError{
+				Func:    "max",
+				Which:   1,
+				ArrayOf: "numbers",
 			},
 		},
 		{
-			Expression: "$map($string)",
+			Expression: []string{
+				`$max(["1","2","3"])`,
+				`$max(["1","2",3])`,
+			},
+			Error: &ArgTypeError{
+				Func:    "max",
+				Which:   1,
+				ArrayOf: "numbers",
+			},
+		},
+		{
+			Expression: "$max()",
 			Error: &ArgCountError{
-				Func:     "map",
-				Expected: 2,
-				Received: 1,
+				Func:     "max",
+				Expected: 1,
+				Received: 0,
 			},
 		},
-	})
-}
-
-func TestFuncMap2(t *testing.T) {
-
-	runTestCases(t, testdata.account, []*testCase{
 		{
-			Expression: `Account.Order.Product ~> $map(λ($prod, $index) { $index+1 & ": " & $prod.` + "`Product Name`" + ` })`,
-			Output: []interface{}{
-				"1: Bowler Hat",
-				"2: Trilby hat",
-				"3: Bowler Hat",
-				"4: Cloak",
+			Expression: "$max([],[])",
+			Error: &ArgCountError{
+				Func:     "max",
+				Expected: 1,
+				Received: 2,
 			},
 		},
 		{
-			Expression: `Account.Order.Product ~> $map(λ($prod, $index, $arr) { $index+1 & "/" & $count($arr) & ": " & $prod.` + "`Product Name`" + ` })`,
-			Output: []interface{}{
-				"1/4: Bowler Hat",
-				"2/4: Trilby hat",
-				"3/4: Bowler Hat",
-				"4/4: Cloak",
+			Expression: "$max(1,2,3)",
+			Error: &ArgCountError{
+				Func:     "max",
+				Expected: 1,
+				Received: 3,
 			},
 		},
 		{
-			Expression: `$map(Phone, function($v, $i) {$v.type="office" ? $i: null})`,
-			Error:      ErrUndefined,
+			Expression: []string{
+				"$max(nothing)",
+				"$max([])",
+				"$max([nothing])",
+				"$max([nothing,nada,nichts])",
+			},
+			Error: ErrUndefined,
 		},
 	})
 }
 
-func TestFuncMap3(t *testing.T) {
+func TestFuncMax2(t *testing.T) {
 
-	runTestCases(t, testdata.address, []*testCase{
+	runTestCases(t, testdata.account, []*testCase{
 		{
-			Expression: []string{
-				`$map(Phone, function($v, $i) {$i[$v.type="office"]})`,
-				`$map(Phone, function($v, $i) {$v.type="office" ? $i})`,
-			},
-			Output: []interface{}{
-				1,
-				2,
-			},
+			Expression: "$max(Account.Order.Product.(Price * Quantity))",
+			Output:     137.8,
 		},
 		{
-			Expression: `$map(Phone, function($v, $i) {$v.type="office" ? $i: null})`,
+			Expression: "$max(Account.Order.Product.(Price * Quantity))",
+			Output:     137.8,
+		},
+		{
+			Expression: "Account.Order.$max(Product.(Price * Quantity))",
 			Output: []interface{}{
-				nil,
-				1,
-				2,
-				nil,
+				68.9,
+				137.8,
 			},
-			Skip: true, // works with non-null else value. Returning the wrong kind of nils?
 		},
 	})
 }
 
-func TestFuncMapZip(t *testing.T) {
+func TestFuncMin(t *testing.T) {
 
 	runTestCases(t, nil, []*testCase{
 		{
 			Expression: []string{
-				`(
-					$data := {
-						"one": [1,2,3,4,5],
-						"two": [5,4,3,2,1]
-					};
-					$map($zip($data.one, $data.two), $sum)
-				)`,
-				`(
-					$data := {
-						"one": [1,2,3,4,5],
-						"two": [5,4,3,2,1]
-					};
-					$data.$zip(one, two) ~> $map($sum)
-				)`,
+				"$min(1)",
+				"$min([1,2,3])",
+				"$min([1..3])",
+				"$min([1..3,nothing])",
 			},
-			Output: []interface{}{
-				float64(6),
-				float64(6),
-				float64(6),
-				float64(6),
-				float64(6),
+			Output: float64(1),
+		},
+		{
+			Expression: []string{
+				"$min(-5)",
+				"$min([-1,-2,-3,-4,-5])",
+				"$min([-5..0])",
+				"$min([-5,nothing])",
 			},
+			Output: float64(-5),
 		},
 		{
 			Expression: []string{
-				`(
-					$data := {
-						"one": [1],
-						"two": [5]
-					};
-					$data[].$zip(one, two) ~> $map($sum)
-				)`,
-				`(
-					$data := {
-						"one": 1,
-						"two": 5
-					};
-					$data[].$zip(one, two) ~> $map($sum)
-				)`,
+				`$min("")`,
+				`$min(true)`,
+				`$min({"one":1})`,
 			},
-			Output: []interface{}{
-				float64(6),
+			Error: &ArgTypeError{
+				Func:    "min",
+				Which:   1,
+				ArrayOf: "numbers",
 			},
 		},
-	})
-}
-
-func TestFuncFilter(t *testing.T) {
-
-	runTestCases(t, testdata.library, []*testCase{
 		{
-			Expression: `$filter([1..10], function($v) {$v % 2})`,
-			Output: []interface{}{
-				float64(1),
-				float64(3),
-				float64(5),
-				float64(7),
-				float64(9),
+			Expression: []string{
+				`$min(["1","2","3"])`,
+				`$min(["1","2",3])`,
+			},
+			Error: &ArgTypeError{
+				Func:    "min",
+				Which:   1,
+				ArrayOf: "numbers",
+			},
+		},
+		{
+			Expression: "$min()",
+			Error: &ArgCountError{
+				Func:     "min",
+				Expected: 1,
+				Received: 0,
+			},
+		},
+		{
+			Expression: "$min([],[])",
+			Error: &ArgCountError{
+				Func:     "min",
+				Expected: 1,
+				Received: 2,
+			},
+		},
+		{
+			Expression: "$min(1,2,3)",
+			Error: &ArgCountError{
+				Func:     "min",
+				Expected: 1,
+				Received: 3,
 			},
 		},
+		{
+			Expression: []string{
+				"$min([])",
+				"$min(nothing)",
+				"$min([nothing,nada,now't])",
+			},
+			Error: ErrUndefined,
+		},
 	})
 }
 
-func TestFuncFilter2(t *testing.T) {
+func TestFuncMin2(t *testing.T) {
 
-	runTestCases(t, testdata.library, []*testCase{
+	runTestCases(t, testdata.account, []*testCase{
 		{
-			Expression: `(library.books~>$filter(λ($v, $i, $a) {$v.price = $max($a.price)})).isbn`,
-			Output:     "9780262510875",
+			Expression: "$min(Account.Order.Product.(Price * Quantity))",
+			Output:     21.67,
 		},
 		{
-			Expression: `(nothing~>$filter(λ($v, $i, $a) {$v.price = $max($a.price)})).isbn`,
-			Error:      ErrUndefined,
+			Expression: "Account.Order.$min(Product.(Price * Quantity))",
+			Output: []interface{}{
+				21.67,
+				107.99,
+			},
+		},
+		{
+			Expression: `Account.Order.(OrderID & ": " & $min(Product.(Price*Quantity)))`,
+			Output: []interface{}{
+				"order103: 21.67",
+				"order104: 107.99",
+			},
 		},
 	})
 }
 
-func TestFuncReduce(t *testing.T) {
+func TestFuncAverage(t *testing.T) {
 
 	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `
-				(
-					$seq := [1,2,3,4,5];
-					$reduce($seq, function($x, $y){$x+$y})
-				)`,
-			Output: float64(15),
+			Expression: "$average(1)",
+			Output:     float64(1),
 		},
 		{
-			Expression: `
-				(
-					$concat := function($s){function($a, $b){$string($a) & $s & $string($b)}};
-					$comma_join := $concat(' ... ');
-					$reduce([1,2,3,4,5], $comma_join)
-				)`,
-			Output: "1 ... 2 ... 3 ... 4 ... 5",
+			Expression: []string{
+				"$average(2)",
+				"$average([1,2,3])",
+				"$average([1..3])",
+				"$average([1..3,nothing])",
+			},
+			Output: float64(2),
 		},
 		{
-			Expression: `
-				(
-					$seq := [1,2,3,4,5];
-					$reduce($seq, function($x, $y){$x+$y}, 2)
-				)`,
-			Output: float64(17),
+			Expression: []string{
+				`$average("")`,
+				`$average(true)`,
+				`$average({"one":1})`,
+			},
+			Error: &ArgTypeError{
+				Func:    "average",
+				Which:   1,
+				ArrayOf: "numbers",
+			},
 		},
 		{
-			Expression: `
-				(
-					$seq := 1;
-					$reduce($seq, function($x, $y){$x+$y})
-				)`,
-			Output: float64(1),
+			Expression: []string{
+				`$average(["1","2","3"])`,
+				`$average(["1","2",3])`,
+			},
+			Error: &ArgTypeError{
+				Func:    "average",
+				Which:   1,
+				ArrayOf: "numbers",
+			},
 		},
 		{
-			Expression: `
-				(
-					$product := function($a, $b) { $a * $b };
-					$power := function($x, $n) { $n = 0 ? 1 : $reduce([1..$n].($x), $product) };
-					[0..5].$power(2, $)
-				)`,
-			Output: []interface{}{
-				float64(1),
-				float64(2),
-				float64(4),
-				float64(8),
-				float64(16),
-				float64(32),
+			Expression: "$average()",
+			Error: &ArgCountError{
+				Func:     "average",
+				Expected: 1,
+				Received: 0,
 			},
 		},
 		{
-			Expression: `
-				(
-					$seq := 1;
-					$reduce($seq, function($x){$x})
-				)`,
-			Error: fmt.Errorf("second argument of function \"reduce\" must be a function that takes two arguments"),
+			Expression: "$average([],[])",
+			Error: &ArgCountError{
+				Func:     "average",
+				Expected: 1,
+				Received: 2,
+			},
+		},
+		{
+			Expression: "$average(1,2,3)",
+			Error: &ArgCountError{
+				Func:     "average",
+				Expected: 1,
+				Received: 3,
+			},
+		},
+		{
+			Expression: []string{
+				"$average([])",
+				"$average(nothing)",
+				"$average([nothing,nada,now't])"},
+			Error: ErrUndefined,
 		},
 	})
 }
 
-func TestFuncReduce2(t *testing.T) {
+func TestFuncAverage2(t *testing.T) {
 
 	runTestCases(t, testdata.account, []*testCase{
 		{
-			Expression: `$reduce(Account.Order.Product.Quantity, $append)`,
+			Expression: "$average(Account.Order.Product.(Price * Quantity))",
+			Output:     84.09,
+		},
+		{
+			Expression: "Account.Order.$average(Product.(Price * Quantity))",
 			Output: []interface{}{
-				float64(2),
-				float64(1),
-				float64(4),
-				float64(1),
+				45.285000000000004,
+				122.89500000000001,
 			},
 		},
-	})
-}
-
-func TestFuncReduce3(t *testing.T) {
-
-	runTestCases(t, testdata.address, []*testCase{
 		{
-			Expression: `$reduce(Account.Order.Product.Quantity, $append)`,
-			Error:      ErrUndefined,
+			Expression: `Account.Order.(OrderID & ": " & $average(Product.(Price*Quantity)))`,
+			Output: []interface{}{
+				"order103: 45.285",
+				"order104: 122.895",
+			},
 		},
 	})
 }
 
-func TestFuncSift(t *testing.T) {
+func TestFuncSpread(t *testing.T) {
 
 	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `
-				(
-					$data := {
-						"one": 1,
-						"two": 2,
-						"three": 3,
-						"four": 4,
-						"five": 5,
-						"six": 6,
-						"seven": 7,
-						"eight": 8,
-						"nine": 9,
-						"ten": 10
-					};
-					$sift($data, function($v){$v % 2})
-				)`,
-			Output: map[string]interface{}{
-				"one":   float64(1),
-				"three": float64(3),
-				"five":  float64(5),
-				"seven": float64(7),
-				"nine":  float64(9),
-			},
+			Expression: `$spread("Hello World")`,
+			Output:     "Hello World",
 		},
 		{
-			Expression: `
-				(
-					$data := {
-						"one": 1,
-						"two": 2,
-						"three": 3,
-						"four": 4,
-						"five": 5,
-						"six": 6,
-						"seven": 7,
-						"eight": 8,
-						"nine": 9,
-						"ten": 10
-					};
-					$sift($data, function($v,$k){$contains($k,"o")})
-				)`,
-			Output: map[string]interface{}{
-				"one":  float64(1),
-				"two":  float64(2),
-				"four": float64(4),
+			Expression: `$spread([1,2,3])`,
+			Output: []interface{}{
+				float64(1),
+				float64(2),
+				float64(3),
 			},
 		},
 		{
-			Expression: `
-				(
-					$data := {
-						"one": 1,
-						"two": 2,
-						"three": 3,
-						"four": 4,
-						"five": 5,
-						"six": 6,
-						"seven": 7,
-						"eight": 8,
-						"nine": 9,
-						"ten": 10
-					};
-					$sift($data, function($v,$k){$length($k) >= $v})
-				)`,
-			Output: map[string]interface{}{
-				"one":   float64(1),
-				"two":   float64(2),
-				"three": float64(3),
-				"four":  float64(4),
-			},
+			Expression: `$string($spread(function($x){$x*$x}))`,
+			Output:     "",
+		},
+		{
+			Expression: "$spread(nothing)",
+			Error:      ErrUndefined,
 		},
 	})
 }
 
-func TestFuncSift2(t *testing.T) {
+func TestFuncSpread2(t *testing.T) {
 
-	runTestCases(t, testdata.address, []*testCase{
+	data := []map[string]interface{}{
 		{
-			Expression: `$sift(λ($v){$v.**.Postcode})`,
-			Output: map[string]interface{}{
-				"Address": map[string]interface{}{
-					"Street":   "Hursley Park",
-					"City":     "Winchester",
-					"Postcode": "SO21 2JN",
-				},
-				"Other": map[string]interface{}{
-					"Over 18 ?": true,
-					"Misc":      nil,
-					"Alternative.Address": map[string]interface{}{
-						"Street":   "Brick Lane",
-						"City":     "London",
-						"Postcode": "E1 6RF",
-					},
+			"one": 1,
+		},
+		{
+			"two": 2,
+		},
+		{
+			"three": 3,
+		},
+	}
+
+	runTestCases(t, data, []*testCase{
+		{
+			Expression: `$spread($[0])`,
+			Output: []interface{}{
+				map[string]interface{}{
+					"one": 1,
 				},
 			},
 		},
 		{
-			Expression: `**[*].$sift(λ($v){$v.Postcode})`,
+			Expression: `$spread($)`,
 			Output: []interface{}{
 				map[string]interface{}{
-					"Address": map[string]interface{}{
-						"Street":   "Hursley Park",
-						"City":     "Winchester",
-						"Postcode": "SO21 2JN",
-					},
+					"one": 1,
 				},
 				map[string]interface{}{
-					"Alternative.Address": map[string]interface{}{
-						"Street":   "Brick Lane",
-						"City":     "London",
-						"Postcode": "E1 6RF",
-					},
+					"two": 2,
 				},
-			},
-		},
-		{
-			Expression: []string{
-				`$sift(λ($v, $k){$match($k, /^A/)})`,
-				`$sift(λ($v, $k){$k ~> /^A/})`,
-			},
-			Output: map[string]interface{}{
-				"Age": float64(28),
-				"Address": map[string]interface{}{
-					"Street":   "Hursley Park",
-					"City":     "Winchester",
-					"Postcode": "SO21 2JN",
+				map[string]interface{}{
+					"three": 3,
 				},
 			},
 		},
 	})
 }
 
-func TestHigherOrderFunctions(t *testing.T) {
-
-	runTestCases(t, nil, []*testCase{
-		{
-			Expression: `
-				(
-					$twice:=function($f){function($x){$f($f($x))}};
-					$add3:=function($y){$y+3};
-					$add6:=$twice($add3);
-					$add6(7)
-				)`,
-			Output: float64(13),
-		},
-		{
-			Expression: `λ($f) { λ($x) { $x($x) }( λ($g) { $f( (λ($a) {$g($g)($a)}))})}(λ($f) { λ($n) { $n < 2 ? 1 : $n * $f($n - 1) } })(6)`,
-			Output:     float64(720),
-		},
-		{
-			Expression: `λ($f) { λ($x) { $x($x) }( λ($g) { $f( (λ($a) {$g($g)($a)}))})}(λ($f) { λ($n) { $n <= 1 ? $n : $f($n-1) + $f($n-2) } })(6)`,
-			Output:     float64(8),
-		},
-	})
-}
-
-func TestClosures(t *testing.T) {
+func TestFuncSpread3(t *testing.T) {
 
-	runTestCases(t, testdata.account, []*testCase{
+	runTestCasesFunc(t, equalArraysUnordered, testdata.account, []*testCase{
 		{
-			Expression: `
-				Account.(
-					$AccName := function() { $.` + "`Account Name`" + `};
-					Order[OrderID = "order104"].Product{
-						"Account": $AccName(),
-						"SKU-" & $string(ProductID): $.` + "`Product Name`" + `
-					}
-				)`,
-			Output: map[string]interface{}{
-				"Account":    "Firefly",
-				"SKU-858383": "Bowler Hat",
-				"SKU-345664": "Cloak",
+			Expression: "$spread((Account.Order.Product.Description))",
+			Output: []interface{}{
+				map[string]interface{}{
+					"Colour": "Purple",
+				},
+				map[string]interface{}{
+					"Width": float64(300),
+				},
+				map[string]interface{}{
+					"Height": float64(200),
+				},
+				map[string]interface{}{
+					"Depth": float64(210),
+				},
+				map[string]interface{}{
+					"Weight": 0.75,
+				},
+				map[string]interface{}{
+					"Colour": "Orange",
+				},
+				map[string]interface{}{
+					"Width": float64(300),
+				},
+				map[string]interface{}{
+					"Height": float64(200),
+				},
+				map[string]interface{}{
+					"Depth": float64(210),
+				},
+				map[string]interface{}{
+					"Weight": 0.6,
+				},
+				map[string]interface{}{
+					"Colour": "Purple",
+				},
+				map[string]interface{}{
+					"Width": float64(300),
+				},
+				map[string]interface{}{
+					"Height": float64(200),
+				},
+				map[string]interface{}{
+					"Depth": float64(210),
+				},
+				map[string]interface{}{
+					"Weight": 0.75,
+				},
+				map[string]interface{}{
+					"Colour": "Black",
+				},
+				map[string]interface{}{
+					"Width": float64(30),
+				},
+				map[string]interface{}{
+					"Height": float64(20),
+				},
+				map[string]interface{}{
+					"Depth": float64(210),
+				},
+				map[string]interface{}{
+					"Weight": float64(2),
+				},
 			},
 		},
 	})
 }
 
-func TestFuncString(t *testing.T) {
+/*
+func TestFuncSpread4(t *testing.T) {
 
-	runTestCases(t, nil, []*testCase{
+	t.SkipNow()
+
+	data := []struct {
+		Int        int
+		Bool       bool
+		String     string
+		Interface  interface{}
+		unexported bool
+	}{
 		{
-			Expression: `$string(5)`,
-			Output:     "5",
+			Int:    1,
+			Bool:   true,
+			String: "string",
 		},
 		{
-			Expression: `$string(22/7)`,
-			Output:     "3.142857142857143", // TODO: jsonata-js returns "3.142857142857"
+			Int:    0,
+			Bool:   false,
+			String: "",
 		},
+	}
+
+	runTestCases(t, data, []*testCase{
 		{
-			Expression: `$string(1e100)`,
-			Output:     "1e+100",
+			Expression: `$spread($[0])`,
+			Output: []interface{}{
+				map[string]interface{}{
+					"Int": 1,
+				},
+				map[string]interface{}{
+					"Bool": true,
+				},
+				map[string]interface{}{
+					"String": "string",
+				},
+				map[string]interface{}{
+					"Interface": nil,
+				},
+			},
 		},
 		{
-			Expression: `$string(1e-100)`,
-			Output:     "1e-100",
+			Expression: `$spread($[1])`,
+			Output: []interface{}{
+				map[string]interface{}{
+					"Int": 0,
+				},
+				map[string]interface{}{
+					"Bool": false,
+				},
+				map[string]interface{}{
+					"String": "",
+				},
+				map[string]interface{}{
+					"Interface": nil,
+				},
+			},
 		},
 		{
-			Expression: `$string(1e-6)`,
-			Output:     "0.000001",
+			Expression: `$spread($)`,
+			Output: []interface{}{
+				map[string]interface{}{
+					"Int": 1,
+				},
+				map[string]interface{}{
+					"Bool": true,
+				},
+				map[string]interface{}{
+					"String": "string",
+				},
+				map[string]interface{}{
+					"Interface": nil,
+				},
+				map[string]interface{}{
+					"Int": 0,
+				},
+				map[string]interface{}{
+					"Bool": false,
+				},
+				map[string]interface{}{
+					"String": "",
+				},
+				map[string]interface{}{
+					"Interface": nil,
+				},
+			},
 		},
+	})
+}
+*/
+
+func TestFuncMerge(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `$string(1e-7)`,
-			Output:     "1e-7",
+			Expression: `$merge({"a":1})`,
+			Output: map[string]interface{}{
+				"a": float64(1),
+			},
 		},
 		{
-			Expression: `$string(1e+20)`,
-			Output:     "100000000000000000000",
+			Expression: `$merge([{"a":1}, {"b":2}])`,
+			Output: map[string]interface{}{
+				"a": float64(1),
+				"b": float64(2),
+			},
 		},
 		{
-			Expression: `$string(1e+21)`,
-			Output:     "1e+21",
+			Expression: `$merge([{"a": 1}, {"b": 2, "c": 3}])`,
+			Output: map[string]interface{}{
+				"a": float64(1),
+				"b": float64(2),
+				"c": float64(3),
+			},
 		},
 		{
-			Expression: `$string(true)`,
-			Output:     "true",
+			Expression: `$merge([{"a": 1}, {"b": 2, "a": 3}])`,
+			Output: map[string]interface{}{
+				"a": float64(3),
+				"b": float64(2),
+			},
 		},
 		{
-			Expression: `$string(false)`,
-			Output:     "false",
+			Expression: []string{
+				`$merge([])`,
+				`$merge({})`,
+			},
+			Output: map[string]interface{}{},
 		},
 		{
-			Expression: `$string(null)`,
-			Output:     "null",
+			Expression: `$merge([{"a": {"b": 1, "c": [1]}}, {"a": {"d": 2, "c": [2]}}], {"deep": true})`,
+			Output: map[string]interface{}{
+				"a": map[string]interface{}{
+					"b": float64(1),
+					"c": []interface{}{float64(2)},
+					"d": float64(2),
+				},
+			},
 		},
 		{
-			Expression: `$string(blah)`,
+			Expression: `$string($merge([{"a": {"x": 1, "y": 2}}, {"a": {"z": 3, "x": 4}}], {"deep": true}))`,
+			Output:     `{"a":{"x":4,"y":2,"z":3}}`,
+		},
+		{
+			Expression: `$merge(nothing)`,
 			Error:      ErrUndefined,
 		},
+	})
+}
+
+func TestFuncClone(t *testing.T) {
+
+	data := map[string]interface{}{
+		"product": map[string]interface{}{
+			"name":  "Widget",
+			"price": 10,
+			"tags":  []string{"new"},
+		},
+	}
+
+	runTestCases(t, data, []*testCase{
 		{
 			Expression: []string{
-				`$string($string)`,
-				`$string(/hat/)`,
-				`$string(function(){true})`,
-				`$string(function(){1})`,
+				`$clone(product) = product`,
+				`$copy(product) = product`,
+				`$deepEqual($clone(product), product)`,
+				`product.$clone() = product`,
 			},
-			Output: "",
+			Output: true,
 		},
 		{
-			Expression: `$string({"string": "hello"})`,
-			Output:     `{"string":"hello"}`,
+			// Updating the clone leaves the original untouched.
+			Expression: `(
+				$p := $clone(product) ~> |$|{"price": 20, "tags": ["sale"]}|;
+				[$p.price, product.price, $p.tags, product.tags]
+			)`,
+			Output: []interface{}{
+				float64(20),
+				10,
+				"sale",
+				"new",
+			},
 		},
 		{
-			Expression: `$string(["string", 5])`,
-			Output:     `["string",5]`,
+			Expression: `$clone("hello")`,
+			Output:     "hello",
 		},
 		{
-			Expression: `
-				$string({
-					"string": "hello",
-					"number": 78.8 / 2,
-					"null":null,
-					"boolean": false,
-					"function": $sum,
-					"lambda": function(){true},
-					"object": {
-						"str": "another",
-						"lambda2": function($n){$n}
-					},
-					"array": []
-				})`,
-			// TODO: Can we get this to print in field order like jsonata-js?
-			Output: `{"array":[],"boolean":false,"function":"","lambda":"","null":null,"number":39.4,"object":{"lambda2":"","str":"another"},"string":"hello"}`,
-			//Output: `{"string":"hello","number":39.4,"null":null,"boolean":false,"function":"","lambda":"","object":{"str":"another","lambda2":""},"array":[]}`,
+			Expression: `$clone(nothing)`,
+			Error:      ErrUndefined,
+		},
+	})
+}
+
+func TestFuncDeepEqual(t *testing.T) {
+
+	data := map[string]interface{}{
+		"target": struct {
+			ID   int      `json:"id"`
+			Tags []string `json:"tags"`
+		}{
+			ID:   2,
+			Tags: []string{"b"},
+		},
+		"items": []interface{}{
+			map[string]interface{}{
+				"id":   1,
+				"tags": []interface{}{"a"},
+			},
+			map[string]interface{}{
+				"id":   2.0,
+				"tags": []interface{}{"b"},
+			},
 		},
+	}
+
+	runTestCases(t, data, []*testCase{
 		{
-			Expression: `$string(1/0)`,
-			Error: &EvalError{
-				Type:  ErrNumberInf,
-				Value: "/",
+			Expression: []string{
+				`$deepEqual(1, 1.0)`,
+				`$deepEqual([1, {"a": [true, null]}], [1, {"a": [true, null]}])`,
+				`$deepEqual({"a": 1, "b": 2}, {"b": 2, "a": 1})`,
+				`$deepEqual(items[1], target)`,
+				`$deepEqual($string, $string)`,
 			},
+			Output: true,
 		},
 		{
-			Expression: `$string({"inf": 1/0})`,
-			Error: &EvalError{
-				Type:  ErrNumberInf,
-				Value: "/",
+			Expression: []string{
+				`$deepEqual(1, "1")`,
+				`$deepEqual([1, 2], [2, 1])`,
+				`$deepEqual({"a": 1}, {"a": 1, "b": 2})`,
+				`$deepEqual(function($x){$x}, function($x){$x})`,
+				`$deepEqual(nothing, nothing)`,
 			},
+			Output: false,
 		},
 		{
-			Expression: `$string(2,3)`,
+			Expression: `$filter(items, function($v){$deepEqual($v, $$.target)}).id`,
+			Output:     2.0,
+		},
+		{
+			Expression: `$deepEqual(1)`,
 			Error: &ArgCountError{
-				Func:     "string",
-				Expected: 1,
-				Received: 2,
+				Func:     "deepEqual",
+				Expected: 2,
+				Received: 1,
 			},
 		},
 	})
 }
 
-func TestFuncString2(t *testing.T) {
+func TestFuncEach(t *testing.T) {
 
-	runTestCases(t, testdata.account, []*testCase{
+	runTestCasesFunc(t, equalArraysUnordered, testdata.address, []*testCase{
 		{
-			Expression: `Account.Order.$string($sum(Product.(Price* Quantity)))`,
-			// TODO: jsonata-js rounds to "90.57" and "245.79"
+			Expression: `$each(Address, λ($v, $k) {$k & ": " & $v})`,
 			Output: []interface{}{
-				"90.57000000000001",
-				"245.79000000000002",
+				"Street: Hursley Park",
+				"City: Winchester",
+				"Postcode: SO21 2JN",
 			},
 		},
 	})
 }
 
-func TestFuncSubstring(t *testing.T) {
+func TestFuncMap(t *testing.T) {
 
 	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `$substring("hello world", 0, 5)`,
-			Output:     "hello",
-		},
-		{
-			Expression: []string{
-				`$substring("hello world", -5, 5)`,
-				`$substring("hello world", 6)`,
+			Expression: `$map([1,2,3], $string)`,
+			Output: []interface{}{
+				"1",
+				"2",
+				"3",
 			},
-			Output: "world",
-		},
-		{
-			Expression: `$substring("hello world", -100, 4)`,
-			Output:     "hell",
 		},
 		{
-			Expression: []string{
-				`$substring("hello world", 100)`,
-				`$substring("hello world", 100, 5)`,
-				`$substring("hello world", 0, 0)`,
-				`$substring("hello world", 0, -100)`,
-				`$substring("超明體繁", 2, 0)`,
+			Expression: `$map([1,4,9,16], $squareroot)`,
+			Exts: map[string]Extension{
+				"squareroot": {
+					Func: func(x float64) float64 {
+						return math.Sqrt(x)
+					},
+				},
+			},
+			Output: []interface{}{
+				float64(1),
+				float64(2),
+				float64(3),
+				float64(4),
 			},
-			Output: "",
 		},
 		{
-			Expression: []string{
-				`$substring("超明體繁", 2)`,
-				`$substring("超明體繁", -2)`,
-				`$substring("超明體繁", -2, 2)`,
+			Expression: `
+				(
+					$data := {
+						"one": [1,2,3,4,5],
+						"two": [5,4,3,2,1]
+					};
+					$add := function($x){$x*$x};
+					$map($data.one, $add)
+				)`,
+			Output: []interface{}{
+				float64(1),
+				float64(4),
+				float64(9),
+				float64(16),
+				float64(25),
 			},
-			Output: "體繁",
 		},
 		{
-			Expression: `$substring(nothing, 6)`,
-			Error:      ErrUndefined,
+			Expression: "$map($string)",
+			Error: &ArgCountError{
+				Func:     "map",
+				Expected: 2,
+				Received: 1,
+			},
 		},
 	})
 }
 
-func TestFuncSubstringBefore(t *testing.T) {
+func TestFuncMap2(t *testing.T) {
 
-	runTestCases(t, nil, []*testCase{
-		{
-			Expression: `$substringBefore("Hello World", " ")`,
-			Output:     "Hello",
-		},
-		{
-			Expression: `$substringBefore("Hello World", "l")`,
-			Output:     "He",
-		},
-		{
-			Expression: `$substringBefore("Hello World", "f")`,
-			Output:     "Hello World",
-		},
-		{
-			Expression: `$substringBefore("Hello World", "He")`,
-			Output:     "",
-		},
+	runTestCases(t, testdata.account, []*testCase{
 		{
-			Expression: `$substringBefore("Hello World", "")`,
-			Output:     "",
+			Expression: `Account.Order.Product ~> $map(λ($prod, $index) { $index+1 & ": " & $prod.` + "`Product Name`" + ` })`,
+			Output: []interface{}{
+				"1: Bowler Hat",
+				"2: Trilby hat",
+				"3: Bowler Hat",
+				"4: Cloak",
+			},
 		},
 		{
-			Expression: `$substringBefore("超明體繁", "體")`,
-			Output:     "超明",
+			Expression: `Account.Order.Product ~> $map(λ($prod, $index, $arr) { $index+1 & "/" & $count($arr) & ": " & $prod.` + "`Product Name`" + ` })`,
+			Output: []interface{}{
+				"1/4: Bowler Hat",
+				"2/4: Trilby hat",
+				"3/4: Bowler Hat",
+				"4/4: Cloak",
+			},
 		},
 		{
-			Expression: `$substringBefore(nothing, "He")`,
+			Expression: `$map(Phone, function($v, $i) {$v.type="office" ? $i: null})`,
 			Error:      ErrUndefined,
 		},
 	})
 }
 
-func TestFuncSubstringAfter(t *testing.T) {
+func TestFuncMap3(t *testing.T) {
 
-	runTestCases(t, nil, []*testCase{
-		{
-			Expression: `$substringAfter("Hello World", " ")`,
-			Output:     "World",
-		},
-		{
-			Expression: `$substringAfter("Hello World", "l")`,
-			Output:     "lo World",
-		},
-		{
-			Expression: `$substringAfter("Hello World", "f")`,
-			Output:     "Hello World",
-		},
-		{
-			Expression: `$substringAfter("Hello World", "ld")`,
-			Output:     "",
-		},
-		{
-			Expression: `$substringAfter("Hello World", "")`,
-			Output:     "Hello World",
-		},
+	runTestCases(t, testdata.address, []*testCase{
 		{
-			Expression: `$substringAfter("超明體繁", "明")`,
-			Output:     "體繁",
+			Expression: []string{
+				`$map(Phone, function($v, $i) {$i[$v.type="office"]})`,
+				`$map(Phone, function($v, $i) {$v.type="office" ? $i})`,
+			},
+			Output: []interface{}{
+				1,
+				2,
+			},
 		},
 		{
-			Expression: `$substringAfter(nothing, "ld")`,
-			Error:      ErrUndefined,
+			Expression: `$map(Phone, function($v, $i) {$v.type="office" ? $i: null})`,
+			Output: []interface{}{
+				nil,
+				1,
+				2,
+				nil,
+			},
 		},
 	})
 }
 
-func TestFuncLowercase(t *testing.T) {
+func TestFuncMapZip(t *testing.T) {
 
 	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `$lowercase("Hello World")`,
-			Output:     "hello world",
-		},
-		{
-			Expression: `$lowercase("Étude in Black")`,
-			Output:     "étude in black",
+			Expression: []string{
+				`(
+					$data := {
+						"one": [1,2,3,4,5],
+						"two": [5,4,3,2,1]
+					};
+					$map($zip($data.one, $data.two), $sum)
+				)`,
+				`(
+					$data := {
+						"one": [1,2,3,4,5],
+						"two": [5,4,3,2,1]
+					};
+					$data.$zip(one, two) ~> $map($sum)
+				)`,
+			},
+			Output: []interface{}{
+				float64(6),
+				float64(6),
+				float64(6),
+				float64(6),
+				float64(6),
+			},
 		},
 		{
-			Expression: `$lowercase(nothing)`,
-			Error:      ErrUndefined,
+			Expression: []string{
+				`(
+					$data := {
+						"one": [1],
+						"two": [5]
+					};
+					$data[].$zip(one, two) ~> $map($sum)
+				)`,
+				`(
+					$data := {
+						"one": 1,
+						"two": 5
+					};
+					$data[].$zip(one, two) ~> $map($sum)
+				)`,
+			},
+			Output: []interface{}{
+				float64(6),
+			},
 		},
 	})
 }
 
-func TestFuncUppercase(t *testing.T) {
+func TestFuncFilter(t *testing.T) {
 
-	runTestCases(t, nil, []*testCase{
+	runTestCases(t, testdata.library, []*testCase{
 		{
-			Expression: `$uppercase("Hello World")`,
-			Output:     "HELLO WORLD",
+			Expression: `$filter([1..10], function($v) {$v % 2})`,
+			Output: []interface{}{
+				float64(1),
+				float64(3),
+				float64(5),
+				float64(7),
+				float64(9),
+			},
 		},
+	})
+}
+
+func TestFuncFilter2(t *testing.T) {
+
+	runTestCases(t, testdata.library, []*testCase{
 		{
-			Expression: `$uppercase("étude in black")`,
-			Output:     "ÉTUDE IN BLACK",
+			Expression: `(library.books~>$filter(λ($v, $i, $a) {$v.price = $max($a.price)})).isbn`,
+			Output:     "9780262510875",
 		},
 		{
-			Expression: `$uppercase(nothing)`,
+			Expression: `(nothing~>$filter(λ($v, $i, $a) {$v.price = $max($a.price)})).isbn`,
 			Error:      ErrUndefined,
 		},
 	})
 }
 
-func TestFuncLength(t *testing.T) {
+func TestFuncReduce(t *testing.T) {
 
 	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `$length("")`,
-			Output:     0,
+			Expression: `
+				(
+					$seq := [1,2,3,4,5];
+					$reduce($seq, function($x, $y){$x+$y})
+				)`,
+			Output: float64(15),
 		},
 		{
-			Expression: `$length("hello")`,
-			Output:     5,
+			Expression: `
+				(
+					$concat := function($s){function($a, $b){$string($a) & $s & $string($b)}};
+					$comma_join := $concat(' ... ');
+					$reduce([1,2,3,4,5], $comma_join)
+				)`,
+			Output: "1 ... 2 ... 3 ... 4 ... 5",
 		},
 		{
-			Expression: `$length(nothing)`,
-			Error:      ErrUndefined,
+			Expression: `
+				(
+					$seq := [1,2,3,4,5];
+					$reduce($seq, function($x, $y){$x+$y}, 2)
+				)`,
+			Output: float64(17),
 		},
 		{
-			Expression: `$length("\u03BB-calculus")`,
-			Output:     10,
+			Expression: `
+				(
+					$seq := 1;
+					$reduce($seq, function($x, $y){$x+$y})
+				)`,
+			Output: float64(1),
 		},
 		{
-			Expression: `$length("\uD834\uDD1E")`,
-			Output:     1,
+			Expression: `
+				(
+					$product := function($a, $b) { $a * $b };
+					$power := function($x, $n) { $n = 0 ? 1 : $reduce([1..$n].($x), $product) };
+					[0..5].$power(2, $)
+				)`,
+			Output: []interface{}{
+				float64(1),
+				float64(2),
+				float64(4),
+				float64(8),
+				float64(16),
+				float64(32),
+			},
 		},
 		{
-			Expression: `$length("𝄞")`,
-			Output:     1,
+			Expression: `
+				(
+					$seq := ["a", "b", "c"];
+					$reduce($seq, function($x, $y, $i){$x & $y & $i})
+				)`,
+			Output: "ab1c2",
 		},
 		{
-			Expression: `$length("超明體繁")`,
-			Output:     4,
+			Expression: `
+				(
+					$seq := ["a", "b", "c"];
+					$reduce($seq, function($x, $y, $i, $a){$x & $y & $count($a)})
+				)`,
+			Output: "ab3c3",
 		},
 		{
-			Expression: []string{
-				`$length("\t")`,
-				`$length("\n")`,
-			},
-			Output: 1,
+			Expression: `
+				(
+					$seq := 1;
+					$reduce($seq, function($x){$x})
+				)`,
+			Error: jlib.NewArgValueError("reduce", 2, "D3050", "must be a function that takes at least two arguments"),
 		},
+	})
+}
+
+func TestFuncReduce2(t *testing.T) {
+
+	runTestCases(t, testdata.account, []*testCase{
 		{
-			Expression: []string{
-				`$length(1234)`,
-				`$length(true)`,
-				`$length(false)`,
-				`$length(null)`,
-				`$length(1.0)`,
-				`$length(["hello"])`,
-			},
-			Error: &ArgTypeError{
-				Func:  "length",
-				Which: 1,
+			Expression: `$reduce(Account.Order.Product.Quantity, $append)`,
+			Output: []interface{}{
+				float64(2),
+				float64(1),
+				float64(4),
+				float64(1),
 			},
 		},
+	})
+}
+
+func TestFuncReduce3(t *testing.T) {
+
+	runTestCases(t, testdata.address, []*testCase{
 		{
-			Expression: `$length("hello", "world")`,
-			Error: &ArgCountError{
-				Func:     "length",
-				Expected: 1,
-				Received: 2,
-			},
+			Expression: `$reduce(Account.Order.Product.Quantity, $append)`,
+			Error:      ErrUndefined,
 		},
 	})
 }
 
-func TestFuncTrim(t *testing.T) {
+func TestFuncSift(t *testing.T) {
 
 	runTestCases(t, nil, []*testCase{
 		{
-			Expression: []string{
-				`$trim("Hello World")`,
-				`$trim("   Hello  \n  \t World  \t ")`,
+			Expression: `
+				(
+					$data := {
+						"one": 1,
+						"two": 2,
+						"three": 3,
+						"four": 4,
+						"five": 5,
+						"six": 6,
+						"seven": 7,
+						"eight": 8,
+						"nine": 9,
+						"ten": 10
+					};
+					$sift($data, function($v){$v % 2})
+				)`,
+			Output: map[string]interface{}{
+				"one":   float64(1),
+				"three": float64(3),
+				"five":  float64(5),
+				"seven": float64(7),
+				"nine":  float64(9),
 			},
-			Output: "Hello World",
 		},
 		{
-			Expression: "$trim()",
-			Error: &ArgCountError{
-				Func:     "trim",
-				Expected: 1,
-				Received: 0,
+			Expression: `
+				(
+					$data := {
+						"one": 1,
+						"two": 2,
+						"three": 3,
+						"four": 4,
+						"five": 5,
+						"six": 6,
+						"seven": 7,
+						"eight": 8,
+						"nine": 9,
+						"ten": 10
+					};
+					$sift($data, function($v,$k){$contains($k,"o")})
+				)`,
+			Output: map[string]interface{}{
+				"one":  float64(1),
+				"two":  float64(2),
+				"four": float64(4),
+			},
+		},
+		{
+			Expression: `
+				(
+					$data := {
+						"one": 1,
+						"two": 2,
+						"three": 3,
+						"four": 4,
+						"five": 5,
+						"six": 6,
+						"seven": 7,
+						"eight": 8,
+						"nine": 9,
+						"ten": 10
+					};
+					$sift($data, function($v,$k){$length($k) >= $v})
+				)`,
+			Output: map[string]interface{}{
+				"one":   float64(1),
+				"two":   float64(2),
+				"three": float64(3),
+				"four":  float64(4),
 			},
-			Skip: true, // returns ErrUndefined (is it using context?)
 		},
 	})
 }
 
-func TestFuncPad(t *testing.T) {
+func TestFuncSift2(t *testing.T) {
 
-	runTestCases(t, nil, []*testCase{
+	runTestCases(t, testdata.address, []*testCase{
 		{
-			Expression: []string{
-				`$pad("foo", 5)`,
-				`$pad("foo", 5, "")`,
-				`$pad("foo", 5, " ")`,
+			Expression: `$sift(λ($v){$v.**.Postcode})`,
+			Output: map[string]interface{}{
+				"Address": map[string]interface{}{
+					"Street":   "Hursley Park",
+					"City":     "Winchester",
+					"Postcode": "SO21 2JN",
+				},
+				"Other": map[string]interface{}{
+					"Over 18 ?": true,
+					"Misc":      nil,
+					"Alternative.Address": map[string]interface{}{
+						"Street":   "Brick Lane",
+						"City":     "London",
+						"Postcode": "E1 6RF",
+					},
+				},
 			},
-			Output: "foo  ",
-		},
-		{
-			Expression: `$pad("foo", -5)`,
-			Output:     "  foo",
-		},
-		{
-			Expression: `$pad("foo", -5, ".")`,
-			Output:     "..foo",
 		},
 		{
-			Expression: `$pad("foo", 5, "超")`,
-			Output:     "foo超超",
+			Expression: `**[*].$sift(λ($v){$v.Postcode})`,
+			Output: []interface{}{
+				map[string]interface{}{
+					"Address": map[string]interface{}{
+						"Street":   "Hursley Park",
+						"City":     "Winchester",
+						"Postcode": "SO21 2JN",
+					},
+				},
+				map[string]interface{}{
+					"Alternative.Address": map[string]interface{}{
+						"Street":   "Brick Lane",
+						"City":     "London",
+						"Postcode": "E1 6RF",
+					},
+				},
+			},
 		},
 		{
 			Expression: []string{
-				`$pad("foo", 1)`,
-				`$pad("foo", -1)`,
+				`$sift(λ($v, $k){$match($k, /^A/)})`,
+				`$sift(λ($v, $k){$k ~> /^A/})`,
+			},
+			Output: map[string]interface{}{
+				"Age": float64(28),
+				"Address": map[string]interface{}{
+					"Street":   "Hursley Park",
+					"City":     "Winchester",
+					"Postcode": "SO21 2JN",
+				},
 			},
-			Output: "foo",
-		},
-		{
-			Expression: `$pad("foo", 8, "-+")`,
-			Output:     "foo-+-+-",
 		},
+	})
+}
+
+func TestFuncSift3(t *testing.T) {
+
+	type product struct {
+		Name     string
+		Price    float64
+		Quantity int
+		sku      string
+	}
+
+	data := product{
+		Name:     "Bowler Hat",
+		Price:    34.45,
+		Quantity: 2,
+		sku:      "0406654608",
+	}
+
+	for _, input := range []interface{}{data, &data} {
+		runTestCases(t, input, []*testCase{
+			{
+				Expression: []string{
+					`$sift(function($v){$type($v) = "number"})`,
+					`$sift($, function($v){$type($v) = "number"})`,
+				},
+				Output: map[string]interface{}{
+					"Price":    34.45,
+					"Quantity": 2,
+				},
+			},
+			{
+				Expression: `$sift(function($v, $k){$k = "Name"})`,
+				Output: map[string]interface{}{
+					"Name": "Bowler Hat",
+				},
+			},
+			{
+				// Unexported fields are not visible to $sift.
+				Expression: `$sift(function($v, $k){$k = "sku"})`,
+				Error:      ErrUndefined,
+			},
+			{
+				Expression: `$sift(function($v, $k, $o){$k != "Name" and $o.Quantity > 1})`,
+				Output: map[string]interface{}{
+					"Price":    34.45,
+					"Quantity": 2,
+				},
+			},
+		})
+	}
+}
+
+func TestFuncSift4(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `$pad("超明體繁", 5)`,
-			Output:     "超明體繁 ",
+			Expression: `$sift({"a": 1, "b": 2, "c": 3}, function($v, $k, $o){$v = $count($keys($o))})`,
+			Output: map[string]interface{}{
+				"c": float64(3),
+			},
 		},
 		{
-			Expression: `$pad("", 6, "超明體繁")`,
-			Output:     "超明體繁超明",
+			Expression: `$sift({"a": 1, "b": 2}, function($v, $k, $o){$lookup($o, $k) = $v})`,
+			Output: map[string]interface{}{
+				"a": float64(1),
+				"b": float64(2),
+			},
 		},
 		{
-			Expression: `$pad(nothing, -1)`,
-			Error:      ErrUndefined,
+			Expression: `$sift([1, 2, 3], function($v){$v})`,
+			Error: &ArgTypeError{
+				Func:  "sift",
+				Which: 1,
+			},
 		},
 	})
 }
 
-func TestFuncContains(t *testing.T) {
+func TestFuncSignatures(t *testing.T) {
 
-	runTestCases(t, nil, []*testCase{
+	data := map[string]interface{}{
+		"name": "Fred",
+		"age":  float64(42),
+	}
+
+	runTestCases(t, data, []*testCase{
 		{
-			Expression: []string{
-				`$contains("Hello World", "lo")`,
-				`$contains("Hello World", "World")`,
-			},
-			Output: true,
+			// A missing argument for a contextable parameter
+			// is replaced by the evaluation context.
+			Expression: `name.$uppercase()`,
+			Output:     "FRED",
 		},
 		{
 			Expression: []string{
-				`$contains("Hello World", "Word")`,
-				`$contains("Hello World", "world")`,
+				`name.$substring(0)`,
+				`name.$pad(4)`,
+				`name.$trim()`,
 			},
-			Output: false,
+			Output: "Fred",
 		},
 		{
-			Expression: `$contains("超明體繁", "明體")`,
-			Output:     true,
+			Expression: `$uppercase()`,
+			Error: &ArgTypeError{
+				Func:    "uppercase",
+				Which:   1,
+				Context: true,
+			},
 		},
 		{
-			Expression: `$contains("超明體繁", "體明")`,
-			Output:     false,
+			Expression: `age.$uppercase()`,
+			Error: &ArgTypeError{
+				Func:     "uppercase",
+				Which:    1,
+				Context:  true,
+				Position: 4,
+			},
 		},
 		{
-			Expression: `$contains(nothing, "World")`,
-			Error:      ErrUndefined,
+			// Undefined arguments don't hide errors with the
+			// other arguments.
+			Expression: `$substring(nothing, "1")`,
+			Error: &ArgTypeError{
+				Func:  "substring",
+				Which: 2,
+			},
 		},
 		{
-			Expression: `$contains(23, 3)`,
+			Expression: `$contains(nothing, 1)`,
 			Error: &ArgTypeError{
 				Func:  "contains",
-				Which: 1,
+				Which: 2,
 			},
 		},
 		{
-			Expression: `$contains("23", 3)`,
+			Expression: `$sum(["1", "2"])`,
 			Error: &ArgTypeError{
-				Func:  "contains",
-				Which: 2,
+				Func:    "sum",
+				Which:   1,
+				ArrayOf: "numbers",
+			},
+		},
+		{
+			Expression: `$append([1])`,
+			Error: &ArgCountError{
+				Func:     "append",
+				Expected: 2,
+				Received: 1,
 			},
 		},
 	})
 }
 
-func TestFuncSplit(t *testing.T) {
+func TestHigherOrderFunctions(t *testing.T) {
 
 	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `$split("Hello World", " ")`,
-			Output: []string{
-				"Hello",
-				"World",
-			},
-		},
-		{
-			Expression: `$split("Hello  World", " ")`,
-			Output: []string{
-				"Hello",
-				"",
-				"World",
-			},
+			Expression: `
+				(
+					$twice:=function($f){function($x){$f($f($x))}};
+					$add3:=function($y){$y+3};
+					$add6:=$twice($add3);
+					$add6(7)
+				)`,
+			Output: float64(13),
 		},
 		{
-			Expression: `$split("Hello", " ")`,
-			Output: []string{
-				"Hello",
-			},
+			Expression: `λ($f) { λ($x) { $x($x) }( λ($g) { $f( (λ($a) {$g($g)($a)}))})}(λ($f) { λ($n) { $n < 2 ? 1 : $n * $f($n - 1) } })(6)`,
+			Output:     float64(720),
 		},
 		{
-			Expression: `$split("Hello", "")`,
-			Output: []string{
-				"H",
-				"e",
-				"l",
-				"l",
-				"o",
-			},
+			Expression: `λ($f) { λ($x) { $x($x) }( λ($g) { $f( (λ($a) {$g($g)($a)}))})}(λ($f) { λ($n) { $n <= 1 ? $n : $f($n-1) + $f($n-2) } })(6)`,
+			Output:     float64(8),
 		},
+	})
+}
+
+func TestClosures(t *testing.T) {
+
+	runTestCases(t, testdata.account, []*testCase{
 		{
-			Expression: `$split("超明體繁", "")`,
-			Output: []string{
-				"超",
-				"明",
-				"體",
-				"繁",
+			Expression: `
+				Account.(
+					$AccName := function() { $.` + "`Account Name`" + `};
+					Order[OrderID = "order104"].Product{
+						"Account": $AccName(),
+						"SKU-" & $string(ProductID): $.` + "`Product Name`" + `
+					}
+				)`,
+			Output: map[string]interface{}{
+				"Account":    "Firefly",
+				"SKU-858383": "Bowler Hat",
+				"SKU-345664": "Cloak",
 			},
 		},
+	})
+}
+
+func TestFuncString(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `$sum($split("12345", "").$number($))`,
-			Output:     float64(15),
+			Expression: `$string(5)`,
+			Output:     "5",
 		},
 		{
-			Expression: []string{
-				`$split("a, b, c, d", ", ")`,
-				`$split("a, b, c, d", ", ", 10)`,
-				//`$split("a, b, c, d", ",").$trim()`,	// returns ErrUndefined
-			},
-			Output: []string{
-				"a",
-				"b",
-				"c",
-				"d",
-			},
+			Expression: `$string(22/7)`,
+			Output:     "3.14285714285714",
 		},
 		{
-			Expression: []string{
-				`$split("a, b, c, d", ", ", 2)`,
-				`$split("a, b, c, d", ", ", 2.5)`,
-			},
-			Output: []string{
-				"a",
-				"b",
-			},
+			Expression: `$string(1e100)`,
+			Output:     "1e+100",
 		},
 		{
-			Expression: `$split("a, b, c, d", ", ", 0)`,
-			Output:     []string{},
+			Expression: `$string(1e-100)`,
+			Output:     "1e-100",
 		},
 		{
-			Expression: `$split(nothing, " ")`,
-			Error:      ErrUndefined,
+			Expression: `$string(1e-6)`,
+			Output:     "0.000001",
 		},
 		{
-			Expression: `$split("a, b, c, d", ", ", -3)`,
-			Error:      fmt.Errorf("third argument of the split function must evaluate to a positive number"), // TODO: Use a proper error for this
+			Expression: `$string(1e-7)`,
+			Output:     "1e-7",
 		},
 		{
-			Expression: []string{
-				`$split("a, b, c, d", ", ", null)`,
-				`$split("a, b, c, d", ", ", "2")`,
-				`$split("a, b, c, d", ", ", true)`,
-			},
-			Error: &ArgTypeError{
-				Func:  "split",
-				Which: 3,
-			},
+			Expression: `$string(1e+20)`,
+			Output:     "100000000000000000000",
 		},
 		{
-			Expression: `$split(12345, 3)`,
-			Error: &ArgTypeError{
-				Func:  "split",
-				Which: 1,
-			},
+			Expression: `$string(1e+21)`,
+			Output:     "1e+21",
 		},
 		{
-			Expression: `$split(12345)`,
-			Error: &ArgCountError{
-				Func:     "split",
-				Expected: 3,
-				Received: 1,
-			},
+			Expression: `$string(0.1 + 0.2)`,
+			Output:     "0.3",
 		},
-	})
-}
-
-func TestFuncJoin(t *testing.T) {
-
-	runTestCases(t, nil, []*testCase{
 		{
-			Expression: []string{
-				`$join("hello", "")`,
-				`$join(["hello"], "")`,
+			Expression: `$string(-0)`,
+			Output:     "0",
+		},
+		{
+			Expression: `$string({"n": 22/7, "a": [0.1 + 0.2]})`,
+			Output:     `{"n":3.14285714285714,"a":[0.3]}`,
+		},
+		{
+			Expression: `"n=" & (0.1 + 0.2)`,
+			Output:     "n=0.3",
+		},
+		{
+			Expression: `{"SKU-" & $string(0.1 + 0.2): 22/7 & ""}`,
+			Output: map[string]interface{}{
+				"SKU-0.3": "3.14285714285714",
 			},
-			Output: "hello",
 		},
 		{
-			Expression: `$join(["hello", "world"], "")`,
-			Output:     "helloworld",
+			Expression: `$string(true)`,
+			Output:     "true",
 		},
 		{
-			Expression: `$join(["hello", "world"], ", ")`,
-			Output:     "hello, world",
+			Expression: `$string(false)`,
+			Output:     "false",
 		},
 		{
-			Expression: `$join(["超","明","體","繁"])`,
-			Output:     "超明體繁",
+			Expression: `$string(null)`,
+			Output:     "null",
 		},
 		{
-			Expression: `$join([], ", ")`,
-			Output:     "",
+			Expression: `$string(blah)`,
+			Error:      ErrUndefined,
 		},
 		{
-			Expression: `$join(true, ", ")`,
-			Error:      fmt.Errorf("function join takes an array of strings"), // TODO: Use a proper error
+			Expression: []string{
+				`$string($string)`,
+				`$string(/hat/)`,
+				`$string(function(){true})`,
+				`$string(function(){1})`,
+			},
+			Output: "",
 		},
 		{
-			Expression: `$join([1,2,3], ", ")`,
-			Error:      fmt.Errorf("function join takes an array of strings"), // TODO: Use a proper error
+			Expression: `$string({"string": "hello"})`,
+			Output:     `{"string":"hello"}`,
 		},
 		{
-			Expression: `$join("hello", 3)`,
-			Error: &ArgTypeError{
-				Func:  "join",
-				Which: 2,
+			Expression: `$string(["string", 5])`,
+			Output:     `["string",5]`,
+		},
+		{
+			Expression: `
+				$string({
+					"string": "hello",
+					"number": 78.8 / 2,
+					"null":null,
+					"boolean": false,
+					"function": $sum,
+					"lambda": function(){true},
+					"object": {
+						"str": "another",
+						"lambda2": function($n){$n}
+					},
+					"array": []
+				})`,
+			Output: `{"string":"hello","number":39.4,"null":null,"boolean":false,"function":"","lambda":"","object":{"str":"another","lambda2":""},"array":[]}`,
+		},
+		{
+			Expression: `$string(1/0)`,
+			Error: &EvalError{
+				Type:  ErrNumberInf,
+				Value: "/",
 			},
 		},
 		{
-			Expression: `$join()`,
+			Expression: `$string({"inf": 1/0})`,
+			Error: &EvalError{
+				Type:  ErrNumberInf,
+				Value: "/",
+			},
+		},
+		{
+			Expression: `$string(2,3)`,
 			Error: &ArgCountError{
-				Func:     "join",
-				Expected: 2,
-				Received: 0,
+				Func:     "string",
+				Expected: 1,
+				Received: 2,
 			},
 		},
 	})
 }
 
-func TestFuncJoin2(t *testing.T) {
+func TestFuncString2(t *testing.T) {
 
 	runTestCases(t, testdata.account, []*testCase{
 		{
-			Expression: `$join(Account.Order.Product.Description.Colour, ", ")`,
-			Output:     "Purple, Orange, Purple, Black",
-		},
-		{
-			Expression: `$join(Account.Order.Product.Description.Colour, "")`,
-			Output:     "PurpleOrangePurpleBlack",
-		},
-		{
-			Expression: `$join(Account.blah.Product.Description.Colour, ", ")`,
-			Error:      ErrUndefined,
+			Expression: `Account.Order.$string($sum(Product.(Price* Quantity)))`,
+			Output: []interface{}{
+				"90.57",
+				"245.79",
+			},
 		},
 	})
 }
 
-func TestFuncReplace(t *testing.T) {
+func TestObjectKeyOrder(t *testing.T) {
 
 	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `$replace("Hello World", "World", "Everyone")`,
-			Output:     "Hello Everyone",
+			Expression: `$keys({"b": 1, "a": 2, "c": 3})`,
+			Output: []string{
+				"b",
+				"a",
+				"c",
+			},
 		},
 		{
-			Expression: `$replace("the cat sat on the mat", "at", "it")`,
-			Output:     "the cit sit on the mit",
+			Expression: `$each({"b": 1, "a": 2}, λ($v, $k) {$k & "=" & $v})`,
+			Output: []interface{}{
+				"b=1",
+				"a=2",
+			},
 		},
 		{
-			Expression: `$replace("the cat sat on the mat", "at", "it", 0)`,
-			Output:     "the cat sat on the mat",
+			Expression: `$spread({"b": 1, "a": 2})`,
+			Output: []interface{}{
+				map[string]interface{}{
+					"b": float64(1),
+				},
+				map[string]interface{}{
+					"a": float64(2),
+				},
+			},
 		},
 		{
-			Expression: `$replace("the cat sat on the mat", "at", "it", 2)`,
-			Output:     "the cit sit on the mat",
+			Expression: `$string($merge([{"b": 1, "a": 2}, {"c": 3, "b": 4}]))`,
+			Output:     `{"b":4,"a":2,"c":3}`,
 		},
 		{
-			Expression: `$replace(nothing, "at", "it", 2)`,
-			Error:      ErrUndefined,
+			Expression: `$string($sift({"c": 1, "b": 2, "a": 3}, λ($v) {$v > 1}))`,
+			Output:     `{"b":2,"a":3}`,
 		},
 		{
-			Expression: `$replace("hello")`,
-			Error: &ArgCountError{
-				Func:     "replace",
-				Expected: 4,
-				Received: 1,
-			},
+			Expression: `$string([{"k": "z", "v": 1}, {"k": "a", "v": 2}, {"k": "z", "v": 3}]{k: $sum(v)})`,
+			Output:     `{"z":4,"a":2}`,
 		},
 		{
-			Expression: `$replace("hello", 1)`,
-			Error: &ArgCountError{
-				Func:     "replace",
-				Expected: 4,
-				Received: 2,
-			},
+			Expression: `$string({"b": 1, "a": 2, "c": 3} ~> |$|{"d": 4, "a": 5}, ["c"]|)`,
+			Output:     `{"b":1,"a":5,"d":4}`,
 		},
 		{
-			Expression: `$replace("hello", "l", "1", null)`,
-			Error: &ArgTypeError{
-				Func:  "replace",
-				Which: 4,
-			},
+			Expression: `$string({"outer": {"b": 1, "a": 2}} ~> |outer|{"c": 3}|)`,
+			Output:     `{"outer":{"b":1,"a":2,"c":3}}`,
 		},
 		{
-			Expression: `$replace(123, 2, 1)`,
-			Error: &ArgTypeError{
-				Func:  "replace",
-				Which: 1,
-			},
+			// Key order does not affect equality.
+			Expression: `{"a": 1, "b": 2} = {"b": 2, "a": 1}`,
+			Output:     true,
 		},
 		{
-			Expression: `$replace("hello", 2, 1)`,
-			Error: &ArgTypeError{
-				Func:  "replace",
-				Which: 2,
+			Expression: `$count($distinct([{"a": 1, "b": 2}, {"b": 2, "a": 1}]))`,
+			Output:     1,
+		},
+		{
+			// Extensions receive regular Go maps, even if
+			// they are nested in arrays or other objects.
+			Expression: []string{
+				`$kind({"a": 1})`,
+				`$kind([{"a": 1}])`,
+				`$kind({"a": {"b": 1}}.a)`,
+				`$kinds([{"a": 1}])`,
+			},
+			Exts: map[string]Extension{
+				"kind": {
+					Func: func(v interface{}) string {
+						switch v := v.(type) {
+						case map[string]interface{}:
+							return "map"
+						case []interface{}:
+							if _, ok := v[0].(map[string]interface{}); ok {
+								return "map"
+							}
+						}
+						return "other"
+					},
+				},
+				"kinds": {
+					Func: func(v []interface{}) string {
+						if _, ok := v[0].(map[string]interface{}); ok {
+							return "map"
+						}
+						return "other"
+					},
+				},
 			},
+			Output: "map",
 		},
 		{
-			Expression: `$replace("hello", "l", "1", -2)`,
-			Error:      fmt.Errorf("fourth argument of function replace must evaluate to a positive number"), // TODO: Use a proper error
+			// Unless they ask for an OrderedMap.
+			Expression: `$keys2({"b": 1, "a": 2})`,
+			Exts: map[string]Extension{
+				"keys2": {
+					Func: func(m *jtypes.OrderedMap) []string {
+						return m.Keys()
+					},
+				},
+			},
+			Output: []string{
+				"b",
+				"a",
+			},
 		},
 		{
-			Expression: `$replace("hello", "", "bye")`,
-			Error:      fmt.Errorf("second argument of function replace can't be an empty string"), // TODO: Use a proper error
+			// Eval returns regular Go maps.
+			Expression: `{"b": {"d": 1, "c": 2}, "a": [{"f": 3, "e": 4}]}`,
+			Output: map[string]interface{}{
+				"b": map[string]interface{}{
+					"d": float64(1),
+					"c": float64(2),
+				},
+				"a": []interface{}{
+					map[string]interface{}{
+						"f": float64(3),
+						"e": float64(4),
+					},
+				},
+			},
 		},
 	})
 }
 
-func TestFormatNumber(t *testing.T) {
+func TestFuncSubstring(t *testing.T) {
 
 	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `$formatNumber(12345.6, "#,###.00")`,
-			Output:     "12,345.60",
-		},
-		{
-			Expression: `$formatNumber(12345678.9, "9,999.99")`,
-			Output:     "12,345,678.90",
-		},
-		{
-			Expression: `$formatNumber(123412345678.9, "9,9,99.99")`,
-			Output:     "123412345,6,78.90",
-		},
-		{
-			Expression: `$formatNumber(1234.56789, "9,999.999,999")`,
-			Output:     "1,234.567,890",
-		},
-		{
-			Expression: `$formatNumber(123.9, "9999")`,
-			Output:     "0124",
-		},
-		{
-			Expression: `$formatNumber(0.14, "01%")`,
-			Output:     "14%",
-		},
-		{
-			Expression: `$formatNumber(0.4857,"###.###‰")`,
-			Output:     "485.7‰",
-		},
-		{
-			Expression: `$formatNumber(0.14, "###pm", {"per-mille": "pm"})`,
-			Output:     "140pm",
-		},
-		{
-			Expression: `$formatNumber(-6, "000")`,
-			Output:     "-006",
-		},
-		{
-			Expression: `$formatNumber(1234.5678, "00.000e0")`,
-			Output:     "12.346e2",
-		},
-		{
-			Expression: `$formatNumber(1234.5678, "00.000e000")`,
-			Output:     "12.346e002",
-		},
-		{
-			Expression: `$formatNumber(1234.5678, "①①.①①①e①", {"zero-digit": "\u245f"})`,
-			Output:     "①②.③④⑥e②",
+			Expression: `$substring("hello world", 0, 5)`,
+			Output:     "hello",
 		},
 		{
 			Expression: []string{
-				`$formatNumber(1234.5678, "𝟎𝟎.𝟎𝟎𝟎e𝟎", {"zero-digit": "𝟎"})`,
-				`$formatNumber(1234.5678, "𝟎𝟎.𝟎𝟎𝟎e𝟎", {"zero-digit": "\ud835\udfce"})`,
+				`$substring("hello world", -5, 5)`,
+				`$substring("hello world", 6)`,
 			},
-			Output: "𝟏𝟐.𝟑𝟒𝟔e𝟐",
+			Output: "world",
 		},
 		{
-			Expression: `$formatNumber(0.234, "0.0e0")`,
-			Output:     "2.3e-1",
+			Expression: `$substring("hello world", -100, 4)`,
+			Output:     "hell",
 		},
 		{
-			Expression: `$formatNumber(0.234, "#.00e0")`,
-			Output:     "0.23e0",
+			Expression: []string{
+				`$substring("hello world", 100)`,
+				`$substring("hello world", 100, 5)`,
+				`$substring("hello world", 0, 0)`,
+				`$substring("hello world", 0, -100)`,
+				`$substring("超明體繁", 2, 0)`,
+			},
+			Output: "",
 		},
 		{
-			Expression: `$formatNumber(0.123, "#.e9")`,
-			Output:     "0.1e0",
+			Expression: []string{
+				`$substring("超明體繁", 2)`,
+				`$substring("超明體繁", -2)`,
+				`$substring("超明體繁", -2, 2)`,
+			},
+			Output: "體繁",
 		},
 		{
-			Expression: `$formatNumber(0.234, ".00e0")`,
-			Output:     ".23e0",
+			Expression: []string{
+				`$substring("hello", -2, 5)`,
+				`$substring("hello", -2.5)`,
+			},
+			Output: "lo",
 		},
 		{
-			Expression: `$formatNumber(2392.14*(-36.58), "000,000.000###;###,###.000###")`,
-			Output:     "87,504.4812",
+			// Fractional arguments follow jsonata-js, which
+			// truncates the start and end of the substring
+			// rather than the start and length.
+			Expression: []string{
+				`$substring("hello", 1.7, 2.6)`,
+				`$substring("hello", 1, 3.5)`,
+			},
+			Output: "ell",
 		},
 		{
-			Expression: `$formatNumber(2.14*86.58,"PREFIX##00.000###SUFFIX")`,
-			Output:     "PREFIX185.2812SUFFIX",
+			Expression: []string{
+				`$substring("超明體繁", 0.5, 0.5)`,
+				`$substring("超明體繁", -4.5, 1)`,
+			},
+			Output: "超",
 		},
 		{
-			Expression: `$formatNumber(1E20,"#,######")`,
-			Output:     "100,000000,000000,000000",
+			Expression: `$substring(nothing, 6)`,
+			Error:      ErrUndefined,
 		},
+	})
+}
 
-		// TODO: Make proper errors for these.
+func TestFuncSubstringBefore(t *testing.T) {
 
+	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `$formatNumber(20,"#;#;#")`,
-			Error:      fmt.Errorf("picture string must contain 1 or 2 subpictures"),
+			Expression: `$substringBefore("Hello World", " ")`,
+			Output:     "Hello",
 		},
 		{
-			Expression: `$formatNumber(20,"#.0.0")`,
-			Error:      fmt.Errorf("a subpicture cannot contain more than one decimal separator"),
+			Expression: `$substringBefore("Hello World", "l")`,
+			Output:     "He",
 		},
 		{
-			Expression: `$formatNumber(20,"#0%%")`,
-			Error:      fmt.Errorf("a subpicture cannot contain more than one percent character"),
+			Expression: `$substringBefore("Hello World", "f")`,
+			Output:     "Hello World",
 		},
 		{
-			Expression: `$formatNumber(20,"#0‰‰")`,
-			Error:      fmt.Errorf("a subpicture cannot contain more than one per-mille character"),
+			Expression: `$substringBefore("Hello World", "He")`,
+			Output:     "",
 		},
 		{
-			Expression: `$formatNumber(20,"#0%‰")`,
-			Error:      fmt.Errorf("a subpicture cannot contain both percent and per-mille characters"),
+			Expression: `$substringBefore("Hello World", "")`,
+			Output:     "",
 		},
 		{
-			Expression: `$formatNumber(20,".e0")`,
-			Error:      fmt.Errorf("a mantissa part must contain at least one decimal or optional digit"),
+			Expression: `$substringBefore("超明體繁", "體")`,
+			Output:     "超明",
 		},
 		{
-			Expression: `$formatNumber(20,"0+.e0")`,
-			Error:      fmt.Errorf("a subpicture cannot contain a passive character that is both preceded by and followed by an active character"),
+			Expression: `$substringBefore(nothing, "He")`,
+			Error:      ErrUndefined,
 		},
+	})
+}
+
+func TestFuncSubstringAfter(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `$formatNumber(20,"0,.e0")`,
-			Error:      fmt.Errorf("a group separator cannot be adjacent to a decimal separator"),
+			Expression: `$substringAfter("Hello World", " ")`,
+			Output:     "World",
 		},
 		{
-			Expression: `$formatNumber(20,"0,")`,
-			Error:      fmt.Errorf("an integer part cannot end with a group separator"),
+			Expression: `$substringAfter("Hello World", "l")`,
+			Output:     "lo World",
 		},
 		{
-			Expression: `$formatNumber(20,"0,,0")`,
-			Error:      fmt.Errorf("a subpicture cannot contain adjacent group separators"),
+			Expression: `$substringAfter("Hello World", "f")`,
+			Output:     "Hello World",
 		},
 		{
-			Expression: `$formatNumber(20,"0#.e0")`,
-			Error:      fmt.Errorf("an integer part cannot contain a decimal digit followed by an optional digit"),
+			Expression: `$substringAfter("Hello World", "ld")`,
+			Output:     "",
 		},
 		{
-			Expression: `$formatNumber(20,"#0.#0e0")`,
-			Error:      fmt.Errorf("a fractional part cannot contain an optional digit followed by a decimal digit"),
+			Expression: `$substringAfter("Hello World", "")`,
+			Output:     "Hello World",
 		},
 		{
-			Expression: `$formatNumber(20,"#0.0e0%")`,
-			Error:      fmt.Errorf("a subpicture cannot contain a percent/per-mille character and an exponent separator"),
+			Expression: `$substringAfter("超明體繁", "明")`,
+			Output:     "體繁",
 		},
 		{
-			Expression: `$formatNumber(20,"#0.0e0,0")`,
-			Error:      fmt.Errorf("an exponent part must consist solely of one or more decimal digits"),
+			Expression: `$substringAfter(nothing, "ld")`,
+			Error:      ErrUndefined,
 		},
 	})
 }
 
-func TestFuncFormatBase(t *testing.T) {
+func TestFuncLowercase(t *testing.T) {
 
 	runTestCases(t, nil, []*testCase{
 		{
-			Expression: "$formatBase(100)",
-			Output:     "100",
-		},
-		{
-			Expression: "$formatBase(nothing)",
-			Error:      ErrUndefined,
-		},
-		{
-			Expression: []string{
-				"$formatBase(100, 2)",
-				"$formatBase(99.5, 2.5)",
-			},
-			Output: "1100100",
-		},
-		{
-			Expression: "$formatBase(-100, 2)",
-			Output:     "-1100100",
+			Expression: `$lowercase("Hello World")`,
+			Output:     "hello world",
 		},
 		{
-			Expression: "$formatBase(100, 1)",
-			Error:      fmt.Errorf("the second argument to formatBase must be between 2 and 36"),
-			/*Error: &EvalError1{
-				Errno:    ErrInvalidBase,
-				Position: -3,
-				Value:    "1",
-			},*/
+			Expression: `$lowercase("Étude in Black")`,
+			Output:     "étude in black",
 		},
 		{
-			Expression: "$formatBase(100, 37)",
-			Error:      fmt.Errorf("the second argument to formatBase must be between 2 and 36"),
-			/*Error: &EvalError1{
-				Errno:    ErrInvalidBase,
-				Position: -3,
-				Value:    "37",
-			},*/
+			Expression: `$lowercase(nothing)`,
+			Error:      ErrUndefined,
 		},
 	})
 }
 
-func TestFuncBase64Encode(t *testing.T) {
+func TestFuncUppercase(t *testing.T) {
 
 	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `$base64encode("hello:world")`,
-			Output:     "aGVsbG86d29ybGQ=",
+			Expression: `$uppercase("Hello World")`,
+			Output:     "HELLO WORLD",
 		},
 		{
-			Expression: `$base64encode(nothing)`,
+			Expression: `$uppercase("étude in black")`,
+			Output:     "ÉTUDE IN BLACK",
+		},
+		{
+			Expression: `$uppercase(nothing)`,
 			Error:      ErrUndefined,
 		},
 	})
 }
 
-func TestFuncBase64Decode(t *testing.T) {
+func TestFuncLength(t *testing.T) {
 
 	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `$base64decode("aGVsbG86d29ybGQ=")`,
-			Output:     "hello:world",
+			Expression: `$length("")`,
+			Output:     0,
 		},
 		{
-			Expression: `$base64decode(nothing)`,
-			Error:      ErrUndefined,
-		},
-	})
-}
-
-func TestFuncNumber(t *testing.T) {
-
-	runTestCases(t, nil, []*testCase{
-		{
-			Expression: []string{
-				"$number(0)",
-				`$number("0")`,
-			},
-			Output: float64(0),
-		},
-		{
-			Expression: []string{
-				"$number(10)",
-				`$number("10")`,
-			},
-			Output: float64(10),
-		},
-		{
-			Expression: []string{
-				"$number(-0.05)",
-				`$number("-0.05")`,
-			},
-			Output: -0.05,
-		},
-		{
-			Expression: `$number("1e2")`,
-			Output:     float64(100),
-		},
-		{
-			Expression: `$number("-1e2")`,
-			Output:     float64(-100),
-		},
-		{
-			Expression: `$number("1.0e-2")`,
-			Output:     0.01,
-		},
-		{
-			Expression: `$number("1e0")`,
-			Output:     float64(1),
-		},
-		{
-			Expression: `$number("10e500")`,
-			Error:      fmt.Errorf("unable to cast %q to a number", "10e500"),
-			/*Error: &EvalError1{
-				Errno:    ErrCastNumber,
-				Position: -10,
-				Value:    "10e500",
-			},*/
-		},
-		{
-			Expression: `$number("Hello world")`,
-			Error:      fmt.Errorf("unable to cast %q to a number", "Hello world"),
-			/*Error: &EvalError1{
-				Errno:    ErrCastNumber,
-				Position: -10,
-				Value:    "Hello world",
-			},*/
-		},
-		{
-			Expression: `$number("1/2")`,
-			Error:      fmt.Errorf("unable to cast %q to a number", "1/2"),
-			/*Error: &EvalError1{
-				Errno:    ErrCastNumber,
-				Position: -10,
-				Value:    "1/2",
-			},*/
-		},
-		{
-			Expression: `$number("1234 hello")`,
-			Error:      fmt.Errorf("unable to cast %q to a number", "1234 hello"),
-			/*Error: &EvalError1{
-				Errno:    ErrCastNumber,
-				Position: -10,
-				Value:    "1234 hello",
-			},*/
+			Expression: `$length("hello")`,
+			Output:     5,
 		},
 		{
-			Expression: `$number("")`,
-			Error:      fmt.Errorf("unable to cast %q to a number", ""),
-			/*Error: &EvalError1{
-				Errno:    ErrCastNumber,
-				Position: -10,
-				Value:    "",
-			},*/
+			Expression: `$length(nothing)`,
+			Error:      ErrUndefined,
 		},
 		{
-			Expression: `$number("[1]")`,
-			Error:      fmt.Errorf("unable to cast %q to a number", "[1]"),
-			/*Error: &EvalError1{
-				Errno:    ErrCastNumber,
-				Position: -10,
-				Value:    "[1]",
-			},*/
+			Expression: `$length("\u03BB-calculus")`,
+			Output:     10,
 		},
-
 		{
-			Expression: `$number(true)`,
-			Output:     1.,
+			Expression: `$length("\uD834\uDD1E")`,
+			Output:     1,
 		},
 		{
-			Expression: `$number(false)`,
-			Output:     0.,
+			Expression: `$length("𝄞")`,
+			Output:     1,
 		},
 		{
-			Expression: `$number(null)`,
-			Error: &ArgTypeError{
-				Func:  "number",
-				Which: 1,
-			},
+			Expression: `$length("超明體繁")`,
+			Output:     4,
 		},
 		{
-			Expression: `$number([])`,
-			Error: &ArgTypeError{
-				Func:  "number",
-				Which: 1,
+			Expression: []string{
+				`$length("\t")`,
+				`$length("\n")`,
 			},
+			Output: 1,
 		},
 		{
-			Expression: `$number([1,2])`,
-			Error: &ArgTypeError{
-				Func:  "number",
-				Which: 1,
+			Expression: []string{
+				`$length(1234)`,
+				`$length(true)`,
+				`$length(false)`,
+				`$length(null)`,
+				`$length(1.0)`,
+				`$length(["hello"])`,
 			},
-		},
-		{
-			Expression: `$number(["hello"])`,
 			Error: &ArgTypeError{
-				Func:  "number",
+				Func:  "length",
 				Which: 1,
 			},
 		},
 		{
-			Expression: `$number(["2"])`,
-			Error: &ArgTypeError{
-				Func:  "number",
-				Which: 1,
+			Expression: `$length("hello", "world")`,
+			Error: &ArgCountError{
+				Func:     "length",
+				Expected: 1,
+				Received: 2,
 			},
 		},
+	})
+}
+
+func TestFuncTrim(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `$number({})`,
-			Error: &ArgTypeError{
-				Func:  "number",
-				Which: 1,
+			Expression: []string{
+				`$trim("Hello World")`,
+				`$trim("   Hello  \n  \t World  \t ")`,
 			},
+			Output: "Hello World",
 		},
 		{
-			Expression: `$number({"hello":"world"})`,
-			Error: &ArgTypeError{
-				Func:  "number",
-				Which: 1,
-			},
+			// $trim's parameter is contextable, so $trim()
+			// uses the evaluation context, which is undefined
+			// here.
+			Expression: "$trim()",
+			Error:      ErrUndefined,
 		},
 		{
-			Expression: `$number($number)`,
+			Expression: "$trim(1)",
 			Error: &ArgTypeError{
-				Func:  "number",
+				Func:  "trim",
 				Which: 1,
 			},
 		},
 		{
-			Expression: `$number(1,2)`,
+			Expression: "$trim(1, 2)",
 			Error: &ArgCountError{
-				Func:     "number",
+				Func:     "trim",
 				Expected: 1,
 				Received: 2,
 			},
 		},
-		{
-			Expression: `$number(nothing)`,
-			Error:      ErrUndefined,
-		},
 	})
 }
 
-func TestFuncAbs(t *testing.T) {
+func TestFuncPad(t *testing.T) {
 
 	runTestCases(t, nil, []*testCase{
 		{
 			Expression: []string{
-				"$abs(3.7)",
-				"$abs(-3.7)",
+				`$pad("foo", 5)`,
+				`$pad("foo", 5, "")`,
+				`$pad("foo", 5, " ")`,
 			},
-			Output: 3.7,
-		},
-		{
-			Expression: "$abs(0)",
-			Output:     float64(0),
-		},
-		{
-			Expression: "$abs(nothing)",
-			Error:      ErrUndefined,
+			Output: "foo  ",
 		},
-	})
-}
-
-func TestFuncFloor(t *testing.T) {
-
-	runTestCases(t, nil, []*testCase{
 		{
-			Expression: "$floor(3.7)",
-			Output:     float64(3),
+			Expression: `$pad("foo", -5)`,
+			Output:     "  foo",
 		},
 		{
-			Expression: "$floor(-3.7)",
-			Output:     float64(-4),
+			Expression: `$pad("foo", -5, ".")`,
+			Output:     "..foo",
 		},
 		{
-			Expression: "$floor(0)",
-			Output:     float64(0),
+			Expression: `$pad("foo", 5, "超")`,
+			Output:     "foo超超",
 		},
 		{
-			Expression: "$floor(nothing)",
-			Error:      ErrUndefined,
+			Expression: []string{
+				`$pad("foo", 1)`,
+				`$pad("foo", -1)`,
+			},
+			Output: "foo",
 		},
-	})
-}
-
-func TestFuncCeil(t *testing.T) {
-
-	runTestCases(t, nil, []*testCase{
 		{
-			Expression: "$ceil(3.7)",
-			Output:     float64(4),
+			Expression: `$pad("foo", 8, "-+")`,
+			Output:     "foo-+-+-",
 		},
 		{
-			Expression: "$ceil(-3.7)",
-			Output:     float64(-3),
+			Expression: `$pad("超明體繁", 5)`,
+			Output:     "超明體繁 ",
 		},
 		{
-			Expression: "$ceil(0)",
-			Output:     float64(0),
+			Expression: `$pad("", 6, "超明體繁")`,
+			Output:     "超明體繁超明",
 		},
 		{
-			Expression: "$ceil(nothing)",
+			Expression: `$pad(nothing, -1)`,
 			Error:      ErrUndefined,
 		},
 	})
 }
 
-func TestFuncRound(t *testing.T) {
+func TestFuncContains(t *testing.T) {
 
 	runTestCases(t, nil, []*testCase{
 		{
-			Expression: "$round(4)",
-			Output:     float64(4),
+			Expression: []string{
+				`$contains("Hello World", "lo")`,
+				`$contains("Hello World", "World")`,
+			},
+			Output: true,
 		},
 		{
-			Expression: "$round(2.3)",
-			Output:     float64(2),
+			Expression: []string{
+				`$contains("Hello World", "Word")`,
+				`$contains("Hello World", "world")`,
+			},
+			Output: false,
 		},
 		{
-			Expression: "$round(2.7)",
-			Output:     float64(3),
+			Expression: `$contains("超明體繁", "明體")`,
+			Output:     true,
 		},
 		{
-			Expression: "$round(2.5)",
-			Output:     float64(2),
+			Expression: `$contains("超明體繁", "體明")`,
+			Output:     false,
 		},
 		{
-			Expression: "$round(3.5)",
-			Output:     float64(4),
+			Expression: `$contains(nothing, "World")`,
+			Error:      ErrUndefined,
 		},
 		{
-			Expression: []string{
-				"$round(-0.5)",
-				"$round(-0.3)",
-				"$round(0.5)",
+			Expression: `$contains(23, 3)`,
+			Error: &ArgTypeError{
+				Func:  "contains",
+				Which: 1,
 			},
-			Output: float64(0),
 		},
 		{
-			Expression: []string{
-				"$round(-7.5)",
-				"$round(-8.5)",
+			Expression: `$contains("23", 3)`,
+			Error: &ArgTypeError{
+				Func:  "contains",
+				Which: 2,
 			},
-			Output: float64(-8),
 		},
+	})
+}
+
+func TestFuncSplit(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
 		{
-			Expression: "$round(4.49, 1)",
-			Output:     float64(4.5),
+			Expression: `$split("Hello World", " ")`,
+			Output: []string{
+				"Hello",
+				"World",
+			},
 		},
 		{
-			Expression: "$round(4.525, 2)",
-			Output:     float64(4.52),
+			Expression: `$split("Hello  World", " ")`,
+			Output: []string{
+				"Hello",
+				"",
+				"World",
+			},
 		},
 		{
-			Expression: "$round(4.515, 2)",
-			Output:     float64(4.52),
+			Expression: `$split("Hello", " ")`,
+			Output: []string{
+				"Hello",
+			},
 		},
 		{
-			Expression: "$round(12345, -2)",
-			Output:     float64(12300),
+			Expression: `$split("Hello", "")`,
+			Output: []string{
+				"H",
+				"e",
+				"l",
+				"l",
+				"o",
+			},
+		},
+		{
+			Expression: `$split("超明體繁", "")`,
+			Output: []string{
+				"超",
+				"明",
+				"體",
+				"繁",
+			},
+		},
+		{
+			Expression: `$sum($split("12345", "").$number($))`,
+			Output:     float64(15),
 		},
 		{
 			Expression: []string{
-				"$round(12450, -2)",
-				"$round(12350, -2)",
+				`$split("a, b, c, d", ", ")`,
+				`$split("a, b, c, d", ", ", 10)`,
+				//`$split("a, b, c, d", ",").$trim()`,	// returns ErrUndefined
+			},
+			Output: []string{
+				"a",
+				"b",
+				"c",
+				"d",
 			},
-			Output: float64(12400),
 		},
 		{
-			Expression: "$round(6.022e-23, 24)",
-			Output:     6.0e-23,
+			Expression: []string{
+				`$split("a, b, c, d", ", ", 2)`,
+				`$split("a, b, c, d", ", ", 2.5)`,
+			},
+			Output: []string{
+				"a",
+				"b",
+			},
 		},
 		{
-			Expression: "$round(nothing)",
+			Expression: `$split("a, b, c, d", ", ", 0)`,
+			Output:     []string{},
+		},
+		{
+			Expression: `$split(nothing, " ")`,
 			Error:      ErrUndefined,
 		},
-	})
-}
-
-func TestFuncSqrt(t *testing.T) {
-
-	runTestCases(t, nil, []*testCase{
 		{
-			Expression: "$sqrt(4)",
-			Output:     float64(2),
+			Expression: `$split("a, b, c, d", ", ", -3)`,
+			Error:      jlib.NewArgValueError("split", 3, "D3020", "must evaluate to a positive number"),
 		},
 		{
-			Expression: "$sqrt(2)",
-			Output:     math.Sqrt2,
+			Expression: []string{
+				`$split("a, b, c, d", ", ", null)`,
+				`$split("a, b, c, d", ", ", "2")`,
+				`$split("a, b, c, d", ", ", true)`,
+			},
+			Error: &ArgTypeError{
+				Func:  "split",
+				Which: 3,
+			},
 		},
 		{
-			Expression: "$sqrt(-2)",
-			Error:      fmt.Errorf("the sqrt function cannot be applied to a negative number"),
+			Expression: `$split(12345, 3)`,
+			Error: &ArgTypeError{
+				Func:  "split",
+				Which: 1,
+			},
 		},
 		{
-			Expression: "$sqrt(nothing)",
-			Error:      ErrUndefined,
+			Expression: `$split(12345)`,
+			Error: &ArgTypeError{
+				Func:  "split",
+				Which: 1,
+			},
 		},
-	})
-}
-
-func TestFuncSqrt2(t *testing.T) {
-
-	runTestCasesFunc(t, equalFloats(1e-13), nil, []*testCase{
 		{
-			Expression: "$sqrt(10) * $sqrt(10)",
-			Output:     float64(10),
+			// An undefined limit means no limit. This lets
+			// a partially applied function take an optional
+			// limit.
+			Expression: []string{
+				`$split("a, b, c", ", ", nothing)`,
+				`$split(?, ?, ?)("a, b, c", ", ", nothing)`,
+				`($f := $split(?, ", ", ?); $f("a, b, c", $limit))`,
+			},
+			Output: []string{
+				"a",
+				"b",
+				"c",
+			},
 		},
 	})
 }
 
-func TestFuncPower(t *testing.T) {
+func TestFuncJoin(t *testing.T) {
 
 	runTestCases(t, nil, []*testCase{
 		{
-			Expression: "$power(4,2)",
-			Output:     float64(16),
+			Expression: []string{
+				`$join("hello", "")`,
+				`$join(["hello"], "")`,
+			},
+			Output: "hello",
 		},
 		{
-			Expression: "$power(4,0.5)",
-			Output:     float64(2),
+			Expression: `$join(["hello", "world"], "")`,
+			Output:     "helloworld",
 		},
 		{
-			Expression: "$power(10,-2)",
-			Output:     0.01,
+			Expression: `$join(["hello", "world"], ", ")`,
+			Output:     "hello, world",
 		},
 		{
-			Expression: "$power(-2,3)",
-			Output:     float64(-8),
+			Expression: `$join(["超","明","體","繁"])`,
+			Output:     "超明體繁",
 		},
 		{
-			Expression: "$power(nothing,3)",
-			Error:      ErrUndefined,
+			Expression: `$join([], ", ")`,
+			Output:     "",
 		},
 		{
-			Expression: "$power(-2,1/3)",
-			Error:      fmt.Errorf("the power function has resulted in a value that cannot be represented as a JSON number"),
+			Expression: []string{
+				`$join(true, ", ")`,
+				`$join([1,2,3], ", ")`,
+			},
+			Error: &ArgTypeError{
+				Func:    "join",
+				Which:   1,
+				ArrayOf: "strings",
+			},
 		},
 		{
-			Expression: "$power(100,1000)",
-			Error:      fmt.Errorf("the power function has resulted in a value that cannot be represented as a JSON number"),
+			Expression: `$join("hello", 3)`,
+			Error: &ArgTypeError{
+				Func:  "join",
+				Which: 2,
+			},
+		},
+		{
+			Expression: `$join()`,
+			Error: &ArgCountError{
+				Func:     "join",
+				Expected: 2,
+				Received: 0,
+			},
 		},
 	})
 }
 
-func TestFuncRandom(t *testing.T) {
+func TestFuncJoin2(t *testing.T) {
 
-	runTestCases(t, nil, []*testCase{
+	runTestCases(t, testdata.account, []*testCase{
 		{
-			Expression: "($x := $random(); $x >= 0 and $x < 1)",
-			Output:     true,
+			Expression: `$join(Account.Order.Product.Description.Colour, ", ")`,
+			Output:     "Purple, Orange, Purple, Black",
 		},
 		{
-			Expression: "$random() = $random()",
-			Output:     false,
+			Expression: `$join(Account.Order.Product.Description.Colour, "")`,
+			Output:     "PurpleOrangePurpleBlack",
+		},
+		{
+			Expression: `$join(Account.blah.Product.Description.Colour, ", ")`,
+			Error:      ErrUndefined,
 		},
 	})
 }
 
-func TestFuncKeys(t *testing.T) {
+func TestFuncReplace(t *testing.T) {
 
-	runTestCasesFunc(t, equalArraysUnordered, testdata.account, []*testCase{
+	runTestCases(t, nil, []*testCase{
 		{
-			Expression: "$keys(Account)",
-			Output: []string{
-				"Account Name",
-				"Order",
-			},
+			Expression: `$replace("Hello World", "World", "Everyone")`,
+			Output:     "Hello Everyone",
 		},
 		{
-			Expression: "$keys(Account.Order.Product)",
-			Output: []string{
-				"Product Name",
-				"ProductID",
-				"SKU",
-				"Description",
-				"Price",
-				"Quantity",
-			},
+			Expression: `$replace("the cat sat on the mat", "at", "it")`,
+			Output:     "the cit sit on the mit",
 		},
-	})
-}
-
-func TestFuncKeys2(t *testing.T) {
-
-	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `$keys({"foo":{}})`,
-			Output:     "foo",
-			/*Output: []string{
-				"foo",
-			},*/
+			Expression: `$replace("the cat sat on the mat", "at", "it", 0)`,
+			Output:     "the cat sat on the mat",
 		},
 		{
 			Expression: []string{
-				"$keys({})",
-				`$keys("foo")`,
-				`$keys(function(){1})`,
-				`$keys(["foo", "bar"])`,
+				`$replace("the cat sat on the mat", "at", "it", nothing)`,
+				`$replace(?, ?, ?, ?)("the cat sat on the mat", "at", "it", nothing)`,
 			},
-			Error: ErrUndefined,
-		},
-	})
-}
-
-func TestFuncLookup(t *testing.T) {
-
-	runTestCases(t, testdata.account, []*testCase{
-		{
-			Expression: `$lookup(Account, "Account Name")`,
-			Output:     "Firefly",
+			Output: "the cit sit on the mit",
 		},
 		{
-			Expression: `$lookup(Account.Order.Product, "Product Name")`,
-			Output: []interface{}{
-				"Bowler Hat",
-				"Trilby hat",
-				"Bowler Hat",
-				"Cloak",
-			},
+			Expression: `$replace("the cat sat on the mat", "at", "it", 2)`,
+			Output:     "the cit sit on the mat",
 		},
 		{
-			Expression: `$lookup(Account.Order.Product.ProductID, "Product Name")`,
+			Expression: `$replace(nothing, "at", "it", 2)`,
 			Error:      ErrUndefined,
-			Skip:       true, // returns a type error instead of ErrUndefined
 		},
-	})
-}
-
-func TestFuncLookup2(t *testing.T) {
-
-	data := map[string]interface{}{
-		"temp":      22.7,
-		"wind":      7,
-		"gust":      nil,
-		"timestamp": 1508971317377,
-	}
-
-	runTestCases(t, data, []*testCase{
 		{
-			Expression: []string{
-				`$lookup($, "gust")`,
-				`$lookup($$, "gust")`,
+			Expression: `$replace("hello")`,
+			Error: &ArgCountError{
+				Func:     "replace",
+				Expected: 4,
+				Received: 1,
 			},
-			Output: nil,
 		},
-	})
-}
-
-func TestDefaultContext(t *testing.T) {
-
-	runTestCases(t, "5", []*testCase{
 		{
-			Expression: "$number()",
-			Output:     float64(5),
+			Expression: `$replace("hello", 1)`,
+			Error: &ArgTypeError{
+				Func:  "replace",
+				Which: 2,
+			},
 		},
-	})
-}
-
-func TestDefaultContext2(t *testing.T) {
-
-	runTestCases(t, nil, []*testCase{
 		{
-			Expression: "[1..5].$string()",
-			Output: []interface{}{
-				"1",
-				"2",
-				"3",
-				"4",
-				"5",
+			Expression: `$replace("hello", "l", "1", null)`,
+			Error: &ArgTypeError{
+				Func:  "replace",
+				Which: 4,
 			},
 		},
 		{
-			Expression: `[1..5].("Item " & $string())`,
-			Output: []interface{}{
-				"Item 1",
-				"Item 2",
-				"Item 3",
-				"Item 4",
-				"Item 5",
+			Expression: `$replace(123, 2, 1)`,
+			Error: &ArgTypeError{
+				Func:  "replace",
+				Which: 1,
 			},
 		},
-	})
-}
-
-func TestDefaultContext3(t *testing.T) {
-
-	runTestCases(t, testdata.account, []*testCase{
 		{
-			Expression: `Account.Order.Product.` + "`Product Name`" + `.$uppercase().$substringBefore(" ")`,
-			Output: []interface{}{
-				"BOWLER",
-				"TRILBY",
-				"BOWLER",
-				"CLOAK",
+			Expression: `$replace("hello", 2, 1)`,
+			Error: &ArgTypeError{
+				Func:  "replace",
+				Which: 2,
 			},
 		},
+		{
+			Expression: `$replace("hello", "l", "1", -2)`,
+			Error:      jlib.NewArgValueError("replace", 4, "D3011", "must evaluate to a positive number"),
+		},
+		{
+			Expression: `$replace("hello", "", "bye")`,
+			Error:      jlib.NewArgValueError("replace", 2, "D3010", "can't be an empty string"),
+		},
 	})
 }
 
-func TestApplyOperator(t *testing.T) {
+func TestFormatNumber(t *testing.T) {
 
 	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `
-				(
-					$uppertrim := $trim ~> $uppercase;
-					$uppertrim("   Hello    World   ")
-				)`,
-			Output: "HELLO WORLD",
+			Expression: `$formatNumber(12345.6, "#,###.00")`,
+			Output:     "12,345.60",
 		},
 		{
-			Expression: `"john@example.com" ~> $substringAfter("@") ~> $substringBefore(".")`,
-			Output:     "example",
+			Expression: `$formatNumber(12345678.9, "9,999.99")`,
+			Output:     "12,345,678.90",
 		},
 		{
-			Expression: `
-				(
-					$domain := $substringAfter(?,"@") ~> $substringBefore(?,".");
-					$domain("john@example.com")
-				)`,
-			Output: "example",
+			Expression: `$formatNumber(123412345678.9, "9,9,99.99")`,
+			Output:     "123412345,6,78.90",
 		},
 		{
-			Expression: `
-				(
-					$square := function($x){$x*$x};
-					[1..5] ~> $map($square)
-				)`,
-			Output: []interface{}{
-				float64(1),
-				float64(4),
-				float64(9),
-				float64(16),
-				float64(25),
-			},
+			Expression: `$formatNumber(1234.56789, "9,999.999,999")`,
+			Output:     "1,234.567,890",
 		},
 		{
-			Expression: `
-				(
-					$square := function($x){$x*$x};
-					[1..5] ~> $map($square) ~> $sum()
-				)`,
-			Output: float64(55),
+			Expression: `$formatNumber(123.9, "9999")`,
+			Output:     "0124",
 		},
 		{
-			Expression: `
-				(
-					$betweenBackets := $substringAfter(?, "(") ~> $substringBefore(?, ")");
-					$betweenBackets("test(foo)bar")
-				)`,
-			Output: "foo",
+			Expression: `$formatNumber(0.14, "01%")`,
+			Output:     "14%",
 		},
 		{
-			Expression: `
-				(
-					$square := function($x){$x*$x};
-					$chain := λ($f, $g){λ($x){$g($f($x))}};
-					$instructions := [$sum, $square];
-					$sumsq := $instructions ~> $reduce($chain);
-					[1..5] ~> $sumsq()
-				)`,
-			Output: float64(225),
+			Expression: `$formatNumber(0.4857,"###.###‰")`,
+			Output:     "485.7‰",
 		},
 		{
-			Expression: `
-				(
-					$square := function($x){$x*$x};
-					$chain := λ($f, $g){λ($x){ $x ~> $f ~> $g }};
-					$instructions := [$sum, $square, $string];
-					$sumsq := $instructions ~> $reduce($chain);
-					[1..5] ~> $sumsq()
-				)`,
-			Output: "225",
+			Expression: `$formatNumber(0.14, "###pm", {"per-mille": "pm"})`,
+			Output:     "140pm",
 		},
 		{
-			Expression: `
-				(
-					$square := function($x){$x*$x};
-					$instructions := $sum ~> $square;
-					[1..5] ~> $instructions()
-				)`,
-			Output: float64(225),
+			Expression: `$formatNumber(-6, "000")`,
+			Output:     "-006",
 		},
 		{
-			Expression: `
-				(
-					$square := function($x){$x*$x};
-					$sum_of_squares := $map(?, $square) ~> $sum;
-					[1..5] ~> $sum_of_squares()
-				)`,
-			Output: float64(55),
+			Expression: `$formatNumber(1234.5678, "00.000e0")`,
+			Output:     "12.346e2",
 		},
 		{
-			Expression: `
-				(
-					$times := λ($x, $y) { $x * $y };
-					$product := $reduce(?, $times);
-					$square := function($x){$x*$x};
-					$product_of_squares := $map(?, $square) ~> $product;
-					[1..5] ~> $product_of_squares()
-				)`,
-			Output: float64(14400),
+			Expression: `$formatNumber(1234.5678, "00.000e000")`,
+			Output:     "12.346e002",
 		},
 		{
-			Expression: `
-				(
-					$square := function($x){$x*$x};
-					[1..5] ~> $map($square) ~> $reduce(λ($x, $y) { $x * $y });
-				)`,
-			Output: float64(14400),
+			Expression: `$formatNumber(1234.5678, "①①.①①①e①", {"zero-digit": "\u245f"})`,
+			Output:     "①②.③④⑥e②",
 		},
 		{
-			Expression: `"" ~> $substringAfter("@") ~> $substringBefore(".")`,
-			Output:     "",
+			Expression: []string{
+				`$formatNumber(1234.5678, "𝟎𝟎.𝟎𝟎𝟎e𝟎", {"zero-digit": "𝟎"})`,
+				`$formatNumber(1234.5678, "𝟎𝟎.𝟎𝟎𝟎e𝟎", {"zero-digit": "\ud835\udfce"})`,
+			},
+			Output: "𝟏𝟐.𝟑𝟒𝟔e𝟐",
 		},
 		{
-			Expression: `foo ~> $substringAfter("@") ~> $substringBefore(".")`,
-			Error:      ErrUndefined,
+			Expression: `$formatNumber(0.234, "0.0e0")`,
+			Output:     "2.3e-1",
 		},
-	})
-}
-
-func TestApplyOperator2(t *testing.T) {
-
-	runTestCases(t, testdata.account, []*testCase{
 		{
-			Expression: "Account.Order[0].OrderID ~> $uppercase()",
-			Output:     "ORDER103",
+			Expression: `$formatNumber(0.234, "#.00e0")`,
+			Output:     "0.23e0",
 		},
 		{
-			Expression: "Account.Order[0].OrderID ~> $uppercase() ~> $lowercase()",
-			Output:     "order103",
+			Expression: `$formatNumber(0.123, "#.e9")`,
+			Output:     "0.1e0",
 		},
 		{
-			Expression: "Account.Order.OrderID ~> $join()",
-			Output:     "order103order104",
+			Expression: `$formatNumber(0.234, ".00e0")`,
+			Output:     ".23e0",
 		},
 		{
-			Expression: `Account.Order.OrderID ~> $join(", ")`,
-			Output:     "order103, order104",
+			Expression: `$formatNumber(2392.14*(-36.58), "000,000.000###;###,###.000###")`,
+			Output:     "87,504.4812",
 		},
 		{
-			Expression: "Account.Order.Product.(Price * Quantity) ~> $sum()",
-			Output:     336.36,
+			Expression: `$formatNumber(2.14*86.58,"PREFIX##00.000###SUFFIX")`,
+			Output:     "PREFIX185.2812SUFFIX",
 		},
 		{
-			Expression: `
-				(
-					$prices := Account.Order.Product.Price;
-					$quantities := Account.Order.Product.Quantity;
-					$product := λ($arr) { $arr[0] * $arr[1] };
-					$zip($prices, $quantities) ~> $map($product) ~> $sum()
-				)`,
-			Output: 336.36,
+			Expression: `$formatNumber(1E20,"#,######")`,
+			Output:     "100,000000,000000,000000",
 		},
 		{
-			Expression: `42 ~> "hello"`,
-			Error: &EvalError{
-				Type:  ErrNonCallableApply,
-				Token: `"hello"`,
-				Value: "~>",
+			Expression: `$formatNumber(1234.5, "#.###,00", {"decimal-separator": ",", "grouping-separator": "."})`,
+			Output:     "1.234,50",
+		},
+		{
+			// Round trip a German-style number.
+			Expression: `$number($replace($replace($formatNumber(1234.5, "#.###,00", {"decimal-separator": ",", "grouping-separator": "."}), ".", ""), ",", "."))`,
+			Output:     1234.5,
+		},
+
+		// TODO: Make proper errors for these.
+
+		{
+			Expression: `$formatNumber(20,"#;#;#")`,
+			Error:      fmt.Errorf("picture string must contain 1 or 2 subpictures"),
+		},
+		{
+			Expression: `$formatNumber(20,"#.0.0")`,
+			Error:      fmt.Errorf("a subpicture cannot contain more than one decimal separator"),
+		},
+		{
+			Expression: `$formatNumber(20,"#0%%")`,
+			Error:      fmt.Errorf("a subpicture cannot contain more than one percent character"),
+		},
+		{
+			Expression: `$formatNumber(20,"#0‰‰")`,
+			Error:      fmt.Errorf("a subpicture cannot contain more than one per-mille character"),
+		},
+		{
+			Expression: `$formatNumber(20,"#0%‰")`,
+			Error:      fmt.Errorf("a subpicture cannot contain both percent and per-mille characters"),
+		},
+		{
+			Expression: `$formatNumber(20,".e0")`,
+			Error:      fmt.Errorf("a mantissa part must contain at least one decimal or optional digit"),
+		},
+		{
+			Expression: `$formatNumber(20,"0+.e0")`,
+			Error:      fmt.Errorf("a subpicture cannot contain a passive character that is both preceded by and followed by an active character"),
+		},
+		{
+			Expression: `$formatNumber(20,"0,.e0")`,
+			Error:      fmt.Errorf("a group separator cannot be adjacent to a decimal separator"),
+		},
+		{
+			Expression: `$formatNumber(20,"0,")`,
+			Error:      fmt.Errorf("an integer part cannot end with a group separator"),
+		},
+		{
+			Expression: `$formatNumber(20,"0,,0")`,
+			Error:      fmt.Errorf("a subpicture cannot contain adjacent group separators"),
+		},
+		{
+			Expression: `$formatNumber(20,"0#.e0")`,
+			Error:      fmt.Errorf("an integer part cannot contain a decimal digit followed by an optional digit"),
+		},
+		{
+			Expression: `$formatNumber(20,"#0.#0e0")`,
+			Error:      fmt.Errorf("a fractional part cannot contain an optional digit followed by a decimal digit"),
+		},
+		{
+			Expression: `$formatNumber(20,"#0.0e0%")`,
+			Error:      fmt.Errorf("a subpicture cannot contain a percent/per-mille character and an exponent separator"),
+		},
+		{
+			Expression: `$formatNumber(20,"#0.0e0,0")`,
+			Error:      fmt.Errorf("an exponent part must consist solely of one or more decimal digits"),
+		},
+	})
+}
+
+func TestFuncFormatBase(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: "$formatBase(100)",
+			Output:     "100",
+		},
+		{
+			Expression: "$formatBase(nothing)",
+			Error:      ErrUndefined,
+		},
+		{
+			Expression: []string{
+				"$formatBase(100, 2)",
+				"$formatBase(99.5, 2.5)",
 			},
+			Output: "1100100",
+		},
+		{
+			Expression: "$formatBase(-100, 2)",
+			Output:     "-1100100",
+		},
+		{
+			Expression: "$formatBase(100, 1)",
+			Error:      jlib.NewArgValueError("formatBase", 2, "D3100", "must be between 2 and 36"),
+			/*Error: &EvalError1{
+				Errno:    ErrInvalidBase,
+				Position: -3,
+				Value:    "1",
+			},*/
+		},
+		{
+			Expression: "$formatBase(100, 37)",
+			Error:      jlib.NewArgValueError("formatBase", 2, "D3100", "must be between 2 and 36"),
+			/*Error: &EvalError1{
+				Errno:    ErrInvalidBase,
+				Position: -3,
+				Value:    "37",
+			},*/
 		},
 	})
 }
 
-func TestTransformOperator(t *testing.T) {
+func TestFuncFormatInteger(t *testing.T) {
 
-	runTestCases(t, testdata.account, []*testCase{
+	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `$ ~> |Account.Order.Product|{"Total":Price*Quantity},["Description", "SKU"]|`,
-			Output: map[string]interface{}{
-				"Account": map[string]interface{}{
-					"Account Name": "Firefly",
-					"Order": []interface{}{
-						map[string]interface{}{
-							"OrderID": "order103",
-							"Product": []interface{}{
-								map[string]interface{}{
-									"Product Name": "Bowler Hat",
-									"ProductID":    float64(858383),
-									"Price":        34.45,
-									"Quantity":     float64(2),
-									"Total":        68.9,
-								},
-								map[string]interface{}{
-									"Product Name": "Trilby hat",
-									"ProductID":    float64(858236),
-									"Price":        21.67,
-									"Quantity":     float64(1),
-									"Total":        21.67,
-								},
-							},
-						},
-						map[string]interface{}{
-							"OrderID": "order104",
-							"Product": []interface{}{
-								map[string]interface{}{
-									"Product Name": "Bowler Hat",
-									"ProductID":    float64(858383),
-									"Price":        34.45,
-									"Quantity":     float64(4),
-									"Total":        137.8,
-								},
-								map[string]interface{}{
-									"ProductID":    float64(345664),
-									"Product Name": "Cloak",
-									"Price":        107.99,
-									"Quantity":     float64(1),
-									"Total":        107.99,
-								},
-							},
-						},
-					},
-				},
+			Expression: []string{
+				`$formatInteger(1234567, "#,##0")`,
+				`$formatInteger(1234567.9, "#,##0")`,
+				`1234567 ~> $formatInteger("#,##0")`,
 			},
+			Output: "1,234,567",
 		},
 		{
-			Expression: `Account.Order ~> |Product|{"Total":Price*Quantity},["Description", "SKU"]|`,
+			Expression: `$formatInteger(42, "0000")`,
+			Output:     "0042",
+		},
+		{
+			Expression: `$formatInteger(1999, "I")`,
+			Output:     "MCMXCIX",
+		},
+		{
+			Expression: `$formatInteger(123, "w")`,
+			Output:     "one hundred and twenty-three",
+		},
+		{
+			Expression: `[1, 2, 3, 11, 22].$formatInteger($, "w;o")`,
 			Output: []interface{}{
-				map[string]interface{}{
-					"OrderID": "order103",
-					"Product": []interface{}{
-						map[string]interface{}{
-							"Product Name": "Bowler Hat",
-							"ProductID":    float64(858383),
-							"Price":        34.45,
-							"Quantity":     float64(2),
-							"Total":        68.9,
-						},
-						map[string]interface{}{
-							"Product Name": "Trilby hat",
-							"ProductID":    float64(858236),
-							"Price":        21.67,
-							"Quantity":     float64(1),
-							"Total":        21.67,
-						},
-					},
-				},
-				map[string]interface{}{
-					"OrderID": "order104",
-					"Product": []interface{}{
-						map[string]interface{}{
-							"Product Name": "Bowler Hat",
-							"ProductID":    float64(858383),
-							"Price":        34.45,
-							"Quantity":     float64(4),
-							"Total":        137.8,
-						},
-						map[string]interface{}{
-							"ProductID":    float64(345664),
-							"Product Name": "Cloak",
-							"Price":        107.99,
-							"Quantity":     float64(1),
-							"Total":        107.99,
-						},
-					},
-				},
+				"first",
+				"second",
+				"third",
+				"eleventh",
+				"twenty-second",
 			},
 		},
 		{
-			Expression: `$ ~> |Account.Order.Product|{"Total":Price*Quantity, "Price": Price * 1.2}|`,
-			Output: map[string]interface{}{
-				"Account": map[string]interface{}{
-					"Account Name": "Firefly",
-					"Order": []interface{}{
-						map[string]interface{}{
-							"OrderID": "order103",
-							"Product": []interface{}{
-								map[string]interface{}{
-									"Product Name": "Bowler Hat",
-									"ProductID":    float64(858383),
-									"SKU":          "0406654608",
-									"Description": map[string]interface{}{
-										"Colour": "Purple",
-										"Width":  float64(300),
-										"Height": float64(200),
-										"Depth":  float64(210),
-										"Weight": 0.75,
-									},
-									"Price":    41.34,
-									"Quantity": float64(2),
-									"Total":    68.9,
-								},
-								map[string]interface{}{
-									"Product Name": "Trilby hat",
-									"ProductID":    float64(858236),
-									"SKU":          "0406634348",
-									"Description": map[string]interface{}{
-										"Colour": "Orange",
-										"Width":  float64(300),
-										"Height": float64(200),
-										"Depth":  float64(210),
-										"Weight": 0.6,
-									},
-									"Price":    26.004,
-									"Quantity": float64(1),
-									"Total":    21.67,
-								},
-							},
-						},
-						map[string]interface{}{
-							"OrderID": "order104",
-							"Product": []interface{}{
-								map[string]interface{}{
-									"Product Name": "Bowler Hat",
-									"ProductID":    float64(858383),
-									"SKU":          "040657863",
-									"Description": map[string]interface{}{
-										"Colour": "Purple",
-										"Width":  float64(300),
-										"Height": float64(200),
-										"Depth":  float64(210),
-										"Weight": 0.75,
-									},
-									"Price":    41.34,
-									"Quantity": float64(4),
-									"Total":    137.8,
-								},
-								map[string]interface{}{
-									"ProductID":    float64(345664),
-									"SKU":          "0406654603",
-									"Product Name": "Cloak",
-									"Description": map[string]interface{}{
-										"Colour": "Black",
-										"Width":  float64(30),
-										"Height": float64(20),
-										"Depth":  float64(210),
-										"Weight": float64(2),
-									},
-									"Price":    129.588,
-									"Quantity": float64(1),
-									"Total":    107.99,
-								},
-							},
-						},
-					},
-				},
+			Expression: `[1, 2, 3, 11, 22].$formatInteger($, "0;o")`,
+			Output: []interface{}{
+				"1st",
+				"2nd",
+				"3rd",
+				"11th",
+				"22nd",
+			},
+		},
+		{
+			Expression: `$formatInteger(nothing, "0")`,
+			Error:      ErrUndefined,
+		},
+		{
+			Expression: `$formatInteger(1, "x")`,
+			Error: &jxpath.PictureError{
+				Picture: "x",
+				Reason:  `unsupported format token "x"`,
 			},
 		},
 		{
+			Expression: `$formatInteger(-9223372036854774784, "#,##0")`,
+			Output:     "-9,223,372,036,854,774,784",
+		},
+		{
+			// Numbers that do not fit in an int are rejected.
 			Expression: []string{
-				`$ ~> |Account.Order.Product|{},"Description"|`,
-				`$ ~> |Account.Order.Product|nomatch,"Description"|`,
+				`$formatInteger(1e20, "0")`,
+				`$formatInteger(-1e20, "w")`,
+				`$formatInteger(9223372036854775808, "0")`,
+				`$formatInteger(-9223372036854775808, "0")`,
 			},
-			Output: map[string]interface{}{
-				"Account": map[string]interface{}{
-					"Account Name": "Firefly",
-					"Order": []interface{}{
-						map[string]interface{}{
-							"OrderID": "order103",
-							"Product": []interface{}{
-								map[string]interface{}{
-									"Product Name": "Bowler Hat",
-									"ProductID":    float64(858383),
-									"SKU":          "0406654608",
-									"Price":        34.45,
-									"Quantity":     float64(2),
-								},
-								map[string]interface{}{
-									"Product Name": "Trilby hat",
-									"ProductID":    float64(858236),
-									"SKU":          "0406634348",
-									"Price":        21.67,
-									"Quantity":     float64(1),
-								},
-							},
-						},
-						map[string]interface{}{
-							"OrderID": "order104",
-							"Product": []interface{}{
-								map[string]interface{}{
-									"Product Name": "Bowler Hat",
-									"ProductID":    float64(858383),
-									"SKU":          "040657863",
-									"Price":        34.45,
-									"Quantity":     float64(4),
-								},
-								map[string]interface{}{
-									"ProductID":    float64(345664),
-									"SKU":          "0406654603",
-									"Product Name": "Cloak",
-									"Price":        107.99,
-									"Quantity":     float64(1),
-								},
-							},
-						},
-					},
-				},
+			Error: jlib.NewArgValueError("formatInteger", 1, "", "must be between -9223372036854775807 and 9223372036854775807"),
+		},
+	})
+}
+
+func TestFuncParseInteger(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: []string{
+				`$parseInteger("1,234,567", "#,##0")`,
+				`"1,234,567" ~> $parseInteger("#,##0")`,
 			},
+			Output: float64(1234567),
 		},
 		{
-			Expression: `$ ~> |(Account.Order.Product)[0]|{"Description":"blah"}|`,
-			Output: map[string]interface{}{
-				"Account": map[string]interface{}{
-					"Account Name": "Firefly",
-					"Order": []interface{}{
-						map[string]interface{}{
-							"OrderID": "order103",
-							"Product": []interface{}{
-								map[string]interface{}{
-									"Product Name": "Bowler Hat",
-									"ProductID":    float64(858383),
-									"SKU":          "0406654608",
-									"Description":  "blah",
-									"Price":        34.45,
-									"Quantity":     float64(2),
-								},
-								map[string]interface{}{
-									"Product Name": "Trilby hat",
-									"ProductID":    float64(858236),
-									"SKU":          "0406634348",
-									"Description": map[string]interface{}{
-										"Colour": "Orange",
-										"Width":  float64(300),
-										"Height": float64(200),
-										"Depth":  float64(210),
-										"Weight": 0.6,
-									},
-									"Price":    21.67,
-									"Quantity": float64(1),
-								},
-							},
-						},
-						map[string]interface{}{
-							"OrderID": "order104",
-							"Product": []interface{}{
-								map[string]interface{}{
-									"Product Name": "Bowler Hat",
-									"ProductID":    float64(858383),
-									"SKU":          "040657863",
-									"Description": map[string]interface{}{
-										"Colour": "Purple",
-										"Width":  float64(300),
-										"Height": float64(200),
-										"Depth":  float64(210),
-										"Weight": 0.75,
-									},
-									"Price":    34.45,
-									"Quantity": float64(4),
-								},
-								map[string]interface{}{
-									"ProductID":    float64(345664),
-									"SKU":          "0406654603",
-									"Product Name": "Cloak",
-									"Description": map[string]interface{}{
-										"Colour": "Black",
-										"Width":  float64(30),
-										"Height": float64(20),
-										"Depth":  float64(210),
-										"Weight": float64(2),
-									},
-									"Price":    107.99,
-									"Quantity": float64(1),
-								},
-							},
-						},
-					},
-				},
+			Expression: `$parseInteger("MCMXCIX", "I")`,
+			Output:     float64(1999),
+		},
+		{
+			Expression: `$parseInteger("one hundred and twenty-three", "w")`,
+			Output:     float64(123),
+		},
+		{
+			Expression: `$parseInteger("twenty-second", "w;o")`,
+			Output:     float64(22),
+		},
+		{
+			Expression: `[1, 12, 345, 6789].($parseInteger($formatInteger($, "Ww;o"), "Ww;o"))`,
+			Output: []interface{}{
+				float64(1),
+				float64(12),
+				float64(345),
+				float64(6789),
+			},
+		},
+		{
+			Expression: `$parseInteger(nothing, "0")`,
+			Error:      ErrUndefined,
+		},
+		{
+			Expression: `$parseInteger("12", "")`,
+			Error: &jxpath.PictureError{
+				Picture: "",
+				Reason:  "picture string cannot be empty",
+			},
+		},
+		{
+			Expression: `$parseInteger("12a", "0")`,
+			Error: &jxpath.MatchError{
+				Value:   "12a",
+				Picture: "0",
+			},
+		},
+	})
+}
+
+func TestFuncBase64Encode(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: `$base64encode("hello:world")`,
+			Output:     "aGVsbG86d29ybGQ=",
+		},
+		{
+			Expression: `$base64encode(nothing)`,
+			Error:      ErrUndefined,
+		},
+	})
+}
+
+func TestFuncBase64Decode(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: `$base64decode("aGVsbG86d29ybGQ=")`,
+			Output:     "hello:world",
+		},
+		{
+			Expression: `$base64decode(nothing)`,
+			Error:      ErrUndefined,
+		},
+		{
+			Expression: `$base64decode("not base64!")`,
+			Error:      jlib.NewArgValueError("base64decode", 1, "", "must be a valid base 64 string"),
+		},
+	})
+}
+
+func TestCryptoExts(t *testing.T) {
+
+	runTestCases(t, "hello", []*testCase{
+		{
+			Expression: `$sha256("hello")`,
+			Exts:       CryptoExts(),
+			Output:     "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		},
+		{
+			// Each function uses the context if it is called
+			// without an argument.
+			Expression: `$sha1()`,
+			Exts:       CryptoExts(),
+			Output:     "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d",
+		},
+		{
+			Expression: `$md5($)`,
+			Exts:       CryptoExts(),
+			Output:     "5d41402abc4b2a76b9719d911017c592",
+		},
+		{
+			Expression: `$hexDecode($hexEncode("hello"))`,
+			Exts:       CryptoExts(),
+			Output:     "hello",
+		},
+		{
+			Expression: `$base64urlEncode("??>")`,
+			Exts:       CryptoExts(),
+			Output:     "Pz8-",
+		},
+		{
+			Expression: `$base64urlDecode("Pz8-")`,
+			Exts:       CryptoExts(),
+			Output:     "??>",
+		},
+		{
+			Expression: `$sha256(nothing)`,
+			Exts:       CryptoExts(),
+			Error:      ErrUndefined,
+		},
+	})
+
+	// The functions are not registered by default.
+	if _, err := MustCompile(`$sha256("hello")`).Eval(nil); err == nil {
+		t.Errorf("expected an error calling $sha256 without CryptoExts")
+	}
+
+	e, err := CompileWithExts(`$sha256("a", "b")`, CryptoExts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Eval(nil); err == nil {
+		t.Errorf("expected an error calling $sha256 with two arguments")
+	}
+
+	e, err = CompileWithExts(`$hexDecode("xyz")`, CryptoExts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.Eval(nil)
+	var argErr *jlib.ArgValueError
+	if !errors.As(err, &argErr) || argErr.Func != "hexDecode" {
+		t.Errorf("expected an ArgValueError from $hexDecode, got %v", err)
+	}
+}
+
+func TestFuncEncodeUrl(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: `$encodeUrl("https://mozilla.org/?x=шеллы&y=a b")`,
+			Output:     "https://mozilla.org/?x=%D1%88%D0%B5%D0%BB%D0%BB%D1%8B&y=a%20b",
+		},
+		{
+			Expression: `$encodeUrlComponent("?x=шеллы&y=a b")`,
+			Output:     "%3Fx%3D%D1%88%D0%B5%D0%BB%D0%BB%D1%8B%26y%3Da%20b",
+		},
+		{
+			Expression: `["a/b"].$encodeUrlComponent()`,
+			Output:     "a%2Fb",
+		},
+		{
+			Expression: []string{
+				`$encodeUrl(nothing)`,
+				`$encodeUrlComponent(nothing)`,
+			},
+			Error: ErrUndefined,
+		},
+		{
+			Expression: `$encodeUrlComponent("\uFFFD")`,
+			Error:      jlib.NewArgValueError("encodeUrlComponent", 0, "D3140", "malformed URL passed to encodeUrlComponent(): \"\uFFFD\""),
+		},
+		{
+			Expression: `$encodeUrl(1)`,
+			Error: &ArgTypeError{
+				Func:  "encodeUrl",
+				Which: 1,
+			},
+		},
+		{
+			Expression: `$encodeUrlComponent("a", "b")`,
+			Error: &ArgCountError{
+				Func:     "encodeUrlComponent",
+				Expected: 1,
+				Received: 2,
+			},
+		},
+	})
+}
+
+func TestFuncDecodeUrl(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: `$decodeUrl("https://mozilla.org/?x=%D1%88%D0%B5%D0%BB%D0%BB%D1%8B%26y")`,
+			Output:     "https://mozilla.org/?x=шеллы%26y",
+		},
+		{
+			Expression: `$decodeUrlComponent("%3Fx%3D%D1%88%D0%B5%D0%BB%D0%BB%D1%8B%26y")`,
+			Output:     "?x=шеллы&y",
+		},
+		{
+			Expression: []string{
+				`$decodeUrl(nothing)`,
+				`$decodeUrlComponent(nothing)`,
+			},
+			Error: ErrUndefined,
+		},
+		{
+			Expression: `$decodeUrl("%E0%A4%A")`,
+			Error:      jlib.NewArgValueError("decodeUrl", 0, "D3140", `malformed URL passed to decodeUrl(): "%E0%A4%A"`),
+		},
+		{
+			Expression: `$decodeUrlComponent("%E0%A4%A")`,
+			Error:      jlib.NewArgValueError("decodeUrlComponent", 0, "D3140", `malformed URL passed to decodeUrlComponent(): "%E0%A4%A"`),
+		},
+		{
+			Expression: `$decodeUrlComponent(true)`,
+			Error: &ArgTypeError{
+				Func:  "decodeUrlComponent",
+				Which: 1,
+			},
+		},
+		{
+			Expression: `$decodeUrl("a", "b")`,
+			Error: &ArgCountError{
+				Func:     "decodeUrl",
+				Expected: 1,
+				Received: 2,
+			},
+		},
+	})
+}
+
+func TestFuncNumber(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: []string{
+				"$number(0)",
+				`$number("0")`,
+			},
+			Output: float64(0),
+		},
+		{
+			Expression: []string{
+				"$number(10)",
+				`$number("10")`,
+			},
+			Output: float64(10),
+		},
+		{
+			Expression: []string{
+				"$number(-0.05)",
+				`$number("-0.05")`,
+			},
+			Output: -0.05,
+		},
+		{
+			Expression: `$number("1e2")`,
+			Output:     float64(100),
+		},
+		{
+			Expression: `$number("-1e2")`,
+			Output:     float64(-100),
+		},
+		{
+			Expression: `$number("1.0e-2")`,
+			Output:     0.01,
+		},
+		{
+			Expression: `$number("1e0")`,
+			Output:     float64(1),
+		},
+		{
+			Expression: `$number("10e500")`,
+			Error:      jlib.NewArgValueError("number", 0, "D3030", fmt.Sprintf("unable to cast %q to a number", "10e500")),
+			/*Error: &EvalError1{
+				Errno:    ErrCastNumber,
+				Position: -10,
+				Value:    "10e500",
+			},*/
+		},
+		{
+			Expression: `$number("Hello world")`,
+			Error:      jlib.NewArgValueError("number", 0, "D3030", fmt.Sprintf("unable to cast %q to a number", "Hello world")),
+			/*Error: &EvalError1{
+				Errno:    ErrCastNumber,
+				Position: -10,
+				Value:    "Hello world",
+			},*/
+		},
+		{
+			Expression: `$number("1/2")`,
+			Error:      jlib.NewArgValueError("number", 0, "D3030", fmt.Sprintf("unable to cast %q to a number", "1/2")),
+			/*Error: &EvalError1{
+				Errno:    ErrCastNumber,
+				Position: -10,
+				Value:    "1/2",
+			},*/
+		},
+		{
+			Expression: `$number("1234 hello")`,
+			Error:      jlib.NewArgValueError("number", 0, "D3030", fmt.Sprintf("unable to cast %q to a number", "1234 hello")),
+			/*Error: &EvalError1{
+				Errno:    ErrCastNumber,
+				Position: -10,
+				Value:    "1234 hello",
+			},*/
+		},
+		{
+			Expression: `$number("")`,
+			Error:      jlib.NewArgValueError("number", 0, "D3030", fmt.Sprintf("unable to cast %q to a number", "")),
+			/*Error: &EvalError1{
+				Errno:    ErrCastNumber,
+				Position: -10,
+				Value:    "",
+			},*/
+		},
+		{
+			Expression: `$number("[1]")`,
+			Error:      jlib.NewArgValueError("number", 0, "D3030", fmt.Sprintf("unable to cast %q to a number", "[1]")),
+			/*Error: &EvalError1{
+				Errno:    ErrCastNumber,
+				Position: -10,
+				Value:    "[1]",
+			},*/
+		},
+
+		{
+			Expression: `$number(true)`,
+			Output:     1.,
+		},
+		{
+			Expression: `$number(false)`,
+			Output:     0.,
+		},
+		{
+			Expression: `$number(null)`,
+			Error: &ArgTypeError{
+				Func:  "number",
+				Which: 1,
+			},
+		},
+		{
+			Expression: `$number([])`,
+			Error: &ArgTypeError{
+				Func:  "number",
+				Which: 1,
+			},
+		},
+		{
+			Expression: `$number([1,2])`,
+			Error: &ArgTypeError{
+				Func:  "number",
+				Which: 1,
+			},
+		},
+		{
+			Expression: `$number(["hello"])`,
+			Error: &ArgTypeError{
+				Func:  "number",
+				Which: 1,
+			},
+		},
+		{
+			Expression: `$number(["2"])`,
+			Error: &ArgTypeError{
+				Func:  "number",
+				Which: 1,
+			},
+		},
+		{
+			Expression: `$number({})`,
+			Error: &ArgTypeError{
+				Func:  "number",
+				Which: 1,
+			},
+		},
+		{
+			Expression: `$number({"hello":"world"})`,
+			Error: &ArgTypeError{
+				Func:  "number",
+				Which: 1,
+			},
+		},
+		{
+			Expression: `$number($number)`,
+			Error: &ArgTypeError{
+				Func:  "number",
+				Which: 1,
+			},
+		},
+		{
+			Expression: `$number(1,2)`,
+			Error: &ArgCountError{
+				Func:     "number",
+				Expected: 1,
+				Received: 2,
+			},
+		},
+		{
+			Expression: `$number(nothing)`,
+			Error:      ErrUndefined,
+		},
+	})
+}
+
+func TestFuncAbs(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: []string{
+				"$abs(3.7)",
+				"$abs(-3.7)",
+			},
+			Output: 3.7,
+		},
+		{
+			Expression: "$abs(0)",
+			Output:     float64(0),
+		},
+		{
+			Expression: "$abs(nothing)",
+			Error:      ErrUndefined,
+		},
+	})
+}
+
+func TestFuncFloor(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: "$floor(3.7)",
+			Output:     float64(3),
+		},
+		{
+			Expression: "$floor(-3.7)",
+			Output:     float64(-4),
+		},
+		{
+			Expression: "$floor(0)",
+			Output:     float64(0),
+		},
+		{
+			Expression: "$floor(nothing)",
+			Error:      ErrUndefined,
+		},
+	})
+}
+
+func TestFuncCeil(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: "$ceil(3.7)",
+			Output:     float64(4),
+		},
+		{
+			Expression: "$ceil(-3.7)",
+			Output:     float64(-3),
+		},
+		{
+			Expression: "$ceil(0)",
+			Output:     float64(0),
+		},
+		{
+			Expression: "$ceil(nothing)",
+			Error:      ErrUndefined,
+		},
+	})
+}
+
+func TestFuncRound(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: "$round(4)",
+			Output:     float64(4),
+		},
+		{
+			Expression: "$round(2.3)",
+			Output:     float64(2),
+		},
+		{
+			Expression: "$round(2.7)",
+			Output:     float64(3),
+		},
+		{
+			Expression: []string{
+				"$round(2.7, nothing)",
+				"$round(?, ?)(2.7, nothing)",
+			},
+			Output: float64(3),
+		},
+		{
+			Expression: "$round(2.5)",
+			Output:     float64(2),
+		},
+		{
+			Expression: "$round(3.5)",
+			Output:     float64(4),
+		},
+		{
+			Expression: []string{
+				"$round(-0.5)",
+				"$round(-0.3)",
+				"$round(0.5)",
+			},
+			Output: float64(0),
+		},
+		{
+			Expression: []string{
+				"$round(-7.5)",
+				"$round(-8.5)",
+			},
+			Output: float64(-8),
+		},
+		{
+			Expression: "$round(4.49, 1)",
+			Output:     float64(4.5),
+		},
+		{
+			Expression: "$round(4.525, 2)",
+			Output:     float64(4.52),
+		},
+		{
+			Expression: "$round(4.515, 2)",
+			Output:     float64(4.52),
+		},
+		{
+			Expression: "$round(12345, -2)",
+			Output:     float64(12300),
+		},
+		{
+			Expression: []string{
+				"$round(12450, -2)",
+				"$round(12350, -2)",
+			},
+			Output: float64(12400),
+		},
+		{
+			Expression: "$round(6.022e-23, 24)",
+			Output:     6.0e-23,
+		},
+		{
+			Expression: "$round(nothing)",
+			Error:      ErrUndefined,
+		},
+	})
+}
+
+func TestFuncSqrt(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: "$sqrt(4)",
+			Output:     float64(2),
+		},
+		{
+			Expression: "$sqrt(2)",
+			Output:     math.Sqrt2,
+		},
+		{
+			Expression: "$sqrt(-2)",
+			Error:      jlib.NewArgValueError("sqrt", 0, "D3060", "the sqrt function cannot be applied to a negative number"),
+		},
+		{
+			Expression: "$sqrt(nothing)",
+			Error:      ErrUndefined,
+		},
+	})
+}
+
+func TestFuncSqrt2(t *testing.T) {
+
+	runTestCasesFunc(t, equalFloats(1e-13), nil, []*testCase{
+		{
+			Expression: "$sqrt(10) * $sqrt(10)",
+			Output:     float64(10),
+		},
+	})
+}
+
+func TestFuncPower(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: "$power(4,2)",
+			Output:     float64(16),
+		},
+		{
+			Expression: "$power(4,0.5)",
+			Output:     float64(2),
+		},
+		{
+			Expression: "$power(10,-2)",
+			Output:     0.01,
+		},
+		{
+			Expression: "$power(-2,3)",
+			Output:     float64(-8),
+		},
+		{
+			Expression: "$power(nothing,3)",
+			Error:      ErrUndefined,
+		},
+		{
+			Expression: "$power(-2,1/3)",
+			Error:      jlib.NewArgValueError("power", 0, "D3061", "the power function has resulted in a value that cannot be represented as a JSON number"),
+		},
+		{
+			Expression: "$power(100,1000)",
+			Error:      jlib.NewArgValueError("power", 0, "D3061", "the power function has resulted in a value that cannot be represented as a JSON number"),
+		},
+	})
+}
+
+func TestFuncRandom(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: "($x := $random(); $x >= 0 and $x < 1)",
+			Output:     true,
+		},
+		{
+			Expression: "$random() = $random()",
+			Output:     false,
+		},
+	})
+}
+
+func TestFuncUUID(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: `$uuid() ~> $match(/^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$/) ~> $exists()`,
+			Output:     true,
+		},
+		{
+			// Each call returns a new UUID.
+			Expression: `$uuid() = $uuid()`,
+			Output:     false,
+		},
+		{
+			Expression: `$count($distinct([1..100].$uuid()))`,
+			Output:     100,
+		},
+		{
+			Expression: `$uuid("x")`,
+			Error: &ArgCountError{
+				Func:     "uuid",
+				Expected: 0,
+				Received: 1,
+			},
+		},
+	})
+}
+
+func TestStructTags(t *testing.T) {
+
+	type address struct {
+		Street   string `json:"street"`
+		City     string `json:"city,omitempty"`
+		Postcode string
+	}
+
+	type person struct {
+		FirstName string   `json:"first_name"`
+		Surname   string   `json:"surname"`
+		Address   *address `json:"address"`
+		Password  string   `json:"-"`
+		age       int
+	}
+
+	data := person{
+		FirstName: "Fred",
+		Surname:   "Smith",
+		Address: &address{
+			Street:   "Hursley Park",
+			City:     "Winchester",
+			Postcode: "SO21 2JN",
+		},
+		Password: "hunter2",
+		age:      28,
+	}
+
+	runTestCases(t, data, []*testCase{
+		{
+			Expression: `first_name & " " & surname`,
+			Output:     "Fred Smith",
+		},
+		{
+			Expression: []string{
+				`address.city`,
+				`$lookup(address, "city")`,
+			},
+			Output: "Winchester",
+		},
+		{
+			Expression: `address.Postcode`,
+			Output:     "SO21 2JN",
+		},
+		{
+			// Go field names are not used when a field has
+			// a json tag.
+			Expression: []string{
+				`FirstName`,
+				`address.City`,
+			},
+			Error: ErrUndefined,
+		},
+		{
+			// Fields tagged "-" and unexported fields are hidden.
+			Expression: []string{
+				`Password`,
+				`age`,
+				`$lookup($, "Password")`,
+			},
+			Error: ErrUndefined,
+		},
+		{
+			Expression: `$keys()`,
+			Output: []string{
+				"first_name",
+				"surname",
+				"address",
+			},
+		},
+		{
+			Expression: `$keys(address)`,
+			Output: []string{
+				"street",
+				"city",
+				"Postcode",
+			},
+		},
+		{
+			Expression: `$spread(address)`,
+			Output: []interface{}{
+				map[string]interface{}{
+					"street": "Hursley Park",
+				},
+				map[string]interface{}{
+					"city": "Winchester",
+				},
+				map[string]interface{}{
+					"Postcode": "SO21 2JN",
+				},
+			},
+		},
+		{
+			Expression: `$each(address, function($v, $k){$k & ": " & $v})`,
+			Output: []interface{}{
+				"street: Hursley Park",
+				"city: Winchester",
+				"Postcode: SO21 2JN",
+			},
+		},
+		{
+			Expression: `$merge([address, {"city": "London"}])`,
+			Output: map[string]interface{}{
+				"street":   "Hursley Park",
+				"city":     "London",
+				"Postcode": "SO21 2JN",
+			},
+		},
+		{
+			Expression: `address.*`,
+			Output: []interface{}{
+				"Hursley Park",
+				"Winchester",
+				"SO21 2JN",
+			},
+		},
+		{
+			Expression: `$ ~> |address|{"city": "London"}, ["Postcode"]|`,
+			Output: map[string]interface{}{
+				"first_name": "Fred",
+				"surname":    "Smith",
+				"address": map[string]interface{}{
+					"street": "Hursley Park",
+					"city":   "London",
+				},
+			},
+		},
+	})
+}
+
+type EmbeddedMeta struct {
+	Source string
+	Name   string
+}
+
+type EmbeddedTagged struct {
+	A int
+}
+
+type EmbeddedLeft struct {
+	Dup string
+}
+
+type EmbeddedRight struct {
+	Dup string
+}
+
+type embeddedBase struct {
+	ID      int `json:"id"`
+	Created string
+}
+
+// embeddedItem embeds structs in each of the ways that
+// encoding/json distinguishes.
+type embeddedItem struct {
+	embeddedBase
+	*EmbeddedMeta
+	EmbeddedTagged `json:"tagged"`
+	EmbeddedLeft
+	EmbeddedRight
+	Name string
+}
+
+func TestStructEmbedded(t *testing.T) {
+
+	data := embeddedItem{
+		embeddedBase: embeddedBase{
+			ID:      1,
+			Created: "today",
+		},
+		EmbeddedMeta: &EmbeddedMeta{
+			Source: "import",
+			Name:   "shadowed",
+		},
+		EmbeddedTagged: EmbeddedTagged{
+			A: 2,
+		},
+		EmbeddedLeft: EmbeddedLeft{
+			Dup: "left",
+		},
+		EmbeddedRight: EmbeddedRight{
+			Dup: "right",
+		},
+		Name: "item",
+	}
+
+	runTestCases(t, data, []*testCase{
+		{
+			// Fields of untagged embedded structs are promoted,
+			// even if the embedded struct is unexported.
+			Expression: `[id, Created, Source]`,
+			Output: []interface{}{
+				1,
+				"today",
+				"import",
+			},
+		},
+		{
+			// Shallower fields hide deeper ones.
+			Expression: `Name`,
+			Output:     "item",
+		},
+		{
+			// Tagged embedded structs are not promoted.
+			Expression: `[tagged.A, $exists(A)]`,
+			Output: []interface{}{
+				2,
+				false,
+			},
+		},
+		{
+			// Conflicting fields at the same depth are hidden.
+			Expression: []string{
+				`Dup`,
+				`EmbeddedMeta`,
+				`embeddedBase`,
+			},
+			Error: ErrUndefined,
+		},
+		{
+			Expression: `$keys()`,
+			Output: []string{
+				"id",
+				"Created",
+				"Source",
+				"tagged",
+				"Name",
+			},
+		},
+	})
+
+	// The visible fields are the ones that encoding/json uses.
+	b, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for key := range decoded {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var exp []interface{}
+	for _, key := range keys {
+		exp = append(exp, key)
+	}
+
+	output, err := MustCompile(`$sort($keys())`).Eval(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(output, exp) {
+		t.Errorf("expected keys %v, got %v", exp, output)
+	}
+
+	// Fields promoted from nil embedded pointers are undefined.
+	data.EmbeddedMeta = nil
+
+	runTestCases(t, data, []*testCase{
+		{
+			Expression: `Source`,
+			Error:      ErrUndefined,
+		},
+		{
+			Expression: `$keys()`,
+			Output: []string{
+				"id",
+				"Created",
+				"tagged",
+				"Name",
+			},
+		},
+		{
+			Expression: `*`,
+			Output: []interface{}{
+				1,
+				"today",
+				EmbeddedTagged{
+					A: 2,
+				},
+				"item",
+			},
+		},
+	})
+
+	// EvalTo allocates nil embedded pointers.
+	var out embeddedItem
+	err = MustCompile(`{"id": 3, "Source": "eval", "tagged": {"A": 4}}`).EvalTo(nil, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out.ID != 3 || out.EmbeddedMeta == nil || out.Source != "eval" || out.A != 4 {
+		t.Errorf("unexpected EvalTo result %+v", out)
+	}
+}
+
+// structAccount mirrors testdata/account.json with Go structs.
+type structAccount struct {
+	Account struct {
+		Name  string `json:"Account Name"`
+		Order []struct {
+			OrderID string
+			Product []*structProduct
+		}
+	}
+}
+
+type structProduct struct {
+	Name        string `json:"Product Name"`
+	ProductID   int
+	SKU         string
+	Description struct {
+		Colour string
+		Width  int
+		Height int
+		Depth  int
+		Weight float64
+	}
+	Price    float64
+	Quantity int
+}
+
+func TestStructArrays(t *testing.T) {
+
+	// Decoding the fixture into structs ensures that both
+	// versions hold the same data.
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "account.json"))
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile: %s", err)
+	}
+
+	var account structAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		t.Fatalf("json.Unmarshal: %s", err)
+	}
+
+	// Expressions should produce the same results whether
+	// they are evaluated against structs or decoded JSON.
+	exprs := []string{
+		`Account.Order.Product[Price > 30].SKU`,
+		`Account.Order[OrderID = "order104"].Product.` + "`Product Name`",
+		`Account.Order.Product[Description.Colour = "Purple"].Price`,
+		`Account.Order.Product[Quantity in [1, 4]].SKU`,
+		`"Cloak" in Account.Order.Product.` + "`Product Name`",
+		`Account.Order.Product[SKU in ["0406654608", "0406654603"]].ProductID`,
+		`Account.Order.Product{` + "`Product Name`" + `: $sum(Price)}`,
+		`Account.Order.Product[Price < 100]{SKU: Quantity}`,
+		`Account.Order{OrderID: $sum(Product.(Price * Quantity))}`,
+		`Account.Order.Product^(>Price).SKU`,
+		`Account.Order.Product.{"order": %.OrderID, "account": %.%.` + "`Account Name`" + `}`,
+		`Account.Order#$i.Product[$i = 1].SKU`,
+		`Account.Order@$o.$o.Product[Price > 30].{"order": $o.OrderID, "sku": SKU}`,
+		`$count(Account.Order.Product[Description.Weight > 0.7])`,
+		`$sum(Account.Order.Product.Quantity)`,
+		`**.Colour`,
+	}
+
+	for _, expr := range exprs {
+
+		e := MustCompile(expr)
+
+		exp, err := e.Eval(testdata.account)
+		if err != nil {
+			t.Errorf("%s: Eval against decoded JSON returned error %s", expr, err)
+			continue
+		}
+
+		got, err := e.Eval(account)
+		if err != nil {
+			t.Errorf("%s: Eval against structs returned error %s", expr, err)
+			continue
+		}
+
+		// Compare the JSON encodings to ignore differences
+		// in numeric types.
+		b1, _ := json.Marshal(exp)
+		b2, _ := json.Marshal(got)
+		if !bytes.Equal(b1, b2) {
+			t.Errorf("%s: expected %s, got %s", expr, b1, b2)
+		}
+	}
+
+	// Filter a top level array of structs.
+	runTestCases(t, account.Account.Order[1].Product, []*testCase{
+		{
+			Expression: `$[Price > 30].SKU`,
+			Output: []interface{}{
+				"040657863",
+				"0406654603",
+			},
+		},
+		{
+			Expression: `$[Description.Colour = "Black"]{SKU: Quantity}`,
+			Output: map[string]interface{}{
+				"0406654603": 1,
+			},
+		},
+	})
+}
+
+func TestFuncKeys(t *testing.T) {
+
+	runTestCasesFunc(t, equalArraysUnordered, testdata.account, []*testCase{
+		{
+			Expression: "$keys(Account)",
+			Output: []string{
+				"Account Name",
+				"Order",
+			},
+		},
+		{
+			Expression: "$keys(Account.Order.Product)",
+			Output: []string{
+				"Product Name",
+				"ProductID",
+				"SKU",
+				"Description",
+				"Price",
+				"Quantity",
+			},
+		},
+	})
+}
+
+func TestFuncKeys2(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: `$keys({"foo":{}})`,
+			Output:     "foo",
+			/*Output: []string{
+				"foo",
+			},*/
+		},
+		{
+			Expression: []string{
+				"$keys({})",
+				`$keys("foo")`,
+				`$keys(function(){1})`,
+				`$keys(["foo", "bar"])`,
+			},
+			Error: ErrUndefined,
+		},
+	})
+}
+
+func TestFuncLookup(t *testing.T) {
+
+	runTestCases(t, testdata.account, []*testCase{
+		{
+			Expression: `$lookup(Account, "Account Name")`,
+			Output:     "Firefly",
+		},
+		{
+			Expression: `$lookup(Account.Order.Product, "Product Name")`,
+			Output: []interface{}{
+				"Bowler Hat",
+				"Trilby hat",
+				"Bowler Hat",
+				"Cloak",
+			},
+		},
+		{
+			Expression: `$lookup(Account.Order.Product.ProductID, "Product Name")`,
+			Error:      ErrUndefined,
+		},
+	})
+}
+
+func TestFuncLookup2(t *testing.T) {
+
+	data := map[string]interface{}{
+		"temp":      22.7,
+		"wind":      7,
+		"gust":      nil,
+		"timestamp": 1508971317377,
+	}
+
+	runTestCases(t, data, []*testCase{
+		{
+			Expression: []string{
+				`$lookup($, "gust")`,
+				`$lookup($$, "gust")`,
+			},
+			Output: nil,
+		},
+	})
+}
+
+func TestFuncIsNull(t *testing.T) {
+
+	// The same data as TestFuncLookup2, in which gust is
+	// present with a null value.
+	data := map[string]interface{}{
+		"temp":      22.7,
+		"wind":      7,
+		"gust":      nil,
+		"timestamp": 1508971317377,
+	}
+
+	runTestCases(t, data, []*testCase{
+		{
+			Expression: []string{
+				`$isNull(gust)`,
+				`$isNull($lookup($, "gust"))`,
+				`$isNull(null)`,
+				`$exists(gust)`,
+				`gust = null`,
+				`null = gust`,
+				`gust in [null]`,
+				`$type(gust) = "null"`,
+			},
+			Output: true,
+		},
+		{
+			Expression: []string{
+				`$isNull(missing)`,
+				`$isNull($lookup($, "missing"))`,
+				`$isNull(temp)`,
+				`$isNull([null])`,
+				`$isNull({})`,
+				`$exists(missing)`,
+				`missing = null`,
+				`missing != null`,
+				`gust != null`,
+				`$boolean(gust)`,
+			},
+			Output: false,
+		},
+		{
+			// Null is falsy in predicates, so a predicate on
+			// a key that may be null must compare it with null
+			// or call $isNull.
+			Expression: []string{
+				`$[gust]`,
+				`$[missing = null]`,
+				`$[$isNull(missing)]`,
+			},
+			Error: ErrUndefined,
+		},
+		{
+			Expression: []string{
+				`$[gust = null].temp`,
+				`$[$isNull(gust)].temp`,
+				`$[$exists(gust)].temp`,
+			},
+			Output: 22.7,
+		},
+		{
+			Expression: `$keys($)[$isNull($lookup($$, $))]`,
+			Output:     "gust",
+		},
+		{
+			Expression: `$sort($keys($)[$exists($lookup($$, $))])`,
+			Output: []interface{}{
+				"gust",
+				"temp",
+				"timestamp",
+				"wind",
+			},
+		},
+		{
+			Expression: `$isNull()`,
+			Error: &ArgCountError{
+				Func:     "isNull",
+				Expected: 1,
+				Received: 0,
+			},
+		},
+	})
+
+	type weather struct {
+		Temp float64
+		Gust interface{}
+		Peak *float64
+	}
+
+	// Go nils in structs and typed maps are nulls too.
+	inputs := []interface{}{
+		weather{
+			Temp: 22.7,
+		},
+		&weather{
+			Temp: 22.7,
+		},
+		map[string]*float64{
+			"Gust": nil,
+			"Peak": nil,
+		},
+	}
+
+	for _, input := range inputs {
+		runTestCases(t, input, []*testCase{
+			{
+				Expression: []string{
+					`$isNull(Gust)`,
+					`$isNull(Peak)`,
+					`$exists(Gust)`,
+					`Gust = null`,
+					`Peak = null`,
+				},
+				Output: true,
+			},
+			{
+				Expression: []string{
+					`$isNull(Missing)`,
+					`$exists(Missing)`,
+					`Missing = null`,
+				},
+				Output: false,
+			},
+		})
+	}
+}
+
+func TestFuncLookup3(t *testing.T) {
+
+	type stringKey string
+
+	type weather struct {
+		Temp     float64
+		Wind     int
+		Gust     interface{}
+		location string
+	}
+
+	inputs := []interface{}{
+		map[string]float64{
+			"Temp": 22.7,
+			"Wind": 7,
+		},
+		map[stringKey]interface{}{
+			"Temp": 22.7,
+			"Wind": 7,
+			"Gust": nil,
+		},
+		weather{
+			Temp:     22.7,
+			Wind:     7,
+			location: "Winchester",
+		},
+		&weather{
+			Temp:     22.7,
+			Wind:     7,
+			location: "Winchester",
+		},
+	}
+
+	for _, input := range inputs {
+		runTestCases(t, input, []*testCase{
+			{
+				Expression: []string{
+					`$lookup($, "Temp")`,
+					`Temp`,
+				},
+				Output: 22.7,
+			},
+			{
+				Expression: []string{
+					`$lookup($, "Humidity")`,
+					`$lookup($, "location")`,
+					`Humidity`,
+					`location`,
+				},
+				Error: ErrUndefined,
+			},
+		})
+	}
+
+	// Non-string keys are matched by their string form.
+	runTestCases(t, map[int]string{1: "one"}, []*testCase{
+		{
+			Expression: []string{
+				`$lookup($, "1")`,
+				"$.`1`",
+			},
+			Output: "one",
+		},
+		{
+			Expression: []string{
+				`$lookup($, "01")`,
+				"$.`2`",
+			},
+			Error: ErrUndefined,
+		},
+	})
+
+	runTestCases(t, map[bool]string{true: "yes"}, []*testCase{
+		{
+			Expression: "$.`true`",
+			Output:     "yes",
+		},
+	})
+
+	runTestCases(t, map[struct{}]string{{}: "empty"}, []*testCase{
+		{
+			Expression: "$.`{}`",
+			Error:      ErrUndefined,
+		},
+	})
+}
+
+func TestNonStringKeys(t *testing.T) {
+
+	type item struct {
+		Name   string
+		Scores map[int]float64
+		Flags  map[bool]string
+	}
+
+	type point struct {
+		X, Y int
+	}
+
+	data := map[string]interface{}{
+		"items": []item{
+			{
+				Name: "a",
+				Scores: map[int]float64{
+					1: 1.5,
+					2: 2.5,
+				},
+				Flags: map[bool]string{
+					true:  "yes",
+					false: "no",
+				},
+			},
+			{
+				Name: "b",
+				Scores: map[int]float64{
+					3: 3,
+				},
+				Flags: map[bool]string{
+					true: "yes",
+				},
+			},
+		},
+		"grid": map[point]string{
+			{1, 2}: "x",
+		},
+	}
+
+	runTestCases(t, data, []*testCase{
+		{
+			Expression: `items{Name: $sort($keys(Scores))}`,
+			Output: map[string]interface{}{
+				"a": []interface{}{
+					"1",
+					"2",
+				},
+				"b": []interface{}{
+					"3",
+				},
+			},
+		},
+		{
+			Expression: `items{Name: $sort($keys(Flags))}`,
+			Output: map[string]interface{}{
+				"a": []interface{}{
+					"false",
+					"true",
+				},
+				"b": []interface{}{
+					"true",
+				},
+			},
+		},
+		{
+			Expression: `items{Name: $sort($each(Scores, function($v, $k) {$k & "=" & $v}))}`,
+			Output: map[string]interface{}{
+				"a": []interface{}{
+					"1=1.5",
+					"2=2.5",
+				},
+				"b": []interface{}{
+					"3=3",
+				},
+			},
+		},
+		{
+			Expression: `items[1].[$spread(Scores), $spread(Flags)]`,
+			Output: []interface{}{
+				map[string]interface{}{
+					"3": float64(3),
+				},
+				map[string]interface{}{
+					"true": "yes",
+				},
+			},
+		},
+		{
+			Expression: []string{
+				`$merge(items.Scores)`,
+				`$merge(items.Scores) ~> |$|{}|`,
+			},
+			Output: map[string]interface{}{
+				"1": 1.5,
+				"2": 2.5,
+				"3": float64(3),
+			},
+		},
+		{
+			Expression: []string{
+				"items[0].Scores.`2`",
+				`$lookup(items[0].Scores, "2")`,
+			},
+			Output: 2.5,
+		},
+		{
+			Expression: "items[0].Flags.`false`",
+			Output:     "no",
+		},
+		{
+			Expression: `$string(items[0].Flags)`,
+			Output:     `{"false":"no","true":"yes"}`,
+		},
+		{
+			Expression: `$string(items[0].Scores)`,
+			Output:     `{"1":1.5,"2":2.5}`,
+		},
+		{
+			// Maps with different keys are not equal.
+			Expression: `[items[0].Scores = items[1].Scores, items[0].Scores = {"1": 1.5, "2": 2.5}]`,
+			Output: []interface{}{
+				false,
+				true,
+			},
+		},
+		{
+			Expression: `$count($distinct(items.Scores))`,
+			Output:     2,
+		},
+		{
+			Expression: `$keys(grid)`,
+			Error: &EvalError{
+				Type:  ErrNonStringKey,
+				Value: "jsonata.point",
+			},
+		},
+		{
+			Expression: `items{Name: $spread($$.grid)}`,
+			Error: &EvalError{
+				Type:  ErrNonStringKey,
+				Value: "jsonata.point",
+			},
+		},
+		{
+			Expression: `$string(grid)`,
+			Error: &EvalError{
+				Type:  ErrNonStringKey,
+				Value: "jsonata.point",
+			},
+		},
+		{
+			Expression: `grid ~> |$|{}|`,
+			Error: &EvalError{
+				Type:  ErrNonStringKey,
+				Value: "jsonata.point",
+			},
+		},
+		{
+			// Values are still reachable with wildcards.
+			Expression: `grid.*`,
+			Output:     "x",
+		},
+	})
+}
+
+func TestFuncLookup4(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			// Lookups on arrays of objects return a flattened
+			// sequence of the values found.
+			Expression: `$lookup([{"a": 1}, {"b": 2}, {"a": [3, 4]}], "a")`,
+			Output: []interface{}{
+				float64(1),
+				float64(3),
+				float64(4),
+			},
+		},
+		{
+			Expression: `$lookup([{"a": 1}, {"b": 2}], "a")`,
+			Output:     float64(1),
+		},
+		{
+			Expression: `$lookup([{"a": 1}, {"b": 2}], "c")`,
+			Error:      ErrUndefined,
+		},
+	})
+}
+
+func TestDefaultContext(t *testing.T) {
+
+	runTestCases(t, "5", []*testCase{
+		{
+			Expression: "$number()",
+			Output:     float64(5),
+		},
+	})
+}
+
+func TestDefaultContext2(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: "[1..5].$string()",
+			Output: []interface{}{
+				"1",
+				"2",
+				"3",
+				"4",
+				"5",
+			},
+		},
+		{
+			Expression: `[1..5].("Item " & $string())`,
+			Output: []interface{}{
+				"Item 1",
+				"Item 2",
+				"Item 3",
+				"Item 4",
+				"Item 5",
+			},
+		},
+	})
+}
+
+func TestDefaultContext3(t *testing.T) {
+
+	runTestCases(t, testdata.account, []*testCase{
+		{
+			Expression: `Account.Order.Product.` + "`Product Name`" + `.$uppercase().$substringBefore(" ")`,
+			Output: []interface{}{
+				"BOWLER",
+				"TRILBY",
+				"BOWLER",
+				"CLOAK",
+			},
+		},
+	})
+}
+
+func TestApplyOperator(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: `
+				(
+					$uppertrim := $trim ~> $uppercase;
+					$uppertrim("   Hello    World   ")
+				)`,
+			Output: "HELLO WORLD",
+		},
+		{
+			Expression: `"john@example.com" ~> $substringAfter("@") ~> $substringBefore(".")`,
+			Output:     "example",
+		},
+		{
+			Expression: `
+				(
+					$domain := $substringAfter(?,"@") ~> $substringBefore(?,".");
+					$domain("john@example.com")
+				)`,
+			Output: "example",
+		},
+		{
+			Expression: `
+				(
+					$square := function($x){$x*$x};
+					[1..5] ~> $map($square)
+				)`,
+			Output: []interface{}{
+				float64(1),
+				float64(4),
+				float64(9),
+				float64(16),
+				float64(25),
+			},
+		},
+		{
+			Expression: `
+				(
+					$square := function($x){$x*$x};
+					[1..5] ~> $map($square) ~> $sum()
+				)`,
+			Output: float64(55),
+		},
+		{
+			Expression: `
+				(
+					$betweenBackets := $substringAfter(?, "(") ~> $substringBefore(?, ")");
+					$betweenBackets("test(foo)bar")
+				)`,
+			Output: "foo",
+		},
+		{
+			Expression: `
+				(
+					$square := function($x){$x*$x};
+					$chain := λ($f, $g){λ($x){$g($f($x))}};
+					$instructions := [$sum, $square];
+					$sumsq := $instructions ~> $reduce($chain);
+					[1..5] ~> $sumsq()
+				)`,
+			Output: float64(225),
+		},
+		{
+			Expression: `
+				(
+					$square := function($x){$x*$x};
+					$chain := λ($f, $g){λ($x){ $x ~> $f ~> $g }};
+					$instructions := [$sum, $square, $string];
+					$sumsq := $instructions ~> $reduce($chain);
+					[1..5] ~> $sumsq()
+				)`,
+			Output: "225",
+		},
+		{
+			Expression: `
+				(
+					$square := function($x){$x*$x};
+					$instructions := $sum ~> $square;
+					[1..5] ~> $instructions()
+				)`,
+			Output: float64(225),
+		},
+		{
+			Expression: `
+				(
+					$square := function($x){$x*$x};
+					$sum_of_squares := $map(?, $square) ~> $sum;
+					[1..5] ~> $sum_of_squares()
+				)`,
+			Output: float64(55),
+		},
+		{
+			Expression: `
+				(
+					$times := λ($x, $y) { $x * $y };
+					$product := $reduce(?, $times);
+					$square := function($x){$x*$x};
+					$product_of_squares := $map(?, $square) ~> $product;
+					[1..5] ~> $product_of_squares()
+				)`,
+			Output: float64(14400),
+		},
+		{
+			Expression: `
+				(
+					$square := function($x){$x*$x};
+					[1..5] ~> $map($square) ~> $reduce(λ($x, $y) { $x * $y });
+				)`,
+			Output: float64(14400),
+		},
+		{
+			Expression: `"" ~> $substringAfter("@") ~> $substringBefore(".")`,
+			Output:     "",
+		},
+		{
+			Expression: `foo ~> $substringAfter("@") ~> $substringBefore(".")`,
+			Error:      ErrUndefined,
+		},
+	})
+}
+
+func TestApplyOperatorChainErrors(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: `
+				(
+					$f := λ($x)<n:n>{$x * 2} ~> $string ~> $uppercase;
+					$f(2)
+				)`,
+			Output: "4",
+		},
+		{
+			// The middle stage of a three stage chain
+			// rejects its argument.
+			Expression: `
+				(
+					$f := λ($x)<n:n>{$x * 2} ~> λ($y)<s:s>{$y} ~> $uppercase;
+					$f(2)
+				)`,
+			Error: &ChainError{
+				Func:  "lambda",
+				Stage: 2,
+				Err: &ArgTypeError{
+					Func:  "lambda",
+					Which: 1,
+				},
+			},
+		},
+		{
+			// The chain's arguments are checked against the
+			// signature of the first stage.
+			Expression: `
+				(
+					$f := λ($x)<n:n>{$x * 2} ~> $string ~> $uppercase;
+					$f("2")
+				)`,
+			Error: &ChainError{
+				Func:  "lambda",
+				Stage: 1,
+				Err: &ArgTypeError{
+					Func:  "lambda",
+					Which: 1,
+				},
+			},
+		},
+		{
+			Expression: `
+				(
+					$f := λ($x)<n:n>{$x * 2} ~> $string ~> $uppercase;
+					$f(2, 3)
+				)`,
+			Error: &ChainError{
+				Func:  "lambda",
+				Stage: 1,
+				Err: &ArgCountError{
+					Func:     "lambda",
+					Expected: 1,
+					Received: 2,
+				},
+			},
+		},
+		{
+			// Chains of chains number their stages
+			// consecutively.
+			Expression: `
+				(
+					$f := λ($x)<n:n>{$x * 2} ~> $string;
+					$g := $f ~> $number ~> λ($y)<s:s>{$y};
+					$g(2)
+				)`,
+			Error: &ChainError{
+				Func:  "lambda",
+				Stage: 4,
+				Err: &ArgTypeError{
+					Func:  "lambda",
+					Which: 1,
+				},
+			},
+		},
+		{
+			// A chain takes as many arguments as its
+			// first stage.
+			Expression: `
+				(
+					$f := λ($v, $i)<nn:n>{$v * $i} ~> $string;
+					[3, 4] ~> $map($f)
+				)`,
+			Output: []interface{}{
+				"0",
+				"4",
+			},
+		},
+	})
+}
+
+func TestApplyOperator2(t *testing.T) {
+
+	runTestCases(t, testdata.account, []*testCase{
+		{
+			Expression: "Account.Order[0].OrderID ~> $uppercase()",
+			Output:     "ORDER103",
+		},
+		{
+			Expression: "Account.Order[0].OrderID ~> $uppercase() ~> $lowercase()",
+			Output:     "order103",
+		},
+		{
+			Expression: "Account.Order.OrderID ~> $join()",
+			Output:     "order103order104",
+		},
+		{
+			Expression: `Account.Order.OrderID ~> $join(", ")`,
+			Output:     "order103, order104",
+		},
+		{
+			Expression: "Account.Order.Product.(Price * Quantity) ~> $sum()",
+			Output:     336.36,
+		},
+		{
+			Expression: `
+				(
+					$prices := Account.Order.Product.Price;
+					$quantities := Account.Order.Product.Quantity;
+					$product := λ($arr) { $arr[0] * $arr[1] };
+					$zip($prices, $quantities) ~> $map($product) ~> $sum()
+				)`,
+			Output: 336.36,
+		},
+		{
+			Expression: `42 ~> "hello"`,
+			Error: &EvalError{
+				Type:  ErrNonCallableApply,
+				Token: `"hello"`,
+				Value: "~>",
+			},
+		},
+	})
+}
+
+func TestTransformOperator(t *testing.T) {
+
+	runTestCases(t, testdata.account, []*testCase{
+		{
+			Expression: `$ ~> |Account.Order.Product|{"Total":Price*Quantity},["Description", "SKU"]|`,
+			Output: map[string]interface{}{
+				"Account": map[string]interface{}{
+					"Account Name": "Firefly",
+					"Order": []interface{}{
+						map[string]interface{}{
+							"OrderID": "order103",
+							"Product": []interface{}{
+								map[string]interface{}{
+									"Product Name": "Bowler Hat",
+									"ProductID":    float64(858383),
+									"Price":        34.45,
+									"Quantity":     float64(2),
+									"Total":        68.9,
+								},
+								map[string]interface{}{
+									"Product Name": "Trilby hat",
+									"ProductID":    float64(858236),
+									"Price":        21.67,
+									"Quantity":     float64(1),
+									"Total":        21.67,
+								},
+							},
+						},
+						map[string]interface{}{
+							"OrderID": "order104",
+							"Product": []interface{}{
+								map[string]interface{}{
+									"Product Name": "Bowler Hat",
+									"ProductID":    float64(858383),
+									"Price":        34.45,
+									"Quantity":     float64(4),
+									"Total":        137.8,
+								},
+								map[string]interface{}{
+									"ProductID":    float64(345664),
+									"Product Name": "Cloak",
+									"Price":        107.99,
+									"Quantity":     float64(1),
+									"Total":        107.99,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			Expression: `Account.Order ~> |Product|{"Total":Price*Quantity},["Description", "SKU"]|`,
+			Output: []interface{}{
+				map[string]interface{}{
+					"OrderID": "order103",
+					"Product": []interface{}{
+						map[string]interface{}{
+							"Product Name": "Bowler Hat",
+							"ProductID":    float64(858383),
+							"Price":        34.45,
+							"Quantity":     float64(2),
+							"Total":        68.9,
+						},
+						map[string]interface{}{
+							"Product Name": "Trilby hat",
+							"ProductID":    float64(858236),
+							"Price":        21.67,
+							"Quantity":     float64(1),
+							"Total":        21.67,
+						},
+					},
+				},
+				map[string]interface{}{
+					"OrderID": "order104",
+					"Product": []interface{}{
+						map[string]interface{}{
+							"Product Name": "Bowler Hat",
+							"ProductID":    float64(858383),
+							"Price":        34.45,
+							"Quantity":     float64(4),
+							"Total":        137.8,
+						},
+						map[string]interface{}{
+							"ProductID":    float64(345664),
+							"Product Name": "Cloak",
+							"Price":        107.99,
+							"Quantity":     float64(1),
+							"Total":        107.99,
+						},
+					},
+				},
+			},
+		},
+		{
+			Expression: `$ ~> |Account.Order.Product|{"Total":Price*Quantity, "Price": Price * 1.2}|`,
+			Output: map[string]interface{}{
+				"Account": map[string]interface{}{
+					"Account Name": "Firefly",
+					"Order": []interface{}{
+						map[string]interface{}{
+							"OrderID": "order103",
+							"Product": []interface{}{
+								map[string]interface{}{
+									"Product Name": "Bowler Hat",
+									"ProductID":    float64(858383),
+									"SKU":          "0406654608",
+									"Description": map[string]interface{}{
+										"Colour": "Purple",
+										"Width":  float64(300),
+										"Height": float64(200),
+										"Depth":  float64(210),
+										"Weight": 0.75,
+									},
+									"Price":    41.34,
+									"Quantity": float64(2),
+									"Total":    68.9,
+								},
+								map[string]interface{}{
+									"Product Name": "Trilby hat",
+									"ProductID":    float64(858236),
+									"SKU":          "0406634348",
+									"Description": map[string]interface{}{
+										"Colour": "Orange",
+										"Width":  float64(300),
+										"Height": float64(200),
+										"Depth":  float64(210),
+										"Weight": 0.6,
+									},
+									"Price":    26.004,
+									"Quantity": float64(1),
+									"Total":    21.67,
+								},
+							},
+						},
+						map[string]interface{}{
+							"OrderID": "order104",
+							"Product": []interface{}{
+								map[string]interface{}{
+									"Product Name": "Bowler Hat",
+									"ProductID":    float64(858383),
+									"SKU":          "040657863",
+									"Description": map[string]interface{}{
+										"Colour": "Purple",
+										"Width":  float64(300),
+										"Height": float64(200),
+										"Depth":  float64(210),
+										"Weight": 0.75,
+									},
+									"Price":    41.34,
+									"Quantity": float64(4),
+									"Total":    137.8,
+								},
+								map[string]interface{}{
+									"ProductID":    float64(345664),
+									"SKU":          "0406654603",
+									"Product Name": "Cloak",
+									"Description": map[string]interface{}{
+										"Colour": "Black",
+										"Width":  float64(30),
+										"Height": float64(20),
+										"Depth":  float64(210),
+										"Weight": float64(2),
+									},
+									"Price":    129.588,
+									"Quantity": float64(1),
+									"Total":    107.99,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			Expression: []string{
+				`$ ~> |Account.Order.Product|{},"Description"|`,
+				`$ ~> |Account.Order.Product|nomatch,"Description"|`,
+			},
+			Output: map[string]interface{}{
+				"Account": map[string]interface{}{
+					"Account Name": "Firefly",
+					"Order": []interface{}{
+						map[string]interface{}{
+							"OrderID": "order103",
+							"Product": []interface{}{
+								map[string]interface{}{
+									"Product Name": "Bowler Hat",
+									"ProductID":    float64(858383),
+									"SKU":          "0406654608",
+									"Price":        34.45,
+									"Quantity":     float64(2),
+								},
+								map[string]interface{}{
+									"Product Name": "Trilby hat",
+									"ProductID":    float64(858236),
+									"SKU":          "0406634348",
+									"Price":        21.67,
+									"Quantity":     float64(1),
+								},
+							},
+						},
+						map[string]interface{}{
+							"OrderID": "order104",
+							"Product": []interface{}{
+								map[string]interface{}{
+									"Product Name": "Bowler Hat",
+									"ProductID":    float64(858383),
+									"SKU":          "040657863",
+									"Price":        34.45,
+									"Quantity":     float64(4),
+								},
+								map[string]interface{}{
+									"ProductID":    float64(345664),
+									"SKU":          "0406654603",
+									"Product Name": "Cloak",
+									"Price":        107.99,
+									"Quantity":     float64(1),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			Expression: `$ ~> |(Account.Order.Product)[0]|{"Description":"blah"}|`,
+			Output: map[string]interface{}{
+				"Account": map[string]interface{}{
+					"Account Name": "Firefly",
+					"Order": []interface{}{
+						map[string]interface{}{
+							"OrderID": "order103",
+							"Product": []interface{}{
+								map[string]interface{}{
+									"Product Name": "Bowler Hat",
+									"ProductID":    float64(858383),
+									"SKU":          "0406654608",
+									"Description":  "blah",
+									"Price":        34.45,
+									"Quantity":     float64(2),
+								},
+								map[string]interface{}{
+									"Product Name": "Trilby hat",
+									"ProductID":    float64(858236),
+									"SKU":          "0406634348",
+									"Description": map[string]interface{}{
+										"Colour": "Orange",
+										"Width":  float64(300),
+										"Height": float64(200),
+										"Depth":  float64(210),
+										"Weight": 0.6,
+									},
+									"Price":    21.67,
+									"Quantity": float64(1),
+								},
+							},
+						},
+						map[string]interface{}{
+							"OrderID": "order104",
+							"Product": []interface{}{
+								map[string]interface{}{
+									"Product Name": "Bowler Hat",
+									"ProductID":    float64(858383),
+									"SKU":          "040657863",
+									"Description": map[string]interface{}{
+										"Colour": "Purple",
+										"Width":  float64(300),
+										"Height": float64(200),
+										"Depth":  float64(210),
+										"Weight": 0.75,
+									},
+									"Price":    34.45,
+									"Quantity": float64(4),
+								},
+								map[string]interface{}{
+									"ProductID":    float64(345664),
+									"SKU":          "0406654603",
+									"Product Name": "Cloak",
+									"Description": map[string]interface{}{
+										"Colour": "Black",
+										"Width":  float64(30),
+										"Height": float64(20),
+										"Depth":  float64(210),
+										"Weight": float64(2),
+									},
+									"Price":    107.99,
+									"Quantity": float64(1),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			Expression: `Account ~> |Order|{"Product":"blah"},nomatch|`,
+			Output: map[string]interface{}{
+				"Account Name": "Firefly",
+				"Order": []interface{}{
+					map[string]interface{}{
+						"OrderID": "order103",
+						"Product": "blah",
+					},
+					map[string]interface{}{
+						"OrderID": "order104",
+						"Product": "blah",
+					},
+				},
+			},
+		},
+		{
+			Expression: `$ ~> |foo.bar|{"Description":"blah"}|`,
+			Output:     testdata.account,
+		},
+		{
+			Expression: `foo ~> |foo.bar|{"Description":"blah"}|`,
+			Error:      ErrUndefined,
+		},
+		{
+			Expression: `Account ~> |Order|5|`,
+			Error: &EvalError{
+				Type:  ErrIllegalUpdate,
+				Token: "5",
+			},
+		},
+		{
+			Expression: `Account ~> |Order|"blah"|`,
+			Error: &EvalError{
+				Type:  ErrIllegalUpdate,
+				Token: `"blah"`,
+			},
+		},
+		{
+			Expression: `Account ~> |Order|[]|`,
+			Error: &EvalError{
+				Type:  ErrIllegalUpdate,
+				Token: "[]",
+			},
+		},
+		{
+			Expression: `Account ~> |Order|null|`,
+			Error: &EvalError{
+				Type:  ErrIllegalUpdate,
+				Token: "null",
+			},
+		},
+		{
+			Expression: `Account ~> |Order|false|`,
+			Error: &EvalError{
+				Type:  ErrIllegalUpdate,
+				Token: "false",
+			},
+		},
+		{
+			Expression: `Account ~> |Order|{},5|`,
+			Error: &EvalError{
+				Type:  ErrIllegalDelete,
+				Token: "5",
+			},
+		},
+		{
+			Expression: `Account ~> |Order|{},{}|`,
+			Error: &EvalError{
+				Type:  ErrIllegalDelete,
+				Token: "{}",
+			},
+		},
+		{
+			Expression: `Account ~> |Order|{},null|`,
+			Error: &EvalError{
+				Type:  ErrIllegalDelete,
+				Token: "null",
+			},
+		},
+		{
+			Expression: `Account ~> |Order|{},[1,2,3]|`,
+			Error: &EvalError{
+				Type:  ErrIllegalDelete,
+				Token: "[1, 2, 3]",
+			},
+		},
+		{
+			// Updates replace arrays. To append, include the
+			// existing items in the update.
+			Expression: `
+				(
+					$newItem := {"Product Name": "Fez"};
+					$ ~> |Account.Order|{"Product": [Product, $newItem]}|
+				).Account.Order.Product.` + "`Product Name`",
+			Output: []interface{}{
+				"Bowler Hat",
+				"Trilby hat",
+				"Fez",
+				"Bowler Hat",
+				"Cloak",
+				"Fez",
+			},
+		},
+		{
+			Expression: `($ ~> |Account.Order|{"Product": $append(Product[0], {"SKU": "X"})}|).Account.Order.Product.SKU`,
+			Output: []interface{}{
+				"0406654608",
+				"X",
+				"040657863",
+				"X",
+			},
+		},
+		{
+			Expression: `($ ~> |Account.Order|{"Product": [{"SKU": "X"}]}|).Account.Order.Product.SKU`,
+			Output: []interface{}{
+				"X",
+				"X",
+			},
+		},
+		{
+			// Keys with undefined values are skipped.
+			Expression: `($ ~> |Account.Order.Product|{"Discounted": Price > 100 ? true : undefined}|).Account.Order.Product.Discounted`,
+			Output:     true,
+		},
+		{
+			Expression: `($ ~> |Account.Order.Product|{"Price": Price > 100 ? Price * 0.9 : undefined}|).Account.Order.Product.Price`,
+			Output: []interface{}{
+				34.45,
+				21.67,
+				34.45,
+				97.191,
+			},
+		},
+		{
+			// Null values are written.
+			Expression: `($ ~> |Account.Order.Product|{"Discounted": Price > 100 ? true : null}|).Account.Order.Product.Discounted`,
+			Output: []interface{}{
+				nil,
+				nil,
+				nil,
+				true,
+			},
+		},
+		{
+			// Positional patterns update the selected elements
+			// in place.
+			Expression: `($ ~> |(Account.Order.Product)[0]|{"Price": 1}|).Account.Order.Product.Price`,
+			Output: []interface{}{
+				float64(1),
+				21.67,
+				34.45,
+				107.99,
+			},
+		},
+		{
+			Expression: `($ ~> |Account.Order.Product[-1]|{"Price": 1}|).Account.Order.Product.Price`,
+			Output: []interface{}{
+				34.45,
+				float64(1),
+				34.45,
+				float64(1),
+			},
+		},
+		{
+			Expression: `($ ~> |(Account.Order.Product)[[1..2]]|{"Price": 1}|).Account.Order.Product.Price`,
+			Output: []interface{}{
+				34.45,
+				float64(1),
+				float64(1),
+				107.99,
+			},
+		},
+		{
+			Expression: `($ ~> |Account.Order[1].Product[[0..0]]|{"Price": 1}|).Account.Order.[$count(Product), Product[0].Price]`,
+			Output: []interface{}{
+				[]interface{}{
+					2,
+					34.45,
+				},
+				[]interface{}{
+					2,
+					float64(1),
+				},
+			},
+		},
+		{
+			// Paths into nested arrays used to panic.
+			Expression: `{"rows": [[{"a": 1}, {"a": 2}], [{"a": 3}]]}.rows[a = 2]`,
+			Error:      ErrUndefined,
+		},
+	})
+}
+
+func TestRegex(t *testing.T) {
+
+	runTestCasesFunc(t, equalRegexMatches, nil, []*testCase{
+		{
+			Expression: `/ab/ ("ab")`,
+			Output: map[string]interface{}{
+				"match":  "ab",
+				"start":  0,
+				"end":    2,
+				"groups": []string{},
+			},
+		},
+		{
+			Expression: `/ab/ ()`,
+			Error:      ErrUndefined,
+		},
+		{
+			Expression: `/ab+/ ("ababbabbcc")`,
+			Output: map[string]interface{}{
+				"match":  "ab",
+				"start":  0,
+				"end":    2,
+				"groups": []string{},
+			},
+		},
+		{
+			Expression: `/a(b+)/ ("ababbabbcc")`,
+			Output: map[string]interface{}{
+				"match": "ab",
+				"start": 0,
+				"end":   2,
+				"groups": []string{
+					"b",
+				},
+			},
+		},
+		{
+			Expression: `/a(b+)/ ("ababbabbcc").next()`,
+			Output: map[string]interface{}{
+				"match": "abb",
+				"start": 2,
+				"end":   5,
+				"groups": []string{
+					"bb",
+				},
+			},
+		},
+		{
+			Expression: `/a(b+)/ ("ababbabbcc").next().next()`,
+			Output: map[string]interface{}{
+				"match": "abb",
+				"start": 5,
+				"end":   8,
+				"groups": []string{
+					"bb",
+				},
+			},
+		},
+		{
+			Expression: `/a(b+)/ ("ababbabbcc").next().next().next()`,
+			Error:      ErrUndefined,
+		},
+		{
+			Expression: []string{
+				`/a(b+)/i ("Ababbabbcc")`,
+				`/(?i)a(b+)/ ("Ababbabbcc")`,
+			},
+			Output: map[string]interface{}{
+				"match": "Ab",
+				"start": 0,
+				"end":   2,
+				"groups": []string{
+					"b",
+				},
+			},
+		},
+		{
+			Expression: `//`,
+			Error: &jparse.Error{
+				Type:     jparse.ErrEmptyRegex,
+				Position: 1,
+			},
+		},
+		{
+			Expression: `/`,
+			Error: &jparse.Error{
+				Type:     jparse.ErrUnterminatedRegex,
+				Position: 1,
+				Hint:     "/",
+			},
+		},
+	})
+}
+
+func TestRegexFlags(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: `$match("one\ntwo\nthree", /^t\w+$/m).match`,
+			Output: []interface{}{
+				"two",
+				"three",
+			},
+		},
+		{
+			Expression: `$contains("one\ntwo\nthree", /^t\w+$/)`,
+			Output:     false,
+		},
+		{
+			Expression: `$contains("one\ntwo", /e.t/s)`,
+			Output:     true,
+		},
+		{
+			Expression: `$contains("one\ntwo", /e.t/)`,
+			Output:     false,
+		},
+		{
+			Expression: []string{
+				`$contains("One\nTwo", /^two$/im)`,
+				`$contains("One\nTwo", /^two$/mi)`,
+				`$contains("One\nTwo", /(?im)^two$/)`,
+			},
+			Output: true,
+		},
+		{
+			Expression: `$replace("2024-05-01", /
+				(\d{4}) - (\d\d)  # year and month
+				- (\d\d)          # day
+			/x, "$3/$2/$1")`,
+			Output: "01/05/2024",
+		},
+		{
+			// Escaped whitespace and # characters, and those
+			// in character classes, are not removed.
+			Expression: `$match("a # b c", /a\ \#[ ]b [ ] c  # comment/x).match`,
+			Output:     "a # b c",
+		},
+		{
+			Expression: `$match("A B", /a \  b/xi).match`,
+			Output:     "A B",
+		},
+		{
+			Expression: `/ab/g`,
+			Error: &jparse.Error{
+				Type:     jparse.ErrInvalidRegexFlag,
+				Token:    "g",
+				Position: 4,
+			},
+		},
+		{
+			Expression: `$contains("abc", /b/iu)`,
+			Error: &jparse.Error{
+				Type:     jparse.ErrInvalidRegexFlag,
+				Token:    "u",
+				Position: 21,
+			},
+		},
+	})
+}
+
+func TestRegex2(t *testing.T) {
+
+	runTestCases(t, testdata.account, []*testCase{
+		{
+			Expression: []string{
+				`Account.Order.Product[$.` + "`Product Name`" + ` ~> /hat/i].ProductID`,
+				`Account.Order.Product[$.` + "`Product Name`" + ` ~> /(?i)hat/].ProductID`,
+			},
+			Output: []interface{}{
+				float64(858383),
+				float64(858236),
+				float64(858383),
+			},
+		},
+	})
+}
+
+func TestRegexMatch(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: `$match("ababbabbcc",/ab/)`,
+			Output: []map[string]interface{}{
+				{
+					"match":  "ab",
+					"index":  0,
+					"groups": []string{},
+				},
+				{
+					"match":  "ab",
+					"index":  2,
+					"groups": []string{},
+				},
+				{
+					"match":  "ab",
+					"index":  5,
+					"groups": []string{},
+				},
+			},
+		},
+		{
+			Expression: `$match("ababbabbcc",/a(b+)/)`,
+			Output: []map[string]interface{}{
+				{
+					"match": "ab",
+					"index": 0,
+					"groups": []string{
+						"b",
+					},
+				},
+				{
+					"match": "abb",
+					"index": 2,
+					"groups": []string{
+						"bb",
+					},
+				},
+				{
+					"match": "abb",
+					"index": 5,
+					"groups": []string{
+						"bb",
+					},
+				},
+			},
+		},
+		{
+			Expression: `$match("ababbabbcc",/a(b+)/, 1)`,
+			Output: []map[string]interface{}{
+				{
+					"match": "ab",
+					"index": 0,
+					"groups": []string{
+						"b",
+					},
+				},
+			},
+		},
+		{
+			Expression: []string{
+				`$match("ababbabbcc",/a(b+)/, 0)`,
+				`$match("ababbabbcc",/a(xb+)/)`,
+			},
+			Output: []map[string]interface{}{},
+		},
+		{
+			Expression: `$match(nothing,/a(xb+)/)`,
+			Error:      ErrUndefined,
+		},
+		{
+			// An undefined limit means no limit.
+			Expression: []string{
+				`$match("abab", /ab/, nothing).index`,
+				`$match(?, ?, ?)("abab", /ab/, nothing).index`,
+			},
+			Output: []interface{}{
+				0,
+				2,
+			},
+		},
+		{
+			Expression: `$match("a, b, c, d", /ab/, -3)`,
+			Error:      jlib.NewArgValueError("match", 3, "D3040", "must evaluate to a positive number"),
+		},
+		{
+			Expression: `$match(12345, 3)`,
+			Error: &ArgTypeError{
+				Func:  "match",
+				Which: 1,
+			},
+		},
+		{
+			Expression: []string{
+				`$match("a, b, c, d", "ab")`,
+				`$match("a, b, c, d", true)`,
+			},
+			Error: &ArgTypeError{
+				Func:  "match",
+				Which: 2,
+			},
+		},
+		{
+			Expression: []string{
+				`$match("a, b, c, d", /ab/, null)`,
+				`$match("a, b, c, d", /ab/, "2")`,
+			},
+			Error: &ArgTypeError{
+				Func:  "match",
+				Which: 3,
+			},
+		},
+		{
+			Expression: `$match(12345)`,
+			Error: &ArgTypeError{
+				Func:  "match",
+				Which: 1,
+			},
+		},
+	})
+}
+
+func TestRegexReplace(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: `$replace("ababbxabbcc",/b+/, "yy")`,
+			Output:     "ayyayyxayycc",
+		},
+		{
+			Expression: `$replace("ababbxabbcc",/b+/, "yy", 2)`,
+			Output:     "ayyayyxabbcc",
+		},
+		{
+			Expression: `$replace("ababbxabbcc",/b+/, "yy", 0)`,
+			Output:     "ababbxabbcc",
+		},
+		{
+			Expression: `$replace("ababbxabbcc",/d+/, "yy")`,
+			Output:     "ababbxabbcc",
+		},
+		{
+			Expression: `$replace("John Smith", /(\w+)\s(\w+)/, "$2, $1")`,
+			Output:     "Smith, John",
+		},
+		{
+			Expression: `$replace("265USD", /([0-9]+)USD/, "$$$1")`,
+			Output:     "$265",
+		},
+		{
+			Expression: `$replace("265USD", /([0-9]+)USD/, "$w")`,
+			Output:     "$w",
+		},
+		{
+			Expression: `$replace("265USD", /([0-9]+)USD/, "$0 -> $$$1")`,
+			Output:     "265USD -> $265",
+		},
+		{
+			Expression: `$replace("265USD", /([0-9]+)USD/, "$0$1$2")`,
+			Output:     "265USD265",
+		},
+		{
+			Expression: `$replace("abcd", /(ab)|(a)/, "[1=$1][2=$2]")`,
+			Output:     "[1=ab][2=]cd",
+		},
+		{
+			Expression: `$replace("abracadabra", /bra/, "*")`,
+			Output:     "a*cada*",
+		},
+		{
+			Expression: `$replace("abracadabra", /a.*a/, "*")`,
+			Output:     "*",
+		},
+		{
+			Expression: `$replace("abracadabra", /a.*?a/, "*")`,
+			Output:     "*c*bra",
+		},
+		{
+			Expression: `$replace("abracadabra", /a/, "")`,
+			Output:     "brcdbr",
+		},
+		{
+			Expression: `$replace("abracadabra", /a(.)/, "a$1$1")`,
+			Output:     "abbraccaddabbra",
+		},
+		{
+			Expression: `$replace("abracadabra", /.*?/, "$1")`,
+			Skip:       true, // jsonata-js throws error D1004
+		},
+		{
+			Expression: `$replace("AAAA", /A+/, "b")`,
+			Output:     "b",
+		},
+		{
+			Expression: `$replace("AAAA", /A+?/, "b")`,
+			Output:     "bbbb",
+		},
+		{
+			Expression: `$replace("darted", /^(.*?)d(.*)$/, "$1c$2")`,
+			Output:     "carted",
+		},
+		{
+			Expression: `$replace("abcdefghijklmno", /(a)(b)(c)(d)(e)(f)(g)(h)(i)(j)(k)(l)(m)/, "$8$5$12$12$18$123")`,
+			Output:     "hella8l3no",
+		},
+		{
+			Expression: `$replace("abcdefghijklmno", /xyz/, "$8$5$12$12$18$123")`,
+			Output:     "abcdefghijklmno",
+		},
+		{
+			Expression: `$replace("abcdefghijklmno", /ijk/, "$8$5$12$12$18$123")`,
+			Output:     "abcdefgh22823lmno",
+		},
+		{
+			Expression: `$replace("abcdefghijklmno", /(ijk)/, "$8$5$12$12$18$123")`,
+			Output:     "abcdefghijk2ijk2ijk8ijk23lmno",
+		},
+		{
+			Expression: `$replace("abcdefghijklmno", /ijk/, "$x")`,
+			Output:     "abcdefgh$xlmno",
+		},
+		{
+			Expression: `$replace("abcdefghijklmno", /(ijk)/, "$x$")`,
+			Output:     "abcdefgh$x$lmno",
+		},
+	})
+}
+
+func TestRegexReplace2(t *testing.T) {
+
+	runTestCases(t, testdata.account, []*testCase{
+		{
+			Expression: []string{
+				`Account.Order.Product.$replace($.` + "`Product Name`" + `, /hat/i, function($match) { "foo" })`,
+				`Account.Order.Product.$replace($.` + "`Product Name`" + `, /(?i)hat/, function($match) { "foo" })`,
+			},
+			Output: []interface{}{
+				"Bowler foo",
+				"Trilby foo",
+				"Bowler foo",
+				"Cloak",
+			},
+		},
+		{
+			Expression: []string{
+				`Account.Order.Product.$replace($.` + "`Product Name`" + `, /(h)(at)/i, function($match) { $uppercase($match.match) })`,
+				`Account.Order.Product.$replace($.` + "`Product Name`" + `, /(?i)(h)(at)/, function($match) { $uppercase($match.match) })`,
+			},
+			Output: []interface{}{
+				"Bowler HAT",
+				"Trilby HAT",
+				"Bowler HAT",
+				"Cloak",
+			},
+		},
+		{
+			Expression: `Account.Order.Product.$replace($.` + "`Product Name`" + `, /(?i)hat/,
+				function($match) { true })`,
+			Error: jlib.NewArgValueError("replace", 3, "D3012", "must be a function that returns a string"),
+		},
+		{
+			Expression: `Account.Order.Product.$replace($.` + "`Product Name`" + `, /(?i)hat/,
+				function($match) { 42 })`,
+			Error: jlib.NewArgValueError("replace", 3, "D3012", "must be a function that returns a string"),
+		},
+	})
+}
+
+func TestRegexReplace3(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: `$replace("temperature = 68F today", /(-?\d+(?:\.\d*)?)F\b/,
+				function($m) { ($number($m.groups[0]) - 32) * 5/9 & "C" })`,
+			Output: "temperature = 20C today",
+		},
+		{
+			// The match object passed to the function has the
+			// fields of the regex match object as well as those
+			// returned by $match.
+			Expression: `$replace("banana", /a(?P<n>n)?/, function($m) {
+				"[" & $m.start & "-" & $m.end & ":" & $m.index & $m.named.n & ($m.next() ? "+" : "") & "]"
+			}, 2)`,
+			Output: "b[1-3:1n+][3-5:3n+]a",
+		},
+		{
+			// The limit counts matches that are replaced with
+			// empty strings.
+			Expression: `$replace("banana", /a/, function($m) { "" }, 2)`,
+			Output:     "bnna",
+		},
+		{
+			Expression: `$replace("banana", /a/, function($m) { $m.index > 2 ? "" : "a" }, 2)`,
+			Output:     "banna",
+		},
+		{
+			Expression: `$replace("banana", /a/, function($m) { "" }, 0)`,
+			Output:     "banana",
+		},
+		{
+			Expression: `$replace("banana", /a/, function($m) { "" }, 10)`,
+			Output:     "bnn",
+		},
+		{
+			Expression: `$replace("banana", /a/, function($m) { $m.start }, 1)`,
+			Error:      jlib.NewArgValueError("replace", 3, "D3012", "must be a function that returns a string"),
+		},
+	})
+}
+
+func TestRegexNamedGroups(t *testing.T) {
+
+	runTestCasesFunc(t, equalRegexMatches, nil, []*testCase{
+		{
+			Expression: `/(?P<year>\d{4})-(?P<month>\d\d)/ ("on 2024-05-01")`,
+			Output: map[string]interface{}{
+				"match": "2024-05",
+				"start": 3,
+				"end":   10,
+				"groups": []string{
+					"2024",
+					"05",
+				},
+				"named": map[string]string{
+					"year":  "2024",
+					"month": "05",
+				},
+			},
+		},
+		{
+			// Unmatched groups are empty strings.
+			Expression: `/(?P<sign>-)?(?P<digits>\d+)/ ("42")`,
+			Output: map[string]interface{}{
+				"match": "42",
+				"start": 0,
+				"end":   2,
+				"groups": []string{
+					"",
+					"42",
+				},
+				"named": map[string]string{
+					"sign":   "",
+					"digits": "42",
+				},
+			},
+		},
+	})
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: `$match("2024-05 and 2025-12", /(?P<year>\d{4})-(\d\d)/)`,
+			Output: []map[string]interface{}{
+				{
+					"match": "2024-05",
+					"index": 0,
+					"groups": []string{
+						"2024",
+						"05",
+					},
+					"named": map[string]string{
+						"year": "2024",
+					},
+				},
+				{
+					"match": "2025-12",
+					"index": 12,
+					"groups": []string{
+						"2025",
+						"12",
+					},
+					"named": map[string]string{
+						"year": "2025",
+					},
+				},
+			},
+		},
+		{
+			// Named groups can be referred to by name or by
+			// position.
+			Expression: `$replace("2024-05-01", /(?P<year>\d{4})-(?P<month>\d\d)-(\d\d)/, "$3/${month}/$1 (${year})")`,
+			Output:     "01/05/2024 (2024)",
+		},
+		{
+			// Unknown names and escaped dollars are copied as is.
+			Expression: `$replace("2024", /(?P<year>\d+)/, "${day} $${year} ${year}")`,
+			Output:     "${day} ${year} 2024",
+		},
+		{
+			Expression: `$replace("2024-05", /(?P<year>\d{4})-(?P<month>\d\d)/, function($m) { $m.named.month & "/" & $m.groups[0] })`,
+			Output:     "05/2024",
+		},
+	})
+}
+
+func TestRegexContains(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: `$contains("ababbxabbcc", /ab+/)`,
+			Output:     true,
+		},
+		{
+			Expression: `$contains("ababbxabbcc", /ax+/)`,
+			Output:     false,
+		},
+	})
+}
+
+func TestRegexContains2(t *testing.T) {
+
+	runTestCases(t, testdata.account, []*testCase{
+		{
+			Expression: "Account.Order.Product[$contains(`Product Name`, /hat/)].ProductID",
+			Output:     float64(858236),
+		},
+		{
+			Expression: []string{
+				"Account.Order.Product[$contains(`Product Name`, /hat/i)].ProductID",
+				"Account.Order.Product[$contains(`Product Name`, /(?i)hat/)].ProductID",
+			},
+			Output: []interface{}{
+				float64(858383),
+				float64(858236),
+				float64(858383),
+			},
+		},
+	})
+}
+
+func TestRegexSplit(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: `$split("ababbxabbcc",/b+/)`,
+			Output: []string{
+				"a",
+				"a",
+				"xa",
+				"cc",
+			},
+		},
+		{
+			Expression: `$split("ababbxabbcc",/b+/, 2)`,
+			Output: []string{
+				"a",
+				"a",
+			},
+		},
+		{
+			Expression: `$split("ababbxabbcc",/d+/)`,
+			Output: []string{
+				"ababbxabbcc",
+			},
+		},
+	})
+}
+
+var reNow = regexp.MustCompile(`^\d\d\d\d-\d\d-\d\dT\d\d:\d\d:\d\d.\d\d\dZ$`)
+
+func TestFuncNow(t *testing.T) {
+
+	expr, err := Compile("$now()")
+	if err != nil {
+		t.Fatalf("Compile failed: %s", err)
+	}
+
+	var results [2]string
+
+	for i := range results {
+
+		output, err := expr.Eval(nil)
+		if err != nil {
+			t.Fatalf("Eval failed: %s", err)
+		}
+
+		results[i] = output.(string)
+		// $now() returns a timestamp that includes milliseconds, so
+		// sleeping for 1ms should be enough to reliably produce a
+		// different result.
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	for _, s := range results {
+		if !reNow.MatchString(s) {
+			t.Errorf("Timestamp %q does not match expected regex %q", s, reNow)
+		}
+	}
+
+	if results[0] == results[1] {
+		t.Errorf("calling $now() %d times returned identical timestamps: %q", len(results), results[0])
+	}
+}
+
+func TestFuncNow2(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: `{"now": $now(), "delay": $sum([1..10000]), "later": $now()}.(now = later)`,
+			Output:     true,
+		},
+		{
+			Expression: `$now()`,
+			Exts: map[string]Extension{
+				"now": {
+					Func: func() string {
+						return "time for tea"
+					},
+				},
+			},
+			Output: "time for tea",
+		},
+	})
+}
+
+func TestFuncNowPicture(t *testing.T) {
+
+	now := time.Date(2024, time.May, 1, 22, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		Expression string
+		Output     interface{}
+		Error      error
+	}{
+		{
+			Expression: `$now("[Y0001]-[M01]-[D01]")`,
+			Output:     "2024-05-01",
+		},
+		{
+			Expression: `$now("[Y0001]-[M01]-[D01] [H01]:[m01]", "+0200")`,
+			Output:     "2024-05-02 00:30",
+		},
+		{
+			// An empty or undefined picture uses the default
+			// format.
+			Expression: `[$now(""), $now(nothing, "-0500"), $now("", "-0500")]`,
+			Output: []interface{}{
+				"2024-05-01T22:30:00.000Z",
+				"2024-05-01T17:30:00.000-05:00",
+				"2024-05-01T17:30:00.000-05:00",
+			},
+		},
+		{
+			// $now returns the same time as $fromMillis
+			// with the result of $millis.
+			Expression: `$now("[H01]:[m01]", "+0530") = $fromMillis($millis(), "[H01]:[m01]", "+0530")`,
+			Output:     true,
+		},
+		{
+			Expression: `$now(2024)`,
+			Error: &ArgTypeError{
+				Func:  "now",
+				Which: 1,
+			},
+		},
+		{
+			Expression: `$now("[Y]", 5)`,
+			Error: &ArgTypeError{
+				Func:  "now",
+				Which: 2,
+			},
+		},
+		{
+			Expression: `$now("[Y]", "+0100", "extra")`,
+			Error: &ArgCountError{
+				Func:     "now",
+				Expected: 2,
+				Received: 3,
+			},
+		},
+	}
+
+	for _, test := range tests {
+
+		e := MustCompile(test.Expression)
+		e.SetClock(func() time.Time {
+			return now
+		})
+
+		output, err := e.Eval(nil)
+		if !reflect.DeepEqual(err, test.Error) {
+			t.Errorf("%s: expected error %v, got %v", test.Expression, test.Error, err)
+		}
+
+		if !reflect.DeepEqual(output, test.Output) {
+			t.Errorf("%s: expected %v, got %v", test.Expression, test.Output, output)
+		}
+	}
+}
+
+func TestFuncMillis(t *testing.T) {
+
+	expr, err := Compile("$millis()")
+	if err != nil {
+		t.Fatalf("Compile failed: %s", err)
+	}
+
+	var results [2]int64
+
+	for i := range results {
+
+		output, err := expr.Eval(nil)
+		if err != nil {
+			t.Fatalf("Eval failed: %s", err)
+		}
+
+		results[i] = output.(int64)
+		// $millis() returns the unix time in milliseconds, so
+		// sleeping for 1ms should be enough to reliably produce
+		// a different result.
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	for _, ms := range results {
+		if ms <= 1502264152715 || ms >= 2000000000000 {
+			t.Errorf("Unix time %d does not fall between expected values 1502264152715 and 2000000000000", ms)
+		}
+	}
+
+	if results[0] == results[1] {
+		t.Errorf("calling $millis() %d times returned identical unix times: %d", len(results), results[0])
+	}
+}
+
+func TestSetClock(t *testing.T) {
+
+	now := time.Date(2019, time.March, 14, 15, 9, 26, 535000000, time.UTC)
+
+	calls := 0
+	clock := func() time.Time {
+		calls++
+		return now
+	}
+
+	e := MustCompile(`[$now(), $millis(), $eval("$millis()"), $now("[Y0001]-[M01]-[D01]")]`)
+	e.SetClock(clock)
+
+	exp := []interface{}{
+		"2019-03-14T15:09:26.535Z",
+		int64(1552576166535),
+		int64(1552576166535),
+		"2019-03-14",
+	}
+
+	for i := 0; i < 2; i++ {
+
+		output, err := e.Eval(nil)
+		if err != nil {
+			t.Fatalf("Eval: %s", err)
+		}
+
+		if !reflect.DeepEqual(output, exp) {
+			t.Errorf("expected %v, got %v", exp, output)
+		}
+	}
+
+	// The clock is read once per evaluation.
+	if calls != 2 {
+		t.Errorf("expected 2 calls to the clock, got %d", calls)
+	}
+
+	// Clones share the clock until it's changed.
+	clone := e.Clone()
+	clone.SetClock(nil)
+
+	output, err := clone.Eval(nil)
+	if err != nil {
+		t.Fatalf("Eval: %s", err)
+	}
+
+	if reflect.DeepEqual(output, exp) {
+		t.Errorf("expected the current time, got %v", output)
+	}
+
+	output, err = e.Eval(nil)
+	if err != nil {
+		t.Fatalf("Eval: %s", err)
+	}
+
+	if !reflect.DeepEqual(output, exp) {
+		t.Errorf("expected %v, got %v", exp, output)
+	}
+}
+
+func TestSetRandSource(t *testing.T) {
+
+	eval := func(seed int64) interface{} {
+
+		e := MustCompile(`{"shuffle": $shuffle([1..20]), "random": $random(), "uuid": $uuid()}`)
+		e.SetRandSource(rand.NewSource(seed))
+
+		output, err := e.Eval(nil)
+		if err != nil {
+			t.Fatalf("Eval: %s", err)
+		}
+
+		return output
+	}
+
+	// The same seed produces the same results.
+	output1 := eval(42)
+	output2 := eval(42)
+
+	if !reflect.DeepEqual(output1, output2) {
+		t.Errorf("expected identical results for the same seed, got %v and %v", output1, output2)
+	}
+
+	// Different seeds produce different results. The chance of
+	// two shuffles of 20 items being the same is negligible.
+	output3 := eval(43)
+
+	if reflect.DeepEqual(output1, output3) {
+		t.Errorf("expected different results for different seeds, got %v", output1)
+	}
+
+	// Evaluations can share a source safely.
+	e := MustCompile(`$shuffle([1..10])`)
+	e.SetRandSource(rand.NewSource(1))
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := e.Clone().Eval(nil); err != nil {
+				t.Errorf("Eval: %s", err)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestSetConfig(t *testing.T) {
+
+	config := map[string]interface{}{
+		"region": "eu-west-1",
+		"limits": map[string]interface{}{
+			"maxItems": 100,
+		},
+		"servers": []interface{}{
+			map[string]interface{}{
+				"host": "a.example.com",
+			},
+			map[string]interface{}{
+				"host": "b.example.com",
+			},
+		},
+	}
+
+	tests := []struct {
+		Expression string
+		Output     interface{}
+		Error      error
+	}{
+		{
+			Expression: `$config("region")`,
+			Output:     "eu-west-1",
+		},
+		{
+			Expression: `$config("limits.maxItems")`,
+			Output:     100,
+		},
+		{
+			Expression: `$config("servers.1.host")`,
+			Output:     "b.example.com",
+		},
+		{
+			Expression: `$config("servers").host`,
+			Output: []interface{}{
+				"a.example.com",
+				"b.example.com",
+			},
+		},
+		{
+			Expression: `$config().region`,
+			Output:     "eu-west-1",
+		},
+		{
+			Expression: `$config("limits.minItems")`,
+			Error:      ErrUndefined,
+		},
+		{
+			Expression: `$config("servers.2.host")`,
+			Error:      ErrUndefined,
+		},
+		{
+			Expression: `$config("region.name")`,
+			Error:      ErrUndefined,
+		},
+		{
+			// An undefined path is the same as no path.
+			Expression: `$config(nothing).region`,
+			Output:     "eu-west-1",
+		},
+		{
+			// The transform operator cannot modify the
+			// configuration.
+			Expression: `($config("limits") ~> |$|{"maxItems": 0}|; $config("limits.maxItems"))`,
+			Output:     100,
+		},
+	}
+
+	for _, test := range tests {
+
+		e := MustCompile(test.Expression)
+		must(t, "SetConfig", e.SetConfig(config))
+
+		output, err := e.Eval(nil)
+		if !reflect.DeepEqual(output, test.Output) || err != test.Error {
+			t.Errorf("%s: expected %v (error %v), got %v (error %v)", test.Expression, test.Output, test.Error, output, err)
+		}
+	}
+
+	e := MustCompile(`$config("limits.maxItems")`)
+	must(t, "SetConfig", e.SetConfig(config))
+
+	// Changes to the map after SetConfig are not seen by the
+	// expression.
+	config["limits"].(map[string]interface{})["maxItems"] = 5
+
+	if output, err := e.Eval(nil); output != 100 || err != nil {
+		t.Errorf("expected 100, got %v (error %v)", output, err)
+	}
+
+	// Clones share the configuration.
+	if output, err := e.Clone().Eval(nil); output != 100 || err != nil {
+		t.Errorf("Clone: expected 100, got %v (error %v)", output, err)
+	}
+
+	// Concurrent evaluations can share the configuration.
+	transform := MustCompile(`$config() ~> |limits|{"maxItems": maxItems + 1}|`)
+	must(t, "SetConfig", transform.SetConfig(config))
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := transform.Eval(nil); err != nil {
+				t.Errorf("Eval: %s", err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	// Without a configuration, $config returns undefined.
+	if _, err := MustCompile(`$config("region")`).Eval(nil); err != ErrUndefined {
+		t.Errorf("expected ErrUndefined without a configuration, got %v", err)
+	}
+
+	must(t, "SetConfig", e.SetConfig(nil))
+	if _, err := e.Eval(nil); err != ErrUndefined {
+		t.Errorf("expected ErrUndefined after removing the configuration, got %v", err)
+	}
+
+	// Configurations that can't be copied are rejected.
+	cyclic := map[string]interface{}{}
+	cyclic["self"] = cyclic
+	if err := e.SetConfig(cyclic); err == nil {
+		t.Errorf("expected an error setting a cyclic configuration")
+	}
+}
+
+func TestFuncMillis2(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: `{"now": $millis(), "delay": $sum([1..10000]), "later": $millis()}.(now = later)`,
+			Output:     true,
+		},
+		{
+			Expression: `$millis(1)`,
+			Error: &ArgCountError{
+				Func:     "millis",
+				Expected: 0,
+				Received: 1,
+			},
+		},
+	})
+}
+
+func TestFuncToMillis(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: `$toMillis("1970-01-01T00:00:00.001Z")`,
+			Output:     int64(1),
+		},
+		{
+			Expression: `$toMillis("2017-10-30T16:25:32.935Z")`,
+			Output:     int64(1509380732935),
+		},
+		{
+			Expression: `$toMillis(foo)`,
+			Error:      ErrUndefined,
+		},
+		{
+			Expression: []string{
+				`$toMillis("2024-05-01T10:00:00Z")`,
+				`$toMillis("2024-05-01t10:00:00z")`,
+				`$toMillis("2024-05-01T10:00:00")`,
+				`$toMillis("2024-05-01 10:00:00")`,
+				`$toMillis("2024-05-01T10:00Z")`,
+				`$toMillis("2024-05-01T10:00:00.000000Z")`,
+				`$toMillis("2024-05-01T11:00:00+01:00")`,
+				`$toMillis("2024-05-01T11:00:00+0100")`,
+				`$toMillis("2024-05-01T11:00:00+01")`,
+				`$toMillis("2024-05-01T08:30-01:30")`,
+				`$toMillis("2024-122T10:00:00Z")`,
+			},
+			Output: int64(1714557600000),
+		},
+		{
+			Expression: []string{
+				`$toMillis("2024-05-01T10:00:00.1234Z")`,
+				`$toMillis("2024-05-01T10:00:00,123Z")`,
+				`$toMillis("2024-05-01T10:00:00.123456789012Z")`,
+			},
+			Output: int64(1714557600123),
+		},
+		{
+			Expression: []string{
+				`$toMillis("2024-05-01")`,
+				`$toMillis("2024-122")`,
+			},
+			Output: int64(1714521600000),
+		},
+		{
+			Expression: []string{
+				`$toMillis("2024-01")`,
+				`$toMillis("2024")`,
+				`$toMillis("2024-001")`,
+			},
+			Output: int64(1704067200000),
+		},
+		{
+			// Leap years have 366 days.
+			Expression: `$toMillis("2024-366") = $toMillis("2024-12-31")`,
+			Output:     true,
+		},
+		{
+			Expression: `$toMillis("9999-12-31T23:59:59.999Z")`,
+			Output:     int64(253402300799999),
+		},
+		{
+			Expression: `$toMillis("1600-01-01T00:00:00Z")`,
+			Output:     int64(-11676096000000),
+		},
+		{
+			Expression: `$toMillis("01/05/2024", "[D01]/[M01]/[Y0001]")`,
+			Output:     int64(1714521600000),
+		},
+		{
+			Expression: `$toMillis("foo")`,
+			Error: &EvalError{
+				Type:  ErrUnparseableTimestamp,
+				Value: "foo",
+			},
+		},
+		{
+			Expression: `$toMillis("2024-05-01", "[D01]/[M01]/[Y0001]")`,
+			Error: &EvalError{
+				Type:  ErrUnparseableTimestamp,
+				Value: "2024-05-01",
+			},
+		},
+		{
+			Expression: `$toMillis("2024-05-01", "[Q]")`,
+			Error:      jlib.NewArgValueError("toMillis", 2, "D3110", "must be a valid date format"),
+		},
+	})
+
+	// Invalid and out of range timestamps.
+	var tests []*testCase
+	for _, s := range []string{
+		"",
+		"2024-13-01",
+		"2023-02-29",
+		"2023-366",
+		"2024-000",
+		"2024-05-01T24:00:00Z",
+		"2024-05-01T10:60:00Z",
+		"2024-05-01T10:00:60Z",
+		"2024-05-01T10:00:00+24:00",
+		"2024-05-01T10Z",
+		"2024-05-01Z",
+		"2024-05-01T10:00:00.Z",
+		"2024-5-1",
+		" 2024-05-01",
+	} {
+		tests = append(tests, &testCase{
+			Expression: fmt.Sprintf("$toMillis(%q)", s),
+			Error: &EvalError{
+				Type:  ErrUnparseableTimestamp,
+				Value: s,
+			},
+		})
+	}
+
+	runTestCases(t, nil, tests)
+}
+
+func TestFuncFromMillis(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: `$fromMillis(1)`,
+			Output:     "1970-01-01T00:00:00.001Z",
+		},
+		{
+			Expression: `$fromMillis(1509380732935)`,
+			Output:     "2017-10-30T16:25:32.935Z",
+		},
+		{
+			Expression: `$fromMillis(foo)`,
+			Error:      ErrUndefined,
+		},
+	})
+}
+
+func TestLambdaSignatures(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: `λ($arg)<b:b>{$not($arg)}(true)`,
+			Output:     false,
+		},
+		{
+			Expression: `λ($arg)<b:b>{$not($arg)}(foo)`,
+			Output:     true,
+		},
+		{
+			Expression: `λ($arg)<x:b>{$not($arg)}(null)`,
+			Output:     true,
+		},
+		{
+			Expression: `function($x,$y)<n-n:n>{$x+$y}(2, 6)`,
+			Output:     float64(8),
+		},
+		{
+			Expression: `[1..5].function($x,$y)<n-n:n>{$x+$y}(2, 6)`,
+			Output: []interface{}{
+				float64(8),
+				float64(8),
+				float64(8),
+				float64(8),
+				float64(8),
+			},
+		},
+		{
+			Expression: `[1..5].function($x,$y)<n-n:n>{$x+$y}(6)`,
+			Output: []interface{}{
+				float64(7),
+				float64(8),
+				float64(9),
+				float64(10),
+				float64(11),
+			},
+		},
+		{
+			Expression: `λ($str)<s->{$uppercase($str)}("hello")`,
+			Output:     "HELLO",
+		},
+		{
+			Expression: `λ($str, $prefix)<s-s>{$prefix & $str}("World", "Hello ")`,
+			Output:     "Hello World",
+		},
+		{
+			Expression: `λ($arr, $sep)<a<s>s?:s>{$join($arr, $sep)}("a")`,
+			Output:     "a",
+		},
+		{
+			Expression: `λ($arr, $sep)<a<s>s?:s>{$join($arr, $sep)}("a", "-")`,
+			Output:     "a",
+		},
+		{
+			Expression: `λ($arr, $sep)<a<s>s?:s>{$join($arr, $sep)}(["a"], "-")`,
+			Output:     "a",
+		},
+		{
+			Expression: `λ($arr, $sep)<a<s>s?:s>{$join($arr, $sep)}(["a", "b"], "-")`,
+			Output:     "a-b",
+		},
+		{
+			Expression: `λ($arr, $sep)<as?:s>{$join($arr, $sep)}(["a", "b"], "-")`,
+			Output:     "a-b",
+		},
+		{
+			Expression: `λ($arr, $sep)<a<s>s?:s>{$join($arr, $sep)}([], "-")`,
+			Output:     "",
+		},
+		{
+			Expression: `λ($arr, $sep)<a<s>s?:s>{$join($arr, $sep)}(foo, "-")`,
+			Error:      ErrUndefined,
+		},
+		{
+			Expression: `λ($obj)<o>{$obj}({"hello": "world"})`,
+			Output: map[string]interface{}{
+				"hello": "world",
+			},
+		},
+		{
+			Expression: `λ($arr)<a<a<n>>>{$arr}([[1]])`,
+			Output: []interface{}{
+				[]interface{}{
+					float64(1),
+				},
+			},
+		},
+		{
+			Expression: `λ($num)<(ns)-:n>{$number($num)}(5)`,
+			Output:     float64(5),
+		},
+		{
+			Expression: `λ($num)<(ns)-:n>{$number($num)}("5")`,
+			Output:     float64(5),
+		},
+		{
+			Expression: `[1..5].λ($num)<(ns)-:n>{$number($num)}()`,
+			Output: []interface{}{
+				float64(1),
+				float64(2),
+				float64(3),
+				float64(4),
+				float64(5),
+			},
+		},
+		{
+			Expression: `
+				(
+					$twice := function($f)<f:f>{function($x)<n:n>{$f($f($x))}};
+					$add2 := function($x)<n:n>{$x+2};
+					$add4 := $twice($add2);
+					$add4(5)
+				)`,
+			Output: float64(9),
+		},
+		{
+			Expression: `
+				(
+					$twice := function($f)<f<n:n>:f<n:n>>{function($x)<n:n>{$f($f($x))}};
+					$add2 := function($x)<n:n>{$x+2};
+					$add4 := $twice($add2);
+					$add4(5)
+				)`,
+			Output: float64(9),
+		},
+		{
+			Expression: `λ($arg)<n<n>>{$arg}(5)`,
+			Error: &jparse.Error{
+				// TODO: Get position info.
+				Type: jparse.ErrInvalidSubtype,
+				Hint: "n",
+			},
+		},
+	})
+}
+
+func TestLambdaSignatures2(t *testing.T) {
+
+	runTestCases(t, testdata.address, []*testCase{
+		{
+			Expression: `Age.function($x,$y)<n-n:n>{$x+$y}(6)`,
+			Output:     float64(34),
+		},
+		{
+			Expression: `FirstName.λ($str, $prefix)<s-s>{$prefix & $str}("Hello ")`,
+			Output:     "Hello Fred",
+		},
+		{
+			Expression: `λ($arr, $sep)<a<s>s?:s>{$join($arr, $sep)}(["a"])`,
+			Output:     "a",
+		},
+	})
+}
+
+func TestLambdaSignatures3(t *testing.T) {
+
+	runTestCases(t, testdata.account, []*testCase{
+		{
+			Expression: `Account.Order.Product.Description.Colour.λ($str)<s->{$uppercase($str)}()`,
+			Output: []interface{}{
+				"PURPLE",
+				"ORANGE",
+				"PURPLE",
+				"BLACK",
+			},
+		},
+	})
+}
+
+func TestLambdaSignatureViolations(t *testing.T) {
+
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: `λ($arg1, $arg2)<nn:a>{[$arg1, $arg2]}(1,"2")`,
+			Error: &ArgTypeError{
+				Func:  "lambda",
+				Which: 2,
+			},
+		},
+		{
+			Expression: `λ($arg1, $arg2)<nn:a>{[$arg1, $arg2]}(1,3,"2")`,
+			Error: &ArgCountError{
+				Func:     "lambda",
+				Expected: 2,
+				Received: 3,
+			},
+		},
+		{
+			Expression: `λ($arg1, $arg2)<nn+:a>{[$arg1, $arg2]}(1,3, 2,"g")`,
+			Error: &ArgTypeError{
+				Func:  "lambda",
+				Which: 4,
+			},
+		},
+		{
+			Expression: `λ($arr)<a<n>>{$arr}(["3"]) `,
+			Error: &ArgTypeError{
+				Func:    "lambda",
+				Which:   1,
+				ArrayOf: "numbers",
+			},
+		},
+		{
+			Expression: `λ($arr)<a<n>>{$arr}([1, 2, "3"]) `,
+			Error: &ArgTypeError{
+				Func:    "lambda",
+				Which:   1,
+				ArrayOf: "numbers",
+			},
+		},
+		{
+			Expression: `λ($arr)<a<n>>{$arr}("f")`,
+			Error: &ArgTypeError{
+				Func:    "lambda",
+				Which:   1,
+				ArrayOf: "numbers",
+			},
+		},
+		{
+			Expression: `
+				(
+					$fun := λ($arr)<a<n>>{$arr};
+					$fun("f")
+				)`,
+			Error: &ArgTypeError{
+				Func:     "fun",
+				Which:    1,
+				ArrayOf:  "numbers",
+				Position: 47,
+			},
+		},
+		{
+			Expression: `λ($arr)<(sa<n>)>>{$arr}([[1]])`,
+			Error: &jparse.Error{
+				// TODO: Get position info.
+				Type: jparse.ErrInvalidUnionType,
+				Hint: "<",
+			},
+		},
+	})
+}
+
+func TestTransform(t *testing.T) {
+
+	data := map[string]interface{}{
+		"state": map[string]interface{}{
+			"tempReadings": []float64{
+				27.2,
+				28.9,
+				28,
+				28.2,
+				28.4,
+			},
+			"readingsCount":   5,
+			"sumTemperatures": 140.7,
+			"avgTemperature":  28.14,
+			"maxTemperature":  28.9,
+			"minTemperature":  27.2,
+		},
+		"event": map[string]interface{}{
+			"t": 28.4,
+		},
+	}
+
+	runTestCases(t, data, []*testCase{
+		{
+			Expression: `
+				(
+					$tempReadings := $count(state.tempReadings) = 5 ?
+						[state.tempReadings[[1..4]], event.t] :
+						[state.tempReadings, event.t];
+
+					{
+						"tempReadings": $tempReadings,
+						"sumTemperatures": $sum($tempReadings),
+						"avgTemperature": $average($tempReadings) ~> $round(2),
+						"maxTemperature": $max($tempReadings),
+						"minTemperature": $min($tempReadings)
+					}
+				)`,
+			Output: map[string]interface{}{
+				"tempReadings": []interface{}{
+					28.9,
+					float64(28),
+					28.2,
+					28.4,
+					28.4,
+				},
+				"sumTemperatures": 141.9,
+				"avgTemperature":  28.38,
+				"maxTemperature":  28.9,
+				"minTemperature":  float64(28),
+			},
+		},
+	})
+}
+
+func TestTransformCopiesInput(t *testing.T) {
+
+	type item struct {
+		Name  string
+		Tags  []string
+		Price float64
+	}
+
+	newData := func() map[string]interface{} {
+		return map[string]interface{}{
+			"order": map[string]interface{}{
+				"id": int64(9007199254740993),
+				"items": []map[string]interface{}{
+					{
+						"name":  "hat",
+						"sizes": []int{1, 2, 3},
+					},
+				},
+				"product": &item{
+					Name:  "cloak",
+					Tags:  []string{"warm"},
+					Price: 99.5,
+				},
+			},
+		}
+	}
+
+	data := newData()
+
+	exprs := []string{
+		`$ ~> |order.items|{"sizes": [4, 5], "name": "fez"}|`,
+		`$ ~> |order.items|{}, ["sizes"]|`,
+		`$ ~> |order.product|{"Tags": $append(Tags, "dry"), "Price": 0}|`,
+		`$ ~> |order|{"id": id + 1}, ["items"]|`,
+	}
+
+	for _, expr := range exprs {
+		if _, err := MustCompile(expr).Eval(data); err != nil {
+			t.Fatalf("%s: %s", expr, err)
+		}
+		if !reflect.DeepEqual(data, newData()) {
+			t.Fatalf("%s: input was modified: %v", expr, data)
+		}
+	}
+
+	// Values in the copy keep their Go types and structs are
+	// copied to objects.
+	output, err := MustCompile(`$ ~> |order.product|{"Price": 0}|`).Eval(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := map[string]interface{}{
+		"order": map[string]interface{}{
+			"id": int64(9007199254740993),
+			"items": []interface{}{
+				map[string]interface{}{
+					"name":  "hat",
+					"sizes": []interface{}{1, 2, 3},
+				},
+			},
+			"product": map[string]interface{}{
+				"Name":  "cloak",
+				"Tags":  []interface{}{"warm"},
+				"Price": float64(0),
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(output, exp) {
+		t.Errorf("expected %v, got %v", exp, output)
+	}
+}
+
+func TestTransformComposition(t *testing.T) {
+
+	newData := func() map[string]interface{} {
+		return map[string]interface{}{
+			"order": map[string]interface{}{
+				"items": []interface{}{
+					map[string]interface{}{
+						"name":  "hat",
+						"price": 10,
+					},
+					map[string]interface{}{
+						"name":  "scarf",
+						"price": 20,
+					},
+				},
+			},
+		}
+	}
+
+	const transforms = `
+		$t1 := |order.items|{"price": price * 2}|;
+		$t2 := |order.items|{"tax": price / 10}|;
+		$t3 := |order|{"total": $sum(items.(price + tax))}, ["items"]|;
+	`
+
+	// Reducing over an array of transforms, either by applying
+	// each one to the accumulated result or by chaining them
+	// into a single function, is the same as applying them in
+	// sequence.
+	exprs := []string{
+		`$ ~> $t1 ~> $t2 ~> $t3`,
+		`$reduce([$t1, $t2, $t3], λ($acc, $t) { $acc ~> $t }, $)`,
+		`$reduce([$t1, $t2, $t3], λ($f, $g) { $f ~> $g })($)`,
+	}
+
+	exp := map[string]interface{}{
+		"order": map[string]interface{}{
+			"total": int64(66),
+		},
+	}
+
+	data := newData()
+
+	for _, expr := range exprs {
+
+		expr = "(" + transforms + expr + ")"
+
+		output, err := MustCompile(expr).Eval(data)
+		if err != nil {
+			t.Fatalf("%s: %s", expr, err)
+		}
+
+		if !reflect.DeepEqual(output, exp) {
+			t.Errorf("%s: expected %v, got %v", expr, exp, output)
+		}
+	}
+
+	if !reflect.DeepEqual(data, newData()) {
+		t.Errorf("input was modified: %v", data)
+	}
+
+	// A transform can be applied more than once, and can be
+	// passed to functions that take a function argument.
+	runTestCases(t, nil, []*testCase{
+		{
+			Expression: `(
+				$inc := |$|{"n": n + 1}|;
+				[{"n": 1} ~> $inc, {"n": 5} ~> $inc, {"n": 1} ~> $inc ~> $inc].n
+			)`,
+			Output: []interface{}{
+				float64(2),
+				float64(6),
+				float64(3),
+			},
+		},
+		{
+			Expression: `(
+				$inc := |$|{"n": n + 1}|;
+				$map([{"n": 1}, {"n": 2}], $inc).n
+			)`,
+			Output: []interface{}{
+				float64(2),
+				float64(3),
+			},
+		},
+		{
+			Expression: `(
+				$inc := |$|{"n": n + 1}|;
+				$reduce([$inc, $inc, $inc], λ($acc, $t) { $acc ~> $t }, {"n": 0}).n
+			)`,
+			Output: float64(3),
+		},
+		{
+			Expression: `(
+				$inc := |$|{"n": n + 1}|;
+				$twice($inc, {"n": 0}).n
+			)`,
+			Exts: map[string]Extension{
+				"twice": {
+					Func: func(fn jtypes.Callable, v interface{}) (interface{}, error) {
+						for i := 0; i < 2; i++ {
+							res, err := fn.Call([]reflect.Value{reflect.ValueOf(v)})
+							if err != nil {
+								return nil, err
+							}
+							v = res.Interface()
+						}
+						return v, nil
+					},
+				},
+			},
+			Output: float64(2),
+		},
+	})
+}
+
+func TestTransformRoot(t *testing.T) {
+
+	data := testdata.account
+
+	// In a transform pattern, $$ is the copy of the value that
+	// the transform is applied to, not the input to the whole
+	// expression. The same transform can therefore be applied
+	// to different parts of the input.
+	runTestCases(t, data, []*testCase{
+		{
+			Expression: `(
+				$t := |$$.Product[0]|{"Price": 1}|;
+				[Account.Order[0] ~> $t, Account.Order[1] ~> $t].Product.Price
+			)`,
+			Output: []interface{}{
+				float64(1),
+				21.67,
+				float64(1),
+				107.99,
+			},
+		},
+		{
+			// Relative patterns give the same results.
+			Expression: `(
+				$t := |Product[0]|{"Price": 1}|;
+				[Account.Order[0] ~> $t, Account.Order[1] ~> $t].Product.Price
+			)`,
+			Output: []interface{}{
+				float64(1),
+				21.67,
+				float64(1),
+				107.99,
+			},
+		},
+		{
+			Expression: `(
+				$t := |$$.Order.Product|{"Price": 1}|;
+				(Account ~> $t).Order.Product.Price
+			)`,
+			Output: []interface{}{
+				float64(1),
+				float64(1),
+				float64(1),
+				float64(1),
+			},
+		},
+		{
+			// Applied to the whole input, the same pattern does
+			// not match anything.
+			Expression: `(
+				$t := |$$.Order.Product|{"Price": 1}|;
+				($ ~> $t).Account.Order.Product.Price
+			)`,
+			Output: []interface{}{
+				34.45,
+				21.67,
+				34.45,
+				107.99,
+			},
+		},
+		{
+			Expression: `(
+				$t := |$$.Account.Order.Product|{"Price": 1}|;
+				[($ ~> $t).Account.Order.Product.Price, (Account ~> $t).Order.Product.Price]
+			)`,
+			Output: []interface{}{
+				float64(1),
+				float64(1),
+				float64(1),
+				float64(1),
+				34.45,
+				21.67,
+				34.45,
+				107.99,
+			},
+		},
+		{
+			// Patterns that refer to $$ do not modify the input.
+			Expression: `(
+				$t := |$$.Account.Order.Product|{"Price": 1}|;
+				$x := $ ~> $t;
+				Account.Order.Product.Price
+			)`,
+			Output: []interface{}{
+				34.45,
+				21.67,
+				34.45,
+				107.99,
+			},
+		},
+	})
+}
+
+func TestErrorCode(t *testing.T) {
+
+	tests := []struct {
+		Expression string
+		Code       string
+	}{
+		{
+			// Parse errors.
+			Expression: `[1, 2`,
+			Code:       "S0203",
+		},
+		{
+			Expression: `"hello`,
+			Code:       "S0101",
+		},
+		{
+			Expression: `(2 := 3)`,
+			Code:       "S0212",
+		},
+		{
+			// Evaluation errors.
+			Expression: `"5" + 5`,
+			Code:       "T2001",
+		},
+		{
+			Expression: `1 < "2"`,
+			Code:       "T2009",
+		},
+		{
+			Expression: `{"a": 1, "a": 2}`,
+			Code:       "D1009",
+		},
+		{
+			Expression: `$x()`,
+			Code:       "T1006",
+		},
+		{
+			// Function argument errors.
+			Expression: `$uppercase("a", "b")`,
+			Code:       "T0410",
+		},
+		{
+			Expression: `$uppercase(1)`,
+			Code:       "T0410",
+		},
+		{
+			Expression: `$sum([1, "2"])`,
+			Code:       "T0412",
+		},
+		{
+			Expression: `{"a": 1}.$uppercase()`,
+			Code:       "T0411",
+		},
+		{
+			Expression: `$number("five")`,
+			Code:       "D3030",
+		},
+		{
+			Expression: `$split("a,b", ",", -1)`,
+			Code:       "D3020",
+		},
+		{
+			Expression: `$string(1/0)`,
+			Code:       "D1001",
+		},
+		{
+			// No error.
+			Expression: `1 + 1`,
+			Code:       "",
+		},
+	}
+
+	for _, test := range tests {
+
+		e, err := Compile(test.Expression)
+		if err == nil {
+			_, err = e.Eval(nil)
+		}
+
+		if code := ErrorCode(err); code != test.Code {
+			t.Errorf("%s: expected error code %q, got %q (%v)", test.Expression, test.Code, code, err)
+		}
+	}
+}
+
+func TestEvalOptions(t *testing.T) {
+
+	opts := EvalOptions{
+		MaxRangeItems:   100,
+		MaxStringLength: 10,
+		MaxArrayLength:  50,
+	}
+
+	data := map[string]interface{}{
+		"items": []interface{}{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+	}
+
+	tests := []struct {
+		Expression string
+		Output     interface{}
+		Error      error
+	}{
+		{
+			Expression: `$count([1..40])`,
+			Output:     40,
+		},
+		{
+			Expression: `[1..101]`,
+			Error: &EvalError{
+				Type:  ErrLimitExceeded,
+				Token: "MaxRangeItems",
+				Value: "100",
+			},
+		},
+		{
+			Expression: `[1..51]`,
+			Error: &EvalError{
+				Type:  ErrLimitExceeded,
+				Token: "MaxArrayLength",
+				Value: "50",
+			},
+		},
+		{
+			Expression: `[1..30, 1..30]`,
+			Error: &EvalError{
+				Type:  ErrLimitExceeded,
+				Token: "MaxArrayLength",
+				Value: "50",
+			},
+		},
+		{
+			Expression: `items.($$.items)`,
+			Error: &EvalError{
+				Type:  ErrLimitExceeded,
+				Token: "MaxArrayLength",
+				Value: "50",
+			},
+		},
+		{
+			Expression: `$append(items, [1..45])`,
+			Error: &EvalError{
+				Type:  ErrLimitExceeded,
+				Token: "MaxArrayLength",
+				Value: "50",
+			},
+		},
+		{
+			// Ranges and strings built in the steps of a path
+			// with a positional or context binding count
+			// towards the limits as well.
+			Expression: `items#$i.([1..101])`,
+			Error: &EvalError{
+				Type:  ErrLimitExceeded,
+				Token: "MaxRangeItems",
+				Value: "100",
+			},
+		},
+		{
+			Expression: `items@$x.("hello" & " world")`,
+			Error: &EvalError{
+				Type:  ErrLimitExceeded,
+				Token: "MaxStringLength",
+				Value: "10",
+			},
+		},
+		{
+			Expression: `"hello" & "world"`,
+			Output:     "helloworld",
+		},
+		{
+			Expression: `"hello" & " world"`,
+			Error: &EvalError{
+				Type:  ErrLimitExceeded,
+				Token: "MaxStringLength",
+				Value: "10",
+			},
+		},
+		{
+			Expression: `$pad("x", 10)`,
+			Output:     "x         ",
+		},
+		{
+			Expression: `$pad("x", -100000000)`,
+			Error: &EvalError{
+				Type:  ErrLimitExceeded,
+				Token: "MaxStringLength",
+				Value: "10",
+			},
+		},
+		{
+			Expression: `$join(["hello", "world"], " ")`,
+			Error: &EvalError{
+				Type:  ErrLimitExceeded,
+				Token: "MaxStringLength",
+				Value: "10",
+			},
+		},
+		{
+			Expression: `$map([1..10], function($v) { $v & " item(s) found" })`,
+			Error: &EvalError{
+				Type:  ErrLimitExceeded,
+				Token: "MaxStringLength",
+				Value: "10",
+			},
+		},
+		{
+			// Limits apply to values created by the expression,
+			// not to the input data.
+			Expression: `items`,
+			Output:     []interface{}{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+		},
+	}
+
+	for _, test := range tests {
+
+		e := MustCompile(test.Expression)
+		_, err := e.Eval(data)
+		if err != nil {
+			t.Fatalf("%s: unexpected error without limits: %s", test.Expression, err)
+		}
+
+		e, err = CompileWithOptions(test.Expression, opts)
+		if err != nil {
+			t.Fatalf("%s: %s", test.Expression, err)
+		}
+
+		output, err := e.Eval(data)
+
+		if !reflect.DeepEqual(output, test.Output) {
+			t.Errorf("%s: expected output %v, got %v", test.Expression, test.Output, output)
+		}
+
+		if !reflect.DeepEqual(err, test.Error) {
+			t.Errorf("%s: expected error %v, got %v", test.Expression, test.Error, err)
+		}
+	}
+
+	// Without options, ranges are subject to the default limit.
+	_, err := MustCompile(`[1..10000001]`).Eval(nil)
+	if e, ok := err.(*EvalError); !ok || e.Type != ErrMaxRangeItems {
+		t.Errorf("expected error of type ErrMaxRangeItems, got %v", err)
+	}
+}
+
+func TestDecimalMode(t *testing.T) {
+
+	opts := EvalOptions{
+		Decimal: true,
+	}
+
+	data := map[string]interface{}{
+		"price": 0.1,
+		"qty":   3,
+	}
+
+	tests := []struct {
+		Expression string
+		Output     interface{}
+		Error      error
+	}{
+		{
+			Expression: `0.1 + 0.2`,
+			Output:     json.Number("0.3"),
+		},
+		{
+			Expression: `0.1 + 0.2 = 0.3`,
+			Output:     true,
+		},
+		{
+			Expression: `0.1 + 0.2 > 0.3`,
+			Output:     false,
+		},
+		{
+			Expression: `1.1 * 1.1`,
+			Output:     json.Number("1.21"),
+		},
+		{
+			Expression: `-(0.1 - 0.3)`,
+			Output:     json.Number("0.2"),
+		},
+		{
+			Expression: `7 % -3`,
+			Output:     json.Number("1"),
+		},
+		{
+			Expression: `-7.5 % 2`,
+			Output:     json.Number("-1.5"),
+		},
+		{
+			Expression: `$string(22/7)`,
+			Output:     "3.14285714285714",
+		},
+		{
+			Expression: `$string(1/8)`,
+			Output:     "0.125",
+		},
+		{
+			// Results without an exact decimal representation
+			// have the precision of a float64.
+			Expression: `22/7`,
+			Output:     json.Number("3.142857142857143"),
+		},
+		{
+			Expression: `$sum([0.1, 0.2])`,
+			Output:     json.Number("0.3"),
+		},
+		{
+			Expression: `$sum([price, 0.2, qty])`,
+			Output:     json.Number("3.3"),
+		},
+		{
+			Expression: `$sum(0.1)`,
+			Output:     json.Number("0.1"),
+		},
+		{
+			Expression: `$average([0.1, 0.2])`,
+			Output:     json.Number("0.15"),
+		},
+		{
+			Expression: `$average([1, 1, 2])`,
+			Output:     json.Number("1.3333333333333333"),
+		},
+		{
+			Expression: `$max([0.1, 0.3, 0.2])`,
+			Output:     json.Number("0.3"),
+		},
+		{
+			Expression: `$min([price, 0.3, 0.2])`,
+			Output:     json.Number("0.1"),
+		},
+		{
+			// Regular numbers are promoted to Decimals.
+			Expression: `price * 3`,
+			Output:     json.Number("0.3"),
+		},
+		{
+			Expression: `price + 0.2 = 0.3`,
+			Output:     true,
+		},
+		{
+			// Operations on regular numbers are not affected.
+			Expression: `price * qty`,
+			Output:     0.30000000000000004,
+		},
+		{
+			Expression: `[10, 20, 30][1]`,
+			Output:     json.Number("20"),
+		},
+		{
+			Expression: `{"total": 0.7 + 0.1}`,
+			Output: map[string]interface{}{
+				"total": json.Number("0.8"),
+			},
+		},
+		{
+			Expression: `1 / 0`,
+			Error: &EvalError{
+				Type:  ErrNumberInf,
+				Value: "/",
+			},
+		},
+		{
+			// Number literals in the steps of a path with a
+			// positional or context binding are Decimals, so
+			// the price is still promoted and the sum is exact.
+			Expression: `price#$i.($ + 0.2)`,
+			Output:     json.Number("0.3"),
+		},
+		{
+			Expression: `price@$p.($p * 3)`,
+			Output:     json.Number("0.3"),
+		},
+	}
+
+	for _, test := range tests {
+
+		e, err := CompileWithOptions(test.Expression, opts)
+		if err != nil {
+			t.Fatalf("%s: %s", test.Expression, err)
+		}
+
+		output, err := e.Eval(data)
+
+		if !reflect.DeepEqual(output, test.Output) {
+			t.Errorf("%s: expected output %v (%T), got %v (%T)", test.Expression, test.Output, test.Output, output, output)
+		}
+
+		if !reflect.DeepEqual(err, test.Error) {
+			t.Errorf("%s: expected error %v, got %v", test.Expression, test.Error, err)
+		}
+	}
+
+	// EvalBytes decodes input numbers as Decimals.
+	e, err := CompileWithOptions(`{"total": a + b, "id": id}`, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := e.EvalBytes([]byte(`{"a": 0.1, "b": 0.2, "id": 12345678901234567890}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := `{"id":12345678901234567890,"total":0.3}`; string(output) != exp {
+		t.Errorf("EvalBytes: expected %s, got %s", exp, output)
+	}
+
+	// The default mode is unchanged.
+	v, err := MustCompile(`0.1 + 0.2 = 0.3`).Eval(nil)
+	if err != nil || v != false {
+		t.Errorf("expected false without decimal mode, got %v (error %v)", v, err)
+	}
+}
+
+func TestJSONNumber(t *testing.T) {
+
+	data := readJSONNumbers("account.json")
+
+	runTestCases(t, data, []*testCase{
+		{
+			Expression: `Account.Order.Product.Price`,
+			Output: []interface{}{
+				json.Number("34.45"),
+				json.Number("21.67"),
+				json.Number("34.45"),
+				json.Number("107.99"),
+			},
+		},
+		{
+			Expression: `Account.Order.Product[Price > 30].SKU`,
+			Output: []interface{}{
+				"0406654608",
+				"040657863",
+				"0406654603",
+			},
+		},
+		{
+			Expression: `Account.Order.Product[ProductID = 858383].SKU`,
+			Output: []interface{}{
+				"0406654608",
+				"040657863",
+			},
+		},
+		{
+			Expression: `$sum(Account.Order.Product.Quantity)`,
+			Output:     int64(8),
+		},
+		{
+			Expression: `$max(Account.Order.Product.Price)`,
+			Output:     107.99,
+		},
+		{
+			Expression: `$round(Account.Order[0].Product[0].Price)`,
+			Output:     float64(34),
+		},
+		{
+			Expression: `Account.Order[0].Product[0].(Price * Quantity)`,
+			Output:     68.9,
+		},
+		{
+			Expression: `$type(Account.Order[0].Product[0].Price)`,
+			Output:     "number",
+		},
+		{
+			Expression: `$string(Account.Order[0].Product[0].Price)`,
+			Output:     "34.45",
+		},
+		{
+			Expression: `Account.Order.Product^(Price).SKU`,
+			Output: []interface{}{
+				"0406634348",
+				"0406654608",
+				"040657863",
+				"0406654603",
+			},
+		},
+		{
+			Expression: `Account.Order[0].Product[0].Price & ""`,
+			Output:     "34.45",
+		},
+		{
+			Expression: `$uppercase(Account.Order[0].Product[0].Price)`,
+			Error: &ArgTypeError{
+				Func:  "uppercase",
+				Which: 1,
+			},
+		},
+	})
+
+	// Large integers pass through unchanged.
+	var v interface{}
+	dec := json.NewDecoder(strings.NewReader(`{"id": 9007199254740993}`))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+
+	runTestCases(t, v, []*testCase{
+		{
+			Expression: `id`,
+			Output:     json.Number("9007199254740993"),
+		},
+		{
+			Expression: `$[id > 0].id`,
+			Output:     json.Number("9007199254740993"),
+		},
+	})
+}
+
+type celsius float64
+
+func (c celsius) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`{"value":%g,"unit":"C"}`, float64(c))), nil
+}
+
+type sku struct {
+	prefix string
+	id     int
+}
+
+func (s sku) String() string {
+	return fmt.Sprintf("%s-%04d", s.prefix, s.id)
+}
+
+func TestValueConverters(t *testing.T) {
+
+	err := RegisterValueConverter(reflect.TypeOf(sku{}), func(v interface{}) (interface{}, error) {
+		return v.(fmt.Stringer).String(), nil
+	})
+	if err != nil {
+		t.Fatalf("RegisterValueConverter: %s", err)
+	}
+
+	type reading struct {
+		Created time.Time
+		Temp    celsius
+		Sensor  sku
+		Meta    json.RawMessage
+		Times   []time.Time
+	}
+
+	created := time.Date(2018, 7, 1, 12, 30, 0, 0, time.UTC)
+
+	data := []reading{
+		{
+			Created: created,
+			Temp:    21.5,
+			Sensor:  sku{"TMP", 12},
+			Meta:    json.RawMessage(`{"site":"north","tags":["a","b"]}`),
+			Times:   []time.Time{created, created.Add(time.Hour)},
+		},
+		{
+			Created: created.Add(24 * time.Hour),
+			Temp:    19,
+			Sensor:  sku{"TMP", 7},
+			Meta:    json.RawMessage(`{"site":"south","tags":[]}`),
+		},
+	}
+
+	runTestCases(t, data, []*testCase{
+		{
+			Expression: `Created`,
+			Output: []interface{}{
+				"2018-07-01T12:30:00Z",
+				"2018-07-02T12:30:00Z",
+			},
+		},
+		{
+			Expression: `$toMillis($[0].Created)`,
+			Output:     int64(1530448200000),
+		},
+		{
+			Expression: `$[Created > "2018-07-02"].Sensor`,
+			Output:     "TMP-0007",
+		},
+		{
+			Expression: `Times[1]`,
+			Output:     "2018-07-01T13:30:00Z",
+		},
+		{
+			Expression: `Temp[unit = "C"].value`,
+			Output: []interface{}{
+				21.5,
+				float64(19),
+			},
+		},
+		{
+			Expression: `Meta.site`,
+			Output: []interface{}{
+				"north",
+				"south",
+			},
+		},
+		{
+			Expression: `Meta.tags`,
+			Output: []interface{}{
+				"a",
+				"b",
+			},
+		},
+		{
+			Expression: `$[0].(Sensor & ":" & Meta.site)`,
+			Output:     "TMP-0012:north",
+		},
+		{
+			// Wildcards convert the values they find.
+			Expression: `$[1].*`,
+			Output: []interface{}{
+				"2018-07-02T12:30:00Z",
+				map[string]interface{}{
+					"unit":  "C",
+					"value": float64(19),
+				},
+				"TMP-0007",
+				map[string]interface{}{
+					"site": "south",
+					"tags": []interface{}{},
+				},
+			},
+		},
+		{
+			Expression: `$[0].Meta.*`,
+			Output: []interface{}{
+				"north",
+				"a",
+				"b",
+			},
+		},
+		{
+			Expression: `$[0].Times.*`,
+			Error:      ErrUndefined,
+		},
+		{
+			// So do descendants, which see inside converted
+			// values.
+			Expression: `$[0].**.site`,
+			Output:     "north",
+		},
+		{
+			Expression: `$[0].**[$type($) = "string"]`,
+			Output: []interface{}{
+				"2018-07-01T12:30:00Z",
+				"C",
+				"TMP-0012",
+				"north",
+				"a",
+				"b",
+				"2018-07-01T12:30:00Z",
+				"2018-07-01T13:30:00Z",
+			},
+		},
+		{
+			Expression: `$start`,
+			Vars: map[string]interface{}{
+				"start": created,
+			},
+			Output: "2018-07-01T12:30:00Z",
+		},
+		{
+			Expression: `$meta.site`,
+			Vars: map[string]interface{}{
+				"meta": json.RawMessage(`{"site":"east"}`),
+			},
+			Output: "east",
+		},
+	})
+
+	_, err = MustCompile(`$meta.site`).EvalWithVars(nil, map[string]interface{}{
+		"meta": json.RawMessage(`{"site":`),
+	})
+	if err == nil {
+		t.Errorf("expected an error for invalid JSON")
+	}
+
+	if err := RegisterValueConverter(nil, nil); err == nil {
+		t.Errorf("RegisterValueConverter: expected an error for a nil type")
+	}
+}
+
+func TestLargeIntegers(t *testing.T) {
+
+	data := map[string]interface{}{
+		"id":  int64(9007199254740993),
+		"ids": []interface{}{int64(9007199254740993), int64(9007199254740995)},
+		"idx": int64(1),
+		"max": int64(math.MaxInt64),
+	}
+
+	runTestCases(t, data, []*testCase{
+		{
+			Expression: `id`,
+			Output:     int64(9007199254740993),
+		},
+		{
+			Expression: `{"id": id}`,
+			Output: map[string]interface{}{
+				"id": int64(9007199254740993),
+			},
+		},
+		{
+			Expression: `id + 1`,
+			Output:     int64(9007199254740994),
+		},
+		{
+			Expression: `id - 9007199254740992`,
+			Output:     int64(1),
+		},
+		{
+			Expression: `id * 2`,
+			Output:     int64(18014398509481986),
+		},
+		{
+			Expression: `id % 10`,
+			Output:     int64(3),
+		},
+		{
+			Expression: `-id`,
+			Output:     int64(-9007199254740993),
+		},
+		{
+			// Fractional operations use floating point.
+			Expression: `id / 2`,
+			Output:     4503599627370496.5,
+		},
+		{
+			Expression: `idx + 0.5`,
+			Output:     1.5,
+		},
+		{
+			// Integer overflow falls back to floating point.
+			Expression: `max + 1`,
+			Output:     9223372036854775808.0,
+		},
+		{
+			Expression: `id = 9007199254740992`,
+			Output:     false,
+		},
+		{
+			Expression: `id > 9007199254740992`,
+			Output:     true,
+		},
+		{
+			// Integers are compared with number literals, which
+			// are floats, exactly. The literal 9007199254740993
+			// is rounded to the float 9007199254740992.
+			Expression: []string{
+				`id != 9007199254740992`,
+				`9007199254740992 < id`,
+				`id >= 9007199254740992`,
+				`id < 9007199254740994`,
+				`9007199254740994 > id`,
+				`id + 1 = 9007199254740994`,
+			},
+			Output: true,
+		},
+		{
+			Expression: []string{
+				`id = 9007199254740993`,
+				`id in [9007199254740992]`,
+				`id < 9007199254740992`,
+				`id = 9007199254740996`,
+				`max = 9223372036854775807`,
+			},
+			Output: false,
+		},
+		{
+			Expression: `max < 9223372036854775807`,
+			Output:     true,
+		},
+		{
+			// Integers are compared with each other exactly.
+			Expression: []string{
+				`id = ids[0]`,
+				`id < ids[1]`,
+				`ids[1] > id`,
+				`id + 2 = ids[1]`,
+			},
+			Output: true,
+		},
+		{
+			Expression: []string{
+				`id = id + 1`,
+				`id >= ids[1]`,
+			},
+			Output: false,
+		},
+		{
+			Expression: `ids[0] = ids[1]`,
+			Output:     false,
+		},
+		{
+			Expression: `ids[0] < ids[1]`,
+			Output:     true,
+		},
+		{
+			Expression: `ids[$$.idx]`,
+			Output:     int64(9007199254740995),
+		},
+		{
+			Expression: `ids^(>$)`,
+			Output: []interface{}{
+				int64(9007199254740995),
+				int64(9007199254740993),
+			},
+		},
+		{
+			Expression: `$string(id)`,
+			Output:     "9007199254740993",
+		},
+		{
+			Expression: `$sum(ids)`,
+			Output:     int64(18014398509481988),
+		},
+		{
+			Expression: `$max(ids)`,
+			Output:     int64(9007199254740995),
+		},
+		{
+			Expression: `$min(ids)`,
+			Output:     int64(9007199254740993),
+		},
+		{
+			Expression: `$sum([max, max])`,
+			Output:     1.8446744073709552e19,
+		},
+	})
+}
+
+func TestGroupDuplicateKeys(t *testing.T) {
+
+	data := map[string]interface{}{
+		"items": []interface{}{
+			map[string]interface{}{"type": "fruit", "name": "apple", "alias": "pome"},
+			map[string]interface{}{"type": "veg", "name": "leek", "alias": "allium"},
+			map[string]interface{}{"type": "fruit", "name": "pear", "alias": "fruit"},
+		},
+	}
+
+	tests := []struct {
+		Expression string
+		Output     interface{}
+		Error      error
+	}{
+		{
+			Expression: `{"a": 1, "a": 2}`,
+			Output: map[string]interface{}{
+				"a": []interface{}{float64(1), float64(2)},
+			},
+			Error: &EvalError{
+				Type:     ErrDuplicateKey,
+				Token:    `"a"`,
+				Value:    "a",
+				Position: 9,
+			},
+		},
+		{
+			// The key "fruit" is produced by both pairs but
+			// only for the third input item.
+			Expression: `items{type: name, alias: name}`,
+			Output: map[string]interface{}{
+				"fruit":  []interface{}{"apple", "pear", "pear"},
+				"veg":    "leek",
+				"pome":   "apple",
+				"allium": "leek",
+			},
+			Error: &EvalError{
+				Type:     ErrDuplicateKey,
+				Token:    "alias",
+				Value:    "fruit",
+				Item:     3,
+				Position: 18,
+			},
+		},
+		{
+			// Keys produced by a single pair are grouped as usual.
+			Expression: `items{type: $count(name)}`,
+			Output: map[string]interface{}{
+				"fruit": 2,
+				"veg":   1,
+			},
+		},
+		{
+			// An object constructor in a step of a path with a
+			// positional binding builds one object per item,
+			// so duplicate keys are grouped within each item
+			// rather than across the path.
+			Expression: `items#$i.{"key": name, "key": alias}`,
+			Output: []interface{}{
+				map[string]interface{}{"key": []interface{}{"apple", "pome"}},
+				map[string]interface{}{"key": []interface{}{"leek", "allium"}},
+				map[string]interface{}{"key": []interface{}{"pear", "fruit"}},
+			},
+			Error: &EvalError{
+				Type:     ErrDuplicateKey,
+				Token:    `"key"`,
+				Value:    "key",
+				Position: 23,
+			},
+		},
+	}
+
+	for _, test := range tests {
+
+		// Without the option, duplicate keys are an error.
+		_, err := MustCompile(test.Expression).Eval(data)
+		if test.Error == nil && err != nil {
+			t.Errorf("%s: unexpected error %s", test.Expression, err)
+		}
+		if test.Error != nil && !reflect.DeepEqual(err, test.Error) {
+			t.Errorf("%s: expected error %v, got %v", test.Expression, test.Error, err)
+		}
+
+		e, err := CompileWithOptions(test.Expression, EvalOptions{
+			GroupDuplicateKeys: true,
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", test.Expression, err)
+		}
+
+		output, err := e.Eval(data)
+		if err != nil {
+			t.Errorf("%s: unexpected error with GroupDuplicateKeys: %s", test.Expression, err)
+		}
+
+		if !reflect.DeepEqual(output, test.Output) {
+			t.Errorf("%s: expected output %v, got %v", test.Expression, test.Output, output)
+		}
+	}
+
+	err := &EvalError{
+		Type:  ErrDuplicateKey,
+		Value: "fruit",
+		Item:  3,
+	}
+	if exp := `multiple object keys evaluate to the value "fruit" (input item 3)`; err.Error() != exp {
+		t.Errorf("expected error message %q, got %q", exp, err.Error())
+	}
+}
+
+func TestLenientObjectKeys(t *testing.T) {
+
+	tests := []struct {
+		Expression string
+		Options    EvalOptions
+		Output     interface{}
+		Error      *EvalError
+	}{
+		{
+			Expression: `Account.Order.Product{ProductID: Price}`,
+			Output: map[string]interface{}{
+				"858383": []interface{}{34.45, 34.45},
+				"858236": 21.67,
+				"345664": 107.99,
+			},
+		},
+		{
+			Expression: `Account.Order.Product{ProductID: $sum(Quantity)}`,
+			Output: map[string]interface{}{
+				"858383": float64(6),
+				"858236": float64(1),
+				"345664": float64(1),
+			},
+		},
+		{
+			Expression: `Account.Order.{OrderID: Product{ProductID: Quantity}}`,
+			Output: []interface{}{
+				map[string]interface{}{
+					"order103": map[string]interface{}{
+						"858383": float64(2),
+						"858236": float64(1),
+					},
+				},
+				map[string]interface{}{
+					"order104": map[string]interface{}{
+						"858383": float64(4),
+						"345664": float64(1),
+					},
+				},
+			},
+		},
+		{
+			// A positional binding is a number, so using it as
+			// a key relies on the option to convert it.
+			Expression: `Account.Order#$i.{$i: OrderID}`,
+			Output: []interface{}{
+				map[string]interface{}{
+					"0": "order103",
+				},
+				map[string]interface{}{
+					"1": "order104",
+				},
+			},
+		},
+		{
+			Expression: `{true: 1, 1.5: 2, 1e21: 3, -0: 4}`,
+			Output: map[string]interface{}{
+				"true":  float64(1),
+				"1.5":   float64(2),
+				"1e+21": float64(3),
+				"0":     float64(4),
+			},
+		},
+		{
+			// A number and a string that convert to the same
+			// key are grouped, like any other duplicate produced
+			// by a single pair.
+			Expression: `[{"id": 858383, "n": 1}, {"id": "858383", "n": 2}]{id: n}`,
+			Output: map[string]interface{}{
+				"858383": []interface{}{float64(1), float64(2)},
+			},
+		},
+		{
+			// Duplicates from different pairs are an error...
+			Expression: `{858383: 1, "858383": 2}`,
+			Error: &EvalError{
+				Type: ErrDuplicateKey,
+			},
+		},
+		{
+			// ...unless the GroupDuplicateKeys option is set.
+			Expression: `{858383: 1, "858383": 2}`,
+			Options: EvalOptions{
+				GroupDuplicateKeys: true,
+			},
+			Output: map[string]interface{}{
+				"858383": []interface{}{float64(1), float64(2)},
+			},
+		},
+		{
+			Expression: `{0.1 + 0.2: 1}`,
+			Options: EvalOptions{
+				Decimal: true,
+			},
+			Output: map[string]interface{}{
+				"0.3": json.Number("1"),
+			},
+		},
+		{
+			Expression: `Account.Order[0].Product[0] ~> |$|{ProductID: Quantity}|`,
+			Output: map[string]interface{}{
+				"Product Name": "Bowler Hat",
+				"ProductID":    float64(858383),
+				"SKU":          "0406654608",
+				"Description": map[string]interface{}{
+					"Colour": "Purple",
+					"Width":  float64(300),
+					"Height": float64(200),
+					"Depth":  float64(210),
+					"Weight": 0.75,
+				},
+				"Price":    34.45,
+				"Quantity": float64(2),
+				"858383":   float64(2),
+			},
+		},
+		{
+			// Other types of key are still errors.
+			Expression: `{null: 1}`,
+			Error: &EvalError{
+				Type: ErrIllegalKey,
+			},
+		},
+		{
+			Expression: `{[1]: 1}`,
+			Error: &EvalError{
+				Type: ErrIllegalKey,
+			},
+		},
+		{
+			Expression: `Account{Order: 1}`,
+			Error: &EvalError{
+				Type: ErrIllegalKey,
+			},
+		},
+		{
+			Expression: `{$string: 1}`,
+			Error: &EvalError{
+				Type: ErrIllegalKey,
+			},
+		},
+	}
+
+	for _, test := range tests {
+
+		// Without the option, keys that are not strings are
+		// an error.
+		_, err := MustCompile(test.Expression).Eval(testdata.account)
+		if e, ok := err.(*EvalError); !ok || e.Type != ErrIllegalKey {
+			t.Errorf("%s: expected ErrIllegalKey, got %v", test.Expression, err)
+		}
+
+		opts := test.Options
+		opts.LenientObjectKeys = true
+
+		e, err := CompileWithOptions(test.Expression, opts)
+		if err != nil {
+			t.Fatalf("%s: %s", test.Expression, err)
+		}
+
+		output, err := e.Eval(testdata.account)
+
+		switch {
+		case test.Error == nil && err != nil:
+			t.Errorf("%s: unexpected error %s", test.Expression, err)
+		case test.Error != nil:
+			// Only the error types are compared.
+			if e, ok := err.(*EvalError); !ok || e.Type != test.Error.Type {
+				t.Errorf("%s: expected error %v, got %v", test.Expression, test.Error, err)
+			}
+		}
+
+		if !reflect.DeepEqual(output, test.Output) {
+			t.Errorf("%s: expected output %v, got %v", test.Expression, test.Output, output)
+		}
+	}
+}
+
+// TestStringRoundTrip checks that every expression in this
+// file can be converted back to a string that parses to the
+// same syntax tree.
+
+func TestGraphemes(t *testing.T) {
+
+	// The family emoji is seven code points (four people joined
+	// by zero width joiners) but a single character.
+	const family = "\U0001F469\u200D\U0001F469\u200D\U0001F467\u200D\U0001F466"
+
+	data := map[string]interface{}{
+		"family":   family,
+		"composed": "caf\u00E9",
+		"combined": "cafe\u0301",
+	}
+
+	tests := []struct {
+		Expression string
+		Runes      interface{}
+		Graphemes  interface{}
+	}{
+		{
+			Expression: `$length(family)`,
+			Runes:      7,
+			Graphemes:  1,
+		},
+		{
+			Expression: `[$length(composed), $length(combined)]`,
+			Runes:      []interface{}{4, 5},
+			Graphemes:  []interface{}{4, 4},
+		},
+		{
+			Expression: `$substring(family, 0, 1)`,
+			Runes:      "\U0001F469",
+			Graphemes:  family,
+		},
+		{
+			Expression: `combined.$substring(3)`,
+			Runes:      "e\u0301",
+			Graphemes:  "e\u0301",
+		},
+		{
+			Expression: `$substring(combined, -1)`,
+			Runes:      "\u0301",
+			Graphemes:  "e\u0301",
+		},
+		{
+			Expression: `$pad(combined, 6, ".")`,
+			Runes:      "cafe\u0301.",
+			Graphemes:  "cafe\u0301..",
+		},
+		{
+			Expression: `$pad(family, -2)`,
+			Runes:      family,
+			Graphemes:  " " + family,
+		},
+	}
+
+	for _, test := range tests {
+
+		output, err := MustCompile(test.Expression).Eval(data)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.Expression, err)
+		}
+
+		if !reflect.DeepEqual(output, test.Runes) {
+			t.Errorf("%s: expected %q, got %q", test.Expression, test.Runes, output)
+		}
+
+		// Graphemes also applies when combined with a string
+		// length limit, which replaces $pad.
+		for _, opts := range []EvalOptions{
+			{Graphemes: true},
+			{Graphemes: true, MaxStringLength: 100},
+		} {
+
+			e, err := CompileWithOptions(test.Expression, opts)
+			if err != nil {
+				t.Fatalf("%s: %s", test.Expression, err)
+			}
+
+			output, err := e.Eval(data)
+			if err != nil {
+				t.Errorf("%s: unexpected error with Graphemes: %s", test.Expression, err)
+			}
+
+			if !reflect.DeepEqual(output, test.Graphemes) {
+				t.Errorf("%s: expected %q with Graphemes, got %q", test.Expression, test.Graphemes, output)
+			}
+		}
+	}
+}
+
+func TestTemporalComparison(t *testing.T) {
+
+	data := map[string]interface{}{
+		"readings": []interface{}{
+			map[string]interface{}{
+				"time":  "2024-01-01T01:30:00+02:00",
+				"value": 1.0,
+			},
+			map[string]interface{}{
+				"time":  "2023-12-31T19:30:00-05:00",
+				"value": 2.0,
+			},
+			map[string]interface{}{
+				"time":  "2024-01-01T00:15:00Z",
+				"value": 3.0,
+			},
+		},
+	}
+
+	tests := []struct {
+		Expression string
+		Output     interface{} // with TemporalComparison
+		Default    interface{} // without TemporalComparison
+	}{
+		{
+			// Timestamps with different offsets are compared
+			// as instants.
+			Expression: `"2024-01-01T02:00:00+02:00" > "2024-01-01T00:30:00Z"`,
+			Output:     false,
+			Default:    true,
+		},
+		{
+			Expression: `"2024-01-01T02:00:00+02:00" <= "2024-01-01T00:00:00Z"`,
+			Output:     true,
+			Default:    false,
+		},
+		{
+			Expression: `"2024-01-01T02:00:00+02:00" >= "2024-01-01T00:00:00Z"`,
+			Output:     true,
+			Default:    true,
+		},
+		{
+			Expression: `"2024-01-01T02:00:00+02:00" < "2024-01-01T00:00:00Z"`,
+			Output:     false,
+			Default:    false,
+		},
+		{
+			Expression: `"2024-01-01T00:00:00Z" < "2024-01-01T00:00:00.5Z"`,
+			Output:     true,
+			Default:    false,
+		},
+		{
+			// Equality still compares strings.
+			Expression: `"2024-01-01T02:00:00+02:00" = "2024-01-01T00:00:00Z"`,
+			Output:     false,
+			Default:    false,
+		},
+		{
+			Expression: `readings[time > "2024-01-01T00:00:00Z"].value`,
+			Output: []interface{}{
+				2.0,
+				3.0,
+			},
+			Default: []interface{}{
+				1.0,
+				3.0,
+			},
+		},
+		{
+			Expression: `readings[time < $t].value`,
+			Output: []interface{}{
+				1.0,
+				2.0,
+				3.0,
+			},
+			Default: 2.0,
+		},
+		{
+			// A filter on a path with a positional binding
+			// compares the timestamps too. The positions show
+			// that the second and third readings are later,
+			// not the first and third as in string order.
+			Expression: `readings#$i[time > "2024-01-01T00:00:00Z"].$i`,
+			Output: []interface{}{
+				1.0,
+				2.0,
+			},
+			Default: []interface{}{
+				0.0,
+				2.0,
+			},
+		},
+		{
+			// Strings that look like timestamps but are not
+			// RFC 3339 timestamps are compared as strings.
+			Expression: `"2024-01-01 02:00:00+02:00" > "2024-01-01 00:30:00Z"`,
+			Output:     true,
+			Default:    true,
+		},
+		{
+			Expression: `"2024-01-01T02:00:00+02:00 " > "2024-01-01T00:30:00Z"`,
+			Output:     true,
+			Default:    true,
+		},
+		{
+			Expression: `"2024-01-01T02:00:00" > "2024-01-01T00:30:00Z"`,
+			Output:     true,
+			Default:    true,
+		},
+		{
+			Expression: `"2024-13-01T00:00:00Z" > "2024-12-01T00:00:00+05:00"`,
+			Output:     true,
+			Default:    true,
+		},
+		{
+			Expression: `"2024-01-01" < "2024-01-01T00:00:00Z"`,
+			Output:     true,
+			Default:    true,
+		},
+	}
+
+	vars := map[string]interface{}{
+		"t": "2023-12-31T19:45:00-05:00",
+	}
+
+	for _, test := range tests {
+		for _, opts := range []EvalOptions{
+			{},
+			{TemporalComparison: true},
+		} {
+			exp := test.Default
+			if opts.TemporalComparison {
+				exp = test.Output
+			}
+
+			e, err := CompileWithOptions(test.Expression, opts)
+			if err != nil {
+				t.Fatalf("%s: %s", test.Expression, err)
+			}
+			must(t, "Vars", e.RegisterVars(vars))
+
+			// Constant folding must not change the results.
+			for _, optimize := range []bool{false, true} {
+				if optimize {
+					e.Optimize()
+				}
+
+				output, err := e.Eval(data)
+				if err != nil {
+					t.Errorf("%s: unexpected error: %s", test.Expression, err)
+				}
+
+				if !reflect.DeepEqual(output, exp) {
+					t.Errorf("%s (%+v): expected %v, got %v", test.Expression, opts, exp, output)
+				}
+			}
+		}
+	}
+}
+
+type methodItem struct {
+	Price    float64
+	Quantity int
+}
+
+func (i methodItem) Subtotal() float64 {
+	return i.Price * float64(i.Quantity)
+}
+
+type methodOrder struct {
+	Reference string `json:"Ref"`
+	Items     []methodItem
+	Discount  float64
+}
+
+func (o *methodOrder) Total() float64 {
+	var total float64
+	for _, item := range o.Items {
+		total += item.Subtotal()
+	}
+	return total - o.Discount
+}
+
+func (o methodOrder) Status() (string, error) {
+	if len(o.Items) == 0 {
+		return "", errors.New("order has no items")
+	}
+	return "open", nil
+}
+
+// Ref is hidden by the field with the same JSONata name.
+func (o methodOrder) Ref() string {
+	return "method"
+}
+
+// Methods with arguments or more than one result are not
+// called.
+func (o methodOrder) Describe(prefix string) string {
+	return prefix + o.Reference
+}
+
+func (o methodOrder) Counts() (int, int) {
+	return len(o.Items), 0
+}
+
+func TestMethodFallback(t *testing.T) {
+
+	orders := []methodOrder{
+		{
+			Reference: "A1",
+			Items: []methodItem{
+				{Price: 2.5, Quantity: 2},
+				{Price: 10, Quantity: 1},
+			},
+			Discount: 1,
+		},
+		{
+			Reference: "B2",
+			Items: []methodItem{
+				{Price: 4, Quantity: 3},
+			},
+		},
+	}
+
+	empty := methodOrder{
+		Reference: "C3",
+	}
+
+	tests := []struct {
+		Input      interface{}
+		Expression string
+		Output     interface{}
+		Error      error
+	}{
+		{
+			Input:      orders,
+			Expression: `Total`,
+			Output: []interface{}{
+				14.0,
+				12.0,
+			},
+		},
+		{
+			Input:      orders,
+			Expression: `Items.Subtotal`,
+			Output: []interface{}{
+				5.0,
+				10.0,
+				12.0,
+			},
+		},
+		{
+			Input:      orders,
+			Expression: `$[Total > 13].(Ref & ": " & $sum(Items[Subtotal > 5].Subtotal))`,
+			Output:     "A1: 10",
+		},
+		{
+			Input:      orders,
+			Expression: `$.{"ref": Ref, "status": Status}`,
+			Output: []interface{}{
+				map[string]interface{}{
+					"ref":    "A1",
+					"status": "open",
+				},
+				map[string]interface{}{
+					"ref":    "B2",
+					"status": "open",
+				},
+			},
+		},
+		{
+			// Total is a method, not a field. It's found on
+			// the items of a path with a positional or context
+			// binding, including when the item is referred to
+			// through the bound variable.
+			Input: map[string]interface{}{
+				"orders": orders,
+			},
+			Expression: `orders#$i.Total`,
+			Output: []interface{}{
+				14.0,
+				12.0,
+			},
+		},
+		{
+			Input: map[string]interface{}{
+				"orders": orders,
+			},
+			Expression: `orders#$i.($i & ": " & Total)`,
+			Output: []interface{}{
+				"0: 14",
+				"1: 12",
+			},
+		},
+		{
+			Input: map[string]interface{}{
+				"orders": orders,
+			},
+			Expression: `orders@$o.$o.Total`,
+			Output: []interface{}{
+				14.0,
+				12.0,
+			},
+		},
+		{
+			Input:      orders,
+			Expression: `Describe`,
+			Error:      ErrUndefined,
+		},
+		{
+			Input:      orders,
+			Expression: `Counts`,
+			Error:      ErrUndefined,
+		},
+		{
+			// Pointer receiver methods can be called on
+			// struct values as well as pointers.
+			Input:      &empty,
+			Expression: `Total`,
+			Output:     0.0,
+		},
+		{
+			Input:      empty,
+			Expression: `Total`,
+			Output:     0.0,
+		},
+		{
+			Input:      []interface{}{orders[1], empty},
+			Expression: `Status`,
+			Error: &EvalError{
+				Type:     ErrMethodCall,
+				Token:    "Status",
+				Value:    "order has no items",
+				Position: 0,
+			},
+		},
+	}
+
+	for _, test := range tests {
+
+		e, err := CompileWithOptions(test.Expression, EvalOptions{
+			MethodFallback: true,
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", test.Expression, err)
+		}
+
+		output, err := e.Eval(test.Input)
+		if !reflect.DeepEqual(err, test.Error) {
+			t.Errorf("%s: expected error %v, got %v", test.Expression, test.Error, err)
+		}
+
+		if !reflect.DeepEqual(output, test.Output) {
+			t.Errorf("%s: expected %v, got %v", test.Expression, test.Output, output)
+		}
+	}
+
+	// Without the option, methods are not called.
+	for _, expr := range []string{`Total`, `Items.Subtotal`, `Status`, `$[Total > 13]`} {
+		output, err := MustCompile(expr).Eval(orders)
+		if err != ErrUndefined {
+			t.Errorf("%s: expected undefined without MethodFallback, got %v (error %v)", expr, output, err)
+		}
+	}
+}
+
+func TestStringRoundTrip(t *testing.T) {
+
+	exprs, err := readTestExpressions("jsonata_test.go")
+	if err != nil {
+		t.Fatalf("readTestExpressions: %s", err)
+	}
+
+	for _, expr := range exprs {
+
+		node, err := jparse.Parse(expr)
+		if err != nil {
+			// Skip expressions that test parser errors.
+			continue
+		}
+
+		s := node.String()
+
+		node2, err := jparse.Parse(s)
+		if err != nil {
+			t.Errorf("%s: String returned %s, which does not parse: %s", expr, s, err)
+			continue
+		}
+
+		if s2 := node2.String(); s2 != s {
+			t.Errorf("%s: String returned %s, then %s", expr, s, s2)
+		}
+
+		clearPositions(node)
+		clearPositions(node2)
+
+		if !reflect.DeepEqual(node, node2) {
+			t.Errorf("%s: String returned %s, which parses to a different AST", expr, s)
+		}
+	}
+}
+
+// readTestExpressions returns the string literals assigned to
+// the Expression field of test cases in the given Go file.
+func readTestExpressions(filename string) ([]string, error) {
+
+	f, err := parser.ParseFile(token.NewFileSet(), filename, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var exprs []string
+
+	addLiteral := func(e ast.Expr) {
+		if lit, ok := e.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+			if s, err := strconv.Unquote(lit.Value); err == nil {
+				exprs = append(exprs, s)
+			}
+		}
+	}
+
+	ast.Inspect(f, func(n ast.Node) bool {
+		kv, ok := n.(*ast.KeyValueExpr)
+		if !ok {
+			return true
+		}
+
+		if key, ok := kv.Key.(*ast.Ident); !ok || key.Name != "Expression" {
+			return true
+		}
+
+		switch v := kv.Value.(type) {
+		case *ast.BasicLit:
+			addLiteral(v)
+		case *ast.CompositeLit:
+			for _, elt := range v.Elts {
+				addLiteral(elt)
+			}
+		}
+
+		return false
+	})
+
+	return exprs, nil
+}
+
+// clearPositions zeroes the source positions in a syntax tree
+// so that trees parsed from different sources can be compared.
+func clearPositions(node jparse.Node) {
+	jparse.Walk(node, func(n jparse.Node) bool {
+		span := reflect.ValueOf(n).Elem().FieldByName("Span")
+		span.Set(reflect.Zero(span.Type()))
+		switch n := n.(type) {
+		case *jparse.FunctionCallNode:
+			n.Position = 0
+		case *jparse.PartialNode:
+			n.Position = 0
+		case *jparse.TypedLambdaNode:
+			n.LambdaNode.Span = jparse.Span{}
+		}
+		return true
+	})
+}
+
+func TestReferencedPaths(t *testing.T) {
+
+	tests := []struct {
+		Expression string
+		Output     []string
+	}{
+		{
+			Expression: `Account.Order[Total > $$.Limit].Product`,
+			Output:     []string{"Account", "Limit"},
+		},
+		{
+			Expression: `$sum(Order.Product.(Price * Quantity)) + Tax`,
+			Output:     []string{"Order", "Tax"},
+		},
+		{
+			Expression: `{"name": $.Name, "items": Items^(>Price).SKU}`,
+			Output:     []string{"Items", "Name"},
+		},
+		{
+			Expression: `Orders{Customer: $sum(Total)}`,
+			Output:     []string{"Orders"},
+		},
+		{
+			Expression: `($x := Config; Data ~> |Item|{"id": Id}|)`,
+			Output:     []string{"Config", "Data"},
+		},
+		{
+			Expression: `Account.Order#$i[$i > Max]`,
+			Output:     []string{"Account"},
+		},
+		{
+			Expression: `**.Price`,
+			Output:     []string{"**"},
+		},
+		{
+			Expression: `1 + 2`,
+			Output:     []string{},
+		},
+	}
+
+	for _, test := range tests {
+
+		e := MustCompile(test.Expression)
+
+		if got := ReferencedPaths(e); !reflect.DeepEqual(got, test.Output) {
+			t.Errorf("%s: expected paths %q, got %q", test.Expression, test.Output, got)
+		}
+
+		if e.AST() == nil || e.AST().String() != e.String() {
+			t.Errorf("%s: AST does not match the expression", test.Expression)
+		}
+	}
+}
+
+func TestInputs(t *testing.T) {
+
+	tests := []struct {
+		Expression string
+		Output     []string
+	}{
+		{
+			Expression: `Account.Order.Product.(Price * Quantity)`,
+			Output: []string{
+				"Account.Order.Product.Price (number)",
+				"Account.Order.Product.Quantity (number)",
+			},
+		},
+		{
+			Expression: `$sum(Account.Order.Product.(Price * Quantity))`,
+			Output: []string{
+				"Account.Order.Product.Price (number)",
+				"Account.Order.Product.Quantity (number)",
+			},
+		},
+		{
+			Expression: `Account.Order[OrderID = "order104"].Product.SKU`,
+			Output: []string{
+				"Account.Order.OrderID (string)",
+				"Account.Order.Product.SKU",
+			},
+		},
+		{
+			Expression: `Account.Order.OrderID & ": " & $$.Account.` + "`Account Name`",
+			Output: []string{
+				"Account.Account Name (string)",
+				"Account.Order.OrderID (string)",
+			},
+		},
+		{
+			Expression: `Account.Order.Product[Price > 30].Description.Weight`,
+			Output: []string{
+				"Account.Order.Product.Description.Weight",
+				"Account.Order.Product.Price (number)",
+			},
+		},
+		{
+			Expression: `Account.Order.Product{SKU: $sum(Price)}`,
+			Output: []string{
+				"Account.Order.Product.Price (number)",
+				"Account.Order.Product.SKU (string)",
+			},
+		},
+		{
+			Expression: `Account.Order.Product^(>Price).SKU`,
+			Output: []string{
+				"Account.Order.Product.Price",
+				"Account.Order.Product.SKU",
+			},
+		},
+		{
+			// Functions that accept the context read it if
+			// they are called without arguments.
+			Expression: `Account.Order.OrderID.$uppercase()`,
+			Output: []string{
+				"Account.Order.OrderID (string)",
+			},
+		},
+		{
+			Expression: `$.Account.Order.Product.Description.$.(Width * %.Quantity)`,
+			Output: []string{
+				"Account.Order.Product.Description.Width (number)",
+				"Account.Order.Product.Quantity (number)",
+			},
+		},
+		{
+			Expression: `($o := Account.Order; $o.Product.Quantity > 2)`,
+			Output: []string{
+				"Account.Order.Product.Quantity (number)",
+			},
+		},
+		{
+			Expression: `Account.Order@$o.$o.OrderID`,
+			Output: []string{
+				"Account.Order.OrderID",
+			},
+		},
+		{
+			// Lambdas passed to higher-order functions are
+			// called with the items of the first argument.
+			Expression: `$map(Account.Order.Product, function($p) {$p.Price * 2})`,
+			Output: []string{
+				"Account.Order.Product (array)",
+				"Account.Order.Product.Price (number)",
+			},
+		},
+		{
+			Expression: `Account.Order.Product ~> $filter(function($p) {$p.Quantity > 1})`,
+			Output: []string{
+				"Account.Order.Product (array)",
+				"Account.Order.Product.Quantity (number)",
+			},
+		},
+		{
+			Expression: `Account.*.Product.Description.Colour`,
+			Output: []string{
+				"Account.*.Product.Description.Colour",
+			},
+		},
+		{
+			Expression: `Account.**.Colour ~> $join(", ")`,
+			Output: []string{
+				"Account.**.Colour (string)",
+			},
+		},
+		{
+			// Values used by dynamic lookups and functions
+			// that aren't known are dynamic.
+			Expression: `$lookup(Account, "Account Name")`,
+			Output: []string{
+				"Account (dynamic)",
+			},
+		},
+		{
+			Expression: `$f(Account.Order)`,
+			Output: []string{
+				"Account.Order (dynamic)",
+			},
+		},
+		{
+			Expression: `$map(Account.Order, $f)`,
+			Output: []string{
+				"Account.Order (dynamic)",
+			},
+		},
+		{
+			Expression: `"hello"`,
+			Output:     []string{},
+		},
+	}
+
+	for _, test := range tests {
+
+		refs := MustCompile(test.Expression).Inputs()
+
+		got := make([]string, len(refs))
+		for i, ref := range refs {
+			got[i] = ref.String()
+		}
+
+		if !reflect.DeepEqual(got, test.Output) {
+			t.Errorf("%s: expected inputs %q, got %q", test.Expression, test.Output, got)
+		}
+
+		// Check that the paths exist in the account data.
+		for _, ref := range refs {
+
+			if ref.Wildcard || ref.InferredType == InputTypeDynamic {
+				continue
+			}
+
+			path := make([]string, len(ref.Path))
+			for i, name := range ref.Path {
+				path[i] = "`" + name + "`"
+			}
+
+			if _, err := MustCompile(strings.Join(path, ".")).Eval(testdata.account); err != nil {
+				t.Errorf("%s: input %s: %s", test.Expression, ref, err)
+			}
+		}
+	}
+
+	// Wildcard paths are flagged.
+	refs := MustCompile(`Account.*.Product.Price`).Inputs()
+	if len(refs) != 1 || !refs[0].Wildcard {
+		t.Errorf("expected a wildcard input, got %v", refs)
+	}
+}
+
+func TestOptimize(t *testing.T) {
+
+	tests := []struct {
+		Expression string
+		Exts       map[string]Extension
+		Folded     []string
+	}{
+		{
+			Expression: `1 + 2 * 3`,
+			Folded:     []string{"1 + 2 * 3"},
+		},
+		{
+			Expression: `Order.(Price * (1 + 0.2))`,
+			Folded:     []string{"(1 + 0.2)"},
+		},
+		{
+			Expression: `[1, 2, [3, 4]]`,
+			Folded:     []string{"[1, 2, [3, 4]]"},
+		},
+		{
+			Expression: `{"total": 2 * 3, "name": Name}`,
+			Folded:     []string{"2 * 3"},
+		},
+		{
+			Expression: `$uppercase("abc") & $lowercase(Name)`,
+			Folded:     []string{`$uppercase("abc")`},
+		},
+		{
+			Expression: `$join(["a", "b"], ", ")`,
+			Folded:     []string{`$join(["a", "b"], ", ")`},
+		},
+		{
+			// Functions that are not pure.
+			Expression: `$random() * 10 + $millis()`,
+		},
+		{
+			// Functions that use the evaluation context.
+			Expression: `$uppercase() & $substring(2)`,
+		},
+		{
+			// Built-in functions hidden by a variable.
+			Expression: `($uppercase := function($s) { $s }; $uppercase("abc"))`,
+		},
+		{
+			// Built-in functions hidden by an extension.
+			Expression: `$uppercase("abc")`,
+			Exts: map[string]Extension{
+				"uppercase": {
+					Func: func(s string) string {
+						return s
+					},
+				},
+			},
+		},
+		{
+			Expression: `"abc" ~> $substring(1)`,
+		},
+		{
+			Expression: `$string(1/0)`,
+		},
+		{
+			Expression: `[1..3]`,
+		},
+	}
+
+	for _, test := range tests {
+
+		e := MustCompile(test.Expression)
+		must(t, "Exts", e.RegisterExts(test.Exts))
+
+		e.Optimize()
+
+		var folded []string
+		jparse.Walk(e.AST(), func(node jparse.Node) bool {
+			if _, ok := node.(*constantNode); ok {
+				folded = append(folded, node.String())
+			}
+			return true
+		})
+
+		if !reflect.DeepEqual(folded, test.Folded) {
+			t.Errorf("%s: expected folded nodes %q, got %q", test.Expression, test.Folded, folded)
+		}
+
+		if s := e.String(); s != MustCompile(test.Expression).String() {
+			t.Errorf("%s: String returned %s after Optimize", test.Expression, s)
+		}
+	}
+}
+
+func TestOptimizeCopiesValues(t *testing.T) {
+
+	e := MustCompile(`[1, 2, [3, 4]]`)
+	e.Optimize()
+
+	v1, err := e.Eval(nil)
+	if err != nil {
+		t.Fatalf("Eval: %s", err)
+	}
+
+	v1.([]interface{})[0] = "x"
+	v1.([]interface{})[2].([]interface{})[0] = "y"
+
+	v2, err := e.Eval(nil)
+	if err != nil {
+		t.Fatalf("Eval: %s", err)
+	}
+
+	exp := []interface{}{
+		float64(1),
+		float64(2),
+		[]interface{}{
+			float64(3),
+			float64(4),
+		},
+	}
+
+	if !reflect.DeepEqual(v2, exp) {
+		t.Errorf("expected %v, got %v", exp, v2)
+	}
+}
+
+func TestExprClone(t *testing.T) {
+
+	e := MustCompile(`$greet($name)`)
+
+	err := e.RegisterExts(map[string]Extension{
+		"greet": {
+			Func: func(s string) string {
+				return "Hello, " + s
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = e.RegisterVars(map[string]interface{}{
+		"name": "world",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clone := e.Clone()
+
+	err = clone.RegisterVars(map[string]interface{}{
+		"name": "clone",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Expr   *Expr
+		Output string
+	}{
+		{
+			Expr:   e,
+			Output: "Hello, world",
+		},
+		{
+			Expr:   clone,
+			Output: "Hello, clone",
+		},
+	}
+
+	for _, test := range tests {
+
+		output, err := test.Expr.Eval(nil)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.Output, err)
+		}
+
+		if output != test.Output {
+			t.Errorf("expected %q, got %q", test.Output, output)
+		}
+	}
+}
+
+func TestExprConcurrentEval(t *testing.T) {
+
+	// Run this test with the -race flag to detect data races.
+	e := MustCompile(`($prefix ~> $uppercase()) & ": " & ($names ~> $join(", "))`)
+
+	const n = 20
+	var wg sync.WaitGroup
+
+	for i := 0; i < n; i++ {
+
+		prefix := fmt.Sprintf("group %d", i)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			clone := e.Clone()
+
+			err := clone.RegisterVars(map[string]interface{}{
+				"prefix": prefix,
+				"names":  []interface{}{"a", "b", "c"},
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			expected := strings.ToUpper(prefix) + ": a, b, c"
+
+			// Evaluate repeatedly to check that evaluation
+			// does not modify the expression.
+			for j := 0; j < 10; j++ {
+
+				output, err := clone.Eval(nil)
+				if err != nil {
+					t.Errorf("%s: unexpected error: %s", prefix, err)
+					return
+				}
+
+				if output != expected {
+					t.Errorf("%s: expected %q, got %q", prefix, expected, output)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestCompileWithExts(t *testing.T) {
+
+	exts := map[string]Extension{
+		"greet": {
+			Func: func(s string) string {
+				return "Hello, " + s
+			},
+		},
+	}
+
+	e, err := CompileWithExts(`$greet("world")`, exts)
+	if err != nil {
+		t.Fatalf("CompileWithExts: %s", err)
+	}
+
+	output, err := e.Eval(nil)
+	if err != nil {
+		t.Fatalf("Eval: %s", err)
+	}
+
+	if output != "Hello, world" {
+		t.Errorf("expected %q, got %q", "Hello, world", output)
+	}
+
+	// The extensions are not available to other expressions.
+	_, err = MustCompile(`$greet("world")`).Eval(nil)
+	if err == nil {
+		t.Errorf("expected an error calling an unregistered extension")
+	}
+
+	if _, err := CompileWithExts(`$greet(`, exts); err == nil {
+		t.Errorf("expected an error for an invalid expression")
+	}
+
+	_, err = CompileWithExts(`$greet("world")`, map[string]Extension{
+		"greet": {
+			Func: "not a function",
+		},
+	})
+	if err == nil {
+		t.Errorf("expected an error for an invalid extension")
+	}
+}
+
+func TestRegisterExtsConcurrentCompile(t *testing.T) {
+
+	// Run this test with the -race flag to detect data races.
+	const n = 20
+	var wg sync.WaitGroup
+
+	// Compiled expressions take a snapshot of the package level
+	// extensions, so later registrations don't affect them.
+	before := MustCompile(`$raceExt0()`)
+
+	for i := 0; i < n; i++ {
+
+		name := fmt.Sprintf("raceExt%d", i)
+		value := float64(i)
+
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+
+			err := RegisterExts(map[string]Extension{
+				name: {
+					Func: func() float64 {
+						return value
+					},
+				},
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			e := MustCompile(`$uppercase("a")`)
+
+			for j := 0; j < 10; j++ {
+				if _, err := e.Eval(nil); err != nil {
+					t.Errorf("unexpected error: %s", err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if _, err := before.Eval(nil); err == nil {
+		t.Errorf("expected an error calling an extension registered after compilation")
+	}
+
+	output, err := MustCompile(`$raceExt0() + $raceExt1()`).Eval(nil)
+	if err != nil {
+		t.Fatalf("Eval: %s", err)
+	}
+
+	if output != float64(1) {
+		t.Errorf("expected 1, got %v [%T]", output, output)
+	}
+}
+
+func TestEvalReturnsLambda(t *testing.T) {
+
+	e := MustCompile(`function($x) { $x + $y }`)
+
+	output, err := e.EvalWithVars(nil, map[string]interface{}{
+		"y": 10.0,
+	})
+	if err != nil {
+		t.Fatalf("EvalWithVars: %s", err)
+	}
+
+	fn, ok := output.(jtypes.Callable)
+	if !ok {
+		t.Fatalf("expected a Callable, got %v [%T]", output, output)
+	}
+
+	// Evaluate other expressions, which reuse the environments
+	// of earlier evaluations where possible. The lambda must
+	// still see its own variables.
+	for i := 0; i < 10; i++ {
+		if _, err := MustCompile(`$y`).EvalWithVars(nil, map[string]interface{}{"y": float64(i)}); err != nil {
+			t.Fatalf("EvalWithVars: %s", err)
+		}
+	}
+
+	res, err := fn.Call([]reflect.Value{reflect.ValueOf(1.0)})
+	if err != nil {
+		t.Fatalf("Call: %s", err)
+	}
+
+	if got := res.Interface(); got != float64(11) {
+		t.Errorf("expected 11, got %v [%T]", got, got)
+	}
+}
+
+func TestEvalWithVars(t *testing.T) {
+
+	e := MustCompile(`$greeting & ", " & $double($count(names)) & " times"`)
+
+	err := e.RegisterVars(map[string]interface{}{
+		"greeting": "Hello",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := map[string]interface{}{
+		"names": []interface{}{"a", "b", "c"},
+	}
+
+	vars := map[string]interface{}{
+		"greeting": "Goodbye",
+		"double":   multiplyCallable(2),
+	}
+
+	output, err := e.EvalWithVars(data, vars)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if expected := "Goodbye, 6 times"; output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+
+	// The variables from EvalWithVars must not be visible to
+	// subsequent evaluations.
+	_, err = e.Eval(data)
+	if err == nil || !strings.Contains(err.Error(), "non-function $double") {
+		t.Errorf("expected a non-callable error, got %v", err)
+	}
+
+	output, err = e.EvalWithVars(data, map[string]interface{}{
+		"double": multiplyCallable(10),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if expected := "Hello, 30 times"; output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+
+	_, err = e.EvalWithVars(data, map[string]interface{}{
+		"not valid": 1,
+	})
+	if err == nil {
+		t.Errorf("expected an error for an invalid variable name")
+	}
+}
+
+// multiplyCallable is a jtypes.Callable that multiplies its
+// argument by a fixed amount.
+type multiplyCallable float64
+
+func (f multiplyCallable) Name() string {
+	return "multiply"
+}
+
+func (f multiplyCallable) ParamCount() int {
+	return 1
+}
+
+func (f multiplyCallable) Call(argv []reflect.Value) (reflect.Value, error) {
+
+	if len(argv) != 1 {
+		return reflect.Value{}, fmt.Errorf("multiply takes 1 argument")
+	}
+
+	n, ok := jtypes.AsNumber(argv[0])
+	if !ok {
+		return reflect.Value{}, fmt.Errorf("multiply takes a number")
+	}
+
+	return reflect.ValueOf(n * float64(f)), nil
+}
+
+var benchmarkRecords = func() []map[string]interface{} {
+
+	records := make([]map[string]interface{}, 100)
+	for i := range records {
+		records[i] = map[string]interface{}{
+			"id":     i,
+			"prices": []interface{}{1.5, 2.5, float64(i)},
+		}
+	}
+
+	return records
+}()
+
+const benchmarkExpr = `{"id": id, "total": $sum(prices) * $rate, "label": $prefix & id}`
+
+func BenchmarkEvalWithVars(b *testing.B) {
+
+	e := MustCompile(benchmarkExpr)
+
+	for i := 0; i < b.N; i++ {
+		for _, rec := range benchmarkRecords {
+
+			vars := map[string]interface{}{
+				"rate":   1.2,
+				"prefix": "item-",
+			}
+
+			if _, err := e.EvalWithVars(rec, vars); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkEvalSimplePath(b *testing.B) {
+
+	e := MustCompile(`Account.Order.Product.Price`)
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := e.Eval(testdata.account); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEvalLambdaHeavy(b *testing.B) {
+
+	e := MustCompile(`(
+		$total := function($p) { $p.Price * $p.Quantity };
+		$sum := function($a, $b) { $a + $b };
+		$map(Account.Order.Product, $total) ~> $reduce($sum)
+	)`)
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := e.Eval(testdata.account); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+var benchmarkItems = func() interface{} {
+
+	items := make([]interface{}, 10000)
+	for i := range items {
+		items[i] = map[string]interface{}{
+			"id":    float64(i),
+			"name":  fmt.Sprintf("Item-%d", i),
+			"price": float64(i % 100),
+		}
+	}
+
+	return map[string]interface{}{
+		"items": items,
+	}
+}()
+
+func BenchmarkEvalPredicate(b *testing.B) {
+
+	e := MustCompile(`items[price > 50 and name != "Item-99"].id`)
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := e.Eval(benchmarkItems); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEvalLambdaReduce(b *testing.B) {
+
+	e := MustCompile(`$reduce($map(items, function($v) {$v.price * 2}), function($a, $b) {$a + $b})`)
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := e.Eval(benchmarkItems); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+var benchmarkStrings = func() []interface{} {
+
+	strs := make([]interface{}, 10000)
+	for i := range strs {
+		strs[i] = fmt.Sprintf("Item-%d", i)
+	}
+
+	return strs
+}()
+
+func BenchmarkEvalDynamicRegex(b *testing.B) {
+
+	// The regex is built from a variable, so $eval parses it
+	// on every evaluation. Parsing reuses the compiled regex.
+	e := MustCompile(`$replace($, $eval("/" & $pattern & "/i"), "#")`)
+
+	err := e.RegisterVars(map[string]interface{}{
+		"pattern": "item-[0-9]+",
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		for _, s := range benchmarkStrings {
+			if _, err := e.Eval(s); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkCompilePerRecord(b *testing.B) {
+
+	for i := 0; i < b.N; i++ {
+		for _, rec := range benchmarkRecords {
+
+			e := MustCompile(benchmarkExpr)
+
+			err := e.RegisterVars(map[string]interface{}{
+				"rate":   1.2,
+				"prefix": "item-",
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			if _, err := e.Eval(rec); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+type evalToProduct struct {
+	Name     string `json:"Product Name"`
+	SKU      string
+	Price    float64
+	Quantity uint8
+	Details  *evalToDescription `json:"Description"`
+}
+
+type evalToDescription struct {
+	Colour string
+}
+
+type evalToOrder struct {
+	ID       string `json:"OrderID"`
+	Products []evalToProduct
+	Total    int
+	Extra    map[string]interface{}
+}
+
+func TestEvalTo(t *testing.T) {
+
+	var orders []evalToOrder
+
+	err := MustCompile(`Account.Order.{
+		"orderid": OrderID,
+		"Products": Product,
+		"total": $round($sum(Product.(Price * Quantity))),
+		"extra": {"lines": $count(Product)}
+	}`).EvalTo(testdata.account, &orders)
+	if err != nil {
+		t.Fatalf("EvalTo: %s", err)
+	}
+
+	exp := []evalToOrder{
+		{
+			ID: "order103",
+			Products: []evalToProduct{
+				{Name: "Bowler Hat", SKU: "0406654608", Price: 34.45, Quantity: 2, Details: &evalToDescription{"Purple"}},
+				{Name: "Trilby hat", SKU: "0406634348", Price: 21.67, Quantity: 1, Details: &evalToDescription{"Orange"}},
 			},
+			Total: 91,
+			Extra: map[string]interface{}{"lines": 2},
 		},
 		{
-			Expression: `Account ~> |Order|{"Product":"blah"},nomatch|`,
-			Output: map[string]interface{}{
-				"Account Name": "Firefly",
-				"Order": []interface{}{
-					map[string]interface{}{
-						"OrderID": "order103",
-						"Product": "blah",
-					},
-					map[string]interface{}{
-						"OrderID": "order104",
-						"Product": "blah",
-					},
-				},
+			ID: "order104",
+			Products: []evalToProduct{
+				{Name: "Bowler Hat", SKU: "040657863", Price: 34.45, Quantity: 4, Details: &evalToDescription{"Purple"}},
+				{Name: "Cloak", SKU: "0406654603", Price: 107.99, Quantity: 1, Details: &evalToDescription{"Black"}},
 			},
+			Total: 246,
+			Extra: map[string]interface{}{"lines": 2},
 		},
+	}
+
+	if !reflect.DeepEqual(orders, exp) {
+		t.Errorf("EvalTo: expected %+v, got %+v", exp, orders)
+	}
+
+	tests := []struct {
+		Expression string
+		Out        interface{}
+		Output     interface{}
+		Error      error
+	}{
 		{
-			Expression: `$ ~> |foo.bar|{"Description":"blah"}|`,
-			Output:     testdata.account,
+			Expression: `[1, 2, 3]`,
+			Out:        new([2]int8),
+			Output:     &[2]int8{1, 2},
 		},
 		{
-			Expression: `foo ~> |foo.bar|{"Description":"blah"}|`,
-			Error:      ErrUndefined,
+			Expression: `{"1": "one", "2": "two"}`,
+			Out:        new(map[int]string),
+			Output:     &map[int]string{1: "one", 2: "two"},
 		},
 		{
-			Expression: `Account ~> |Order|5|`,
-			Error: &EvalError{
-				Type:  ErrIllegalUpdate,
-				Token: "5",
-			},
+			Expression: `$string(2.5)`,
+			Out:        new(json.Number),
+			Output:     func() *json.Number { n := json.Number("2.5"); return &n }(),
 		},
 		{
-			Expression: `Account ~> |Order|"blah"|`,
-			Error: &EvalError{
-				Type:  ErrIllegalUpdate,
-				Token: `"blah"`,
-			},
+			Expression: `{"a": [true, null]}`,
+			Out:        new(interface{}),
+			Output: func() *interface{} {
+				var v interface{} = map[string]interface{}{
+					"a": []interface{}{true, nil},
+				}
+				return &v
+			}(),
 		},
 		{
-			Expression: `Account ~> |Order|[]|`,
-			Error: &EvalError{
-				Type:  ErrIllegalUpdate,
-				Token: "[]",
+			Expression: `Account.Order[0].Product[0].Price`,
+			Out:        new(int),
+			Error: &json.UnmarshalTypeError{
+				Value: "number 34.45",
+				Type:  reflect.TypeOf(0),
 			},
 		},
 		{
-			Expression: `Account ~> |Order|null|`,
-			Error: &EvalError{
-				Type:  ErrIllegalUpdate,
-				Token: "null",
+			Expression: `0.1 + 0.2`,
+			Out:        new(int),
+			Error: &json.UnmarshalTypeError{
+				Value: "number 0.3",
+				Type:  reflect.TypeOf(0),
 			},
 		},
 		{
-			Expression: `Account ~> |Order|false|`,
-			Error: &EvalError{
-				Type:  ErrIllegalUpdate,
-				Token: "false",
+			Expression: `{"n": 300}`,
+			Out:        new(struct{ N int8 }),
+			Error: &json.UnmarshalTypeError{
+				Value: "number 300",
+				Type:  reflect.TypeOf(int8(0)),
+				Field: "N",
 			},
 		},
 		{
-			Expression: `Account ~> |Order|{},5|`,
-			Error: &EvalError{
-				Type:  ErrIllegalDelete,
-				Token: "5",
+			Expression: `[{"n": -1}]`,
+			Out:        new([]struct{ N uint }),
+			Error: &json.UnmarshalTypeError{
+				Value: "number -1",
+				Type:  reflect.TypeOf(uint(0)),
+				Field: "[0].N",
 			},
 		},
 		{
-			Expression: `Account ~> |Order|{},{}|`,
-			Error: &EvalError{
-				Type:  ErrIllegalDelete,
-				Token: "{}",
+			Expression: `"hello"`,
+			Out:        new(bool),
+			Error: &json.UnmarshalTypeError{
+				Value: "string",
+				Type:  reflect.TypeOf(false),
 			},
 		},
 		{
-			Expression: `Account ~> |Order|{},null|`,
-			Error: &EvalError{
-				Type:  ErrIllegalDelete,
-				Token: "null",
-			},
+			Expression: `"2018-07-01T12:30:00Z"`,
+			Out:        new(time.Time),
+			Output: func() *time.Time {
+				tm := time.Date(2018, 7, 1, 12, 30, 0, 0, time.UTC)
+				return &tm
+			}(),
 		},
 		{
-			Expression: `Account ~> |Order|{},[1,2,3]|`,
-			Error: &EvalError{
-				Type:  ErrIllegalDelete,
-				Token: "[1, 2, 3]",
-			},
+			Expression: `Account.Missing`,
+			Out:        new(string),
+			Error:      ErrUndefined,
 		},
+		{
+			Expression: `Account.Missing`,
+			Out:        func() **string { s := "set"; p := &s; return &p }(),
+			Output:     new(*string),
+		},
+	}
+
+	for _, test := range tests {
+
+		err := MustCompile(test.Expression).EvalTo(testdata.account, test.Out)
+
+		if !reflect.DeepEqual(err, test.Error) {
+			t.Errorf("%s: expected error %v, got %v", test.Expression, test.Error, err)
+		}
+
+		if test.Error == nil && !reflect.DeepEqual(test.Out, test.Output) {
+			t.Errorf("%s: expected %v, got %v", test.Expression, test.Output, test.Out)
+		}
+	}
+
+	if err := MustCompile(`1`).EvalTo(nil, 0); err == nil {
+		t.Errorf("EvalTo: expected an error for a non-pointer")
+	}
+}
+
+type benchmarkRecord struct {
+	ID    int     `json:"id"`
+	Total float64 `json:"total"`
+	Label string  `json:"label"`
+}
+
+func BenchmarkEvalTo(b *testing.B) {
+
+	e := MustCompile(benchmarkExpr)
+	e.RegisterVars(map[string]interface{}{
+		"rate":   1.2,
+		"prefix": "item-",
 	})
+
+	for i := 0; i < b.N; i++ {
+		for _, rec := range benchmarkRecords {
+
+			var out benchmarkRecord
+			if err := e.EvalTo(rec, &out); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
 }
 
-func TestRegex(t *testing.T) {
+func BenchmarkEvalToViaJSON(b *testing.B) {
 
-	runTestCasesFunc(t, equalRegexMatches, nil, []*testCase{
-		{
-			Expression: `/ab/ ("ab")`,
-			Output: map[string]interface{}{
-				"match":  "ab",
-				"start":  0,
-				"end":    2,
-				"groups": []string{},
+	e := MustCompile(benchmarkExpr)
+	e.RegisterVars(map[string]interface{}{
+		"rate":   1.2,
+		"prefix": "item-",
+	})
+
+	for i := 0; i < b.N; i++ {
+		for _, rec := range benchmarkRecords {
+
+			res, err := e.Eval(rec)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			data, err := json.Marshal(res)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			var out benchmarkRecord
+			if err := json.Unmarshal(data, &out); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestCallContext(t *testing.T) {
+
+	exts := map[string]Extension{
+		// resolve evaluates a path relative to the root
+		// of the input data.
+		"resolve": {
+			Func: func(ctx CallContext, ref string) (interface{}, error) {
+				return ctx.Eval(ref, ctx.Root())
+			},
+		},
+		// describe returns a description of the evaluation
+		// context.
+		"describe": {
+			Func: func(ctx CallContext, prefix jtypes.OptionalString) string {
+				m, ok := ctx.Context().(map[string]interface{})
+				if !ok {
+					return prefix.String + "no context"
+				}
+				return fmt.Sprintf("%s%v", prefix.String, m["name"])
 			},
 		},
+		// lookup returns the value of a variable.
+		"lookup": {
+			Func: func(ctx CallContext, name string) (interface{}, error) {
+				v, ok := ctx.Lookup(name)
+				if !ok {
+					return nil, jtypes.ErrUndefined
+				}
+				return v, nil
+			},
+		},
+	}
+
+	data := map[string]interface{}{
+		"defaults": map[string]interface{}{
+			"colour": "red",
+		},
+		"items": []interface{}{
+			map[string]interface{}{
+				"name": "widget",
+				"ref":  "defaults.colour",
+			},
+			map[string]interface{}{
+				"name": "gadget",
+				"ref":  "defaults.size",
+			},
+		},
+	}
+
+	tests := []struct {
+		Expression string
+		Output     interface{}
+		Error      error
+	}{
 		{
-			Expression: `/ab/ ()`,
+			Expression: `items.$resolve(ref)`,
+			Output:     "red",
+		},
+		{
+			Expression: `$resolve("defaults.size")`,
 			Error:      ErrUndefined,
 		},
 		{
-			Expression: `/ab+/ ("ababbabbcc")`,
-			Output: map[string]interface{}{
-				"match":  "ab",
-				"start":  0,
-				"end":    2,
-				"groups": []string{},
+			Expression: `items.$describe()`,
+			Output: []interface{}{
+				"widget",
+				"gadget",
 			},
 		},
 		{
-			Expression: `/a(b+)/ ("ababbabbcc")`,
-			Output: map[string]interface{}{
-				"match": "ab",
-				"start": 0,
-				"end":   2,
-				"groups": []string{
-					"b",
-				},
+			Expression: `items.$describe("item: ")`,
+			Output: []interface{}{
+				"item: widget",
+				"item: gadget",
 			},
 		},
 		{
-			Expression: `/a(b+)/ ("ababbabbcc").next()`,
-			Output: map[string]interface{}{
-				"match": "abb",
-				"start": 2,
-				"end":   5,
-				"groups": []string{
-					"bb",
-				},
-			},
+			// The context is not available when the function
+			// is called indirectly.
+			Expression: `$map(["item: "], $describe)`,
+			Output:     []interface{}{"item: no context"},
 		},
 		{
-			Expression: `/a(b+)/ ("ababbabbcc").next().next()`,
-			Output: map[string]interface{}{
-				"match": "abb",
-				"start": 5,
-				"end":   8,
-				"groups": []string{
-					"bb",
-				},
-			},
+			Expression: `($colour := "blue"; $lookup("colour"))`,
+			Output:     "blue",
 		},
 		{
-			Expression: `/a(b+)/ ("ababbabbcc").next().next().next()`,
+			Expression: `$lookup("colour")`,
 			Error:      ErrUndefined,
 		},
 		{
-			Expression: []string{
-				`/a(b+)/i ("Ababbabbcc")`,
-				`/(?i)a(b+)/ ("Ababbabbcc")`,
+			Expression: `($x := 2; $resolve("$x * 10"))`,
+			Output:     float64(20),
+		},
+	}
+
+	for _, test := range tests {
+
+		e := MustCompile(test.Expression)
+		if err := e.RegisterExts(exts); err != nil {
+			t.Fatal(err)
+		}
+
+		output, err := e.Eval(data)
+
+		if !reflect.DeepEqual(output, test.Output) {
+			t.Errorf("%s: expected output %v, got %v", test.Expression, test.Output, output)
+		}
+
+		if !reflect.DeepEqual(err, test.Error) {
+			t.Errorf("%s: expected error %v, got %v", test.Expression, test.Error, err)
+		}
+	}
+}
+
+type flagsKey struct{}
+
+func TestEvalCtx(t *testing.T) {
+
+	var calls int
+	var cancel context.CancelFunc
+
+	exts := map[string]Extension{
+		// flag returns the value of a feature flag stored
+		// in the context.
+		"flag": {
+			Func: func(ctx context.Context, name string) bool {
+				flags, _ := ctx.Value(flagsKey{}).(map[string]bool)
+				return flags[name]
 			},
-			Output: map[string]interface{}{
-				"match": "Ab",
-				"start": 0,
-				"end":   2,
-				"groups": []string{
-					"b",
-				},
+			UndefinedHandler: jtypes.ArgUndefined(0),
+			Signature:        "<s:b>",
+		},
+		// fetch cancels the context on its second call.
+		"fetch": {
+			Func: func(ctx context.Context, id float64) (float64, error) {
+				calls++
+				if calls == 2 {
+					cancel()
+				}
+				if err := ctx.Err(); err != nil {
+					return 0, err
+				}
+				return id * 10, nil
+			},
+		},
+	}
+
+	flags := map[string]bool{
+		"beta": true,
+	}
+
+	tests := []struct {
+		Expression string
+		Output     interface{}
+		Calls      int
+		Error      bool
+	}{
+		{
+			Expression: `[$flag("beta"), $flag("alpha")]`,
+			Output: []interface{}{
+				true,
+				false,
+			},
+		},
+		{
+			// The context is available when the function
+			// is called indirectly.
+			Expression: `$map(["alpha", "beta"], $flag)`,
+			Output: []interface{}{
+				false,
+				true,
 			},
 		},
 		{
-			Expression: `//`,
-			Error: &jparse.Error{
-				Type:     jparse.ErrEmptyRegex,
-				Position: 1,
-			},
+			Expression: `$flag(missing)`,
+		},
+		{
+			Expression: `[1, 2, 3].$fetch($)`,
+			Calls:      2,
+			Error:      true,
+		},
+	}
+
+	for _, test := range tests {
+
+		e, err := CompileWithExts(test.Expression, exts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ctx context.Context
+		ctx = context.WithValue(context.Background(), flagsKey{}, flags)
+		ctx, cancel = context.WithCancel(ctx)
+
+		calls = 0
+		output, err := e.EvalCtx(ctx, nil)
+		cancel()
+
+		if test.Error {
+			var extErr *ExtensionError
+			if !errors.Is(err, context.Canceled) || !errors.As(err, &extErr) || extErr.Func != "fetch" {
+				t.Errorf("%s: expected a cancellation error from fetch, got %v", test.Expression, err)
+			}
+		} else if test.Output == nil && err != ErrUndefined {
+			t.Errorf("%s: expected error %v, got %v", test.Expression, ErrUndefined, err)
+		} else if test.Output != nil && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.Expression, err)
+		}
+
+		if !reflect.DeepEqual(output, test.Output) {
+			t.Errorf("%s: expected output %v, got %v", test.Expression, test.Output, output)
+		}
+
+		if calls != test.Calls {
+			t.Errorf("%s: expected %d calls to fetch, got %d", test.Expression, test.Calls, calls)
+		}
+	}
+
+	e, err := CompileWithExts(`$flag("beta")`, exts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Eval passes context.Background() to extensions.
+	if output, err := e.Eval(nil); output != false || err != nil {
+		t.Errorf("Eval: expected false, got %v (error %v)", output, err)
+	}
+
+	// EvalCtx fails if the context is already done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := e.EvalCtx(ctx, nil); err != context.Canceled {
+		t.Errorf("EvalCtx: expected error %v, got %v", context.Canceled, err)
+	}
+
+	// EvalCtx stops when the context is done, even if the
+	// expression does not call any functions that take one.
+	e = MustCompile(`($loop := function($n) { $loop($n + 1) }; $loop(0))`)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := e.EvalCtx(ctx, nil)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("EvalCtx: expected error %v, got %v", context.DeadlineExceeded, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("EvalCtx: expected the evaluation to stop when the context expired")
+	}
+}
+
+func TestExtensionSignature(t *testing.T) {
+
+	exts := map[string]Extension{
+		// join concatenates any number of values with
+		// a separator.
+		"join": {
+			Func: func(sep string, values ...interface{}) string {
+				parts := make([]string, len(values))
+				for i, v := range values {
+					parts[i] = fmt.Sprint(v)
+				}
+				return strings.Join(parts, sep)
+			},
+			Signature: "<sx+:s>",
+		},
+		// repeat repeats a string. The count is optional
+		// and the string defaults to the context.
+		"repeat": {
+			Func: func(s string, n jtypes.OptionalInt) string {
+				if !n.IsSet() {
+					return s
+				}
+				return strings.Repeat(s, n.Int)
+			},
+			Signature:        "<s-n?:s>",
+			UndefinedHandler: jtypes.ArgUndefined(0),
+		},
+	}
+
+	data := map[string]interface{}{
+		"name": "ab",
+	}
+
+	tests := []struct {
+		Expression string
+		Output     interface{}
+		Error      error
+	}{
+		{
+			Expression: `$join("-", 1, "two", true)`,
+			Output:     "1-two-true",
 		},
 		{
-			Expression: `/`,
-			Error: &jparse.Error{
-				Type:     jparse.ErrUnterminatedRegex,
-				Position: 1,
-				Hint:     "/",
-			},
+			// Partial application of a variadic extension.
+			Expression: `$join("+", ?, ?)(1, 2)`,
+			Output:     "1+2",
 		},
-	})
-}
-
-func TestRegex2(t *testing.T) {
-
-	runTestCases(t, testdata.account, []*testCase{
 		{
-			Expression: []string{
-				`Account.Order.Product[$.` + "`Product Name`" + ` ~> /hat/i].ProductID`,
-				`Account.Order.Product[$.` + "`Product Name`" + ` ~> /(?i)hat/].ProductID`,
-			},
-			Output: []interface{}{
-				float64(858383),
-				float64(858236),
-				float64(858383),
-			},
+			Expression: `($sum := $join(" + ", ?, ?, 3); $sum("x", "y"))`,
+			Output:     "x + y + 3",
 		},
-	})
-}
-
-func TestRegexMatch(t *testing.T) {
-
-	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `$match("ababbabbcc",/ab/)`,
-			Output: []map[string]interface{}{
-				{
-					"match":  "ab",
-					"index":  0,
-					"groups": []string{},
-				},
-				{
-					"match":  "ab",
-					"index":  2,
-					"groups": []string{},
-				},
-				{
-					"match":  "ab",
-					"index":  5,
-					"groups": []string{},
-				},
+			Expression: `$join()`,
+			Error: &ArgCountError{
+				Func:     "join",
+				Expected: 2,
+				Received: 0,
 			},
 		},
 		{
-			Expression: `$match("ababbabbcc",/a(b+)/)`,
-			Output: []map[string]interface{}{
-				{
-					"match": "ab",
-					"index": 0,
-					"groups": []string{
-						"b",
-					},
-				},
-				{
-					"match": "abb",
-					"index": 2,
-					"groups": []string{
-						"bb",
-					},
-				},
-				{
-					"match": "abb",
-					"index": 5,
-					"groups": []string{
-						"bb",
-					},
-				},
+			Expression: `$join(1, 2)`,
+			Error: &ArgTypeError{
+				Func:  "join",
+				Which: 1,
 			},
 		},
 		{
-			Expression: `$match("ababbabbcc",/a(b+)/, 1)`,
-			Output: []map[string]interface{}{
-				{
-					"match": "ab",
-					"index": 0,
-					"groups": []string{
-						"b",
-					},
-				},
-			},
+			Expression: `$repeat("x", 3)`,
+			Output:     "xxx",
 		},
 		{
-			Expression: []string{
-				`$match("ababbabbcc",/a(b+)/, 0)`,
-				`$match("ababbabbcc",/a(xb+)/)`,
-			},
-			Output: []map[string]interface{}{},
+			Expression: `$repeat("x")`,
+			Output:     "x",
 		},
 		{
-			Expression: `$match(nothing,/a(xb+)/)`,
-			Error:      ErrUndefined,
+			Expression: `name.$repeat(2)`,
+			Output:     "abab",
 		},
 		{
-			Expression: `$match("a, b, c, d", /ab/, -3)`,
-			Error:      fmt.Errorf("third argument of function match must evaluate to a positive number"), // TODO: use a proper error
+			Expression: `name.$repeat()`,
+			Output:     "ab",
 		},
 		{
-			Expression: `$match(12345, 3)`,
-			Error: &ArgTypeError{
-				Func:  "match",
-				Which: 1,
+			Expression: `$repeat("x", 1, 2)`,
+			Error: &ArgCountError{
+				Func:     "repeat",
+				Expected: 2,
+				Received: 3,
 			},
 		},
 		{
-			Expression: []string{
-				`$match("a, b, c, d", "ab")`,
-				`$match("a, b, c, d", true)`,
-			},
+			// The UndefinedHandler is called after the
+			// arguments are checked against the signature,
+			// so undefined arguments don't hide errors.
+			Expression: `$repeat(missing, "not a number")`,
 			Error: &ArgTypeError{
-				Func:  "match",
+				Func:  "repeat",
 				Which: 2,
 			},
 		},
 		{
-			Expression: []string{
-				`$match("a, b, c, d", /ab/, null)`,
-				`$match("a, b, c, d", /ab/, "2")`,
-			},
-			Error: &ArgTypeError{
-				Func:  "match",
-				Which: 3,
-			},
+			Expression: `$repeat(missing, 2)`,
+			Error:      ErrUndefined,
 		},
 		{
-			Expression: `$match(12345)`,
-			Error: &ArgCountError{
-				Func:     "match",
-				Expected: 3,
-				Received: 1,
+			Expression: `$repeat("x", "not a number")`,
+			Error: &ArgTypeError{
+				Func:  "repeat",
+				Which: 2,
 			},
 		},
-	})
+	}
+
+	for _, test := range tests {
+
+		e := MustCompile(test.Expression)
+		if err := e.RegisterExts(exts); err != nil {
+			t.Fatal(err)
+		}
+
+		output, err := e.Eval(data)
+
+		if !reflect.DeepEqual(output, test.Output) {
+			t.Errorf("%s: expected output %v, got %v", test.Expression, test.Output, output)
+		}
+
+		if !reflect.DeepEqual(err, test.Error) {
+			t.Errorf("%s: expected error %v, got %v", test.Expression, test.Error, err)
+		}
+	}
 }
 
-func TestRegexReplace(t *testing.T) {
+func TestExtensionUndefinedArgs(t *testing.T) {
 
-	runTestCases(t, nil, []*testCase{
-		{
-			Expression: `$replace("ababbxabbcc",/b+/, "yy")`,
-			Output:     "ayyayyxayycc",
+	join := func(values ...interface{}) string {
+		parts := make([]string, len(values))
+		for i, v := range values {
+			parts[i] = fmt.Sprint(v)
+		}
+		return strings.Join(parts, ",")
+	}
+
+	exts := map[string]Extension{
+		"any": {
+			Func:          join,
+			UndefinedArgs: jtypes.ArgsAnyUndefined(),
 		},
+		"all": {
+			Func:          join,
+			UndefinedArgs: jtypes.ArgsAllUndefined(),
+		},
+		// second returns undefined if its second or
+		// third argument is undefined.
+		"second": {
+			Func:          join,
+			UndefinedArgs: jtypes.ArgUndefinedAny(1, 2),
+		},
+	}
+
+	tests := []struct {
+		Expression string
+		Output     interface{}
+	}{
 		{
-			Expression: `$replace("ababbxabbcc",/b+/, "yy", 2)`,
-			Output:     "ayyayyxabbcc",
+			Expression: `$any(1, 2)`,
+			Output:     "1,2",
 		},
 		{
-			Expression: `$replace("ababbxabbcc",/b+/, "yy", 0)`,
-			Output:     "ababbxabbcc",
+			Expression: `$any(1, missing)`,
 		},
 		{
-			Expression: `$replace("ababbxabbcc",/d+/, "yy")`,
-			Output:     "ababbxabbcc",
+			Expression: `$any()`,
+			Output:     "",
 		},
 		{
-			Expression: `$replace("John Smith", /(\w+)\s(\w+)/, "$2, $1")`,
-			Output:     "Smith, John",
+			Expression: `$all(1, missing)`,
+			Output:     "1,<nil>",
 		},
 		{
-			Expression: `$replace("265USD", /([0-9]+)USD/, "$$$1")`,
-			Output:     "$265",
+			Expression: `$all(missing, missing)`,
 		},
 		{
-			Expression: `$replace("265USD", /([0-9]+)USD/, "$w")`,
-			Output:     "$w",
+			Expression: `$all()`,
+			Output:     "",
 		},
 		{
-			Expression: `$replace("265USD", /([0-9]+)USD/, "$0 -> $$$1")`,
-			Output:     "265USD -> $265",
+			Expression: `$second(missing, 2)`,
+			Output:     "<nil>,2",
 		},
 		{
-			Expression: `$replace("265USD", /([0-9]+)USD/, "$0$1$2")`,
-			Output:     "265USD265",
+			Expression: `$second(1, missing)`,
 		},
 		{
-			Expression: `$replace("abcd", /(ab)|(a)/, "[1=$1][2=$2]")`,
-			Output:     "[1=ab][2=]cd",
+			Expression: `$second(1, 2, missing)`,
 		},
 		{
-			Expression: `$replace("abracadabra", /bra/, "*")`,
-			Output:     "a*cada*",
+			// Positions beyond the last argument are
+			// ignored.
+			Expression: `$second(1)`,
+			Output:     "1",
 		},
 		{
-			Expression: `$replace("abracadabra", /a.*a/, "*")`,
-			Output:     "*",
+			// Missing placeholder arguments are undefined.
+			Expression: `$second(1, ?)()`,
+		},
+	}
+
+	for _, test := range tests {
+
+		e, err := CompileWithExts(test.Expression, exts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		output, err := e.Eval(nil)
+
+		if !reflect.DeepEqual(output, test.Output) {
+			t.Errorf("%s: expected output %v, got %v", test.Expression, test.Output, output)
+		}
+
+		if test.Output == nil && err != ErrUndefined {
+			t.Errorf("%s: expected error %v, got %v", test.Expression, ErrUndefined, err)
+		} else if test.Output != nil && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.Expression, err)
+		}
+	}
+
+	err := RegisterExts(map[string]Extension{
+		"both": {
+			Func:             join,
+			UndefinedHandler: jtypes.ArgUndefined(0),
+			UndefinedArgs:    jtypes.ArgUndefinedAny(0),
+		},
+	})
+	if err == nil {
+		t.Errorf("expected an error for an extension with both an UndefinedHandler and UndefinedArgs")
+	}
+}
+
+func TestExtensionApplyContext(t *testing.T) {
+
+	repeat := func(s string, n jtypes.OptionalInt) string {
+		if !n.IsSet() {
+			return s
+		}
+		return strings.Repeat(s, n.Int)
+	}
+
+	exts := map[string]Extension{
+		// repeat uses the context as its first argument.
+		"repeat": {
+			Func:         repeat,
+			ApplyContext: true,
 		},
+		// repeatSig is repeat with a signature.
+		"repeatSig": {
+			Func:         repeat,
+			Signature:    "<sn?:s>",
+			ApplyContext: true,
+		},
+		// strict never uses the context.
+		"strict": {
+			Func: repeat,
+		},
+	}
+
+	data := map[string]interface{}{
+		"name": "ab",
+		"age":  float64(42),
+	}
+
+	tests := []struct {
+		Expressions []string
+		Output      interface{}
+		Error       error
+	}{
 		{
-			Expression: `$replace("abracadabra", /a.*?a/, "*")`,
-			Output:     "*c*bra",
+			Expressions: []string{
+				`name.$repeat()`,
+				`name.$repeatSig()`,
+				`$strict(name)`,
+				`$repeat(name)`,
+			},
+			Output: "ab",
 		},
 		{
-			Expression: `$replace("abracadabra", /a/, "")`,
-			Output:     "brcdbr",
+			Expressions: []string{
+				`name.$repeat(2)`,
+				`name.$repeatSig(2)`,
+				`$repeat("ab", 2)`,
+				`age.$repeat("ab", 2)`,
+			},
+			Output: "abab",
 		},
 		{
-			Expression: `$replace("abracadabra", /a(.)/, "a$1$1")`,
-			Output:     "abbraccaddabbra",
+			// Outside a path, the context is the input.
+			Expressions: []string{
+				`$repeat()`,
+				`$repeat(2)`,
+			},
+			Error: &ArgTypeError{
+				Func:    "repeat",
+				Which:   1,
+				Context: true,
+			},
 		},
 		{
-			Expression: `$replace("abracadabra", /.*?/, "$1")`,
-			Skip:       true, // jsonata-js throws error D1004
+			Expressions: []string{
+				`$repeatSig()`,
+				`$repeatSig(2)`,
+			},
+			Error: &ArgTypeError{
+				Func:    "repeatSig",
+				Which:   1,
+				Context: true,
+			},
 		},
 		{
-			Expression: `$replace("AAAA", /A+/, "b")`,
-			Output:     "b",
+			// The context is used in place of the first
+			// argument, so 2 is the first argument.
+			Expressions: []string{
+				`name.$repeat(2, 3)`,
+			},
+			Error: &ArgTypeError{
+				Func:     "repeat",
+				Which:    1,
+				Position: 5,
+			},
 		},
 		{
-			Expression: `$replace("AAAA", /A+?/, "b")`,
-			Output:     "bbbb",
+			// The context is undefined.
+			Expressions: []string{
+				`missing.$repeat()`,
+				`missing.$repeatSig(2)`,
+			},
+			Error: ErrUndefined,
 		},
 		{
-			Expression: `$replace("darted", /^(.*?)d(.*)$/, "$1c$2")`,
-			Output:     "carted",
+			Expressions: []string{
+				`name.$strict()`,
+			},
+			Error: &ArgCountError{
+				Func:     "strict",
+				Expected: 2,
+				Received: 0,
+				Position: 5,
+			},
 		},
 		{
-			Expression: `$replace("abcdefghijklmno", /(a)(b)(c)(d)(e)(f)(g)(h)(i)(j)(k)(l)(m)/, "$8$5$12$12$18$123")`,
-			Output:     "hella8l3no",
+			Expressions: []string{
+				`name.$strict(2)`,
+			},
+			Error: &ArgTypeError{
+				Func:     "strict",
+				Which:    1,
+				Position: 5,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		for _, expr := range test.Expressions {
+
+			e := MustCompile(expr)
+			if err := e.RegisterExts(exts); err != nil {
+				t.Fatal(err)
+			}
+
+			output, err := e.Eval(data)
+
+			if !reflect.DeepEqual(output, test.Output) {
+				t.Errorf("%s: expected output %v, got %v", expr, test.Output, output)
+			}
+
+			if !reflect.DeepEqual(err, test.Error) {
+				t.Errorf("%s: expected error %v, got %v", expr, test.Error, err)
+			}
+		}
+	}
+}
+
+func TestExtensionPartials(t *testing.T) {
+
+	repeat := func(s string, n int) string {
+		return strings.Repeat(s, n)
+	}
+
+	exts := map[string]Extension{
+		// repeat returns undefined if its first argument
+		// is undefined.
+		"repeat": {
+			Func:             repeat,
+			UndefinedHandler: jtypes.ArgUndefined(0),
 		},
-		{
-			Expression: `$replace("abcdefghijklmno", /xyz/, "$8$5$12$12$18$123")`,
-			Output:     "abcdefghijklmno",
+		// strict has no UndefinedHandler.
+		"strict": {
+			Func: repeat,
 		},
+	}
+
+	data := map[string]interface{}{
+		"name": "ab",
+	}
+
+	// Partially applied and chained extensions should behave
+	// like direct calls.
+	tests := []struct {
+		Expressions []string
+		Output      interface{}
+		Error       error
+	}{
 		{
-			Expression: `$replace("abcdefghijklmno", /ijk/, "$8$5$12$12$18$123")`,
-			Output:     "abcdefgh22823lmno",
+			Expressions: []string{
+				`$repeat(name, 2)`,
+				`$repeat(?, 2)(name)`,
+				`($twice := $repeat(?, 2); $twice(name))`,
+				`name ~> $repeat(?, 2)`,
+				`name ~> $repeat(2)`,
+				`($f := $repeat(?, 2) ~> $uppercase; $lowercase($f(name)))`,
+			},
+			Output: "abab",
 		},
 		{
-			Expression: `$replace("abcdefghijklmno", /(ijk)/, "$8$5$12$12$18$123")`,
-			Output:     "abcdefghijk2ijk2ijk8ijk23lmno",
+			Expressions: []string{
+				`$repeat(missing, 2)`,
+				`$repeat(?, 2)(missing)`,
+				`($twice := $repeat(?, 2); $twice(missing))`,
+				`($twice := $repeat(?, 2); $twice())`,
+				`missing ~> $repeat(?, 2)`,
+				`($f := $repeat(?, 2) ~> $uppercase; $f(missing))`,
+				`($f := $repeat(?, 2) ~> $repeat(?, 3); $f(missing))`,
+			},
+			Error: ErrUndefined,
 		},
 		{
-			Expression: `$replace("abcdefghijklmno", /ijk/, "$x")`,
-			Output:     "abcdefgh$xlmno",
+			Expressions: []string{
+				`$strict(missing, 2)`,
+				`$strict(?, 2)(missing)`,
+				`($twice := $strict(?, 2); $twice(missing))`,
+			},
+			Error: &ArgTypeError{
+				Func:  "strict",
+				Which: 1,
+			},
 		},
 		{
-			Expression: `$replace("abcdefghijklmno", /(ijk)/, "$x$")`,
-			Output:     "abcdefgh$x$lmno",
+			Expressions: []string{
+				`($f := $strict(?, 2) ~> $uppercase; $f(missing))`,
+			},
+			Error: &ChainError{
+				Func:  "strict_partial",
+				Stage: 1,
+				Err: &ArgTypeError{
+					Func:  "strict",
+					Which: 1,
+				},
+			},
 		},
-	})
+	}
+
+	for _, test := range tests {
+		for _, expr := range test.Expressions {
+
+			e, err := CompileWithExts(expr, exts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			output, err := e.Eval(data)
+
+			if !reflect.DeepEqual(output, test.Output) {
+				t.Errorf("%s: expected output %v, got %v", expr, test.Output, output)
+			}
+
+			if !reflect.DeepEqual(err, test.Error) {
+				t.Errorf("%s: expected error %v, got %v", expr, test.Error, err)
+			}
+		}
+	}
 }
 
-func TestRegexReplace2(t *testing.T) {
+func TestExtensionHigherOrder(t *testing.T) {
 
-	runTestCases(t, testdata.account, []*testCase{
-		{
-			Expression: []string{
-				`Account.Order.Product.$replace($.` + "`Product Name`" + `, /hat/i, function($match) { "foo" })`,
-				`Account.Order.Product.$replace($.` + "`Product Name`" + `, /(?i)hat/, function($match) { "foo" })`,
+	exts := map[string]Extension{
+		"pair": {
+			Func: func(v interface{}, k string) string {
+				return fmt.Sprintf("%s=%v", k, v)
 			},
-			Output: []interface{}{
-				"Bowler foo",
-				"Trilby foo",
-				"Bowler foo",
-				"Cloak",
+		},
+		"evenIndex": {
+			Func: func(v interface{}, i int) bool {
+				return i%2 == 0
 			},
 		},
-		{
-			Expression: []string{
-				`Account.Order.Product.$replace($.` + "`Product Name`" + `, /(h)(at)/i, function($match) { $uppercase($match.match) })`,
-				`Account.Order.Product.$replace($.` + "`Product Name`" + `, /(?i)(h)(at)/, function($match) { $uppercase($match.match) })`,
+		"lastIndex": {
+			Func: func(v interface{}, i int, a []interface{}) bool {
+				return i == len(a)-1
 			},
-			Output: []interface{}{
-				"Bowler HAT",
-				"Trilby HAT",
-				"Bowler HAT",
-				"Cloak",
+		},
+		"shortKey": {
+			Func: func(v interface{}, k string) bool {
+				return len(k) == 1
 			},
 		},
-		{
-			Expression: `Account.Order.Product.$replace($.` + "`Product Name`" + `, /(?i)hat/,
-				function($match) { true })`,
-			Error: fmt.Errorf("third argument of function replace must be a function that returns a string"),
+		"add": {
+			Func: func(x, y float64) float64 {
+				return x + y
+			},
 		},
-		{
-			Expression: `Account.Order.Product.$replace($.` + "`Product Name`" + `, /(?i)hat/,
-				function($match) { 42 })`,
-			Error: fmt.Errorf("third argument of function replace must be a function that returns a string"),
+		"greater": {
+			Func: func(x, y float64) bool {
+				return x > y
+			},
 		},
-	})
-}
+		"one": {
+			Func: func() int {
+				return 1
+			},
+		},
+	}
 
-func TestRegexReplace3(t *testing.T) {
+	data := map[string]interface{}{
+		"list": []interface{}{
+			float64(1),
+			float64(2),
+			float64(3),
+		},
+		"obj": map[string]interface{}{
+			"a":  "x",
+			"bb": "y",
+		},
+	}
 
-	runTestCases(t, nil, []*testCase{
+	// Go extensions should be called with as many arguments
+	// as they take, like lambdas.
+	tests := []struct {
+		Expression string
+		Output     interface{}
+	}{
 		{
-			Expression: `$replace("temperature = 68F today", /(-?\d+(?:\.\d*)?)F\b/,
-				function($m) { ($number($m.groups[0]) - 32) * 5/9 & "C" })`,
-			Output: "temperature = 20C today",
+			Expression: `$sort($each(obj, $pair))`,
+			Output: []interface{}{
+				"a=x",
+				"bb=y",
+			},
 		},
-	})
-}
-
-func TestRegexContains(t *testing.T) {
-
-	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `$contains("ababbxabbcc", /ab+/)`,
-			Output:     true,
+			Expression: `$filter(list, $evenIndex)`,
+			Output: []interface{}{
+				float64(1),
+				float64(3),
+			},
 		},
 		{
-			Expression: `$contains("ababbxabbcc", /ax+/)`,
-			Output:     false,
+			Expression: `$sift(obj, $shortKey)`,
+			Output: map[string]interface{}{
+				"a": "x",
+			},
 		},
-	})
-}
-
-func TestRegexContains2(t *testing.T) {
-
-	runTestCases(t, testdata.account, []*testCase{
 		{
-			Expression: "Account.Order.Product[$contains(`Product Name`, /hat/)].ProductID",
-			Output:     float64(858236),
+			Expression: `$reduce(list, $add)`,
+			Output:     float64(6),
 		},
 		{
-			Expression: []string{
-				"Account.Order.Product[$contains(`Product Name`, /hat/i)].ProductID",
-				"Account.Order.Product[$contains(`Product Name`, /(?i)hat/)].ProductID",
-			},
+			Expression: `$sort(list, $greater)`,
 			Output: []interface{}{
-				float64(858383),
-				float64(858236),
-				float64(858383),
+				float64(1),
+				float64(2),
+				float64(3),
 			},
 		},
-	})
-}
-
-func TestRegexSplit(t *testing.T) {
-
-	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `$split("ababbxabbcc",/b+/)`,
-			Output: []string{
-				"a",
-				"a",
-				"xa",
-				"cc",
-			},
+			Expression: `$single(list, $lastIndex)`,
+			Output:     float64(3),
 		},
 		{
-			Expression: `$split("ababbxabbcc",/b+/, 2)`,
-			Output: []string{
-				"a",
-				"a",
+			Expression: `$map(list, $one)`,
+			Output: []interface{}{
+				1,
+				1,
+				1,
 			},
 		},
 		{
-			Expression: `$split("ababbxabbcc",/d+/)`,
-			Output: []string{
-				"ababbxabbcc",
+			Expression: `$each(obj, $one)`,
+			Output: []interface{}{
+				1,
+				1,
 			},
 		},
-	})
-}
-
-var reNow = regexp.MustCompile(`^\d\d\d\d-\d\d-\d\dT\d\d:\d\d:\d\d.\d\d\dZ$`)
-
-func TestFuncNow(t *testing.T) {
-
-	expr, err := Compile("$now()")
-	if err != nil {
-		t.Fatalf("Compile failed: %s", err)
 	}
 
-	var results [2]string
-
-	for i := range results {
+	for _, test := range tests {
 
-		output, err := expr.Eval(nil)
+		e, err := CompileWithExts(test.Expression, exts)
 		if err != nil {
-			t.Fatalf("Eval failed: %s", err)
+			t.Fatal(err)
 		}
 
-		results[i] = output.(string)
-		// $now() returns a timestamp that includes milliseconds, so
-		// sleeping for 1ms should be enough to reliably produce a
-		// different result.
-		time.Sleep(1 * time.Millisecond)
-	}
-
-	for _, s := range results {
-		if !reNow.MatchString(s) {
-			t.Errorf("Timestamp %q does not match expected regex %q", s, reNow)
+		output, err := e.Eval(data)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.Expression, err)
 		}
-	}
 
-	if results[0] == results[1] {
-		t.Errorf("calling $now() %d times returned identical timestamps: %q", len(results), results[0])
+		output = jtypes.Plain(output)
+		if !reflect.DeepEqual(output, test.Output) {
+			t.Errorf("%s: expected output %v, got %v", test.Expression, test.Output, output)
+		}
 	}
 }
 
-func TestFuncNow2(t *testing.T) {
+func TestExtensionError(t *testing.T) {
 
-	runTestCases(t, nil, []*testCase{
+	errFailed := errors.New("something failed")
+
+	exts := map[string]Extension{
+		"fail": {
+			Func: func(v interface{}) (interface{}, error) {
+				return nil, errFailed
+			},
+		},
+	}
+
+	tests := []struct {
+		Expression string
+		Error      error
+	}{
 		{
-			Expression: `{"now": $now(), "delay": $sum([1..10000]), "later": $now()}.(now = later)`,
-			Output:     true,
+			Expression: `1 + $fail(1)`,
+			Error: &ExtensionError{
+				Func:     "fail",
+				Position: 4,
+				Err:      errFailed,
+			},
 		},
 		{
-			Expression: `$now()`,
-			Exts: map[string]Extension{
-				"now": {
-					Func: func() string {
-						return "time for tea"
-					},
-				},
+			Expression: `{"a": [1, 2, 3].($ + 1)}.a ~> $fail()`,
+			Error: &ExtensionError{
+				Func:     "fail",
+				Position: 0,
+				Err:      errFailed,
+			},
+		},
+		{
+			// The position is unknown when the function is
+			// called by another function.
+			Expression: `$map([1, 2], $fail)`,
+			Error: &ExtensionError{
+				Func: "fail",
+				Err:  errFailed,
 			},
-			Output: "time for tea",
 		},
-	})
-}
-
-func TestFuncMillis(t *testing.T) {
-
-	expr, err := Compile("$millis()")
-	if err != nil {
-		t.Fatalf("Compile failed: %s", err)
 	}
 
-	var results [2]int64
-
-	for i := range results {
+	for _, test := range tests {
 
-		output, err := expr.Eval(nil)
-		if err != nil {
-			t.Fatalf("Eval failed: %s", err)
+		e := MustCompile(test.Expression)
+		if err := e.RegisterExts(exts); err != nil {
+			t.Fatal(err)
 		}
 
-		results[i] = output.(int64)
-		// $millis() returns the unix time in milliseconds, so
-		// sleeping for 1ms should be enough to reliably produce
-		// a different result.
-		time.Sleep(1 * time.Millisecond)
-	}
+		_, err := e.Eval(nil)
 
-	for _, ms := range results {
-		if ms <= 1502264152715 || ms >= 2000000000000 {
-			t.Errorf("Unix time %d does not fall between expected values 1502264152715 and 2000000000000", ms)
+		if !reflect.DeepEqual(err, test.Error) {
+			t.Errorf("%s: expected error %v, got %v", test.Expression, test.Error, err)
+		}
+
+		if errors.Unwrap(err) != errFailed {
+			t.Errorf("%s: expected Unwrap to return %v, got %v", test.Expression, errFailed, errors.Unwrap(err))
 		}
 	}
 
-	if results[0] == results[1] {
-		t.Errorf("calling $millis() %d times returned identical unix times: %d", len(results), results[0])
+	// Errors from built-in functions are not wrapped.
+	_, err := MustCompile(`$number("x")`).Eval(nil)
+	if _, ok := err.(*jlib.ArgValueError); !ok {
+		t.Errorf("expected a jlib.ArgValueError, got %T", err)
 	}
 }
 
-func TestFuncMillis2(t *testing.T) {
-
-	runTestCases(t, nil, []*testCase{
-		{
-			Expression: `{"now": $millis(), "delay": $sum([1..10000]), "later": $millis()}.(now = later)`,
-			Output:     true,
-		},
-	})
-}
+func TestCustomOperators(t *testing.T) {
 
-func TestFuncToMillis(t *testing.T) {
+	fuzzy := Operator{
+		BindingPower: 50,
+		Func: func(lhs, rhs interface{}) (interface{}, error) {
+			s1, ok1 := lhs.(string)
+			s2, ok2 := rhs.(string)
+			if !ok1 || !ok2 {
+				return nil, fmt.Errorf("cannot compare %v and %v", lhs, rhs)
+			}
+			return strings.EqualFold(s1, s2), nil
+		},
+	}
 
-	runTestCases(t, nil, []*testCase{
-		{
-			Expression: `$toMillis("1970-01-01T00:00:00.001Z")`,
-			Output:     int64(1),
+	orElse := Operator{
+		BindingPower: 30,
+		Func: func(lhs, rhs interface{}) (interface{}, error) {
+			if lhs == nil {
+				return rhs, nil
+			}
+			return lhs, nil
 		},
-		{
-			Expression: `$toMillis("2017-10-30T16:25:32.935Z")`,
-			Output:     int64(1509380732935),
+		EvalUndefined: true,
+	}
+
+	must(t, "RegisterOperator", RegisterOperator("~~", fuzzy))
+	must(t, "RegisterOperator", RegisterOperator("!?", orElse))
+	defer UnregisterOperator("~~")
+	defer UnregisterOperator("!?")
+
+	data := map[string]interface{}{
+		"items": []interface{}{
+			map[string]interface{}{
+				"name":  "Apple",
+				"price": 1.5,
+			},
+			map[string]interface{}{
+				"name":  "Pear",
+				"price": 2.5,
+			},
 		},
+		"none": nil,
+	}
+
+	runTestCases(t, data, []*testCase{
 		{
-			Expression: `$toMillis(foo)`,
-			Error:      ErrUndefined,
+			Expression: `"Apple" ~~ "APPLE"`,
+			Output:     true,
 		},
 		{
-			Expression: `$toMillis("foo")`,
-			Error:      fmt.Errorf(`could not parse time "foo"`),
+			Expression: `items[name ~~ "pear"].price`,
+			Output:     2.5,
 		},
-	})
-}
-
-func TestFuncFromMillis(t *testing.T) {
-
-	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `$fromMillis(1)`,
-			Output:     "1970-01-01T00:00:00.001Z",
+			Expression: `$map(items.name, function($v){ $v ~~ "apple" })`,
+			Output: []interface{}{
+				true,
+				false,
+			},
 		},
 		{
-			Expression: `$fromMillis(1509380732935)`,
-			Output:     "2017-10-30T16:25:32.935Z",
+			// & binds more tightly than ~~, which binds more
+			// tightly than and.
+			Expression: `"app" & "le" ~~ "APPLE" and "x" ~~ "X"`,
+			Output:     true,
 		},
 		{
-			Expression: `$fromMillis(foo)`,
+			// By default, undefined operands give an undefined
+			// result.
+			Expression: `missing ~~ "apple"`,
 			Error:      ErrUndefined,
 		},
-	})
-}
-
-func TestLambdaSignatures(t *testing.T) {
-
-	runTestCases(t, nil, []*testCase{
-		{
-			Expression: `λ($arg)<b:b>{$not($arg)}(true)`,
-			Output:     false,
-		},
 		{
-			Expression: `λ($arg)<b:b>{$not($arg)}(foo)`,
-			Output:     true,
+			// With EvalUndefined, the operator is called with
+			// nil in place of undefined.
+			Expression: `missing !? "default"`,
+			Output:     "default",
 		},
 		{
-			Expression: `λ($arg)<x:b>{$not($arg)}(null)`,
-			Output:     true,
+			Expression: `none !? "default"`,
+			Output:     "default",
 		},
 		{
-			Expression: `function($x,$y)<n-n:n>{$x+$y}(2, 6)`,
-			Output:     float64(8),
+			Expression: `items[0].name !? "default"`,
+			Output:     "Apple",
 		},
 		{
-			Expression: `[1..5].function($x,$y)<n-n:n>{$x+$y}(2, 6)`,
-			Output: []interface{}{
-				float64(8),
-				float64(8),
-				float64(8),
-				float64(8),
-				float64(8),
+			Expression: `"apple" ~~ 1`,
+			Error: &OperatorError{
+				Operator: "~~",
+				Position: 0,
+				Err:      fmt.Errorf("cannot compare apple and 1"),
 			},
 		},
 		{
-			Expression: `[1..5].function($x,$y)<n-n:n>{$x+$y}(6)`,
+			// Operators are available in paths evaluated in
+			// tuple mode.
+			Expression: `items#$i.(name ~~ "pear")`,
 			Output: []interface{}{
-				float64(7),
-				float64(8),
-				float64(9),
-				float64(10),
-				float64(11),
+				false,
+				true,
 			},
 		},
 		{
-			Expression: `λ($str)<s->{$uppercase($str)}("hello")`,
-			Output:     "HELLO",
+			Expression: []string{
+				`items#$i[name ~~ "pear"].price`,
+				`items@$item[$item.name ~~ "pear"].$item.price`,
+				`items.name[% .price > 2 and $ ~~ "PEAR"].%.price`,
+			},
+			Output: 2.5,
 		},
-		{
-			Expression: `λ($str, $prefix)<s-s>{$prefix & $str}("World", "Hello ")`,
-			Output:     "Hello World",
+	})
+
+	// An operator that is not available to the evaluation
+	// returns an error.
+	node := &jparse.CustomOperatorNode{
+		Span:     jparse.Span{Start: 4, End: 11},
+		Symbol:   "~~",
+		LHS:      &jparse.StringNode{Value: "a"},
+		RHS:      &jparse.StringNode{Value: "b"},
+		Position: 8,
+	}
+
+	_, err := eval(node, undefined, newEnvironment(nil, 0))
+	if operr, ok := err.(*OperatorError); !ok || operr.Operator != "~~" || operr.Position != 4 {
+		t.Errorf("expected an OperatorError for an unknown operator, got %v", err)
+	}
+
+	// Operators are recognised by $eval.
+	output, err := MustCompile(`$eval("'a' ~~ 'A'")`).Eval(nil)
+	if err != nil || output != true {
+		t.Errorf("$eval: expected true, got %v (error %v)", output, err)
+	}
+
+	// Operators survive a round trip through String.
+	if got, want := MustCompile(`"a"~~"b"~~("c" ~~ "d")`).String(), `"a" ~~ "b" ~~ ("c" ~~ "d")`; got != want {
+		t.Errorf("String: expected %s, got %s", want, got)
+	}
+}
+
+func TestRegisterOperator(t *testing.T) {
+
+	yes := Operator{
+		BindingPower: 50,
+		Func: func(lhs, rhs interface{}) (interface{}, error) {
+			return "yes", nil
 		},
-		{
-			Expression: `λ($arr, $sep)<a<s>s?:s>{$join($arr, $sep)}("a")`,
-			Output:     "a",
+	}
+
+	no := Operator{
+		BindingPower: 50,
+		Func: func(lhs, rhs interface{}) (interface{}, error) {
+			return "no", nil
 		},
-		{
-			Expression: `λ($arr, $sep)<a<s>s?:s>{$join($arr, $sep)}("a", "-")`,
-			Output:     "a",
+	}
+
+	must(t, "RegisterOperator", RegisterOperator("~=", yes))
+	defer UnregisterOperator("~=")
+
+	before := MustCompile(`1 ~= 2`)
+
+	// Registering the symbol again replaces the operator for
+	// expressions compiled afterwards.
+	must(t, "RegisterOperator", RegisterOperator("~=", no))
+	after := MustCompile(`1 ~= 2`)
+
+	// Unregistering the symbol stops new expressions from
+	// using it.
+	UnregisterOperator("~=")
+
+	if _, err := Compile(`1 ~= 2`); err == nil {
+		t.Errorf("expected an error compiling an unregistered operator")
+	}
+
+	// Expressions that have already been compiled keep the
+	// operators that they were compiled with.
+	for _, test := range []struct {
+		Expr   *Expr
+		Output string
+	}{
+		{before, "yes"},
+		{after, "no"},
+		{before.Clone(), "yes"},
+	} {
+		output, err := test.Expr.Eval(nil)
+		if err != nil || output != test.Output {
+			t.Errorf("%s: expected %q, got %v (error %v)", test.Expr, test.Output, output, err)
+		}
+	}
+
+	invalid := []struct {
+		Symbol string
+		Op     Operator
+	}{
+		{"", yes},
+		{"~", yes},
+		{"~>", yes},
+		{"!=~", yes},
+		{"+~", yes},
+		{"~a", yes},
+		{"~~", Operator{BindingPower: 20, Func: yes.Func}},
+		{"~~", Operator{BindingPower: 80, Func: yes.Func}},
+		{"~~", Operator{BindingPower: 50}},
+	}
+
+	for _, test := range invalid {
+		if err := RegisterOperator(test.Symbol, test.Op); err == nil {
+			t.Errorf("RegisterOperator(%q): expected an error", test.Symbol)
+		}
+	}
+}
+
+func TestCollectErrors(t *testing.T) {
+
+	data := map[string]interface{}{
+		"items": []interface{}{
+			map[string]interface{}{
+				"name":  "a",
+				"price": 1.0,
+			},
+			map[string]interface{}{
+				"name":  "b",
+				"price": "free",
+			},
+			map[string]interface{}{
+				"name":  "c",
+				"price": 3.0,
+			},
 		},
+	}
+
+	tests := []struct {
+		Expression string
+		Output     interface{}
+		Errors     int
+	}{
 		{
-			Expression: `λ($arr, $sep)<a<s>s?:s>{$join($arr, $sep)}(["a"], "-")`,
-			Output:     "a",
+			// Failed array items are omitted.
+			Expression: `[1, $error("one"), 3, $error("two")]`,
+			Output: []interface{}{
+				float64(1),
+				float64(3),
+			},
+			Errors: 2,
 		},
 		{
-			Expression: `λ($arr, $sep)<a<s>s?:s>{$join($arr, $sep)}(["a", "b"], "-")`,
-			Output:     "a-b",
+			// Failed object values are omitted with their keys.
+			Expression: `{"a": 1, "b": $error("oops"), "c": 3}`,
+			Output: map[string]interface{}{
+				"a": float64(1),
+				"c": float64(3),
+			},
+			Errors: 1,
 		},
 		{
-			Expression: `λ($arr, $sep)<as?:s>{$join($arr, $sep)}(["a", "b"], "-")`,
-			Output:     "a-b",
+			// Errors are collected from nested constructors.
+			Expression: `{"list": [1, $error("oops")], "ok": true}`,
+			Output: map[string]interface{}{
+				"list": []interface{}{
+					float64(1),
+				},
+				"ok": true,
+			},
+			Errors: 1,
 		},
 		{
-			Expression: `λ($arr, $sep)<a<s>s?:s>{$join($arr, $sep)}([], "-")`,
-			Output:     "",
+			// Failed groups are omitted.
+			Expression: `items{name: price * 2}`,
+			Output: map[string]interface{}{
+				"a": float64(2),
+				"c": float64(6),
+			},
+			Errors: 1,
 		},
 		{
-			Expression: `λ($arr, $sep)<a<s>s?:s>{$join($arr, $sep)}(foo, "-")`,
-			Error:      ErrUndefined,
+			// An error in a predicate fails the whole path
+			// rather than omitting the item being tested.
+			Expression: `[1, $error("one"), items[price * 2 > 1].name]`,
+			Output: []interface{}{
+				float64(1),
+			},
+			Errors: 2,
 		},
 		{
-			Expression: `λ($obj)<o>{$obj}({"hello": "world"})`,
-			Output: map[string]interface{}{
-				"hello": "world",
+			// Likewise for an error in a condition.
+			Expression: `[1, $error("two") ? 2 : 3, 4]`,
+			Output: []interface{}{
+				float64(1),
+				float64(4),
 			},
+			Errors: 1,
 		},
 		{
-			Expression: `λ($arr)<a<a<n>>>{$arr}([[1]])`,
+			// An error in one item of a path with a positional
+			// binding only drops the field that failed. The
+			// other items, and the position of each item, are
+			// unaffected.
+			Expression: `items#$i.{"name": name, "index": $i, "double": price * 2}`,
 			Output: []interface{}{
-				[]interface{}{
-					float64(1),
+				map[string]interface{}{
+					"name":   "a",
+					"index":  float64(0),
+					"double": float64(2),
+				},
+				map[string]interface{}{
+					"name":  "b",
+					"index": float64(1),
+				},
+				map[string]interface{}{
+					"name":   "c",
+					"index":  float64(2),
+					"double": float64(6),
 				},
 			},
+			Errors: 1,
+		},
+	}
+
+	for _, test := range tests {
+
+		expr, err := CompileWithOptions(test.Expression, EvalOptions{
+			CollectErrors: true,
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", test.Expression, err)
+		}
+
+		output, err := expr.Eval(data)
+
+		var merr *MultiError
+		if !errors.As(err, &merr) {
+			t.Errorf("%s: expected a MultiError, got %v", test.Expression, err)
+			continue
+		}
+
+		if len(merr.Errors) != test.Errors {
+			t.Errorf("%s: expected %d errors, got %d: %s", test.Expression, test.Errors, len(merr.Errors), merr)
+		}
+
+		if !reflect.DeepEqual(output, test.Output) {
+			t.Errorf("%s: expected output %v, got %v", test.Expression, test.Output, output)
+		}
+
+		// Without the option, the first error is returned.
+		if output, err := MustCompile(test.Expression).Eval(data); err == nil || isPartial(err) {
+			t.Errorf("%s: expected an error without CollectErrors, got %v (error %v)", test.Expression, output, err)
+		}
+	}
+
+	// Errors that are not inside a constructor are returned
+	// as usual.
+	expr, err := CompileWithOptions(`items[1].price * 2`, EvalOptions{
+		CollectErrors: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expr.Eval(data); err == nil || isPartial(err) {
+		t.Errorf("expected a regular error, got %v", err)
+	}
+
+	// Limit errors are never collected.
+	expr, err = CompileWithOptions(`[1, [1..100], 3]`, EvalOptions{
+		CollectErrors: true,
+		MaxRangeItems: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expr.Eval(nil); isPartial(err) {
+		t.Errorf("expected a limit error, got %v", err)
+	}
+
+	// Expressions that don't fail return no error.
+	expr, err = CompileWithOptions(`[1, 2, 3]`, EvalOptions{
+		CollectErrors: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expr.Eval(nil); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	// EvalBytes returns the partial result.
+	expr, err = CompileWithOptions(`{"a": 1, "b": $error("oops")}`, EvalOptions{
+		CollectErrors: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := expr.EvalBytes([]byte(`{}`))
+	if !isPartial(err) || string(b) != `{"a":1}` {
+		t.Errorf("EvalBytes: expected {\"a\":1} and a MultiError, got %s (error %v)", b, err)
+	}
+	if err != nil && err.Error() != "oops" {
+		t.Errorf("EvalBytes: expected error message \"oops\", got %q", err)
+	}
+}
+
+func TestErrorPositions(t *testing.T) {
+
+	data := map[string]interface{}{
+		"name":  "widget",
+		"price": 3,
+		"items": []interface{}{1, 2, "three"},
+		"grid": map[[2]int]string{
+			{1, 2}: "x",
+		},
+	}
+
+	tests := []struct {
+		Expression string
+		Error      error
+	}{
+		{
+			Expression: `$map([1, 2], function($v) { $v + name })`,
+			Error: &EvalError{
+				Type:     ErrNonNumberRHS,
+				Token:    "name",
+				Value:    "+",
+				Position: 33,
+			},
 		},
 		{
-			Expression: `λ($num)<(ns)-:n>{$number($num)}(5)`,
-			Output:     float64(5),
+			// Constant folding does not change the position.
+			Expression: `{"total": 1 + (2 * 3 - "4")}`,
+			Error: &EvalError{
+				Type:     ErrNonNumberRHS,
+				Token:    `"4"`,
+				Value:    "-",
+				Position: 23,
+			},
 		},
 		{
-			Expression: `λ($num)<(ns)-:n>{$number($num)}("5")`,
-			Output:     float64(5),
+			Expression: "(\n  $x := price;\n  $x > 1 ? {\"k\": $x & \"\"}.k - 1 : 0\n)",
+			Error: &EvalError{
+				Type:     ErrNonNumberLHS,
+				Token:    `{"k": $x & ""}.k`,
+				Value:    "-",
+				Position: 28,
+			},
 		},
 		{
-			Expression: `[1..5].λ($num)<(ns)-:n>{$number($num)}()`,
-			Output: []interface{}{
-				float64(1),
-				float64(2),
-				float64(3),
-				float64(4),
-				float64(5),
+			// Errors without a token take their position
+			// from the operator.
+			Expression: `[0, 10e300 * price * 10e300][1]`,
+			Error: &EvalError{
+				Type:     ErrNumberInf,
+				Value:    "*",
+				Position: 4,
 			},
 		},
 		{
-			Expression: `
-				(
-					$twice := function($f)<f:f>{function($x)<n:n>{$f($f($x))}};
-					$add2 := function($x)<n:n>{$x+2};
-					$add4 := $twice($add2);
-					$add4(5)
-				)`,
-			Output: float64(9),
+			Expression: `items[$ < "2"]`,
+			Error: &EvalError{
+				Type:     ErrTypeMismatch,
+				Value:    "<",
+				Position: 6,
+			},
 		},
 		{
-			Expression: `
-				(
-					$twice := function($f)<f<n:n>:f<n:n>>{function($x)<n:n>{$f($f($x))}};
-					$add2 := function($x)<n:n>{$x+2};
-					$add4 := $twice($add2);
-					$add4(5)
-				)`,
-			Output: float64(9),
+			Expression: "(\n  $f := price;\n  $string($f())\n)",
+			Error: &EvalError{
+				Type:     ErrNonCallable,
+				Token:    "$f",
+				Position: 27,
+			},
 		},
 		{
-			Expression: `λ($arg)<n<n>>{$arg}(5)`,
-			Error: &jparse.Error{
-				// TODO: Get position info.
-				Type: jparse.ErrInvalidSubtype,
-				Hint: "n",
+			// Errors from built-in functions have the
+			// position of the call's opening parenthesis.
+			Expression: `{"root": $sqrt(-price)}`,
+			Error: &jlib.ArgValueError{
+				Func:     "sqrt",
+				Reason:   "the sqrt function cannot be applied to a negative number",
+				Position: 9,
 			},
 		},
-	})
-}
-
-func TestLambdaSignatures2(t *testing.T) {
-
-	runTestCases(t, testdata.address, []*testCase{
 		{
-			Expression: `Age.function($x,$y)<n-n:n>{$x+$y}(6)`,
-			Output:     float64(34),
+			Expression: `[1, 2].$string($power($$.price, 1000))`,
+			Error: &jlib.ArgValueError{
+				Func:     "power",
+				Reason:   "the power function has resulted in a value that cannot be represented as a JSON number",
+				Position: 15,
+			},
 		},
 		{
-			Expression: `FirstName.λ($str, $prefix)<s-s>{$prefix & $str}("Hello ")`,
-			Output:     "Hello Fred",
+			// Functions called by other functions take the
+			// position of the outer call.
+			Expression: `"x" & $map([-1], $sqrt)`,
+			Error: &jlib.ArgValueError{
+				Func:     "sqrt",
+				Reason:   "the sqrt function cannot be applied to a negative number",
+				Position: 6,
+			},
 		},
 		{
-			Expression: `λ($arr, $sep)<a<s>s?:s>{$join($arr, $sep)}(["a"])`,
-			Output:     "a",
+			// Map keys that can't be converted to strings
+			// are reported as EvalErrors.
+			Expression: `"x" & $keys(grid)`,
+			Error: &EvalError{
+				Type:     ErrNonStringKey,
+				Value:    "[2]int",
+				Position: 6,
+			},
 		},
-	})
-}
-
-func TestLambdaSignatures3(t *testing.T) {
-
-	runTestCases(t, testdata.account, []*testCase{
 		{
-			Expression: `Account.Order.Product.Description.Colour.λ($str)<s->{$uppercase($str)}()`,
-			Output: []interface{}{
-				"PURPLE",
-				"ORANGE",
-				"PURPLE",
-				"BLACK",
+			Expression: `grid ~> |$|{"y": 1}|`,
+			Error: &EvalError{
+				Type:     ErrNonStringKey,
+				Value:    "[2]int",
+				Position: 9,
 			},
 		},
-	})
-}
-
-func TestLambdaSignatureViolations(t *testing.T) {
-
-	runTestCases(t, nil, []*testCase{
 		{
-			Expression: `λ($arg1, $arg2)<nn:a>{[$arg1, $arg2]}(1,"2")`,
-			Error: &ArgTypeError{
-				Func:  "lambda",
-				Which: 2,
+			Expression: `name & $toMillis(name)`,
+			Error: &EvalError{
+				Type:     ErrUnparseableTimestamp,
+				Value:    "widget",
+				Position: 7,
 			},
 		},
 		{
-			Expression: `λ($arg1, $arg2)<nn:a>{[$arg1, $arg2]}(1,3,"2")`,
+			Expression: `name & $abs(price, 2)`,
 			Error: &ArgCountError{
-				Func:     "lambda",
-				Expected: 2,
-				Received: 3,
+				Func:     "abs",
+				Expected: 1,
+				Received: 2,
+				Position: 7,
 			},
 		},
 		{
-			Expression: `λ($arg1, $arg2)<nn+:a>{[$arg1, $arg2]}(1,3, 2,"g")`,
+			Expression: `name & $substring(name, "1")`,
 			Error: &ArgTypeError{
-				Func:  "lambda",
-				Which: 4,
+				Func:     "substring",
+				Which:    2,
+				Position: 7,
 			},
 		},
 		{
-			Expression: `λ($arr)<a<n>>{$arr}(["3"]) `,
+			// Calls in the tail position of a lambda are
+			// positioned too.
+			Expression: `($f := function($n) <n:n> { $n }; $g := function() { $f(name) }; $g())`,
 			Error: &ArgTypeError{
-				Func:  "lambda",
-				Which: 1,
+				Func:     "f",
+				Which:    1,
+				Position: 53,
 			},
 		},
 		{
-			Expression: `λ($arr)<a<n>>{$arr}([1, 2, "3"]) `,
+			// Functions called by other functions have no
+			// position.
+			Expression: `name & $map([name], $abs)`,
 			Error: &ArgTypeError{
-				Func:  "lambda",
+				Func:  "abs",
 				Which: 1,
 			},
 		},
-		{
-			Expression: `λ($arr)<a<n>>{$arr}("f")`,
-			Error: &ArgTypeError{
-				Func:  "lambda",
-				Which: 1,
+	}
+
+	for _, test := range tests {
+		for _, optimize := range []bool{false, true} {
+
+			e := MustCompile(test.Expression)
+			if optimize {
+				e.Optimize()
+			}
+
+			_, err := e.Eval(data)
+
+			// ArgValueErrors have an unexported code, so
+			// compare their exported fields only.
+			if avErr, ok := err.(*jlib.ArgValueError); ok {
+				err = &jlib.ArgValueError{
+					Func:     avErr.Func,
+					Which:    avErr.Which,
+					Reason:   avErr.Reason,
+					Position: avErr.Position,
+				}
+			}
+
+			if !reflect.DeepEqual(err, test.Error) {
+				t.Errorf("%s (optimized: %t): expected error %#v, got %#v", test.Expression, optimize, test.Error, err)
+			}
+		}
+	}
+}
+
+type extensionResult struct {
+	Name  string
+	Count int
+}
+
+type extensionTemp float64
+
+func TestExtensionReturnTypes(t *testing.T) {
+
+	exts := map[string]Extension{
+		"int": {
+			Func: func() (int, error) {
+				return 3, nil
 			},
 		},
-		{
-			Expression: `
-				(
-					$fun := λ($arr)<a<n>>{$arr};
-					$fun("f")
-				)`,
-			Error: &ArgTypeError{
-				Func:  "fun",
-				Which: 1,
+		"temp": {
+			Func: func() (extensionTemp, error) {
+				return 21.5, nil
 			},
 		},
-		{
-			Expression: `λ($arr)<(sa<n>)>>{$arr}([[1]])`,
-			Error: &jparse.Error{
-				// TODO: Get position info.
-				Type: jparse.ErrInvalidUnionType,
-				Hint: "<",
+		"strings": {
+			Func: func() ([]string, error) {
+				return []string{"a", "b"}, nil
 			},
 		},
-	})
+		"struct": {
+			Func: func() (extensionResult, error) {
+				return extensionResult{"x", 2}, nil
+			},
+		},
+		"structs": {
+			Func: func() ([]*extensionResult, error) {
+				return []*extensionResult{{"a", 1}, {"b", 2}}, nil
+			},
+		},
+		"map": {
+			Func: func() (map[string]extensionResult, error) {
+				return map[string]extensionResult{
+					"k": {"y", 5},
+				}, nil
+			},
+		},
+	}
+
+	tests := []struct {
+		Expression string
+		Output     interface{}
+	}{
+		{
+			Expression: `$int() + 1`,
+			Output:     int64(4),
+		},
+		{
+			Expression: `$temp() * 2`,
+			Output:     float64(43),
+		},
+		{
+			Expression: `$strings()[1]`,
+			Output:     "b",
+		},
+		{
+			Expression: `$struct().Name`,
+			Output:     "x",
+		},
+		{
+			Expression: `$sum($structs().Count)`,
+			Output:     int64(3),
+		},
+		{
+			Expression: `$structs()[Count = 2].Name`,
+			Output:     "b",
+		},
+		{
+			Expression: `$map().k.Count`,
+			Output:     5,
+		},
+	}
+
+	for _, test := range tests {
+
+		e := MustCompile(test.Expression)
+		if err := e.RegisterExts(exts); err != nil {
+			t.Fatal(err)
+		}
+
+		output, err := e.Eval(nil)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.Expression, err)
+		}
+
+		if !reflect.DeepEqual(output, test.Output) {
+			t.Errorf("%s: expected output %v (%T), got %v (%T)", test.Expression, test.Output, test.Output, output, output)
+		}
+	}
 }
 
-func TestTransform(t *testing.T) {
+func TestEvalOrdered(t *testing.T) {
 
 	data := map[string]interface{}{
-		"state": map[string]interface{}{
-			"tempReadings": []float64{
-				27.2,
-				28.9,
-				28,
-				28.2,
-				28.4,
+		"items": []interface{}{
+			map[string]interface{}{
+				"name":  "widget",
+				"price": 9.99,
+			},
+			map[string]interface{}{
+				"name":  "gadget",
+				"price": 19.99,
 			},
-			"readingsCount":   5,
-			"sumTemperatures": 140.7,
-			"avgTemperature":  28.14,
-			"maxTemperature":  28.9,
-			"minTemperature":  27.2,
-		},
-		"event": map[string]interface{}{
-			"t": 28.4,
 		},
 	}
 
-	runTestCases(t, data, []*testCase{
+	tests := []struct {
+		Expression string
+		Output     string
+	}{
 		{
-			Expression: `
-				(
-					$tempReadings := $count(state.tempReadings) = 5 ?
-						[state.tempReadings[[1..4]], event.t] :
-						[state.tempReadings, event.t];
+			Expression: `{"b": 1, "a": 2}`,
+			Output:     `{"b":1,"a":2}`,
+		},
+		{
+			// Nested objects.
+			Expression: `{"z": {"y": 1, "x": {"w": 2, "v": 3}}, "a": null}`,
+			Output:     `{"z":{"y":1,"x":{"w":2,"v":3}},"a":null}`,
+		},
+		{
+			// Arrays of objects.
+			Expression: `items.{"price": price, "name": name}`,
+			Output:     `[{"price":9.99,"name":"widget"},{"price":19.99,"name":"gadget"}]`,
+		},
+		{
+			// Objects from the input data are not reordered.
+			Expression: `{"second": items[1], "first": items[0]}`,
+			Output:     `{"second":{"name":"gadget","price":19.99},"first":{"name":"widget","price":9.99}}`,
+		},
+		{
+			// Updated keys keep their position. New keys are
+			// added at the end.
+			Expression: `{"c": 1, "b": 2, "a": 3} ~> |$|{"a": 4, "d": 5}, "b"|`,
+			Output:     `{"c":1,"a":4,"d":5}`,
+		},
+		{
+			Expression: `$ ~> |items|{"id": $uppercase(name)}|`,
+			Output:     `{"items":[{"name":"widget","price":9.99,"id":"WIDGET"},{"name":"gadget","price":19.99,"id":"GADGET"}]}`,
+		},
+	}
 
-					{
-						"tempReadings": $tempReadings,
-						"sumTemperatures": $sum($tempReadings),
-						"avgTemperature": $average($tempReadings) ~> $round(2),
-						"maxTemperature": $max($tempReadings),
-						"minTemperature": $min($tempReadings)
-					}
-				)`,
-			Output: map[string]interface{}{
-				"tempReadings": []interface{}{
-					28.9,
-					float64(28),
-					28.2,
-					28.4,
-					28.4,
+	for _, test := range tests {
+
+		e := MustCompile(test.Expression)
+
+		output, err := e.EvalOrdered(data)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.Expression, err)
+			continue
+		}
+
+		b, err := json.Marshal(output)
+		if err != nil {
+			t.Errorf("%s: marshal error: %s", test.Expression, err)
+			continue
+		}
+
+		if s := string(b); s != test.Output {
+			t.Errorf("%s: expected %s, got %s", test.Expression, test.Output, s)
+		}
+	}
+}
+
+func TestEvalOrderedMapAccess(t *testing.T) {
+
+	e := MustCompile(`{"b": 1, "a": {"c": [{"d": true}]}}`)
+
+	output, err := e.EvalOrdered(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	m, ok := output.(*jtypes.OrderedMap)
+	if !ok {
+		t.Fatalf("expected *jtypes.OrderedMap, got %T", output)
+	}
+
+	if keys := m.Keys(); !reflect.DeepEqual(keys, []string{"b", "a"}) {
+		t.Errorf("expected keys [b a], got %v", keys)
+	}
+
+	if v, ok := m.Get("b"); !ok || v != float64(1) {
+		t.Errorf("expected b to be 1, got %v", v)
+	}
+
+	v, _ := m.Get("a")
+	if _, ok := v.(*jtypes.OrderedMap); !ok {
+		t.Errorf("expected nested object to be *jtypes.OrderedMap, got %T", v)
+	}
+
+	// Eval returns the same result as regular Go maps.
+	output, err = e.Eval(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := map[string]interface{}{
+		"b": float64(1),
+		"a": map[string]interface{}{
+			"c": []interface{}{
+				map[string]interface{}{
+					"d": true,
 				},
-				"sumTemperatures": 141.9,
-				"avgTemperature":  28.38,
-				"maxTemperature":  28.9,
-				"minTemperature":  float64(28),
 			},
 		},
-	})
+	}
+
+	if !reflect.DeepEqual(output, expected) {
+		t.Errorf("expected %v, got %v", expected, output)
+	}
 }
 
 // Helper functions
@@ -7977,26 +17014,74 @@ func runTestCase(t *testing.T, equal compareFunc, input interface{}, test *testC
 		t.Fatalf("Bad expression: %T %v", e, e)
 	}
 
-	var output interface{}
-
 	for _, exp := range exps {
 
-		expr, err := Compile(exp)
-		if err == nil {
-			must(t, "Vars", expr.RegisterVars(test.Vars))
-			must(t, "Exts", expr.RegisterExts(test.Exts))
-			output, err = expr.Eval(input)
-		}
+		var errs []error
+
+		// Evaluate each expression with and without constant
+		// folding. Both must produce the expected results.
+		for _, optimize := range []bool{false, true} {
+
+			var output interface{}
 
-		if !equal(output, test.Output) {
-			t.Errorf("\nExpression: %s\nExp. Value: %v [%T]\nAct. Value: %v [%T]", exp, test.Output, test.Output, output, output)
+			expr, err := Compile(exp)
+			if err == nil {
+				must(t, "Vars", expr.RegisterVars(test.Vars))
+				must(t, "Exts", expr.RegisterExts(test.Exts))
+				if optimize {
+					expr.Optimize()
+				}
+				output, err = expr.Eval(input)
+			}
+
+			if !equal(output, test.Output) {
+				t.Errorf("\nExpression: %s\nOptimized: %t\nExp. Value: %v [%T]\nAct. Value: %v [%T]", exp, optimize, test.Output, test.Output, output, output)
+			}
+			if !reflect.DeepEqual(withoutPosition(err), test.Error) {
+				t.Errorf("\nExpression: %s\nOptimized: %t\nExp. Error: %v [%T]\nAct. Error: %v [%T]", exp, optimize, test.Error, test.Error, err, err)
+			}
+
+			errs = append(errs, err)
 		}
-		if !reflect.DeepEqual(err, test.Error) {
-			t.Errorf("\nExpression: %s\nExp. Error: %v [%T]\nAct. Error: %v [%T]", exp, test.Error, test.Error, err, err)
+
+		// Constant folding must not change the positions of
+		// errors, which are not included in the expected errors
+		// (see TestErrorPositions).
+		if !reflect.DeepEqual(errs[0], errs[1]) {
+			t.Errorf("\nExpression: %s\nError with folding: %#v\nError without folding: %#v", exp, errs[1], errs[0])
 		}
 	}
 }
 
+// withoutPosition returns a copy of err with the position
+// set by the evaluator cleared.
+func withoutPosition(err error) error {
+	switch e := err.(type) {
+	case *EvalError:
+		clone := *e
+		clone.Position = 0
+		return &clone
+	case *jlib.ArgValueError:
+		clone := *e
+		clone.Position = 0
+		return &clone
+	case *jlib.NonArrayError:
+		clone := *e
+		clone.Position = 0
+		return &clone
+	case *jlib.ArrayTypeError:
+		clone := *e
+		clone.Position = 0
+		return &clone
+	case *ChainError:
+		clone := *e
+		clone.Err = withoutPosition(e.Err)
+		return &clone
+	default:
+		return err
+	}
+}
+
 func equalRegexMatches(v1 interface{}, v2 interface{}) bool {
 
 	makeMap := func(in interface{}) map[string]interface{} {
@@ -8106,3 +17191,23 @@ func readJSON(filename string) interface{} {
 
 	return dest
 }
+
+// readJSONNumbers is like readJSON except that numbers are
+// decoded as json.Numbers.
+func readJSONNumbers(filename string) interface{} {
+
+	data, err := ioutil.ReadFile(filepath.Join("testdata", filename))
+	if err != nil {
+		panicf("ioutil.ReadFile error: %s", err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var dest interface{}
+	if err = dec.Decode(&dest); err != nil {
+		panicf("json.Decode error: %s", err)
+	}
+
+	return dest
+}
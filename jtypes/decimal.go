@@ -0,0 +1,245 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jtypes
+
+import (
+	"encoding/json"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+)
+
+// TypeDecimal is the reflect.Type for *Decimal.
+var TypeDecimal = reflect.TypeOf((*Decimal)(nil))
+
+// decimalDigits is the number of significant digits used to
+// format Decimals that cannot be represented exactly as decimal
+// fractions (e.g. 1/3). It matches the precision used by the
+// jsonata-js $string function.
+const decimalDigits = 15
+
+// A Decimal is an exact number used in place of float64 when
+// JSONata is evaluated in decimal mode. Decimals are immutable.
+// They are stored as rational numbers, so the results of
+// addition, subtraction and multiplication are always exact.
+//
+// Use ParseDecimal or DecimalFromFloat to create a Decimal.
+type Decimal struct {
+	rat big.Rat
+}
+
+// NewDecimal returns a Decimal with the value of r.
+func NewDecimal(r *big.Rat) *Decimal {
+	d := &Decimal{}
+	d.rat.Set(r)
+	return d
+}
+
+// ParseDecimal converts a string such as "0.1" or "1.5e3" to
+// a Decimal. The second return value is false if the string
+// is not a valid number.
+func ParseDecimal(s string) (*Decimal, bool) {
+	d := &Decimal{}
+	if _, ok := d.rat.SetString(s); !ok {
+		return nil, false
+	}
+	return d, true
+}
+
+// DecimalFromFloat converts a float64 to a Decimal. The float
+// is converted via its shortest decimal representation, so
+// DecimalFromFloat(0.1) returns exactly 1/10 rather than the
+// binary approximation stored in the float. The second return
+// value is false if the float is NaN or infinite.
+func DecimalFromFloat(f float64) (*Decimal, bool) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, false
+	}
+	return ParseDecimal(strconv.FormatFloat(f, 'g', -1, 64))
+}
+
+// Rat returns the value of the Decimal as a big.Rat.
+func (d *Decimal) Rat() *big.Rat {
+	return new(big.Rat).Set(&d.rat)
+}
+
+// Float64 returns the nearest float64 to the Decimal.
+func (d *Decimal) Float64() float64 {
+	f, _ := d.rat.Float64()
+	return f
+}
+
+// ConvertTo converts the Decimal to the given numeric type. It
+// implements the Convertible interface so that Decimals can be
+// passed to Go functions that expect regular numbers.
+func (d *Decimal) ConvertTo(t reflect.Type) (reflect.Value, bool) {
+
+	if !isIntKind(t.Kind()) && !isUintKind(t.Kind()) && !isFloatKind(t.Kind()) {
+		return reflect.Value{}, false
+	}
+
+	return reflect.ValueOf(d.Float64()).Convert(t), true
+}
+
+// String returns the Decimal in decimal notation. Values that
+// have an exact decimal representation (e.g. 3/10) are written
+// out in full. Other values (e.g. 1/3) are rounded to 15
+// significant digits.
+func (d *Decimal) String() string {
+
+	if d.rat.IsInt() {
+		return d.rat.Num().String()
+	}
+
+	if n, ok := decimalPlaces(d.rat.Denom()); ok {
+		return d.rat.FloatString(n)
+	}
+
+	f := new(big.Float).SetPrec(256).SetRat(&d.rat)
+	return f.Text('g', decimalDigits)
+}
+
+// MarshalJSON encodes the Decimal as a JSON number. It has a
+// value receiver so that Decimals encode correctly whether or
+// not they are accessed through a pointer.
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// decimalPlaces returns the number of decimal places needed to
+// write out a fraction with the given denominator exactly. The
+// second return value is false if the fraction has no exact
+// decimal representation, i.e. if the denominator has prime
+// factors other than 2 and 5.
+func decimalPlaces(denom *big.Int) (int, bool) {
+
+	n := new(big.Int).Set(denom)
+
+	twos := int(n.TrailingZeroBits())
+	n.Rsh(n, uint(twos))
+
+	var fives int
+	var q, r big.Int
+	five := big.NewInt(5)
+
+	for {
+		q.QuoRem(n, five, &r)
+		if r.Sign() != 0 {
+			break
+		}
+		n.Set(&q)
+		fives++
+	}
+
+	if !n.IsInt64() || n.Int64() != 1 {
+		return 0, false
+	}
+
+	if twos > fives {
+		return twos, true
+	}
+
+	return fives, true
+}
+
+// AsDecimal returns the Decimal held by v, if any. The second
+// return value is false if v is not a Decimal.
+func AsDecimal(v reflect.Value) (*Decimal, bool) {
+	v = Resolve(v)
+
+	if !v.IsValid() || v.Type() != TypeDecimal.Elem() {
+		return nil, false
+	}
+
+	if v.CanAddr() {
+		return v.Addr().Interface().(*Decimal), true
+	}
+
+	if v.CanInterface() {
+		d := v.Interface().(Decimal)
+		return &d, true
+	}
+
+	return nil, false
+}
+
+// ToDecimal converts any number, including a Decimal, to a
+// Decimal. The second return value is false if v is not a
+// number or is not finite.
+func ToDecimal(v reflect.Value) (*Decimal, bool) {
+
+	if d, ok := AsDecimal(v); ok {
+		return d, true
+	}
+
+	v = Resolve(v)
+
+	switch {
+	case isJSONNumber(v):
+		// Parse the number directly to avoid losing
+		// precision in a conversion to float64.
+		return ParseDecimal(v.String())
+	case isFloat(v):
+		return DecimalFromFloat(v.Float())
+	case isInt(v):
+		d := &Decimal{}
+		d.rat.SetInt64(v.Int())
+		return d, true
+	case isUint(v):
+		d := &Decimal{}
+		d.rat.SetInt(new(big.Int).SetUint64(v.Uint()))
+		return d, true
+	default:
+		return nil, false
+	}
+}
+
+// IsDecimal returns true if v is a Decimal.
+func IsDecimal(v reflect.Value) bool {
+	v = Resolve(v)
+	return v.IsValid() && v.Type() == TypeDecimal.Elem()
+}
+
+// compareDecimals compares two numbers exactly, converting
+// them to Decimals if necessary. The second return value is
+// false if either value is not a finite number.
+func compareDecimals(lhs, rhs reflect.Value) (int, bool) {
+	d1, ok := ToDecimal(lhs)
+	if !ok {
+		return 0, false
+	}
+
+	d2, ok := ToDecimal(rhs)
+	if !ok {
+		return 0, false
+	}
+
+	return d1.Rat().Cmp(d2.Rat()), true
+}
+
+// PlainDecimals returns a copy of v in which any Decimals have
+// been replaced by json.Numbers. Like Plain, it descends into
+// slices and maps, including OrderedMaps.
+func PlainDecimals(v interface{}) interface{} {
+	v, _ = plain(v, replaceDecimals)
+	return v
+}
+
+// decimalToNumber converts a Decimal to a json.Number. Like
+// String, it writes out values that have an exact decimal
+// representation in full. Other values are written with the
+// precision of a float64, which is how jsonata-js returns the
+// result of e.g. 22/7.
+func decimalToNumber(d *Decimal) json.Number {
+
+	if !d.rat.IsInt() {
+		if _, ok := decimalPlaces(d.rat.Denom()); !ok {
+			return json.Number(strconv.FormatFloat(d.Float64(), 'g', -1, 64))
+		}
+	}
+
+	return json.Number(d.String())
+}
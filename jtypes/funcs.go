@@ -6,6 +6,9 @@
 package jtypes
 
 import (
+	"encoding/json"
+	"math"
+	"math/big"
 	"reflect"
 )
 
@@ -32,12 +35,16 @@ func IsBool(v reflect.Value) bool {
 
 // IsString (golint)
 func IsString(v reflect.Value) bool {
-	return v.Kind() == reflect.String || resolvedKind(v) == reflect.String
+	return (v.Kind() == reflect.String || resolvedKind(v) == reflect.String) && !isJSONNumber(v)
 }
 
 // IsNumber (golint)
 func IsNumber(v reflect.Value) bool {
-	return isFloat(v) || isInt(v) || isUint(v)
+	if isJSONNumber(v) {
+		_, ok := asJSONNumber(v)
+		return ok
+	}
+	return isFloat(v) || isInt(v) || isUint(v) || IsDecimal(v)
 }
 
 // IsCallable (golint)
@@ -74,12 +81,12 @@ func IsArrayOf(v reflect.Value, hasType func(reflect.Value) bool) bool {
 
 // IsMap (golint)
 func IsMap(v reflect.Value) bool {
-	return resolvedKind(v) == reflect.Map
+	return resolvedKind(v) == reflect.Map || isOrderedMap(v)
 }
 
 // IsStruct (golint)
 func IsStruct(v reflect.Value) bool {
-	return resolvedKind(v) == reflect.Struct
+	return resolvedKind(v) == reflect.Struct && !isOrderedMap(v) && !IsDecimal(v)
 }
 
 // AsBool (golint)
@@ -115,11 +122,113 @@ func AsNumber(v reflect.Value) (float64, bool) {
 		return v.Float(), true
 	case isInt(v), isUint(v):
 		return v.Convert(typeFloat64).Float(), true
+	case IsDecimal(v):
+		d, _ := AsDecimal(v)
+		return d.Float64(), true
+	case isJSONNumber(v):
+		return asJSONNumber(v)
+	default:
+		return 0, false
+	}
+}
+
+// AsInt64 returns the value of v if v is a Go integer, or a
+// json.Number holding an integer, that fits in an int64. The
+// second return value is false for all other values, including
+// floats with integral values.
+func AsInt64(v reflect.Value) (int64, bool) {
+	v = Resolve(v)
+
+	switch {
+	case isJSONNumber(v):
+		n, err := json.Number(v.String()).Int64()
+		return n, err == nil
+	case isInt(v):
+		return v.Int(), true
+	case isUint(v):
+		if n := v.Uint(); n <= math.MaxInt64 {
+			return int64(n), true
+		}
+		return 0, false
 	default:
 		return 0, false
 	}
 }
 
+// CompareNumbers compares two numbers without loss of precision.
+// Integers are compared with floats exactly, without converting
+// them to float64, so an integer above 2^53 is not equal to the
+// nearest float. It returns -1, 0 or +1 depending on whether lhs
+// is less than, equal to or greater than rhs. The second return
+// value is false if either value is not a number or if the
+// numbers cannot be compared (e.g. because one of them is NaN).
+func CompareNumbers(lhs, rhs reflect.Value) (int, bool) {
+
+	if IsDecimal(lhs) || IsDecimal(rhs) {
+		return compareDecimals(lhs, rhs)
+	}
+
+	i1, lhsInt := AsInt64(lhs)
+	i2, rhsInt := AsInt64(rhs)
+
+	if lhsInt && rhsInt {
+		switch {
+		case i1 < i2:
+			return -1, true
+		case i1 > i2:
+			return 1, true
+		default:
+			return 0, true
+		}
+	}
+
+	f1, ok := AsNumber(lhs)
+	if !ok {
+		return 0, false
+	}
+
+	f2, ok := AsNumber(rhs)
+	if !ok || math.IsNaN(f1) || math.IsNaN(f2) {
+		return 0, false
+	}
+
+	// Compare integers with floats exactly. Converting the
+	// integer to a float64 could change its value, which would
+	// make equality intransitive.
+	switch {
+	case lhsInt && !math.IsInf(f2, 0):
+		return compareIntFloat(i1, f2), true
+	case rhsInt && !math.IsInf(f1, 0):
+		return -compareIntFloat(i2, f1), true
+	case f1 < f2:
+		return -1, true
+	case f1 > f2:
+		return 1, true
+	default:
+		return 0, true
+	}
+}
+
+// compareIntFloat compares an integer with a finite float
+// exactly.
+func compareIntFloat(i int64, f float64) int {
+
+	// Floats in this range that have no fractional part can
+	// be converted to int64 without loss.
+	if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+		switch n := int64(f); {
+		case i < n:
+			return -1
+		case i > n:
+			return 1
+		default:
+			return 0
+		}
+	}
+
+	return new(big.Float).SetInt64(i).Cmp(big.NewFloat(f))
+}
+
 // AsCallable (golint)
 func AsCallable(v reflect.Value) (Callable, bool) {
 	v = Resolve(v)
@@ -135,6 +244,21 @@ func AsCallable(v reflect.Value) (Callable, bool) {
 	return nil, false
 }
 
+func isJSONNumber(v reflect.Value) bool {
+	v = Resolve(v)
+	return v.IsValid() && v.Type() == TypeJSONNumber
+}
+
+// asJSONNumber converts a json.Number to a float64. The second
+// return value is false if the json.Number is not a valid number.
+func asJSONNumber(v reflect.Value) (float64, bool) {
+	n, err := json.Number(Resolve(v).String()).Float64()
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
 func isInt(v reflect.Value) bool {
 	return isIntKind(v.Kind()) || isIntKind(resolvedKind(v))
 }
@@ -0,0 +1,363 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jtypes
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+)
+
+// TypeOrderedMap is the reflect.Type for *OrderedMap.
+var TypeOrderedMap = reflect.TypeOf((*OrderedMap)(nil))
+
+// An OrderedMap is a JSON object that remembers the order in
+// which its keys were added. JSONata uses OrderedMaps for the
+// objects that it creates (e.g. with object constructors or
+// the transform operator) so that their keys can be iterated
+// and encoded in the same order as jsonata-js.
+//
+// Use NewOrderedMap to create an OrderedMap.
+type OrderedMap struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+// NewOrderedMap returns an empty OrderedMap with space for
+// the given number of keys.
+func NewOrderedMap(size int) *OrderedMap {
+	return &OrderedMap{
+		keys:   make([]string, 0, size),
+		values: make(map[string]interface{}, size),
+	}
+}
+
+// Len returns the number of keys in the map.
+func (m *OrderedMap) Len() int {
+	return len(m.keys)
+}
+
+// Keys returns the keys of the map in insertion order. The
+// returned slice must not be modified.
+func (m *OrderedMap) Keys() []string {
+	return m.keys
+}
+
+// Get returns the value stored under the given key. The second
+// return value is false if the key is not present.
+func (m *OrderedMap) Get(key string) (interface{}, bool) {
+	v, ok := m.values[key]
+	return v, ok
+}
+
+// Set stores a value under the given key. New keys are added
+// to the end of the map. Existing keys keep their position.
+func (m *OrderedMap) Set(key string, value interface{}) {
+	if m.values == nil {
+		m.values = map[string]interface{}{}
+	}
+	if _, ok := m.values[key]; !ok {
+		m.keys = append(m.keys, key)
+	}
+	m.values[key] = value
+}
+
+// Delete removes the given key from the map.
+func (m *OrderedMap) Delete(key string) {
+	if _, ok := m.values[key]; !ok {
+		return
+	}
+
+	delete(m.values, key)
+
+	for i, k := range m.keys {
+		if k == key {
+			m.keys = append(m.keys[:i:i], m.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// Map returns the contents of the map as a regular Go map.
+// The returned map is a shallow copy: nested OrderedMaps are
+// not converted.
+func (m *OrderedMap) Map() map[string]interface{} {
+	results := make(map[string]interface{}, len(m.values))
+	for k, v := range m.values {
+		results[k] = v
+	}
+	return results
+}
+
+// MarshalJSON encodes the map as a JSON object with its keys
+// in insertion order. It has a value receiver so that OrderedMaps
+// encode correctly whether or not they are accessed through a
+// pointer.
+func (m OrderedMap) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+
+	b.WriteByte('{')
+
+	for i, k := range m.keys {
+
+		if i > 0 {
+			b.WriteByte(',')
+		}
+
+		key, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := json.Marshal(m.values[k])
+		if err != nil {
+			return nil, err
+		}
+
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+
+	b.WriteByte('}')
+
+	return b.Bytes(), nil
+}
+
+// DecodeOrdered reads the next JSON value from a Decoder. It
+// works like Decoder.Decode except that JSON objects are
+// decoded to OrderedMaps so that their key order is preserved.
+func DecodeOrdered(d *json.Decoder) (interface{}, error) {
+
+	tok, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		m := NewOrderedMap(0)
+		for d.More() {
+			key, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := DecodeOrdered(d)
+			if err != nil {
+				return nil, err
+			}
+			m.Set(key.(string), value)
+		}
+		_, err = d.Token()
+		return m, err
+	case json.Delim('['):
+		a := []interface{}{}
+		for d.More() {
+			value, err := DecodeOrdered(d)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, value)
+		}
+		_, err = d.Token()
+		return a, err
+	default:
+		return tok, nil
+	}
+}
+
+// AsOrderedMap returns the OrderedMap held by v, if any. The
+// second return value is false if v is not an OrderedMap.
+func AsOrderedMap(v reflect.Value) (*OrderedMap, bool) {
+	v = Resolve(v)
+
+	if !v.IsValid() || v.Type() != TypeOrderedMap.Elem() {
+		return nil, false
+	}
+
+	if v.CanAddr() {
+		return v.Addr().Interface().(*OrderedMap), true
+	}
+
+	if v.CanInterface() {
+		m := v.Interface().(OrderedMap)
+		return &m, true
+	}
+
+	return nil, false
+}
+
+// MapLen returns the number of keys in v, which must be a map
+// or an OrderedMap.
+func MapLen(v reflect.Value) int {
+	if m, ok := AsOrderedMap(v); ok {
+		return m.Len()
+	}
+	return Resolve(v).Len()
+}
+
+// MapKeys returns the keys of v, which must be a map or an
+// OrderedMap. The keys of an OrderedMap are returned in
+// insertion order. The keys of a Go map are returned in an
+// unspecified order.
+func MapKeys(v reflect.Value) []reflect.Value {
+	m, ok := AsOrderedMap(v)
+	if !ok {
+		return Resolve(v).MapKeys()
+	}
+
+	keys := make([]reflect.Value, len(m.keys))
+	for i, k := range m.keys {
+		keys[i] = reflect.ValueOf(k)
+	}
+
+	return keys
+}
+
+// MapIndex returns the value stored under key in v, which must
+// be a map or an OrderedMap. Like reflect.Value.MapIndex, it
+// returns the zero Value if the key is not present.
+func MapIndex(v reflect.Value, key reflect.Value) reflect.Value {
+	m, ok := AsOrderedMap(v)
+	if !ok {
+		return Resolve(v).MapIndex(key)
+	}
+
+	if key.Kind() != reflect.String {
+		return reflect.Value{}
+	}
+
+	return reflect.ValueOf(m.values).MapIndex(key.Convert(typeString))
+}
+
+func isOrderedMap(v reflect.Value) bool {
+	v = Resolve(v)
+	return v.IsValid() && v.Type() == TypeOrderedMap.Elem()
+}
+
+// Plain returns a copy of v in which any OrderedMaps have been
+// replaced by map[string]interface{}. It descends into slices
+// of type []interface{} and maps of type map[string]interface{}.
+// Values that do not contain OrderedMaps are returned as is.
+func Plain(v interface{}) interface{} {
+	v, _ = plain(v, replaceOrderedMaps)
+	return v
+}
+
+// PlainNulls returns a copy of v in which any JSONata null
+// values (nil pointers of type *interface{}) have been replaced
+// by untyped nils. Like Plain, it descends into slices and maps,
+// including OrderedMaps.
+func PlainNulls(v interface{}) interface{} {
+	v, _ = plain(v, replaceNulls)
+	return v
+}
+
+type replaceFlags int
+
+const (
+	replaceOrderedMaps replaceFlags = 1 << iota
+	replaceNulls
+	replaceDecimals
+)
+
+// plain is the implementation of Plain, PlainNulls and
+// PlainDecimals. The second return value is true if v was
+// replaced.
+func plain(v interface{}, flags replaceFlags) (interface{}, bool) {
+	switch v := v.(type) {
+	case *Decimal:
+		if v != nil && flags&replaceDecimals != 0 {
+			return decimalToNumber(v), true
+		}
+		return v, false
+	case *interface{}:
+		if v == nil && flags&replaceNulls != 0 {
+			return nil, true
+		}
+		return v, false
+	case *OrderedMap:
+		if v == nil {
+			return v, false
+		}
+		return plainOrderedMap(v, flags)
+	case OrderedMap:
+		m, _ := plainOrderedMap(&v, flags)
+		return m, true
+	case map[string]interface{}:
+		if m := plainMap(v, false, flags); m != nil {
+			return m, true
+		}
+		return v, false
+	case []interface{}:
+		var results []interface{}
+		for i, item := range v {
+			p, changed := plain(item, flags)
+			if !changed {
+				continue
+			}
+			if results == nil {
+				results = make([]interface{}, len(v))
+				copy(results, v)
+			}
+			results[i] = p
+		}
+		if results == nil {
+			return v, false
+		}
+		return results, true
+	default:
+		return v, false
+	}
+}
+
+// plainOrderedMap applies plain to the values of an OrderedMap.
+// If flags includes replaceOrderedMaps, the result is a Go map.
+// Otherwise it is an OrderedMap with the same keys.
+func plainOrderedMap(m *OrderedMap, flags replaceFlags) (interface{}, bool) {
+	if flags&replaceOrderedMaps != 0 {
+		return plainMap(m.values, true, flags), true
+	}
+
+	values := plainMap(m.values, false, flags)
+	if values == nil {
+		return m, false
+	}
+
+	return &OrderedMap{
+		keys:   append([]string(nil), m.keys...),
+		values: values,
+	}, true
+}
+
+// plainMap returns a copy of m with its values converted by
+// plain. If none of the values change, plainMap returns nil
+// unless force is true.
+func plainMap(m map[string]interface{}, force bool, flags replaceFlags) map[string]interface{} {
+	var results map[string]interface{}
+
+	if force {
+		results = make(map[string]interface{}, len(m))
+		for k, v := range m {
+			results[k] = v
+		}
+	}
+
+	for k, v := range m {
+		p, changed := plain(v, flags)
+		if !changed {
+			continue
+		}
+		if results == nil {
+			results = make(map[string]interface{}, len(m))
+			for k, v := range m {
+				results[k] = v
+			}
+		}
+		results[k] = p
+	}
+
+	return results
+}
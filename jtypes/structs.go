@@ -0,0 +1,280 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jtypes
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// StructField describes a struct field that is visible to
+// JSONata expressions.
+type StructField struct {
+	// Name is the name used to access the field. It is taken
+	// from the field's json tag if there is one, otherwise it
+	// is the Go field name.
+	Name string
+
+	// Index is the index sequence of the field, suitable for
+	// passing to reflect.Value.FieldByIndex. Fields promoted
+	// from embedded structs have more than one index.
+	Index []int
+}
+
+// Value returns the field of struct value v. Unlike
+// reflect.Value.FieldByIndex, it does not panic if the field
+// is promoted from a nil embedded pointer. It returns an
+// invalid Value instead.
+func (f StructField) Value(v reflect.Value) reflect.Value {
+	for i, x := range f.Index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+type structInfo struct {
+	fields []StructField
+	byName map[string]int
+}
+
+// structCache maps a struct type to its *structInfo so that
+// the fields and tags of a given type are only parsed once.
+var structCache sync.Map
+
+// StructFields returns the fields of struct type t that are
+// visible to JSONata, in declaration order. Unexported fields
+// and fields tagged with `json:"-"` are omitted. Fields with
+// a json tag are named after the tag. The fields of embedded
+// structs are promoted according to the rules of encoding/json:
+// an embedded struct with a json tag is treated as a regular
+// field, and when several fields have the same name, the one
+// that is least deeply nested wins. If that does not settle
+// it, a tagged field wins over untagged ones, otherwise all of
+// the fields with that name are omitted.
+func StructFields(t reflect.Type) []StructField {
+	return getStructInfo(t).fields
+}
+
+// FieldByName returns the field of struct value v with the
+// given JSONata name. The second return value is false if v
+// has no such field, or if the field is promoted from a nil
+// embedded pointer.
+func FieldByName(v reflect.Value, name string) (reflect.Value, bool) {
+	info := getStructInfo(v.Type())
+
+	i, ok := info.byName[name]
+	if !ok {
+		return reflect.Value{}, false
+	}
+
+	v = info.fields[i].Value(v)
+	return v, v.IsValid()
+}
+
+func getStructInfo(t reflect.Type) *structInfo {
+	if info, ok := structCache.Load(t); ok {
+		return info.(*structInfo)
+	}
+
+	info, _ := structCache.LoadOrStore(t, newStructInfo(t))
+	return info.(*structInfo)
+}
+
+// A structCandidate is a field that may be visible to JSONata,
+// depending on the other fields with the same name.
+type structCandidate struct {
+	StructField
+	tagged bool
+}
+
+// An embeddedStruct is a struct type whose fields are
+// promoted, and the index sequence of its embedded field.
+type embeddedStruct struct {
+	typ   reflect.Type
+	index []int
+}
+
+func newStructInfo(t reflect.Type) *structInfo {
+
+	var candidates []structCandidate
+	visited := map[reflect.Type]bool{}
+
+	// Walk the embedded structs breadth first, so that the
+	// candidates are ordered by depth.
+	for current := []embeddedStruct{{typ: t}}; len(current) > 0; {
+
+		var next []embeddedStruct
+
+		for _, embedded := range current {
+
+			// A type embedded more than once at the same depth
+			// is walked each time, so that its fields conflict.
+			if visited[embedded.typ] {
+				continue
+			}
+
+			for i, N := 0, embedded.typ.NumField(); i < N; i++ {
+
+				field := embedded.typ.Field(i)
+
+				ft := field.Type
+				if field.Anonymous && ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+
+				name, tagged, ok := fieldName(field)
+				if !ok {
+					continue
+				}
+
+				index := make([]int, len(embedded.index)+1)
+				copy(index, embedded.index)
+				index[len(embedded.index)] = i
+
+				if field.Anonymous && !tagged && ft.Kind() == reflect.Struct {
+					// Promote the fields of untagged embedded
+					// structs, even unexported ones.
+					next = append(next, embeddedStruct{
+						typ:   ft,
+						index: index,
+					})
+					continue
+				}
+
+				if field.PkgPath != "" {
+					// Skip unexported fields.
+					continue
+				}
+
+				candidates = append(candidates, structCandidate{
+					StructField: StructField{
+						Name:  name,
+						Index: index,
+					},
+					tagged: tagged,
+				})
+			}
+		}
+
+		for _, embedded := range current {
+			visited[embedded.typ] = true
+		}
+
+		current = next
+	}
+
+	byName := map[string][]structCandidate{}
+	for _, c := range candidates {
+		byName[c.Name] = append(byName[c.Name], c)
+	}
+
+	var fields []StructField
+	for _, c := range candidates {
+		if f, ok := dominantField(byName[c.Name]); ok && sameIndex(f.Index, c.Index) {
+			fields = append(fields, f)
+		}
+	}
+
+	// Return the fields in declaration order, with promoted
+	// fields in place of the embedded struct.
+	sort.Slice(fields, func(i, j int) bool {
+		return lessIndex(fields[i].Index, fields[j].Index)
+	})
+
+	info := &structInfo{
+		fields: fields,
+		byName: make(map[string]int, len(fields)),
+	}
+
+	for i, f := range fields {
+		info.byName[f.Name] = i
+	}
+
+	return info
+}
+
+// dominantField returns the field that is visible among
+// candidates with the same name, which must be ordered by
+// depth. The second return value is false if none of them
+// is visible.
+func dominantField(candidates []structCandidate) (StructField, bool) {
+
+	depth := len(candidates[0].Index)
+
+	var dominant []structCandidate
+	for _, c := range candidates {
+		if len(c.Index) > depth {
+			break
+		}
+		dominant = append(dominant, c)
+	}
+
+	if len(dominant) == 1 {
+		return dominant[0].StructField, true
+	}
+
+	var tagged []structCandidate
+	for _, c := range dominant {
+		if c.tagged {
+			tagged = append(tagged, c)
+		}
+	}
+
+	if len(tagged) == 1 {
+		return tagged[0].StructField, true
+	}
+
+	return StructField{}, false
+}
+
+func sameIndex(x, y []int) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func lessIndex(x, y []int) bool {
+	for i := 0; i < len(x) && i < len(y); i++ {
+		if x[i] != y[i] {
+			return x[i] < y[i]
+		}
+	}
+	return len(x) < len(y)
+}
+
+// fieldName returns the JSON name of a struct field, following
+// the conventions of encoding/json, and whether the name comes
+// from a json tag. The third return value is false if the field
+// should be hidden.
+func fieldName(field reflect.StructField) (string, bool, bool) {
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false, false
+	}
+
+	if i := strings.Index(tag, ","); i >= 0 {
+		tag = tag[:i]
+	}
+
+	if tag == "" {
+		return field.Name, false, true
+	}
+
+	return tag, true, true
+}
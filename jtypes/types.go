@@ -7,6 +7,7 @@
 package jtypes
 
 import (
+	"encoding/json"
 	"errors"
 	"reflect"
 )
@@ -31,6 +32,9 @@ var (
 	TypeValue = reflect.TypeOf((*reflect.Value)(nil)).Elem()
 	// TypeInterface (golint)
 	TypeInterface = reflect.TypeOf((*interface{})(nil)).Elem()
+	// TypeJSONNumber is the reflect.Type for json.Number. JSON
+	// numbers are treated as numbers rather than strings.
+	TypeJSONNumber = reflect.TypeOf((*json.Number)(nil)).Elem()
 )
 
 // ErrUndefined (golint)
@@ -245,9 +249,59 @@ func ArgCountEquals(n int) ArgHandler {
 	}
 }
 
-// ArgUndefined (golint)
+// ArgUndefined returns an ArgHandler that is true if the i'th
+// argument is undefined. Extensions should use ArgUndefinedAny
+// with the UndefinedArgs field of jsonata.Extension instead.
 func ArgUndefined(i int) ArgHandler {
 	return func(argv []reflect.Value) bool {
 		return len(argv) > i && argv[i] == undefined
 	}
 }
+
+// UndefinedArgs decides whether a call to a function returns
+// undefined, based on which of its arguments are undefined.
+// The i'th element of undefined is true if the i'th argument
+// is undefined. See the UndefinedArgs field of jsonata.Extension.
+type UndefinedArgs func(undefined []bool) bool
+
+// ArgsAnyUndefined returns an UndefinedArgs that is true if
+// any argument is undefined.
+func ArgsAnyUndefined() UndefinedArgs {
+	return func(undefined []bool) bool {
+		for _, u := range undefined {
+			if u {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ArgsAllUndefined returns an UndefinedArgs that is true if
+// there is at least one argument and every argument is
+// undefined.
+func ArgsAllUndefined() UndefinedArgs {
+	return func(undefined []bool) bool {
+		for _, u := range undefined {
+			if !u {
+				return false
+			}
+		}
+		return len(undefined) > 0
+	}
+}
+
+// ArgUndefinedAny returns an UndefinedArgs that is true if
+// any of the arguments at the given (zero-based) positions is
+// undefined. Positions beyond the end of the argument list are
+// ignored.
+func ArgUndefinedAny(indices ...int) UndefinedArgs {
+	return func(undefined []bool) bool {
+		for _, i := range indices {
+			if i >= 0 && i < len(undefined) && undefined[i] {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jsonata
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/blues/jsonata-go/jparse"
+)
+
+// evalNameMethod calls the method with the given name on
+// struct value v, for the MethodFallback option. The second
+// return value is false if v has no suitable method.
+func evalNameMethod(node *jparse.NameNode, v reflect.Value) (reflect.Value, bool, error) {
+
+	recv := v
+	i, ok := getMethodInfo(v.Type()).byName[node.Value]
+
+	if !ok {
+		// Look for a method with a pointer receiver. If v
+		// is not addressable, e.g. because it's an item in
+		// a sequence, call the method on a copy of v.
+		i, ok = getMethodInfo(reflect.PtrTo(v.Type())).byName[node.Value]
+		if !ok {
+			return undefined, false, nil
+		}
+
+		if v.CanAddr() {
+			recv = v.Addr()
+		} else {
+			recv = reflect.New(v.Type())
+			recv.Elem().Set(v)
+		}
+	}
+
+	results := recv.Method(i).Call(nil)
+
+	if len(results) == 2 && !results[1].IsNil() {
+		err := results[1].Interface().(error)
+		return undefined, true, newEvalError(ErrMethodCall, node, err.Error())
+	}
+
+	return results[0], true, nil
+}
+
+// methodInfo holds the methods of a type that can be called
+// by evalNameMethod, i.e. exported methods that take no
+// arguments and return a single value, or a value and an
+// error.
+type methodInfo struct {
+	byName map[string]int
+}
+
+var methodCache sync.Map // map[reflect.Type]*methodInfo
+
+func getMethodInfo(t reflect.Type) *methodInfo {
+	if info, ok := methodCache.Load(t); ok {
+		return info.(*methodInfo)
+	}
+
+	info, _ := methodCache.LoadOrStore(t, newMethodInfo(t))
+	return info.(*methodInfo)
+}
+
+func newMethodInfo(t reflect.Type) *methodInfo {
+	info := &methodInfo{
+		byName: map[string]int{},
+	}
+
+	for i, N := 0, t.NumMethod(); i < N; i++ {
+
+		m := t.Method(i)
+		if m.PkgPath != "" {
+			continue
+		}
+
+		// The method type includes the receiver.
+		mt := m.Type
+		if mt.NumIn() != 1 {
+			continue
+		}
+
+		switch mt.NumOut() {
+		case 1:
+		case 2:
+			if mt.Out(1) != typeError {
+				continue
+			}
+		default:
+			continue
+		}
+
+		info.byName[m.Name] = i
+	}
+
+	return info
+}
@@ -0,0 +1,169 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jsonata
+
+import (
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/blues/jsonata-go/jtypes"
+)
+
+// Metrics receives notifications about evaluations, e.g. to
+// record evaluation counts, error rates and durations for
+// each expression. See SetMetrics and Expr.SetMetrics.
+//
+// The methods are called from the goroutine that calls the
+// evaluation method. A Metrics used by Exprs that are evaluated
+// concurrently must be safe for concurrent use.
+type Metrics interface {
+
+	// OnEvalStart is called at the start of each evaluation.
+	// The fingerprint identifies the expression (see
+	// Expr.Fingerprint).
+	OnEvalStart(fingerprint string)
+
+	// OnEvalEnd is called at the end of each evaluation with
+	// the time it took and the error it returned, if any
+	// (including ErrUndefined). The size is an estimate of the
+	// size of the result: the number of values it contains,
+	// counting each array, object and scalar value. It is zero
+	// if the evaluation did not return a result.
+	OnEvalEnd(fingerprint string, d time.Duration, err error, size int)
+}
+
+// globalMetrics holds the Metrics set by SetMetrics, wrapped
+// in a metricsValue because an atomic.Value cannot store nil.
+var globalMetrics atomic.Value
+
+type metricsValue struct {
+	m Metrics
+}
+
+// SetMetrics sets the Metrics that are notified of evaluations
+// of all Exprs, except those that have their own Metrics (see
+// Expr.SetMetrics). Pass nil to stop collecting metrics. When
+// no Metrics are set, evaluations do not measure anything.
+func SetMetrics(m Metrics) {
+	globalMetrics.Store(metricsValue{m})
+}
+
+// SetMetrics sets the Metrics that are notified of evaluations
+// of the Expr (and of its clones, until they call SetMetrics
+// themselves), in place of those set by the package level
+// SetMetrics function. Pass nil to use the package level
+// Metrics again.
+func (e *Expr) SetMetrics(m Metrics) {
+	e.metrics = m
+}
+
+// Fingerprint returns a hash of the source text of the Expr,
+// for use as a key in metrics. Exprs compiled from the same
+// source text have the same fingerprint.
+func (e *Expr) Fingerprint() string {
+	return e.fingerprint
+}
+
+// fingerprint returns the fingerprint of an expression's
+// source text.
+func fingerprint(expr string) string {
+	h := fnv.New64a()
+	h.Write([]byte(expr))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// getMetrics returns the Metrics for evaluations of the Expr,
+// or nil if there are none.
+func (e *Expr) getMetrics() Metrics {
+
+	if e.metrics != nil {
+		return e.metrics
+	}
+
+	v, _ := globalMetrics.Load().(metricsValue)
+	return v.m
+}
+
+// measure calls eval and reports it to m.
+func (e *Expr) measure(m Metrics, eval func() (interface{}, error)) (interface{}, error) {
+
+	m.OnEvalStart(e.fingerprint)
+	start := time.Now()
+
+	v, err := eval()
+
+	size := 0
+	if err == nil || isPartial(err) {
+		size = resultSize(v)
+	}
+
+	m.OnEvalEnd(e.fingerprint, time.Since(start), err, size)
+	return v, err
+}
+
+// resultSize returns the number of values in v, counting each
+// array, object and scalar value.
+func resultSize(v interface{}) int {
+
+	switch v := v.(type) {
+	case nil, string, float64, bool:
+		return 1
+
+	case []interface{}:
+		n := 1
+		for _, item := range v {
+			n += resultSize(item)
+		}
+		return n
+
+	case map[string]interface{}:
+		n := 1
+		for _, item := range v {
+			n += resultSize(item)
+		}
+		return n
+
+	case *jtypes.OrderedMap:
+		n := 1
+		for _, key := range v.Keys() {
+			item, _ := v.Get(key)
+			n += resultSize(item)
+		}
+		return n
+	}
+
+	// Other types come from the input data.
+	rv := reflect.ValueOf(v)
+
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		n := 1
+		for i := 0; i < rv.Len(); i++ {
+			n += resultSize(valueInterface(rv.Index(i)))
+		}
+		return n
+
+	case reflect.Map:
+		n := 1
+		iter := rv.MapRange()
+		for iter.Next() {
+			n += resultSize(valueInterface(iter.Value()))
+		}
+		return n
+
+	default:
+		return 1
+	}
+}
+
+func valueInterface(v reflect.Value) interface{} {
+	if !v.CanInterface() {
+		return nil
+	}
+	return v.Interface()
+}
@@ -0,0 +1,249 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jsonata
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// metricsEvent records a call to a recordingMetrics.
+type metricsEvent struct {
+	Start       bool
+	Fingerprint string
+	Err         error
+	Size        int
+}
+
+type recordingMetrics struct {
+	events []metricsEvent
+}
+
+func (m *recordingMetrics) OnEvalStart(fingerprint string) {
+	m.events = append(m.events, metricsEvent{
+		Start:       true,
+		Fingerprint: fingerprint,
+	})
+}
+
+func (m *recordingMetrics) OnEvalEnd(fingerprint string, d time.Duration, err error, size int) {
+	m.events = append(m.events, metricsEvent{
+		Fingerprint: fingerprint,
+		Err:         err,
+		Size:        size,
+	})
+}
+
+func TestMetrics(t *testing.T) {
+
+	data := map[string]interface{}{
+		"a": []interface{}{
+			1.0,
+			"two",
+			map[string]interface{}{
+				"three": true,
+			},
+		},
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		Expression string
+		Eval       func(*Expr) error
+		Size       int
+		Error      bool
+	}{
+		{
+			Expression: `a`,
+			Size:       5,
+		},
+		{
+			Expression: `{"x": a[0], "y": [1, 2]}`,
+			Size:       5,
+		},
+		{
+			Expression: `null`,
+			Size:       1,
+		},
+		{
+			Expression: `missing`,
+		},
+		{
+			Expression: `$number("x")`,
+			Error:      true,
+		},
+		{
+			Expression: `a[2]`,
+			Eval: func(e *Expr) error {
+				_, err := e.EvalBytes([]byte(`{"a": [1, 2, {"b": null}]}`))
+				return err
+			},
+			Size: 2,
+		},
+		{
+			Expression: `a[2]`,
+			Eval: func(e *Expr) error {
+				_, err := e.EvalRaw([]byte(`{"a": [1, 2, {"b": null}]}`))
+				return err
+			},
+			Size: 2,
+		},
+		{
+			Expression: `a[5]`,
+			Eval: func(e *Expr) error {
+				_, err := e.EvalRaw([]byte(`{"a": [1, 2, 3]}`))
+				return err
+			},
+		},
+		{
+			Expression: `$x`,
+			Eval: func(e *Expr) error {
+				_, err := e.EvalWithVars(nil, map[string]interface{}{
+					"x": "value",
+				})
+				return err
+			},
+			Size: 1,
+		},
+		{
+			Expression: `a`,
+			Eval: func(e *Expr) error {
+				_, err := e.EvalCtx(canceled, data)
+				return err
+			},
+			Error: true,
+		},
+	}
+
+	for _, test := range tests {
+
+		e := MustCompile(test.Expression)
+
+		var m recordingMetrics
+		e.SetMetrics(&m)
+
+		var err error
+		if test.Eval != nil {
+			err = test.Eval(e)
+		} else {
+			_, err = e.Eval(data)
+		}
+
+		if test.Size == 0 && !test.Error && err != ErrUndefined {
+			t.Errorf("%s: expected error %v, got %v", test.Expression, ErrUndefined, err)
+		}
+
+		if len(m.events) != 2 || !m.events[0].Start || m.events[1].Start {
+			t.Errorf("%s: expected one call to OnEvalStart and one to OnEvalEnd, got %v", test.Expression, m.events)
+			continue
+		}
+
+		for _, ev := range m.events {
+			if ev.Fingerprint != e.Fingerprint() {
+				t.Errorf("%s: expected fingerprint %q, got %q", test.Expression, e.Fingerprint(), ev.Fingerprint)
+			}
+		}
+
+		end := m.events[1]
+
+		if end.Err != err {
+			t.Errorf("%s: expected OnEvalEnd to receive error %v, got %v", test.Expression, err, end.Err)
+		}
+
+		if test.Error && err == nil {
+			t.Errorf("%s: expected an error", test.Expression)
+		}
+
+		if end.Size != test.Size {
+			t.Errorf("%s: expected size %d, got %d", test.Expression, test.Size, end.Size)
+		}
+	}
+}
+
+func TestSetMetrics(t *testing.T) {
+
+	var global, local recordingMetrics
+
+	SetMetrics(&global)
+	defer SetMetrics(nil)
+
+	e := MustCompile(`1 + 1`)
+	e.Eval(nil)
+
+	if len(global.events) != 2 {
+		t.Errorf("expected 2 events from the global Metrics, got %d", len(global.events))
+	}
+
+	// Clones inherit the Expr's Metrics, which take precedence
+	// over the global Metrics.
+	e.SetMetrics(&local)
+	e.Clone().Eval(nil)
+
+	if len(global.events) != 2 {
+		t.Errorf("expected no more events from the global Metrics, got %d", len(global.events)-2)
+	}
+
+	if len(local.events) != 2 {
+		t.Errorf("expected 2 events from the Expr's Metrics, got %d", len(local.events))
+	}
+
+	e.SetMetrics(nil)
+	SetMetrics(nil)
+	e.Eval(nil)
+
+	if len(global.events) != 2 || len(local.events) != 2 {
+		t.Errorf("expected no events after removing the Metrics, got %d and %d", len(global.events)-2, len(local.events)-2)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+
+	e1 := MustCompile(`Account.Order.Product.Price`)
+	e2 := MustCompile(`Account.Order.Product.Price`)
+	e3 := MustCompile(`Account.Order.Product.Quantity`)
+
+	if e1.Fingerprint() == "" {
+		t.Errorf("expected a fingerprint")
+	}
+
+	if e1.Fingerprint() != e2.Fingerprint() {
+		t.Errorf("expected the same fingerprint for the same expression, got %q and %q", e1.Fingerprint(), e2.Fingerprint())
+	}
+
+	if e1.Fingerprint() == e3.Fingerprint() {
+		t.Errorf("expected different fingerprints for different expressions, got %q", e1.Fingerprint())
+	}
+
+	if fp := e1.Clone().Fingerprint(); fp != e1.Fingerprint() {
+		t.Errorf("expected the clone's fingerprint to be %q, got %q", e1.Fingerprint(), fp)
+	}
+}
+
+func BenchmarkMetrics(b *testing.B) {
+
+	e := MustCompile(`Account.Order[0].Product[0].Price * 2`)
+
+	b.Run("unset", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			e.Eval(testdata.account)
+		}
+	})
+
+	b.Run("set", func(b *testing.B) {
+		e := e.Clone()
+		e.SetMetrics(discardMetrics{})
+		for i := 0; i < b.N; i++ {
+			e.Eval(testdata.account)
+		}
+	})
+}
+
+type discardMetrics struct{}
+
+func (discardMetrics) OnEvalStart(string)                          {}
+func (discardMetrics) OnEvalEnd(string, time.Duration, error, int) {}
@@ -0,0 +1,453 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jsonata
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/blues/jsonata-go/jparse"
+	"github.com/blues/jsonata-go/jtypes"
+)
+
+// EvalRaw is like Eval except that it takes JSON data as a
+// byte slice. Expressions that are simple paths, made up of
+// names (e.g. payload.device.id or `device id`) and constant
+// array indexes (e.g. readings[0].temp or readings[-1]), are
+// evaluated by scanning the JSON for the value that the path
+// selects, without decoding the rest of the document. Other
+// expressions are evaluated by decoding the whole document and
+// calling Eval.
+//
+// The results are the same as decoding the data with
+// json.Unmarshal (or as Decimals, if the Decimal option is set)
+// and calling Eval. In particular, EvalRaw returns ErrUndefined
+// if the path does not match anything, and it returns an error
+// if the data is not valid JSON, even if the path's value can
+// be found. Paths that pass through an array without indexing
+// it (e.g. items.name, where items is an array) are evaluated
+// by Eval.
+func (e *Expr) EvalRaw(data []byte) (interface{}, error) {
+
+	raw, ok := e.scanRawPath(data)
+	if !ok {
+		v, err := e.decodeJSON(data)
+		if err != nil {
+			return nil, err
+		}
+		return e.Eval(v)
+	}
+
+	if m := e.getMetrics(); m != nil {
+		return e.measure(m, func() (interface{}, error) {
+			return e.evalRawValue(raw)
+		})
+	}
+
+	return e.evalRawValue(raw)
+}
+
+// evalRawValue returns the result of EvalRaw for the JSON
+// that scanRawPath found.
+func (e *Expr) evalRawValue(raw []byte) (interface{}, error) {
+
+	if raw == nil {
+		return nil, ErrUndefined
+	}
+
+	v, err := e.decodeJSON(raw)
+	if err != nil || v == nil {
+		return nil, err
+	}
+
+	v, err = e.result(reflect.ValueOf(v), nil)
+	return jtypes.Plain(v), err
+}
+
+// decodeJSON decodes JSON data in the same way as EvalBytes.
+func (e *Expr) decodeJSON(data []byte) (interface{}, error) {
+
+	if e.options != nil && e.options.Decimal {
+		return decodeDecimals(data)
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// scanRawPath returns the JSON for the value that the Expr
+// selects in data, or nil if there is no such value. The second
+// return value is false if the Expr is not a simple path (see
+// EvalRaw) or if the data requires the full evaluator.
+func (e *Expr) scanRawPath(data []byte) ([]byte, bool) {
+
+	if e.rawPath == nil || e.trace != nil || convertsJSON() {
+		return nil, false
+	}
+
+	// The scanner assumes that the data is valid. Invalid data
+	// fails in the same way as it would in json.Unmarshal.
+	if !json.Valid(data) {
+		return nil, false
+	}
+
+	return walkRawPath(data, e.rawPath.steps, e.rawPath.isPath)
+}
+
+// jsonTypes are the types of the values that decodeJSON
+// produces.
+var jsonTypes = []reflect.Type{
+	reflect.TypeOf(""),
+	reflect.TypeOf(float64(0)),
+	reflect.TypeOf(false),
+	reflect.TypeOf(json.Number("")),
+	reflect.TypeOf(map[string]interface{}{}),
+	reflect.TypeOf([]interface{}{}),
+	jtypes.TypeDecimal.Elem(),
+}
+
+// convertsJSON reports whether a custom ValueConverter is
+// registered for any of the types that decodeJSON produces.
+// The scanner does not apply converters.
+func convertsJSON() bool {
+
+	if atomic.LoadInt32(&numConverters) == 0 {
+		return false
+	}
+
+	for _, t := range jsonTypes {
+		if converterFor(t) != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// A rawPath is an expression that EvalRaw can evaluate by
+// scanning JSON data.
+type rawPath struct {
+	steps []rawStep
+
+	// isPath is true if the expression is a path, which
+	// returns undefined rather than an empty array.
+	isPath bool
+}
+
+// A rawStep is a step in a rawPath: a name, optionally
+// followed by constant array indexes.
+type rawStep struct {
+	name    string
+	indexes []float64
+}
+
+// newRawPath returns a rawPath for node, or nil if node is
+// not a static path.
+func newRawPath(node jparse.Node) *rawPath {
+
+	switch node := node.(type) {
+	case *jparse.NameNode:
+		return &rawPath{
+			steps: []rawStep{
+				{
+					name: node.Value,
+				},
+			},
+		}
+
+	case *jparse.PathNode:
+		if node.KeepArrays || node.Tuples || len(node.Steps) == 0 {
+			return nil
+		}
+
+		steps := make([]rawStep, len(node.Steps))
+		for i, step := range node.Steps {
+			var ok bool
+			if steps[i], ok = newRawStep(step); !ok {
+				return nil
+			}
+		}
+
+		return &rawPath{
+			steps:  steps,
+			isPath: true,
+		}
+
+	default:
+		return nil
+	}
+}
+
+func newRawStep(node jparse.Node) (rawStep, bool) {
+
+	switch node := node.(type) {
+	case *jparse.NameNode:
+		return rawStep{
+			name: node.Value,
+		}, true
+
+	case *jparse.PredicateNode:
+		name, ok := node.Expr.(*jparse.NameNode)
+		if !ok {
+			return rawStep{}, false
+		}
+
+		indexes := make([]float64, len(node.Filters))
+		for i, filter := range node.Filters {
+			if indexes[i], ok = constantIndex(filter); !ok {
+				return rawStep{}, false
+			}
+		}
+
+		return rawStep{
+			name:    name.Value,
+			indexes: indexes,
+		}, true
+
+	default:
+		return rawStep{}, false
+	}
+}
+
+func constantIndex(node jparse.Node) (float64, bool) {
+
+	switch node := node.(type) {
+	case *jparse.NumberNode:
+		return node.Value, true
+	case *jparse.NegationNode:
+		if n, ok := node.RHS.(*jparse.NumberNode); ok {
+			return -n.Value, true
+		}
+	}
+
+	return 0, false
+}
+
+// walkRawPath returns the JSON for the value that steps select
+// in data, which must be valid JSON. It returns nil if there is
+// no such value. The second return value is false if the steps
+// visit an array that the evaluator would map over, which the
+// scanner does not support.
+func walkRawPath(data []byte, steps []rawStep, isPath bool) ([]byte, bool) {
+
+	cur := bytes.TrimSpace(data)
+
+	for i, step := range steps {
+
+		switch cur[0] {
+		case '{':
+		case '[':
+			return nil, false
+		default:
+			// Names do not match anything in strings,
+			// numbers, booleans or null.
+			return nil, true
+		}
+
+		v := rawObjectValue(cur, step.name)
+		if v == nil {
+			return nil, true
+		}
+
+		if len(step.indexes) > 0 {
+			if v = rawIndex(v, step.indexes); v == nil {
+				return nil, true
+			}
+		}
+
+		if v[0] == '[' {
+			if i < len(steps)-1 {
+				return nil, false
+			}
+			if isPath && rawArrayLen(v) == 0 {
+				return nil, true
+			}
+		}
+
+		cur = v
+	}
+
+	return cur, true
+}
+
+// rawIndex applies constant array indexes to v. Like the
+// evaluator, it treats a value that is not an array as an
+// array of one item, and each index after the first selects
+// from the single item picked by the one before.
+func rawIndex(v []byte, indexes []float64) []byte {
+
+	var items [][]byte
+	if v[0] == '[' {
+		items = rawArrayItems(v)
+	} else {
+		items = [][]byte{v}
+	}
+
+	for _, n := range indexes {
+
+		i := int(math.Floor(n))
+		if i < 0 {
+			i += len(items)
+		}
+
+		if i < 0 || i >= len(items) {
+			return nil
+		}
+
+		items = items[i : i+1]
+	}
+
+	return items[0]
+}
+
+// rawObjectValue returns the JSON for the value of the named
+// key in obj, which must be a valid JSON object. Like
+// json.Unmarshal, it uses the last value if the key appears
+// more than once. It returns nil if the key is not present.
+func rawObjectValue(obj []byte, name string) []byte {
+
+	var value []byte
+
+	i := skipSpace(obj, 1)
+	for obj[i] != '}' {
+
+		end := skipString(obj, i)
+		key := obj[i:end]
+
+		i = skipSpace(obj, end)
+		i = skipSpace(obj, i+1) // ':'
+
+		start := i
+		i = skipValue(obj, i)
+
+		if rawKeyEquals(key, name) {
+			value = obj[start:i]
+		}
+
+		i = skipSpace(obj, i)
+		if obj[i] == ',' {
+			i = skipSpace(obj, i+1)
+		}
+	}
+
+	return value
+}
+
+// rawKeyEquals reports whether the quoted JSON string key
+// decodes to name.
+func rawKeyEquals(key []byte, name string) bool {
+
+	// Keys without escapes can be compared directly unless the
+	// name contains the replacement character, which the decoder
+	// substitutes for invalid UTF-8.
+	if bytes.IndexByte(key, '\\') < 0 && !strings.ContainsRune(name, utf8.RuneError) {
+		return string(key[1:len(key)-1]) == name
+	}
+
+	var s string
+	return json.Unmarshal(key, &s) == nil && s == name
+}
+
+// rawArrayItems returns the JSON for the items in arr, which
+// must be a valid JSON array.
+func rawArrayItems(arr []byte) [][]byte {
+
+	var items [][]byte
+
+	i := skipSpace(arr, 1)
+	for arr[i] != ']' {
+
+		start := i
+		i = skipValue(arr, i)
+		items = append(items, arr[start:i])
+
+		i = skipSpace(arr, i)
+		if arr[i] == ',' {
+			i = skipSpace(arr, i+1)
+		}
+	}
+
+	return items
+}
+
+func rawArrayLen(arr []byte) int {
+	return len(rawArrayItems(arr))
+}
+
+// skipValue returns the offset of the first byte after the
+// JSON value that starts at offset i.
+func skipValue(b []byte, i int) int {
+
+	switch b[i] {
+	case '"':
+		return skipString(b, i)
+
+	case '{', '[':
+		depth := 0
+		for ; i < len(b); i++ {
+			switch b[i] {
+			case '"':
+				i = skipString(b, i) - 1
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return i + 1
+				}
+			}
+		}
+		return i
+
+	default:
+		// Numbers, true, false and null end at the next
+		// delimiter.
+		for ; i < len(b); i++ {
+			switch b[i] {
+			case ',', '}', ']', ' ', '\t', '\n', '\r':
+				return i
+			}
+		}
+		return i
+	}
+}
+
+// skipString returns the offset of the first byte after the
+// JSON string that starts at offset i.
+func skipString(b []byte, i int) int {
+
+	for i++; i < len(b); i++ {
+		switch b[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+
+	return i
+}
+
+func skipSpace(b []byte, i int) int {
+
+	for ; i < len(b); i++ {
+		switch b[i] {
+		case ' ', '\t', '\n', '\r':
+		default:
+			return i
+		}
+	}
+
+	return i
+}
@@ -0,0 +1,315 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jsonata
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestEvalRaw(t *testing.T) {
+
+	tests := []struct {
+		Input      string
+		Expression string
+		Fast       bool
+	}{
+		{
+			Input:      `{"payload": {"device": {"id": "dev:1"}}}`,
+			Expression: `payload.device.id`,
+			Fast:       true,
+		},
+		{
+			Input:      `{"payload": {"device": {"id": "dev:1"}}}`,
+			Expression: `payload.sensor.id`,
+			Fast:       true,
+		},
+		{
+			Input:      ` { "a" : { "b" : [ 1 , 2 , 3 ] } } `,
+			Expression: `a.b`,
+			Fast:       true,
+		},
+		{
+			Input:      `{"a": {"b": [1, 2, 3]}}`,
+			Expression: `a.b[-1]`,
+			Fast:       true,
+		},
+		{
+			Input:      `{"a": {"b": [1, 2, 3]}}`,
+			Expression: `a.b[1.9]`,
+			Fast:       true,
+		},
+		{
+			Input:      `{"a": {"b": [1, 2, 3]}}`,
+			Expression: `a.b[3]`,
+			Fast:       true,
+		},
+		{
+			Input:      `{"a": {"b": []}}`,
+			Expression: `a.b`,
+			Fast:       true,
+		},
+		{
+			Input:      `{"a": []}`,
+			Expression: `a`,
+			Fast:       true,
+		},
+		{
+			Input:      `{"a": {"b": [[1, 2], [3]]}}`,
+			Expression: `a.b[0]`,
+			Fast:       true,
+		},
+		{
+			Input:      `{"a": {"b": [[1, 2], [3]]}}`,
+			Expression: `a.b[0][0]`,
+			Fast:       true,
+		},
+		{
+			Input:      `{"a": {"b": {"c": 1}}}`,
+			Expression: `a.b[0].c`,
+			Fast:       true,
+		},
+		{
+			Input:      `{"a": {"b": null}}`,
+			Expression: `a.b`,
+			Fast:       true,
+		},
+		{
+			Input:      `{"a": null}`,
+			Expression: `a.b`,
+			Fast:       true,
+		},
+		{
+			Input:      `{"a": "string"}`,
+			Expression: `a.b`,
+			Fast:       true,
+		},
+		{
+			Input:      `{"a": 1, "a": 2}`,
+			Expression: `a`,
+			Fast:       true,
+		},
+		{
+			Input:      `{"a\"b": 1, "cd": {"e f": true}}`,
+			Expression: "`a\"b` + (cd.`e f` ? 1 : 0)",
+		},
+		{
+			Input:      `{"a\"b": 1, "cd": {"e f": true}}`,
+			Expression: "cd.`e f`",
+			Fast:       true,
+		},
+		{
+			Input:      `{"a\"b": "x\ty"}`,
+			Expression: "`a\"b`",
+			Fast:       true,
+		},
+		{
+			Input:      `[{"a": 1}, {"a": 2}]`,
+			Expression: `a`,
+		},
+		{
+			Input:      `{"items": [{"a": 1}, {"a": 2}]}`,
+			Expression: `items.a`,
+		},
+		{
+			Input:      `{"items": [{"a": 1}, {"a": 2}]}`,
+			Expression: `items[1].a`,
+			Fast:       true,
+		},
+		{
+			Input:      `{"items": [{"a": 1}, {"a": 2}]}`,
+			Expression: `items[a > 1].a`,
+		},
+		{
+			Input:      `{"a": {"b": [1]}}`,
+			Expression: `a.b[]`,
+		},
+		{
+			Input:      `{"a": 1} {"a": 2}`,
+			Expression: `a`,
+		},
+		{
+			Input:      `{"a": {"b": 1}`,
+			Expression: `a.b`,
+		},
+	}
+
+	for _, test := range tests {
+
+		data := []byte(test.Input)
+		e := MustCompile(test.Expression)
+
+		if _, fast := e.scanRawPath(data); fast != test.Fast {
+			t.Errorf("%s: expected fast path %t, got %t", test.Expression, test.Fast, fast)
+		}
+
+		testEvalRaw(t, e, test.Expression, data)
+	}
+}
+
+func TestEvalRawDecimal(t *testing.T) {
+
+	data := []byte(`{"a": {"b": 9007199254740993, "c": [0.1]}}`)
+
+	for _, expr := range []string{`a.b`, `a.c`, `a.c[0]`, `a.c[0] + 0.2`} {
+		e, err := CompileWithOptions(expr, EvalOptions{
+			Decimal: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		testEvalRaw(t, e, expr, data)
+	}
+}
+
+// TestEvalRawFixtures compares EvalRaw with Eval for paths
+// into each of the JSON files in the testdata directory.
+func TestEvalRawFixtures(t *testing.T) {
+
+	files, err := filepath.Glob(filepath.Join("testdata", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var total, fast int
+
+	for _, file := range files {
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var v interface{}
+		if err := json.Unmarshal(data, &v); err != nil {
+			t.Fatalf("%s: %s", file, err)
+		}
+
+		for _, expr := range rawTestPaths(v, "", 5) {
+
+			e := MustCompile(expr)
+			if _, ok := e.scanRawPath(data); ok {
+				fast++
+			}
+			total++
+
+			testEvalRaw(t, e, file+": "+expr, data)
+		}
+	}
+
+	if fast == 0 || fast == total {
+		t.Errorf("expected some paths to use the fast path, got %d of %d", fast, total)
+	}
+}
+
+func testEvalRaw(t *testing.T, e *Expr, name string, data []byte) {
+
+	output, err := e.EvalRaw(data)
+
+	var exp interface{}
+	v, expErr := e.decodeJSON(data)
+	if expErr == nil {
+		exp, expErr = e.Eval(v)
+	}
+
+	if !reflect.DeepEqual(output, exp) {
+		t.Errorf("%s: expected %v (%T), got %v (%T)", name, exp, exp, output, output)
+	}
+
+	if fmt.Sprint(err) != fmt.Sprint(expErr) {
+		t.Errorf("%s: expected error %v, got %v", name, expErr, err)
+	}
+}
+
+// rawTestPaths returns paths to the values in v, to a depth
+// of n steps. It includes paths that index arrays (with valid
+// and invalid indexes) and paths that do not match anything.
+func rawTestPaths(v interface{}, prefix string, n int) []string {
+
+	if n == 0 {
+		return nil
+	}
+
+	join := func(step string) string {
+		if prefix == "" {
+			return step
+		}
+		return prefix + "." + step
+	}
+
+	var paths []string
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			if !strings.Contains(k, "`") {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			path := join("`" + k + "`")
+			paths = append(paths, path)
+			paths = append(paths, rawTestPaths(v[k], path, n-1)...)
+
+			for _, index := range []int{0, 1, -1, 99} {
+				indexed := fmt.Sprintf("%s[%d]", path, index)
+				paths = append(paths, indexed)
+				if a, ok := v[k].([]interface{}); ok && index >= 0 && index < len(a) {
+					paths = append(paths, rawTestPaths(a[index], indexed, n-1)...)
+				}
+			}
+		}
+		paths = append(paths, join("missing"))
+
+	case []interface{}:
+		if len(v) > 0 {
+			paths = append(paths, rawTestPaths(v[0], prefix, n)...)
+		}
+	}
+
+	return paths
+}
+
+func BenchmarkEvalRaw(b *testing.B) {
+
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "account.json"))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	e := MustCompile(`Account.Order[-1].Product[0].Price`)
+
+	b.Run("scan", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := e.EvalRaw(data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("decode", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			v, err := e.decodeJSON(data)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := e.Eval(v); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,121 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jsonata
+
+import (
+	"sort"
+
+	"github.com/blues/jsonata-go/jparse"
+)
+
+// ReferencedPaths returns the names of the top-level fields
+// that an expression reads from its input data, sorted and
+// without duplicates. For example, the expression
+//
+//	Account.Order[Total > $$.Limit].Product
+//
+// references the fields Account and Limit. Names that are
+// read relative to other values (Order, Total and Product in
+// the example) are not included.
+//
+// Wildcards and descendant operators that apply to the input
+// data are reported as "*" and "**" respectively. Fields that
+// are read by extension functions or by the lambda functions
+// passed to them are not detected.
+func ReferencedPaths(e *Expr) []string {
+
+	refs := map[string]bool{}
+	collectRefs(e.node, true, refs)
+
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// collectRefs adds the top-level field names referenced by node
+// to refs. The root argument is true if node is evaluated with
+// the input data as its context.
+func collectRefs(node jparse.Node, root bool, refs map[string]bool) {
+
+	switch node := node.(type) {
+	case *jparse.NameNode:
+		if root {
+			refs[node.Value] = true
+		}
+		return
+	case *jparse.WildcardNode:
+		if root {
+			refs["*"] = true
+		}
+		return
+	case *jparse.DescendentNode:
+		if root {
+			refs["**"] = true
+		}
+		return
+	case *jparse.PathNode:
+		for _, step := range node.Steps {
+			collectRefs(step, root, refs)
+			root = isRootStep(step, root)
+		}
+		return
+	case *jparse.PredicateNode:
+		collectRefs(node.Expr, root, refs)
+		for _, filter := range node.Filters {
+			collectRefs(filter, false, refs)
+		}
+		return
+	case *jparse.SortNode:
+		collectRefs(node.Expr, root, refs)
+		for _, term := range node.Terms {
+			collectRefs(term.Expr, false, refs)
+		}
+		return
+	case *jparse.GroupNode:
+		collectRefs(node.Expr, root, refs)
+		collectRefs(node.ObjectNode, false, refs)
+		return
+	case *jparse.ObjectTransformationNode:
+		// The transform operator applies to the object that
+		// is passed to it, not to the input data.
+		collectRefs(node.Pattern, false, refs)
+		collectRefs(node.Updates, false, refs)
+		collectRefs(node.Deletes, false, refs)
+		return
+	}
+
+	// Other nodes evaluate their children in their own context.
+	jparse.Walk(node, func(child jparse.Node) bool {
+		if child == node {
+			return true
+		}
+		collectRefs(child, root, refs)
+		return false
+	})
+}
+
+// isRootStep returns true if the path step after step is
+// evaluated with the input data as its context, i.e. if step
+// is $$ or is $ in the root context.
+func isRootStep(step jparse.Node, root bool) bool {
+
+	v, ok := step.(*jparse.VariableNode)
+	if !ok {
+		return false
+	}
+
+	switch v.Name {
+	case "$":
+		return true
+	case "":
+		return root
+	default:
+		return false
+	}
+}
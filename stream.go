@@ -0,0 +1,125 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jsonata
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// StreamOptions controls the behaviour of EvalStream.
+type StreamOptions struct {
+
+	// EmitUndefined makes EvalStream write null for records
+	// that evaluate to undefined. By default, they produce no
+	// output.
+	EmitUndefined bool
+
+	// OnError is called when a record cannot be decoded or
+	// evaluated. The error passed to OnError is a *StreamError.
+	// If OnError returns nil, EvalStream skips the record and
+	// continues with the next one. Otherwise EvalStream stops
+	// and returns the error that OnError returned. If OnError
+	// is nil, EvalStream stops at the first error.
+	//
+	// If the Expr was compiled with CollectErrors, a record
+	// that evaluates to a partial result (see
+	// EvalOptions.CollectErrors) writes the result before
+	// OnError is called with the *MultiError.
+	OnError func(err error) error
+}
+
+// A StreamError is an error that occurred while evaluating a
+// record in a stream.
+type StreamError struct {
+	// Line is the line number of the record, starting from 1.
+	Line int
+
+	// Err is the decoding or evaluation error.
+	Err error
+}
+
+func (e StreamError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+}
+
+// Unwrap returns the decoding or evaluation error.
+func (e StreamError) Unwrap() error {
+	return e.Err
+}
+
+// EvalStream evaluates an expression against each record in a
+// stream of newline-delimited JSON (also known as NDJSON or
+// JSON Lines). It writes the result for each record to w as a
+// single line of JSON. Blank lines in the input are ignored.
+//
+// EvalStream evaluates every record with the same Expr, so the
+// cost of compiling the expression is only paid once. It does
+// not modify the Expr.
+func EvalStream(expr *Expr, r io.Reader, w io.Writer, opts StreamOptions) error {
+
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+
+	for line := 1; ; line++ {
+
+		record, readErr := br.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+
+		record = bytes.TrimSpace(record)
+
+		if len(record) > 0 {
+
+			result, err := expr.EvalBytes(record)
+
+			switch {
+			case err == ErrUndefined:
+				if opts.EmitUndefined {
+					result = []byte("null")
+				}
+			case err != nil && !isPartial(err):
+				result = nil
+			}
+
+			if result != nil {
+				bw.Write(result)
+				if err := bw.WriteByte('\n'); err != nil {
+					return err
+				}
+			}
+
+			if err != nil && err != ErrUndefined {
+				if err := handleStreamError(line, err, opts); err != nil {
+					bw.Flush()
+					return err
+				}
+			}
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+	}
+
+	return bw.Flush()
+}
+
+func handleStreamError(line int, err error, opts StreamOptions) error {
+
+	serr := &StreamError{
+		Line: line,
+		Err:  err,
+	}
+
+	if opts.OnError == nil {
+		return serr
+	}
+
+	return opts.OnError(serr)
+}
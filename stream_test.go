@@ -0,0 +1,158 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jsonata
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEvalStream(t *testing.T) {
+
+	input := strings.Join([]string{
+		`{"level": "info", "msg": "starting", "ms": 5}`,
+		`{"level": "error", "msg": "failed", "ms": 12}`,
+		``,
+		`{"level": "info", "ms": 7}`,
+		`not json`,
+		`{"level": "info", "msg": "done", "ms": "slow"}`,
+		`{"level": "info", "msg": "last", "ms": 1}`,
+	}, "\n")
+
+	expr := MustCompile(`{"msg": $uppercase(msg), "secs": ms / 1000}.msg`)
+
+	tests := []struct {
+		Opts   StreamOptions
+		Output []string
+		Errors []int
+		Error  bool
+	}{
+		{
+			// Stop at the first error.
+			Output: []string{`"STARTING"`, `"FAILED"`},
+			Error:  true,
+		},
+		{
+			// Skip records that fail.
+			Opts: StreamOptions{
+				OnError: func(err error) error {
+					return nil
+				},
+			},
+			Output: []string{`"STARTING"`, `"FAILED"`, `"LAST"`},
+			Errors: []int{5, 6},
+		},
+		{
+			// Write null for undefined results.
+			Opts: StreamOptions{
+				EmitUndefined: true,
+				OnError: func(err error) error {
+					return nil
+				},
+			},
+			Output: []string{`"STARTING"`, `"FAILED"`, `null`, `"LAST"`},
+			Errors: []int{5, 6},
+		},
+	}
+
+	for i, test := range tests {
+
+		var lines []int
+		if onError := test.Opts.OnError; onError != nil {
+			test.Opts.OnError = func(err error) error {
+				var serr *StreamError
+				if !errors.As(err, &serr) {
+					t.Errorf("test %d: expected a *StreamError, got %T", i, err)
+				} else {
+					lines = append(lines, serr.Line)
+				}
+				return onError(err)
+			}
+		}
+
+		var w bytes.Buffer
+		err := EvalStream(expr, strings.NewReader(input), &w, test.Opts)
+
+		if test.Error {
+			var serr *StreamError
+			if !errors.As(err, &serr) || serr.Line != 5 {
+				t.Errorf("test %d: expected an error on line 5, got %v", i, err)
+			}
+		} else if err != nil {
+			t.Errorf("test %d: unexpected error: %s", i, err)
+		}
+
+		output := strings.Split(strings.TrimSuffix(w.String(), "\n"), "\n")
+		if !reflect.DeepEqual(output, test.Output) {
+			t.Errorf("test %d: expected output %q, got %q", i, test.Output, output)
+		}
+
+		if !reflect.DeepEqual(lines, test.Errors) {
+			t.Errorf("test %d: expected errors on lines %v, got %v", i, test.Errors, lines)
+		}
+	}
+}
+
+func TestEvalStreamPartialResults(t *testing.T) {
+
+	input := "[1, 2]\n[3, \"four\"]\n[5]\n"
+	expr, err := CompileWithOptions(`[$[0] * 2, $[1] * 2]`, EvalOptions{
+		CollectErrors: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var errs []error
+
+	var w bytes.Buffer
+	err = EvalStream(expr, strings.NewReader(input), &w, StreamOptions{
+		OnError: func(err error) error {
+			errs = append(errs, err)
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The partial result for line 2 is written along with
+	// the error, as Eval would return both.
+	if s := w.String(); s != "[2,4]\n[6]\n[10]\n" {
+		t.Errorf("expected the partial result, got %q", s)
+	}
+
+	var merr *MultiError
+	if len(errs) != 1 || !errors.As(errs[0], &merr) || errs[0].(*StreamError).Line != 2 {
+		t.Errorf("expected a *MultiError on line 2, got %v", errs)
+	}
+}
+
+func TestEvalStreamOnError(t *testing.T) {
+
+	errStop := errors.New("stop")
+
+	input := "1\n2\n\"three\"\n4\n"
+	expr := MustCompile(`$ * 2`)
+
+	var w bytes.Buffer
+	err := EvalStream(expr, strings.NewReader(input), &w, StreamOptions{
+		OnError: func(err error) error {
+			return errStop
+		},
+	})
+
+	if err != errStop {
+		t.Errorf("expected the error returned by OnError, got %v", err)
+	}
+
+	if s := w.String(); s != "2\n4\n" {
+		t.Errorf("expected the results before the error, got %q", s)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jsonata
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/blues/jsonata-go/jparse"
+	"github.com/blues/jsonata-go/jtypes"
+)
+
+// compareTimestamps compares the operands of an ordering
+// operator as instants in time if they are both RFC 3339
+// timestamps and the TemporalComparison option is set. The
+// second return value is false if the operands should be
+// compared in the usual way.
+func compareTimestamps(node *jparse.ComparisonOperatorNode, lhs, rhs reflect.Value, env *environment) (bool, bool) {
+
+	if opts := env.evalOptions(); opts == nil || !opts.TemporalComparison {
+		return false, false
+	}
+
+	t1, ok := timestamp(node.LHS, lhs, env)
+	if !ok {
+		return false, false
+	}
+
+	t2, ok := timestamp(node.RHS, rhs, env)
+	if !ok {
+		return false, false
+	}
+
+	switch node.Type {
+	case jparse.ComparisonLess:
+		return t1.Before(t2), true
+	case jparse.ComparisonLessEqual:
+		return !t1.After(t2), true
+	case jparse.ComparisonGreater:
+		return t1.After(t2), true
+	case jparse.ComparisonGreaterEqual:
+		return !t1.Before(t2), true
+	default:
+		return false, false
+	}
+}
+
+// timestamp returns the instant in time represented by v, the
+// value of the given node. String literals are looked up in the
+// timestamps parsed at compile time. Other values are parsed
+// on demand.
+func timestamp(node jparse.Node, v reflect.Value, env *environment) (time.Time, bool) {
+
+	if lit, ok := node.(*jparse.StringNode); ok && env.timestamps != nil {
+		t, ok := env.timestamps[lit]
+		if ok {
+			return t, true
+		}
+	}
+
+	s, ok := jtypes.AsString(v)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return parseTimestamp(s)
+}
+
+// literalTimestamps returns the string literals in node that
+// are RFC 3339 timestamps, parsed into times.
+func literalTimestamps(node jparse.Node) map[*jparse.StringNode]time.Time {
+
+	var timestamps map[*jparse.StringNode]time.Time
+
+	jparse.Walk(node, func(node jparse.Node) bool {
+		if lit, ok := node.(*jparse.StringNode); ok {
+			if t, ok := parseTimestamp(lit.Value); ok {
+				if timestamps == nil {
+					timestamps = map[*jparse.StringNode]time.Time{}
+				}
+				timestamps[lit] = t
+			}
+		}
+		return true
+	})
+
+	return timestamps
+}
+
+// parseTimestamp parses an RFC 3339 timestamp. Strings that
+// do not start with a date and time in the form 2006-01-02T15:04:05
+// are rejected without calling time.Parse.
+func parseTimestamp(s string) (time.Time, bool) {
+
+	if !hasTimestampPrefix(s) {
+		return time.Time{}, false
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return t, true
+}
+
+func hasTimestampPrefix(s string) bool {
+
+	const layout = "0000-00-00T00:00:00"
+
+	if len(s) <= len(layout) {
+		return false
+	}
+
+	for i := 0; i < len(layout); i++ {
+		if layout[i] == '0' {
+			if s[i] < '0' || s[i] > '9' {
+				return false
+			}
+		} else if s[i] != layout[i] {
+			return false
+		}
+	}
+
+	return true
+}
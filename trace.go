@@ -0,0 +1,344 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jsonata
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/blues/jsonata-go/jparse"
+	"github.com/blues/jsonata-go/jtypes"
+)
+
+// maxTraceSummary is the maximum length in bytes of the value
+// summaries in a TraceEvent, not counting the trailing ellipsis
+// added to summaries that are truncated.
+const maxTraceSummary = 80
+
+// A TraceEvent describes the evaluation of one node of an
+// expression. See Expr.SetTrace.
+type TraceEvent struct {
+
+	// Node is the node that was evaluated. Its position in
+	// the expression is given by jparse.SpanOf.
+	Node jparse.Node
+
+	// Depth is the number of nodes whose evaluation was in
+	// progress when Node was evaluated. The root node of the
+	// expression has a depth of zero, its operands (or steps,
+	// arguments, etc.) have a depth of one, and so on.
+	Depth int
+
+	// Input summarises the context value that Node was
+	// evaluated against, in a JSON-like form that is truncated
+	// if it is long.
+	Input string
+
+	// Output is the value that Node evaluated to, or nil if
+	// it evaluated to undefined or returned an error.
+	Output interface{}
+
+	// Err is the error returned by Node, if any.
+	Err error
+}
+
+// SetTrace sets a function that is called after each node of
+// the expression is evaluated, for debugging. Nodes are reported
+// in the order in which their evaluations finish, so operands
+// are reported before the operators that use them. A nil fn
+// turns tracing off. Tracing slows evaluation considerably and
+// is intended for development use. See also TraceToWriter.
+//
+// So that every node is reported, tracing turns off tail call
+// optimisation. Tail-recursive functions that recurse deeply
+// may use up the stack when they are traced.
+//
+// Evaluations of the Expr (and of its clones, until they call
+// SetTrace themselves) call fn from the goroutine that calls
+// the evaluation method. If the Expr is evaluated from more
+// than one goroutine at once, fn must be safe for concurrent
+// use.
+func (e *Expr) SetTrace(fn func(TraceEvent)) {
+	e.trace = fn
+}
+
+// TraceToWriter returns a function for use with SetTrace that
+// writes an indented line to w for each TraceEvent, e.g.
+//
+//	NameNode Price @24: {"Price":2.5} => 2.5
+//
+// Write errors are ignored.
+func TraceToWriter(w io.Writer) func(TraceEvent) {
+	return func(ev TraceEvent) {
+
+		out := summarize(reflect.ValueOf(ev.Output))
+		if ev.Err != nil {
+			out = "error: " + ev.Err.Error()
+		} else if ev.Output == nil {
+			out = "undefined"
+		}
+
+		fmt.Fprintf(w, "%s%s %s @%d: %s => %s\n",
+			strings.Repeat("  ", ev.Depth),
+			reflect.Indirect(reflect.ValueOf(ev.Node)).Type().Name(),
+			truncateSummary(ev.Node.String()),
+			jparse.SpanOf(ev.Node).Start,
+			ev.Input,
+			out)
+	}
+}
+
+// A tracer holds the state of a traced evaluation. Each
+// evaluation has its own tracer.
+type tracer struct {
+	fn    func(TraceEvent)
+	depth int
+}
+
+// eval evaluates node and reports it to the tracer's function.
+func (t *tracer) eval(node jparse.Node, input reflect.Value, env *environment) (reflect.Value, error) {
+
+	t.depth++
+	v, err := evalNode(node, input, env)
+	t.depth--
+
+	ev := TraceEvent{
+		Node:  node,
+		Depth: t.depth,
+		Input: summarize(input),
+		Err:   err,
+	}
+
+	if v.IsValid() && v.CanInterface() {
+		ev.Output = v.Interface()
+	}
+
+	t.fn(ev)
+
+	return v, err
+}
+
+// summarize returns a short, JSON-like description of v. Long
+// values are truncated without being formatted in full.
+func summarize(v reflect.Value) string {
+
+	if v == undefined {
+		return "undefined"
+	}
+
+	var b strings.Builder
+	writeSummary(&b, v)
+
+	return truncateSummary(b.String())
+}
+
+func truncateSummary(s string) string {
+
+	if len(s) <= maxTraceSummary {
+		return s
+	}
+
+	n := maxTraceSummary
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n] + "..."
+}
+
+func writeSummary(b *strings.Builder, v reflect.Value) {
+
+	// Stop once the summary is long enough to be truncated.
+	if b.Len() > maxTraceSummary {
+		return
+	}
+
+	if seq, ok := asSequence(v); ok {
+		v = reflect.ValueOf(seq.values)
+	}
+
+	v = jtypes.Resolve(v)
+
+	switch {
+	case !v.IsValid():
+		b.WriteString("null")
+
+	case jtypes.IsString(v):
+		s, _ := jtypes.AsString(v)
+		if len(s) > maxTraceSummary {
+			s = s[:maxTraceSummary]
+		}
+		b.WriteString(strconv.Quote(s))
+
+	case jtypes.IsBool(v):
+		b.WriteString(strconv.FormatBool(v.Bool()))
+
+	case jtypes.IsCallable(v):
+		b.WriteString("function")
+
+	case jtypes.IsArray(v):
+		b.WriteByte('[')
+		for i, n := 0, v.Len(); i < n && b.Len() <= maxTraceSummary; i++ {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			writeSummary(b, v.Index(i))
+		}
+		b.WriteByte(']')
+
+	case jtypes.IsMap(v):
+		keys := jtypes.MapKeys(v)
+		if _, ok := jtypes.AsOrderedMap(v); !ok {
+			sort.Slice(keys, func(i, j int) bool {
+				return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+			})
+		}
+		b.WriteByte('{')
+		for i, k := range keys {
+			if b.Len() > maxTraceSummary {
+				break
+			}
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(strconv.Quote(fmt.Sprint(k)))
+			b.WriteByte(':')
+			writeSummary(b, jtypes.MapIndex(v, k))
+		}
+		b.WriteByte('}')
+
+	case jtypes.IsStruct(v):
+		b.WriteByte('{')
+		n := 0
+		for _, f := range jtypes.StructFields(v.Type()) {
+			if b.Len() > maxTraceSummary {
+				break
+			}
+			fv := f.Value(v)
+			if !fv.IsValid() {
+				continue
+			}
+			if n > 0 {
+				b.WriteByte(',')
+			}
+			n++
+			b.WriteString(strconv.Quote(f.Name))
+			b.WriteByte(':')
+			writeSummary(b, fv)
+		}
+		b.WriteByte('}')
+
+	default:
+		if v.CanInterface() {
+			fmt.Fprint(b, v.Interface())
+		}
+	}
+}
+
+// A TraceRecord holds the arguments to a call to the $trace
+// function. See Expr.SetTraceSink.
+type TraceRecord struct {
+
+	// Label is the optional second argument to $trace, or
+	// the empty string if there isn't one.
+	Label string
+
+	// Value is the first argument to $trace, or nil if the
+	// argument was undefined.
+	Value interface{}
+
+	// Undefined is true if the first argument to $trace was
+	// undefined.
+	Undefined bool
+}
+
+func newTraceRecord(label string, v reflect.Value) TraceRecord {
+
+	if seq, ok := asSequence(v); ok {
+		v = seq.Value()
+	}
+
+	if v == undefined || !v.CanInterface() {
+		return TraceRecord{
+			Label:     label,
+			Undefined: true,
+		}
+	}
+
+	return TraceRecord{
+		Label: label,
+		Value: jtypes.PlainNulls(v.Interface()),
+	}
+}
+
+// String returns the record's label, if it has one, followed
+// by its value in JSON, e.g.
+//
+//	after filter: [{"id":1}]
+func (r TraceRecord) String() string {
+
+	var value string
+	if r.Undefined {
+		value = "undefined"
+	} else if b, err := json.Marshal(jtypes.PlainDecimals(r.Value)); err == nil {
+		value = string(b)
+	} else {
+		value = fmt.Sprint(r.Value)
+	}
+
+	if r.Label == "" {
+		return value
+	}
+
+	return r.Label + ": " + value
+}
+
+// SetTraceSink sets the function that receives the values
+// passed to the $trace function. $trace takes a value and an
+// optional label, e.g.
+//
+//	Order[Price > 10] ~> $trace("after filter") ~> $count()
+//
+// and returns the value unchanged, so it can be added to an
+// expression for debugging without changing the result. By
+// default, and if fn is nil, $trace discards its arguments.
+//
+// An undefined value is passed to fn as a TraceRecord with
+// Undefined set to true and is returned as undefined, so an
+// expression that ends in a call to $trace still returns
+// ErrUndefined. Optimize never evaluates calls to $trace.
+//
+// Like SetTrace, fn is shared with clones of the Expr that
+// have not set their own sink. To route each request's records
+// to a different place, Clone the Expr and call SetTraceSink
+// on the clone.
+func (e *Expr) SetTraceSink(fn func(TraceRecord)) {
+
+	if fn == nil {
+		e.traceSink = reflect.Value{}
+		return
+	}
+
+	e.traceSink = reflect.ValueOf(&traceCallable{
+		callableName: callableName{
+			name: "trace",
+		},
+		sink: fn,
+	})
+}
+
+// discardTrace is the $trace function of an Expr that has no
+// trace sink.
+var discardTrace = reflect.ValueOf(&traceCallable{
+	callableName: callableName{
+		name: "trace",
+	},
+})
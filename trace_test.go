@@ -0,0 +1,321 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jsonata
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/blues/jsonata-go/jparse"
+)
+
+func TestTrace(t *testing.T) {
+
+	var events []TraceEvent
+	e := MustCompile(`a.b + 1`)
+	e.SetTrace(func(ev TraceEvent) {
+		events = append(events, ev)
+	})
+
+	output, err := e.Eval(map[string]interface{}{
+		"a": map[string]interface{}{
+			"b": 2.0,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != 3.0 {
+		t.Errorf("expected 3, got %v", output)
+	}
+
+	var got []string
+	for _, ev := range events {
+		got = append(got, fmt.Sprintf("%d %T %v", ev.Depth, ev.Node, ev.Output))
+	}
+
+	exp := []string{
+		`2 *jparse.NameNode map[b:2]`,
+		`2 *jparse.NameNode 2`,
+		`1 *jparse.PathNode 2`,
+		`1 *jparse.NumberNode 1`,
+		`0 *jparse.NumericOperatorNode 3`,
+	}
+
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected events:\n%s\ngot:\n%s", strings.Join(exp, "\n"), strings.Join(got, "\n"))
+	}
+
+	if s := events[1].Input; s != `{"b":2}` {
+		t.Errorf("expected input {\"b\":2}, got %s", s)
+	}
+
+	// Tracing is per Expr and is turned off by a nil function.
+	events = nil
+	e.SetTrace(nil)
+	if _, err := e.Eval(nil); err != ErrUndefined {
+		t.Errorf("expected ErrUndefined, got %v", err)
+	}
+	if len(events) != 0 {
+		t.Errorf("expected no events, got %d", len(events))
+	}
+
+	// Paths with a positional binding are evaluated item by
+	// item. The steps are traced for each item, including the
+	// references to the binding.
+	events = nil
+	e = MustCompile(`a#$i.(b + $i)`)
+	e.SetTrace(func(ev TraceEvent) {
+		events = append(events, ev)
+	})
+
+	output, err = e.Eval(map[string]interface{}{
+		"a": []interface{}{
+			map[string]interface{}{"b": 1.0},
+			map[string]interface{}{"b": 2.0},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(output, []interface{}{1.0, 3.0}) {
+		t.Errorf("expected [1, 3], got %v", output)
+	}
+
+	got = nil
+	for _, ev := range events {
+		got = append(got, fmt.Sprintf("%d %T %v", ev.Depth, ev.Node, ev.Output))
+	}
+
+	exp = []string{
+		`1 *jparse.NameNode [map[b:1] map[b:2]]`,
+		`4 *jparse.NameNode 1`,
+		`3 *jparse.PathNode 1`,
+		`3 *jparse.VariableNode 0`,
+		`2 *jparse.NumericOperatorNode 1`,
+		`1 *jparse.BlockNode 1`,
+		`4 *jparse.NameNode 2`,
+		`3 *jparse.PathNode 2`,
+		`3 *jparse.VariableNode 1`,
+		`2 *jparse.NumericOperatorNode 3`,
+		`1 *jparse.BlockNode 3`,
+		`0 *jparse.PathNode [1 3]`,
+	}
+
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected events:\n%s\ngot:\n%s", strings.Join(exp, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestTraceError(t *testing.T) {
+
+	var last TraceEvent
+	e := MustCompile(`1 + $foo()`)
+	e.SetTrace(func(ev TraceEvent) {
+		last = ev
+	})
+
+	_, err := e.Eval(nil)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if last.Err != err || last.Output != nil || last.Depth != 0 {
+		t.Errorf("expected the root node to report %v, got %+v", err, last)
+	}
+}
+
+func TestTraceToWriter(t *testing.T) {
+
+	var buf bytes.Buffer
+	e := MustCompile(`$count(items)`)
+	e.SetTrace(TraceToWriter(&buf))
+
+	_, err := e.Eval(map[string]interface{}{
+		"items": []interface{}{
+			strings.Repeat("x", 200),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x := strings.Repeat("x", maxTraceSummary-11)
+	exp := `  VariableNode $count @0: {"items":["` + x + `... => function
+    NameNode items @7: {"items":["` + x + `... => ["` + x + `xxxxxxxxx...
+  PathNode items @7: {"items":["` + x + `... => ["` + x + `xxxxxxxxx...
+FunctionCallNode $count(items) @0: {"items":["` + x + `... => 1
+`
+
+	if got := buf.String(); got != exp {
+		t.Errorf("expected trace:\n%s\ngot:\n%s", exp, got)
+	}
+}
+
+// collectTrace sets a trace sink on e that appends the records
+// passed to $trace to the returned slice.
+func collectTrace(e *Expr) *[]TraceRecord {
+	var records []TraceRecord
+	e.SetTraceSink(func(r TraceRecord) {
+		records = append(records, r)
+	})
+	return &records
+}
+
+func TestTraceFunc(t *testing.T) {
+
+	data := map[string]interface{}{
+		"Order": []interface{}{
+			map[string]interface{}{"id": 1.0, "Price": 5.0},
+			map[string]interface{}{"id": 2.0, "Price": 15.0},
+			map[string]interface{}{"id": 3.0, "Price": 25.0},
+		},
+	}
+
+	tests := []struct {
+		Expression string
+		Output     interface{}
+		Error      error
+		Records    []string
+	}{
+		{
+			Expression: `Order[Price > 10] ~> $trace("after filter") ~> $count()`,
+			Output:     2,
+			Records: []string{
+				`after filter: [{"Price":15,"id":2},{"Price":25,"id":3}]`,
+			},
+		},
+		{
+			Expression: `$sum(Order.$trace(Price))`,
+			Output:     45.0,
+			Records: []string{
+				`5`,
+				`15`,
+				`25`,
+			},
+		},
+		{
+			Expression: `$trace(null, "null")`,
+			Output:     nil,
+			Records: []string{
+				`null: null`,
+			},
+		},
+		{
+			Expression: `Missing ~> $trace("missing")`,
+			Error:      ErrUndefined,
+			Records: []string{
+				`missing: undefined`,
+			},
+		},
+		{
+			Expression: `$trace(1, 2)`,
+			Error:      fmt.Errorf(`argument 2 of function "trace" does not match function signature`),
+		},
+		{
+			Expression: `$trace(1, "a", "b")`,
+			Error:      fmt.Errorf(`function "trace" takes 2 argument(s), got 3`),
+		},
+	}
+
+	for _, test := range tests {
+
+		e := MustCompile(test.Expression)
+		records := collectTrace(e)
+
+		output, err := e.Eval(data)
+		if fmt.Sprint(err) != fmt.Sprint(test.Error) {
+			t.Errorf("%s: expected error %v, got %v", test.Expression, test.Error, err)
+		}
+		if !reflect.DeepEqual(output, test.Output) {
+			t.Errorf("%s: expected %v, got %v", test.Expression, test.Output, output)
+		}
+
+		var got []string
+		for _, r := range *records {
+			got = append(got, r.String())
+		}
+		if !reflect.DeepEqual(got, test.Records) {
+			t.Errorf("%s: expected records %q, got %q", test.Expression, test.Records, got)
+		}
+	}
+}
+
+func TestTraceSink(t *testing.T) {
+
+	e := MustCompile(`$trace(1) + 1`)
+
+	// Without a sink, $trace discards its arguments.
+	output, err := e.Eval(nil)
+	if err != nil || output != 2.0 {
+		t.Errorf("expected 2, got %v (error %v)", output, err)
+	}
+
+	// Each clone has its own sink.
+	c1, c2 := e.Clone(), e.Clone()
+	r1, r2 := collectTrace(c1), collectTrace(c2)
+
+	for _, c := range []*Expr{c1, c2, c1} {
+		if _, err := c.Eval(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(*r1) != 2 || len(*r2) != 1 {
+		t.Errorf("expected 2 and 1 records, got %d and %d", len(*r1), len(*r2))
+	}
+
+	// Optimize does not fold calls to $trace.
+	e = MustCompile(`$trace(1 + 2)`)
+	records := collectTrace(e)
+	e.Optimize()
+
+	for i := 0; i < 2; i++ {
+		if _, err := e.Eval(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(*records) != 2 || (*records)[0].Value != 3.0 {
+		t.Errorf("expected 2 records of 3, got %v", *records)
+	}
+}
+
+func TestTraceTailCalls(t *testing.T) {
+
+	// Tail calls are traced like other function calls.
+	var calls []string
+	e := MustCompile(`(
+		$count := function($n, $acc) { $n = 0 ? $acc : $count($n-1, $acc+1) };
+		$count(3, 0)
+	)`)
+	e.SetTrace(func(ev TraceEvent) {
+		if _, ok := ev.Node.(*jparse.FunctionCallNode); ok {
+			calls = append(calls, fmt.Sprintf("%d %s => %v", ev.Depth, ev.Node, ev.Output))
+		}
+	})
+
+	output, err := e.Eval(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != 3.0 {
+		t.Errorf("expected 3, got %v", output)
+	}
+
+	exp := []string{
+		`7 $count($n - 1, $acc + 1) => 3`,
+		`5 $count($n - 1, $acc + 1) => 3`,
+		`3 $count($n - 1, $acc + 1) => 3`,
+		`1 $count(3, 0) => 3`,
+	}
+
+	if !reflect.DeepEqual(calls, exp) {
+		t.Errorf("expected calls:\n%s\ngot:\n%s", strings.Join(exp, "\n"), strings.Join(calls, "\n"))
+	}
+}
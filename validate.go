@@ -0,0 +1,396 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jsonata
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/blues/jsonata-go/jparse"
+	"github.com/blues/jsonata-go/jtypes"
+)
+
+// Severity describes how serious a Diagnostic is.
+type Severity int
+
+const (
+	// SeverityError means that the expression cannot be
+	// compiled, or that evaluating it will fail.
+	SeverityError Severity = iota
+
+	// SeverityWarning means that evaluating the expression
+	// may fail, e.g. because it calls a function that is not
+	// known to Validate but may be supplied at evaluation time.
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	default:
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+}
+
+// A Diagnostic describes a problem with an expression found
+// by Validate.
+type Diagnostic struct {
+	Severity Severity
+
+	// Code is the jsonata-js error code for the problem, e.g.
+	// "S0202" or "T0410". It is empty if jsonata-js has no
+	// equivalent error.
+	Code string
+
+	// Message describes the problem.
+	Message string
+
+	// Token is the part of the expression that caused the
+	// problem, e.g. an unexpected token or the name of a
+	// function. It may be empty, e.g. at the end of the
+	// expression.
+	Token string
+
+	// Hint is a suggestion for fixing the problem. It may be
+	// empty.
+	Hint string
+
+	// Position and EndPosition are the byte offsets of the
+	// start and end of the problem in the expression.
+	Position    int
+	EndPosition int
+
+	// Line and Column give the location of Position. Both
+	// start from 1. Columns are counted in characters (i.e.
+	// Unicode code points), not bytes.
+	Line   int
+	Column int
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%d:%d: %s: %s", d.Line, d.Column, d.Severity, d.Message)
+}
+
+// A ValidateOption provides Validate with information about
+// the environment in which an expression will be evaluated.
+type ValidateOption func(*validateConfig)
+
+type validateConfig struct {
+	exts map[string]Extension
+	vars map[string]bool
+}
+
+// ValidateExts tells Validate about custom functions that
+// will be registered with the Expr, e.g. with CompileWithExts.
+// Custom functions registered at the package level are always
+// known to Validate.
+func ValidateExts(exts map[string]Extension) ValidateOption {
+	return func(c *validateConfig) {
+		for name, ext := range exts {
+			if c.exts == nil {
+				c.exts = map[string]Extension{}
+			}
+			c.exts[name] = ext
+		}
+	}
+}
+
+// ValidateVars tells Validate about variables that will be
+// available when the expression is evaluated, e.g. variables
+// passed to EvalWithVars. The names do not include the
+// leading $.
+func ValidateVars(names ...string) ValidateOption {
+	return func(c *validateConfig) {
+		for _, name := range names {
+			if c.vars == nil {
+				c.vars = map[string]bool{}
+			}
+			c.vars[name] = true
+		}
+	}
+}
+
+// Validate checks an expression without evaluating it and
+// returns a Diagnostic for each problem that it finds. It
+// returns nil if the expression has no problems.
+//
+// If the expression cannot be parsed, Validate returns a
+// single Diagnostic that describes the parse error. Otherwise
+// it looks for calls to functions that are not defined and
+// calls to built-in and custom functions with the wrong number
+// of arguments. Calls to undefined functions are reported as
+// warnings because the functions may be supplied at evaluation
+// time (see ValidateExts and ValidateVars). Calls to functions
+// whose names are bound by the expression itself, e.g. by
+// assignment, are not checked.
+func Validate(expr string, opts ...ValidateOption) []Diagnostic {
+
+	var config validateConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	e, err := Compile(expr)
+	if err != nil {
+		return []Diagnostic{newParseDiagnostic(expr, err)}
+	}
+
+	// Add the custom functions individually so that an
+	// invalid one doesn't hide the others.
+	for name, ext := range config.exts {
+		e.RegisterExts(map[string]Extension{
+			name: ext,
+		})
+	}
+
+	v := &validator{
+		expr:     expr,
+		env:      e.newEnv(undefined, nil),
+		vars:     config.vars,
+		shadowed: boundNames(e.node),
+		applied:  map[*jparse.FunctionCallNode]bool{},
+	}
+
+	jparse.Walk(e.node, v.visit)
+
+	sort.SliceStable(v.diags, func(i, j int) bool {
+		return v.diags[i].Position < v.diags[j].Position
+	})
+
+	return v.diags
+}
+
+func newParseDiagnostic(expr string, err error) Diagnostic {
+
+	var perr *jparse.Error
+	if !errors.As(err, &perr) {
+		return newDiagnostic(expr, SeverityError, "", err.Error(), "", "", 0, len(expr))
+	}
+
+	return newDiagnostic(expr, SeverityError, perr.Code(), perr.Error(), perr.Token, perr.Hint, perr.Position, perr.Position+len(perr.Token))
+}
+
+func newDiagnostic(expr string, severity Severity, code, msg, token, hint string, start, end int) Diagnostic {
+
+	start = clamp(start, 0, len(expr))
+	end = clamp(end, start, len(expr))
+
+	line := 1 + strings.Count(expr[:start], "\n")
+	col := 1 + utf8.RuneCountInString(expr[strings.LastIndexByte(expr[:start], '\n')+1:start])
+
+	return Diagnostic{
+		Severity:    severity,
+		Code:        code,
+		Message:     msg,
+		Token:       token,
+		Hint:        hint,
+		Position:    start,
+		EndPosition: end,
+		Line:        line,
+		Column:      col,
+	}
+}
+
+func clamp(n, min, max int) int {
+	switch {
+	case n < min:
+		return min
+	case n > max:
+		return max
+	default:
+		return n
+	}
+}
+
+// An argCounter is a built-in or custom function that knows
+// how many arguments it accepts. Validate checks the number of
+// arguments in calls to argCounters.
+type argCounter interface {
+	argCountRange() (int, int)
+}
+
+// A validator performs the static checks for Validate.
+type validator struct {
+	expr     string
+	env      *environment
+	vars     map[string]bool
+	shadowed map[string]bool
+
+	// applied holds the function calls on the right hand
+	// side of the ~> operator, which receive an extra
+	// argument.
+	applied map[*jparse.FunctionCallNode]bool
+
+	diags []Diagnostic
+}
+
+func (v *validator) visit(node jparse.Node) bool {
+
+	switch node := node.(type) {
+	case *jparse.FunctionApplicationNode:
+		if call, ok := node.RHS.(*jparse.FunctionCallNode); ok {
+			v.applied[call] = true
+		}
+	case *jparse.FunctionCallNode:
+		argc := len(node.Args)
+		if v.applied[node] {
+			argc++
+		}
+		v.checkCall(node.Func, argc, node.Position)
+	case *jparse.PartialNode:
+		v.checkCall(node.Func, len(node.Args), node.Position)
+	}
+
+	return true
+}
+
+// checkCall checks a call to the function fn with argc
+// arguments. pos is the byte offset of the opening parenthesis
+// of the argument list.
+func (v *validator) checkCall(fn jparse.Node, argc int, pos int) {
+
+	sym, ok := fn.(*jparse.VariableNode)
+	if !ok || sym.Name == "" || sym.Name == "$" || v.shadowed[sym.Name] || v.vars[sym.Name] {
+		return
+	}
+
+	token := "$" + sym.Name
+	start, end := v.locate(token, pos)
+
+	value := v.env.lookup(sym.Name)
+	if value == undefined {
+		v.diags = append(v.diags, newDiagnostic(v.expr, SeverityWarning, errcodes[ErrNonCallable],
+			fmt.Sprintf("unknown function %s", token), token, v.suggest(sym.Name), start, end))
+		return
+	}
+
+	c, ok := jtypes.AsCallable(value)
+	if !ok {
+		return
+	}
+
+	ac, ok := c.(argCounter)
+	if !ok {
+		return
+	}
+
+	min, max := ac.argCountRange()
+	if argc >= min && (max < 0 || argc <= max) {
+		return
+	}
+
+	v.diags = append(v.diags, newDiagnostic(v.expr, SeverityError, ArgCountError{}.Code(),
+		fmt.Sprintf("function %s takes %s, got %d", token, describeArgCount(min, max), argc),
+		token, "", start, end))
+}
+
+// locate returns the start and end of a function name in the
+// expression. The name is expected to precede the opening
+// parenthesis at pos, optionally followed by whitespace. If
+// it does not, locate returns the position of the parenthesis.
+func (v *validator) locate(token string, pos int) (int, int) {
+
+	pos = clamp(pos, 0, len(v.expr))
+
+	end := len(strings.TrimRightFunc(v.expr[:pos], unicode.IsSpace))
+	if strings.HasSuffix(v.expr[:end], token) {
+		return end - len(token), end
+	}
+
+	return pos, pos + 1
+}
+
+// suggest returns a hint naming a known function whose name
+// is similar to name, or an empty string if there isn't one.
+func (v *validator) suggest(name string) string {
+
+	// Allow one edit for every three characters, up to a
+	// maximum of two.
+	limit := 1 + utf8.RuneCountInString(name)/3
+	if limit > 3 {
+		limit = 3
+	}
+
+	best := ""
+	bestDist := limit
+
+	for env := v.env; env != nil; env = env.parent {
+		env.each(func(candidate string, value reflect.Value) {
+			if _, ok := jtypes.AsCallable(value); !ok {
+				return
+			}
+			d := editDistance(strings.ToLower(name), strings.ToLower(candidate))
+			if d < bestDist || (d == bestDist && candidate < best) {
+				best, bestDist = candidate, d
+			}
+		})
+	}
+
+	if best == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("did you mean $%s?", best)
+}
+
+// describeArgCount describes a range of argument counts, e.g.
+// "2 or 3 arguments". A max of -1 means no upper limit.
+func describeArgCount(min, max int) string {
+	switch {
+	case max < 0:
+		return fmt.Sprintf("at least %d argument(s)", min)
+	case min == max:
+		return fmt.Sprintf("%d argument(s)", min)
+	case min+1 == max:
+		return fmt.Sprintf("%d or %d arguments", min, max)
+	default:
+		return fmt.Sprintf("%d to %d arguments", min, max)
+	}
+}
+
+// editDistance returns the Levenshtein distance between two
+// strings.
+func editDistance(s, t string) int {
+
+	r1, r2 := []rune(s), []rune(t)
+
+	prev := make([]int, len(r2)+1)
+	curr := make([]int, len(r2)+1)
+
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(r1); i++ {
+		curr[0] = i
+		for j := 1; j <= len(r2); j++ {
+			cost := 1
+			if r1[i-1] == r2[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+
+	return prev[len(r2)]
+}
+
+func minInt(n int, ns ...int) int {
+	for _, m := range ns {
+		if m < n {
+			n = m
+		}
+	}
+	return n
+}
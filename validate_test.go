@@ -0,0 +1,257 @@
+// Copyright 2018 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package jsonata
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+
+	exts := map[string]Extension{
+		"greet": {
+			Func: func(name string) string {
+				return "hello " + name
+			},
+		},
+	}
+
+	tests := []struct {
+		Expression  string
+		Options     []ValidateOption
+		Diagnostics []Diagnostic
+	}{
+		{
+			Expression: `$uppercase(name) & $eval("1") & $millis() & $now()`,
+		},
+		{
+			// Parse errors report the line and column.
+			Expression: "(\n  $x := 1;\n  $x +\n)",
+			Diagnostics: []Diagnostic{
+				{
+					Severity:    SeverityError,
+					Code:        "S0211",
+					Message:     "the symbol ')' cannot be used as a prefix operator",
+					Token:       ")",
+					Position:    20,
+					EndPosition: 21,
+					Line:        4,
+					Column:      1,
+				},
+			},
+		},
+		{
+			Expression: `Account.Order[`,
+			Diagnostics: []Diagnostic{
+				{
+					Severity:    SeverityError,
+					Code:        "S0207",
+					Message:     "unexpected end of expression",
+					Position:    14,
+					EndPosition: 14,
+					Line:        1,
+					Column:      15,
+				},
+			},
+		},
+		{
+			// Unknown functions are warnings. Columns count
+			// characters, not bytes.
+			Expression: `"éé" & $lenght ("x") & $bar()`,
+			Diagnostics: []Diagnostic{
+				{
+					Severity:    SeverityWarning,
+					Code:        "T1006",
+					Message:     "unknown function $lenght",
+					Token:       "$lenght",
+					Hint:        "did you mean $length?",
+					Position:    9,
+					EndPosition: 16,
+					Line:        1,
+					Column:      8,
+				},
+				{
+					Severity:    SeverityWarning,
+					Code:        "T1006",
+					Message:     "unknown function $bar",
+					Token:       "$bar",
+					Position:    25,
+					EndPosition: 29,
+					Line:        1,
+					Column:      24,
+				},
+			},
+		},
+		{
+			Expression: "[$substring(),\n $substring(?, 1, 2, 3)]",
+			Diagnostics: []Diagnostic{
+				{
+					Severity:    SeverityError,
+					Code:        "T0410",
+					Message:     "function $substring takes 1 to 3 arguments, got 0",
+					Token:       "$substring",
+					Position:    1,
+					EndPosition: 11,
+					Line:        1,
+					Column:      2,
+				},
+				{
+					Severity:    SeverityError,
+					Code:        "T0410",
+					Message:     "function $substring takes 1 to 3 arguments, got 4",
+					Token:       "$substring",
+					Position:    16,
+					EndPosition: 26,
+					Line:        2,
+					Column:      2,
+				},
+			},
+		},
+		{
+			// The ~> operator adds an argument.
+			Expression: `[1] ~> $map($string) ~> $count()`,
+		},
+		{
+			Expression: `"abc" ~> $substring(1, 1, 1)`,
+			Diagnostics: []Diagnostic{
+				{
+					Severity:    SeverityError,
+					Code:        "T0410",
+					Message:     "function $substring takes 1 to 3 arguments, got 4",
+					Token:       "$substring",
+					Position:    9,
+					EndPosition: 19,
+					Line:        1,
+					Column:      10,
+				},
+			},
+		},
+		{
+			Expression: `$zip()`,
+			Diagnostics: []Diagnostic{
+				{
+					Severity:    SeverityError,
+					Code:        "T0410",
+					Message:     "function $zip takes at least 1 argument(s), got 0",
+					Token:       "$zip",
+					Position:    0,
+					EndPosition: 4,
+					Line:        1,
+					Column:      1,
+				},
+			},
+		},
+		{
+			// So are calls to functions that take no arguments,
+			// or that are bound for each evaluation.
+			Expression: `$random(1) + $millis(2) & $now(1, 2, 3) & $eval()`,
+			Diagnostics: []Diagnostic{
+				{
+					Severity:    SeverityError,
+					Code:        "T0410",
+					Message:     "function $random takes 0 argument(s), got 1",
+					Token:       "$random",
+					Position:    0,
+					EndPosition: 7,
+					Line:        1,
+					Column:      1,
+				},
+				{
+					Severity:    SeverityError,
+					Code:        "T0410",
+					Message:     "function $millis takes 0 argument(s), got 1",
+					Token:       "$millis",
+					Position:    13,
+					EndPosition: 20,
+					Line:        1,
+					Column:      14,
+				},
+				{
+					Severity:    SeverityError,
+					Code:        "T0410",
+					Message:     "function $now takes 0 to 2 arguments, got 3",
+					Token:       "$now",
+					Position:    26,
+					EndPosition: 30,
+					Line:        1,
+					Column:      27,
+				},
+				{
+					Severity:    SeverityError,
+					Code:        "T0410",
+					Message:     "function $eval takes 1 or 2 arguments, got 0",
+					Token:       "$eval",
+					Position:    42,
+					EndPosition: 47,
+					Line:        1,
+					Column:      43,
+				},
+			},
+		},
+		{
+			// Functions bound by the expression are not checked.
+			Expression: `($count := function($x, $y) { $x + $y }; $f := λ($g) { $g() }; $count(1, 2) + $f($count))`,
+		},
+		{
+			// Including functions bound by parameter patterns.
+			Expression: `λ([$f, {"g": $g}]) { $f() & $g() }`,
+		},
+		{
+			Expression: `$greet("world")`,
+			Diagnostics: []Diagnostic{
+				{
+					Severity:    SeverityWarning,
+					Code:        "T1006",
+					Message:     "unknown function $greet",
+					Token:       "$greet",
+					Position:    0,
+					EndPosition: 6,
+					Line:        1,
+					Column:      1,
+				},
+			},
+		},
+		{
+			Expression: `$greet("world")`,
+			Options: []ValidateOption{
+				ValidateExts(exts),
+			},
+		},
+		{
+			Expression: `$greet()`,
+			Options: []ValidateOption{
+				ValidateExts(exts),
+			},
+			Diagnostics: []Diagnostic{
+				{
+					Severity:    SeverityError,
+					Code:        "T0410",
+					Message:     "function $greet takes 1 argument(s), got 0",
+					Token:       "$greet",
+					Position:    0,
+					EndPosition: 6,
+					Line:        1,
+					Column:      1,
+				},
+			},
+		},
+		{
+			Expression: `$fetch(id)`,
+			Options: []ValidateOption{
+				ValidateVars("fetch"),
+			},
+		},
+	}
+
+	for _, test := range tests {
+
+		diags := Validate(test.Expression, test.Options...)
+
+		if !reflect.DeepEqual(diags, test.Diagnostics) {
+			t.Errorf("%s: expected diagnostics %#v, got %#v", test.Expression, test.Diagnostics, diags)
+		}
+	}
+}